@@ -13,10 +13,12 @@ import (
 	"fmt"
 	"io"
 	"strings"
+	"sync"
 )
 
 type Reader struct {
-	r         *bufio.Reader
+	r         *bufio.Reader // nil once released
+	done      error         // error that released r
 	meta      []MetaField
 	metaRead  bool
 	peekLine  string
@@ -25,6 +27,16 @@ type Reader struct {
 	sourceLen int
 }
 
+// bufReaders recycles the buffers of readers, which are released once a
+// link dump has been read to the end.
+var bufReaders = sync.Pool{New: func() interface{} { return bufio.NewReaderSize(nil, 64<<10) }}
+
+func newBufReader(r io.Reader) *bufio.Reader {
+	br := bufReaders.Get().(*bufio.Reader)
+	br.Reset(r)
+	return br
+}
+
 type MetaField struct {
 	Name, Value string
 }
@@ -49,13 +61,13 @@ const (
 // NewReader constructs a reader that reads RFC-format BEACON link
 // dumps.
 func NewReader(r io.Reader) *Reader {
-	return &Reader{r: bufio.NewReader(r)}
+	return &Reader{r: newBufReader(r)}
 }
 
 // NewURLTeamReader constructs a reader that reads URLTeam-format BEACON
 // link dumps. Links always omit the annotation field.
 func NewURLTeamReader(r io.Reader, shortcodeLen int) *Reader {
-	return &Reader{r: bufio.NewReader(r), format: URLTeam, sourceLen: shortcodeLen}
+	return &Reader{r: newBufReader(r), format: URLTeam, sourceLen: shortcodeLen}
 }
 
 // Meta returns the meta fields in the header.
@@ -186,7 +198,7 @@ func (r *Reader) readLinkURLTeam() (*Link, error) {
 		if i == -1 {
 			return nil, fmt.Errorf("link line missing bar separator: %q", line)
 		}
-		return &Link{line[:i], dropLineBreak(line[i:]), ""}, nil
+		return &Link{line[:i], dropLineBreak(line[i+1:]), ""}, nil
 	}
 
 	// Fixed shortcode length
@@ -228,14 +240,26 @@ func (r *Reader) readLineRaw() (string, error) {
 		r.peekLine = ""
 		return l, nil
 	}
+	if r.r == nil {
+		return "", r.done
+	}
 	r.line++
 	line, err := r.r.ReadString('\n')
 	if err != nil && !(err == io.EOF && line != "") {
+		r.release(err)
 		return "", err
 	}
 	return line, nil
 }
 
+// release returns the buffer to bufReaders, after which reads return
+// err.
+func (r *Reader) release(err error) {
+	r.r.Reset(nil)
+	bufReaders.Put(r.r)
+	r.r, r.done = nil, err
+}
+
 func (r *Reader) err(err error) error {
 	if err == io.EOF || err == nil {
 		return err
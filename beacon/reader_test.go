@@ -6,7 +6,13 @@
 
 package beacon
 
-import "testing"
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/andrewarchi/urlhero/benchdata"
+)
 
 func TestSplitMeta(t *testing.T) {
 	tests := []struct {
@@ -35,3 +41,71 @@ func TestSplitMeta(t *testing.T) {
 		}
 	}
 }
+
+func TestWriter(t *testing.T) {
+	meta := []MetaField{{"FORMAT", "BEACON"}, {"PREFIX", "https://bit.ly/"}}
+	links := []Link{
+		{"abc", "http://example.com/", ""},
+		{"abd", "http://example.com/?a|b", ""},
+	}
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	if err := w.WriteMeta(meta); err != nil {
+		t.Fatal(err)
+	}
+	for i := range links {
+		if err := w.Write(&links[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Write(&Link{"abe", "http://example.com/\n", ""}); err == nil {
+		t.Error("link with line break accepted")
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	want := "#FORMAT: BEACON\n#PREFIX: https://bit.ly/\n\nabc|http://example.com/\nabd|http://example.com/?a|b\n"
+	if got := buf.String(); got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+
+	r := NewURLTeamReader(&buf, 0)
+	gotMeta, err := r.Meta()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(gotMeta) != len(meta) || gotMeta[0] != meta[0] || gotMeta[1] != meta[1] {
+		t.Errorf("got meta %v, want %v", gotMeta, meta)
+	}
+	for i := 0; ; i++ {
+		link, err := r.Read()
+		if err == io.EOF {
+			if i != len(links) {
+				t.Errorf("read %d links, want %d", i, len(links))
+			}
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i >= len(links) || *link != links[i] {
+			t.Errorf("link %d: got %v", i, link)
+		}
+	}
+}
+
+func BenchmarkURLTeamReader(b *testing.B) {
+	dump := benchdata.LinkDump(100000, 6)
+	b.SetBytes(int64(len(dump)))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		br := NewURLTeamReader(bytes.NewReader(dump), 6)
+		for {
+			if _, err := br.Read(); err == io.EOF {
+				break
+			} else if err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
@@ -0,0 +1,84 @@
+// Copyright (c) 2021 Andrew Archibald
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package beacon
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Writer writes URLTeam-format BEACON link dumps.
+type Writer struct {
+	w         *bufio.Writer
+	metaWrote bool
+}
+
+// NewWriter constructs a writer that writes URLTeam-format BEACON link
+// dumps.
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w: bufio.NewWriter(w)}
+}
+
+// WriteMeta writes the meta fields of the header, followed by a blank
+// line. It must be called at most once, before any links are written.
+func (w *Writer) WriteMeta(meta []MetaField) error {
+	if w.metaWrote {
+		return fmt.Errorf("beacon: meta already written")
+	}
+	w.metaWrote = true
+	for _, m := range meta {
+		if !validMetaName(m.Name) || strings.ContainsAny(m.Value, "\r\n") {
+			return fmt.Errorf("beacon: invalid meta field: %q", m.String())
+		}
+		if _, err := fmt.Fprintf(w.w, "%s\n", m); err != nil {
+			return err
+		}
+	}
+	_, err := w.w.WriteString("\n")
+	return err
+}
+
+// Write writes a link as SOURCE|TARGET. Links with line breaks or
+// annotations cannot be represented and are rejected.
+func (w *Writer) Write(link *Link) error {
+	w.metaWrote = true
+	if link.Annotation != "" {
+		return fmt.Errorf("beacon: annotation not supported: %q", link.String())
+	}
+	if strings.ContainsAny(link.Source, "|\r\n") || strings.ContainsAny(link.Target, "\r\n") {
+		return fmt.Errorf("beacon: invalid link: %q", link.String())
+	}
+	if _, err := w.w.WriteString(link.Source); err != nil {
+		return err
+	}
+	if err := w.w.WriteByte('|'); err != nil {
+		return err
+	}
+	if _, err := w.w.WriteString(link.Target); err != nil {
+		return err
+	}
+	return w.w.WriteByte('\n')
+}
+
+// Flush writes any buffered data to the underlying writer.
+func (w *Writer) Flush() error {
+	return w.w.Flush()
+}
+
+func validMetaName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, ch := range name {
+		if ch < 'A' || ch > 'Z' {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,143 @@
+// Copyright (c) 2021 Andrew Archibald
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package benchdata generates the synthetic datasets of benchmarks.
+// Datasets are generated from a fixed seed, so that results are
+// comparable across commits; changing a generator invalidates earlier
+// results.
+package benchdata
+
+import (
+	"bytes"
+	"math/rand"
+	"sort"
+	"strconv"
+)
+
+// Seed seeds every generator.
+const Seed = 20210101
+
+// Alphabet is the alphabet of generated shortcodes, which is the most
+// common alphabet of terroroftinytown projects.
+const Alphabet = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+// Shortcodes returns n distinct shortcodes of the given length in random
+// order. The length must be long enough for n shortcodes.
+func Shortcodes(n, length int) []string {
+	rng := rand.New(rand.NewSource(Seed))
+	seen := make(map[string]struct{}, n)
+	codes := make([]string, 0, n)
+	b := make([]byte, length)
+	for len(codes) < n {
+		for i := range b {
+			b[i] = Alphabet[rng.Intn(len(Alphabet))]
+		}
+		if _, ok := seen[string(b)]; ok {
+			continue
+		}
+		code := string(b)
+		seen[code] = struct{}{}
+		codes = append(codes, code)
+	}
+	return codes
+}
+
+// SortedShortcodes returns the shortcodes of Shortcodes in increasing
+// order.
+func SortedShortcodes(n, length int) []string {
+	codes := Shortcodes(n, length)
+	sort.Strings(codes)
+	return codes
+}
+
+var (
+	targetHosts = []string{
+		"www.youtube.com", "twitter.com", "www.facebook.com", "en.wikipedia.org",
+		"www.nytimes.com", "github.com", "www.amazon.com", "example.org",
+	}
+	targetWords = []string{
+		"watch", "status", "article", "wiki", "news", "2014", "index.html",
+		"products", "story", "p", "id", "view", "search", "blog",
+	}
+)
+
+// Target returns a random target URL, which resembles those of short
+// URLs.
+func Target(rng *rand.Rand) string {
+	b := []byte("http://")
+	if rng.Intn(2) == 0 {
+		b = []byte("https://")
+	}
+	b = append(b, targetHosts[rng.Intn(len(targetHosts))]...)
+	for n := rng.Intn(4) + 1; n > 0; n-- {
+		b = append(b, '/')
+		b = append(b, targetWords[rng.Intn(len(targetWords))]...)
+	}
+	if rng.Intn(3) == 0 {
+		b = append(b, "?v="...)
+		b = strconv.AppendInt(b, rng.Int63n(1<<40), 36)
+	}
+	if rng.Intn(10) == 0 {
+		b = append(b, "&utm_source=twitter&utm_medium=social"...)
+	}
+	return string(b)
+}
+
+// Link is a mapping from a shortcode to its target. It is separate from
+// the link and record types of other packages, so that their tests can
+// import benchdata.
+type Link struct {
+	Shortcode, Target string
+}
+
+// Links returns n links with distinct shortcodes of the given length in
+// random order.
+func Links(n, shortcodeLen int) []Link {
+	codes := Shortcodes(n, shortcodeLen)
+	rng := rand.New(rand.NewSource(Seed + 1))
+	links := make([]Link, n)
+	for i, code := range codes {
+		links[i] = Link{code, Target(rng)}
+	}
+	return links
+}
+
+// LinkDump returns a URLTeam-format link dump of Links.
+func LinkDump(n, shortcodeLen int) []byte {
+	var b bytes.Buffer
+	for _, l := range Links(n, shortcodeLen) {
+		b.WriteString(l.Shortcode)
+		b.WriteByte('|')
+		b.WriteString(l.Target)
+		b.WriteByte('\n')
+	}
+	return b.Bytes()
+}
+
+// ShortURLs returns n short URLs of a host with 4-character shortcodes,
+// like those archived by the Internet Archive: a third are duplicates, a
+// tenth have a port and trailing junk, and a tenth have a query.
+func ShortURLs(host string, n int) []string {
+	codes := Shortcodes(n-n/3, 4)
+	rng := rand.New(rand.NewSource(Seed + 2))
+	urls := make([]string, n)
+	for i := range urls {
+		code := codes[rng.Intn(len(codes))]
+		if i < len(codes) {
+			code = codes[i]
+		}
+		switch rng.Intn(10) {
+		case 0:
+			urls[i] = "http://" + host + ":80/" + code + "..."
+		case 1:
+			urls[i] = "https://" + host + "/" + code + "?utm_source=x"
+		default:
+			urls[i] = "http://" + host + "/" + code
+		}
+	}
+	rng.Shuffle(len(urls), func(i, j int) { urls[i], urls[j] = urls[j], urls[i] })
+	return urls
+}
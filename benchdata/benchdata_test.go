@@ -0,0 +1,60 @@
+// Copyright (c) 2021 Andrew Archibald
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package benchdata
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDeterministic(t *testing.T) {
+	if a, b := Links(1000, 5), Links(1000, 5); !reflect.DeepEqual(a, b) {
+		t.Error("links differ between calls")
+	}
+	if a, b := ShortURLs("bfy.tw", 1000), ShortURLs("bfy.tw", 1000); !reflect.DeepEqual(a, b) {
+		t.Error("short URLs differ between calls")
+	}
+	if a, b := LinkDump(1000, 5), LinkDump(1000, 5); !bytes.Equal(a, b) {
+		t.Error("link dumps differ between calls")
+	}
+}
+
+func TestShortcodes(t *testing.T) {
+	codes := Shortcodes(10000, 3)
+	seen := make(map[string]bool)
+	for _, code := range codes {
+		if len(code) != 3 {
+			t.Fatalf("shortcode %q not 3 characters", code)
+		}
+		if seen[code] {
+			t.Fatalf("duplicate shortcode %q", code)
+		}
+		seen[code] = true
+		if strings.Trim(code, Alphabet) != "" {
+			t.Fatalf("shortcode %q not in alphabet", code)
+		}
+	}
+	if len(codes) != 10000 {
+		t.Errorf("got %d shortcodes, want 10000", len(codes))
+	}
+}
+
+func TestShortURLs(t *testing.T) {
+	urls := ShortURLs("bfy.tw", 3000)
+	distinct := make(map[string]bool)
+	for _, u := range urls {
+		if !strings.Contains(u, "://bfy.tw") {
+			t.Fatalf("URL %q not of host", u)
+		}
+		distinct[u] = true
+	}
+	if len(urls) != 3000 || len(distinct) == len(urls) {
+		t.Errorf("got %d URLs, %d distinct", len(urls), len(distinct))
+	}
+}
@@ -0,0 +1,171 @@
+// Copyright (c) 2021 Andrew Archibald
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Command benchcmp compares the results of two runs of go test -bench,
+// such as before and after a change, and exits with status 1 when any
+// benchmark regressed by more than a threshold. Results repeated with
+// -count are summarized by their median. See tools/bench.bash to
+// compare commits.
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"math"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+func main() {
+	threshold := flag.Float64("threshold", 0.10, "fraction by which a metric may increase before it is a regression")
+	metrics := flag.String("metrics", "ns/op,B/op,allocs/op", "comma-separated units of the metrics compared")
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [-threshold f] [-metrics units] old.txt new.txt\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 2 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	before, err := parseFile(flag.Arg(0))
+	try(err)
+	after, err := parseFile(flag.Arg(1))
+	try(err)
+
+	var names []string
+	for name := range after {
+		if _, ok := before[name]; ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "benchmark\tmetric\told\tnew\tdelta\t\t")
+	regressions := 0
+	for _, name := range names {
+		for _, unit := range strings.Split(*metrics, ",") {
+			b, ok1 := before[name][unit]
+			a, ok2 := after[name][unit]
+			if !ok1 || !ok2 {
+				continue
+			}
+			old, cur := median(b), median(a)
+			mark := ""
+			if regressed(old, cur, *threshold) {
+				mark = "REGRESSION"
+				regressions++
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t\n", name, unit, format(old), format(cur), delta(old, cur), mark)
+		}
+	}
+	tw.Flush()
+	for name := range before {
+		if _, ok := after[name]; !ok {
+			fmt.Printf("only in old: %s\n", name)
+		}
+	}
+	if regressions != 0 {
+		fmt.Fprintf(os.Stderr, "%d metrics regressed by more than %.0f%%\n", regressions, *threshold*100)
+		os.Exit(1)
+	}
+}
+
+// results maps benchmark names, qualified by package, to the values of
+// each metric unit.
+type results map[string]map[string][]float64
+
+// procsSuffix matches the GOMAXPROCS suffix of benchmark names, which is
+// dropped, so that runs on different machines can be compared.
+var procsSuffix = regexp.MustCompile(`-\d+$`)
+
+func parseFile(filename string) (results, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	res := make(results)
+	pkg := ""
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line := sc.Text()
+		if strings.HasPrefix(line, "pkg: ") {
+			pkg = strings.TrimPrefix(line, "pkg: ")
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 4 || !strings.HasPrefix(fields[0], "Benchmark") {
+			continue
+		}
+		if _, err := strconv.Atoi(fields[1]); err != nil {
+			continue // not a result line
+		}
+		name := procsSuffix.ReplaceAllString(fields[0], "")
+		if pkg != "" {
+			name = pkg[strings.LastIndexByte(pkg, '/')+1:] + "." + name
+		}
+		if res[name] == nil {
+			res[name] = make(map[string][]float64)
+		}
+		for i := 2; i+1 < len(fields); i += 2 {
+			v, err := strconv.ParseFloat(fields[i], 64)
+			if err != nil {
+				return nil, fmt.Errorf("%s: bad value %q in line %q", filename, fields[i], line)
+			}
+			res[name][fields[i+1]] = append(res[name][fields[i+1]], v)
+		}
+	}
+	return res, sc.Err()
+}
+
+func median(vs []float64) float64 {
+	s := append([]float64(nil), vs...)
+	sort.Float64s(s)
+	if len(s)%2 == 1 {
+		return s[len(s)/2]
+	}
+	return (s[len(s)/2-1] + s[len(s)/2]) / 2
+}
+
+// regressed reports whether a metric increased by more than the
+// threshold. Any increase from zero, such as of allocations, is a
+// regression.
+func regressed(old, cur, threshold float64) bool {
+	if old == 0 {
+		return cur > 0
+	}
+	return (cur-old)/old > threshold
+}
+
+func delta(old, cur float64) string {
+	switch {
+	case old == cur:
+		return "~"
+	case old == 0:
+		return "+inf%"
+	}
+	return fmt.Sprintf("%+.1f%%", (cur-old)/old*100)
+}
+
+func format(v float64) string {
+	if math.Abs(v) >= 100 {
+		return strconv.FormatFloat(v, 'f', 0, 64)
+	}
+	return strconv.FormatFloat(v, 'g', 3, 64)
+}
+
+func try(err error) {
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
@@ -7,9 +7,12 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/andrewarchi/urlhero/tinytown"
 )
@@ -25,7 +28,9 @@ func main() {
 		os.Exit(1)
 	}
 
-	if err := tinytown.DownloadTorrents(dir); err != nil {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if err := tinytown.DownloadTorrentsContext(ctx, dir); err != nil {
 		log.Fatal(err)
 	}
 }
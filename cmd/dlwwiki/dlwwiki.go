@@ -7,8 +7,11 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"os"
+	"os/signal"
+	"syscall"
 
 	wwiki "github.com/andrewarchi/urlhero/shorteners/w-wiki"
 )
@@ -19,8 +22,10 @@ func main() {
 		os.Exit(2)
 	}
 	dir := os.Args[1]
-	try(wwiki.DownloadDumps(dir))
-	try(wwiki.DownloadIADumps(dir))
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	try(wwiki.DownloadDumpsContext(ctx, dir))
+	try(wwiki.DownloadIADumpsContext(ctx, dir))
 }
 
 func try(err error) {
@@ -7,10 +7,13 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"os"
+	"os/signal"
 	"regexp"
 	"strings"
+	"syscall"
 
 	"github.com/andrewarchi/urlhero/shorteners"
 )
@@ -46,7 +49,9 @@ func main() {
 		}
 	}
 
-	shortcodes, err := s.GetIAShortcodes()
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	shortcodes, err := s.GetIAShortcodesContext(ctx, nil)
 	for _, shortcode := range shortcodes {
 		fmt.Println(shortcode)
 	}
@@ -0,0 +1,82 @@
+// Copyright (c) 2021 Andrew Archibald
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"os"
+
+	"github.com/andrewarchi/urlhero/index"
+)
+
+var compactCmd = &command{
+	name:  "compact",
+	usage: "[-min-segments n] [index]",
+	run:   runCompact,
+}
+
+func runCompact(cmd *command, args []string) error {
+	fs := newFlagSet(cmd)
+	minSegments := fs.Int("min-segments", 1, "only compact hosts with at least this many segments")
+	parseFlags(fs, args)
+	if fs.NArg() > 1 || *minSegments < 1 {
+		usageExit(fs)
+	}
+	dir := dataDir().Index()
+	if fs.NArg() == 1 {
+		dir = fs.Arg(0)
+	}
+
+	if data := dataDir(); dir == data.Index() {
+		lock, err := data.Lock()
+		if err != nil {
+			return err
+		}
+		defer lock.Unlock()
+	}
+
+	out := newOutput(os.Stdout)
+	hosts, err := index.CompactDir(dir, *minSegments)
+	for _, host := range hosts {
+		out.Record(struct {
+			Host string `json:"host"`
+		}{host}, "compacted %s\n", host)
+	}
+	if err != nil {
+		out.Close()
+		return err
+	}
+	out.Summary(struct {
+		Compacted int `json:"compacted"`
+	}{len(hosts)}, "compacted %d hosts in %s\n", len(hosts), dir)
+	return out.Close()
+}
+
+var migrateCmd = &command{
+	name:  "migrate",
+	usage: "index new-index",
+	run:   runMigrate,
+}
+
+func runMigrate(cmd *command, args []string) error {
+	fs := newFlagSet(cmd)
+	parseFlags(fs, args)
+	if fs.NArg() != 2 {
+		usageExit(fs)
+	}
+	dir, newDir := fs.Arg(0), fs.Arg(1)
+
+	out := newOutput(os.Stdout)
+	if err := index.Migrate(dir, newDir); err != nil {
+		out.Close()
+		return err
+	}
+	out.Summary(struct {
+		Index    string `json:"index"`
+		Migrated string `json:"migrated"`
+	}{dir, newDir}, "migrated %s to %s\n", dir, newDir)
+	return out.Close()
+}
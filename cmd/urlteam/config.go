@@ -0,0 +1,188 @@
+// Copyright (c) 2021 Andrew Archibald
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/andrewarchi/urlhero/crawl"
+	"github.com/andrewarchi/urlhero/datadir"
+	"github.com/andrewarchi/urlhero/ia"
+)
+
+// config is the urlteam configuration. Settings are merged in order of
+// increasing precedence from defaults, the config file, environment
+// variables, and command-line flags.
+//
+// Example config.toml:
+//
+//	data_dir = "/srv/urlteam"
+//	proxy = "socks5://localhost:1080"
+//
+//	[http]
+//	contact = "mailto:archivist@example.org"
+//	timeout = "2m"
+//	retries = 3
+//	request_delay = "500ms"
+//
+//	[ia]
+//	access_key = "..."
+//	secret_key = "..."
+//
+//	[server]
+//	anonymous_scopes = ["read"]
+//	cors_origins = ["https://tools.example.org"]
+//
+//	[[server.tokens]]
+//	name = "mirror"
+//	token = "..."
+//	scopes = ["read", "bulk"]
+//
+//	[tracing]
+//	endpoint = "localhost:4317"
+//	insecure = true
+//	sample_ratio = 0.1
+//
+//	[flags.shorteners]
+//	index = "/srv/urlteam/index"
+type config struct {
+	DataDir string `toml:"data_dir"` // env: URLTEAM_DATA_DIR
+	Proxy   string `toml:"proxy"`    // env: URLTEAM_PROXY; defaults to HTTP_PROXY and HTTPS_PROXY
+	// HTTP is the identity and politeness of every outbound request.
+	HTTP struct {
+		UserAgent    string   `toml:"user_agent"`
+		Contact      string   `toml:"contact"` // env: URLTEAM_CONTACT; appended to the user agent
+		Timeout      duration `toml:"timeout"` // for response headers
+		Retries      int      `toml:"retries"`
+		RetryDelay   duration `toml:"retry_delay"`   // doubled for each retry
+		RequestDelay duration `toml:"request_delay"` // per host, including the Internet Archive
+	} `toml:"http"`
+	IA struct {
+		AccessKey string `toml:"access_key"` // env: IA_ACCESS_KEY
+		SecretKey string `toml:"secret_key"` // env: IA_SECRET_KEY
+	} `toml:"ia"`
+	Server struct {
+		// Tokens enable authentication of the lookup server.
+		Tokens []struct {
+			Name   string   `toml:"name"`
+			Token  string   `toml:"token"`
+			Scopes []string `toml:"scopes"` // read, bulk, or admin
+		} `toml:"tokens"`
+		AnonymousScopes []string `toml:"anonymous_scopes"` // scopes without a token
+		// CORS allows browsers on other origins to call the API.
+		CORSOrigins []string `toml:"cors_origins"` // or ["*"] for any
+		CORSMethods []string `toml:"cors_methods"` // default GET, HEAD, and POST
+		CORSMaxAge  duration `toml:"cors_max_age"` // of preflight responses
+	} `toml:"server"`
+	// Tracing exports OpenTelemetry spans with OTLP over gRPC, when an
+	// endpoint is set here or in OTEL_EXPORTER_OTLP_ENDPOINT.
+	Tracing struct {
+		Endpoint    string  `toml:"endpoint"` // host:port of the collector
+		Insecure    bool    `toml:"insecure"` // connect without TLS
+		SampleRatio float64 `toml:"sample_ratio"`
+		ServiceName string  `toml:"service_name"` // default urlteam
+	} `toml:"tracing"`
+	// Flags are default flag values, keyed by subcommand and flag name.
+	Flags map[string]map[string]string `toml:"flags"`
+}
+
+var cfg config
+
+type duration struct{ time.Duration }
+
+func (d *duration) UnmarshalText(text []byte) error {
+	var err error
+	d.Duration, err = time.ParseDuration(string(text))
+	return err
+}
+
+// defaultConfigFile returns the path of the config file, following the
+// XDG base directory specification.
+func defaultConfigFile() string {
+	if f := os.Getenv("URLTEAM_CONFIG"); f != "" {
+		return f
+	}
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "urlteam", "config.toml")
+}
+
+// loadConfig reads the config file, if it exists, and applies
+// environment variables. A missing file is only an error when it was
+// explicitly requested.
+func loadConfig(filename string, explicit bool) error {
+	if filename != "" {
+		_, err := toml.DecodeFile(filename, &cfg)
+		if err != nil && (explicit || !errors.Is(err, os.ErrNotExist)) {
+			return err
+		}
+	}
+
+	setFromEnv(&cfg.DataDir, "URLTEAM_DATA_DIR")
+	setFromEnv(&cfg.Proxy, "URLTEAM_PROXY")
+	setFromEnv(&cfg.HTTP.Contact, "URLTEAM_CONTACT")
+	setFromEnv(&cfg.IA.AccessKey, "IA_ACCESS_KEY")
+	setFromEnv(&cfg.IA.SecretKey, "IA_SECRET_KEY")
+	if cfg.DataDir == "" {
+		cfg.DataDir = datadir.Default()
+	}
+
+	if cfg.Proxy != "" {
+		proxy, err := url.Parse(cfg.Proxy)
+		if err != nil {
+			return fmt.Errorf("config: proxy: %w", err)
+		}
+		if t, ok := http.DefaultTransport.(*http.Transport); ok {
+			t.Proxy = http.ProxyURL(proxy)
+		}
+		ia.Transport.Proxy = http.ProxyURL(proxy)
+	}
+	crawl.Configure(crawl.Config{
+		UserAgent:    cfg.HTTP.UserAgent,
+		Contact:      cfg.HTTP.Contact,
+		Timeout:      cfg.HTTP.Timeout.Duration,
+		Retries:      cfg.HTTP.Retries,
+		RetryDelay:   cfg.HTTP.RetryDelay.Duration,
+		RequestDelay: cfg.HTTP.RequestDelay.Duration,
+	})
+	ia.AccessKey = cfg.IA.AccessKey
+	ia.SecretKey = cfg.IA.SecretKey
+	return nil
+}
+
+func setFromEnv(v *string, key string) {
+	if s := os.Getenv(key); s != "" {
+		*v = s
+	}
+}
+
+// dataDir returns the configured data directory.
+func dataDir() *datadir.Dir {
+	return datadir.New(cfg.DataDir)
+}
+
+// parseFlags applies the configured default flags for a subcommand,
+// then parses the command-line flags, which take precedence.
+func parseFlags(fs *flag.FlagSet, args []string) {
+	for name, value := range cfg.Flags[fs.Name()] {
+		if err := fs.Set(name, value); err != nil {
+			fmt.Fprintf(os.Stderr, "urlteam: config: flags.%s.%s: %v\n", fs.Name(), name, err)
+			os.Exit(2)
+		}
+	}
+	fs.Parse(args)
+}
@@ -0,0 +1,92 @@
+// Copyright (c) 2021 Andrew Archibald
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/andrewarchi/urlhero/index"
+)
+
+var conflictsCmd = &command{
+	name:  "conflicts",
+	usage: "[-index dir] <shortener>",
+	run:   runConflicts,
+}
+
+// conflictResult is a shortcode that has been archived with more than
+// one target, the first of which is current.
+type conflictResult struct {
+	Host      string          `json:"host"`
+	Shortcode string          `json:"shortcode"`
+	Versions  []versionResult `json:"versions"`
+}
+
+type versionResult struct {
+	Target    string     `json:"target,omitempty"` // empty when only its hash is known
+	Releases  []string   `json:"releases,omitempty"`
+	FirstSeen *time.Time `json:"first_seen,omitempty"`
+	LastSeen  *time.Time `json:"last_seen,omitempty"`
+}
+
+func runConflicts(cmd *command, args []string) error {
+	fs := newFlagSet(cmd)
+	indexDir := fs.String("index", dataDir().Index(), "index directory")
+	parseFlags(fs, args)
+	if fs.NArg() != 1 {
+		usageExit(fs)
+	}
+	s, err := lookupShortener(fs.Arg(0), "")
+	if err != nil {
+		return &inputError{err}
+	}
+	idx, err := index.Open(*indexDir)
+	if err != nil {
+		return err
+	}
+	defer idx.Close()
+	r := idx.Reader(s.Host)
+	if r == nil {
+		return &inputError{fmt.Errorf("host %s not in index %s", s.Host, *indexDir)}
+	}
+	if r.Provenance() == nil {
+		return &inputError{fmt.Errorf("no provenance log for host %s in index %s", s.Host, *indexDir)}
+	}
+
+	out := newOutput(os.Stdout)
+	n := 0
+	err = r.Conflicts(func(c index.Conflict) error {
+		n++
+		res := conflictResult{Host: s.Host, Shortcode: c.Shortcode}
+		var text strings.Builder
+		for i, v := range c.Versions {
+			vr := versionResult{Target: v.Target, Releases: v.Releases}
+			target, first, last := v.Target, "-", "-"
+			if target == "" {
+				target = "(unknown)"
+			}
+			if !v.FirstSeen.IsZero() {
+				vr.FirstSeen, vr.LastSeen = &c.Versions[i].FirstSeen, &c.Versions[i].LastSeen
+				first, last = v.FirstSeen.Format("2006-01-02"), v.LastSeen.Format("2006-01-02")
+			}
+			res.Versions = append(res.Versions, vr)
+			fmt.Fprintf(&text, "%s\t%s\t%s\t%s\t%s\n", c.Shortcode, target, strings.Join(v.Releases, ","), first, last)
+		}
+		return out.Record(res, "%s", text.String())
+	})
+	if err != nil {
+		out.Close()
+		return err
+	}
+	out.Summary(struct {
+		Conflicts int `json:"conflicts"`
+	}{n}, "%d conflicting shortcodes\n", n)
+	return out.Close()
+}
@@ -0,0 +1,190 @@
+// Copyright (c) 2021 Andrew Archibald
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/andrewarchi/urlhero/index"
+)
+
+var diffCmd = &command{
+	name:  "diff",
+	usage: "[-host host] <old> <new>",
+	run:   runDiff,
+}
+
+// Sources of records to compare are an index directory, a release
+// directory or project zip, a directory of releases, or ia:<shortener>
+// for the shortcodes captured by the Internet Archive.
+
+func runDiff(cmd *command, args []string) error {
+	fs := newFlagSet(cmd)
+	host := fs.String("host", "", "only compare the given shortener name or host")
+	parseFlags(fs, args)
+	if fs.NArg() != 2 {
+		usageExit(fs)
+	}
+	// Internet Archive captures are for a single host
+	for _, arg := range fs.Args() {
+		if strings.HasPrefix(arg, "ia:") && *host == "" {
+			*host = strings.TrimPrefix(arg, "ia:")
+		}
+	}
+	if *host != "" {
+		s, err := lookupShortener(*host, "")
+		if err != nil {
+			return err
+		}
+		*host = s.Host
+	}
+
+	ctx, stop := interruptContext()
+	defer stop()
+	out := newOutput(os.Stdout)
+	oldSrc, err := openDiffSource(ctx, out, fs.Arg(0))
+	if err != nil {
+		return err
+	}
+	defer oldSrc.close()
+	newSrc, err := openDiffSource(ctx, out, fs.Arg(1))
+	if err != nil {
+		return err
+	}
+	defer newSrc.close()
+
+	var hosts []string
+	if *host != "" {
+		hosts = []string{*host}
+	} else {
+		hosts = unionHosts(oldSrc.hosts(), newSrc.hosts())
+	}
+
+	var summary struct {
+		Added   int `json:"added"`
+		Removed int `json:"removed"`
+		Changed int `json:"changed"`
+	}
+	for _, h := range hosts {
+		err := index.Diff(oldSrc.iter(h), newSrc.iter(h), func(c index.Change) error {
+			rec := struct {
+				Kind      string `json:"kind"`
+				Host      string `json:"host"`
+				Shortcode string `json:"shortcode"`
+				Old       string `json:"old,omitempty"`
+				New       string `json:"new,omitempty"`
+			}{c.Kind.String(), h, c.Shortcode, c.Old, c.New}
+			switch c.Kind {
+			case index.Added:
+				summary.Added++
+				return out.Record(rec, "+ %s %s %s\n", h, c.Shortcode, c.New)
+			case index.Removed:
+				summary.Removed++
+				return out.Record(rec, "- %s %s %s\n", h, c.Shortcode, c.Old)
+			default:
+				summary.Changed++
+				return out.Record(rec, "~ %s %s %s -> %s\n", h, c.Shortcode, c.Old, c.New)
+			}
+		})
+		if err != nil {
+			out.Close()
+			return err
+		}
+	}
+	out.Summary(summary, "%d added, %d removed, %d changed\n",
+		summary.Added, summary.Removed, summary.Changed)
+	return out.Close()
+}
+
+type diffSource interface {
+	hosts() []string
+	iter(host string) index.Iter
+	close() error
+}
+
+func openDiffSource(ctx context.Context, out *output, arg string) (diffSource, error) {
+	if strings.HasPrefix(arg, "ia:") {
+		return openIASource(ctx, strings.TrimPrefix(arg, "ia:"))
+	}
+	indexes, err := filepath.Glob(filepath.Join(arg, "*"+index.Ext))
+	if err != nil {
+		return nil, err
+	}
+	if len(indexes) != 0 {
+		idx, err := index.Open(arg)
+		if err != nil {
+			return nil, err
+		}
+		return indexSource{idx}, nil
+	}
+	filenames, err := findProjects(arg)
+	if err != nil {
+		return nil, err
+	}
+	b := index.NewBuilder()
+	if err := processProjects(out, "reading "+arg, filenames, b.ProcessFunc()); err != nil {
+		return nil, err
+	}
+	return builderSource{b}, nil
+}
+
+type indexSource struct{ idx *index.Index }
+
+func (s indexSource) hosts() []string { return s.idx.Hosts() }
+func (s indexSource) close() error    { return s.idx.Close() }
+
+func (s indexSource) iter(host string) index.Iter {
+	if r := s.idx.Reader(host); r != nil {
+		return r.Iter()
+	}
+	return index.SliceIter(nil)
+}
+
+type builderSource struct{ b *index.Builder }
+
+func (s builderSource) hosts() []string             { return s.b.Hosts() }
+func (s builderSource) iter(host string) index.Iter { return index.SliceIter(s.b.Records(host)) }
+func (s builderSource) close() error                { return nil }
+
+func openIASource(ctx context.Context, shortener string) (diffSource, error) {
+	if shortener == "" {
+		return nil, errors.New("ia source requires a shortener, e.g. ia:a.ll.st")
+	}
+	s, err := lookupShortener(shortener, "")
+	if err != nil {
+		return nil, err
+	}
+	shortcodes, err := s.GetIAShortcodesContext(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	b := index.NewBuilder()
+	for _, shortcode := range shortcodes {
+		b.Add(s.Host, index.Record{Shortcode: shortcode})
+	}
+	return builderSource{b}, nil
+}
+
+func unionHosts(a, b []string) []string {
+	seen := make(map[string]struct{}, len(a)+len(b))
+	var hosts []string
+	for _, hs := range [][]string{a, b} {
+		for _, h := range hs {
+			if _, ok := seen[h]; !ok {
+				seen[h] = struct{}{}
+				hosts = append(hosts, h)
+			}
+		}
+	}
+	sort.Strings(hosts)
+	return hosts
+}
@@ -0,0 +1,317 @@
+// Copyright (c) 2021 Andrew Archibald
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/anacrolix/torrent"
+	"github.com/andrewarchi/urlhero/datadir"
+	"github.com/andrewarchi/urlhero/index"
+	"github.com/andrewarchi/urlhero/tinytown"
+	"github.com/andrewarchi/urlhero/xz"
+)
+
+var doctorCmd = &command{
+	name:  "doctor",
+	usage: "[-offline]",
+	run:   runDoctor,
+}
+
+// Free space thresholds for the data directory. A full set of releases
+// is on the order of a terabyte.
+const (
+	minFreeWarn  = 100 << 30
+	minFreeError = 1 << 30
+)
+
+type findingStatus string
+
+const (
+	statusOK    findingStatus = "ok"
+	statusWarn  findingStatus = "warn"
+	statusError findingStatus = "error"
+)
+
+// finding is the result of a diagnostic check.
+type finding struct {
+	Check   string        `json:"check"`
+	Status  findingStatus `json:"status"`
+	Message string        `json:"message"`
+	Hint    string        `json:"hint,omitempty"` // suggested fix
+}
+
+func runDoctor(cmd *command, args []string) error {
+	fs := newFlagSet(cmd)
+	offline := fs.Bool("offline", false, "skip network checks")
+	parseFlags(fs, args)
+	if fs.NArg() != 0 {
+		usageExit(fs)
+	}
+
+	var findings []finding
+	findings = append(findings, checkDataDir(dataDir())...)
+	findings = append(findings, checkIndex(dataDir().Index())...)
+	findings = append(findings, checkDiskSpace(dataDir().Root))
+	findings = append(findings, checkTorrentPort())
+	findings = append(findings, checkXZ())
+	if !*offline {
+		findings = append(findings, checkIA())
+	}
+
+	out := newOutput(os.Stdout)
+	counts := make(map[findingStatus]int)
+	for _, f := range findings {
+		counts[f.Status]++
+		if f.Hint != "" {
+			out.Record(f, "[%s] %s: %s\n\t%s\n", f.Status, f.Check, f.Message, f.Hint)
+		} else {
+			out.Record(f, "[%s] %s: %s\n", f.Status, f.Check, f.Message)
+		}
+	}
+	out.Summary(struct {
+		OK       int `json:"ok"`
+		Warnings int `json:"warnings"`
+		Errors   int `json:"errors"`
+	}{counts[statusOK], counts[statusWarn], counts[statusError]},
+		"%d ok, %d warnings, %d errors\n", counts[statusOK], counts[statusWarn], counts[statusError])
+	if err := out.Close(); err != nil {
+		return err
+	}
+	if counts[statusError] != 0 {
+		return fmt.Errorf("%d checks failed", counts[statusError])
+	}
+	return nil
+}
+
+// checkDataDir validates the layout of the data directory.
+func checkDataDir(data *datadir.Dir) []finding {
+	const check = "data dir"
+	dir := data.Root
+	fi, err := os.Stat(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return []finding{{check, statusWarn, dir + " does not exist",
+			"it is created by the first download; set data_dir in the config or URLTEAM_DATA_DIR to use another location"}}
+	}
+	if err != nil {
+		return []finding{{check, statusError, err.Error(), ""}}
+	}
+	if !fi.IsDir() {
+		return []finding{{check, statusError, dir + " is not a directory",
+			"set data_dir in the config or URLTEAM_DATA_DIR to a directory"}}
+	}
+	f, err := os.CreateTemp(dir, ".doctor")
+	if err != nil {
+		return []finding{{check, statusError, dir + " is not writable: " + err.Error(),
+			"fix the permissions or choose another data_dir"}}
+	}
+	f.Close()
+	os.Remove(f.Name())
+
+	findings := []finding{{check, statusOK, dir, ""}}
+	findings = append(findings, checkInterrupted(data.Index())...)
+
+	releases := data.Releases()
+	entries, err := os.ReadDir(releases)
+	if errors.Is(err, os.ErrNotExist) {
+		return append(findings, finding{"releases", statusWarn, "no releases downloaded",
+			"run urlteam watch -once to download releases"})
+	}
+	if err != nil {
+		return append(findings, finding{"releases", statusError, err.Error(), ""})
+	}
+	n := 0
+	var empty []string
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		zips, err := filepath.Glob(filepath.Join(releases, e.Name(), "*.zip"))
+		if err != nil {
+			return append(findings, finding{"releases", statusError, err.Error(), ""})
+		}
+		if len(zips) == 0 {
+			empty = append(empty, e.Name())
+		}
+		n++
+	}
+	if len(empty) != 0 {
+		findings = append(findings, finding{"releases", statusWarn,
+			fmt.Sprintf("%d releases have no project zips: %s", len(empty), strings.Join(empty, ", ")),
+			"the download may be incomplete; rerun urlteam watch"})
+	}
+	return append(findings, finding{"releases", statusOK, fmt.Sprintf("%d releases in %s", n, releases), ""})
+}
+
+// checkInterrupted reports the files left by an interrupted index
+// update: the write-ahead log beside the index, which the next update
+// resumes from, and temporary segments or index files in it, which are
+// only renamed into place once complete.
+func checkInterrupted(dir string) []finding {
+	const check = "data dir"
+	var findings []finding
+	wal := dir + ".wal"
+	if fi, err := os.Stat(wal); err == nil && fi.IsDir() {
+		findings = append(findings, finding{check, statusWarn, wal + " left by an interrupted index update",
+			"run urlteam index to resume it"})
+	}
+	tmps, err := filepath.Glob(filepath.Join(dir, "*.tmp"))
+	if err != nil {
+		return append(findings, finding{check, statusError, err.Error(), ""})
+	}
+	if len(tmps) != 0 {
+		findings = append(findings, finding{check, statusWarn,
+			fmt.Sprintf("%d temporary files in %s left by an interrupted index write", len(tmps), dir),
+			"remove " + strings.Join(tmps, " ")})
+	}
+	return findings
+}
+
+// checkIndex validates that every index file can be read by this
+// version.
+func checkIndex(dir string) []finding {
+	const check = "index"
+	filenames, err := filepath.Glob(filepath.Join(dir, "*"+index.Ext))
+	if err != nil {
+		return []finding{{check, statusError, err.Error(), ""}}
+	}
+	if len(filenames) == 0 {
+		return []finding{{check, statusWarn, "no index in " + dir,
+			"run urlteam watch to build the index"}}
+	}
+	var findings []finding
+	var n int64
+	outdated := 0
+	for _, filename := range filenames {
+		r, err := index.OpenReader(filename)
+		var verr *index.VersionError
+		if errors.As(err, &verr) {
+			findings = append(findings, finding{check, statusError, err.Error(),
+				"upgrade urlteam to read it or rebuild the index"})
+			continue
+		} else if err != nil {
+			findings = append(findings, finding{check, statusError, err.Error(),
+				"the index may be corrupt or from another version of urlteam; rebuild it"})
+			continue
+		}
+		if r.Outdated() {
+			outdated++
+		}
+		if host := strings.TrimSuffix(filepath.Base(filename), index.Ext); r.Meta().Host != host {
+			findings = append(findings, finding{check, statusError,
+				fmt.Sprintf("%s: contains host %s", filename, r.Meta().Host), "rebuild the index"})
+		}
+		n += r.Len()
+		r.Close()
+	}
+	if outdated != 0 {
+		findings = append(findings, finding{check, statusWarn,
+			fmt.Sprintf("%d index files in %s are in an outdated format", outdated, dir),
+			"run urlteam migrate to upgrade them"})
+	}
+	segments, err := filepath.Glob(filepath.Join(dir, "*"+index.SegmentExt))
+	if err == nil && len(segments) > maxSegments {
+		findings = append(findings, finding{check, statusWarn,
+			fmt.Sprintf("%d uncompacted segments in %s", len(segments), dir),
+			"lookups slow as segments accumulate; run urlteam compact"})
+	}
+	if len(findings) == 0 {
+		findings = append(findings, finding{check, statusOK,
+			fmt.Sprintf("%d hosts, %d shortcodes in %s", len(filenames), n, dir), ""})
+	}
+	return findings
+}
+
+// maxSegments is the number of segments in an index, after which doctor
+// suggests compaction.
+const maxSegments = 64
+
+// checkDiskSpace checks the free space of the file system containing
+// the data directory.
+func checkDiskSpace(dir string) finding {
+	const check = "disk space"
+	// Use the nearest existing parent, when the directory is not yet
+	// created
+	for {
+		if _, err := os.Stat(dir); err == nil || filepath.Dir(dir) == dir {
+			break
+		}
+		dir = filepath.Dir(dir)
+	}
+	free, err := tinytown.DiskFree(dir)
+	if err != nil {
+		return finding{check, statusWarn, "unable to check: " + err.Error(), ""}
+	}
+	msg := fmt.Sprintf("%s free in %s", formatBytes(int64(free)), dir)
+	switch {
+	case free < minFreeError:
+		return finding{check, statusError, msg, "free up space or move data_dir to a larger disk"}
+	case free < minFreeWarn:
+		return finding{check, statusWarn, msg, "the full set of releases needs about a terabyte"}
+	}
+	return finding{check, statusOK, msg, ""}
+}
+
+// checkTorrentPort checks that the torrent client can listen on its
+// port. Reachability from outside, such as through port forwarding, is
+// not checked.
+func checkTorrentPort() finding {
+	const check = "torrent port"
+	port := torrent.NewDefaultClientConfig().ListenPort
+	addr := net.JoinHostPort("", strconv.Itoa(port))
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return finding{check, statusWarn, err.Error(),
+			"another torrent client may be running; downloads will be slower or fail"}
+	}
+	l.Close()
+	pc, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return finding{check, statusWarn, err.Error(),
+			"another torrent client may be running; downloads will be slower or fail"}
+	}
+	pc.Close()
+	return finding{check, statusOK, fmt.Sprintf("TCP and UDP port %d available", port),
+		"forward the port on your router to download from more peers"}
+}
+
+// checkXZ reports the xz backend used to process releases.
+func checkXZ() finding {
+	const check = "xz"
+	backend := xz.DefaultBackend.Resolve()
+	if backend == xz.Go {
+		return finding{check, statusWarn, "using the Go xz decoder",
+			"install XZ Utils or build with -tags liblzma to process releases about 3x faster"}
+	}
+	return finding{check, statusOK, fmt.Sprintf("using the %s xz backend", backend), ""}
+}
+
+// checkIA checks connectivity to the Internet Archive API.
+func checkIA() finding {
+	const check = "internet archive"
+	start := time.Now()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	ids, err := tinytown.GetReleaseIDsContext(ctx)
+	if err != nil {
+		hint := "check your network connection"
+		if cfg.Proxy != "" {
+			hint += " and the proxy " + cfg.Proxy
+		}
+		return finding{check, statusError, err.Error(), hint}
+	}
+	return finding{check, statusOK, fmt.Sprintf("found %d releases in %s", len(ids),
+		time.Since(start).Round(time.Millisecond)), ""}
+}
@@ -0,0 +1,52 @@
+// Copyright (c) 2021 Andrew Archibald
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/andrewarchi/urlhero/datadir"
+)
+
+func TestCheckInterrupted(t *testing.T) {
+	data := &datadir.Dir{Root: t.TempDir()}
+	if err := data.Init(); err != nil {
+		t.Fatal(err)
+	}
+	warnings := func() []string {
+		var msgs []string
+		for _, f := range checkDataDir(data) {
+			if f.Status == statusWarn {
+				msgs = append(msgs, f.Message)
+			}
+		}
+		return msgs
+	}
+	if msgs := warnings(); len(msgs) != 0 {
+		t.Fatalf("got warnings %q for a clean data dir", msgs)
+	}
+
+	// An update that crashed leaves its write-ahead log and a segment
+	// that was being written
+	wal := data.Index() + ".wal"
+	if err := os.Mkdir(wal, 0o777); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(wal, "wal.log"), nil, 0o666); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(data.Index(), "bit.ly.000001.seg.tmp"), nil, 0o666); err != nil {
+		t.Fatal(err)
+	}
+	msgs := warnings()
+	if len(msgs) != 2 || !strings.Contains(msgs[0], wal) || !strings.Contains(msgs[1], "1 temporary files") {
+		t.Errorf("got warnings %q, want the write-ahead log and 1 temporary file", msgs)
+	}
+}
@@ -0,0 +1,278 @@
+// Copyright (c) 2021 Andrew Archibald
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/andrewarchi/urlhero/logger"
+	"github.com/andrewarchi/urlhero/report"
+	"github.com/andrewarchi/urlhero/tinytown"
+)
+
+var downloadCmd = &command{
+	name:  "download",
+	usage: "[-releases dir] [-mode torrent|http|auto] [-stall duration] [-files patterns] [-max-torrents n] [-max-conns n] [-rate KiB/s] [-seed] [-seed-ratio ratio] [-seed-time duration] [-no-space-check] [-since release] [-from date] [-before date] [-match pattern] [-verify] [-dry-run] [release...]",
+	run:   runDownload,
+}
+
+func runDownload(cmd *command, args []string) error {
+	fs := newFlagSet(cmd)
+	data := dataDir()
+	dir := fs.String("releases", data.Releases(), "directory to download releases to")
+	verify := fs.Bool("verify", false, "verify the checksums of releases after downloading")
+	dryRun := fs.Bool("dry-run", false, "list the files and bytes of the releases that would be downloaded, from their metadata, without downloading them")
+	noSpaceCheck := fs.Bool("no-space-check", false, "download even when the releases need more space than is free")
+	since := fs.String("since", "", "only download releases after this `release` identifier")
+	from := fs.String("from", "", "only download releases at or after this `date`, such as 2020-01-01")
+	before := fs.String("before", "", "only download releases before this `date`")
+	match := fs.String("match", "", "only download releases with identifiers that match this glob `pattern`, such as urlteam_2021-*")
+	modeName := fs.String("mode", "torrent", "download releases via `mode` torrent, http, or auto, which falls back to http for stalled torrents")
+	stall := fs.Duration("stall", tinytown.DefaultStallTimeout, "in auto mode, download releases over http after their torrents make no progress for this `duration`")
+	files := fs.String("files", "", "only download the files of releases that match these comma-separated glob `patterns`, such as *.zip")
+	maxTorrents := fs.Int("max-torrents", tinytown.DefaultMaxTorrents, "download at most `n` releases at once")
+	maxConns := fs.Int("max-conns", 0, "limit the peer connections of each torrent to `n`, if positive")
+	rateLimit := fs.Int64("rate", 0, "limit the download rate to `KiB/s`, if positive")
+	seed := fs.Bool("seed", false, "seed the downloaded torrents until interrupted or they reach the -seed-ratio or -seed-time")
+	seedRatio := fs.Float64("seed-ratio", 0, "stop seeding each torrent once it uploads `ratio` times its size, if positive")
+	seedTime := fs.Duration("seed-time", 0, "stop seeding after this `duration`, if positive")
+	parseFlags(fs, args)
+	mode, err := tinytown.ParseDownloadMode(*modeName)
+	if err != nil {
+		return &inputError{err}
+	}
+	if (*since != "" || *from != "" || *before != "" || *match != "") && fs.NArg() != 0 {
+		usageExit(fs)
+	}
+	releases := &tinytown.ReleaseFilter{Pattern: *match}
+	if releases.From, err = parseDate(*from); err != nil {
+		return &inputError{err}
+	}
+	if releases.Before, err = parseDate(*before); err != nil {
+		return &inputError{err}
+	}
+	if err := releases.Valid(); err != nil {
+		return &inputError{err}
+	}
+	filter, err := fileFilter(*files)
+	if err != nil {
+		return &inputError{err}
+	}
+
+	if *dir == data.Releases() && !*dryRun {
+		lock, err := data.Lock()
+		if err != nil {
+			return err
+		}
+		defer lock.Unlock()
+	}
+	if !*dryRun {
+		if err := os.MkdirAll(*dir, 0o755); err != nil {
+			return err
+		}
+	}
+	ctx, stop := interruptContext()
+	defer stop()
+
+	// Without releases, only those that are not yet downloaded are
+	// fetched
+	ids := fs.Args()
+	if len(ids) == 0 {
+		all, err := tinytown.GetReleaseIDsFilter(ctx, releases)
+		if err != nil {
+			return err
+		}
+		ids = tinytown.PendingReleases(*dir, all, *since)
+		logger.Info("listed releases", "releases", len(all), "pending", len(ids))
+	}
+
+	out := newOutput(os.Stdout)
+	if *dryRun {
+		return planDownload(ctx, out, *dir, ids, filter)
+	}
+	failed := make(map[string]bool)
+	rep := report.New("download")
+	rep.OnFail = func(id string, err error) {
+		failed[id] = true
+		logger.Error("download failed", "id", id, "err", err)
+	}
+	p := newProgress(out, "download", len(ids), 0)
+	// Torrents report their own bytes, which are summed over releases
+	var mu sync.Mutex
+	var bytes, total int64
+	completed := make(map[string]int64)
+	lengths := make(map[string]int64)
+	dctx := tinytown.WithProgress(ctx, func(e tinytown.ProgressEvent) {
+		mu.Lock()
+		bytes += e.N - completed[e.Release]
+		total += e.Total - lengths[e.Release]
+		completed[e.Release], lengths[e.Release] = e.N, e.Total
+		b, t := bytes, total
+		mu.Unlock()
+		p.setBytes(b, t)
+		if e.Kind == tinytown.ProgressTorrent {
+			p.finishItem(0)
+		}
+	})
+	err = tinytown.DownloadReleasesOptions(dctx, *dir, ids, &tinytown.DownloadOptions{
+		Mode:           mode,
+		StallTimeout:   *stall,
+		Filter:         filter,
+		MaxTorrents:    *maxTorrents,
+		MaxConns:       *maxConns,
+		RateLimit:      *rateLimit << 10,
+		Seed:           *seed,
+		SeedRatio:      *seedRatio,
+		SeedTime:       *seedTime,
+		SkipSpaceCheck: *noSpaceCheck,
+		Report:         rep,
+	})
+	p.done()
+	if err != nil {
+		out.Close()
+		return err
+	}
+	// An interrupt stops seeding, after which releases are still verified
+	if *seed {
+		ctx, stop = interruptContext()
+		defer stop()
+	}
+	rep.Finish()
+	// Releases that failed to download are not verified
+	var vrep *report.Report
+	if *verify {
+		vrep = report.New("verify")
+		vrep.OnFail = func(id string, err error) {
+			failed[id] = true
+			logger.Error("verification failed", "id", id, "err", err)
+		}
+	}
+	for _, id := range ids {
+		if failed[id] {
+			continue
+		}
+		if vrep != nil {
+			if err := tinytown.VerifyReleaseContext(ctx, *dir, id); err != nil {
+				if ctx.Err() != nil {
+					out.Close()
+					return ctx.Err()
+				}
+				vrep.Fail(id, err)
+				continue
+			}
+			vrep.Succeed(1)
+		}
+		out.Record(struct {
+			Release  string `json:"release"`
+			Verified bool   `json:"verified"`
+		}{id, *verify}, "downloaded %s\n", id)
+	}
+	if vrep != nil {
+		vrep.Finish()
+	}
+	out.Summary(struct {
+		Dir      string         `json:"dir"`
+		Download *report.Report `json:"download"`
+		Verify   *report.Report `json:"verify,omitempty"`
+	}{*dir, rep, vrep}, "downloaded %d of %d releases to %s\n", len(ids)-len(failed), len(ids), *dir)
+	if err := out.Close(); err != nil {
+		return err
+	}
+	err = rep.Err()
+	if err == nil && vrep != nil {
+		err = vrep.Err()
+	}
+	if err != nil {
+		return &partialError{err}
+	}
+	return nil
+}
+
+// planDownload prints what would be downloaded of each release, as
+// listed in its metadata, and the totals.
+func planDownload(ctx context.Context, out *output, dir string, ids []string, filter func(name string) bool) error {
+	rep := report.New("plan")
+	rep.OnFail = func(id string, err error) {
+		logger.Error("listing files failed", "id", id, "err", err)
+	}
+	plans, err := tinytown.PlanReleases(ctx, dir, ids, &tinytown.DownloadOptions{Filter: filter, Report: rep})
+	if err != nil {
+		out.Close()
+		return err
+	}
+	rep.Finish()
+	var files int
+	var bytes, existing int64
+	for _, plan := range plans {
+		files += plan.Files
+		bytes += plan.Bytes
+		existing += plan.Existing
+		out.Record(plan, "%s\t%d files\t%s\n", plan.ID, plan.Files, formatBytes(plan.Bytes))
+	}
+	out.Summary(struct {
+		Dir      string         `json:"dir"`
+		Releases int            `json:"releases"`
+		Files    int            `json:"files"`
+		Bytes    int64          `json:"bytes"`
+		Existing int64          `json:"existing"`
+		Plan     *report.Report `json:"plan"`
+	}{dir, len(plans), files, bytes, existing, rep},
+		"would download %d files of %d releases, %s, of which %s exist in %s\n",
+		files, len(plans), formatBytes(bytes), formatBytes(existing), dir)
+	if err := out.Close(); err != nil {
+		return err
+	}
+	if err := rep.Err(); err != nil {
+		return &partialError{err}
+	}
+	return nil
+}
+
+// parseDate parses a date, such as 2020-01-01, or a time in RFC 3339
+// format, or returns the zero time for an empty string.
+func parseDate(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse("2006-01-02", s); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("date %q: want YYYY-MM-DD or RFC 3339 format", s)
+	}
+	return t, nil
+}
+
+// fileFilter returns a filter of the files of releases that match any
+// of the comma-separated glob patterns, or nil for all files when there
+// are none.
+func fileFilter(patterns string) (func(name string) bool, error) {
+	if patterns == "" {
+		return nil, nil
+	}
+	globs := strings.Split(patterns, ",")
+	for _, glob := range globs {
+		if _, err := path.Match(glob, ""); err != nil {
+			return nil, fmt.Errorf("file pattern %q: %w", glob, err)
+		}
+	}
+	return func(name string) bool {
+		for _, glob := range globs {
+			if ok, _ := path.Match(glob, name); ok {
+				return true
+			}
+		}
+		return false
+	}, nil
+}
@@ -0,0 +1,94 @@
+// Copyright (c) 2021 Andrew Archibald
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/andrewarchi/urlhero/escrow"
+	"github.com/andrewarchi/urlhero/index"
+	"github.com/andrewarchi/urlhero/xz"
+)
+
+var escrowCmd = &command{
+	name:  "escrow",
+	usage: "[-index dir] [-release id] <shortener> <dump.csv[.xz]>...",
+	run:   runEscrow,
+}
+
+func runEscrow(cmd *command, args []string) error {
+	fs := newFlagSet(cmd)
+	indexDir := fs.String("index", dataDir().Index(), "index directory")
+	release := fs.String("release", "301works", "release that the mappings are attributed to, such as the 301Works item")
+	parseFlags(fs, args)
+	if fs.NArg() < 2 || *release == "" {
+		usageExit(fs)
+	}
+	s, err := lookupShortener(fs.Arg(0), "")
+	if err != nil {
+		return &inputError{err}
+	}
+
+	if data := dataDir(); *indexDir == data.Index() {
+		lock, err := data.Lock()
+		if err != nil {
+			return err
+		}
+		defer lock.Unlock()
+	}
+
+	out := newOutput(os.Stdout)
+	b := index.NewBuilder()
+	b.MemLimit, b.TempDir = index.DefaultMemLimit, filepath.Dir(*indexDir)
+	total := 0
+	for _, filename := range fs.Args()[1:] {
+		n, err := importEscrow(b, s.Host, *release, filename)
+		if err != nil {
+			b.Close()
+			out.Close()
+			return err
+		}
+		total += n
+		out.Record(struct {
+			File     string `json:"file"`
+			Mappings int    `json:"mappings"`
+		}{filename, n}, "%s\t%d mappings\n", filename, n)
+	}
+	if err := b.WriteSegment(*indexDir); err != nil {
+		out.Close()
+		return err
+	}
+	out.Summary(struct {
+		Host     string `json:"host"`
+		Release  string `json:"release"`
+		Mappings int    `json:"mappings"`
+	}{s.Host, *release, total}, "imported %d mappings of %s into %s\n", total, s.Host, *indexDir)
+	return out.Close()
+}
+
+// importEscrow adds the mappings of a dump, which is decompressed when
+// it has the .xz extension.
+func importEscrow(b *index.Builder, host, release, filename string) (int, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return 0, &inputError{err}
+	}
+	defer f.Close()
+	var r io.Reader = f
+	if strings.HasSuffix(filename, ".xz") {
+		xr, err := xz.NewReader(f)
+		if err != nil {
+			return 0, err
+		}
+		defer xr.Close()
+		r = xr
+	}
+	return escrow.Import(b, host, release, r)
+}
@@ -0,0 +1,105 @@
+// Copyright (c) 2021 Andrew Archibald
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"net"
+	"os"
+
+	"github.com/andrewarchi/urlhero/ia"
+	"github.com/andrewarchi/urlhero/index"
+	"github.com/andrewarchi/urlhero/report"
+	"github.com/andrewarchi/urlhero/shorteners"
+	"github.com/andrewarchi/urlhero/tinytown"
+)
+
+// Exit codes distinguish classes of failure, so that automation can
+// branch on the failure type.
+const (
+	exitOK      = 0
+	exitFailure = 1 // unclassified failure
+	exitUsage   = 2 // invalid command-line usage
+	exitPartial = 3 // some items failed, but output was produced
+	exitVerify  = 4 // checksum or integrity verification failed
+	exitNetwork = 5 // network or remote service failure
+	exitInput   = 6 // malformed or missing input data
+)
+
+// partialError indicates that a command produced output despite some
+// failures.
+type partialError struct{ err error }
+
+func (err *partialError) Error() string { return err.err.Error() }
+func (err *partialError) Unwrap() error { return err.err }
+
+// inputError indicates that a command was given bad input.
+type inputError struct{ err error }
+
+func (err *inputError) Error() string { return err.err.Error() }
+func (err *inputError) Unwrap() error { return err.err }
+
+// classify returns the exit code and class name for an error.
+func classify(err error) (int, string) {
+	var (
+		partialErr  *partialError
+		inputErr    *inputError
+		checksumErr *ia.ChecksumError
+		statusErr   *ia.StatusError
+		trackerErr  *tinytown.StatusError
+		patternErr  *shorteners.PatternError
+		pathErr     *fs.PathError
+		netErr      net.Error
+		syntaxErr   *json.SyntaxError
+	)
+	switch {
+	case err == nil:
+		return exitOK, "ok"
+	case errors.As(err, &partialErr):
+		return exitPartial, "partial"
+	case errors.As(err, &checksumErr):
+		return exitVerify, "verification"
+	// Check input before network, so that failures of local files, which
+	// may wrap the same syscall errors as network failures, are input
+	case errors.As(err, &inputErr), errors.As(err, &syntaxErr),
+		errors.As(err, &patternErr), errors.Is(err, shorteners.ErrNoHost),
+		errors.Is(err, index.ErrFormat), errors.Is(err, zip.ErrFormat),
+		errors.Is(err, tinytown.ErrFormat), errors.As(err, &pathErr),
+		errors.Is(err, os.ErrNotExist):
+		return exitInput, "input"
+	case errors.As(err, &statusErr), errors.As(err, &trackerErr), errors.As(err, &netErr):
+		return exitNetwork, "network"
+	}
+	return exitFailure, "failure"
+}
+
+// errorSummary is the machine-readable summary of a failed run, written
+// to stderr with the -error-summary flag.
+type errorSummary struct {
+	Command  string `json:"command"`
+	ExitCode int    `json:"exit_code"`
+	Class    string `json:"class"`
+	Error    string `json:"error,omitempty"`
+	// Report is the run report, for commands in which some items failed.
+	Report *report.Summary `json:"report,omitempty"`
+}
+
+func writeErrorSummary(command string, err error) {
+	code, class := classify(err)
+	s := errorSummary{Command: command, ExitCode: code, Class: class}
+	if err != nil {
+		s.Error = err.Error()
+	}
+	var reportErr *report.Error
+	if errors.As(err, &reportErr) {
+		s.Report = &reportErr.Summary
+	}
+	json.NewEncoder(os.Stderr).Encode(s)
+}
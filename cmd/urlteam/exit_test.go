@@ -0,0 +1,37 @@
+// Copyright (c) 2021 Andrew Archibald
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"syscall"
+	"testing"
+)
+
+func TestClassify(t *testing.T) {
+	tests := []struct {
+		err  error
+		code int
+	}{
+		{nil, exitOK},
+		{errors.New("boom"), exitFailure},
+		{&partialError{errors.New("some failed")}, exitPartial},
+		{&fs.PathError{Op: "open", Path: "releases", Err: fs.ErrNotExist}, exitInput},
+		{&fs.PathError{Op: "read", Path: "releases", Err: syscall.EIO}, exitInput},
+		{fmt.Errorf("process: %w", &fs.PathError{Op: "open", Path: "x.zip", Err: fs.ErrPermission}), exitInput},
+		{&net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}, exitNetwork},
+		{&net.DNSError{Err: "no such host", Name: "archive.org"}, exitNetwork},
+	}
+	for _, tt := range tests {
+		if code, class := classify(tt.err); code != tt.code {
+			t.Errorf("classify(%v) = %d (%s), want %d", tt.err, code, class, tt.code)
+		}
+	}
+}
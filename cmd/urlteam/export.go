@@ -0,0 +1,91 @@
+// Copyright (c) 2021 Andrew Archibald
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/andrewarchi/urlhero/tinytown"
+)
+
+var exportCmd = &command{
+	name:  "export",
+	usage: "[-format csv|tsv|jsonl] [-host host] [-o file] [index or releases]",
+	run:   runExport,
+}
+
+func runExport(cmd *command, args []string) error {
+	fs := newFlagSet(cmd)
+	formatName := fs.String("format", "csv", "export mappings as `csv`, tsv, or jsonl, with the project and release time of each")
+	host := fs.String("host", "", "only export the given shortener name or host")
+	outFile := fs.String("o", "", "write the export to `file` instead of stdout")
+	parseFlags(fs, args)
+	if fs.NArg() > 1 {
+		usageExit(fs)
+	}
+	src := dataDir().Releases()
+	if fs.NArg() == 1 {
+		src = fs.Arg(0)
+	}
+	var newWriter func(io.Writer) tinytown.ExportWriter
+	switch *formatName {
+	case "csv":
+		newWriter = func(w io.Writer) tinytown.ExportWriter { return tinytown.NewCSVWriter(w) }
+	case "tsv":
+		newWriter = func(w io.Writer) tinytown.ExportWriter { return tinytown.NewTSVWriter(w) }
+	case "jsonl":
+		newWriter = func(w io.Writer) tinytown.ExportWriter { return tinytown.NewJSONLWriter(w) }
+	default:
+		return &inputError{fmt.Errorf("unknown export format %q", *formatName)}
+	}
+	if *host != "" {
+		s, err := lookupShortener(*host, "")
+		if err != nil {
+			return &inputError{err}
+		}
+		*host = s.Host
+	}
+
+	// Progress and the summary go to stderr when the export is on stdout
+	var f io.Writer = os.Stdout
+	out := newOutput(os.Stderr)
+	if *outFile != "" {
+		file, err := os.Create(*outFile)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		f = file
+		out = newOutput(os.Stdout)
+	}
+	w := newWriter(f)
+	var n int64
+	err := scanMappings(out, "exporting", src, *host, func(m mapping) error {
+		n++
+		return w.Write(tinytown.ExportRecord{Shortener: m.Host, Shortcode: m.Shortcode, Target: m.Target, Release: m.Release, Project: m.Project})
+	})
+	if err == nil {
+		err = w.Flush()
+	}
+	if err != nil {
+		out.Close()
+		return err
+	}
+	if file, ok := f.(*os.File); ok && file != os.Stdout {
+		if err := file.Close(); err != nil {
+			out.Close()
+			return err
+		}
+	}
+	out.Summary(struct {
+		Format   string `json:"format"`
+		Mappings int64  `json:"mappings"`
+	}{*formatName, n}, "exported %d mappings as %s\n", n, *formatName)
+	return out.Close()
+}
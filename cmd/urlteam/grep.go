@@ -0,0 +1,86 @@
+// Copyright (c) 2021 Andrew Archibald
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"os"
+	"regexp"
+	"strings"
+)
+
+var grepCmd = &command{
+	name:  "grep",
+	usage: "[-E] [-i] [-host host] <pattern> [index or releases]",
+	run:   runGrep,
+}
+
+func runGrep(cmd *command, args []string) error {
+	fs := newFlagSet(cmd)
+	isRegexp := fs.Bool("E", false, "interpret pattern as a regular expression instead of a substring")
+	ignoreCase := fs.Bool("i", false, "match case-insensitively")
+	host := fs.String("host", "", "only search the given shortener name or host")
+	parseFlags(fs, args)
+	if fs.NArg() < 1 || fs.NArg() > 2 {
+		usageExit(fs)
+	}
+	src := dataDir().Index()
+	if fs.NArg() == 2 {
+		src = fs.Arg(1)
+	}
+
+	match, err := compileMatcher(fs.Arg(0), *isRegexp, *ignoreCase)
+	if err != nil {
+		return &inputError{err}
+	}
+	if *host != "" {
+		s, err := lookupShortener(*host, "")
+		if err != nil {
+			return &inputError{err}
+		}
+		*host = s.Host
+	}
+
+	out := newOutput(os.Stdout)
+	n := 0
+	err = scanMappings(out, "searching", src, *host, func(m mapping) error {
+		if !match(m.Target) {
+			return nil
+		}
+		n++
+		return out.Record(m, "%s %s %s\n", m.Host, m.Shortcode, m.Target)
+	})
+	if err != nil {
+		out.Close()
+		return err
+	}
+	out.Summary(struct {
+		Matches int `json:"matches"`
+	}{n}, "%d matches\n", n)
+	return out.Close()
+}
+
+func compileMatcher(pattern string, isRegexp, ignoreCase bool) (func(string) bool, error) {
+	if !isRegexp {
+		if ignoreCase {
+			pattern = strings.ToLower(pattern)
+			return func(s string) bool {
+				return strings.Contains(strings.ToLower(s), pattern)
+			}, nil
+		}
+		return func(s string) bool {
+			return strings.Contains(s, pattern)
+		}, nil
+	}
+	if ignoreCase {
+		pattern = "(?i)" + pattern
+	}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return nil, err
+	}
+	return re.MatchString, nil
+}
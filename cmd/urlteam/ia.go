@@ -0,0 +1,93 @@
+// Copyright (c) 2021 Andrew Archibald
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/andrewarchi/urlhero/ia"
+	"github.com/andrewarchi/urlhero/shorteners"
+)
+
+var iaCmd = &command{
+	name:  "ia",
+	usage: "[-alphabet chars] [-from date] [-to date] [-cdx] [-o file] <shortener>",
+	run:   runIA,
+}
+
+func runIA(cmd *command, args []string) error {
+	fs := newFlagSet(cmd)
+	alphabet := fs.String("alphabet", "", "shortcode alphabet for an unregistered host")
+	from := fs.String("from", "", "earliest capture date, e.g. 2015 or 2015-06-01")
+	to := fs.String("to", "", "latest capture date, e.g. 2020 or 2020-12-31")
+	cdx := fs.Bool("cdx", false, "query the CDX server instead of the timemap API")
+	outFile := fs.String("o", "", "file to write shortcodes to, instead of stdout")
+	parseFlags(fs, args)
+	if fs.NArg() != 1 {
+		usageExit(fs)
+	}
+
+	s, err := lookupShortener(fs.Arg(0), *alphabet)
+	if err != nil {
+		return &inputError{err}
+	}
+	options := &shorteners.IAOptions{UseCDX: *cdx}
+	if options.From, err = parseTimestamp(*from); err != nil {
+		return &inputError{err}
+	}
+	if options.To, err = parseTimestamp(*to); err != nil {
+		return &inputError{err}
+	}
+
+	var w io.Writer = os.Stdout
+	if *outFile != "" {
+		f, err := os.Create(*outFile)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	out := newOutput(w)
+	shortcodes, err := s.GetIAShortcodesOptions(options)
+	for _, shortcode := range shortcodes {
+		out.Record(struct {
+			Host      string `json:"host"`
+			Shortcode string `json:"shortcode"`
+		}{s.Host, shortcode}, "%s\n", shortcode)
+	}
+	out.Summary(struct {
+		Host       string `json:"host"`
+		Shortcodes int    `json:"shortcodes"`
+	}{s.Host, len(shortcodes)}, "%d shortcodes\n", len(shortcodes))
+	if err != nil && len(shortcodes) != 0 {
+		// Some URLs could not be cleaned
+		err = &partialError{err}
+	}
+	if err1 := out.Close(); err == nil {
+		err = err1
+	}
+	return err
+}
+
+// parseTimestamp converts a date, such as "2015-06-01", to a Wayback
+// Machine timestamp prefix, such as "20150601".
+func parseTimestamp(date string) (string, error) {
+	ts := strings.NewReplacer("-", "", ":", "", " ", "", "T", "").Replace(date)
+	if len(ts) > len(ia.TimestampFormat) {
+		return "", fmt.Errorf("invalid date: %q", date)
+	}
+	for i := 0; i < len(ts); i++ {
+		if ts[i] < '0' || ts[i] > '9' {
+			return "", fmt.Errorf("invalid date: %q", date)
+		}
+	}
+	return ts, nil
+}
@@ -0,0 +1,85 @@
+// Copyright (c) 2021 Andrew Archibald
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/andrewarchi/urlhero/index"
+	"github.com/andrewarchi/urlhero/logger"
+)
+
+var indexCmd = &command{
+	name:  "index",
+	usage: "[-releases dir] [-index dir] [-index-format format] [release...]",
+	run:   runIndex,
+}
+
+func runIndex(cmd *command, args []string) error {
+	fs := newFlagSet(cmd)
+	data := dataDir()
+	releasesDir := fs.String("releases", data.Releases(), "directory of downloaded releases")
+	indexDir := fs.String("index", data.Index(), "index directory to update")
+	formatName := fs.String("index-format", "plain", "format of index files: plain, compact (smaller, slower to build), or columnar (faster scans of target hosts)")
+	parseFlags(fs, args)
+	format, err := index.ParseFormat(*formatName)
+	if err != nil {
+		return &inputError{err}
+	}
+
+	if *releasesDir == data.Releases() || *indexDir == data.Index() {
+		lock, err := data.Lock()
+		if err != nil {
+			return err
+		}
+		defer lock.Unlock()
+	}
+	ctx, stop := interruptContext()
+	defer stop()
+
+	// Without releases, every release that is not yet indexed is added.
+	// Updates interrupted by a crash resume from their last batch.
+	releases := fs.Args()
+	if len(releases) == 0 {
+		if releases, err = index.UnindexedReleases(*indexDir, *releasesDir); err != nil {
+			return err
+		}
+		logger.Info("listed unindexed releases", "releases", len(releases))
+	}
+	var filenames []string
+	for _, id := range releases {
+		projects, err := findProjects(filepath.Join(*releasesDir, id))
+		if err != nil {
+			return err
+		}
+		filenames = append(filenames, projects...)
+	}
+	sizes, total, err := projectSizes(filenames)
+	if err != nil {
+		return err
+	}
+	out := newOutput(os.Stdout)
+	p := newProgress(out, "index", len(filenames), total)
+	opts := &index.BuildOptions{Format: format, WALDir: *indexDir + ".wal"}
+	indexed, err := index.UpdateContext(withProjectProgress(ctx, p, filenames, sizes), *indexDir, *releasesDir, releases, opts)
+	p.done()
+	for _, id := range indexed {
+		out.Record(struct {
+			Release string `json:"release"`
+		}{id}, "indexed %s\n", id)
+	}
+	if err != nil {
+		out.Close()
+		return err
+	}
+	out.Summary(struct {
+		Index   string `json:"index"`
+		Indexed int    `json:"indexed"`
+	}{*indexDir, len(indexed)}, "indexed %d releases in %s\n", len(indexed), *indexDir)
+	return out.Close()
+}
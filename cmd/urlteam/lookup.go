@@ -0,0 +1,377 @@
+// Copyright (c) 2021 Andrew Archibald
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/andrewarchi/urlhero/index"
+	"github.com/andrewarchi/urlhero/logger"
+	"github.com/andrewarchi/urlhero/report"
+	"github.com/andrewarchi/urlhero/shorteners"
+)
+
+var lookupCmd = &command{
+	name: "lookup",
+	usage: "[-index dir] [-limit n] [-after shortcode] [-provenance] <shortener> <shortcode or prefix*>...\n" +
+		"\turlteam [global flags] lookup [-index dir] [-provenance] <short URL>\n" +
+		"\turlteam [global flags] lookup -stdin [-index dir] [-batch n] [-workers n] [-unordered] [shortener]",
+	run: runLookup,
+}
+
+type lookupResult struct {
+	Host      string     `json:"host"`
+	Shortcode string     `json:"shortcode"`
+	Target    string     `json:"target,omitempty"`
+	Found     bool       `json:"found"`
+	Releases  []string   `json:"releases,omitempty"`   // with -provenance
+	FirstSeen *time.Time `json:"first_seen,omitempty"` // with -provenance
+	LastSeen  *time.Time `json:"last_seen,omitempty"`  // with -provenance
+	Input     string     `json:"input,omitempty"`      // line read with -stdin
+	Error     string     `json:"error,omitempty"`      // invalid -stdin line
+}
+
+func runLookup(cmd *command, args []string) error {
+	fs := newFlagSet(cmd)
+	indexDir := fs.String("index", dataDir().Index(), "index directory")
+	limit := fs.Int("limit", 100, "maximum number of results per prefix query, or 0 for no limit")
+	after := fs.String("after", "", "return prefix results after this shortcode, to continue a previous query")
+	provenance := fs.Bool("provenance", false, "show the releases that archived each target and when it was first and last seen, from the provenance log")
+	stdin := fs.Bool("stdin", false, "look up shortcodes or short URLs, one per line, read from stdin")
+	batch := fs.Int("batch", 4096, "number of -stdin lines to look up per batch")
+	workers := fs.Int("workers", runtime.GOMAXPROCS(0), "number of -stdin batches to look up concurrently")
+	unordered := fs.Bool("unordered", false, "write -stdin results as batches complete instead of in input order")
+	parseFlags(fs, args)
+	args = fs.Args()
+	if !*stdin && len(args) == 1 && strings.Contains(args[0], "/") {
+		// A short URL, rather than a shortener and shortcodes
+		host, shortcode, err := shorteners.ParseShortURL(args[0])
+		if err != nil {
+			return &inputError{err}
+		}
+		if shortcode == "" {
+			return &inputError{fmt.Errorf("no shortcode in short URL %q", args[0])}
+		}
+		args = []string{host, shortcode}
+	}
+	if *stdin {
+		if len(args) > 1 || *batch < 1 || *workers < 1 {
+			usageExit(fs)
+		}
+	} else if len(args) < 2 || *limit < 0 {
+		usageExit(fs)
+	}
+	var s *shorteners.Shortener
+	if len(args) != 0 {
+		var err error
+		s, err = lookupShortener(args[0], "")
+		if err != nil {
+			return &inputError{err}
+		}
+	}
+	idx, err := index.Open(*indexDir)
+	if err != nil {
+		return err
+	}
+	defer idx.Close()
+	if *stdin {
+		return lookupStdin(idx, s, *batch, *workers, *unordered)
+	}
+	r := idx.Reader(s.Host)
+	if r == nil {
+		return &inputError{fmt.Errorf("host %s not in index %s", s.Host, *indexDir)}
+	}
+
+	var prov *index.ProvenanceCursor
+	if *provenance {
+		if p := r.Provenance(); p != nil {
+			prov = p.Cursor()
+		} else {
+			logger.Warn("no provenance log for host", "host", s.Host)
+		}
+	}
+
+	out := newOutput(os.Stdout)
+	var found, missing int
+	var next string
+	for _, arg := range args[1:] {
+		if prefix := strings.TrimSuffix(arg, "*"); prefix != arg {
+			cursor, err := lookupPrefix(out, r, prov, s.Host, prefix, *after, *limit, &found)
+			if err != nil {
+				out.Close()
+				return err
+			}
+			if cursor != "" {
+				next = cursor
+			}
+			continue
+		}
+		target, ok, err := r.Lookup(arg)
+		if err != nil {
+			out.Close()
+			return err
+		}
+		if ok {
+			found++
+			if err := writeFound(out, prov, lookupResult{Host: s.Host, Shortcode: arg, Target: target, Found: true}); err != nil {
+				out.Close()
+				return err
+			}
+		} else {
+			missing++
+			out.Record(lookupResult{Host: s.Host, Shortcode: arg}, "%s\t(not found)\n", arg)
+		}
+	}
+
+	summary := struct {
+		Found   int    `json:"found"`
+		Missing int    `json:"missing"`
+		Next    string `json:"next,omitempty"` // cursor for -after
+	}{found, missing, next}
+	if next != "" {
+		out.Summary(summary, "%d found, %d missing; more results with -after %s\n", found, missing, next)
+	} else {
+		out.Summary(summary, "%d found, %d missing\n", found, missing)
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	if missing != 0 {
+		return &partialError{fmt.Errorf("%d shortcodes not found", missing)}
+	}
+	return nil
+}
+
+// lookupPrefix writes a page of records with shortcodes starting with
+// prefix and returns the cursor for the next page, if any.
+func lookupPrefix(out *output, r *index.Reader, prov *index.ProvenanceCursor, host, prefix, after string, limit int, found *int) (string, error) {
+	records, next, err := r.Page(prefix, after, limit)
+	if err != nil {
+		return "", err
+	}
+	for _, rec := range records {
+		*found++
+		if err := writeFound(out, prov, lookupResult{Host: host, Shortcode: rec.Shortcode, Target: rec.Target, Found: true}); err != nil {
+			return "", err
+		}
+	}
+	return next, nil
+}
+
+// writeFound writes a result that was found, with its releases and
+// the dates that it was first and last seen, when prov is set, as more
+// columns.
+func writeFound(out *output, prov *index.ProvenanceCursor, res lookupResult) error {
+	if prov == nil {
+		out.Record(res, "%s\t%s\n", res.Shortcode, res.Target)
+		return nil
+	}
+	o, err := prov.Origin(res.Shortcode, res.Target)
+	if err != nil {
+		return err
+	}
+	res.Releases = o.Releases
+	first, last := "-", "-"
+	if !o.FirstSeen.IsZero() {
+		res.FirstSeen, res.LastSeen = &o.FirstSeen, &o.LastSeen
+		first, last = o.FirstSeen.Format("2006-01-02"), o.LastSeen.Format("2006-01-02")
+	}
+	out.Record(res, "%s\t%s\t%s\t%s\t%s\n", res.Shortcode, res.Target, strings.Join(res.Releases, ","), first, last)
+	return nil
+}
+
+// lookupBatch is a batch of -stdin lines and their results.
+type lookupBatch struct {
+	seq     int
+	results []lookupResult
+	bytes   int64 // bytes of the lines read
+}
+
+// lookupStdin streams shortcodes or short URLs from stdin through the
+// index in batches. Bare shortcodes are looked up on the shortener s.
+// Progress is reported as batches are looked up, with the size of stdin
+// as the total, when it is a file.
+func lookupStdin(idx *index.Index, s *shorteners.Shortener, batchSize, workers int, unordered bool) error {
+	var size int64
+	if fi, err := os.Stdin.Stat(); err == nil && fi.Mode().IsRegular() {
+		size = fi.Size()
+	}
+	out := newOutput(os.Stdout)
+	p := newProgress(out, "lookup", 0, size)
+	batches := make(chan *lookupBatch)
+	done := make(chan *lookupBatch)
+	var readErr error
+	go func() {
+		defer close(batches)
+		sc := bufio.NewScanner(os.Stdin)
+		sc.Buffer(make([]byte, 64*1024), 1024*1024)
+		b := &lookupBatch{}
+		for sc.Scan() {
+			b.bytes += int64(len(sc.Bytes())) + 1
+			line := strings.TrimSpace(sc.Text())
+			if line == "" {
+				continue
+			}
+			b.results = append(b.results, parseLookupLine(line, s))
+			if len(b.results) == batchSize {
+				batches <- b
+				b = &lookupBatch{seq: b.seq + 1}
+			}
+		}
+		if len(b.results) != 0 {
+			batches <- b
+		}
+		readErr = sc.Err()
+	}()
+	var wg sync.WaitGroup
+	errs := make(chan error, workers)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for b := range batches {
+				if err := lookupResults(idx, b.results); err != nil {
+					errs <- err
+					// Drain, so that the reader is not blocked
+					for range batches {
+					}
+					return
+				}
+				p.addRecords(int64(len(b.results)))
+				p.finishItem(b.bytes)
+				done <- b
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	var found, missing, invalid int
+	rep := report.New("resolve")
+	// Lookups in the index do not fail, so only malformed lines do
+	rep.Classify = func(error) string { return report.ClassInput }
+	write := func(b *lookupBatch) {
+		for _, r := range b.results {
+			switch {
+			case r.Error != "":
+				invalid++
+				rep.Fail(r.Input, errors.New(r.Error))
+				out.Record(r, "%s\t(%s)\n", r.Input, r.Error)
+			case r.Found:
+				found++
+				rep.Succeed(1)
+				out.Record(r, "%s\t%s\n", r.Input, r.Target)
+			default:
+				missing++
+				rep.Skip(r.Input, "not found")
+				out.Record(r, "%s\t(not found)\n", r.Input)
+			}
+		}
+	}
+	pending := make(map[int]*lookupBatch)
+	next := 0
+	for b := range done {
+		if unordered {
+			write(b)
+			continue
+		}
+		pending[b.seq] = b
+		for b, ok := pending[next]; ok; b, ok = pending[next] {
+			write(b)
+			delete(pending, next)
+			next++
+		}
+	}
+	p.done()
+	select {
+	case err := <-errs:
+		out.Close()
+		return err
+	default:
+	}
+	if readErr != nil {
+		out.Close()
+		return readErr
+	}
+
+	rep.Finish()
+	out.Summary(struct {
+		Found   int            `json:"found"`
+		Missing int            `json:"missing"`
+		Invalid int            `json:"invalid"`
+		Report  *report.Report `json:"report"`
+	}{found, missing, invalid, rep}, "%d found, %d missing, %d invalid\n", found, missing, invalid)
+	if err := out.Close(); err != nil {
+		return err
+	}
+	if err := rep.Err(); err != nil {
+		return &partialError{err}
+	}
+	if missing != 0 {
+		return &partialError{fmt.Errorf("%d of %d lines not found", missing, found+missing)}
+	}
+	return nil
+}
+
+// parseLookupLine parses a line of -stdin input, which is either a
+// short URL or a bare shortcode for the shortener s.
+func parseLookupLine(line string, s *shorteners.Shortener) lookupResult {
+	r := lookupResult{Shortcode: line, Input: line}
+	if !strings.Contains(line, "://") {
+		if s == nil {
+			r.Error = "shortcode without shortener"
+		} else {
+			r.Host = s.Host
+		}
+		return r
+	}
+	var err error
+	r.Host, r.Shortcode, err = shorteners.ParseShortURL(line)
+	if err != nil {
+		r.Error = err.Error()
+	} else if r.Shortcode == "" {
+		r.Error = "no shortcode in URL"
+	}
+	return r
+}
+
+// lookupResults fills in the targets of the results, grouped by host.
+func lookupResults(idx *index.Index, results []lookupResult) error {
+	byHost := make(map[string][]int)
+	for i, r := range results {
+		if r.Error == "" {
+			byHost[r.Host] = append(byHost[r.Host], i)
+		}
+	}
+	for host, is := range byHost {
+		r := idx.Reader(host)
+		if r == nil {
+			continue
+		}
+		shortcodes := make([]string, len(is))
+		for j, i := range is {
+			shortcodes[j] = results[i].Shortcode
+		}
+		targets, found, err := r.LookupBatch(shortcodes)
+		if err != nil {
+			return err
+		}
+		for j, i := range is {
+			results[i].Target, results[i].Found = targets[j], found[j]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,197 @@
+// Copyright (c) 2021 Andrew Archibald
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Command urlteam works with URLTeam releases, indexes, and the
+// registered URL shorteners.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"sort"
+	"syscall"
+	"time"
+
+	"github.com/andrewarchi/urlhero/logger"
+	"github.com/andrewarchi/urlhero/tracing"
+	"github.com/andrewarchi/urlhero/xz"
+)
+
+type command struct {
+	name  string
+	usage string
+	run   func(cmd *command, args []string) error
+}
+
+var commands = []*command{
+	compactCmd,
+	conflictsCmd,
+	diffCmd,
+	doctorCmd,
+	downloadCmd,
+	escrowCmd,
+	exportCmd,
+	grepCmd,
+	iaCmd,
+	indexCmd,
+	lookupCmd,
+	mergeCmd,
+	migrateCmd,
+	processCmd,
+	sampleCmd,
+	serveCmd,
+	shortenersCmd,
+	spamCmd,
+	statsCmd,
+	watchCmd,
+}
+
+func main() {
+	jsonOut := flag.Bool("json", false, "print output as a single JSON document")
+	ndjsonOut := flag.Bool("ndjson", false, "print output as JSON lines of records, progress, and summary events")
+	configFile := flag.String("config", defaultConfigFile(), "config file")
+	verbose := flag.Bool("v", false, "log debug messages")
+	flag.BoolVar(&quiet, "q", false, "only log warnings and errors and omit progress")
+	logFormat := flag.String("log-format", "text", "log format: text or json")
+	xzBackend := flag.String("xz", "auto", "xz decompression backend: auto, go, xz, or liblzma")
+	errSummary := flag.Bool("error-summary", false, "write a JSON summary of the result to stderr at the end of the run")
+	flag.Usage = printUsage
+	flag.Parse()
+	level := logger.LevelInfo
+	switch {
+	case *verbose && quiet:
+		printUsage()
+	case *verbose:
+		level = logger.LevelDebug
+	case quiet:
+		level = logger.LevelWarn
+	}
+	switch *logFormat {
+	case "text":
+		logger.Default = logger.NewText(os.Stderr, level)
+	case "json":
+		logger.Default = logger.NewJSON(os.Stderr, level)
+	default:
+		printUsage()
+	}
+	backend, err := xz.ParseBackend(*xzBackend)
+	if err != nil {
+		printUsage()
+	}
+	if !backend.Available() {
+		fmt.Fprintf(os.Stderr, "urlteam: xz backend %s unavailable\n", backend)
+		os.Exit(exitInput)
+	}
+	xz.DefaultBackend = backend
+	explicit := false
+	flag.Visit(func(f *flag.Flag) {
+		explicit = explicit || f.Name == "config"
+	})
+	if err := loadConfig(*configFile, explicit || os.Getenv("URLTEAM_CONFIG") != ""); err != nil {
+		fmt.Fprintf(os.Stderr, "urlteam: %v\n", err)
+		os.Exit(exitInput)
+	}
+	if flag.NArg() < 1 {
+		printUsage()
+	}
+	switch {
+	case *jsonOut && *ndjsonOut:
+		printUsage()
+	case *jsonOut:
+		format = jsonFormat
+	case *ndjsonOut:
+		format = ndjsonFormat
+	}
+	var cmd *command
+	for _, c := range commands {
+		if c.name == flag.Arg(0) {
+			cmd = c
+		}
+	}
+	if cmd == nil {
+		printUsage()
+	}
+	shutdown, err := setupTracing()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "urlteam: %v\n", err)
+		os.Exit(exitInput)
+	}
+	err = cmd.run(cmd, flag.Args()[1:])
+	shutdown()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "urlteam %s: %v\n", cmd.name, err)
+	}
+	if *errSummary {
+		writeErrorSummary(cmd.name, err)
+	}
+	code, _ := classify(err)
+	os.Exit(code)
+}
+
+// setupTracing exports spans, when configured. The returned function
+// flushes them.
+func setupTracing() (shutdown func(), err error) {
+	t := cfg.Tracing
+	if t.Endpoint == "" && os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") == "" &&
+		os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") == "" {
+		return func() {}, nil
+	}
+	stop, err := tracing.Setup(context.Background(), &tracing.Config{
+		Endpoint:    t.Endpoint,
+		Insecure:    t.Insecure,
+		SampleRatio: t.SampleRatio,
+		ServiceName: t.ServiceName,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("config: tracing: %w", err)
+	}
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := stop(ctx); err != nil {
+			logger.Warn("flushing spans failed", "err", err)
+		}
+	}, nil
+}
+
+func printUsage() {
+	fmt.Fprintln(os.Stderr, "Usage:")
+	sort.Slice(commands, func(i, j int) bool {
+		return commands[i].name < commands[j].name
+	})
+	for _, c := range commands {
+		fmt.Fprintf(os.Stderr, "\turlteam [global flags] %s %s\n", c.name, c.usage)
+	}
+	fmt.Fprintln(os.Stderr, "Global flags:")
+	flag.PrintDefaults()
+	os.Exit(exitUsage)
+}
+
+// newFlagSet constructs a flag set for a subcommand that prints its
+// usage and exits on error.
+func newFlagSet(cmd *command) *flag.FlagSet {
+	fs := flag.NewFlagSet(cmd.name, flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage:\n\turlteam [global flags] %s %s\n", cmd.name, cmd.usage)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+// interruptContext returns a context that is canceled on an interrupt
+// or termination signal, so that long runs stop cleanly.
+func interruptContext() (context.Context, context.CancelFunc) {
+	return signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+}
+
+// usageExit prints the usage of a subcommand and exits.
+func usageExit(fs *flag.FlagSet) {
+	fs.Usage()
+	os.Exit(exitUsage)
+}
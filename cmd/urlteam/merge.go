@@ -0,0 +1,63 @@
+// Copyright (c) 2021 Andrew Archibald
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"os"
+
+	"github.com/andrewarchi/urlhero/tinytown"
+)
+
+var mergeCmd = &command{
+	name:  "merge",
+	usage: "[-releases dir] [-policy last|first] [-mem MiB] out-dir",
+	run:   runMerge,
+}
+
+func runMerge(cmd *command, args []string) error {
+	fs := newFlagSet(cmd)
+	data := dataDir()
+	releasesDir := fs.String("releases", data.Releases(), "directory of downloaded releases")
+	policyName := fs.String("policy", "last", "keep the mapping of the `last` or first release of shortcodes in several")
+	mem := fs.Int("mem", tinytown.DefaultMergeMemory>>20, "hold at most this many `MiB` of mappings in memory before spilling them to disk")
+	parseFlags(fs, args)
+	if fs.NArg() != 1 || *mem < 1 {
+		usageExit(fs)
+	}
+	policy, err := tinytown.ParseMergePolicy(*policyName)
+	if err != nil {
+		return &inputError{err}
+	}
+
+	if *releasesDir == data.Releases() {
+		lock, err := data.Lock()
+		if err != nil {
+			return err
+		}
+		defer lock.Unlock()
+	}
+	ctx, stop := interruptContext()
+	defer stop()
+
+	out := newOutput(os.Stdout)
+	merged, err := tinytown.MergeReleases(ctx, *releasesDir, fs.Arg(0), &tinytown.MergeOptions{Policy: policy, MemLimit: *mem << 20})
+	var mappings int64
+	for _, m := range merged {
+		mappings += m.Mappings
+		out.Record(m, "%s\t%d mappings\t%d duplicates\t%s\n", m.Host, m.Mappings, m.Duplicates, m.Filename)
+	}
+	if err != nil {
+		out.Close()
+		return err
+	}
+	out.Summary(struct {
+		Dir        string `json:"dir"`
+		Shorteners int    `json:"shorteners"`
+		Mappings   int64  `json:"mappings"`
+	}{fs.Arg(0), len(merged), mappings}, "merged %d mappings of %d shorteners to %s\n", mappings, len(merged), fs.Arg(0))
+	return out.Close()
+}
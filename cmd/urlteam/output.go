@@ -0,0 +1,158 @@
+// Copyright (c) 2021 Andrew Archibald
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+)
+
+// outputFormat is the format of command output, selected by the global
+// -json and -ndjson flags.
+type outputFormat uint8
+
+const (
+	textFormat   outputFormat = iota
+	jsonFormat                // single JSON document with records and summary
+	ndjsonFormat              // one JSON event per line
+)
+
+var format outputFormat
+
+// quiet suppresses progress in text format.
+var quiet bool
+
+// output writes the records, progress events, and summary of a command
+// in the selected format. In text format, records are printed to the
+// writer and progress and summaries to stderr. In JSON format, records
+// are streamed as they are written, in a document that Close completes
+// with the summary.
+type output struct {
+	w       *bufio.Writer
+	e       *json.Encoder
+	records int // written in JSON format
+	summary interface{}
+	err     error
+}
+
+type event struct {
+	Type     string      `json:"type"` // "record", "progress", or "summary"
+	Record   interface{} `json:"record,omitempty"`
+	Progress interface{} `json:"progress,omitempty"`
+	Summary  interface{} `json:"summary,omitempty"`
+}
+
+func newOutput(w io.Writer) *output {
+	bw := bufio.NewWriter(w)
+	return &output{w: bw, e: json.NewEncoder(bw)}
+}
+
+// text reports whether output is human-readable text.
+func (o *output) text() bool {
+	return format == textFormat
+}
+
+// Record writes a record. In text format, it is printed with fmt.Fprintf
+// using the format string and args.
+func (o *output) Record(v interface{}, text string, args ...interface{}) error {
+	switch format {
+	case jsonFormat:
+		if o.records == 0 {
+			o.printf(o.w, "{\n  \"records\": [\n    ")
+		} else {
+			o.printf(o.w, ",\n    ")
+		}
+		o.records++
+		o.marshal(v, "    ")
+	case ndjsonFormat:
+		o.encode(event{Type: "record", Record: v})
+	default:
+		o.printf(o.w, text, args...)
+	}
+	return o.err
+}
+
+// Progress reports progress of a long-running operation. Progress
+// is omitted in JSON format and in quiet text format.
+func (o *output) Progress(v interface{}, text string, args ...interface{}) error {
+	switch format {
+	case jsonFormat:
+	case ndjsonFormat:
+		o.encode(event{Type: "progress", Progress: v})
+		if o.err == nil {
+			o.err = o.w.Flush()
+		}
+	default:
+		if !quiet {
+			fmt.Fprintf(os.Stderr, text, args...)
+		}
+	}
+	return o.err
+}
+
+// Summary reports the final result of a command.
+func (o *output) Summary(v interface{}, text string, args ...interface{}) error {
+	switch format {
+	case jsonFormat:
+		o.summary = v
+	case ndjsonFormat:
+		o.encode(event{Type: "summary", Summary: v})
+	default:
+		fmt.Fprintf(os.Stderr, text, args...)
+	}
+	return o.err
+}
+
+// Close completes the JSON document with the summary and flushes the
+// output.
+func (o *output) Close() error {
+	if format == jsonFormat {
+		if o.records == 0 {
+			o.printf(o.w, "{\n  \"records\": []")
+		} else {
+			o.printf(o.w, "\n  ]")
+		}
+		if o.summary != nil {
+			o.printf(o.w, ",\n  \"summary\": ")
+			o.marshal(o.summary, "  ")
+		}
+		o.printf(o.w, "\n}\n")
+	}
+	if err := o.w.Flush(); o.err == nil {
+		o.err = err
+	}
+	return o.err
+}
+
+func (o *output) encode(v interface{}) {
+	if o.err == nil {
+		o.err = o.e.Encode(v)
+	}
+}
+
+// marshal writes the indented JSON of a value, which starts at the
+// indentation of prefix.
+func (o *output) marshal(v interface{}, prefix string) {
+	if o.err != nil {
+		return
+	}
+	b, err := json.MarshalIndent(v, prefix, "  ")
+	if err != nil {
+		o.err = err
+		return
+	}
+	_, o.err = o.w.Write(b)
+}
+
+func (o *output) printf(w io.Writer, text string, args ...interface{}) {
+	if o.err == nil {
+		_, o.err = fmt.Fprintf(w, text, args...)
+	}
+}
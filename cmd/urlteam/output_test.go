@@ -0,0 +1,51 @@
+// Copyright (c) 2021 Andrew Archibald
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+)
+
+func TestOutputJSON(t *testing.T) {
+	defer func(f outputFormat) { format = f }(format)
+	format = jsonFormat
+	type record struct {
+		N int `json:"n"`
+	}
+	type summary struct {
+		Records int `json:"records"`
+	}
+	for _, n := range []int{0, 1, 1000} {
+		var buf bytes.Buffer
+		out := newOutput(&buf)
+		records := []record{}
+		for i := 0; i < n; i++ {
+			records = append(records, record{i})
+			out.Record(record{i}, "")
+		}
+		// Records are streamed, not held until Close
+		if n == 1000 && buf.Len() == 0 {
+			t.Errorf("%d records: nothing written before Close", n)
+		}
+		out.Summary(summary{n}, "")
+		if err := out.Close(); err != nil {
+			t.Fatal(err)
+		}
+		want, err := json.MarshalIndent(struct {
+			Records []record `json:"records"`
+			Summary summary  `json:"summary"`
+		}{records, summary{n}}, "", "  ")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := buf.String(); got != string(want)+"\n" {
+			t.Errorf("%d records: got\n%s\nwant\n%s", n, got, want)
+		}
+	}
+}
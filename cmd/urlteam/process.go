@@ -0,0 +1,54 @@
+// Copyright (c) 2021 Andrew Archibald
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"os"
+)
+
+var processCmd = &command{
+	name:  "process",
+	usage: "[-host host] [releases]",
+	run:   runProcess,
+}
+
+// runProcess prints the mappings of releases, or of a project zip, as
+// lines of the host, shortcode, and target, separated by tabs.
+func runProcess(cmd *command, args []string) error {
+	fs := newFlagSet(cmd)
+	host := fs.String("host", "", "only print the given shortener name or host")
+	parseFlags(fs, args)
+	if fs.NArg() > 1 {
+		usageExit(fs)
+	}
+	src := dataDir().Releases()
+	if fs.NArg() == 1 {
+		src = fs.Arg(0)
+	}
+	if *host != "" {
+		s, err := lookupShortener(*host, "")
+		if err != nil {
+			return &inputError{err}
+		}
+		*host = s.Host
+	}
+
+	out := newOutput(os.Stdout)
+	n := 0
+	err := scanMappings(out, "processing", src, *host, func(m mapping) error {
+		n++
+		return out.Record(m, "%s\t%s\t%s\n", m.Host, m.Shortcode, m.Target)
+	})
+	if err != nil {
+		out.Close()
+		return err
+	}
+	out.Summary(struct {
+		Mappings int `json:"mappings"`
+	}{n}, "%d mappings\n", n)
+	return out.Close()
+}
@@ -0,0 +1,236 @@
+// Copyright (c) 2021 Andrew Archibald
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// progress tracks a long-running operation over a number of items, such
+// as files, with a known total size in bytes. On a terminal, it renders
+// a progress bar with the rate and ETA, and one for the bytes of the
+// current item, when known; otherwise, it reports progress periodically
+// through the command output.
+type progress struct {
+	mu         sync.Mutex
+	out        *output
+	label      string
+	item       string // current item
+	itemBytes  int64  // bytes of the current item
+	itemSize   int64  // size of the current item, if known
+	itemStart  time.Time
+	items      int // completed items
+	itemsTotal int
+	bytes      int64 // bytes of completed items
+	bytesTotal int64
+	records    int64
+	start      time.Time
+	last       time.Time
+	tty        bool
+	interval   time.Duration
+}
+
+// progressEvent is the machine-readable form of progress.
+type progressEvent struct {
+	Label      string  `json:"label"`
+	Item       string  `json:"item,omitempty"`
+	ItemBytes  int64   `json:"item_bytes,omitempty"`
+	ItemSize   int64   `json:"item_size,omitempty"`
+	ItemETA    float64 `json:"item_eta_sec,omitempty"`
+	Items      int     `json:"items"`
+	ItemsTotal int     `json:"items_total"`
+	Bytes      int64   `json:"bytes"`
+	BytesTotal int64   `json:"bytes_total"`
+	Records    int64   `json:"records"`
+	Rate       float64 `json:"records_per_sec"`
+	ETA        float64 `json:"eta_sec,omitempty"`
+}
+
+func newProgress(out *output, label string, itemsTotal int, bytesTotal int64) *progress {
+	now := time.Now()
+	p := &progress{
+		out:        out,
+		label:      label,
+		itemsTotal: itemsTotal,
+		bytesTotal: bytesTotal,
+		start:      now,
+		last:       now,
+		tty:        out.text() && !quiet && isTerminal(os.Stderr),
+		interval:   10 * time.Second,
+	}
+	if p.tty {
+		p.interval = 200 * time.Millisecond
+	}
+	return p
+}
+
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+// startItem marks the beginning of an item of the given size in bytes,
+// or 0 if unknown.
+func (p *progress) startItem(name string, size int64) {
+	p.mu.Lock()
+	p.item = name
+	p.itemBytes, p.itemSize = 0, size
+	p.itemStart = time.Now()
+	p.mu.Unlock()
+	p.update(false)
+}
+
+// addItemBytes counts bytes of the current item that are processed.
+func (p *progress) addItemBytes(n int64) {
+	p.mu.Lock()
+	p.itemBytes += n
+	p.mu.Unlock()
+	p.update(false)
+}
+
+// finishItem marks the completion of an item of the given size.
+func (p *progress) finishItem(size int64) {
+	p.mu.Lock()
+	p.items++
+	p.bytes += size
+	p.itemBytes, p.itemSize = 0, 0
+	p.mu.Unlock()
+	p.update(false)
+}
+
+// setBytes replaces the completed and total bytes, for items whose
+// bytes complete gradually, as with downloads.
+func (p *progress) setBytes(bytes, total int64) {
+	p.mu.Lock()
+	p.bytes, p.bytesTotal = bytes, total
+	p.mu.Unlock()
+	p.update(false)
+}
+
+// addRecords counts processed records.
+func (p *progress) addRecords(n int64) {
+	p.mu.Lock()
+	p.records += n
+	now := time.Now()
+	due := now.Sub(p.last) >= p.interval
+	p.mu.Unlock()
+	if due {
+		p.update(false)
+	}
+}
+
+// done reports the final progress and ends the progress bar.
+func (p *progress) done() {
+	p.update(true)
+	if p.tty {
+		fmt.Fprintln(os.Stderr)
+	}
+}
+
+func (p *progress) update(force bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	if !force && now.Sub(p.last) < p.interval {
+		return
+	}
+	p.last = now
+	e := p.event(now)
+	if p.tty {
+		fmt.Fprintf(os.Stderr, "\r\x1b[K%s", p.bar(e))
+		return
+	}
+	p.out.Progress(e, "%s\n", p.bar(e))
+}
+
+func (p *progress) event(now time.Time) progressEvent {
+	elapsed := now.Sub(p.start).Seconds()
+	e := progressEvent{
+		Label:      p.label,
+		Item:       p.item,
+		ItemBytes:  p.itemBytes,
+		ItemSize:   p.itemSize,
+		Items:      p.items,
+		ItemsTotal: p.itemsTotal,
+		Bytes:      p.bytes + p.itemBytes,
+		BytesTotal: p.bytesTotal,
+		Records:    p.records,
+	}
+	if elapsed > 0 {
+		e.Rate = float64(p.records) / elapsed
+		e.ETA = eta(elapsed, e.Bytes, e.BytesTotal)
+	}
+	if p.itemSize > 0 {
+		e.ItemETA = eta(now.Sub(p.itemStart).Seconds(), p.itemBytes, p.itemSize)
+	}
+	return e
+}
+
+// eta estimates the seconds remaining until total bytes are done, from
+// the elapsed seconds for those done so far, or 0 if unknown.
+func eta(elapsed float64, done, total int64) float64 {
+	if elapsed <= 0 || done <= 0 || total <= done {
+		return 0
+	}
+	return elapsed * float64(total-done) / float64(done)
+}
+
+func (p *progress) bar(e progressEvent) string {
+	var b strings.Builder
+	b.WriteString(e.Label)
+	if e.BytesTotal > 0 {
+		writeMeter(&b, 30, e.Bytes, e.BytesTotal)
+	}
+	if e.ItemsTotal > 0 {
+		fmt.Fprintf(&b, " %d/%d files", e.Items, e.ItemsTotal)
+	}
+	fmt.Fprintf(&b, " %d records (%.0f/s)", e.Records, e.Rate)
+	writeETA(&b, e.ETA)
+	if e.Item != "" && e.Items < e.ItemsTotal {
+		fmt.Fprintf(&b, " | %s", e.Item)
+		if e.ItemSize > 0 {
+			writeMeter(&b, 15, e.ItemBytes, e.ItemSize)
+			writeETA(&b, e.ItemETA)
+		}
+	}
+	return b.String()
+}
+
+// writeMeter writes a bar of the given width filled to the fraction of
+// total bytes that are done, followed by the percentage and sizes.
+func writeMeter(b *strings.Builder, width int, done, total int64) {
+	frac := float64(done) / float64(total)
+	if frac > 1 {
+		frac = 1
+	}
+	n := int(frac * float64(width))
+	fmt.Fprintf(b, " [%s%s] %3.0f%% %s/%s", strings.Repeat("=", n), strings.Repeat(" ", width-n),
+		frac*100, formatBytes(done), formatBytes(total))
+}
+
+func writeETA(b *strings.Builder, eta float64) {
+	if eta > 0 {
+		fmt.Fprintf(b, " ETA %s", (time.Duration(eta) * time.Second).String())
+	}
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
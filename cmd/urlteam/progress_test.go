@@ -0,0 +1,43 @@
+// Copyright (c) 2021 Andrew Archibald
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestProgressItem(t *testing.T) {
+	p := &progress{label: "index", itemsTotal: 2, bytesTotal: 4096, interval: time.Hour}
+	start := time.Now()
+	p.start, p.last = start, start
+	p.startItem("a.zip", 1024)
+	p.finishItem(1024)
+	p.startItem("b.zip", 3072)
+	p.addItemBytes(1024)
+	p.addRecords(100)
+	p.itemStart = start.Add(5 * time.Second)
+
+	e := p.event(start.Add(10 * time.Second))
+	if e.Bytes != 2048 || e.ItemBytes != 1024 || e.ItemSize != 3072 {
+		t.Errorf("got bytes %d, item bytes %d of %d", e.Bytes, e.ItemBytes, e.ItemSize)
+	}
+	if e.ETA != 10 || e.ItemETA != 10 {
+		t.Errorf("got ETA %v, item ETA %v, want 10", e.ETA, e.ItemETA)
+	}
+	want := "index [===============               ]  50% 2.0 KiB/4.0 KiB 1/2 files 100 records (10/s) ETA 10s" +
+		" | b.zip [=====          ]  33% 1.0 KiB/3.0 KiB ETA 10s"
+	if got := p.bar(e); got != want {
+		t.Errorf("got bar\n%q, want\n%q", got, want)
+	}
+
+	p.finishItem(3072)
+	e = p.event(start.Add(20 * time.Second))
+	if e.Bytes != 4096 || e.ItemSize != 0 || e.ETA != 0 || e.ItemETA != 0 {
+		t.Errorf("after last item: got %+v", e)
+	}
+}
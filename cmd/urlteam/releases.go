@@ -0,0 +1,187 @@
+// Copyright (c) 2021 Andrew Archibald
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/andrewarchi/urlhero/beacon"
+	"github.com/andrewarchi/urlhero/index"
+	"github.com/andrewarchi/urlhero/logger"
+	"github.com/andrewarchi/urlhero/report"
+	"github.com/andrewarchi/urlhero/tinytown"
+)
+
+// findProjects lists the terroroftinytown project zips at path, which
+// is either a project zip, a release directory of project zips, or a
+// directory of releases.
+func findProjects(path string) ([]string, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !fi.IsDir() {
+		if !strings.HasSuffix(path, ".zip") {
+			return nil, fmt.Errorf("not a release or project zip: %s", path)
+		}
+		return []string{path}, nil
+	}
+	filenames, err := filepath.Glob(filepath.Join(path, "*.zip"))
+	if err != nil {
+		return nil, err
+	}
+	if len(filenames) == 0 {
+		filenames, err = filepath.Glob(filepath.Join(path, "*", "*.zip"))
+		if err != nil {
+			return nil, err
+		}
+	}
+	sort.Strings(filenames)
+	return filenames, nil
+}
+
+// processProjects calls fn on every link in the project zips, while
+// reporting progress. Projects that cannot be read are logged and
+// skipped, and, when any are, a *partialError with their run report is
+// returned after the rest are processed.
+func processProjects(out *output, label string, filenames []string, fn tinytown.ProcessFunc) error {
+	sizes, total, err := projectSizes(filenames)
+	if err != nil {
+		return err
+	}
+	p := newProgress(out, label, len(filenames), total)
+	defer p.done()
+	ctx := tinytown.WithProgress(context.Background(), func(e tinytown.ProgressEvent) {
+		if e.Kind == tinytown.ProgressMappings {
+			p.addRecords(e.N)
+			p.addItemBytes(e.Bytes)
+		}
+	})
+	rep := report.New(label)
+	rep.OnFail = func(filename string, err error) {
+		logger.Warn("skipped unreadable project", "filename", filename, "err", err)
+	}
+	for i, filename := range filenames {
+		p.startItem(filepath.Base(filename), sizes[i])
+		if err := tinytown.ProcessProjectReport(ctx, filename, fn, rep); err != nil {
+			return err
+		}
+		p.finishItem(sizes[i])
+	}
+	rep.Finish()
+	if err := rep.Err(); err != nil {
+		return &partialError{err}
+	}
+	return nil
+}
+
+// withProjectProgress returns a copy of the context that reports the
+// progress of reading the project zips, which have the given sizes, to
+// p. Each zip is an item of p, which starts when its first mappings are
+// read, for readers like index.UpdateContext that choose the order of
+// the zips. The zips must be read one at a time.
+func withProjectProgress(ctx context.Context, p *progress, filenames []string, sizes []int64) context.Context {
+	size := make(map[string]int64, len(filenames))
+	for i, filename := range filenames {
+		size[filename] = sizes[i]
+	}
+	var item string
+	return tinytown.WithProgress(ctx, func(e tinytown.ProgressEvent) {
+		switch e.Kind {
+		case tinytown.ProgressMappings:
+			if e.Filename != item {
+				item = e.Filename
+				p.startItem(filepath.Base(item), size[item])
+			}
+			p.addRecords(e.N)
+			p.addItemBytes(e.Bytes)
+		case tinytown.ProgressFile:
+			p.finishItem(size[e.Filename])
+			item = ""
+		}
+	})
+}
+
+// projectSizes returns the sizes of the project zips and their total.
+func projectSizes(filenames []string) (sizes []int64, total int64, err error) {
+	sizes = make([]int64, len(filenames))
+	for i, filename := range filenames {
+		fi, err := os.Stat(filename)
+		if err != nil {
+			return nil, 0, err
+		}
+		sizes[i] = fi.Size()
+		total += sizes[i]
+	}
+	return sizes, total, nil
+}
+
+// mapping is a shortcode mapping found in an index or release.
+type mapping struct {
+	Host      string `json:"host"`
+	Shortcode string `json:"shortcode"`
+	Target    string `json:"target"`
+	Release   string `json:"release,omitempty"`
+	Project   string `json:"project,omitempty"` // e.g. "bitly_6", if known
+}
+
+// scanMappings calls fn on every mapping in src, which is either an
+// index directory or a path accepted by findProjects. When host is
+// non-empty, only mappings for that host are scanned.
+func scanMappings(out *output, label, src, host string, fn func(mapping) error) error {
+	indexes, err := filepath.Glob(filepath.Join(src, "*"+index.Ext))
+	if err != nil {
+		return err
+	}
+	if len(indexes) != 0 {
+		idx, err := index.Open(src)
+		if err != nil {
+			return err
+		}
+		defer idx.Close()
+		hosts := idx.Hosts()
+		if host != "" {
+			hosts = []string{host}
+		}
+		for _, h := range hosts {
+			r := idx.Reader(h)
+			if r == nil {
+				continue
+			}
+			err := r.Iterate(func(rec index.Record) error {
+				return fn(mapping{h, rec.Shortcode, rec.Target, "", ""})
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	filenames, err := findProjects(src)
+	if err != nil {
+		return err
+	}
+	hosts := make(map[*tinytown.Meta]string)
+	return processProjects(out, label, filenames, func(l *beacon.Link, m *tinytown.Meta, shortcodeLen int, releaseFilename, dumpFilename string) error {
+		h, ok := hosts[m]
+		if !ok {
+			h = index.TemplateHost(m.URLTemplate)
+			hosts[m] = h
+		}
+		if host != "" && h != host {
+			return nil
+		}
+		release := filepath.Base(filepath.Dir(releaseFilename))
+		return fn(mapping{h, l.Source, l.Target, release, m.Name})
+	})
+}
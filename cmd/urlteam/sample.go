@@ -0,0 +1,68 @@
+// Copyright (c) 2021 Andrew Archibald
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"os"
+	"time"
+
+	"github.com/andrewarchi/urlhero/sample"
+)
+
+var sampleCmd = &command{
+	name:  "sample",
+	usage: "[-n count] [-per-host] [-seed n] [-host host] [index or releases]",
+	run:   runSample,
+}
+
+func runSample(cmd *command, args []string) error {
+	fs := newFlagSet(cmd)
+	n := fs.Int("n", 100, "number of mappings to sample")
+	perHost := fs.Bool("per-host", false, "sample n mappings from each shortener")
+	seed := fs.Int64("seed", 0, "random seed (default: time-based)")
+	host := fs.String("host", "", "only sample the given shortener name or host")
+	parseFlags(fs, args)
+	if fs.NArg() > 1 || *n < 0 {
+		usageExit(fs)
+	}
+	src := dataDir().Index()
+	if fs.NArg() == 1 {
+		src = fs.Arg(0)
+	}
+	if *host != "" {
+		s, err := lookupShortener(*host, "")
+		if err != nil {
+			return &inputError{err}
+		}
+		*host = s.Host
+	}
+	if *seed == 0 {
+		*seed = time.Now().UnixNano()
+	}
+
+	out := newOutput(os.Stdout)
+	sampler := sample.New(*n, *perHost, *seed)
+	err := scanMappings(out, "sampling", src, *host, func(m mapping) error {
+		sampler.Add(sample.Mapping{Host: m.Host, Shortcode: m.Shortcode, Target: m.Target, Release: m.Release})
+		return nil
+	})
+	if err != nil {
+		out.Close()
+		return err
+	}
+
+	mappings := sampler.Sample()
+	for _, m := range mappings {
+		out.Record(m, "%s %s %s\n", m.Host, m.Shortcode, m.Target)
+	}
+	out.Summary(struct {
+		Sampled int   `json:"sampled"`
+		Seen    int64 `json:"seen"`
+		Seed    int64 `json:"seed"`
+	}{len(mappings), sampler.Seen(), *seed}, "sampled %d of %d mappings (seed %d)\n", len(mappings), sampler.Seen(), *seed)
+	return out.Close()
+}
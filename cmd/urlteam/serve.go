@@ -0,0 +1,310 @@
+// Copyright (c) 2021 Andrew Archibald
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/andrewarchi/urlhero/index"
+	"github.com/andrewarchi/urlhero/logger"
+	"github.com/andrewarchi/urlhero/server"
+	"github.com/andrewarchi/urlhero/server/lookuppb"
+	"github.com/andrewarchi/urlhero/tracing"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+var serveCmd = &command{
+	name:  "serve",
+	usage: "[-addr address] [-grpc-addr address] [-redirect-addr address] [-index dir] [-tls-cert file -tls-key file | -acme-domains domains] [flags]",
+	run:   runServe,
+}
+
+func runServe(cmd *command, args []string) error {
+	fs := newFlagSet(cmd)
+	addr := fs.String("addr", "localhost:8080", "address to serve the HTTP lookup API on")
+	grpcAddr := fs.String("grpc-addr", "", "address to serve the gRPC lookup service on, if any")
+	redirectAddr := fs.String("redirect-addr", "", "address to serve redirects from short URLs to archived targets on, if any")
+	redirectStatus := fs.Int("redirect-status", http.StatusMovedPermanently, "status of redirects: 301, 302, 307, or 308")
+	indexDir := fs.String("index", dataDir().Index(), "index directory to serve, or a list of directories to federate, in priority order, separated by "+string(os.PathListSeparator))
+	cacheSize := fs.Int("cache-size", server.DefaultOptions.CacheSize, "number of lookups to cache in memory, or 0 to disable")
+	cacheMaxAge := fs.Duration("cache-max-age", server.DefaultOptions.CacheMaxAge, "max-age of Cache-Control headers, or 0 to omit them")
+	rateLimit := fs.Float64("rate-limit", server.DefaultOptions.RateLimit, "requests per second allowed for each client, or 0 for no limit")
+	rateBurst := fs.Int("rate-burst", server.DefaultOptions.RateBurst, "number of requests a client may make at once")
+	trustProxy := fs.Bool("trust-proxy", false, "identify clients by the last X-Forwarded-For address, when behind a reverse proxy")
+	maxRequestBytes := fs.Int64("max-request-bytes", server.DefaultOptions.MaxRequestBytes, "maximum size of request bodies")
+	stateFile := fs.String("state", dataDir().State("watch.json"), "watch state file to list releases from")
+	useMmap := fs.Bool("mmap", false, "map the index read-only into memory, for serving lookups at high rates")
+	accessLogFile := fs.String("access-log", "", "file to write access logs to, or - for stdout; disabled when empty")
+	accessLogFormat := fs.String("access-log-format", "json", "format of access logs: json or combined")
+	accessLogSample := fs.Float64("access-log-sample", 1, "fraction of requests to log; server errors are always logged")
+	var tlsOpts tlsOptions
+	fs.StringVar(&tlsOpts.certFile, "tls-cert", "", "PEM certificate file to serve the API and gRPC service over TLS with; reloaded on SIGHUP")
+	fs.StringVar(&tlsOpts.keyFile, "tls-key", "", "PEM key file of -tls-cert")
+	fs.StringVar(&tlsOpts.acmeDomains, "acme-domains", "", "comma-separated domains to obtain certificates for with ACME, to serve over TLS")
+	fs.StringVar(&tlsOpts.acmeEmail, "acme-email", "", "contact email of the ACME account, for expiry notices")
+	fs.StringVar(&tlsOpts.acmeCacheDir, "acme-cache", dataDir().Cache("acme"), "directory to cache ACME accounts and certificates in")
+	fs.StringVar(&tlsOpts.acmeDirectory, "acme-directory", "", "ACME directory URL, by default Let's Encrypt")
+	acmeHTTPAddr := fs.String("acme-http-addr", "", "address to answer ACME HTTP-01 challenges and redirect to HTTPS on, such as :80, if any")
+	warm := fs.Bool("warm", true, "read the index into the page cache before reporting ready on /readyz")
+	parseFlags(fs, args)
+	if fs.NArg() != 0 {
+		usageExit(fs)
+	}
+	switch *redirectStatus {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+	default:
+		usageExit(fs)
+	}
+	tokens, anonymous, err := serverTokens()
+	if err != nil {
+		return &inputError{err}
+	}
+	format, err := server.ParseAccessLogFormat(*accessLogFormat)
+	if err != nil {
+		return &inputError{err}
+	}
+	ts, err := newTLSServer(&tlsOpts)
+	if err != nil {
+		return &inputError{err}
+	}
+	if *acmeHTTPAddr != "" && (ts == nil || ts.acme == nil) {
+		return &inputError{errors.New("-acme-http-addr needs -acme-domains")}
+	}
+	var accessLog *server.AccessLog
+	switch *accessLogFile {
+	case "":
+	case "-":
+		accessLog = server.NewAccessLog(os.Stdout, format, *accessLogSample)
+	default:
+		f, err := os.OpenFile(*accessLogFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		accessLog = server.NewAccessLog(f, format, *accessLogSample)
+	}
+	openDir := index.Open
+	if *useMmap {
+		openDir = index.OpenMmap
+	}
+	open := func() (*index.Index, error) { return openFederated(filepath.SplitList(*indexDir), openDir) }
+	idx, err := open()
+	if err != nil {
+		return err
+	}
+
+	ctx, stop := interruptContext()
+	defer stop()
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	api := server.New(idx, &server.Options{
+		CacheSize:       *cacheSize,
+		CacheMaxAge:     *cacheMaxAge,
+		RateLimit:       *rateLimit,
+		RateBurst:       *rateBurst,
+		TrustProxy:      *trustProxy,
+		MaxRequestBytes: *maxRequestBytes,
+		RedirectStatus:  *redirectStatus,
+		Tokens:          tokens,
+		AnonymousScopes: anonymous,
+		CORSOrigins:     cfg.Server.CORSOrigins,
+		CORSMethods:     cfg.Server.CORSMethods,
+		CORSMaxAge:      cfg.Server.CORSMaxAge.Duration,
+		AccessLog:       accessLog,
+		Releases:        func() ([]server.Release, error) { return watchReleases(*stateFile) },
+		Open:            open,
+	})
+	defer api.Close()
+	servers := []*http.Server{newHTTPServer(*addr, api)}
+	if ts != nil {
+		servers[0].TLSConfig = ts.config
+	}
+	if *redirectAddr != "" {
+		// Short URLs were plain HTTP, so redirects are served without TLS
+		servers = append(servers, newHTTPServer(*redirectAddr, api.Redirector()))
+	}
+	if *acmeHTTPAddr != "" {
+		servers = append(servers, newHTTPServer(*acmeHTTPAddr, ts.challengeHandler()))
+	}
+	errs := make(chan error, len(servers)+1)
+	logger.Info("serving index", "index", *indexDir, "hosts", len(idx.Hosts()))
+	for _, srv := range servers {
+		srv := srv
+		go func() {
+			if srv.TLSConfig != nil {
+				logger.Info("listening with TLS", "addr", srv.Addr)
+				errs <- srv.ListenAndServeTLS("", "")
+				return
+			}
+			logger.Info("listening", "addr", srv.Addr)
+			errs <- srv.ListenAndServe()
+		}()
+	}
+	if *grpcAddr != "" {
+		l, err := net.Listen("tcp", *grpcAddr)
+		if err != nil {
+			closeServers(servers)
+			return err
+		}
+		opts := []grpc.ServerOption{
+			grpc.ChainUnaryInterceptor(tracing.UnaryServerInterceptor()),
+			grpc.ChainStreamInterceptor(tracing.StreamServerInterceptor()),
+		}
+		if ts != nil {
+			opts = append(opts, grpc.Creds(credentials.NewTLS(ts.config)))
+		}
+		if accessLog != nil {
+			opts = append(opts, grpc.ChainUnaryInterceptor(accessLog.UnaryInterceptor()),
+				grpc.ChainStreamInterceptor(accessLog.StreamInterceptor()))
+		}
+		g := grpc.NewServer(opts...)
+		lookuppb.RegisterLookupServiceServer(g, api.GRPC())
+		defer g.GracefulStop()
+		go func() {
+			logger.Info("listening for gRPC", "addr", *grpcAddr)
+			errs <- g.Serve(l)
+		}()
+	}
+	if *warm {
+		go func() {
+			if err := api.Warm(); err != nil {
+				errs <- err
+			}
+		}()
+	} else {
+		api.SetReady(true)
+	}
+wait:
+	for {
+		select {
+		case err := <-errs:
+			closeServers(servers)
+			return err
+		case <-hup:
+			// Rebuilt indexes are swapped in by the watch daemon
+			if err := api.Reload(); err != nil {
+				logger.Error("reloading index failed", "err", err)
+			}
+			if ts != nil {
+				if err := ts.reload(); err != nil {
+					logger.Error("reloading TLS certificate failed", "err", err)
+				}
+			}
+		case <-ctx.Done():
+			break wait
+		}
+	}
+
+	logger.Info("shutting down")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	for _, srv := range servers {
+		if err := srv.Shutdown(shutdownCtx); err != nil {
+			return err
+		}
+	}
+	for range servers {
+		if err := <-errs; !errors.Is(err, http.ErrServerClosed) {
+			return err
+		}
+	}
+	return nil
+}
+
+// serverTokens returns the API tokens and anonymous scopes from the
+// config.
+func serverTokens() ([]server.Token, []server.Scope, error) {
+	tokens := make([]server.Token, len(cfg.Server.Tokens))
+	for i, t := range cfg.Server.Tokens {
+		if t.Name == "" || t.Token == "" {
+			return nil, nil, fmt.Errorf("config: server token %d needs a name and token", i+1)
+		}
+		scopes, err := parseScopes(t.Scopes)
+		if err != nil {
+			return nil, nil, err
+		}
+		tokens[i] = server.Token{Name: t.Name, Secret: t.Token, Scopes: scopes}
+	}
+	anonymous, err := parseScopes(cfg.Server.AnonymousScopes)
+	return tokens, anonymous, err
+}
+
+func parseScopes(names []string) ([]server.Scope, error) {
+	scopes := make([]server.Scope, len(names))
+	for i, name := range names {
+		s, err := server.ParseScope(name)
+		if err != nil {
+			return nil, err
+		}
+		scopes[i] = s
+	}
+	return scopes, nil
+}
+
+// watchReleases lists the releases in the state file of the watch
+// daemon.
+func watchReleases(stateFile string) ([]server.Release, error) {
+	state, err := loadWatchState(stateFile)
+	if err != nil {
+		return nil, err
+	}
+	releases := make([]server.Release, 0, len(state.Releases))
+	for id, rs := range state.Releases {
+		releases = append(releases, server.Release{ID: id, Downloaded: rs.Downloaded, Indexed: rs.Indexed, Error: rs.Error})
+	}
+	return releases, nil
+}
+
+func newHTTPServer(addr string, h http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		Handler:           h,
+		ReadHeaderTimeout: 10 * time.Second,
+		MaxHeaderBytes:    64 << 10,
+	}
+}
+
+func closeServers(servers []*http.Server) {
+	for _, srv := range servers {
+		srv.Close()
+	}
+}
+
+// openFederated opens the index directories and federates them, in
+// priority order.
+func openFederated(dirs []string, open func(dir string) (*index.Index, error)) (*index.Index, error) {
+	indexes := make([]*index.Index, 0, len(dirs))
+	for _, dir := range dirs {
+		idx, err := open(dir)
+		if err != nil {
+			for _, idx := range indexes {
+				idx.Close()
+			}
+			return nil, err
+		}
+		indexes = append(indexes, idx)
+	}
+	fed, err := index.Federate(indexes...)
+	if err != nil {
+		for _, idx := range indexes {
+			idx.Close()
+		}
+		return nil, err
+	}
+	return fed, nil
+}
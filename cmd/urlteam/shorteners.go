@@ -0,0 +1,129 @@
+// Copyright (c) 2021 Andrew Archibald
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/andrewarchi/urlhero/index"
+	"github.com/andrewarchi/urlhero/shorteners"
+)
+
+var shortenersCmd = &command{
+	name:  "shorteners",
+	usage: "[-index dir] [-json]",
+	run:   runShorteners,
+}
+
+type shortenerInfo struct {
+	Name      string `json:"name"`
+	Host      string `json:"host"`
+	Prefix    string `json:"prefix"`
+	Alphabet  string `json:"alphabet"`
+	Pattern   string `json:"pattern,omitempty"`
+	HasVanity bool   `json:"has_vanity"`
+	Count     *int64 `json:"count,omitempty"` // nil without an index
+}
+
+func runShorteners(cmd *command, args []string) error {
+	fs := newFlagSet(cmd)
+	defaultIndex := dataDir().Index()
+	indexDir := fs.String("index", defaultIndex, "index directory to count shortcodes from")
+	jsonOut := fs.Bool("json", false, "print shorteners as JSON, like the global -json")
+	parseFlags(fs, args)
+	if fs.NArg() != 0 {
+		usageExit(fs)
+	}
+	if *jsonOut {
+		format = jsonFormat
+	}
+
+	var idx *index.Index
+	if *indexDir != "" {
+		var err error
+		idx, err = index.Open(*indexDir)
+		if err != nil {
+			// Counts are optional when no index has been built
+			if !os.IsNotExist(err) || *indexDir != defaultIndex {
+				return err
+			}
+		} else {
+			defer idx.Close()
+		}
+	}
+
+	infos := make([]shortenerInfo, len(shorteners.Shorteners))
+	for i, s := range shorteners.Shorteners {
+		infos[i] = shortenerInfo{
+			Name:      s.Name,
+			Host:      s.Host,
+			Prefix:    s.Prefix,
+			Alphabet:  s.Alphabet,
+			HasVanity: s.HasVanity,
+		}
+		if s.Pattern != nil {
+			infos[i].Pattern = s.Pattern.String()
+		}
+		if idx != nil {
+			n := idx.Len(s.Host)
+			infos[i].Count = &n
+		}
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	out := newOutput(tw)
+	if out.text() {
+		fmt.Fprint(tw, "NAME\tHOST\tALPHABET\tPATTERN\tVANITY")
+		if idx != nil {
+			fmt.Fprint(tw, "\tCOUNT")
+		}
+		fmt.Fprintln(tw)
+	}
+	for _, info := range infos {
+		count := ""
+		if info.Count != nil {
+			count = fmt.Sprintf("\t%d", *info.Count)
+		}
+		out.Record(info, "%s\t%s\t%s\t%s\t%t%s\n", info.Name, info.Host, info.Alphabet, info.Pattern, info.HasVanity, count)
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return tw.Flush()
+}
+
+// lookupShortener finds a registered shortener by name or host, or
+// constructs an ad hoc shortener for an unregistered host.
+func lookupShortener(shortener, alphabet string) (*shorteners.Shortener, error) {
+	if s, ok := shorteners.Lookup[shortener]; ok {
+		return s, nil
+	}
+	var name, host string
+	if strings.ContainsRune(shortener, '.') {
+		name, host = strings.ReplaceAll(shortener, ".", "-"), shortener
+	} else {
+		name, host = shortener, strings.ReplaceAll(shortener, "-", ".")
+	}
+	s := &shorteners.Shortener{
+		Name:     name,
+		Host:     host,
+		Alphabet: alphabet,
+	}
+	if alphabet != "" {
+		class := strings.ReplaceAll(regexp.QuoteMeta(alphabet), "-", `\-`)
+		pattern, err := regexp.Compile("^[" + class + "]+$")
+		if err != nil {
+			return nil, err
+		}
+		s.Pattern = pattern
+	}
+	return s, nil
+}
@@ -0,0 +1,54 @@
+// Copyright (c) 2021 Andrew Archibald
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/andrewarchi/urlhero/shorteners"
+)
+
+func TestShortenersJSON(t *testing.T) {
+	f, err := os.Create(filepath.Join(t.TempDir(), "stdout"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	stdout := os.Stdout
+	os.Stdout = f
+	defer func() {
+		os.Stdout = stdout
+		format = textFormat
+	}()
+
+	err = runShorteners(shortenersCmd, []string{"-index", "", "-json"})
+	os.Stdout = stdout
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got struct {
+		Records []shortenerInfo `json:"records"`
+	}
+	if err := json.Unmarshal(b, &got); err != nil {
+		t.Fatalf("output is not JSON: %v\n%s", err, b)
+	}
+	if len(got.Records) != len(shorteners.Shorteners) {
+		t.Fatalf("got %d shorteners, want %d", len(got.Records), len(shorteners.Shorteners))
+	}
+	for i, s := range shorteners.Shorteners {
+		if r := got.Records[i]; r.Name != s.Name || r.Host != s.Host || r.Count != nil {
+			t.Errorf("shortener %d: got %+v, want %s (%s) without a count", i, r, s.Name, s.Host)
+		}
+	}
+}
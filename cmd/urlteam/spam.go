@@ -0,0 +1,75 @@
+// Copyright (c) 2021 Andrew Archibald
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"os"
+
+	"github.com/andrewarchi/urlhero/spam"
+)
+
+var spamCmd = &command{
+	name:  "spam",
+	usage: "[-min n] [-density f] [-host host] [index or releases]",
+	run:   runSpam,
+}
+
+func runSpam(cmd *command, args []string) error {
+	fs := newFlagSet(cmd)
+	minCount := fs.Int64("min", 1000, "fewest mappings of a shortener in a flagged cluster")
+	density := fs.Float64("density", 0.5, "smallest share of the mappings in the shortcode range of a flagged cluster that are in it")
+	examples := fs.Int("examples", 3, "number of example targets per cluster")
+	host := fs.String("host", "", "only cluster the given shortener name or host")
+	parseFlags(fs, args)
+	if fs.NArg() > 1 || *minCount < 1 || *density <= 0 || *density > 1 || *examples < 1 {
+		usageExit(fs)
+	}
+	src := dataDir().Index()
+	if fs.NArg() == 1 {
+		src = fs.Arg(0)
+	}
+	if *host != "" {
+		s, err := lookupShortener(*host, "")
+		if err != nil {
+			return &inputError{err}
+		}
+		*host = s.Host
+	}
+
+	out := newOutput(os.Stdout)
+	c := spam.NewClusterer(&spam.Options{MinCount: *minCount, MinDensity: *density, Examples: *examples})
+	err := scanMappings(out, "clustering", src, *host, func(m mapping) error {
+		c.Add(m.Host, m.Shortcode, m.Target)
+		return nil
+	})
+	if err != nil {
+		out.Close()
+		return err
+	}
+	report := c.Report()
+	// Records are tagged with their kind, to tell them apart in JSON
+	for i, cl := range report.Clusters {
+		out.Record(struct {
+			Kind string `json:"kind"`
+			*spam.Cluster
+		}{"cluster", &report.Clusters[i]}, "%s\t%s\t%d\t%.1f%%\t%s-%s\t%.2f\n",
+			cl.Host, cl.Template, cl.Count, 100*cl.Share, cl.First, cl.Last, cl.Density)
+	}
+	for i, camp := range report.Campaigns {
+		out.Record(struct {
+			Kind string `json:"kind"`
+			*spam.Campaign
+		}{"campaign", &report.Campaigns[i]}, "campaign\t%s\t%d\t%d shorteners\n", camp.Template, camp.Count, len(camp.Hosts))
+	}
+	out.Summary(struct {
+		Mappings  int64 `json:"mappings"`
+		Clusters  int   `json:"clusters"`
+		Campaigns int   `json:"campaigns"`
+	}{report.Mappings, len(report.Clusters), len(report.Campaigns)},
+		"%d clusters and %d campaigns flagged in %d mappings\n", len(report.Clusters), len(report.Campaigns), report.Mappings)
+	return out.Close()
+}
@@ -0,0 +1,79 @@
+// Copyright (c) 2021 Andrew Archibald
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"os"
+
+	"github.com/andrewarchi/urlhero/index"
+)
+
+var statsCmd = &command{
+	name:  "stats",
+	usage: "[index]",
+	run:   runStats,
+}
+
+type hostStats struct {
+	Host     string `json:"host"`
+	Records  int64  `json:"records"`
+	Segments int    `json:"segments"`
+	Releases int    `json:"releases"`
+	Projects int    `json:"projects"`
+	Format   string `json:"format"`
+}
+
+func runStats(cmd *command, args []string) error {
+	fs := newFlagSet(cmd)
+	parseFlags(fs, args)
+	if fs.NArg() > 1 {
+		usageExit(fs)
+	}
+	dir := dataDir().Index()
+	if fs.NArg() == 1 {
+		dir = fs.Arg(0)
+	}
+
+	idx, err := index.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer idx.Close()
+
+	out := newOutput(os.Stdout)
+	var records int64
+	releases := make(map[string]bool)
+	for _, host := range idx.Hosts() {
+		r := idx.Reader(host)
+		if r == nil {
+			continue
+		}
+		meta := r.Meta()
+		s := hostStats{
+			Host:     host,
+			Records:  r.Len(),
+			Segments: r.Segments(),
+			Releases: len(meta.Releases),
+			Projects: len(meta.Projects),
+			Format:   r.Format().String(),
+		}
+		records += s.Records
+		for _, id := range meta.Releases {
+			releases[id] = true
+		}
+		out.Record(s, "%s\t%d records\t%d segments\t%d releases\t%s\n",
+			s.Host, s.Records, s.Segments, s.Releases, s.Format)
+	}
+	out.Summary(struct {
+		Index    string `json:"index"`
+		Hosts    int    `json:"hosts"`
+		Records  int64  `json:"records"`
+		Releases int    `json:"releases"`
+	}{dir, len(idx.Hosts()), records, len(releases)},
+		"%d records of %d hosts from %d releases in %s\n", records, len(idx.Hosts()), len(releases), dir)
+	return out.Close()
+}
@@ -0,0 +1,116 @@
+// Copyright (c) 2021 Andrew Archibald
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// tlsOptions configures TLS termination in the serve command, with
+// either a static certificate or certificates issued by ACME.
+type tlsOptions struct {
+	certFile, keyFile string
+	acmeDomains       string // comma-separated
+	acmeEmail         string
+	acmeCacheDir      string
+	acmeDirectory     string // ACME directory URL; default Let's Encrypt
+}
+
+// tlsServer terminates TLS for the serve command.
+type tlsServer struct {
+	config *tls.Config
+	cert   *keyPair          // nil with ACME
+	acme   *autocert.Manager // nil with a static certificate
+}
+
+// newTLSServer configures TLS, or returns nil when it is disabled.
+func newTLSServer(opts *tlsOptions) (*tlsServer, error) {
+	static := opts.certFile != "" || opts.keyFile != ""
+	switch {
+	case static && opts.acmeDomains != "":
+		return nil, errors.New("TLS certificate and ACME domains are mutually exclusive")
+	case static:
+		if opts.certFile == "" || opts.keyFile == "" {
+			return nil, errors.New("TLS needs both a certificate and a key")
+		}
+		kp := &keyPair{certFile: opts.certFile, keyFile: opts.keyFile}
+		if err := kp.load(); err != nil {
+			return nil, err
+		}
+		config := &tls.Config{MinVersion: tls.VersionTLS12, GetCertificate: kp.getCertificate}
+		return &tlsServer{config: config, cert: kp}, nil
+	case opts.acmeDomains != "":
+		var domains []string
+		for _, d := range strings.Split(opts.acmeDomains, ",") {
+			if d = strings.TrimSpace(d); d != "" {
+				domains = append(domains, d)
+			}
+		}
+		m := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			Cache:      autocert.DirCache(opts.acmeCacheDir),
+			HostPolicy: autocert.HostWhitelist(domains...),
+			Email:      opts.acmeEmail,
+		}
+		if opts.acmeDirectory != "" {
+			m.Client = &acme.Client{DirectoryURL: opts.acmeDirectory}
+		}
+		config := m.TLSConfig()
+		config.MinVersion = tls.VersionTLS12
+		return &tlsServer{config: config, acme: m}, nil
+	}
+	return nil, nil
+}
+
+// challengeHandler answers ACME HTTP-01 challenges and redirects other
+// requests to HTTPS. It is nil with a static certificate.
+func (ts *tlsServer) challengeHandler() http.Handler {
+	if ts.acme == nil {
+		return nil
+	}
+	return ts.acme.HTTPHandler(nil)
+}
+
+// reload reloads a static certificate, such as after it is renewed.
+// Certificates issued by ACME are renewed automatically.
+func (ts *tlsServer) reload() error {
+	if ts.cert == nil {
+		return nil
+	}
+	return ts.cert.load()
+}
+
+// keyPair is a certificate and key loaded from files.
+type keyPair struct {
+	certFile, keyFile string
+	mu                sync.RWMutex
+	cert              *tls.Certificate
+}
+
+func (kp *keyPair) load() error {
+	cert, err := tls.LoadX509KeyPair(kp.certFile, kp.keyFile)
+	if err != nil {
+		return err
+	}
+	kp.mu.Lock()
+	kp.cert = &cert
+	kp.mu.Unlock()
+	return nil
+}
+
+func (kp *keyPair) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	kp.mu.RLock()
+	defer kp.mu.RUnlock()
+	return kp.cert, nil
+}
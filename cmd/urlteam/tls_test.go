@@ -0,0 +1,160 @@
+// Copyright (c) 2021 Andrew Archibald
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeKeyPair writes a self-signed certificate for the host and its key
+// to PEM files in dir.
+func writeKeyPair(t *testing.T, dir, host string) (certFile, keyFile string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: host},
+		DNSNames:     []string{host},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+// leafName returns the common name of the certificate that the server
+// presents.
+func leafName(t *testing.T, ts *tlsServer) string {
+	t.Helper()
+	cert, err := ts.config.GetCertificate(&tls.ClientHelloInfo{ServerName: "example.org"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return leaf.Subject.CommonName
+}
+
+func TestTLSStatic(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeKeyPair(t, dir, "example.org")
+	ts, err := newTLSServer(&tlsOptions{certFile: certFile, keyFile: keyFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ts.config.MinVersion != tls.VersionTLS12 {
+		t.Errorf("min version: got %#x, want %#x", ts.config.MinVersion, tls.VersionTLS12)
+	}
+	if ts.challengeHandler() != nil {
+		t.Error("challenge handler with a static certificate")
+	}
+	if name := leafName(t, ts); name != "example.org" {
+		t.Errorf("got certificate for %q", name)
+	}
+
+	// A renewed certificate is served after a reload
+	writeKeyPair(t, dir, "renewed.example.org")
+	if err := ts.reload(); err != nil {
+		t.Fatal(err)
+	}
+	if name := leafName(t, ts); name != "renewed.example.org" {
+		t.Errorf("after reload: got certificate for %q", name)
+	}
+	// and a failed reload keeps the last certificate
+	if err := os.WriteFile(certFile, []byte("not a certificate"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ts.reload(); err == nil {
+		t.Error("reload of an invalid certificate succeeded")
+	}
+	if name := leafName(t, ts); name != "renewed.example.org" {
+		t.Errorf("after failed reload: got certificate for %q", name)
+	}
+}
+
+func TestTLSErrors(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := writeKeyPair(t, dir, "example.org")
+	invalid := filepath.Join(dir, "invalid.pem")
+	if err := os.WriteFile(invalid, []byte("not a certificate"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		opts tlsOptions
+	}{
+		{"missing cert", tlsOptions{certFile: filepath.Join(dir, "missing.pem"), keyFile: keyFile}},
+		{"missing key", tlsOptions{certFile: certFile, keyFile: filepath.Join(dir, "missing.pem")}},
+		{"invalid cert", tlsOptions{certFile: invalid, keyFile: keyFile}},
+		{"invalid key", tlsOptions{certFile: certFile, keyFile: invalid}},
+		{"swapped", tlsOptions{certFile: keyFile, keyFile: certFile}},
+		{"cert without key", tlsOptions{certFile: certFile}},
+		{"key without cert", tlsOptions{keyFile: keyFile}},
+		{"cert and ACME", tlsOptions{certFile: certFile, keyFile: keyFile, acmeDomains: "example.org"}},
+	}
+	for _, tt := range tests {
+		if ts, err := newTLSServer(&tt.opts); err == nil {
+			t.Errorf("%s: got %+v, want error", tt.name, ts)
+		}
+	}
+}
+
+func TestTLSACME(t *testing.T) {
+	ts, err := newTLSServer(&tlsOptions{acmeDomains: " example.org, ,www.example.org", acmeCacheDir: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ts.config.MinVersion != tls.VersionTLS12 {
+		t.Errorf("min version: got %#x, want %#x", ts.config.MinVersion, tls.VersionTLS12)
+	}
+	if ts.challengeHandler() == nil {
+		t.Error("no challenge handler with ACME")
+	}
+	for host, want := range map[string]bool{"example.org": true, "www.example.org": true, "": false, "evil.example.com": false} {
+		if err := ts.acme.HostPolicy(context.Background(), host); (err == nil) != want {
+			t.Errorf("host policy of %q: got %v", host, err)
+		}
+	}
+	if err := ts.reload(); err != nil {
+		t.Errorf("reload with ACME: %v", err)
+	}
+
+	if ts, err := newTLSServer(&tlsOptions{}); ts != nil || err != nil {
+		t.Errorf("without TLS: got %+v, %v", ts, err)
+	}
+}
@@ -0,0 +1,293 @@
+// Copyright (c) 2021 Andrew Archibald
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/andrewarchi/urlhero/index"
+	"github.com/andrewarchi/urlhero/logger"
+	"github.com/andrewarchi/urlhero/report"
+	"github.com/andrewarchi/urlhero/tinytown"
+	"github.com/andrewarchi/urlhero/tracing"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+var watchCmd = &command{
+	name:  "watch",
+	usage: "[-interval duration] [-once] [-releases dir] [-index dir] [-state file] [-compact n]",
+	run:   runWatch,
+}
+
+// watchState is persisted across restarts of the watch daemon.
+type watchState struct {
+	LastPoll time.Time                `json:"last_poll"`
+	Releases map[string]*releaseState `json:"releases"` // key: identifier
+	// LastReport is the report of the downloads and verifications of
+	// the last poll.
+	LastReport *report.Summary `json:"last_report,omitempty"`
+}
+
+type releaseState struct {
+	Downloaded time.Time `json:"downloaded,omitempty"`
+	Verified   time.Time `json:"verified,omitempty"`
+	Indexed    time.Time `json:"indexed,omitempty"`
+	Error      string    `json:"error,omitempty"` // last failure
+}
+
+func runWatch(cmd *command, args []string) error {
+	fs := newFlagSet(cmd)
+	interval := fs.Duration("interval", 24*time.Hour, "time between polls for new releases")
+	once := fs.Bool("once", false, "poll once and exit")
+	data := dataDir()
+	releasesDir := fs.String("releases", data.Releases(), "directory to download releases to")
+	indexDir := fs.String("index", data.Index(), "index directory to update")
+	stateFile := fs.String("state", data.State("watch.json"), "file to persist state to")
+	formatName := fs.String("index-format", "plain", "format of index files: plain, compact (smaller, slower to build), or columnar (faster scans of target hosts)")
+	compact := fs.Int("compact", 16, "compact hosts with at least `n` segments after each update; 0 never compacts")
+	parseFlags(fs, args)
+	if fs.NArg() != 0 {
+		usageExit(fs)
+	}
+	format, err := index.ParseFormat(*formatName)
+	if err != nil {
+		return &inputError{err}
+	}
+	// Updates interrupted by a crash resume from their last batch
+	buildOpts := &index.BuildOptions{Format: format, WALDir: *indexDir + ".wal"}
+
+	// Concurrent runs would download and index the same releases
+	lock, err := data.Lock()
+	if err != nil {
+		return err
+	}
+	defer lock.Unlock()
+	if err := data.Init(); err != nil {
+		return err
+	}
+
+	ctx, stop := interruptContext()
+	defer stop()
+
+	state, err := loadWatchState(*stateFile)
+	if err != nil {
+		return err
+	}
+	for {
+		err := poll(ctx, archiveReleases{}, state, *releasesDir, *indexDir, buildOpts, *compact)
+		state.LastPoll = time.Now().UTC()
+		if err1 := saveWatchState(*stateFile, state); err == nil {
+			err = err1
+		}
+		if *once || ctx.Err() != nil {
+			return err
+		}
+		if err != nil {
+			logger.Error("poll failed", "err", err)
+		}
+		logger.Info("waiting for next poll", "interval", *interval)
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(*interval):
+		}
+	}
+}
+
+// releaseSource lists and fetches the releases that watch polls.
+type releaseSource interface {
+	// List returns the identifiers of the published releases.
+	List(ctx context.Context) ([]string, error)
+	// Download downloads a release into releasesDir.
+	Download(ctx context.Context, releasesDir, id string) error
+	// Verify checks a downloaded release against its checksums.
+	Verify(ctx context.Context, releasesDir, id string) error
+}
+
+// archiveReleases is the releaseSource of the releases published to the
+// Internet Archive.
+type archiveReleases struct{}
+
+func (archiveReleases) List(ctx context.Context) ([]string, error) {
+	return tinytown.GetReleaseIDsContext(ctx)
+}
+
+func (archiveReleases) Download(ctx context.Context, releasesDir, id string) error {
+	return tinytown.DownloadReleasesContext(ctx, releasesDir, []string{id}, nil)
+}
+
+func (archiveReleases) Verify(ctx context.Context, releasesDir, id string) error {
+	return tinytown.VerifyReleaseContext(ctx, releasesDir, id)
+}
+
+// poll downloads, verifies, and indexes any new releases of src. They
+// are added to the index as segments, which are compacted once a host
+// has minSegments, if positive. Releases that fail to download or
+// verify are retried in the next poll and, when any do, a *partialError
+// with the report of the poll is returned.
+func poll(ctx context.Context, src releaseSource, state *watchState, releasesDir, indexDir string, buildOpts *index.BuildOptions, minSegments int) (err error) {
+	ctx, span := tracing.Start(ctx, "watch.poll")
+	defer func() { tracing.End(span, err) }()
+	ids, err := src.List(ctx)
+	if err != nil {
+		return err
+	}
+	sort.Strings(ids)
+	var pending []string
+	for _, id := range ids {
+		rs, ok := state.Releases[id]
+		if !ok {
+			rs = &releaseState{}
+			state.Releases[id] = rs
+		}
+		if rs.Verified.IsZero() {
+			pending = append(pending, id)
+		}
+	}
+	logger.Info("polled releases", "releases", len(ids), "new", len(pending))
+	if err := os.MkdirAll(releasesDir, 0o755); err != nil {
+		return err
+	}
+
+	rep := report.New("watch")
+	defer func() {
+		rep.Finish()
+		s := rep.Summary()
+		state.LastReport = &s
+		if rerr := rep.Err(); rerr != nil {
+			logger.Warn("some releases failed", "failed", s.Failed, "succeeded", s.Succeeded)
+			if err == nil {
+				err = &partialError{rerr}
+			}
+		}
+	}()
+	for _, id := range pending {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err := fetchRelease(ctx, src, releasesDir, id, state.Releases[id], rep); err != nil {
+			return err
+		}
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	// Releases that failed to index in an earlier poll are retried
+	var unindexed []string
+	for id, rs := range state.Releases {
+		if !rs.Verified.IsZero() && rs.Indexed.IsZero() {
+			unindexed = append(unindexed, id)
+		}
+	}
+	if len(unindexed) == 0 {
+		return nil
+	}
+	sort.Strings(unindexed)
+	logger.Info("updating index", "dir", indexDir, "releases", len(unindexed))
+	indexCtx, indexSpan := tracing.Start(ctx, "watch.index", attribute.Int("releases", len(unindexed)))
+	_, err = index.UpdateContext(indexCtx, indexDir, releasesDir, unindexed, buildOpts)
+	tracing.End(indexSpan, err)
+	if err != nil {
+		return err
+	}
+	now := time.Now().UTC()
+	for _, id := range unindexed {
+		state.Releases[id].Indexed = now
+	}
+	if minSegments <= 0 {
+		return nil
+	}
+	compactCtx, compactSpan := tracing.Start(ctx, "watch.compact")
+	hosts, err := index.CompactDirContext(compactCtx, indexDir, minSegments)
+	tracing.End(compactSpan, err)
+	if len(hosts) != 0 {
+		logger.Info("compacted index", "hosts", len(hosts))
+	}
+	return err
+}
+
+// fetchRelease downloads, unless already downloaded, and verifies a
+// release and records the outcome in its state and rep. Releases that
+// fail are discarded, to be retried in the next poll; only errors
+// discarding them are returned.
+func fetchRelease(ctx context.Context, src releaseSource, releasesDir, id string, rs *releaseState, rep *report.Report) error {
+	if rs.Downloaded.IsZero() {
+		logger.Info("downloading release", "id", id)
+		downloadCtx, span := tracing.Start(ctx, "watch.download", attribute.String("release", id))
+		err := src.Download(downloadCtx, releasesDir, id)
+		tracing.End(span, err)
+		if err != nil {
+			rs.Error = err.Error()
+			rep.Fail(id, err)
+			logger.Error("download failed", "id", id, "err", err)
+			return discardRelease(releasesDir, id, rs)
+		}
+		rs.Downloaded = time.Now().UTC()
+	}
+	verifyCtx, span := tracing.Start(ctx, "watch.verify", attribute.String("release", id))
+	err := src.Verify(verifyCtx, releasesDir, id)
+	tracing.End(span, err)
+	if err != nil {
+		rs.Error = err.Error()
+		rep.Fail(id, err)
+		logger.Error("verification failed", "id", id, "err", err)
+		return discardRelease(releasesDir, id, rs)
+	}
+	rs.Verified = time.Now().UTC()
+	rs.Error = ""
+	rep.Succeed(1)
+	return nil
+}
+
+// discardRelease removes the files of a release that failed to download
+// or verify, so that they are not indexed, and resets its state, so
+// that it is downloaded again on the next poll.
+func discardRelease(releasesDir, id string, rs *releaseState) error {
+	rs.Downloaded = time.Time{}
+	return os.RemoveAll(filepath.Join(releasesDir, id))
+}
+
+func loadWatchState(filename string) (*watchState, error) {
+	state := &watchState{Releases: make(map[string]*releaseState)}
+	b, err := os.ReadFile(filename)
+	if errors.Is(err, os.ErrNotExist) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, state); err != nil {
+		return nil, &inputError{err}
+	}
+	if state.Releases == nil {
+		state.Releases = make(map[string]*releaseState)
+	}
+	return state, nil
+}
+
+// saveWatchState atomically replaces the state file.
+func saveWatchState(filename string, state *watchState) error {
+	if err := os.MkdirAll(filepath.Dir(filename), 0o755); err != nil {
+		return err
+	}
+	b, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := filename + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filename)
+}
@@ -0,0 +1,107 @@
+// Copyright (c) 2021 Andrew Archibald
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// fakeReleases is a releaseSource of empty releases, whose verification
+// fails while failVerify has them.
+type fakeReleases struct {
+	ids        []string
+	failVerify map[string]bool
+	downloads  []string
+}
+
+func (f *fakeReleases) List(ctx context.Context) ([]string, error) {
+	return f.ids, nil
+}
+
+func (f *fakeReleases) Download(ctx context.Context, releasesDir, id string) error {
+	f.downloads = append(f.downloads, id)
+	return os.MkdirAll(filepath.Join(releasesDir, id), 0o755)
+}
+
+func (f *fakeReleases) Verify(ctx context.Context, releasesDir, id string) error {
+	if f.failVerify[id] {
+		return errors.New("checksum mismatch")
+	}
+	return nil
+}
+
+func TestPoll(t *testing.T) {
+	dir := t.TempDir()
+	releasesDir := filepath.Join(dir, "releases")
+	indexDir := filepath.Join(dir, "index")
+	stateFile := filepath.Join(dir, "state", "watch.json")
+	src := &fakeReleases{
+		ids:        []string{"urlteam_2021-01-02-00-00-00", "urlteam_2021-01-01-00-00-00"},
+		failVerify: map[string]bool{"urlteam_2021-01-02-00-00-00": true},
+	}
+	// pollOnce polls with the state as saved by the last poll, as after
+	// a restart
+	pollOnce := func() (*watchState, error) {
+		state, err := loadWatchState(stateFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = poll(context.Background(), src, state, releasesDir, indexDir, nil, 0)
+		if err := saveWatchState(stateFile, state); err != nil {
+			t.Fatal(err)
+		}
+		return state, err
+	}
+
+	// A failed verification is recorded and the release discarded
+	state, err := pollOnce()
+	var perr *partialError
+	if !errors.As(err, &perr) {
+		t.Fatalf("got error %v, want a *partialError", err)
+	}
+	failed := state.Releases["urlteam_2021-01-02-00-00-00"]
+	if failed.Error == "" || !failed.Downloaded.IsZero() || !failed.Verified.IsZero() {
+		t.Errorf("failed release has state %+v, want an error and not downloaded", failed)
+	}
+	if _, err := os.Stat(filepath.Join(releasesDir, "urlteam_2021-01-02-00-00-00")); !os.IsNotExist(err) {
+		t.Errorf("failed release was kept: %v", err)
+	}
+	if ok := state.Releases["urlteam_2021-01-01-00-00-00"]; ok.Verified.IsZero() || ok.Indexed.IsZero() || ok.Error != "" {
+		t.Errorf("verified release has state %+v, want verified and indexed", ok)
+	}
+	if state.LastReport == nil || state.LastReport.Failed != 1 || state.LastReport.Succeeded != 1 {
+		t.Errorf("got report %+v, want 1 failed and 1 succeeded", state.LastReport)
+	}
+
+	// The failed release is retried on the next poll, but not the
+	// completed one
+	src.failVerify = nil
+	if state, err = pollOnce(); err != nil {
+		t.Fatal(err)
+	}
+	retried := state.Releases["urlteam_2021-01-02-00-00-00"]
+	if retried.Error != "" || retried.Verified.IsZero() || retried.Indexed.IsZero() {
+		t.Errorf("retried release has state %+v, want verified and indexed", retried)
+	}
+	want := []string{"urlteam_2021-01-01-00-00-00", "urlteam_2021-01-02-00-00-00", "urlteam_2021-01-02-00-00-00"}
+	if !reflect.DeepEqual(src.downloads, want) {
+		t.Errorf("got downloads %q, want %q", src.downloads, want)
+	}
+
+	// Completed releases are skipped after a restart
+	if _, err := pollOnce(); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(src.downloads, want) {
+		t.Errorf("got downloads %q after a restart, want %q", src.downloads, want)
+	}
+}
@@ -0,0 +1,276 @@
+// Copyright (c) 2021 Andrew Archibald
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package crawl configures the identity and politeness of every
+// outbound HTTP request of this module, so that operators set their
+// crawl identity, timeouts, retries, and pacing once. The clients of ia
+// and tinytown use Transport, which reads the configuration for each
+// request, so Configure may be called after they are constructed.
+package crawl
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// DefaultUserAgent is the user agent of requests, when none is
+// configured.
+const DefaultUserAgent = "urlhero (+https://github.com/andrewarchi/urlhero)"
+
+// Config is the identity and politeness of outbound requests.
+type Config struct {
+	// UserAgent identifies the crawler, by default DefaultUserAgent.
+	UserAgent string
+	// Contact, such as an email address or URL, is appended to the user
+	// agent, so that the operators of the sites that are crawled can
+	// reach the operator of the crawl.
+	Contact string
+	// Timeout is the longest wait for the headers of a response, if
+	// positive. Bodies are not limited, so slow downloads of large
+	// files do not time out.
+	Timeout time.Duration
+	// Retries is the number of times that GET and HEAD requests that fail
+	// transiently, as judged by Retryable, are retried.
+	Retries int
+	// RetryDelay is the delay before the first retry, by default 1s,
+	// which doubles for each after. A longer Retry-After of a response
+	// takes precedence.
+	RetryDelay time.Duration
+	// RequestDelay is the minimum delay between successive requests to
+	// each host.
+	RequestDelay time.Duration
+}
+
+var current atomic.Value // Config
+
+func init() {
+	current.Store(Config{})
+}
+
+// Configure replaces the configuration of every request that follows.
+func Configure(c Config) {
+	current.Store(c)
+}
+
+// Current returns the configuration.
+func Current() Config {
+	return current.Load().(Config)
+}
+
+// UserAgentString returns the configured user agent, with the contact,
+// if any.
+func (c Config) UserAgentString() string {
+	ua := c.UserAgent
+	if ua == "" {
+		ua = DefaultUserAgent
+	}
+	if c.Contact != "" {
+		ua += " (" + c.Contact + ")"
+	}
+	return ua
+}
+
+// UserAgent returns the user agent of the current configuration.
+func UserAgent() string {
+	return Current().UserAgentString()
+}
+
+// Retryable reports whether an error is a transient network failure,
+// after which a request may be retried: a timeout, a refused or reset
+// connection, or a status error whose Temporary method reports true, as
+// for 429 and 5xx statuses. Data errors, such as malformed responses or
+// failed checksums, are not retryable.
+func Retryable(err error) bool {
+	var temp interface{ Temporary() bool }
+	if errors.As(err, &temp) && temp.Temporary() {
+		return true
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	return errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.EPIPE)
+}
+
+// TemporaryStatus reports whether a request that responded with a
+// status may succeed when retried, for server errors and rate
+// limiting.
+func TemporaryStatus(code int) bool {
+	return code == http.StatusTooManyRequests || code == http.StatusRequestTimeout || code >= 500
+}
+
+// Transport wraps a round tripper, or http.DefaultTransport when nil,
+// to apply the configuration to each request: it sets the user agent,
+// unless the request has one, paces requests to each host, times out
+// responses, and retries idempotent requests that fail transiently.
+func Transport(rt http.RoundTripper) http.RoundTripper {
+	if rt == nil {
+		rt = http.DefaultTransport
+	}
+	return &transport{rt: rt, last: make(map[string]time.Time)}
+}
+
+type transport struct {
+	rt   http.RoundTripper
+	mu   sync.Mutex
+	last map[string]time.Time // time of the last request to each host
+}
+
+func (t *transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	c := Current()
+	if req.Header.Get("User-Agent") == "" {
+		req = req.Clone(req.Context())
+		req.Header.Set("User-Agent", c.UserAgentString())
+	}
+	retries := c.Retries
+	if req.Method != http.MethodGet && req.Method != http.MethodHead ||
+		req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+		retries = 0
+	}
+	delay := c.RetryDelay
+	if delay <= 0 {
+		delay = time.Second
+	}
+	for i := 0; ; i++ {
+		if err := t.wait(req, c.RequestDelay); err != nil {
+			return nil, err
+		}
+		if i != 0 && req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req = req.Clone(req.Context())
+			req.Body = body
+		}
+		resp, err := t.roundTrip(req, c.Timeout)
+		if i == retries {
+			return resp, err
+		}
+		d := delay << i
+		switch {
+		case err != nil:
+			if !Retryable(err) {
+				return nil, err
+			}
+		case TemporaryStatus(resp.StatusCode):
+			if ra := retryAfter(resp); ra > d {
+				d = ra
+			}
+			io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<16))
+			resp.Body.Close()
+		default:
+			return resp, nil
+		}
+		if err := sleep(req.Context(), d); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// roundTrip sends a request, which is canceled when its response
+// headers take longer than the timeout, if positive.
+func (t *transport) roundTrip(req *http.Request, timeout time.Duration) (*http.Response, error) {
+	if timeout <= 0 {
+		return t.rt.RoundTrip(req)
+	}
+	ctx, cancel := context.WithCancel(req.Context())
+	timer := time.AfterFunc(timeout, cancel)
+	resp, err := t.rt.RoundTrip(req.WithContext(ctx))
+	if !timer.Stop() && err != nil && req.Context().Err() == nil {
+		cancel()
+		return nil, &timeoutError{req.URL.Host, timeout}
+	}
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	resp.Body = &cancelBody{resp.Body, cancel}
+	return resp, nil
+}
+
+// wait sleeps until the request delay has passed since the last request
+// to the host of the request.
+func (t *transport) wait(req *http.Request, d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+	host := req.URL.Host
+	t.mu.Lock()
+	now := time.Now()
+	next := t.last[host].Add(d)
+	if next.Before(now) {
+		next = now
+	}
+	t.last[host] = next
+	t.mu.Unlock()
+	return sleep(req.Context(), next.Sub(now))
+}
+
+// retryAfter returns the delay of the Retry-After header of a
+// response, in seconds or as a date, if any.
+func retryAfter(resp *http.Response) time.Duration {
+	ra := resp.Header.Get("Retry-After")
+	if ra == "" {
+		return 0
+	}
+	if s, err := strconv.Atoi(ra); err == nil && s > 0 {
+		return time.Duration(s) * time.Second
+	}
+	if t, err := http.ParseTime(ra); err == nil {
+		return time.Until(t)
+	}
+	return 0
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// cancelBody releases the context of its request when closed.
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+// timeoutError is returned when the headers of a response take longer
+// than the configured timeout.
+type timeoutError struct {
+	host    string
+	timeout time.Duration
+}
+
+func (err *timeoutError) Error() string {
+	return "crawl: " + err.host + ": no response after " + err.timeout.String()
+}
+
+func (err *timeoutError) Timeout() bool   { return true }
+func (err *timeoutError) Temporary() bool { return true }
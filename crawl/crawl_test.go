@@ -0,0 +1,84 @@
+// Copyright (c) 2021 Andrew Archibald
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package crawl
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestTransport(t *testing.T) {
+	var requests int32
+	var ua atomic.Value
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ua.Store(r.UserAgent())
+		switch r.URL.Path {
+		case "/flaky":
+			if atomic.AddInt32(&requests, 1) < 3 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+		case "/slow":
+			time.Sleep(100 * time.Millisecond)
+		case "/missing":
+			atomic.AddInt32(&requests, 1)
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+	defer srv.Close()
+	defer Configure(Config{})
+	client := &http.Client{Transport: Transport(nil)}
+
+	Configure(Config{Contact: "mailto:ops@example.org", Retries: 2, RetryDelay: time.Millisecond})
+	resp, err := client.Get(srv.URL + "/flaky")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || requests != 3 {
+		t.Errorf("flaky: got status %d after %d requests, want 200 after 3", resp.StatusCode, requests)
+	}
+	if got, want := ua.Load(), DefaultUserAgent+" (mailto:ops@example.org)"; got != want {
+		t.Errorf("user agent: got %q, want %q", got, want)
+	}
+
+	requests = 0
+	resp, err = client.Get(srv.URL + "/missing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound || requests != 1 {
+		t.Errorf("missing: got status %d after %d requests, want 404 after 1", resp.StatusCode, requests)
+	}
+
+	Configure(Config{UserAgent: "test", Timeout: 10 * time.Millisecond})
+	if _, err := client.Get(srv.URL + "/slow"); err == nil || !Retryable(err) {
+		t.Errorf("slow: got error %v, want retryable timeout", err)
+	}
+
+	Configure(Config{UserAgent: "test", RequestDelay: 20 * time.Millisecond})
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		resp, err := client.Get(srv.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	if d := time.Since(start); d < 40*time.Millisecond {
+		t.Errorf("paced requests took %v, want at least 40ms", d)
+	}
+	if got := ua.Load(); got != "test" {
+		t.Errorf("user agent: got %q, want %q", got, "test")
+	}
+}
@@ -0,0 +1,146 @@
+// Copyright (c) 2021 Andrew Archibald
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package datadir defines and manages the layout of the urlteam data
+// directory, which every subsystem uses, rather than joining paths of
+// its own:
+//
+//	releases/   downloaded releases, one directory per release
+//	extracted/  files extracted from releases
+//	index/      the lookup index
+//	state/      state persisted between runs, such as of watch
+//	cache/      data that can be recreated, such as ACME certificates
+//
+// By default, the data directory is $XDG_DATA_HOME/urlteam, following
+// the XDG base directory specification.
+package datadir
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Dir is a data directory.
+type Dir struct {
+	Root string
+}
+
+// New returns the data directory at root, or the default directory,
+// when root is empty. It does not create it.
+func New(root string) *Dir {
+	if root == "" {
+		root = Default()
+	}
+	return &Dir{Root: root}
+}
+
+// Default returns $XDG_DATA_HOME/urlteam, falling back to
+// ~/.local/share/urlteam.
+func Default() string {
+	if dir := os.Getenv("XDG_DATA_HOME"); dir != "" {
+		return filepath.Join(dir, "urlteam")
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "urlteam"
+	}
+	return filepath.Join(home, ".local", "share", "urlteam")
+}
+
+// Subdirs are the subdirectories of a data directory.
+var Subdirs = []string{"releases", "extracted", "index", "state", "cache"}
+
+// Releases returns the directory of downloaded releases.
+func (d *Dir) Releases() string { return filepath.Join(d.Root, "releases") }
+
+// Release returns the directory of a release, by its identifier.
+func (d *Dir) Release(id string) string { return filepath.Join(d.Root, "releases", id) }
+
+// Extracted returns the directory of files extracted from releases.
+func (d *Dir) Extracted() string { return filepath.Join(d.Root, "extracted") }
+
+// Index returns the index directory.
+func (d *Dir) Index() string { return filepath.Join(d.Root, "index") }
+
+// State returns the path of a state file, such as "watch.json".
+func (d *Dir) State(name string) string { return filepath.Join(d.Root, "state", name) }
+
+// Cache returns the path of a cache file or directory, such as "acme".
+func (d *Dir) Cache(name string) string { return filepath.Join(d.Root, "cache", name) }
+
+// Init creates the data directory and its subdirectories.
+func (d *Dir) Init() error {
+	for _, sub := range Subdirs {
+		if err := os.MkdirAll(filepath.Join(d.Root, sub), 0o777); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ErrLocked is matched by errors.Is when the data directory is locked
+// by another run.
+var ErrLocked = errors.New("datadir: locked by another run")
+
+// Lock is an exclusive lock on a data directory, which keeps runs that
+// write to it, such as watch and compact, from running concurrently.
+type Lock struct {
+	f *os.File
+}
+
+// lockName is the name of the lock file, which holds the process ID of
+// the run that holds the lock.
+const lockName = "lock"
+
+// Lock locks the data directory, creating it when it does not exist,
+// without waiting. When it is locked by another run, an error matching
+// ErrLocked is returned. The lock is released when the process exits,
+// even when it crashes.
+func (d *Dir) Lock() (*Lock, error) {
+	if err := os.MkdirAll(d.Root, 0o777); err != nil {
+		return nil, err
+	}
+	filename := filepath.Join(d.Root, lockName)
+	f, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE, 0o666)
+	if err != nil {
+		return nil, err
+	}
+	if err := lockFile(f); err != nil {
+		f.Close()
+		if errors.Is(err, errWouldBlock) {
+			return nil, d.lockedError()
+		}
+		return nil, fmt.Errorf("datadir: locking %s: %w", filename, err)
+	}
+	if err := f.Truncate(0); err == nil {
+		f.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0)
+	}
+	return &Lock{f}, nil
+}
+
+func (d *Dir) lockedError() error {
+	b, _ := os.ReadFile(filepath.Join(d.Root, lockName))
+	if pid := strings.TrimSpace(string(b)); pid != "" {
+		return fmt.Errorf("%w: %s is locked by process %s", ErrLocked, d.Root, pid)
+	}
+	return fmt.Errorf("%w: %s", ErrLocked, d.Root)
+}
+
+// Unlock releases the lock.
+func (l *Lock) Unlock() error {
+	// The lock file is kept, since removing it would race with a run
+	// that has opened it, but not yet locked it
+	l.f.Truncate(0)
+	if err := unlockFile(l.f); err != nil {
+		l.f.Close()
+		return err
+	}
+	return l.f.Close()
+}
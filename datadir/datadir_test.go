@@ -0,0 +1,75 @@
+// Copyright (c) 2021 Andrew Archibald
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package datadir
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestLayout(t *testing.T) {
+	root := t.TempDir()
+	d := New(root)
+	for _, tt := range []struct{ got, want string }{
+		{d.Releases(), filepath.Join(root, "releases")},
+		{d.Release("urlteam_1"), filepath.Join(root, "releases", "urlteam_1")},
+		{d.Extracted(), filepath.Join(root, "extracted")},
+		{d.Index(), filepath.Join(root, "index")},
+		{d.State("watch.json"), filepath.Join(root, "state", "watch.json")},
+		{d.Cache("acme"), filepath.Join(root, "cache", "acme")},
+	} {
+		if tt.got != tt.want {
+			t.Errorf("got path %s, want %s", tt.got, tt.want)
+		}
+	}
+	if err := d.Init(); err != nil {
+		t.Fatal(err)
+	}
+	for _, sub := range Subdirs {
+		if fi, err := os.Stat(filepath.Join(root, sub)); err != nil || !fi.IsDir() {
+			t.Errorf("Init did not create %s: %v", sub, err)
+		}
+	}
+
+	old, ok := os.LookupEnv("XDG_DATA_HOME")
+	os.Setenv("XDG_DATA_HOME", "/xdg")
+	defer func() {
+		if ok {
+			os.Setenv("XDG_DATA_HOME", old)
+		} else {
+			os.Unsetenv("XDG_DATA_HOME")
+		}
+	}()
+	if got, want := New("").Root, filepath.Join("/xdg", "urlteam"); got != want {
+		t.Errorf("default root %s, want %s", got, want)
+	}
+}
+
+func TestLock(t *testing.T) {
+	if runtime.GOOS != "linux" && runtime.GOOS != "darwin" && runtime.GOOS != "freebsd" {
+		t.Skip("locks are not supported on", runtime.GOOS)
+	}
+	d := New(filepath.Join(t.TempDir(), "data"))
+	lock, err := d.Lock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Lock(); !errors.Is(err, ErrLocked) {
+		t.Errorf("second Lock: got error %v, want ErrLocked", err)
+	}
+	if err := lock.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+	lock, err = d.Lock()
+	if err != nil {
+		t.Fatalf("Lock after Unlock: %v", err)
+	}
+	lock.Unlock()
+}
@@ -0,0 +1,249 @@
+// Copyright (c) 2021 Andrew Archibald
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package escrow imports the CSV dumps that shortener operators donate
+// to escrow with 301Works, so that donated mappings are indexed with
+// those scraped by URLTeam.
+package escrow
+
+import (
+	"bufio"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/andrewarchi/urlhero/index"
+	"github.com/andrewarchi/urlhero/shorteners"
+)
+
+// The 301Works escrow schema is a CSV file with a row per mapping of
+// the short URL or shortcode, the long URL, and, optionally, when it was
+// created. Operators differ in the details: the fields may be separated
+// by commas, tabs, pipes, or semicolons, and a header row naming the
+// columns, in any order and with others, may come first. Without a
+// header, the columns are the short URL or shortcode, the long URL, then
+// the creation time, and a first row without a long URL is taken to be
+// a header that is not recognized.
+
+// columnNames are the header names of each column, lowercase with
+// spaces and dashes as underscores.
+var columnNames = [numFields][]string{
+	shortField:   {"short_url", "shorturl", "short", "shortcode", "short_code", "code", "slug", "keyword", "hash"},
+	longField:    {"long_url", "longurl", "url", "target", "destination", "original_url", "original", "redirect"},
+	createdField: {"created", "created_at", "creation_date", "date", "timestamp", "time"},
+}
+
+const (
+	shortField = iota
+	longField
+	createdField
+	numFields
+)
+
+// timeLayouts are the layouts of creation times that are recognized,
+// besides Unix times.
+var timeLayouts = []string{
+	time.RFC3339,
+	"2006-01-02 15:04:05",
+	"2006-01-02T15:04:05",
+	"2006-01-02",
+	"01/02/2006 15:04:05",
+	"01/02/2006",
+}
+
+// ErrHost is returned for short URLs of another shortener than that of
+// the dump.
+var ErrHost = errors.New("escrow: short URL of another host")
+
+// Reader reads the mappings of an escrow dump as records.
+type Reader struct {
+	host    string
+	br      *bufio.Reader
+	cr      *csv.Reader
+	columns [numFields]int // index of each field, or -1
+	pending []string       // first row, when there is no header
+	row     int            // rows read, counting the header
+}
+
+// NewReader constructs a reader of a dump of the shortener with the
+// given host. The delimiter and header are detected from the first
+// line.
+func NewReader(r io.Reader, host string) *Reader {
+	return &Reader{host: host, br: bufio.NewReader(r)}
+}
+
+// init detects the delimiter and reads the header, if any.
+func (r *Reader) init() error {
+	first, err := r.br.Peek(4096)
+	if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+		return err
+	}
+	if i := strings.IndexByte(string(first), '\n'); i != -1 {
+		first = first[:i]
+	}
+	comma := ','
+	best := strings.Count(string(first), ",")
+	for _, c := range []rune{'\t', '|', ';'} {
+		if n := strings.Count(string(first), string(c)); n > best {
+			comma, best = c, n
+		}
+	}
+	r.cr = csv.NewReader(r.br)
+	r.cr.Comma = comma
+	r.cr.FieldsPerRecord = -1
+	r.cr.LazyQuotes = true
+	r.cr.TrimLeadingSpace = true
+	row, err := r.cr.Read()
+	if err != nil {
+		return err
+	}
+	r.row++
+	if len(row) != 0 {
+		row[0] = strings.TrimPrefix(row[0], "\ufeff")
+	}
+	header := false
+	for i := range r.columns {
+		r.columns[i] = -1
+	}
+	for i, name := range row {
+		name = strings.ToLower(strings.TrimSpace(name))
+		name = strings.NewReplacer(" ", "_", "-", "_").Replace(name)
+		for f, names := range columnNames {
+			if r.columns[f] != -1 {
+				continue
+			}
+			for _, n := range names {
+				if name == n {
+					r.columns[f], header = i, true
+					break
+				}
+			}
+		}
+	}
+	if !header {
+		if len(row) < 2 || !strings.ContainsAny(row[longField], ".:/") {
+			return fmt.Errorf("escrow: unrecognized header: %q", row)
+		}
+		r.columns = [numFields]int{0, 1, 2}
+		r.pending = append([]string(nil), row...)
+		return nil
+	}
+	if r.columns[shortField] == -1 || r.columns[longField] == -1 {
+		return fmt.Errorf("escrow: header has no short and long URL columns: %q", row)
+	}
+	return nil
+}
+
+// Read reads the next mapping as a record, with the creation time, if
+// any, as when it was first and last seen. Bare shortcodes are used as
+// they are and short URLs are cleaned by the rules of the shortener.
+// Rows without a shortcode or long URL are skipped. It returns io.EOF
+// at the end of the dump.
+func (r *Reader) Read() (index.Record, error) {
+	if r.cr == nil {
+		if err := r.init(); err != nil {
+			return index.Record{}, err
+		}
+	}
+	for {
+		var row []string
+		if r.pending != nil {
+			row, r.pending = r.pending, nil
+		} else {
+			var err error
+			if row, err = r.cr.Read(); err != nil {
+				if err != io.EOF {
+					err = fmt.Errorf("escrow: row %d: %w", r.row+1, err)
+				}
+				return index.Record{}, err
+			}
+			r.row++
+		}
+		rec, ok, err := r.parse(row)
+		if err != nil {
+			return index.Record{}, fmt.Errorf("escrow: row %d: %w", r.row, err)
+		}
+		if ok {
+			return rec, nil
+		}
+	}
+}
+
+func (r *Reader) parse(row []string) (index.Record, bool, error) {
+	field := func(f int) string {
+		if i := r.columns[f]; i != -1 && i < len(row) {
+			return strings.TrimSpace(row[i])
+		}
+		return ""
+	}
+	short, long := field(shortField), field(longField)
+	if short == "" || long == "" {
+		return index.Record{}, false, nil
+	}
+	shortcode := short
+	if strings.Contains(short, "/") {
+		host, code, err := shorteners.ParseShortURL(short)
+		if err != nil {
+			return index.Record{}, false, err
+		}
+		if host != r.host {
+			return index.Record{}, false, fmt.Errorf("%w: %s", ErrHost, short)
+		}
+		shortcode = code
+	}
+	if shortcode == "" {
+		return index.Record{}, false, nil
+	}
+	rec := index.Record{Shortcode: shortcode, Target: long}
+	if created := field(createdField); created != "" {
+		t, err := parseTime(created)
+		if err != nil {
+			return index.Record{}, false, err
+		}
+		rec.FirstSeen, rec.LastSeen = t, t
+	}
+	return rec, true, nil
+}
+
+// parseTime parses a creation time in any of the layouts or as Unix
+// seconds.
+func parseTime(s string) (time.Time, error) {
+	if n, err := strconv.ParseInt(s, 10, 64); err == nil && n > 0 {
+		return time.Unix(n, 0).UTC(), nil
+	}
+	for _, layout := range timeLayouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t.UTC(), nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("unrecognized creation time %q", s)
+}
+
+// Import adds the mappings of a dump of the shortener with the given
+// host to an index builder, attributed to a release, such as the ID of
+// the 301Works item, and returns the number added.
+func Import(b *index.Builder, host, release string, r io.Reader) (int, error) {
+	er := NewReader(r, host)
+	b.AddRelease(host, release)
+	n := 0
+	for {
+		rec, err := er.Read()
+		if err == io.EOF {
+			return n, nil
+		}
+		if err != nil {
+			return n, err
+		}
+		if err := b.AddFrom(host, release, rec); err != nil {
+			return n, err
+		}
+		n++
+	}
+}
@@ -0,0 +1,111 @@
+// Copyright (c) 2021 Andrew Archibald
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package escrow
+
+import (
+	"errors"
+	"io"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/andrewarchi/urlhero/index"
+)
+
+func TestReader(t *testing.T) {
+	created := time.Date(2011, 3, 18, 12, 30, 0, 0, time.UTC)
+	for _, tt := range []struct {
+		name, dump string
+		want       []index.Record
+	}{
+		{"header", "\ufeffID,Long URL,Short URL,Created At\n" +
+			"1,http://example.com/a,https://rb.gy/abc,2011-03-18 12:30:00\n" +
+			"2,,https://rb.gy/empty,\n" +
+			"3,\"http://example.com/b,c\",http://rb.gy/def+,\n",
+			[]index.Record{
+				{Shortcode: "abc", Target: "http://example.com/a", FirstSeen: created, LastSeen: created},
+				{Shortcode: "def", Target: "http://example.com/b,c"},
+			}},
+		{"headerless tabs", "abc\thttp://example.com/a\t1300451400\n" +
+			"def\thttp://example.com/\"quoted\"\n",
+			[]index.Record{
+				{Shortcode: "abc", Target: "http://example.com/a", FirstSeen: created, LastSeen: created},
+				{Shortcode: "def", Target: `http://example.com/"quoted"`},
+			}},
+		{"pipes", "shortcode|url\nabc|http://example.com/a\n",
+			[]index.Record{{Shortcode: "abc", Target: "http://example.com/a"}}},
+		{"empty", "", nil},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			r := NewReader(strings.NewReader(tt.dump), "rb.gy")
+			var got []index.Record
+			for {
+				rec, err := r.Read()
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				got = append(got, rec)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReaderErrors(t *testing.T) {
+	for _, tt := range []struct {
+		dump string
+		is   error
+	}{
+		{"short_url,long_url\nhttps://bit.ly/abc,http://example.com/\n", ErrHost},
+		{"short_url,long_url,created\nabc,http://example.com/,yesterday\n", nil},
+		{"id,name\n1,a\n", nil}, // unrecognized header
+	} {
+		r := NewReader(strings.NewReader(tt.dump), "rb.gy")
+		var err error
+		for err == nil {
+			_, err = r.Read()
+		}
+		if err == io.EOF {
+			t.Errorf("reading %q succeeded", tt.dump)
+		} else if tt.is != nil && !errors.Is(err, tt.is) {
+			t.Errorf("reading %q: got error %v, want %v", tt.dump, err, tt.is)
+		}
+	}
+}
+
+func TestImport(t *testing.T) {
+	b := index.NewBuilder()
+	dump := "short_url,long_url,created\nhttps://rb.gy/abc,http://example.com/a,2011-03-18\n"
+	if n, err := Import(b, "rb.gy", "301works_rbgy", strings.NewReader(dump)); err != nil || n != 1 {
+		t.Fatalf("Import = %d, %v, want 1", n, err)
+	}
+	dir := filepath.Join(t.TempDir(), "index")
+	if err := b.Write(dir); err != nil {
+		t.Fatal(err)
+	}
+	idx, err := index.Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idx.Close()
+	r := idx.Reader("rb.gy")
+	if got := r.Meta().Releases; !reflect.DeepEqual(got, []string{"301works_rbgy"}) {
+		t.Errorf("got releases %q", got)
+	}
+	day := time.Date(2011, 3, 18, 0, 0, 0, 0, time.UTC)
+	want := index.Record{Shortcode: "abc", Target: "http://example.com/a", FirstSeen: day, LastSeen: day}
+	if rec, ok, err := r.LookupRecord("abc"); err != nil || !ok || rec != want {
+		t.Errorf("LookupRecord = %v, %t, %v, want %v", rec, ok, err, want)
+	}
+}
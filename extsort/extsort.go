@@ -0,0 +1,553 @@
+// Copyright (c) 2021 Andrew Archibald
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package extsort sorts sequences of items that do not fit in memory,
+// by spilling sorted runs to temporary files and merging them. Items
+// are opaque byte strings, ordered by a caller-provided comparator.
+package extsort
+
+import (
+	"bufio"
+	"container/heap"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+)
+
+// Less reports whether item a sorts before item b.
+type Less func(a, b []byte) bool
+
+// Iter iterates over items in order.
+type Iter interface {
+	// Next advances to the next item and returns false when there are
+	// no more items or an error occurred.
+	Next() bool
+	// Item returns the current item, which is only valid until the next
+	// call to Next.
+	Item() []byte
+	// Err returns the error, if any, that stopped iteration.
+	Err() error
+}
+
+// RunWriter writes a run of items, each prefixed by its length as a
+// uvarint.
+type RunWriter struct {
+	w   *bufio.Writer
+	buf [binary.MaxVarintLen64]byte
+}
+
+// runBufSize is the buffer size of run readers and writers.
+const runBufSize = 64 << 10
+
+// Buffers of runs are recycled, because a builder spills and merges
+// runs for every host.
+var (
+	runWriters = sync.Pool{New: func() interface{} { return bufio.NewWriterSize(nil, runBufSize) }}
+	runReaders = sync.Pool{New: func() interface{} { return bufio.NewReaderSize(nil, runBufSize) }}
+)
+
+// NewRunWriter constructs a run writer that writes to w.
+func NewRunWriter(w io.Writer) *RunWriter {
+	bw := runWriters.Get().(*bufio.Writer)
+	bw.Reset(w)
+	return &RunWriter{w: bw}
+}
+
+// Write writes an item to the run.
+func (rw *RunWriter) Write(item []byte) error {
+	n := binary.PutUvarint(rw.buf[:], uint64(len(item)))
+	if _, err := rw.w.Write(rw.buf[:n]); err != nil {
+		return err
+	}
+	_, err := rw.w.Write(item)
+	return err
+}
+
+// Flush writes any buffered items to the underlying writer.
+func (rw *RunWriter) Flush() error {
+	return rw.w.Flush()
+}
+
+// release returns the buffer to runWriters, after the run is flushed.
+func (rw *RunWriter) release() {
+	rw.w.Reset(nil)
+	runWriters.Put(rw.w)
+	rw.w = nil
+}
+
+// RunReader reads a run of items written by RunWriter.
+type RunReader struct {
+	r    *bufio.Reader
+	item []byte
+	err  error
+}
+
+// NewRunReader constructs a run reader that reads from r. Its buffer is
+// recycled once the run has been read to the end.
+func NewRunReader(r io.Reader) *RunReader {
+	br := runReaders.Get().(*bufio.Reader)
+	br.Reset(r)
+	return &RunReader{r: br}
+}
+
+func (rr *RunReader) Next() bool {
+	if rr.err != nil || rr.r == nil {
+		return false
+	}
+	n, err := binary.ReadUvarint(rr.r)
+	if err != nil {
+		if err != io.EOF {
+			rr.err = fmt.Errorf("extsort: reading run: %w", err)
+		}
+		rr.item = nil
+		rr.release()
+		return false
+	}
+	if uint64(cap(rr.item)) < n {
+		rr.item = make([]byte, n)
+	}
+	rr.item = rr.item[:n]
+	if _, err := io.ReadFull(rr.r, rr.item); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		rr.err = fmt.Errorf("extsort: reading run: %w", err)
+		rr.item = nil
+		rr.release()
+		return false
+	}
+	return true
+}
+
+func (rr *RunReader) release() {
+	rr.r.Reset(nil)
+	runReaders.Put(rr.r)
+	rr.r = nil
+}
+
+func (rr *RunReader) Item() []byte { return rr.item }
+func (rr *RunReader) Err() error   { return rr.err }
+
+// Merge merges sorted iterators with a k-way merge. Equal items are
+// yielded in the order of the iterators they are from, so a merge of
+// runs that were stably sorted in order is stable.
+func Merge(less Less, its ...Iter) Iter {
+	return &merger{h: mergeHeap{less: less}, its: its}
+}
+
+type merger struct {
+	h       mergeHeap
+	its     []Iter
+	started bool
+	cur     Iter // advanced on the next call to Next
+	err     error
+}
+
+func (m *merger) Next() bool {
+	if m.err != nil {
+		return false
+	}
+	if !m.started {
+		m.started = true
+		for i, it := range m.its {
+			if it.Next() {
+				m.h.entries = append(m.h.entries, mergeEntry{it, i})
+			} else if err := it.Err(); err != nil {
+				m.err = err
+				return false
+			}
+		}
+		heap.Init(&m.h)
+	} else if m.cur != nil {
+		if m.cur.Next() {
+			heap.Fix(&m.h, 0)
+		} else {
+			if err := m.cur.Err(); err != nil {
+				m.err = err
+				return false
+			}
+			heap.Pop(&m.h)
+		}
+	}
+	if len(m.h.entries) == 0 {
+		m.cur = nil
+		return false
+	}
+	m.cur = m.h.entries[0].it
+	return true
+}
+
+func (m *merger) Item() []byte {
+	if m.cur == nil {
+		return nil
+	}
+	return m.cur.Item()
+}
+
+func (m *merger) Err() error { return m.err }
+
+type mergeEntry struct {
+	it    Iter
+	order int
+}
+
+type mergeHeap struct {
+	less    Less
+	entries []mergeEntry
+}
+
+func (h *mergeHeap) Len() int { return len(h.entries) }
+func (h *mergeHeap) Less(i, j int) bool {
+	a, b := h.entries[i], h.entries[j]
+	if h.less(a.it.Item(), b.it.Item()) {
+		return true
+	}
+	if h.less(b.it.Item(), a.it.Item()) {
+		return false
+	}
+	return a.order < b.order
+}
+func (h *mergeHeap) Swap(i, j int)      { h.entries[i], h.entries[j] = h.entries[j], h.entries[i] }
+func (h *mergeHeap) Push(x interface{}) { h.entries = append(h.entries, x.(mergeEntry)) }
+func (h *mergeHeap) Pop() interface{} {
+	e := h.entries[len(h.entries)-1]
+	h.entries = h.entries[:len(h.entries)-1]
+	return e
+}
+
+// Unique removes adjacent equal items from a sorted iterator, keeping
+// the first of each.
+func Unique(it Iter, equal func(a, b []byte) bool) Iter {
+	return &uniqueIter{it: it, equal: equal}
+}
+
+type uniqueIter struct {
+	it    Iter
+	equal func(a, b []byte) bool
+	prev  []byte
+	ok    bool // whether prev is set
+}
+
+func (u *uniqueIter) Next() bool {
+	for u.it.Next() {
+		item := u.it.Item()
+		if u.ok && u.equal(u.prev, item) {
+			continue
+		}
+		u.prev = append(u.prev[:0], item...)
+		u.ok = true
+		return true
+	}
+	return false
+}
+
+func (u *uniqueIter) Item() []byte { return u.prev }
+func (u *uniqueIter) Err() error   { return u.it.Err() }
+
+// Sorter sorts items stably, spilling them to sorted runs in temporary
+// files when they exceed a memory limit.
+type Sorter struct {
+	less     Less
+	dir      string
+	memLimit int
+	maxFanIn int
+
+	arena  []byte
+	chunks []*[arenaSize]byte // of arena, to recycle
+	items  [][]byte
+	size   int
+	runs   []*os.File
+	sorted bool
+}
+
+// arenaSize is the size of the chunks that added items are copied into.
+const arenaSize = 1 << 20
+
+// arenas recycles the chunks of sorters once their items are spilled,
+// so that the sorters of a builder, which spill together, share them.
+var arenas = sync.Pool{New: func() interface{} { return new([arenaSize]byte) }}
+
+// DefaultMaxFanIn is the default maximum number of runs that are
+// merged at once.
+const DefaultMaxFanIn = 64
+
+// NewSorter constructs a sorter, which spills runs to dir, or the
+// default temporary directory when empty, once the added items exceed
+// memLimit bytes. A memLimit of 0 never spills automatically.
+func NewSorter(less Less, dir string, memLimit int) *Sorter {
+	return &Sorter{less: less, dir: dir, memLimit: memLimit, maxFanIn: DefaultMaxFanIn}
+}
+
+// SetMaxFanIn sets the maximum number of runs that are merged at once,
+// which bounds the open files and read buffers of a merge. When more
+// runs are spilled, Sort first merges them in intermediate passes. A
+// fan-in less than 2 is DefaultMaxFanIn.
+func (s *Sorter) SetMaxFanIn(n int) {
+	if n < 2 {
+		n = DefaultMaxFanIn
+	}
+	s.maxFanIn = n
+}
+
+// errSorted is returned when items are added after sorting.
+var errSorted = errors.New("extsort: add after sort")
+
+// Add adds a copy of an item.
+func (s *Sorter) Add(item []byte) error {
+	if s.sorted {
+		return errSorted
+	}
+	if len(s.arena)+len(item) > cap(s.arena) {
+		// Items refer to the old chunk, so it is not grown in place
+		if len(item) > arenaSize {
+			s.arena = make([]byte, 0, len(item))
+		} else {
+			chunk := arenas.Get().(*[arenaSize]byte)
+			s.chunks = append(s.chunks, chunk)
+			s.arena = chunk[:0]
+		}
+	}
+	start := len(s.arena)
+	s.arena = append(s.arena, item...)
+	s.items = append(s.items, s.arena[start:len(s.arena):len(s.arena)])
+	s.size += len(item)
+	if s.memLimit > 0 && s.size >= s.memLimit {
+		return s.Spill()
+	}
+	return nil
+}
+
+// Len returns the number of items held in memory.
+func (s *Sorter) Len() int { return len(s.items) }
+
+// Size returns the number of bytes of items held in memory.
+func (s *Sorter) Size() int { return s.size }
+
+// Runs returns the number of runs spilled to disk.
+func (s *Sorter) Runs() int { return len(s.runs) }
+
+// RunFiles returns the names of the files of the runs, in order.
+func (s *Sorter) RunFiles() []string {
+	names := make([]string, len(s.runs))
+	for i, f := range s.runs {
+		names[i] = f.Name()
+	}
+	return names
+}
+
+// AddRun adds a run that was previously spilled, such as by a sorter
+// before a crash, after the runs already spilled. It is removed by
+// Close.
+func (s *Sorter) AddRun(filename string) error {
+	if s.sorted {
+		return errSorted
+	}
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	s.runs = append(s.runs, f)
+	return nil
+}
+
+// Sync commits the runs to stable storage.
+func (s *Sorter) Sync() error {
+	for _, f := range s.runs {
+		if err := f.Sync(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Spill sorts the items held in memory and writes them as a run to a
+// temporary file.
+func (s *Sorter) Spill() error {
+	if len(s.items) == 0 {
+		return nil
+	}
+	s.sortMemory()
+	f, err := os.CreateTemp(s.dir, "extsort-*.run")
+	if err != nil {
+		return err
+	}
+	s.runs = append(s.runs, f)
+	rw := NewRunWriter(f)
+	for _, item := range s.items {
+		if err := rw.Write(item); err != nil {
+			return err
+		}
+	}
+	if err := rw.Flush(); err != nil {
+		return err
+	}
+	rw.release()
+	s.reset()
+	return nil
+}
+
+// reset drops the items held in memory and recycles their chunks.
+func (s *Sorter) reset() {
+	for i, chunk := range s.chunks {
+		arenas.Put(chunk)
+		s.chunks[i] = nil
+	}
+	for i := range s.items {
+		s.items[i] = nil
+	}
+	s.arena, s.chunks, s.items, s.size = nil, s.chunks[:0], s.items[:0], 0
+}
+
+func (s *Sorter) sortMemory() {
+	sort.SliceStable(s.items, func(i, j int) bool {
+		return s.less(s.items[i], s.items[j])
+	})
+}
+
+// Sort returns an iterator over the items in order. No more items can
+// be added.
+func (s *Sorter) Sort() (Iter, error) {
+	s.sorted = true
+	if len(s.runs) == 0 {
+		s.sortMemory()
+		return &sliceIter{items: s.items, i: -1}, nil
+	}
+	if err := s.Spill(); err != nil {
+		return nil, err
+	}
+	for len(s.runs) > s.maxFanIn {
+		if err := s.mergePass(); err != nil {
+			return nil, err
+		}
+	}
+	return s.mergeRuns(s.runs)
+}
+
+// mergeRuns returns an iterator that merges runs.
+func (s *Sorter) mergeRuns(runs []*os.File) (Iter, error) {
+	its := make([]Iter, len(runs))
+	for i, f := range runs {
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+		its[i] = NewRunReader(f)
+	}
+	return Merge(s.less, its...), nil
+}
+
+// mergePass merges each group of up to maxFanIn adjacent runs into a
+// single run, which replaces them. Runs are merged in order, so the
+// merge stays stable.
+func (s *Sorter) mergePass() error {
+	runs := s.runs
+	s.runs = nil
+	for i := 0; i < len(runs); i += s.maxFanIn {
+		j := i + s.maxFanIn
+		if j > len(runs) {
+			j = len(runs)
+		}
+		if j-i == 1 {
+			s.runs = append(s.runs, runs[i])
+			continue
+		}
+		f, err := s.mergeGroup(runs[i:j])
+		if f != nil {
+			s.runs = append(s.runs, f)
+		}
+		if err != nil {
+			// The runs that are not merged are still removed by Close
+			s.runs = append(s.runs, runs[i:]...)
+			return err
+		}
+		for _, run := range runs[i:j] {
+			err := run.Close()
+			if err1 := os.Remove(run.Name()); err == nil {
+				err = err1
+			}
+			if err != nil {
+				s.runs = append(s.runs, runs[j:]...)
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// mergeGroup merges runs into a new run. The run is returned, even with
+// an error, so that it is removed by Close.
+func (s *Sorter) mergeGroup(runs []*os.File) (*os.File, error) {
+	it, err := s.mergeRuns(runs)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.CreateTemp(s.dir, "extsort-*.run")
+	if err != nil {
+		return nil, err
+	}
+	rw := NewRunWriter(f)
+	for it.Next() {
+		if err := rw.Write(it.Item()); err != nil {
+			return f, err
+		}
+	}
+	if err := it.Err(); err != nil {
+		return f, err
+	}
+	if err := rw.Flush(); err != nil {
+		return f, err
+	}
+	rw.release()
+	return f, nil
+}
+
+// Close removes the spilled runs.
+func (s *Sorter) Close() error {
+	return s.close(true)
+}
+
+// Detach closes the spilled runs without removing them, so that they
+// can be added to another sorter.
+func (s *Sorter) Detach() error {
+	return s.close(false)
+}
+
+func (s *Sorter) close(remove bool) error {
+	var err error
+	for _, f := range s.runs {
+		if err1 := f.Close(); err1 != nil && err == nil {
+			err = err1
+		}
+		if remove {
+			if err1 := os.Remove(f.Name()); err1 != nil && err == nil {
+				err = err1
+			}
+		}
+	}
+	s.runs = nil
+	s.reset()
+	return err
+}
+
+type sliceIter struct {
+	items [][]byte
+	i     int
+}
+
+func (it *sliceIter) Next() bool {
+	if it.i+1 >= len(it.items) {
+		it.i = len(it.items)
+		return false
+	}
+	it.i++
+	return true
+}
+
+func (it *sliceIter) Item() []byte { return it.items[it.i] }
+func (it *sliceIter) Err() error   { return nil }
@@ -0,0 +1,225 @@
+// Copyright (c) 2021 Andrew Archibald
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package extsort
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+// lessKey orders items by their key, the text before a space, so that
+// stability is observable by the text after.
+func lessKey(a, b []byte) bool {
+	return bytes.Compare(key(a), key(b)) < 0
+}
+
+func key(item []byte) []byte {
+	if i := bytes.IndexByte(item, ' '); i != -1 {
+		return item[:i]
+	}
+	return item
+}
+
+func collect(t *testing.T, it Iter) []string {
+	t.Helper()
+	var items []string
+	for it.Next() {
+		items = append(items, string(it.Item()))
+	}
+	if err := it.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return items
+}
+
+// sorterItems returns items with duplicate keys and the items stably
+// sorted.
+func sorterItems() (items, sorted []string) {
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 5000; i++ {
+		items = append(items, fmt.Sprintf("%04d %d", rng.Intn(1000), i))
+	}
+	sorted = append([]string(nil), items...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return lessKey([]byte(sorted[i]), []byte(sorted[j]))
+	})
+	return items, sorted
+}
+
+func TestSorter(t *testing.T) {
+	items, want := sorterItems()
+	for _, memLimit := range []int{0, 1000, 20000} {
+		dir := t.TempDir()
+		s := NewSorter(lessKey, dir, memLimit)
+		for _, item := range items {
+			if err := s.Add([]byte(item)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if memLimit != 0 && s.Runs() == 0 {
+			t.Errorf("memLimit %d: no runs spilled", memLimit)
+		}
+		it, err := s.Sort()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := collect(t, it)
+		if len(got) != len(want) {
+			t.Fatalf("memLimit %d: got %d items, want %d", memLimit, len(got), len(want))
+		}
+		for i := range got {
+			if got[i] != want[i] {
+				t.Fatalf("memLimit %d: item %d = %q, want %q", memLimit, i, got[i], want[i])
+			}
+		}
+		if err := s.Add([]byte("x")); err != errSorted {
+			t.Errorf("Add after Sort: got %v, want %v", err, errSorted)
+		}
+		if err := s.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if files, _ := filepath.Glob(filepath.Join(dir, "*")); len(files) != 0 {
+			t.Errorf("memLimit %d: runs not removed: %q", memLimit, files)
+		}
+	}
+}
+
+func TestSorterFanIn(t *testing.T) {
+	items, want := sorterItems()
+	for _, fanIn := range []int{2, 3, 7, 1000} {
+		dir := t.TempDir()
+		s := NewSorter(lessKey, dir, 1000)
+		s.SetMaxFanIn(fanIn)
+		for _, item := range items {
+			if err := s.Add([]byte(item)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		spilled := s.Runs()
+		if fanIn < 1000 && spilled <= fanIn {
+			t.Fatalf("fan-in %d: only %d runs spilled", fanIn, spilled)
+		}
+		it, err := s.Sort()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s.Runs() > fanIn {
+			t.Errorf("fan-in %d: merging %d runs", fanIn, s.Runs())
+		}
+		files, _ := filepath.Glob(filepath.Join(dir, "*"))
+		if len(files) != s.Runs() {
+			t.Errorf("fan-in %d: %d files for %d runs", fanIn, len(files), s.Runs())
+		}
+		got := collect(t, it)
+		if fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("fan-in %d: items are not stably sorted", fanIn)
+		}
+		if err := s.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if files, _ := filepath.Glob(filepath.Join(dir, "*")); len(files) != 0 {
+			t.Errorf("fan-in %d: runs not removed: %q", fanIn, files)
+		}
+	}
+}
+
+func TestMergeUnique(t *testing.T) {
+	runs := [][]string{
+		{"a 0", "c 0", "e 0"},
+		{},
+		{"a 2", "b 2", "e 2", "f 2"},
+		{"c 3"},
+	}
+	var its []Iter
+	for _, run := range runs {
+		var buf bytes.Buffer
+		rw := NewRunWriter(&buf)
+		for _, item := range run {
+			if err := rw.Write([]byte(item)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := rw.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		its = append(its, NewRunReader(&buf))
+	}
+	equal := func(a, b []byte) bool { return bytes.Equal(key(a), key(b)) }
+	got := collect(t, Unique(Merge(lessKey, its...), equal))
+	want := []string{"a 0", "b 2", "c 0", "e 0", "f 2"}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestRunReaderTruncated(t *testing.T) {
+	var buf bytes.Buffer
+	rw := NewRunWriter(&buf)
+	rw.Write([]byte("shortcode"))
+	rw.Flush()
+	rr := NewRunReader(bytes.NewReader(buf.Bytes()[:buf.Len()-2]))
+	if rr.Next() {
+		t.Fatal("read truncated item")
+	}
+	if rr.Err() == nil {
+		t.Error("no error for truncated run")
+	}
+	it := Merge(lessKey, NewRunReader(bytes.NewReader(buf.Bytes()[:buf.Len()-2])))
+	if it.Next() || it.Err() == nil {
+		t.Error("merge: no error for truncated run")
+	}
+}
+
+func benchItems() [][]byte {
+	rng := rand.New(rand.NewSource(1))
+	items := make([][]byte, 1000000)
+	for i := range items {
+		items[i] = []byte(fmt.Sprintf("%08x https://example.com/%d", rng.Uint32(), i))
+	}
+	return items
+}
+
+func BenchmarkSortSlice(b *testing.B) {
+	items := benchItems()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		sorted := append([][]byte(nil), items...)
+		sort.SliceStable(sorted, func(i, j int) bool { return lessKey(sorted[i], sorted[j]) })
+	}
+}
+
+func BenchmarkSorter(b *testing.B) {
+	items := benchItems()
+	for _, memLimit := range []int{0, 4 << 20} {
+		b.Run(fmt.Sprintf("memLimit=%d", memLimit), func(b *testing.B) {
+			dir := b.TempDir()
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				s := NewSorter(lessKey, dir, memLimit)
+				for _, item := range items {
+					if err := s.Add(item); err != nil {
+						b.Fatal(err)
+					}
+				}
+				it, err := s.Sort()
+				if err != nil {
+					b.Fatal(err)
+				}
+				for it.Next() {
+				}
+				if err := it.Err(); err != nil {
+					b.Fatal(err)
+				}
+				s.Close()
+			}
+		})
+	}
+}
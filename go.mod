@@ -3,9 +3,22 @@ module github.com/andrewarchi/urlhero
 go 1.16
 
 require (
+	crawshaw.io/sqlite v0.3.3-0.20210127221821-98b1f83c5508
+	github.com/BurntSushi/toml v1.3.2
 	github.com/anacrolix/torrent v1.25.1
-	github.com/andrewarchi/archive v0.0.0-20210213193640-3a6449eed2ec
 	github.com/andrewarchi/browser v0.0.0-20210409211550-aeb39920c5c7
 	github.com/hekmon/transmissionrpc v1.1.0
-	golang.org/x/net v0.0.0-20210405180319-a5a99cb37ef4
+	github.com/prometheus/client_golang v1.12.2
+	github.com/syndtr/goleveldb v1.0.0
+	github.com/ulikunitz/xz v0.5.10
+	go.etcd.io/bbolt v1.3.5
+	go.opentelemetry.io/otel v1.7.0
+	go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc v1.7.0
+	go.opentelemetry.io/otel/sdk v1.7.0
+	go.opentelemetry.io/otel/trace v1.7.0
+	golang.org/x/crypto v0.0.0-20201221181555-eec23a3978ad
+	golang.org/x/net v0.0.0-20210525063256-abc453219eb5
+	golang.org/x/time v0.0.0-20201208040808-7e3f01d25324
+	google.golang.org/grpc v1.46.2
+	google.golang.org/protobuf v1.28.1
 )
@@ -0,0 +1,141 @@
+// Copyright (c) 2021 Andrew Archibald
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package ia
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/andrewarchi/urlhero/crawl"
+	"github.com/andrewarchi/urlhero/tracing"
+)
+
+// AccessKey and SecretKey are the Internet Archive S3-like API keys,
+// from https://archive.org/account/s3.php, that authenticate requests.
+// Some items, such as URLTeamTorrentRelease2013July, can only be
+// downloaded when signed in.
+var AccessKey, SecretKey string
+
+// Transport is the transport of every request to the Internet Archive.
+// It keeps connections alive between the many requests for metadata and
+// timemaps and times out stalled connections, but not slow downloads.
+// Its Proxy may be set before the first request.
+var Transport = &http.Transport{
+	Proxy: http.ProxyFromEnvironment,
+	DialContext: (&net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}).DialContext,
+	ForceAttemptHTTP2:     true,
+	MaxIdleConns:          64,
+	MaxIdleConnsPerHost:   MaxRequests,
+	IdleConnTimeout:       90 * time.Second,
+	TLSHandshakeTimeout:   10 * time.Second,
+	ResponseHeaderTimeout: 2 * time.Minute, // CDX queries of popular URLs are slow
+	ExpectContinueTimeout: time.Second,
+}
+
+// MaxRequests is the maximum number of concurrent requests to the
+// Internet Archive. A request counts until its body is closed.
+const MaxRequests = 8
+
+// Client is the HTTP client of every request to the Internet Archive,
+// which traces requests, applies the crawl configuration, including its
+// pacing of requests to each host, and limits them to MaxRequests at a
+// time. Get additionally authenticates requests.
+var Client = &http.Client{Transport: newLimitTransport(tracing.Transport(crawl.Transport(Transport)), MaxRequests)}
+
+// Get requests a URL of the Internet Archive, authenticated with the API
+// keys, if any. A *StatusError is returned for statuses other than 200
+// OK.
+func Get(url string) (*http.Response, error) {
+	return GetContext(context.Background(), url)
+}
+
+// GetContext is like Get, but the request, including the wait for the
+// pacing of crawl.Config.RequestDelay, is canceled with the context.
+func GetContext(ctx context.Context, url string) (*http.Response, error) {
+	return checkResponse(httpGet(ctx, url))
+}
+
+// Retryable reports whether an error is a transient network failure,
+// after which a request may be retried: a timeout, a refused or reset
+// connection, or a status error, of this or another package, whose
+// Temporary method reports true, as for 429 and 5xx statuses. Data
+// errors, such as malformed responses or failed checksums, are not
+// retryable. It is crawl.Retryable.
+func Retryable(err error) bool {
+	return crawl.Retryable(err)
+}
+
+func httpGet(ctx context.Context, url string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	return do(req)
+}
+
+func httpPostForm(ctx context.Context, url string, data url.Values) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, strings.NewReader(data.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return do(req)
+}
+
+func do(req *http.Request) (*http.Response, error) {
+	if AccessKey != "" || SecretKey != "" {
+		req.Header.Set("Authorization", "LOW "+AccessKey+":"+SecretKey)
+	}
+	return Client.Do(req)
+}
+
+// limitTransport limits the number of concurrent requests.
+type limitTransport struct {
+	rt  http.RoundTripper
+	sem chan struct{}
+}
+
+func newLimitTransport(rt http.RoundTripper, n int) *limitTransport {
+	return &limitTransport{rt, make(chan struct{}, n)}
+}
+
+func (t *limitTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	select {
+	case t.sem <- struct{}{}:
+	case <-req.Context().Done():
+		return nil, req.Context().Err()
+	}
+	resp, err := t.rt.RoundTrip(req)
+	if err != nil {
+		<-t.sem
+		return nil, err
+	}
+	resp.Body = &limitBody{ReadCloser: resp.Body, sem: t.sem}
+	return resp, nil
+}
+
+// limitBody releases its request from the limit when closed.
+type limitBody struct {
+	io.ReadCloser
+	sem  chan struct{}
+	once sync.Once
+}
+
+func (b *limitBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(func() { <-b.sem })
+	return err
+}
@@ -7,8 +7,8 @@
 package ia
 
 import (
+	"context"
 	"io"
-	"net/http"
 	"net/url"
 )
 
@@ -21,6 +21,10 @@ type SaveOptions struct {
 }
 
 func Save(pageURL string, options *SaveOptions) error {
+	return SaveContext(context.Background(), pageURL, options)
+}
+
+func SaveContext(ctx context.Context, pageURL string, options *SaveOptions) error {
 	// Save API, as observed on https://web.archive.org/save
 
 	v := make(url.Values)
@@ -33,7 +37,7 @@ func Save(pageURL string, options *SaveOptions) error {
 		setBool(v, "email_result", options.EmailResult)
 	}
 
-	resp, err := checkResponse(http.PostForm("https://web.archive.org/save", v))
+	resp, err := checkResponse(httpPostForm(ctx, "https://web.archive.org/save", v))
 	if err != nil {
 		return err
 	}
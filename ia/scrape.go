@@ -0,0 +1,142 @@
+// Copyright (c) 2021 Andrew Archibald
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package ia
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// ScrapeURL is the endpoint of the scraping API, which pages through the
+// results of a search with cursors.
+const ScrapeURL = "https://archive.org/services/search/v1/scrape"
+
+// ScrapePageSize is the number of items requested per page of scrape
+// results, which is the most the API allows.
+const ScrapePageSize = 10000
+
+// scrapeURL is the endpoint that is scraped, which tests replace.
+var scrapeURL = ScrapeURL
+
+// Scrape searches for items matching a query and calls fn with the JSON
+// object of the given fields of each, as the results are decoded, rather
+// than after every page is read. The object is only valid until fn
+// returns. Pages of ScrapePageSize items are followed by their cursors
+// until the last, so every match is visited, however many there are,
+// and it is an error for fewer items to be returned than the total that
+// the first page reports. Iteration stops early when fn returns an
+// error.
+func Scrape(query string, fields []string, fn func(item json.RawMessage) error) error {
+	return ScrapeContext(context.Background(), query, fields, fn)
+}
+
+// ScrapeContext is like Scrape, but stops when the context is done.
+func ScrapeContext(ctx context.Context, query string, fields []string, fn func(item json.RawMessage) error) error {
+	q := url.Values{"q": {query}, "count": {strconv.Itoa(ScrapePageSize)}}
+	if len(fields) != 0 {
+		q.Set("fields", strings.Join(fields, ","))
+	}
+	count, total := 0, -1
+	countFn := func(item json.RawMessage) error {
+		count++
+		return fn(item)
+	}
+	for prev := ""; ; {
+		resp, err := GetContext(ctx, scrapeURL+"?"+q.Encode())
+		if err != nil {
+			return err
+		}
+		cursor, n, err := decodeScrape(resp.Body, countFn)
+		resp.Body.Close()
+		if err != nil {
+			return err
+		}
+		if total < 0 {
+			total = n
+		}
+		if cursor == "" {
+			if count < total {
+				return fmt.Errorf("ia: scrape: got %d of %d items", count, total)
+			}
+			return nil
+		}
+		if cursor == prev {
+			return fmt.Errorf("ia: scrape: cursor %q repeated", cursor)
+		}
+		q.Set("cursor", cursor)
+		prev = cursor
+	}
+}
+
+// decodeScrape decodes a page of scrape results, calling fn with each
+// item, and returns the cursor of the next page, if any, and the total
+// number of matches, or 0 when not given.
+func decodeScrape(r io.Reader, fn func(item json.RawMessage) error) (cursor string, total int, err error) {
+	dec := json.NewDecoder(r)
+	if err := expectDelim(dec, '{'); err != nil {
+		return "", 0, err
+	}
+	var item json.RawMessage
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return "", 0, err
+		}
+		switch key, _ := tok.(string); key {
+		case "items":
+			if err := expectDelim(dec, '['); err != nil {
+				return "", 0, err
+			}
+			for dec.More() {
+				if err := dec.Decode(&item); err != nil {
+					return "", 0, err
+				}
+				if err := fn(item); err != nil {
+					return "", 0, err
+				}
+			}
+			if err := expectDelim(dec, ']'); err != nil {
+				return "", 0, err
+			}
+		case "cursor":
+			if err := dec.Decode(&cursor); err != nil {
+				return "", 0, err
+			}
+		case "total":
+			if err := dec.Decode(&total); err != nil {
+				return "", 0, err
+			}
+		case "error":
+			var msg string
+			if err := dec.Decode(&msg); err != nil {
+				return "", 0, err
+			}
+			return "", 0, fmt.Errorf("ia: scrape: %s", msg)
+		default:
+			if err := dec.Decode(&item); err != nil {
+				return "", 0, err
+			}
+		}
+	}
+	return cursor, total, expectDelim(dec, '}')
+}
+
+func expectDelim(dec *json.Decoder, delim json.Delim) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if tok != delim {
+		return fmt.Errorf("ia: scrape: got %v, want %v", tok, delim)
+	}
+	return nil
+}
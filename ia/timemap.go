@@ -7,6 +7,7 @@
 package ia
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"net/http"
@@ -15,6 +16,8 @@ import (
 	"strings"
 
 	"github.com/andrewarchi/browser/jsonutil"
+	"github.com/andrewarchi/urlhero/crawl"
+	"github.com/andrewarchi/urlhero/report"
 )
 
 // TimemapOptions contains options for a timemap API call.
@@ -23,13 +26,39 @@ type TimemapOptions struct {
 	Collapse    string   // field to collapse by; earliest captures with unique field is kept
 	Fields      []string // e.g. urlkey,timestamp,endtimestamp,original,mimetype,statuscode,digest,redirect,robotflags,length,offset,filename,groupcount,uniqcount
 	Limit       int      // e.g. 100000
+	From        string   // earliest timestamp, as a prefix of TimestampFormat, e.g. "2015"
+	To          string   // latest timestamp, as a prefix of TimestampFormat
 }
 
 // GetTimemap gets a list of Internet Archive captures of the given URL.
 func GetTimemap(pageURL string, options *TimemapOptions) ([][]string, error) {
+	return GetTimemapContext(context.Background(), pageURL, options)
+}
+
+// GetTimemapContext is like GetTimemap, but the request is canceled
+// with the context.
+func GetTimemapContext(ctx context.Context, pageURL string, options *TimemapOptions) ([][]string, error) {
 	// Timemap API, as observed on
 	// https://web.archive.org/web/*/https://dumps.wikimedia.org/other/shorturls/*
+	return getCaptures(ctx, "https://web.archive.org/web/timemap/", pageURL, options)
+}
+
+// GetCDX gets a list of Internet Archive captures of the given URL from
+// the CDX server. It accepts the same options as GetTimemap and is an
+// alternative when the timemap API is overloaded.
+func GetCDX(pageURL string, options *TimemapOptions) ([][]string, error) {
+	return GetCDXContext(context.Background(), pageURL, options)
+}
+
+// GetCDXContext is like GetCDX, but the request is canceled with the
+// context.
+func GetCDXContext(ctx context.Context, pageURL string, options *TimemapOptions) ([][]string, error) {
+	// CDX server API, as documented at
+	// https://github.com/internetarchive/wayback/tree/master/wayback-cdx-server
+	return getCaptures(ctx, "https://web.archive.org/cdx/search/cdx", pageURL, options)
+}
 
+func getCaptures(ctx context.Context, endpoint, pageURL string, options *TimemapOptions) ([][]string, error) {
 	q := make(url.Values)
 	q.Set("url", pageURL)
 	q.Set("output", "json") // other values: "csv" and omitted
@@ -47,9 +76,15 @@ func GetTimemap(pageURL string, options *TimemapOptions) ([][]string, error) {
 		if options.Limit > 0 {
 			q.Set("limit", strconv.Itoa(options.Limit))
 		}
+		if options.From != "" {
+			q.Set("from", options.From)
+		}
+		if options.To != "" {
+			q.Set("to", options.To)
+		}
 	}
 
-	resp, err := checkResponse(http.Get("https://web.archive.org/web/timemap/?" + q.Encode()))
+	resp, err := checkResponse(httpGet(ctx, endpoint+"?"+q.Encode()))
 	if err != nil {
 		return nil, err
 	}
@@ -105,7 +140,28 @@ func checkResponse(resp *http.Response, err error) (*http.Response, error) {
 	if err == nil && resp.StatusCode != http.StatusOK {
 		defer resp.Body.Close()
 		_, _ = io.Copy(io.Discard, resp.Body)
-		return nil, fmt.Errorf("ia: http status %s", resp.Status)
+		return nil, &StatusError{resp.Request.URL.String(), resp.StatusCode, resp.Status}
 	}
 	return resp, err
 }
+
+// StatusError is returned when an Internet Archive request responds
+// with a status other than 200 OK.
+type StatusError struct {
+	URL        string
+	StatusCode int    // e.g. 503
+	Status     string // e.g. "503 Service Unavailable"
+}
+
+func (err *StatusError) Error() string {
+	return fmt.Sprintf("ia: http status %s", err.Status)
+}
+
+// Temporary reports whether the request may succeed when retried, for
+// server errors and rate limiting.
+func (err *StatusError) Temporary() bool {
+	return crawl.TemporaryStatus(err.StatusCode)
+}
+
+// ErrorClass classifies the error in run reports.
+func (err *StatusError) ErrorClass() string { return report.ClassNetwork }
@@ -8,8 +8,21 @@ package ia
 
 import (
 	"bytes"
+	"context"
 	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"sync"
+	"syscall"
 	"testing"
+	"time"
 )
 
 func TestDecodeDigest(t *testing.T) {
@@ -39,3 +52,150 @@ func TestDecodeDigest(t *testing.T) {
 		}
 	}
 }
+
+func TestLimitTransport(t *testing.T) {
+	var mu sync.Mutex
+	active, maxActive := 0, 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		active++
+		if active > maxActive {
+			maxActive = active
+		}
+		mu.Unlock()
+		time.Sleep(10 * time.Millisecond)
+		w.Write([]byte("ok"))
+	}))
+	defer srv.Close()
+
+	client := &http.Client{Transport: newLimitTransport(srv.Client().Transport, 2)}
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp, err := client.Get(srv.URL)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			io.Copy(io.Discard, resp.Body)
+			// The request holds its slot until the body is closed
+			time.Sleep(10 * time.Millisecond)
+			mu.Lock()
+			active--
+			mu.Unlock()
+			resp.Body.Close()
+		}()
+	}
+	wg.Wait()
+	if maxActive > 2 {
+		t.Errorf("%d concurrent requests, want at most 2", maxActive)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	lt := newLimitTransport(srv.Client().Transport, 1)
+	lt.sem <- struct{}{}
+	cancel()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL, nil)
+	if _, err := lt.RoundTrip(req); err != context.Canceled {
+		t.Errorf("got error %v with canceled context, want %v", err, context.Canceled)
+	}
+}
+
+func TestDecodeScrape(t *testing.T) {
+	page := `{"items":[{"identifier":"urlteam_1"},{"identifier":"urlteam_2"}],"count":2,"cursor":"abc","total":3}`
+	var items []string
+	cursor, total, err := decodeScrape(strings.NewReader(page), func(item json.RawMessage) error {
+		items = append(items, string(item))
+		return nil
+	})
+	want := []string{`{"identifier":"urlteam_1"}`, `{"identifier":"urlteam_2"}`}
+	if err != nil || cursor != "abc" || total != 3 || !reflect.DeepEqual(items, want) {
+		t.Errorf("decodeScrape = %q, %q, %d, %v, want %q, %q, 3", items, cursor, total, err, want, "abc")
+	}
+
+	for _, page := range []string{
+		`{"error":"Invalid cursor"}`,
+		`{"items":[{"identifier":"urlteam_1"}`,
+		`[]`,
+	} {
+		if _, _, err := decodeScrape(strings.NewReader(page), func(json.RawMessage) error { return nil }); err == nil {
+			t.Errorf("decodeScrape(%q) succeeded", page)
+		}
+	}
+	errStop := errors.New("stop")
+	if _, _, err := decodeScrape(strings.NewReader(page), func(json.RawMessage) error { return errStop }); err != errStop {
+		t.Errorf("decodeScrape returned %v, want the error of fn", err)
+	}
+}
+
+func TestScrapePages(t *testing.T) {
+	pages := map[string]string{
+		"":   `{"items":[{"identifier":"urlteam_1"},{"identifier":"urlteam_2"}],"count":2,"cursor":"c1","total":5}`,
+		"c1": `{"items":[{"identifier":"urlteam_3"},{"identifier":"urlteam_4"}],"count":2,"cursor":"c2","total":5}`,
+		"c2": `{"items":[{"identifier":"urlteam_5"}],"count":1,"total":5}`,
+		// Truncated and looping results
+		"short": `{"items":[{"identifier":"urlteam_1"}],"count":1,"total":2}`,
+		"loop":  `{"items":[],"count":0,"cursor":"loop","total":0}`,
+	}
+	var cursors []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		if q.Get("count") != "10000" || q.Get("fields") != "identifier" {
+			t.Errorf("unexpected query %q", r.URL.RawQuery)
+		}
+		cursor := q.Get("cursor")
+		if q.Get("q") != "subject:terroroftinytown" {
+			cursor = q.Get("q")
+		}
+		cursors = append(cursors, cursor)
+		w.Write([]byte(pages[cursor]))
+	}))
+	defer srv.Close()
+	defer func(u string) { scrapeURL = u }(scrapeURL)
+	scrapeURL = srv.URL
+
+	var items []string
+	err := Scrape("subject:terroroftinytown", []string{"identifier"}, func(item json.RawMessage) error {
+		var v struct{ Identifier string }
+		if err := json.Unmarshal(item, &v); err != nil {
+			return err
+		}
+		items = append(items, v.Identifier)
+		return nil
+	})
+	want := []string{"urlteam_1", "urlteam_2", "urlteam_3", "urlteam_4", "urlteam_5"}
+	if err != nil || !reflect.DeepEqual(items, want) {
+		t.Errorf("Scrape = %q, %v, want %q", items, err, want)
+	}
+	if want := []string{"", "c1", "c2"}; !reflect.DeepEqual(cursors, want) {
+		t.Errorf("Scrape requested cursors %q, want %q", cursors, want)
+	}
+
+	for _, query := range []string{"short", "loop"} {
+		if err := Scrape(query, []string{"identifier"}, func(json.RawMessage) error { return nil }); err == nil {
+			t.Errorf("Scrape(%q) succeeded", query)
+		}
+	}
+}
+
+func TestRetryable(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{&StatusError{"", 503, "503 Service Unavailable"}, true},
+		{fmt.Errorf("get: %w", &StatusError{"", 429, "429 Too Many Requests"}), true},
+		{&StatusError{"", 404, "404 Not Found"}, false},
+		{&url.Error{Op: "Get", URL: "https://archive.org", Err: syscall.ECONNRESET}, true},
+		{context.DeadlineExceeded, true},
+		{&ChecksumError{}, false},
+		{io.ErrUnexpectedEOF, false},
+	}
+	for _, tt := range tests {
+		if got := Retryable(tt.err); got != tt.want {
+			t.Errorf("Retryable(%v) = %t, want %t", tt.err, got, tt.want)
+		}
+	}
+}
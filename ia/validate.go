@@ -10,6 +10,7 @@ package ia
 
 import (
 	"bytes"
+	"context"
 	"crypto/md5"
 	"crypto/sha1"
 	"encoding/xml"
@@ -22,16 +23,23 @@ import (
 
 	"github.com/andrewarchi/browser/jsonutil"
 	"github.com/andrewarchi/browser/jsonutil/timefmt"
+	"github.com/andrewarchi/urlhero/logger"
+	"github.com/andrewarchi/urlhero/report"
 )
 
 func Validate(dir string) error {
+	return ValidateContext(context.Background(), dir)
+}
+
+// ValidateContext is like Validate, but stops when the context is done.
+func ValidateContext(ctx context.Context, dir string) error {
 	metaName := filepath.Base(dir) + "_files.xml"
 	files, err := ReadFileMeta(dir)
 	if err != nil {
 		return err
 	}
 	for _, file := range files {
-		fmt.Println(file.Name)
+		logger.Debug("validating file", "dir", dir, "file", file.Name)
 		if file.Name == metaName {
 			continue // checksums of itself are inaccurate
 		}
@@ -39,7 +47,7 @@ func Validate(dir string) error {
 		if err != nil {
 			return err
 		}
-		_, err = io.Copy(io.Discard, fv)
+		_, err = io.Copy(io.Discard, contextReader{ctx, fv})
 		fv.Close()
 		if err != nil {
 			return err
@@ -78,8 +86,14 @@ func ReadFileMeta(dir string) ([]FileMeta, error) {
 		return nil, err
 	}
 	defer f.Close()
+	return DecodeFileMeta(f)
+}
+
+// DecodeFileMeta decodes the file metadata of a *_files.xml file, such
+// as from a response, without saving it.
+func DecodeFileMeta(r io.Reader) ([]FileMeta, error) {
 	var meta filesMeta
-	if err := xml.NewDecoder(f).Decode(&meta); err != nil {
+	if err := xml.NewDecoder(r).Decode(&meta); err != nil {
 		return nil, err
 	}
 	return meta.Files, nil
@@ -98,16 +112,35 @@ func (fm *FileMeta) Validator(r io.Reader) io.Reader {
 }
 
 func ValidateFile(filename string, md5Sum, sha1Sum, crc32Sum []byte) error {
+	return ValidateFileContext(context.Background(), filename, md5Sum, sha1Sum, crc32Sum)
+}
+
+// ValidateFileContext is like ValidateFile, but stops when the context
+// is done.
+func ValidateFileContext(ctx context.Context, filename string, md5Sum, sha1Sum, crc32Sum []byte) error {
 	f, err := os.Open(filename)
 	if err != nil {
 		return err
 	}
 	defer f.Close()
 	v := NewReadValidator(f, filename, md5Sum, sha1Sum, crc32Sum)
-	_, err = io.Copy(io.Discard, v)
+	_, err = io.Copy(io.Discard, contextReader{ctx, v})
 	return err
 }
 
+// contextReader stops reading when its context is done.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
+
 type readValidator struct {
 	r         io.Reader
 	name      string
@@ -165,10 +198,26 @@ func (rv *readValidator) validateSum(kind string, hash hash.Hash, sum []byte) er
 	if hash != nil {
 		s := hash.Sum(nil)
 		if !bytes.Equal(s, sum) {
-			return fmt.Errorf("ia: validate %s: %s sum is %x instead of %x", rv.name, kind, s, sum)
+			return &ChecksumError{rv.name, kind, s, sum}
 		}
 	}
 	return nil
 }
 
 func (rv *readValidateCloser) Close() error { return rv.rc.Close() }
+
+// ChecksumError is returned when the contents of a file do not match
+// its checksum.
+type ChecksumError struct {
+	Name     string
+	Kind     string // "MD5", "SHA-1", or "CRC-32"
+	Got      []byte
+	Expected []byte
+}
+
+func (err *ChecksumError) Error() string {
+	return fmt.Sprintf("ia: validate %s: %s sum is %x instead of %x", err.Name, err.Kind, err.Got, err.Expected)
+}
+
+// ErrorClass classifies the error in run reports.
+func (err *ChecksumError) ErrorClass() string { return report.ClassVerification }
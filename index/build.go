@@ -0,0 +1,865 @@
+// Copyright (c) 2021 Andrew Archibald
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package index
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/andrewarchi/urlhero/beacon"
+	"github.com/andrewarchi/urlhero/extsort"
+	"github.com/andrewarchi/urlhero/intern"
+	"github.com/andrewarchi/urlhero/logger"
+	"github.com/andrewarchi/urlhero/tinytown"
+)
+
+// Builder accumulates records by host and writes them to an index
+// directory.
+type Builder struct {
+	// MemLimit is the approximate number of bytes of records held in
+	// memory, after which they are spilled to sorted runs in TempDir, or
+	// the default temporary directory when empty. Zero never spills.
+	MemLimit int
+	TempDir  string
+	// Format is the format of the index files written, by default
+	// FormatPlain.
+	Format Format
+	// WALDir, when set, is where records are spilled instead of TempDir
+	// and each spilled batch is committed to a write-ahead log, so that
+	// a crashed build resumes from its last batch with Recover.
+	WALDir string
+
+	hosts   map[string]*hostRecords
+	size    int
+	strings *intern.Table // hosts and release IDs
+	targets *intern.Cache
+
+	existing *Index // being updated, if any
+
+	wal    *os.File
+	batch  int       // number of the last batch committed
+	pos    Position  // of the last link added by ProcessFunc
+	resume *Position // links are skipped until it, after recovering
+}
+
+type hostRecords struct {
+	meta    Meta
+	records []Record
+	// sources are the indexes in releases of the releases of records,
+	// or -1 for records added without one, or nil while there are none
+	sources  []int32
+	releases []string        // in the order that they were added
+	times    []int64         // Unix times of releases, or 0 when unknown
+	timed    bool            // whether any record has times
+	sorter   *extsort.Sorter // spilled runs, if any
+}
+
+// NewBuilder constructs an empty index builder.
+func NewBuilder() *Builder {
+	return &Builder{
+		hosts:   make(map[string]*hostRecords),
+		strings: intern.NewTable(),
+		targets: intern.NewCache(targetCacheSize),
+	}
+}
+
+// targetCacheSize is the number of recent targets that are interned,
+// which catches the hot repeated targets of spam and common sites.
+const targetCacheSize = 1 << 16
+
+// Add adds a record for a host. When a shortcode is added multiple
+// times, the first target is kept. An error is returned when spilling the
+// records fails.
+func (b *Builder) Add(host string, r Record) error {
+	return b.add(b.host(host), r, -1)
+}
+
+// AddFrom adds a record for a host from a release, which is recorded
+// in the provenance log of the host, along with the other releases that
+// have the same record.
+func (b *Builder) AddFrom(host, release string, r Record) error {
+	h := b.host(host)
+	return b.add(h, r, h.source(release))
+}
+
+func (b *Builder) add(h *hostRecords, r Record, src int32) error {
+	if src >= 0 && h.sources == nil {
+		h.sources = make([]int32, len(h.records), cap(h.records))
+		for i := range h.sources {
+			h.sources[i] = -1
+		}
+	}
+	h.records = append(h.records, r)
+	if !r.FirstSeen.IsZero() {
+		h.timed = true
+	}
+	if h.sources != nil {
+		h.sources = append(h.sources, src)
+	}
+	b.size += len(r.Shortcode) + len(r.Target)
+	if b.MemLimit > 0 && b.size >= b.MemLimit {
+		return b.spill()
+	}
+	return nil
+}
+
+// spill writes the records of every host in memory to sorted runs and
+// commits them as a batch to the write-ahead log, if any.
+func (b *Builder) spill() error {
+	dir := b.TempDir
+	if b.WALDir != "" {
+		dir = b.WALDir
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return err
+		}
+	}
+	runs := make(map[string]string)
+	for host, h := range b.hosts {
+		if len(h.records) == 0 {
+			continue
+		}
+		if h.sorter == nil {
+			h.sorter = extsort.NewSorter(lessRecord, dir, 0)
+		}
+		// Records are added in order, so the sorter keeps the first of
+		// duplicates, as in memory
+		var buf []byte
+		for i, r := range h.records {
+			buf = appendRecord(buf[:0], r, h.recordSource(i))
+			if err := h.sorter.Add(buf); err != nil {
+				return err
+			}
+		}
+		if err := h.sorter.Spill(); err != nil {
+			return err
+		}
+		h.records, h.sources = nil, nil
+		files := h.sorter.RunFiles()
+		runs[host] = filepath.Base(files[len(files)-1])
+	}
+	b.size = 0
+	if b.WALDir != "" {
+		return b.commit(runs)
+	}
+	return nil
+}
+
+// AddProject records that a terroroftinytown project contributed to the
+// records of a host.
+func (b *Builder) AddProject(host string, m *tinytown.Meta) {
+	h := b.host(host)
+	for _, p := range h.meta.Projects {
+		if p == m.Name {
+			return
+		}
+	}
+	h.meta.Projects = append(h.meta.Projects, m.Name)
+	if h.meta.Alphabet == "" {
+		h.meta.Alphabet = m.Alphabet
+	}
+}
+
+// AddRelease records that a release contributed to the records of a
+// host.
+func (b *Builder) AddRelease(host, id string) {
+	h := b.host(host)
+	for _, r := range h.meta.Releases {
+		if r == id {
+			return
+		}
+	}
+	h.meta.Releases = append(h.meta.Releases, id)
+}
+
+func (b *Builder) host(host string) *hostRecords {
+	h, ok := b.hosts[host]
+	if !ok {
+		h = &hostRecords{meta: Meta{Host: host}}
+		b.hosts[host] = h
+	}
+	return h
+}
+
+// source returns the index of a release in the releases of the host,
+// adding it if needed.
+func (h *hostRecords) source(release string) int32 {
+	for i, id := range h.releases {
+		if id == release {
+			return int32(i)
+		}
+	}
+	h.releases = append(h.releases, release)
+	h.times = append(h.times, releaseTime(release))
+	return int32(len(h.releases) - 1)
+}
+
+// tracked reports whether the host has records from releases or with
+// times, which are written to its provenance log.
+func (h *hostRecords) tracked() bool {
+	return len(h.releases) != 0 || h.timed
+}
+
+// Hosts returns the sorted hosts that have been added.
+func (b *Builder) Hosts() []string {
+	hosts := make([]string, 0, len(b.hosts))
+	for host := range b.hosts {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+	return hosts
+}
+
+// Meta returns the metadata for a host.
+func (b *Builder) Meta(host string) *Meta {
+	h := b.host(host)
+	sort.Strings(h.meta.Projects)
+	sort.Strings(h.meta.Releases)
+	return &h.meta
+}
+
+// recordSource returns the source of the record at index i.
+func (h *hostRecords) recordSource(i int) int32 {
+	if h.sources == nil {
+		return -1
+	}
+	return h.sources[i]
+}
+
+// sort stably sorts the records in memory with their sources.
+func (h *hostRecords) sort() {
+	if h.sources == nil {
+		sort.SliceStable(h.records, func(i, j int) bool {
+			return h.records[i].Shortcode < h.records[j].Shortcode
+		})
+		return
+	}
+	sort.Stable(recordsBySource{h.records, h.sources})
+}
+
+type recordsBySource struct {
+	records []Record
+	sources []int32
+}
+
+func (r recordsBySource) Len() int { return len(r.records) }
+func (r recordsBySource) Less(i, j int) bool {
+	return r.records[i].Shortcode < r.records[j].Shortcode
+}
+func (r recordsBySource) Swap(i, j int) {
+	r.records[i], r.records[j] = r.records[j], r.records[i]
+	r.sources[i], r.sources[j] = r.sources[j], r.sources[i]
+}
+
+// Records sorts and deduplicates the records in memory for a host and
+// returns them. Records that have been spilled are only visited by
+// Iter. The releases of the duplicates are not recorded in the
+// provenance log of the host.
+func (b *Builder) Records(host string) []Record {
+	h, ok := b.hosts[host]
+	if !ok {
+		return nil
+	}
+	h.sort()
+	records := h.records
+	n := 0
+	for i, r := range records {
+		if i != 0 && r.Shortcode == records[n-1].Shortcode {
+			continue
+		}
+		records[n] = r
+		if h.sources != nil {
+			h.sources[n] = h.sources[i]
+		}
+		n++
+	}
+	h.records = records[:n]
+	if h.sources != nil {
+		h.sources = h.sources[:n]
+	}
+	return h.records
+}
+
+// Iter sorts and deduplicates the records for a host, including those
+// that have been spilled, and returns an iterator over them.
+func (b *Builder) Iter(host string) (Iter, error) {
+	return b.iter(host)
+}
+
+// iter returns an iterator over the records for a host, which groups
+// the targets and releases of each shortcode for the provenance log.
+func (b *Builder) iter(host string) (*groupIter, error) {
+	h, ok := b.hosts[host]
+	if !ok {
+		return &groupIter{it: &sourceSliceIter{i: -1}}, nil
+	}
+	if h.sorter == nil {
+		h.sort()
+		return &groupIter{it: &sourceSliceIter{records: h.records, sources: h.sources, i: -1}, times: h.times}, nil
+	}
+	for i, r := range h.records {
+		if err := h.sorter.Add(appendRecord(nil, r, h.recordSource(i))); err != nil {
+			return nil, err
+		}
+	}
+	b.size -= recordsSize(h.records)
+	h.records, h.sources = nil, nil
+	it, err := h.sorter.Sort()
+	if err != nil {
+		return nil, err
+	}
+	return &groupIter{it: &spillIter{it: it}, times: h.times}, nil
+}
+
+// Write sorts and deduplicates the records and writes an index file per
+// host to dir. The write-ahead log, if any, is removed once every file
+// is written, and kept on failure.
+func (b *Builder) Write(dir string) error {
+	if err := b.write(dir); err != nil {
+		b.abort()
+		return err
+	}
+	return b.Close()
+}
+
+func (b *Builder) write(dir string) error {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	for _, host := range b.Hosts() {
+		if err := b.writeHost(Filename(dir, host), dir, host, false); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeHost writes the index file of a host to filename and, when its
+// records came from releases, a batch of their provenance to the log
+// in dir, which replaces the log, unless appending.
+func (b *Builder) writeHost(filename, dir, host string, appendLog bool) error {
+	g, err := b.iter(host)
+	if err != nil {
+		return err
+	}
+	var pw *provWriter
+	if h := b.hosts[host]; h != nil && h.tracked() {
+		if pw, err = appendProvenance(ProvenanceFilename(dir, host), !appendLog, h.releases); err != nil {
+			return err
+		}
+		g.onGroup = pw.add
+	}
+	var it Iter = g
+	format := b.Format
+	if format == 0 {
+		format = FormatPlain
+	}
+	if b.existing != nil {
+		if r := b.existing.Reader(host); r != nil {
+			l := &lastLookup{r: r}
+			it = &newRecordsIter{it: it, r: l}
+			if pw != nil {
+				g.onGroup = func(shortcode string, versions []provVersion) error {
+					return addRetargeted(pw, l, shortcode, versions)
+				}
+			}
+		}
+	}
+	w, err := CreateFormat(filename, b.Meta(host), format)
+	if err != nil {
+		if pw != nil {
+			pw.abort()
+		}
+		return err
+	}
+	for it.Next() {
+		if err := w.Write(it.Record()); err != nil {
+			w.Close()
+			if pw != nil {
+				pw.abort()
+			}
+			return err
+		}
+	}
+	if err := it.Err(); err != nil {
+		w.Close()
+		if pw != nil {
+			pw.abort()
+		}
+		return err
+	}
+	// The provenance is committed first, as a batch that is repeated,
+	// when the index file fails, is harmless, but one that is lost is
+	// not written again
+	if pw != nil {
+		if err := pw.Close(); err != nil {
+			w.Close()
+			return err
+		}
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	// Runs in the write-ahead log are kept until every host is written
+	if h := b.hosts[host]; h.sorter != nil && b.WALDir == "" {
+		err := h.sorter.Close()
+		h.sorter = nil
+		return err
+	}
+	return nil
+}
+
+// Close removes any spilled runs and the write-ahead log.
+func (b *Builder) Close() error {
+	var err error
+	for _, h := range b.hosts {
+		if h.sorter != nil {
+			if err1 := h.sorter.Close(); err1 != nil && err == nil {
+				err = err1
+			}
+			h.sorter = nil
+		}
+	}
+	if b.WALDir != "" {
+		if err1 := b.removeWAL(); err1 != nil && err == nil {
+			err = err1
+		}
+	}
+	return err
+}
+
+// abort releases the resources of a failed build, keeping the
+// write-ahead log, if any, to recover from.
+func (b *Builder) abort() {
+	if b.WALDir == "" {
+		b.Close()
+		return
+	}
+	for _, h := range b.hosts {
+		if h.sorter != nil {
+			h.sorter.Detach()
+			h.sorter = nil
+		}
+	}
+	if b.wal != nil {
+		b.wal.Close()
+		b.wal = nil
+	}
+}
+
+// appendRecord encodes a record as a spilled item: the length of the
+// shortcode as a uvarint, the shortcode, the source plus one and the
+// Unix times first and last seen, or 0, as uvarints, then the target.
+func appendRecord(buf []byte, r Record, src int32) []byte {
+	var n [binary.MaxVarintLen64]byte
+	buf = append(buf, n[:binary.PutUvarint(n[:], uint64(len(r.Shortcode)))]...)
+	buf = append(buf, r.Shortcode...)
+	buf = append(buf, n[:binary.PutUvarint(n[:], uint64(src+1))]...)
+	buf = append(buf, n[:binary.PutUvarint(n[:], uint64(unixTime(r.FirstSeen)))]...)
+	buf = append(buf, n[:binary.PutUvarint(n[:], uint64(unixTime(r.LastSeen)))]...)
+	return append(buf, r.Target...)
+}
+
+func recordShortcode(item []byte) []byte {
+	n, size := binary.Uvarint(item)
+	return item[size : size+int(n)]
+}
+
+func lessRecord(a, b []byte) bool {
+	return bytes.Compare(recordShortcode(a), recordShortcode(b)) < 0
+}
+
+func recordsSize(records []Record) int {
+	size := 0
+	for _, r := range records {
+		size += len(r.Shortcode) + len(r.Target)
+	}
+	return size
+}
+
+// sourceIter iterates over sorted records with duplicates and their
+// sources.
+type sourceIter interface {
+	Iter
+	Source() int32
+}
+
+// sourceSliceIter iterates over sorted records in memory.
+type sourceSliceIter struct {
+	records []Record
+	sources []int32 // or nil
+	i       int
+}
+
+func (it *sourceSliceIter) Next() bool {
+	it.i++
+	return it.i < len(it.records)
+}
+
+func (it *sourceSliceIter) Record() Record { return it.records[it.i] }
+func (it *sourceSliceIter) Err() error     { return nil }
+
+func (it *sourceSliceIter) Source() int32 {
+	if it.sources == nil {
+		return -1
+	}
+	return it.sources[it.i]
+}
+
+// spillIter iterates over spilled records.
+type spillIter struct {
+	it  extsort.Iter
+	r   Record
+	src int32
+}
+
+func (it *spillIter) Next() bool {
+	if !it.it.Next() {
+		return false
+	}
+	item := it.it.Item()
+	n, size := binary.Uvarint(item)
+	shortcode := item[size : size+int(n)]
+	item = item[size+int(n):]
+	src, size := binary.Uvarint(item)
+	item = item[size:]
+	first, size := binary.Uvarint(item)
+	item = item[size:]
+	last, size := binary.Uvarint(item)
+	it.r = Record{Shortcode: string(shortcode), Target: string(item[size:]),
+		FirstSeen: fromUnix(int64(first)), LastSeen: fromUnix(int64(last))}
+	it.src = int32(src) - 1
+	return true
+}
+
+// fromUnix returns the time of a Unix time, or the zero time for 0.
+func fromUnix(sec int64) time.Time {
+	if sec == 0 {
+		return time.Time{}
+	}
+	return time.Unix(sec, 0).UTC()
+}
+
+func (it *spillIter) Record() Record { return it.r }
+func (it *spillIter) Source() int32  { return it.src }
+func (it *spillIter) Err() error     { return it.it.Err() }
+
+// groupIter deduplicates sorted records, keeping the first of each
+// shortcode, and collects the targets, sources, and times of the
+// duplicates, which it passes to onGroup, if set. The times of the
+// records yielded span those of the duplicates with the same target.
+type groupIter struct {
+	it       sourceIter
+	times    []int64 // of the sources
+	onGroup  func(shortcode string, versions []provVersion) error
+	started  bool
+	ok       bool // whether it has a current record
+	rec      Record
+	versions []provVersion
+	err      error
+}
+
+func (g *groupIter) Next() bool {
+	if g.err != nil {
+		return false
+	}
+	if !g.started {
+		g.started = true
+		g.ok = g.it.Next()
+	}
+	if !g.ok {
+		return false
+	}
+	g.rec = g.it.Record()
+	g.versions = g.versions[:0]
+	for g.ok && g.it.Record().Shortcode == g.rec.Shortcode {
+		g.addVersion(g.it.Record(), g.it.Source())
+		g.ok = g.it.Next()
+	}
+	if v := &g.versions[0]; v.first != 0 {
+		g.rec.FirstSeen, g.rec.LastSeen = fromUnix(v.first), fromUnix(v.last)
+	}
+	if g.onGroup != nil {
+		if err := g.onGroup(g.rec.Shortcode, g.versions); err != nil {
+			g.err = err
+			return false
+		}
+	}
+	return true
+}
+
+// addVersion adds the source and times of a record of the current
+// shortcode to the version of its target.
+func (g *groupIter) addVersion(r Record, src int32) {
+	target := r.Target
+	var v *provVersion
+	for i := range g.versions {
+		if g.versions[i].target == target {
+			v = &g.versions[i]
+			break
+		}
+	}
+	if v == nil {
+		if len(g.versions) < cap(g.versions) {
+			g.versions = g.versions[:len(g.versions)+1]
+		} else {
+			g.versions = append(g.versions, provVersion{})
+		}
+		v = &g.versions[len(g.versions)-1]
+		v.target, v.srcs, v.first, v.last = target, v.srcs[:0], 0, 0
+	}
+	first, last := unixTime(r.FirstSeen), unixTime(r.LastSeen)
+	if first == 0 && src >= 0 {
+		first = g.times[src]
+		last = first
+	}
+	if last < first {
+		last = first
+	}
+	v.addTime(first, last)
+	if src < 0 {
+		return
+	}
+	for _, s := range v.srcs {
+		if s == src {
+			return
+		}
+	}
+	v.srcs = append(v.srcs, src)
+}
+
+func (g *groupIter) Record() Record { return g.rec }
+
+func (g *groupIter) Err() error {
+	if g.err != nil {
+		return g.err
+	}
+	return g.it.Err()
+}
+
+// DefaultMemLimit is the memory limit of records in Build.
+const DefaultMemLimit = 1 << 30
+
+// BuildOptions configures Build.
+type BuildOptions struct {
+	Format   Format // default FormatPlain
+	MemLimit int    // default DefaultMemLimit
+	// WALDir enables a write-ahead log, so that a build that crashes
+	// resumes from its last batch when run again with the same releases.
+	WALDir string
+}
+
+// Build indexes every terroroftinytown release in root and writes it to
+// dir. Options may be nil for the defaults.
+func Build(dir, root string, opts *BuildOptions) error {
+	return BuildContext(context.Background(), dir, root, opts)
+}
+
+// BuildContext is like Build, but stops reading releases when the
+// context is done. The records read so far are discarded or, with a
+// write-ahead log, kept in it to resume from.
+func BuildContext(ctx context.Context, dir, root string, opts *BuildOptions) error {
+	b, err := newBuildBuilder(dir, opts)
+	if err != nil {
+		return err
+	}
+	if err := tinytown.ProcessReleasesContext(ctx, root, b.ProcessFunc()); err != nil {
+		b.abort()
+		return err
+	}
+	if err := b.checkResumed(); err != nil {
+		return err
+	}
+	return b.Write(dir)
+}
+
+// Update indexes the given terroroftinytown releases in root, or every
+// release there that is not yet in the index, when nil, and adds them
+// to the index in dir as segments, creating it if needed. Records that
+// the index already has are not written again and releases that a host
+// already has are skipped, so an interrupted update can be retried. It
+// returns the IDs of the releases processed.
+func Update(dir, root string, releases []string, opts *BuildOptions) ([]string, error) {
+	return UpdateContext(context.Background(), dir, root, releases, opts)
+}
+
+// UpdateContext is like Update, but stops reading releases when the
+// context is done, leaving the index as it was. The progress of reading
+// them is reported to the progress function of the context, as set by
+// tinytown.WithProgress.
+func UpdateContext(ctx context.Context, dir, root string, releases []string, opts *BuildOptions) ([]string, error) {
+	idx, err := Open(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		idx = nil
+	} else if err != nil {
+		return nil, err
+	} else {
+		defer idx.Close()
+	}
+	if releases == nil {
+		if releases, err = unindexedReleases(idx, root); err != nil {
+			return nil, err
+		}
+	}
+	if len(releases) == 0 {
+		return nil, nil
+	}
+	b, err := newBuildBuilder(dir, opts)
+	if err != nil {
+		return nil, err
+	}
+	b.existing = idx
+	fn := b.ProcessFunc()
+	for _, id := range releases {
+		if err := tinytown.ProcessReleaseContext(ctx, filepath.Join(root, id), fn); err != nil {
+			b.abort()
+			return nil, err
+		}
+	}
+	if err := b.checkResumed(); err != nil {
+		return nil, err
+	}
+	return releases, b.WriteSegment(dir)
+}
+
+// UnindexedReleases returns the sorted IDs of the releases in root that
+// no host in the index in dir has, which Update indexes by default.
+func UnindexedReleases(dir, root string) ([]string, error) {
+	idx, err := Open(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return unindexedReleases(nil, root)
+	} else if err != nil {
+		return nil, err
+	}
+	defer idx.Close()
+	return unindexedReleases(idx, root)
+}
+
+// unindexedReleases returns the sorted IDs of the releases in root that
+// no host in the index has.
+func unindexedReleases(idx *Index, root string) ([]string, error) {
+	indexed := make(map[string]bool)
+	if idx != nil {
+		for _, host := range idx.Hosts() {
+			for _, id := range idx.Reader(host).Meta().Releases {
+				indexed[id] = true
+			}
+		}
+	}
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for _, e := range entries {
+		if e.IsDir() && !indexed[e.Name()] {
+			ids = append(ids, e.Name())
+		}
+	}
+	return ids, nil
+}
+
+// newBuildBuilder constructs a builder for Build or Update of the index
+// in dir and recovers its write-ahead log, if any.
+func newBuildBuilder(dir string, opts *BuildOptions) (*Builder, error) {
+	if opts == nil {
+		opts = &BuildOptions{}
+	}
+	b := NewBuilder()
+	b.Format = opts.Format
+	b.MemLimit = opts.MemLimit
+	if b.MemLimit == 0 {
+		b.MemLimit = DefaultMemLimit
+	}
+	// Spill beside the index, which has room for the records
+	b.TempDir = filepath.Dir(dir)
+	if opts.WALDir != "" {
+		b.WALDir = opts.WALDir
+		if pos, ok, err := b.Recover(); err != nil {
+			return nil, err
+		} else if ok {
+			logger.Info("resuming index build", "batch", b.batch, "position", pos)
+		}
+	}
+	return b, nil
+}
+
+// checkResumed reports an error when the position recovered from the
+// write-ahead log was never reached.
+func (b *Builder) checkResumed() error {
+	if b.resume != nil {
+		b.abort()
+		return fmt.Errorf("index: position %s of write-ahead log not found in releases", b.resume)
+	}
+	return nil
+}
+
+// ProcessFunc returns a function that adds every link visited in
+// terroroftinytown releases to the builder. After Recover, links up to
+// the recovered position are skipped, as are, in Update, the projects
+// of releases that the index already has for their host.
+func (b *Builder) ProcessFunc() tinytown.ProcessFunc {
+	type project struct {
+		h   *hostRecords
+		src int32
+	}
+	seen := make(map[*tinytown.Meta]project)
+	skip := make(map[*tinytown.Meta]bool)
+	return func(l *beacon.Link, m *tinytown.Meta, shortcodeLen int, releaseFilename, dumpFilename string) error {
+		p, ok := seen[m]
+		if !ok {
+			host := b.strings.String(TemplateHost(m.URLTemplate))
+			release := b.strings.String(filepath.Base(filepath.Dir(releaseFilename)))
+			if b.existing.hasRelease(host, release) {
+				skip[m] = true
+			} else {
+				b.AddProject(host, m)
+				b.AddRelease(host, release)
+				h := b.host(host)
+				p = project{h, h.source(release)}
+			}
+			seen[m] = p
+		}
+		if skip[m] {
+			return tinytown.SkipDump
+		}
+		if b.pos.Release != releaseFilename || b.pos.Dump != dumpFilename {
+			b.pos = Position{Release: releaseFilename, Dump: dumpFilename}
+		}
+		b.pos.Links++
+		if r := b.resume; r != nil {
+			if releaseFilename != r.Release || dumpFilename != r.Dump {
+				// Committed in a batch before the crash
+				return tinytown.SkipDump
+			}
+			if b.pos.Links == r.Links {
+				b.resume = nil
+			}
+			return nil
+		}
+		shortcode := l.Source
+		target, hit := b.targets.String(l.Target)
+		if hit {
+			// Copy the shortcode, so that the line read, which it and the
+			// target are substrings of, is not retained
+			shortcode = intern.Clone(shortcode)
+		}
+		return b.add(p.h, Record{Shortcode: shortcode, Target: target}, p.src)
+	}
+}
+
+// TemplateHost returns the host, without www, of a terroroftinytown URL
+// template, such as "http://bit.ly/{shortcode}".
+func TemplateHost(template string) string {
+	return tinytown.TemplateHost(template)
+}
@@ -0,0 +1,279 @@
+// Copyright (c) 2021 Andrew Archibald
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package index
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// In the columnar format, each block is a uvarint record count, the
+// shortcodes of its records, coded as in the compact format, then the host, path, and query
+// columns of its targets. A target is split, such that their
+// concatenation is the target, into its host, the scheme and authority,
+// like "https://example.com"; its path; and its query and fragment. Each
+// column is the uvarint length of the column compressed with DEFLATE,
+// then the compressed length-prefixed strings, or a length of 0 when
+// every string is empty. Scans of hosts, as for reverse-domain queries,
+// decompress only the host column.
+
+const numColumns = 3
+
+// splitTarget splits a target into its host, path, and query columns.
+func splitTarget(target string) (host, path, query string) {
+	rest := target
+	if i := strings.Index(target, "://"); i != -1 {
+		end := len(target)
+		if j := strings.IndexAny(target[i+3:], "/?#"); j != -1 {
+			end = i + 3 + j
+		}
+		host, rest = target[:end], target[end:]
+	}
+	if i := strings.IndexAny(rest, "?#"); i != -1 {
+		return host, rest[:i], rest[i:]
+	}
+	return host, rest, ""
+}
+
+// columnWriter encodes the blocks of a columnar index file.
+type columnWriter struct {
+	records []Record // of the pending block
+	columns [numColumns][]byte
+	zbuf    bytes.Buffer
+	zw      *flate.Writer
+}
+
+// appendBlock appends the pending block to b and resets it.
+func (cw *columnWriter) appendBlock(b []byte) ([]byte, error) {
+	b = appendUvarint(b, uint64(len(cw.records)))
+	last := ""
+	for i := range cw.columns {
+		cw.columns[i] = cw.columns[i][:0]
+	}
+	empty := [numColumns]bool{true, true, true}
+	for _, r := range cw.records {
+		b = appendKey(b, last, r.Shortcode)
+		last = r.Shortcode
+		host, path, query := splitTarget(r.Target)
+		for i, s := range [numColumns]string{host, path, query} {
+			cw.columns[i] = appendString(cw.columns[i], s)
+			empty[i] = empty[i] && s == ""
+		}
+	}
+	for i, col := range cw.columns {
+		if empty[i] {
+			b = appendUvarint(b, 0)
+			continue
+		}
+		cw.zbuf.Reset()
+		if cw.zw == nil {
+			zw, err := flate.NewWriter(&cw.zbuf, flate.DefaultCompression)
+			if err != nil {
+				return nil, err
+			}
+			cw.zw = zw
+		} else {
+			cw.zw.Reset(&cw.zbuf)
+		}
+		if _, err := cw.zw.Write(col); err != nil {
+			return nil, err
+		}
+		if err := cw.zw.Close(); err != nil {
+			return nil, err
+		}
+		b = appendString(b, cw.zbuf.String())
+	}
+	cw.records = cw.records[:0]
+	return b, nil
+}
+
+// columnReader decodes the blocks of a columnar index file.
+type columnReader struct {
+	records []Record
+	k       int  // index of the next record in records
+	hosts   bool // whether only the host column is decoded
+	// deltaKeys is whether shortcodes are delta coded
+	deltaKeys bool
+	codes     []string
+	z         []byte
+	columns   [numColumns]column
+}
+
+// column is a decompressed column of a block.
+type column struct {
+	buf     []byte
+	strings [][]byte // slices of buf
+}
+
+var errColumn = errors.New("column longer than block")
+
+// next returns the next record, reading the next block from br when the
+// current is exhausted.
+func (cr *columnReader) next(br byteReader) (Record, error) {
+	if cr.k < len(cr.records) {
+		cr.k++
+		return cr.records[cr.k-1], nil
+	}
+	if err := cr.readCodes(br); err != nil {
+		return Record{}, err
+	}
+	if err := cr.readColumns(br); err != nil {
+		return Record{}, err
+	}
+	cr.records = cr.records[:0]
+	var target []byte
+	for i, code := range cr.codes {
+		var t string
+		if cr.hosts {
+			host := cr.columns[0].strings[i]
+			// Hosts usually repeat, which need not be allocated again
+			if i != 0 && string(host) == cr.records[i-1].Target {
+				t = cr.records[i-1].Target
+			} else {
+				t = string(host)
+			}
+		} else {
+			target = target[:0]
+			for _, col := range cr.columns {
+				target = append(target, col.strings[i]...)
+			}
+			t = string(target)
+		}
+		cr.records = append(cr.records, Record{Shortcode: code, Target: t})
+	}
+	cr.k = 1
+	return cr.records[0], nil
+}
+
+// lookup reads the next block from br and returns the target of a
+// shortcode in it, decompressing the columns only when it is found.
+func (cr *columnReader) lookup(br byteReader, shortcode string) (string, bool, error) {
+	if err := cr.readCodes(br); err != nil {
+		return "", false, noEOF(err)
+	}
+	i := sort.SearchStrings(cr.codes, shortcode)
+	if i == len(cr.codes) || cr.codes[i] != shortcode {
+		return "", false, nil
+	}
+	if err := cr.readColumns(br); err != nil {
+		return "", false, err
+	}
+	var target []byte
+	for _, col := range cr.columns {
+		target = append(target, col.strings[i]...)
+	}
+	return string(target), true, nil
+}
+
+// readCodes reads the record count and shortcodes of a block.
+func (cr *columnReader) readCodes(br byteReader) error {
+	n, err := binary.ReadUvarint(br)
+	if err != nil {
+		return err
+	}
+	if n == 0 || n > BlockSize {
+		return errors.New("invalid block length")
+	}
+	cr.codes = cr.codes[:0]
+	last := ""
+	for i := uint64(0); i < n; i++ {
+		var code string
+		var err error
+		if cr.deltaKeys {
+			code, err = readKey(br, last)
+		} else {
+			code, err = readShared(br, last)
+		}
+		if err != nil {
+			return noEOF(err)
+		}
+		cr.codes = append(cr.codes, code)
+		last = code
+	}
+	return nil
+}
+
+// readColumns reads the columns of a block after its shortcodes.
+func (cr *columnReader) readColumns(br byteReader) error {
+	for i := range cr.columns {
+		size, err := binary.ReadUvarint(br)
+		if err != nil {
+			return noEOF(err)
+		}
+		if cr.hosts && i != 0 {
+			if _, err := io.CopyN(io.Discard, br, int64(size)); err != nil {
+				return noEOF(err)
+			}
+			continue
+		}
+		if err := cr.readColumn(&cr.columns[i], br, int(size)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readColumn reads a compressed column of the strings of the block.
+func (cr *columnReader) readColumn(col *column, br byteReader, size int) error {
+	n := len(cr.codes)
+	col.strings = col.strings[:0]
+	if size == 0 {
+		for i := 0; i < n; i++ {
+			col.strings = append(col.strings, nil)
+		}
+		return nil
+	}
+	if cap(cr.z) < size {
+		cr.z = make([]byte, size)
+	}
+	cr.z = cr.z[:size]
+	if _, err := io.ReadFull(br, cr.z); err != nil {
+		return noEOF(err)
+	}
+	zr := flateReaders.Get().(io.ReadCloser)
+	defer flateReaders.Put(zr)
+	if err := zr.(flate.Resetter).Reset(bytes.NewReader(cr.z), nil); err != nil {
+		return err
+	}
+	buf := bytes.NewBuffer(col.buf[:0])
+	_, err := buf.ReadFrom(zr)
+	col.buf = buf.Bytes()
+	if err != nil {
+		return err
+	}
+	b := col.buf
+	for i := 0; i < n; i++ {
+		s, rest, err := sliceString(b)
+		if err != nil {
+			return err
+		}
+		col.strings = append(col.strings, s)
+		b = rest
+	}
+	if len(b) != 0 {
+		return errColumn
+	}
+	return nil
+}
+
+// reset prepares the decoder for reuse with another iterator.
+func (cr *columnReader) reset() {
+	cr.records, cr.k, cr.hosts = cr.records[:0], 0, false
+}
+
+// columnReaders recycles the buffers of column decoders, which would
+// otherwise be allocated by every lookup.
+var columnReaders = sync.Pool{New: func() interface{} { return new(columnReader) }}
+
+// flateReaders recycles the decompressors of columns.
+var flateReaders = sync.Pool{New: func() interface{} { return flate.NewReader(nil) }}
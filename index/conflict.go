@@ -0,0 +1,245 @@
+// Copyright (c) 2021 Andrew Archibald
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package index
+
+import (
+	"sort"
+	"time"
+)
+
+// An index keeps one target per shortcode, but the releases that it
+// merges do not always agree. A shortcode that has been archived with
+// more than one target is a conflict, which is retargeting by its owner,
+// a takeover by spammers, or a bug in a parser. Each version is kept in
+// the provenance log, with the releases and times that it was seen, so
+// conflicts are found by merging the entries of its batches.
+
+// Version is a target that a shortcode has been archived with.
+type Version struct {
+	// Target is empty for a target that was replaced before the log
+	// spelled out replaced targets, of which only the hash is known.
+	Target   string
+	Releases []string // IDs, in the order that they were indexed
+	// FirstSeen and LastSeen are as in Origin.
+	FirstSeen, LastSeen time.Time
+}
+
+// Conflict is a shortcode that has been archived with more than one
+// target.
+type Conflict struct {
+	Shortcode string
+	// Versions are the current target, then the others in the order
+	// that they were first seen.
+	Versions []Version
+}
+
+// batchEntry is the entry of a shortcode in a batch of a log.
+type batchEntry struct {
+	b *provBatch
+	e *provEntry
+}
+
+// Versions returns the versions of a shortcode, the first of which is
+// current, when it is in the log.
+func (c *ProvenanceCursor) Versions(shortcode, current string) ([]Version, error) {
+	var entries []batchEntry
+	for i := range c.p.batches {
+		e, err := c.entry(i, shortcode)
+		if err != nil {
+			return nil, err
+		}
+		if e != nil {
+			entries = append(entries, batchEntry{&c.p.batches[i], e})
+		}
+	}
+	return versions(entries, current), nil
+}
+
+// versions merges the versions of the entries of a shortcode. Hashed
+// targets are resolved against the current target and those that are
+// spelled out in any batch.
+func versions(entries []batchEntry, current string) []Version {
+	type key struct {
+		target string
+		hash   uint32
+	}
+	known := map[uint32]string{targetHash(current): current}
+	for _, be := range entries {
+		for _, v := range be.e.versions {
+			if v.text {
+				if _, ok := known[targetHash(v.target)]; !ok {
+					known[targetHash(v.target)] = v.target
+				}
+			}
+		}
+	}
+	var vs []Version
+	var seen []provVersion
+	index := make(map[key]int)
+	for _, be := range entries {
+		for i := range be.e.versions {
+			v := &be.e.versions[i]
+			k := key{target: v.target}
+			if !v.text {
+				if target, ok := known[v.hash]; ok {
+					k.target = target
+				} else {
+					k.hash = v.hash
+				}
+			}
+			j, ok := index[k]
+			if !ok {
+				j = len(vs)
+				index[k] = j
+				vs = append(vs, Version{Target: k.target})
+				seen = append(seen, provVersion{})
+			}
+			for _, src := range v.srcs {
+				vs[j].Releases = appendMissing(vs[j].Releases, be.b.releases[src:src+1])
+				if !be.b.seen {
+					seen[j].addTime(be.b.times[src], be.b.times[src])
+				}
+			}
+			seen[j].addTime(v.first, v.last)
+		}
+	}
+	for i := range vs {
+		if seen[i].first != 0 {
+			vs[i].FirstSeen, vs[i].LastSeen = time.Unix(seen[i].first, 0).UTC(), time.Unix(seen[i].last, 0).UTC()
+		}
+	}
+	rest := vs
+	if j, ok := index[key{target: current}]; ok {
+		vs[0], vs[j] = vs[j], vs[0]
+		rest = vs[1:]
+	}
+	sort.SliceStable(rest, func(i, j int) bool {
+		ti, tj := rest[i].FirstSeen, rest[j].FirstSeen
+		return !ti.IsZero() && (tj.IsZero() || ti.Before(tj))
+	})
+	return vs
+}
+
+// retargeted reports whether the entries of a shortcode have more than
+// one target, by their hashes, which is cheaper than merging them.
+func retargeted(entries []batchEntry) bool {
+	var h uint32
+	first := true
+	for _, be := range entries {
+		for i := range be.e.versions {
+			v := &be.e.versions[i]
+			vh := v.hash
+			if v.text {
+				vh = targetHash(v.target)
+			}
+			if first {
+				h, first = vh, false
+			} else if vh != h {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// batchIter iterates the entries of a batch in shortcode order.
+type batchIter struct {
+	b     *provBatch
+	block provBlock
+	next  int // index of the next block
+	k     int // index of the current entry
+}
+
+// entry returns the current entry, decoding the next block when the
+// current is exhausted, or nil at the end of the batch.
+func (it *batchIter) entry(c *ProvenanceCursor) (*provEntry, error) {
+	for it.k >= len(it.block.entries) {
+		if it.next == len(it.b.blocks) {
+			return nil, nil
+		}
+		if err := c.decodeBlock(it.b, it.next, &it.block); err != nil {
+			return nil, err
+		}
+		it.next++
+		it.k = 0
+	}
+	return &it.block.entries[it.k], nil
+}
+
+// Conflicts calls fn with each shortcode in the log that has been
+// archived with more than one target, in shortcode order. The current
+// target of each is looked up with lookup. Iteration stops early when fn
+// returns an error.
+func (p *ProvenanceLog) Conflicts(lookup func(shortcode string) (string, bool, error), fn func(Conflict) error) error {
+	c := p.Cursor()
+	its := make([]batchIter, len(p.batches))
+	for i := range its {
+		its[i].b = &p.batches[i]
+	}
+	heads := make([]*provEntry, len(its))
+	var entries []batchEntry
+	for {
+		var min *provEntry
+		for i := range its {
+			e, err := its[i].entry(c)
+			if err != nil {
+				return err
+			}
+			heads[i] = e
+			if e != nil && (min == nil || e.shortcode < min.shortcode) {
+				min = e
+			}
+		}
+		if min == nil {
+			return nil
+		}
+		shortcode := min.shortcode
+		entries = entries[:0]
+		for i, e := range heads {
+			if e != nil && e.shortcode == shortcode {
+				entries = append(entries, batchEntry{its[i].b, e})
+				its[i].k++
+			}
+		}
+		if !retargeted(entries) {
+			continue
+		}
+		current, _, err := lookup(shortcode)
+		if err != nil {
+			return err
+		}
+		if vs := versions(entries, current); len(vs) > 1 {
+			if err := fn(Conflict{Shortcode: shortcode, Versions: vs}); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// Versions returns the versions of a shortcode, the first of which is
+// its current target, according to the provenance log of the host, or
+// nil, when there is none.
+func (r *Reader) Versions(shortcode string) ([]Version, error) {
+	if r.prov == nil {
+		return nil, nil
+	}
+	target, ok, err := r.Lookup(shortcode)
+	if !ok || err != nil {
+		return nil, err
+	}
+	return r.prov.Cursor().Versions(shortcode, target)
+}
+
+// Conflicts calls fn with each shortcode of the host that has been
+// archived with more than one target, according to its provenance log,
+// in shortcode order. Iteration stops early when fn returns an error.
+func (r *Reader) Conflicts(fn func(Conflict) error) error {
+	if r.prov == nil {
+		return nil
+	}
+	return r.prov.Conflicts(r.Lookup, fn)
+}
@@ -0,0 +1,104 @@
+// Copyright (c) 2021 Andrew Archibald
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package index
+
+// Iter iterates over records in increasing shortcode order.
+type Iter interface {
+	// Next advances to the next record and returns false when there are
+	// no more records or an error occurred.
+	Next() bool
+	// Record returns the current record.
+	Record() Record
+	// Err returns the error, if any, that stopped iteration.
+	Err() error
+}
+
+// SliceIter returns an iterator over records that are sorted by
+// shortcode.
+func SliceIter(records []Record) Iter {
+	return &sliceIter{records: records, i: -1}
+}
+
+type sliceIter struct {
+	records []Record
+	i       int
+}
+
+func (it *sliceIter) Next() bool {
+	if it.i+1 >= len(it.records) {
+		it.i = len(it.records)
+		return false
+	}
+	it.i++
+	return true
+}
+
+func (it *sliceIter) Record() Record { return it.records[it.i] }
+func (it *sliceIter) Err() error     { return nil }
+
+// ChangeKind is the kind of difference between two sets of records.
+type ChangeKind uint8
+
+const (
+	Added   ChangeKind = iota // shortcode only in the new records
+	Removed                   // shortcode only in the old records
+	Changed                   // shortcode in both, with different targets
+)
+
+func (k ChangeKind) String() string {
+	switch k {
+	case Added:
+		return "added"
+	case Removed:
+		return "removed"
+	case Changed:
+		return "changed"
+	}
+	return "unknown"
+}
+
+// Change is a difference for a shortcode between two sets of records.
+type Change struct {
+	Kind      ChangeKind
+	Shortcode string
+	Old, New  string // targets
+}
+
+// Diff compares old and new records by merging the two iterators and
+// calls fn for every difference. Targets are only compared when both
+// are non-empty, so that sources with only shortcodes, such as Internet
+// Archive captures, can be compared with indexes.
+func Diff(old, new Iter, fn func(Change) error) error {
+	oldOK, newOK := old.Next(), new.Next()
+	for oldOK || newOK {
+		var c Change
+		switch {
+		case !newOK || (oldOK && old.Record().Shortcode < new.Record().Shortcode):
+			r := old.Record()
+			c = Change{Removed, r.Shortcode, r.Target, ""}
+			oldOK = old.Next()
+		case !oldOK || new.Record().Shortcode < old.Record().Shortcode:
+			r := new.Record()
+			c = Change{Added, r.Shortcode, "", r.Target}
+			newOK = new.Next()
+		default:
+			o, n := old.Record(), new.Record()
+			oldOK, newOK = old.Next(), new.Next()
+			if o.Target == n.Target || o.Target == "" || n.Target == "" {
+				continue
+			}
+			c = Change{Changed, o.Shortcode, o.Target, n.Target}
+		}
+		if err := fn(c); err != nil {
+			return err
+		}
+	}
+	if err := old.Err(); err != nil {
+		return err
+	}
+	return new.Err()
+}
@@ -0,0 +1,264 @@
+// Copyright (c) 2021 Andrew Archibald
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package index
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/net/idna"
+)
+
+// TargetEncoding is how targets are encoded on export. Indexes keep
+// targets as they were archived, which may have spaces, raw non-ASCII
+// bytes, or invalid escapes, and downstream systems expect different
+// forms: SQL and Parquet consumers usually want the archived bytes, WARC
+// replay wants valid URIs, and people want readable IRIs.
+type TargetEncoding uint8
+
+const (
+	// EncodingRaw leaves targets as they were archived.
+	EncodingRaw TargetEncoding = iota
+	// EncodingURI normalizes targets to ASCII URIs, as in RFC 3986: the
+	// scheme and host are lowercased and hosts are converted to
+	// punycode; bytes that are not allowed in URIs, like spaces,
+	// controls, and non-ASCII bytes, and percent signs that do not
+	// start escapes are percent-encoded; escapes of unreserved
+	// characters are decoded; and the hex digits of escapes are
+	// uppercased.
+	EncodingURI
+	// EncodingIRI normalizes targets as EncodingURI does, then decodes
+	// the escapes of non-ASCII UTF-8 sequences and punycode hosts to
+	// Unicode, as in RFC 3987. Bidirectional formatting characters and
+	// invalid UTF-8 stay escaped.
+	EncodingIRI
+)
+
+var targetEncodings = []string{
+	EncodingRaw: "raw",
+	EncodingURI: "uri",
+	EncodingIRI: "iri",
+}
+
+// ParseTargetEncoding parses the name of a target encoding: raw, uri,
+// or iri.
+func ParseTargetEncoding(name string) (TargetEncoding, error) {
+	for e, n := range targetEncodings {
+		if n == name {
+			return TargetEncoding(e), nil
+		}
+	}
+	return 0, fmt.Errorf("index: unknown target encoding %q", name)
+}
+
+func (e TargetEncoding) String() string {
+	if int(e) < len(targetEncodings) {
+		return targetEncodings[e]
+	}
+	return fmt.Sprintf("TargetEncoding(%d)", uint8(e))
+}
+
+// Encode encodes a target.
+func (e TargetEncoding) Encode(target string) string {
+	switch e {
+	case EncodingURI:
+		return normalizeURI(target)
+	case EncodingIRI:
+		return uriToIRI(normalizeURI(target))
+	default:
+		return target
+	}
+}
+
+// splitAuthority returns the offsets of the host in the authority of a
+// target, when it has one, or -1.
+func splitAuthority(target string) (scheme, hostStart, hostEnd int) {
+	i := strings.Index(target, "://")
+	if i <= 0 {
+		return -1, -1, -1
+	}
+	for j := 0; j < i; j++ {
+		if c := target[j]; !isAlpha(c) && (j == 0 || !isDigit(c) && c != '+' && c != '-' && c != '.') {
+			return -1, -1, -1
+		}
+	}
+	start := i + 3
+	end := len(target)
+	if k := strings.IndexAny(target[start:], "/?#"); k != -1 {
+		end = start + k
+	}
+	if k := strings.LastIndexByte(target[start:end], '@'); k != -1 {
+		start += k + 1
+	}
+	if strings.HasPrefix(target[start:end], "[") {
+		if k := strings.IndexByte(target[start:end], ']'); k != -1 {
+			return i, start, start + k + 1
+		}
+	}
+	if k := strings.LastIndexByte(target[start:end], ':'); k != -1 {
+		end = start + k
+	}
+	return i, start, end
+}
+
+func normalizeURI(target string) string {
+	scheme, hostStart, hostEnd := splitAuthority(target)
+	var b strings.Builder
+	b.Grow(len(target))
+	i := 0
+	if scheme != -1 {
+		// Userinfo is case-sensitive, unlike the scheme and host
+		b.WriteString(strings.ToLower(target[:scheme]))
+		escapeURI(&b, target[scheme:hostStart])
+		host := strings.ToLower(target[hostStart:hostEnd])
+		if strings.HasPrefix(host, "[") {
+			b.WriteString(host)
+		} else {
+			if ascii, err := idna.Lookup.ToASCII(percentDecode(host)); err == nil && ascii != "" {
+				host = ascii
+			}
+			escapeURI(&b, host)
+		}
+		i = hostEnd
+	}
+	escapeURI(&b, target[i:])
+	return b.String()
+}
+
+// escapeURI writes s, percent-encoding the bytes not allowed in URIs.
+func escapeURI(b *strings.Builder, s string) {
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c == '%' {
+			if i+2 < len(s) && isHex(s[i+1]) && isHex(s[i+2]) {
+				d := unhex(s[i+1])<<4 | unhex(s[i+2])
+				if isUnreserved(d) {
+					b.WriteByte(d)
+				} else {
+					b.WriteByte('%')
+					b.WriteByte(upperHex[unhex(s[i+1])])
+					b.WriteByte(upperHex[unhex(s[i+2])])
+				}
+				i += 2
+				continue
+			}
+			b.WriteString("%25")
+			continue
+		}
+		if isURIByte(c) {
+			b.WriteByte(c)
+			continue
+		}
+		b.WriteByte('%')
+		b.WriteByte(upperHex[c>>4])
+		b.WriteByte(upperHex[c&15])
+	}
+}
+
+// uriToIRI decodes the escapes of non-ASCII UTF-8 sequences and the
+// punycode labels of the host of a normalized URI.
+func uriToIRI(uri string) string {
+	var b strings.Builder
+	b.Grow(len(uri))
+	i := 0
+	if scheme, hostStart, hostEnd := splitAuthority(uri); scheme != -1 {
+		host := uri[hostStart:hostEnd]
+		if strings.Contains(host, "xn--") {
+			if u, err := idna.Display.ToUnicode(host); err == nil {
+				host = u
+			}
+		}
+		b.WriteString(uri[:hostStart])
+		b.WriteString(host)
+		i = hostEnd
+	}
+	var buf [utf8.UTFMax]byte
+	for i < len(uri) {
+		c := uri[i]
+		if c != '%' || i+2 >= len(uri) || unhex(uri[i+1]) < 8 {
+			b.WriteByte(c)
+			i++
+			continue
+		}
+		// Decode a run of escapes that is a UTF-8 sequence
+		n := 0
+		j := i
+		for n < utf8.UTFMax && j+2 < len(uri) && uri[j] == '%' {
+			buf[n] = unhex(uri[j+1])<<4 | unhex(uri[j+2])
+			n++
+			j += 3
+			if utf8.FullRune(buf[:n]) {
+				break
+			}
+		}
+		r, size := utf8.DecodeRune(buf[:n])
+		if r == utf8.RuneError || size != n || isBidiFormat(r) {
+			b.WriteString(uri[i : i+3])
+			i += 3
+			continue
+		}
+		b.WriteRune(r)
+		i = j
+	}
+	return b.String()
+}
+
+// isBidiFormat reports whether r is a bidirectional formatting
+// character, which RFC 3987 prohibits in IRIs.
+func isBidiFormat(r rune) bool {
+	return r == '\u200e' || r == '\u200f' || '\u202a' <= r && r <= '\u202e' || '\u2066' <= r && r <= '\u2069'
+}
+
+const upperHex = "0123456789ABCDEF"
+
+func isAlpha(c byte) bool { return 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' }
+func isDigit(c byte) bool { return '0' <= c && c <= '9' }
+func isHex(c byte) bool   { return isDigit(c) || 'a' <= c && c <= 'f' || 'A' <= c && c <= 'F' }
+
+func unhex(c byte) byte {
+	switch {
+	case isDigit(c):
+		return c - '0'
+	case 'a' <= c && c <= 'f':
+		return c - 'a' + 10
+	case 'A' <= c && c <= 'F':
+		return c - 'A' + 10
+	}
+	return 0
+}
+
+func isUnreserved(c byte) bool {
+	return isAlpha(c) || isDigit(c) || c == '-' || c == '.' || c == '_' || c == '~'
+}
+
+// isURIByte reports whether c is an unreserved or reserved character of
+// RFC 3986, other than the brackets of IPv6 hosts.
+func isURIByte(c byte) bool {
+	return isUnreserved(c) || strings.IndexByte(":/?#@!$&'()*+,;=", c) != -1
+}
+
+// percentDecode decodes the escapes of a host, when every escape is
+// valid, so that escaped IDNs are converted to punycode.
+func percentDecode(s string) string {
+	if !strings.Contains(s, "%") {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '%' {
+			if i+2 >= len(s) || !isHex(s[i+1]) || !isHex(s[i+2]) {
+				return s
+			}
+			b.WriteByte(unhex(s[i+1])<<4 | unhex(s[i+2]))
+			i += 2
+			continue
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
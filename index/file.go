@@ -0,0 +1,1078 @@
+// Copyright (c) 2021 Andrew Archibald
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package index
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Index files are laid out as:
+//
+//   magic    "URLTIDX" followed by a format version byte: the Format,
+//            with the deltaKeys bit set when shortcodes are delta
+//            coded. Compact files without it are outdated, but still
+//            read, and are upgraded by Migrate. Files of other versions
+//            are rejected with a *VersionError.
+//   meta     uvarint length, followed by JSON-encoded Meta
+//   records  uvarint length-prefixed shortcode and target for each
+//            record, in increasing shortcode byte order
+//   blocks   uvarint block count, followed by the first shortcode and
+//            the offset relative to the records section of every
+//            BlockSize-th record
+//   trailer  big-endian uint64 offset of blocks and uint64 record count
+//
+// In the compact format, records are front coded: the shortcode and
+// target of each record are a uvarint length of the prefix shared with
+// those of the previous record, then the length-prefixed remainder. The
+// first record of each block is shared with nothing, so that blocks are
+// decoded independently. As shortcodes are sorted, this stores each
+// like a path in a trie over the shortcodes of its block. Shortcodes
+// that are nearly sequential, as most shorteners assign, are instead
+// delta coded, as described in keys.go; the block directory keeps the
+// first shortcode of each block whole, so lookups still binary search
+// it. The columnar format stores the targets of each block by column,
+// as described in columnar.go.
+//
+// Lookups binary search the block directory, then scan a single block.
+
+const (
+	magic = "URLTIDX"
+
+	// BlockSize is the number of records between block directory
+	// entries.
+	BlockSize = 64
+
+	trailerSize = 16
+)
+
+// Format is the format of the records in an index file, which is
+// selected when it is created.
+type Format uint8
+
+const (
+	// FormatPlain stores records as is, for the fastest builds and
+	// scans.
+	FormatPlain Format = 1
+	// FormatCompact front codes records, which are typically less than
+	// half the size, at the cost of slower builds and scans.
+	FormatCompact Format = 2
+	// FormatColumnar compresses the hosts, paths, and queries of targets
+	// as separate columns, so that scans of target hosts read only their
+	// column, at the cost of slower lookups.
+	FormatColumnar Format = 3
+)
+
+// ParseFormat parses the name of a format, "plain", "compact", or
+// "columnar".
+func ParseFormat(name string) (Format, error) {
+	switch name {
+	case "plain":
+		return FormatPlain, nil
+	case "compact":
+		return FormatCompact, nil
+	case "columnar":
+		return FormatColumnar, nil
+	}
+	return 0, fmt.Errorf("index: unknown format %q", name)
+}
+
+func (f Format) String() string {
+	switch f {
+	case FormatPlain:
+		return "plain"
+	case FormatCompact:
+		return "compact"
+	case FormatColumnar:
+		return "columnar"
+	}
+	return fmt.Sprintf("Format(%d)", uint8(f))
+}
+
+// Meta describes the shortener of an index file.
+type Meta struct {
+	Host     string   `json:"host"`
+	Projects []string `json:"projects,omitempty"` // terroroftinytown projects, e.g. "bitly_6"
+	Alphabet string   `json:"alphabet,omitempty"`
+	Releases []string `json:"releases,omitempty"` // release identifiers, e.g. "urlteam_2021-05-06-01-17-03"
+}
+
+// Record is a shortcode and the target it redirects to.
+type Record struct {
+	Shortcode string
+	Target    string
+	// FirstSeen and LastSeen are the earliest and latest times that the
+	// mapping was archived, when known. They are kept in the provenance
+	// log of the host, rather than the index file, so they are only set
+	// by LookupRecord, and, when added to a Builder, override the times
+	// of the releases of records.
+	FirstSeen, LastSeen time.Time
+}
+
+type block struct {
+	first  string
+	offset int64
+}
+
+// Writer writes an index file. Records must be written in increasing
+// shortcode order.
+type Writer struct {
+	f          *os.File
+	w          *bufio.Writer
+	format     Format
+	start      int64 // offset of records section
+	off        int64 // offset relative to start
+	n          int64
+	last       string
+	lastTarget string
+	blocks     []block
+	buf        []byte
+	cols       *columnWriter // in the columnar format
+}
+
+// Create creates an index file in the plain format with the given
+// metadata.
+func Create(filename string, meta *Meta) (*Writer, error) {
+	return CreateFormat(filename, meta, FormatPlain)
+}
+
+// CreateFormat creates an index file in the given format.
+func CreateFormat(filename string, meta *Meta, format Format) (*Writer, error) {
+	switch format {
+	case FormatPlain, FormatCompact, FormatColumnar:
+	default:
+		return nil, fmt.Errorf("index: unknown format %d", format)
+	}
+	f, err := os.Create(filename)
+	if err != nil {
+		return nil, err
+	}
+	w := &Writer{f: f, w: bufio.NewWriter(f), format: format}
+	if format == FormatColumnar {
+		w.cols = &columnWriter{}
+	}
+	if err := w.writeHeader(meta); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *Writer) writeHeader(meta *Meta) error {
+	m, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	w.buf = append(w.buf[:0], magic...)
+	version := byte(w.format)
+	if w.format != FormatPlain {
+		version |= deltaKeys
+	}
+	w.buf = append(w.buf, version)
+	w.buf = appendUvarint(w.buf, uint64(len(m)))
+	w.buf = append(w.buf, m...)
+	if _, err := w.w.Write(w.buf); err != nil {
+		return err
+	}
+	w.start = int64(len(w.buf))
+	return nil
+}
+
+// Write appends a record to the index.
+func (w *Writer) Write(r Record) error {
+	if w.n != 0 && r.Shortcode <= w.last {
+		return fmt.Errorf("index: shortcode %q written after %q", r.Shortcode, w.last)
+	}
+	if w.n%BlockSize == 0 {
+		if err := w.flushBlock(); err != nil {
+			return err
+		}
+		w.blocks = append(w.blocks, block{r.Shortcode, w.off})
+		w.last, w.lastTarget = "", ""
+	}
+	if w.cols != nil {
+		w.cols.records = append(w.cols.records, r)
+		w.n++
+		w.last = r.Shortcode
+		return nil
+	}
+	if w.format == FormatCompact {
+		w.buf = appendKey(w.buf[:0], w.last, r.Shortcode)
+		w.buf = appendShared(w.buf, w.lastTarget, r.Target)
+	} else {
+		w.buf = appendString(w.buf[:0], r.Shortcode)
+		w.buf = appendString(w.buf, r.Target)
+	}
+	if _, err := w.w.Write(w.buf); err != nil {
+		return err
+	}
+	w.off += int64(len(w.buf))
+	w.n++
+	w.last, w.lastTarget = r.Shortcode, r.Target
+	return nil
+}
+
+// flushBlock writes the pending block of the columnar format, if any.
+func (w *Writer) flushBlock() error {
+	if w.cols == nil || len(w.cols.records) == 0 {
+		return nil
+	}
+	var err error
+	if w.buf, err = w.cols.appendBlock(w.buf[:0]); err != nil {
+		return err
+	}
+	if _, err := w.w.Write(w.buf); err != nil {
+		return err
+	}
+	w.off += int64(len(w.buf))
+	return nil
+}
+
+// Close writes the block directory and closes the file.
+func (w *Writer) Close() error {
+	err := w.flushBlock()
+	if err == nil {
+		err = w.writeFooter()
+	}
+	if err1 := w.f.Close(); err == nil {
+		err = err1
+	}
+	return err
+}
+
+func (w *Writer) writeFooter() error {
+	w.buf = appendUvarint(w.buf[:0], uint64(len(w.blocks)))
+	for _, b := range w.blocks {
+		w.buf = appendString(w.buf, b.first)
+		w.buf = appendUvarint(w.buf, uint64(b.offset))
+	}
+	w.buf = appendUint64(w.buf, uint64(w.start+w.off))
+	w.buf = appendUint64(w.buf, uint64(w.n))
+	if _, err := w.w.Write(w.buf); err != nil {
+		return err
+	}
+	return w.w.Flush()
+}
+
+func appendString(b []byte, s string) []byte {
+	b = appendUvarint(b, uint64(len(s)))
+	return append(b, s...)
+}
+
+// appendShared appends s front coded against prev.
+func appendShared(b []byte, prev, s string) []byte {
+	n := 0
+	for n < len(prev) && n < len(s) && prev[n] == s[n] {
+		n++
+	}
+	b = appendUvarint(b, uint64(n))
+	return appendString(b, s[n:])
+}
+
+// Reader reads an index file.
+type Reader struct {
+	f      *os.File
+	data   []byte // contents of the file, when mapped
+	format Format
+	// deltaKeys is whether shortcodes are delta coded, as in files
+	// written since it was introduced
+	deltaKeys bool
+	// segments supersede the records of the file, newest first
+	segments []*Reader
+	meta     Meta
+	prov     *ProvenanceLog // of the host, if any
+	start    int64          // offset of records section
+	end      int64          // offset of blocks section
+	n        int64
+	blocks   []block
+}
+
+// ErrFormat is returned when a file is not a valid index file.
+var ErrFormat = errors.New("index: invalid format")
+
+// OpenReader opens an index file.
+func OpenReader(filename string) (*Reader, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	r := &Reader{f: f}
+	if err := r.readHeader(); err != nil {
+		f.Close()
+		var verr *VersionError
+		if errors.As(err, &verr) {
+			verr.Filename = filename
+			return nil, verr
+		}
+		return nil, fmt.Errorf("%w: %s: %v", ErrFormat, filename, err)
+	}
+	if err := r.readFooter(); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%w: %s: %v", ErrFormat, filename, err)
+	}
+	return r, nil
+}
+
+// OpenReaderMmap opens an index file and maps it read-only into memory,
+// so that lookups read from the page cache without system calls or
+// copying.
+func OpenReaderMmap(filename string) (*Reader, error) {
+	r, err := OpenReader(filename)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := r.f.Stat()
+	if err != nil {
+		r.Close()
+		return nil, err
+	}
+	if r.data, err = mmap(r.f, fi.Size()); err != nil {
+		r.Close()
+		return nil, fmt.Errorf("index: mapping %s: %w", filename, err)
+	}
+	return r, nil
+}
+
+// Mapped reports whether the index file and its segments are mapped
+// into memory.
+func (r *Reader) Mapped() bool {
+	for _, seg := range r.segments {
+		if seg.data == nil {
+			return false
+		}
+	}
+	return r.data != nil
+}
+
+func (r *Reader) readHeader() error {
+	br := bufio.NewReader(r.f)
+	var h [len(magic) + 1]byte
+	if _, err := io.ReadFull(br, h[:]); err != nil {
+		return err
+	}
+	if string(h[:len(magic)]) != magic {
+		return errors.New("bad magic")
+	}
+	version := h[len(magic)]
+	r.format, r.deltaKeys = Format(version&^deltaKeys), version&deltaKeys != 0
+	switch r.format {
+	case FormatPlain:
+		if r.deltaKeys {
+			return &VersionError{Version: version}
+		}
+	case FormatCompact, FormatColumnar:
+	default:
+		return &VersionError{Version: version}
+	}
+	m, err := readString(br)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal([]byte(m), &r.meta); err != nil {
+		return err
+	}
+	r.start = int64(len(h)) + int64(uvarintLen(uint64(len(m)))) + int64(len(m))
+	return nil
+}
+
+func (r *Reader) readFooter() error {
+	fi, err := r.f.Stat()
+	if err != nil {
+		return err
+	}
+	if fi.Size() < r.start+trailerSize {
+		return io.ErrUnexpectedEOF
+	}
+	var t [trailerSize]byte
+	if _, err := r.f.ReadAt(t[:], fi.Size()-trailerSize); err != nil {
+		return err
+	}
+	r.end = int64(binary.BigEndian.Uint64(t[:8]))
+	r.n = int64(binary.BigEndian.Uint64(t[8:]))
+	if r.end < r.start || r.end > fi.Size()-trailerSize {
+		return errors.New("blocks offset out of range")
+	}
+	br := bufio.NewReader(io.NewSectionReader(r.f, r.end, fi.Size()-trailerSize-r.end))
+	nblocks, err := binary.ReadUvarint(br)
+	if err != nil {
+		return err
+	}
+	r.blocks = make([]block, 0, nblocks)
+	for i := uint64(0); i < nblocks; i++ {
+		first, err := readString(br)
+		if err != nil {
+			return err
+		}
+		off, err := binary.ReadUvarint(br)
+		if err != nil {
+			return err
+		}
+		r.blocks = append(r.blocks, block{first, int64(off)})
+	}
+	return nil
+}
+
+// Format returns the format of the index file.
+func (r *Reader) Format() Format {
+	return r.format
+}
+
+// Meta returns the metadata of the index file.
+func (r *Reader) Meta() *Meta {
+	return &r.meta
+}
+
+// ModTime returns the modification time of the index file, or of its
+// newest segment.
+func (r *Reader) ModTime() (time.Time, error) {
+	var latest time.Time
+	for _, f := range r.files() {
+		fi, err := f.f.Stat()
+		if err != nil {
+			return time.Time{}, err
+		}
+		if fi.ModTime().After(latest) {
+			latest = fi.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// Len returns the number of records in the index file. With segments,
+// it includes superseded records until they are compacted.
+func (r *Reader) Len() int64 {
+	n := r.n
+	for _, seg := range r.segments {
+		n += seg.n
+	}
+	return n
+}
+
+// Lookup finds the target of a shortcode.
+func (r *Reader) Lookup(shortcode string) (string, bool, error) {
+	for _, seg := range r.segments {
+		if target, ok, err := seg.Lookup(shortcode); ok || err != nil {
+			return target, ok, err
+		}
+	}
+	i := sort.Search(len(r.blocks), func(i int) bool {
+		return r.blocks[i].first > shortcode
+	}) - 1
+	if i < 0 {
+		return "", false, nil
+	}
+	if r.format == FormatColumnar {
+		it := r.iterBlocks(i, i+1)
+		defer it.release()
+		if it.err != nil {
+			return "", false, it.err
+		}
+		return it.cols.lookup(it.br, shortcode)
+	}
+	var target string
+	var found bool
+	err := r.scanBlocks(i, i+1, func(rec Record) error {
+		if rec.Shortcode == shortcode {
+			target, found = rec.Target, true
+			return errStop
+		}
+		if rec.Shortcode > shortcode {
+			return errStop
+		}
+		return nil
+	})
+	return target, found, err
+}
+
+// AppendLookup finds the target of a shortcode and appends it to dst.
+// When the index file is mapped, it does not allocate, apart from
+// growing dst.
+func (r *Reader) AppendLookup(dst []byte, shortcode string) ([]byte, bool, error) {
+	for _, seg := range r.segments {
+		if b, ok, err := seg.AppendLookup(dst, shortcode); ok || err != nil {
+			return b, ok, err
+		}
+	}
+	if r.data == nil || r.format == FormatColumnar {
+		target, ok, err := r.Lookup(shortcode)
+		return append(dst, target...), ok, err
+	}
+	i := sort.Search(len(r.blocks), func(i int) bool {
+		return r.blocks[i].first > shortcode
+	}) - 1
+	if i < 0 {
+		return dst, false, nil
+	}
+	end := r.end
+	if i+1 < len(r.blocks) {
+		end = r.start + r.blocks[i+1].offset
+	}
+	if end > int64(len(r.data)) {
+		return dst, false, io.ErrUnexpectedEOF
+	}
+	b := r.data[r.start+r.blocks[i].offset : end]
+	if r.format == FormatCompact {
+		return appendLookupCompact(dst, b, shortcode, r.deltaKeys)
+	}
+	for len(b) != 0 {
+		code, rest, err := sliceString(b)
+		if err != nil {
+			return dst, false, err
+		}
+		target, rest, err := sliceString(rest)
+		if err != nil {
+			return dst, false, err
+		}
+		switch c := string(code); {
+		case c == shortcode:
+			return append(dst, target...), true, nil
+		case c > shortcode:
+			return dst, false, nil
+		}
+		b = rest
+	}
+	return dst, false, nil
+}
+
+// appendLookupCompact scans a front-coded block for a shortcode. Each
+// target is decoded in place after dst, so that the prefix it shares
+// with the previous target is already there.
+func appendLookupCompact(dst, b []byte, shortcode string, delta bool) ([]byte, bool, error) {
+	var codeBuf [64]byte
+	code := codeBuf[:0]
+	base := len(dst)
+	for len(b) != 0 {
+		var rest []byte
+		var err error
+		if delta {
+			code, rest, err = sliceKey(b, code)
+			if err != nil {
+				return dst[:base], false, err
+			}
+		} else {
+			var shared int
+			var suffix []byte
+			shared, suffix, rest, err = sliceShared(b)
+			if err != nil || shared > len(code) {
+				return dst[:base], false, io.ErrUnexpectedEOF
+			}
+			code = append(code[:shared], suffix...)
+		}
+		sharedTarget, suffix, rest, err := sliceShared(rest)
+		if err != nil || base+sharedTarget > len(dst) {
+			return dst[:base], false, io.ErrUnexpectedEOF
+		}
+		dst = append(dst[:base+sharedTarget], suffix...)
+		switch c := string(code); {
+		case c == shortcode:
+			return dst, true, nil
+		case c > shortcode:
+			return dst[:base], false, nil
+		}
+		b = rest
+	}
+	return dst[:base], false, nil
+}
+
+// LookupBatch finds the targets of many shortcodes. Shortcodes are
+// looked up in sorted order, so that each block is read at most once.
+func (r *Reader) LookupBatch(shortcodes []string) ([]string, []bool, error) {
+	if len(r.segments) != 0 {
+		return r.lookupBatchChain(shortcodes)
+	}
+	targets := make([]string, len(shortcodes))
+	found := make([]bool, len(shortcodes))
+	order := make([]int, len(shortcodes))
+	for i := range order {
+		order[i] = i
+	}
+	sort.Slice(order, func(i, j int) bool {
+		return shortcodes[order[i]] < shortcodes[order[j]]
+	})
+	for k := 0; k < len(order); {
+		i := sort.Search(len(r.blocks), func(i int) bool {
+			return r.blocks[i].first > shortcodes[order[k]]
+		}) - 1
+		if i < 0 {
+			k++
+			continue
+		}
+		var end string // first shortcode of the next block
+		if i+1 < len(r.blocks) {
+			end = r.blocks[i+1].first
+		}
+		it := r.iterBlocks(i, i+1)
+		ok := it.Next()
+		for ; k < len(order) && (end == "" || shortcodes[order[k]] < end); k++ {
+			shortcode := shortcodes[order[k]]
+			for ok && it.Record().Shortcode < shortcode {
+				ok = it.Next()
+			}
+			if ok && it.Record().Shortcode == shortcode {
+				targets[order[k]], found[order[k]] = it.Record().Target, true
+			}
+		}
+		it.release()
+		if err := it.Err(); err != nil {
+			return nil, nil, err
+		}
+	}
+	return targets, found, nil
+}
+
+// lookupBatchChain looks up shortcodes in the index file, then in each
+// segment from oldest to newest, so that newer targets replace older.
+func (r *Reader) lookupBatchChain(shortcodes []string) ([]string, []bool, error) {
+	files := r.files()
+	var targets []string
+	var found []bool
+	for i := len(files) - 1; i >= 0; i-- {
+		f := *files[i]
+		f.segments = nil
+		t, ok, err := f.LookupBatch(shortcodes)
+		if err != nil {
+			return nil, nil, err
+		}
+		if targets == nil {
+			targets, found = t, ok
+			continue
+		}
+		for k := range ok {
+			if ok[k] {
+				targets[k], found[k] = t[k], true
+			}
+		}
+	}
+	return targets, found, nil
+}
+
+// Range calls fn for every record with a shortcode in [start, end) in
+// increasing shortcode order. An empty end is unbounded. Iteration
+// stops early when fn returns an error.
+func (r *Reader) Range(start, end string, fn func(Record) error) error {
+	if len(r.segments) != 0 {
+		it := r.chainIter(start, end)
+		for it.Next() {
+			if err := fn(it.Record()); err != nil {
+				if err == errStop {
+					return nil
+				}
+				return err
+			}
+		}
+		return it.Err()
+	}
+	i, j := r.blockRange(start, end)
+	return r.scanBlocks(i, j, func(rec Record) error {
+		if rec.Shortcode < start {
+			return nil
+		}
+		if end != "" && rec.Shortcode >= end {
+			return errStop
+		}
+		return fn(rec)
+	})
+}
+
+// RangeHosts is like Range, but the target of each record is only its
+// scheme and authority, like "https://example.com", which suffices to
+// filter or aggregate records by the domains of their targets. In the
+// columnar format, only the shortcodes and hosts are read.
+func (r *Reader) RangeHosts(start, end string, fn func(Record) error) error {
+	if len(r.segments) != 0 || r.format != FormatColumnar {
+		return r.Range(start, end, func(rec Record) error {
+			rec.Target, _, _ = splitTarget(rec.Target)
+			return fn(rec)
+		})
+	}
+	i, j := r.blockRange(start, end)
+	it := r.iterBlocks(i, j)
+	if it.cols != nil {
+		it.cols.hosts = true
+	}
+	for it.Next() {
+		rec := it.Record()
+		if rec.Shortcode < start {
+			continue
+		}
+		if end != "" && rec.Shortcode >= end {
+			it.release()
+			break
+		}
+		if err := fn(rec); err != nil {
+			it.release()
+			if err == errStop {
+				return nil
+			}
+			return err
+		}
+	}
+	return it.Err()
+}
+
+// blockRange returns the blocks [i, j) that contain the shortcodes in
+// [start, end).
+func (r *Reader) blockRange(start, end string) (i, j int) {
+	i = sort.Search(len(r.blocks), func(i int) bool {
+		return r.blocks[i].first > start
+	}) - 1
+	if i < 0 {
+		i = 0
+	}
+	j = len(r.blocks)
+	if end != "" {
+		j = sort.Search(len(r.blocks), func(j int) bool {
+			return r.blocks[j].first >= end
+		})
+	}
+	return i, j
+}
+
+// Prefix calls fn for every record with a shortcode starting with
+// prefix in increasing shortcode order.
+func (r *Reader) Prefix(prefix string, fn func(Record) error) error {
+	return r.Range(prefix, PrefixEnd(prefix), fn)
+}
+
+// Page returns up to limit records with shortcodes starting with
+// prefix that sort after the cursor after, for paginating prefix
+// queries. When more records remain, next is the cursor for the
+// following page. A limit of 0 is unlimited.
+func (r *Reader) Page(prefix, after string, limit int) (records []Record, next string, err error) {
+	start := prefix
+	if after >= start {
+		start = after + "\x00"
+	}
+	end := PrefixEnd(prefix)
+	if end != "" && start >= end {
+		return nil, "", nil
+	}
+	err = r.Range(start, end, func(rec Record) error {
+		if limit != 0 && len(records) == limit {
+			next = records[len(records)-1].Shortcode
+			return errStop
+		}
+		records = append(records, rec)
+		return nil
+	})
+	return records, next, err
+}
+
+// PrefixEnd returns the least string greater than every string with the
+// given prefix, or "" if there is none.
+func PrefixEnd(prefix string) string {
+	b := []byte(prefix)
+	for i := len(b) - 1; i >= 0; i-- {
+		if b[i] != 0xff {
+			b[i]++
+			return string(b[:i+1])
+		}
+	}
+	return ""
+}
+
+// Iterate calls fn for every record in increasing shortcode order.
+// Iteration stops early when fn returns an error.
+func (r *Reader) Iterate(fn func(Record) error) error {
+	if len(r.segments) != 0 {
+		return r.Range("", "", fn)
+	}
+	return r.scanBlocks(0, len(r.blocks), fn)
+}
+
+// Iter returns an iterator over every record in increasing shortcode
+// order.
+func (r *Reader) Iter() Iter {
+	if len(r.segments) != 0 {
+		return r.chainIter("", "")
+	}
+	return r.iterBlocks(0, len(r.blocks))
+}
+
+// RangeIter returns an iterator over the records with shortcodes in
+// [start, end) in increasing shortcode order, like Range. An empty end
+// is unbounded.
+func (r *Reader) RangeIter(start, end string) Iter {
+	if len(r.segments) != 0 {
+		return r.chainIter(start, end)
+	}
+	return r.rangeIter(start, end)
+}
+
+var errStop = errors.New("stop")
+
+// scanBlocks calls fn for every record in blocks [i, j).
+func (r *Reader) scanBlocks(i, j int, fn func(Record) error) error {
+	it := r.iterBlocks(i, j)
+	for it.Next() {
+		if err := fn(it.Record()); err != nil {
+			it.release()
+			if err == errStop {
+				return nil
+			}
+			return err
+		}
+	}
+	return it.Err()
+}
+
+// iterBlocks returns an iterator over the records in blocks [i, j).
+func (r *Reader) iterBlocks(i, j int) *blockIter {
+	if i >= j {
+		return &blockIter{}
+	}
+	end := r.end
+	if j < len(r.blocks) {
+		end = r.start + r.blocks[j].offset
+	}
+	off := r.start + r.blocks[i].offset
+	if r.data != nil {
+		if end > int64(len(r.data)) {
+			return &blockIter{err: io.ErrUnexpectedEOF}
+		}
+		return r.newBlockIter(bytes.NewReader(r.data[off:end]))
+	}
+	br := blockReaders.Get().(*bufio.Reader)
+	br.Reset(io.NewSectionReader(r.f, off, end-off))
+	return r.newBlockIter(br)
+}
+
+func (r *Reader) newBlockIter(br byteReader) *blockIter {
+	it := &blockIter{br: br, format: r.format, deltaKeys: r.deltaKeys}
+	if r.format == FormatColumnar {
+		it.cols = columnReaders.Get().(*columnReader)
+		it.cols.deltaKeys = r.deltaKeys
+	}
+	return it
+}
+
+// blockReaders recycles the buffers of block iterators over unmapped
+// files, which would otherwise be allocated by every lookup.
+var blockReaders = sync.Pool{New: func() interface{} { return bufio.NewReader(nil) }}
+
+type blockIter struct {
+	br        byteReader
+	format    Format
+	deltaKeys bool
+	i         int64 // index of the record in its block
+	rec       Record
+	err       error
+	cols      *columnReader // in the columnar format
+}
+
+func (it *blockIter) Next() bool {
+	if it.br == nil || it.err != nil {
+		return false
+	}
+	if it.cols != nil {
+		rec, err := it.cols.next(it.br)
+		if err != nil {
+			if err != io.EOF {
+				it.err = err
+			}
+			it.release()
+			return false
+		}
+		it.rec = rec
+		return true
+	}
+	if it.format == FormatCompact {
+		return it.nextCompact()
+	}
+	shortcode, err := readString(it.br)
+	if err != nil {
+		if err != io.EOF {
+			it.err = err
+		}
+		it.release()
+		return false
+	}
+	target, err := readString(it.br)
+	if err != nil {
+		it.err = noEOF(err)
+		it.release()
+		return false
+	}
+	it.rec = Record{Shortcode: shortcode, Target: target}
+	return true
+}
+
+func (it *blockIter) nextCompact() bool {
+	if it.i%BlockSize == 0 {
+		it.rec = Record{}
+	}
+	var shortcode string
+	var err error
+	if it.deltaKeys {
+		shortcode, err = readKey(it.br, it.rec.Shortcode)
+	} else {
+		shortcode, err = readShared(it.br, it.rec.Shortcode)
+	}
+	if err != nil {
+		if err != io.EOF {
+			it.err = err
+		}
+		it.release()
+		return false
+	}
+	target, err := readShared(it.br, it.rec.Target)
+	if err != nil {
+		it.err = noEOF(err)
+		it.release()
+		return false
+	}
+	it.rec = Record{Shortcode: shortcode, Target: target}
+	it.i++
+	return true
+}
+
+// release returns the buffer of the iterator, if any, to blockReaders
+// and its column decoder to columnReaders, and ends iteration.
+func (it *blockIter) release() {
+	if br, ok := it.br.(*bufio.Reader); ok {
+		br.Reset(nil)
+		blockReaders.Put(br)
+	}
+	it.br = nil
+	if it.cols != nil {
+		it.cols.reset()
+		columnReaders.Put(it.cols)
+		it.cols = nil
+	}
+}
+
+func (it *blockIter) Record() Record { return it.rec }
+func (it *blockIter) Err() error     { return it.err }
+
+// Warm reads the records section of the index file, so that it is in
+// the page cache before the first lookups.
+func (r *Reader) Warm() error {
+	for _, seg := range r.segments {
+		if err := seg.Warm(); err != nil {
+			return err
+		}
+	}
+	_, err := io.Copy(io.Discard, io.NewSectionReader(r.f, r.start, r.end-r.start))
+	return err
+}
+
+// Close closes the index file and its segments and unmaps them, when
+// mapped.
+func (r *Reader) Close() error {
+	var err error
+	for _, seg := range r.segments {
+		if err1 := seg.Close(); err1 != nil && err == nil {
+			err = err1
+		}
+	}
+	r.segments = nil
+	if err1 := munmap(r.data); err1 != nil && err == nil {
+		err = err1
+	}
+	r.data = nil
+	if r.prov != nil {
+		if err1 := r.prov.Close(); err1 != nil && err == nil {
+			err = err1
+		}
+		r.prov = nil
+	}
+	if err1 := r.f.Close(); err == nil {
+		err = err1
+	}
+	return err
+}
+
+type byteReader interface {
+	io.Reader
+	io.ByteReader
+}
+
+func readString(br byteReader) (string, error) {
+	n, err := binary.ReadUvarint(br)
+	if err != nil {
+		return "", err
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(br, b); err != nil {
+		return "", noEOF(err)
+	}
+	return string(b), nil
+}
+
+// readShared reads a string front coded against prev.
+func readShared(br byteReader, prev string) (string, error) {
+	n, err := binary.ReadUvarint(br)
+	if err != nil {
+		return "", err
+	}
+	if n > uint64(len(prev)) {
+		return "", errors.New("shared prefix longer than previous string")
+	}
+	m, err := binary.ReadUvarint(br)
+	if err != nil {
+		return "", noEOF(err)
+	}
+	b := make([]byte, int(n)+int(m))
+	copy(b, prev[:n])
+	if _, err := io.ReadFull(br, b[n:]); err != nil {
+		return "", noEOF(err)
+	}
+	return string(b), nil
+}
+
+// sliceShared slices a front-coded string from b without copying.
+func sliceShared(b []byte) (shared int, suffix, rest []byte, err error) {
+	n, k := binary.Uvarint(b)
+	if k <= 0 || n > math.MaxInt32 {
+		return 0, nil, nil, io.ErrUnexpectedEOF
+	}
+	suffix, rest, err = sliceString(b[k:])
+	return int(n), suffix, rest, err
+}
+
+// sliceString slices a length-prefixed string from b without copying.
+func sliceString(b []byte) (s, rest []byte, err error) {
+	n, k := binary.Uvarint(b)
+	if k <= 0 || uint64(len(b)-k) < n {
+		return nil, nil, io.ErrUnexpectedEOF
+	}
+	return b[k : k+int(n)], b[k+int(n):], nil
+}
+
+func noEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+func appendUvarint(b []byte, x uint64) []byte {
+	var v [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(v[:], x)
+	return append(b, v[:n]...)
+}
+
+func appendUint64(b []byte, x uint64) []byte {
+	var v [8]byte
+	binary.BigEndian.PutUint64(v[:], x)
+	return append(b, v[:]...)
+}
+
+func uvarintLen(x uint64) int {
+	var b [binary.MaxVarintLen64]byte
+	return binary.PutUvarint(b[:], x)
+}
@@ -0,0 +1,291 @@
+// Copyright (c) 2021 Andrew Archibald
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package index builds and reads sorted shortcode→target lookup
+// indexes. An index is a directory with one file per shortener host,
+// so that a single lookup does not require rescanning every release.
+// Updates to a host are added as segments, which compaction merges into
+// its file.
+//
+// Index files are deterministic: the same records, in any order and
+// whether or not they are spilled while building, produce the same
+// bytes, as shortcodes are compared bytewise and duplicates are resolved
+// by a fixed rule, rather than by the order of sorting or of map
+// iteration. Exports and merges are ordered likewise, so that diffs
+// between snapshots of a corpus show only changed records.
+package index
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Ext is the file extension of per-host index files.
+const Ext = ".idx"
+
+// Index is a directory of per-host index files, or a federation of
+// several.
+type Index struct {
+	dir     string
+	readers map[string]*Reader // key: host
+	layers  map[string][]Layer // key: host
+	hosts   []string
+	version string
+	sources []*Index // federated indexes, in priority order
+}
+
+// Layer is the index file of a host in one index of a federation.
+type Layer struct {
+	Source string // base name of the index directory, e.g. "301works"
+	*Reader
+}
+
+// Open opens every index file in dir.
+func Open(dir string) (*Index, error) {
+	return open(dir, OpenReader)
+}
+
+// OpenMmap opens every index file in dir and maps them read-only into
+// memory, for serving lookups at high rates.
+func OpenMmap(dir string) (*Index, error) {
+	return open(dir, OpenReaderMmap)
+}
+
+func open(dir string, openReader func(filename string) (*Reader, error)) (*Index, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	idx := &Index{dir: dir, readers: make(map[string]*Reader), layers: make(map[string][]Layer)}
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !strings.HasSuffix(name, Ext) {
+			continue
+		}
+		r, err := openReader(filepath.Join(dir, name))
+		if err != nil {
+			idx.Close()
+			return nil, err
+		}
+		host := r.Meta().Host
+		if _, ok := idx.readers[host]; ok {
+			r.Close()
+			idx.Close()
+			return nil, fmt.Errorf("index: multiple files for host %s in %s", host, dir)
+		}
+		idx.readers[host] = r
+		idx.hosts = append(idx.hosts, host)
+	}
+	if err := idx.openSegments(openReader); err != nil {
+		idx.Close()
+		return nil, err
+	}
+	for host, r := range idx.readers {
+		p, err := OpenProvenance(ProvenanceFilename(dir, host))
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		} else if err != nil {
+			idx.Close()
+			return nil, err
+		}
+		r.prov = p
+	}
+	for host, r := range idx.readers {
+		idx.layers[host] = []Layer{{filepath.Base(dir), r}}
+	}
+	sort.Strings(idx.hosts)
+	if err := idx.computeVersion(); err != nil {
+		idx.Close()
+		return nil, err
+	}
+	return idx, nil
+}
+
+// openSegments opens the segments in the index directory and chains
+// them to the index files of their hosts.
+func (idx *Index) openSegments(openReader func(filename string) (*Reader, error)) error {
+	segs, err := listSegments(idx.dir)
+	if err != nil {
+		return err
+	}
+	chains := make(map[string][]*Reader)
+	var hosts []string
+	for _, seg := range segs {
+		r, err := openReader(seg.name)
+		if err != nil {
+			for _, c := range chains {
+				for _, r := range c {
+					r.Close()
+				}
+			}
+			return err
+		}
+		host := r.Meta().Host
+		if _, ok := chains[host]; !ok {
+			hosts = append(hosts, host)
+		}
+		chains[host] = append(chains[host], r)
+	}
+	for _, host := range hosts {
+		c := chains[host]
+		if base, ok := idx.readers[host]; ok {
+			c = append([]*Reader{base}, c...)
+		} else {
+			idx.hosts = append(idx.hosts, host)
+		}
+		idx.readers[host] = chain(c)
+	}
+	return nil
+}
+
+// Federate combines indexes, such as those of tinytown, 301works, and
+// freshly resolved data, into one that serves the hosts of all of them.
+// The indexes are in priority order: when several have a host, Reader
+// returns the file of the first and Lookup prefers its targets, while
+// Layers returns all of them. Closing the federation closes the indexes.
+func Federate(indexes ...*Index) (*Index, error) {
+	switch len(indexes) {
+	case 0:
+		return nil, errors.New("index: no indexes to federate")
+	case 1:
+		return indexes[0], nil
+	}
+	fed := &Index{readers: make(map[string]*Reader), layers: make(map[string][]Layer), sources: indexes}
+	dirs := make([]string, len(indexes))
+	names := make(map[string]bool)
+	h := fnv.New64a()
+	for i, idx := range indexes {
+		dirs[i] = idx.dir
+		name := filepath.Base(idx.dir)
+		if names[name] {
+			return nil, fmt.Errorf("index: multiple federated indexes named %s", name)
+		}
+		names[name] = true
+		fmt.Fprintf(h, "%s\x00", idx.version)
+		for _, host := range idx.hosts {
+			if _, ok := fed.readers[host]; !ok {
+				fed.readers[host] = idx.readers[host]
+				fed.hosts = append(fed.hosts, host)
+			}
+			fed.layers[host] = append(fed.layers[host], idx.layers[host]...)
+		}
+	}
+	sort.Strings(fed.hosts)
+	fed.dir = strings.Join(dirs, string(os.PathListSeparator))
+	fed.version = fmt.Sprintf("%016x", h.Sum64())
+	return fed, nil
+}
+
+// computeVersion identifies the index by the hosts, sizes, and
+// modification times of its files, which change whenever it is
+// rebuilt.
+func (idx *Index) computeVersion() error {
+	h := fnv.New64a()
+	for _, host := range idx.hosts {
+		for _, r := range idx.readers[host].files() {
+			fi, err := r.f.Stat()
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(h, "%s\x00%d\x00%d\x00%d\x00", host, fi.Size(), fi.ModTime().UnixNano(), r.n)
+		}
+	}
+	idx.version = fmt.Sprintf("%016x", h.Sum64())
+	return nil
+}
+
+// Version returns an identifier of the index contents, which changes
+// when the index is rebuilt.
+func (idx *Index) Version() string {
+	return idx.version
+}
+
+// Dir returns the directory of the index. The directories of a
+// federation are joined by os.PathListSeparator.
+func (idx *Index) Dir() string {
+	return idx.dir
+}
+
+// Hosts returns the sorted hosts contained in the index.
+func (idx *Index) Hosts() []string {
+	return idx.hosts
+}
+
+// Reader returns the reader for the given host or nil, if the host is
+// not in the index. In a federation, it is the reader of the index with
+// the highest priority.
+func (idx *Index) Reader(host string) *Reader {
+	return idx.readers[host]
+}
+
+// Layers returns the readers for the given host in every federated
+// index that has it, in priority order. An index that is not federated
+// has a single layer.
+func (idx *Index) Layers(host string) []Layer {
+	return idx.layers[host]
+}
+
+// Len returns the number of shortcodes indexed for the host. In a
+// federation, it is the number in the index with the highest priority.
+func (idx *Index) Len(host string) int64 {
+	if r := idx.readers[host]; r != nil {
+		return r.Len()
+	}
+	return 0
+}
+
+// Lookup finds the target of a shortcode on the given host. In a
+// federation, it is the target in the first index with the shortcode.
+func (idx *Index) Lookup(host, shortcode string) (string, bool, error) {
+	for _, l := range idx.layers[host] {
+		target, ok, err := l.Lookup(shortcode)
+		if ok || err != nil {
+			return target, ok, err
+		}
+	}
+	return "", false, nil
+}
+
+// Warm reads every index file into the page cache.
+func (idx *Index) Warm() error {
+	for _, host := range idx.hosts {
+		for _, l := range idx.layers[host] {
+			if err := l.Warm(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Close closes all index files.
+func (idx *Index) Close() error {
+	var first error
+	for _, src := range idx.sources {
+		if err := src.Close(); err != nil && first == nil {
+			first = err
+		}
+	}
+	if idx.sources != nil {
+		return first
+	}
+	for _, r := range idx.readers {
+		if err := r.Close(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// Filename returns the name of the index file for a host in dir.
+func Filename(dir, host string) string {
+	return filepath.Join(dir, host+Ext)
+}
@@ -0,0 +1,133 @@
+// Copyright (c) 2021 Andrew Archibald
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package index
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+)
+
+// In the compact and columnar formats, when the format version byte has
+// the deltaKeys bit set, each shortcode of a block after the first is
+// coded against the previous as a uvarint tag. When the low bit of the
+// tag is 1, the rest of the tag is the difference of the shortcodes as
+// big-endian integers, which have the same length of at most 8 bytes.
+// Otherwise, the rest of the tag is the length of the prefix shared
+// with the previous shortcode, followed by the length-prefixed
+// remainder. Writers choose the shorter of the two, so sequential IDs,
+// which most shorteners assign, take about a byte each, and others are
+// front coded as before.
+
+const deltaKeys = 0x80
+
+// maxDeltaKey is the length of the longest shortcode that is delta
+// coded.
+const maxDeltaKey = 8
+
+// appendKey appends a shortcode coded against the previous shortcode of
+// its block.
+func appendKey(b []byte, prev, s string) []byte {
+	n := 0
+	for n < len(prev) && n < len(s) && prev[n] == s[n] {
+		n++
+	}
+	front := uint64(n) << 1
+	if len(s) == len(prev) && len(s) <= maxDeltaKey && s > prev {
+		delta := keyValue(s) - keyValue(prev)
+		frontLen := uvarintLen(front) + uvarintLen(uint64(len(s)-n)) + len(s) - n
+		if delta < 1<<63 && uvarintLen(delta<<1|1) < frontLen {
+			return appendUvarint(b, delta<<1|1)
+		}
+	}
+	b = appendUvarint(b, front)
+	return appendString(b, s[n:])
+}
+
+// readKey reads a shortcode coded against prev.
+func readKey(br byteReader, prev string) (string, error) {
+	tag, err := binary.ReadUvarint(br)
+	if err != nil {
+		return "", err
+	}
+	if tag&1 != 0 {
+		var b [maxDeltaKey]byte
+		k := append(b[:0], prev...)
+		if err := addDelta(k, tag>>1); err != nil {
+			return "", err
+		}
+		return string(k), nil
+	}
+	n := tag >> 1
+	if n > uint64(len(prev)) {
+		return "", errors.New("shared prefix longer than previous string")
+	}
+	m, err := binary.ReadUvarint(br)
+	if err != nil {
+		return "", noEOF(err)
+	}
+	b := make([]byte, int(n)+int(m))
+	copy(b, prev[:n])
+	if _, err := io.ReadFull(br, b[n:]); err != nil {
+		return "", noEOF(err)
+	}
+	return string(b), nil
+}
+
+// sliceKey decodes a shortcode from b against prev, which it replaces
+// in place, and returns it and the rest of b.
+func sliceKey(b, prev []byte) (key, rest []byte, err error) {
+	tag, k := binary.Uvarint(b)
+	if k <= 0 {
+		return nil, nil, io.ErrUnexpectedEOF
+	}
+	if tag&1 != 0 {
+		if err := addDelta(prev, tag>>1); err != nil {
+			return nil, nil, err
+		}
+		return prev, b[k:], nil
+	}
+	if tag>>1 > uint64(len(prev)) || tag>>1 > math.MaxInt32 {
+		return nil, nil, io.ErrUnexpectedEOF
+	}
+	suffix, rest, err := sliceString(b[k:])
+	if err != nil {
+		return nil, nil, err
+	}
+	return append(prev[:tag>>1], suffix...), rest, nil
+}
+
+// addDelta adds delta to a shortcode as a big-endian integer in place.
+func addDelta(k []byte, delta uint64) error {
+	if len(k) == 0 || len(k) > maxDeltaKey {
+		return errors.New("delta-coded shortcode after one of invalid length")
+	}
+	var v uint64
+	for _, c := range k {
+		v = v<<8 | uint64(c)
+	}
+	sum := v + delta
+	if sum < v || (len(k) < 8 && sum>>(8*uint(len(k))) != 0) {
+		return errors.New("delta-coded shortcode overflows")
+	}
+	for i := len(k) - 1; i >= 0; i-- {
+		k[i] = byte(sum)
+		sum >>= 8
+	}
+	return nil
+}
+
+// keyValue returns a shortcode of at most 8 bytes as a big-endian
+// integer.
+func keyValue(s string) uint64 {
+	var v uint64
+	for i := 0; i < len(s); i++ {
+		v = v<<8 | uint64(s[i])
+	}
+	return v
+}
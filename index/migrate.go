@@ -0,0 +1,115 @@
+// Copyright (c) 2021 Andrew Archibald
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package index
+
+import (
+	"fmt"
+	"io"
+	"os"
+)
+
+// VersionError is returned when an index file has a format version that
+// cannot be read, such as one written by a newer version of this
+// package. It matches ErrFormat with errors.Is.
+type VersionError struct {
+	Filename string
+	Version  byte // format version byte of the header
+}
+
+func (err *VersionError) Error() string {
+	return fmt.Sprintf("index: %s: unsupported format version %#x, which may have been written by a newer version",
+		err.Filename, err.Version)
+}
+
+// Is reports whether target is ErrFormat.
+func (err *VersionError) Is(target error) bool { return target == ErrFormat }
+
+// Outdated reports whether the index file or any of its segments was
+// written in an older version of its format, which Migrate upgrades.
+func (r *Reader) Outdated() bool {
+	for _, f := range r.files() {
+		if f.format != FormatPlain && !f.deltaKeys {
+			return true
+		}
+	}
+	return false
+}
+
+// Migrate rewrites the index in dir into newDir, which must not exist,
+// in the current version of the format of each host, with its segments
+// compacted. The old index is not modified, so the migration can be
+// checked before it replaces the original. On error, newDir is removed.
+func Migrate(dir, newDir string) error {
+	idx, err := Open(dir)
+	if err != nil {
+		return err
+	}
+	defer idx.Close()
+	if err := os.Mkdir(newDir, 0o777); err != nil {
+		return err
+	}
+	for _, host := range idx.Hosts() {
+		if err := rewrite(idx.Reader(host), Filename(newDir, host)); err != nil {
+			os.RemoveAll(newDir)
+			return fmt.Errorf("index: migrating %s: %w", host, err)
+		}
+		if idx.Reader(host).Provenance() != nil {
+			if err := copyFile(ProvenanceFilename(dir, host), ProvenanceFilename(newDir, host)); err != nil {
+				os.RemoveAll(newDir)
+				return fmt.Errorf("index: migrating %s: %w", host, err)
+			}
+		}
+	}
+	return nil
+}
+
+// copyFile copies the provenance log of a host, which is kept as is.
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// rewrite writes the records of a reader, with its segments, to a new
+// index file in its format, through a temporary file, so that readers
+// never see a partial file.
+func rewrite(r *Reader, filename string) error {
+	tmp := filename + ".tmp"
+	w, err := CreateFormat(tmp, r.Meta(), r.Format())
+	if err != nil {
+		return err
+	}
+	it := r.Iter()
+	for it.Next() {
+		if err := w.Write(it.Record()); err != nil {
+			w.Close()
+			os.Remove(tmp)
+			return err
+		}
+	}
+	if err := it.Err(); err != nil {
+		w.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := w.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, filename)
+}
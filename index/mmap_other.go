@@ -0,0 +1,24 @@
+// Copyright (c) 2021 Andrew Archibald
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+//go:build !linux && !darwin && !freebsd
+// +build !linux,!darwin,!freebsd
+
+package index
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+)
+
+func mmap(f *os.File, size int64) ([]byte, error) {
+	return nil, fmt.Errorf("index: mmap unsupported on %s", runtime.GOOS)
+}
+
+func munmap(data []byte) error {
+	return nil
+}
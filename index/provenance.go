@@ -0,0 +1,695 @@
+// Copyright (c) 2021 Andrew Archibald
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package index
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/andrewarchi/urlhero/tinytown"
+)
+
+// The provenance of the records of a host is kept in an append-only log
+// beside its index file, named host.prov, so that every mapping can be
+// cited by the releases that archived it, even after deduplication,
+// segments, and compaction have discarded the copies. Each build or
+// update of the host from releases appends a batch, which is laid out
+// as:
+//
+//   header   big-endian uint64 length of the batch and uint64 offset of
+//            its blocks relative to the batch, which are written as 0
+//            and set once the rest is synced, so that a torn batch is
+//            ignored
+//   sources  uvarint release count, followed by the length-prefixed
+//            release IDs
+//   entries  each shortcode that the releases have, in increasing byte
+//            order, coded as in keys.go against the previous of its
+//            block, then a uvarint version count and the versions
+//   blocks   uvarint block count, followed by the first shortcode and
+//            the offset relative to the entries section of every
+//            BlockSize-th entry
+//
+// A version is a target of the shortcode with the releases that had it:
+// a uvarint tag of the release count shifted left by one, with the low
+// bit set when the target follows as a length-prefixed string, or else
+// a big-endian uint32 FNV-1a hash of the target that was indexed, then
+// the uvarint index of each release in the sources of the batch. Only
+// targets that were not indexed are spelled out, which is rare, so the
+// log is much smaller than the index. When an update retargets a
+// shortcode, the target that it replaces is spelled out as a version
+// without releases, so that it is not lost once the index file and
+// segment of the batch that hashed it are compacted. In batches with the provTimes bit
+// set in the offset of their blocks, as since version 2, the releases
+// are followed by the times that the target was first and last seen, as
+// a uvarint of the Unix time of the first, or 0 when unknown, and, when
+// known, a uvarint of the seconds after it of the last. The times of
+// earlier batches are those of their releases.
+//
+// The log starts with the magic "URLTPRV" and a version byte, which is
+// that of the newest batch.
+
+const (
+	provMagic  = "URLTPRV"
+	provFormat = 2
+	provTimes  = 1 << 63
+	// ProvenanceExt is the file extension of provenance logs.
+	ProvenanceExt = ".prov"
+)
+
+// ProvenanceFilename returns the name of the provenance log of a host
+// in dir.
+func ProvenanceFilename(dir, host string) string {
+	return filepath.Join(dir, host+ProvenanceExt)
+}
+
+// targetHash is the 32-bit FNV-1a hash of a target.
+func targetHash(target string) uint32 {
+	h := uint32(2166136261)
+	for i := 0; i < len(target); i++ {
+		h ^= uint32(target[i])
+		h *= 16777619
+	}
+	return h
+}
+
+// provVersion is a target of a shortcode and the sources, which are the
+// indexes of the releases of the host, that had it, with the Unix times
+// that it was first and last seen, or 0 when unknown.
+type provVersion struct {
+	target      string
+	srcs        []int32
+	first, last int64
+	// superseded is set for the target that the index had before an
+	// update retargeted the shortcode
+	superseded bool
+}
+
+// seen reports whether a version has a source or a time, or is written
+// regardless.
+func (v *provVersion) seen() bool {
+	return len(v.srcs) != 0 || v.first != 0 || v.superseded
+}
+
+// addTime extends the times of a version to include [first, last].
+func (v *provVersion) addTime(first, last int64) {
+	if first == 0 {
+		return
+	}
+	if v.first == 0 || first < v.first {
+		v.first = first
+	}
+	if last > v.last {
+		v.last = last
+	}
+}
+
+// provWriter appends a batch to a provenance log.
+type provWriter struct {
+	f      *os.File
+	w      *bufio.Writer
+	start  int64 // offset of the batch
+	off    int64 // offset relative to the batch
+	base   int64 // offset of the entries relative to the batch
+	n      int64
+	last   string
+	blocks []block
+	buf    []byte
+}
+
+// appendProvenance opens the provenance log filename, creating it or,
+// when truncate is set, replacing it, and starts a batch of records
+// from the given releases. A torn batch at the end, from a writer that
+// crashed, is removed.
+func appendProvenance(filename string, truncate bool, releases []string) (*provWriter, error) {
+	flag := os.O_RDWR | os.O_CREATE
+	if truncate {
+		flag |= os.O_TRUNC
+	}
+	f, err := os.OpenFile(filename, flag, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	pw := &provWriter{f: f}
+	if err := pw.begin(releases); err != nil {
+		f.Close()
+		return nil, provError(filename, err)
+	}
+	return pw, nil
+}
+
+func (pw *provWriter) begin(releases []string) error {
+	fi, err := pw.f.Stat()
+	if err != nil {
+		return err
+	}
+	if fi.Size() == 0 {
+		if _, err := pw.f.Write(append([]byte(provMagic), provFormat)); err != nil {
+			return err
+		}
+		pw.start = int64(len(provMagic) + 1)
+	} else {
+		var version byte
+		if _, pw.start, version, err = readBatches(pw.f, fi.Size()); err != nil {
+			return err
+		}
+		if err := pw.f.Truncate(pw.start); err != nil {
+			return err
+		}
+		if version != provFormat {
+			if _, err := pw.f.WriteAt([]byte{provFormat}, int64(len(provMagic))); err != nil {
+				return err
+			}
+		}
+	}
+	if _, err := pw.f.Seek(pw.start, io.SeekStart); err != nil {
+		return err
+	}
+	pw.w = bufio.NewWriter(pw.f)
+	pw.buf = make([]byte, trailerSize, 64)
+	pw.buf = appendUvarint(pw.buf, uint64(len(releases)))
+	for _, id := range releases {
+		pw.buf = appendString(pw.buf, id)
+	}
+	if _, err := pw.w.Write(pw.buf); err != nil {
+		return err
+	}
+	pw.off = int64(len(pw.buf))
+	pw.base = pw.off
+	return nil
+}
+
+// add appends the versions of a shortcode, the first of which is the
+// target that was indexed. Versions without sources or times are
+// omitted and a shortcode without any is skipped.
+func (pw *provWriter) add(shortcode string, versions []provVersion) error {
+	nv := 0
+	for i := range versions {
+		if versions[i].seen() {
+			nv++
+		}
+	}
+	if nv == 0 {
+		return nil
+	}
+	if pw.n%BlockSize == 0 {
+		pw.blocks = append(pw.blocks, block{shortcode, pw.off - pw.base})
+		pw.last = ""
+	}
+	pw.buf = appendKey(pw.buf[:0], pw.last, shortcode)
+	pw.buf = appendUvarint(pw.buf, uint64(nv))
+	for i, v := range versions {
+		if !v.seen() {
+			continue
+		}
+		tag := uint64(len(v.srcs)) << 1
+		if i == 0 {
+			pw.buf = appendUvarint(pw.buf, tag)
+			h := targetHash(v.target)
+			pw.buf = append(pw.buf, byte(h>>24), byte(h>>16), byte(h>>8), byte(h))
+		} else {
+			pw.buf = appendUvarint(pw.buf, tag|1)
+			pw.buf = appendString(pw.buf, v.target)
+		}
+		for _, src := range v.srcs {
+			pw.buf = appendUvarint(pw.buf, uint64(src))
+		}
+		pw.buf = appendUvarint(pw.buf, uint64(v.first))
+		if v.first != 0 {
+			pw.buf = appendUvarint(pw.buf, uint64(v.last-v.first))
+		}
+	}
+	if _, err := pw.w.Write(pw.buf); err != nil {
+		return err
+	}
+	pw.off += int64(len(pw.buf))
+	pw.n++
+	pw.last = shortcode
+	return nil
+}
+
+// Close writes the block directory and commits the batch.
+func (pw *provWriter) Close() error {
+	if err := pw.commit(); err != nil {
+		pw.abort()
+		return err
+	}
+	return pw.f.Close()
+}
+
+func (pw *provWriter) commit() error {
+	dir := pw.off
+	pw.buf = appendUvarint(pw.buf[:0], uint64(len(pw.blocks)))
+	for _, b := range pw.blocks {
+		pw.buf = appendString(pw.buf, b.first)
+		pw.buf = appendUvarint(pw.buf, uint64(b.offset))
+	}
+	if _, err := pw.w.Write(pw.buf); err != nil {
+		return err
+	}
+	if err := pw.w.Flush(); err != nil {
+		return err
+	}
+	if err := pw.f.Sync(); err != nil {
+		return err
+	}
+	h := appendUint64(pw.buf[:0], uint64(dir+int64(len(pw.buf))))
+	h = appendUint64(h, uint64(dir)|provTimes)
+	if _, err := pw.f.WriteAt(h, pw.start); err != nil {
+		return err
+	}
+	return pw.f.Sync()
+}
+
+// abort removes the batch from the log.
+func (pw *provWriter) abort() {
+	pw.f.Truncate(pw.start)
+	pw.f.Close()
+}
+
+// ProvenanceLog reads the provenance log of a host.
+type ProvenanceLog struct {
+	f       *os.File
+	batches []provBatch
+}
+
+// provBatch is a committed batch of a provenance log.
+type provBatch struct {
+	releases []string
+	times    []int64 // Unix times of the releases, or 0 when unknown
+	seen     bool    // whether versions have times
+	entries  int64   // offset of the entries section
+	end      int64   // offset of the blocks section
+	blocks   []block
+}
+
+// OpenProvenance opens a provenance log.
+func OpenProvenance(filename string) (*ProvenanceLog, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	batches, _, _, err := readBatches(f, fi.Size())
+	if err != nil {
+		f.Close()
+		return nil, provError(filename, err)
+	}
+	return &ProvenanceLog{f: f, batches: batches}, nil
+}
+
+// provError adds the filename of a provenance log to an error.
+func provError(filename string, err error) error {
+	var verr *VersionError
+	if errors.As(err, &verr) {
+		verr.Filename = filename
+		return verr
+	}
+	return fmt.Errorf("index: %s: %w", filename, err)
+}
+
+// readBatches reads the committed batches of a provenance log and
+// returns them with the offset after the last and the version of the
+// log.
+func readBatches(f *os.File, size int64) ([]provBatch, int64, byte, error) {
+	var h [len(provMagic) + 1]byte
+	if _, err := f.ReadAt(h[:], 0); err != nil {
+		return nil, 0, 0, fmt.Errorf("%w: %v", ErrFormat, noEOF(err))
+	}
+	if string(h[:len(provMagic)]) != provMagic {
+		return nil, 0, 0, fmt.Errorf("%w: bad magic", ErrFormat)
+	}
+	version := h[len(provMagic)]
+	if version == 0 || version > provFormat {
+		return nil, 0, 0, &VersionError{Version: version}
+	}
+	var batches []provBatch
+	off := int64(len(h))
+	for off+trailerSize <= size {
+		var t [trailerSize]byte
+		if _, err := f.ReadAt(t[:], off); err != nil {
+			return nil, 0, 0, err
+		}
+		length := int64(binary.BigEndian.Uint64(t[:8]))
+		dir := binary.BigEndian.Uint64(t[8:])
+		seen := dir&provTimes != 0
+		dir &^= provTimes
+		if length == 0 || length > size-off || dir < trailerSize || int64(dir) > length {
+			break // torn by a writer that crashed
+		}
+		b, err := readBatch(f, off, length, int64(dir))
+		if err != nil {
+			return nil, 0, 0, fmt.Errorf("%w: batch at %d: %v", ErrFormat, off, err)
+		}
+		b.seen = seen
+		batches = append(batches, b)
+		off += length
+	}
+	return batches, off, version, nil
+}
+
+func readBatch(f *os.File, off, length, dir int64) (provBatch, error) {
+	br := bufio.NewReader(io.NewSectionReader(f, off+trailerSize, dir-trailerSize))
+	n, err := binary.ReadUvarint(br)
+	if err != nil {
+		return provBatch{}, noEOF(err)
+	}
+	b := provBatch{end: off + dir}
+	size := int64(uvarintLen(n))
+	for i := uint64(0); i < n; i++ {
+		id, err := readString(br)
+		if err != nil {
+			return provBatch{}, noEOF(err)
+		}
+		b.releases = append(b.releases, id)
+		b.times = append(b.times, releaseTime(id))
+		size += int64(uvarintLen(uint64(len(id))) + len(id))
+	}
+	b.entries = off + trailerSize + size
+	if b.entries > b.end {
+		return provBatch{}, errors.New("sources longer than batch")
+	}
+	br = bufio.NewReader(io.NewSectionReader(f, off+dir, length-dir))
+	nblocks, err := binary.ReadUvarint(br)
+	if err != nil {
+		return provBatch{}, noEOF(err)
+	}
+	for i := uint64(0); i < nblocks; i++ {
+		first, err := readString(br)
+		if err != nil {
+			return provBatch{}, noEOF(err)
+		}
+		offset, err := binary.ReadUvarint(br)
+		if err != nil {
+			return provBatch{}, noEOF(err)
+		}
+		b.blocks = append(b.blocks, block{first, int64(offset)})
+	}
+	return b, nil
+}
+
+// Batches returns the number of batches in the log.
+func (p *ProvenanceLog) Batches() int {
+	return len(p.batches)
+}
+
+// Releases returns the IDs of the releases that archived a shortcode
+// with the given target, in the order that they were indexed.
+func (p *ProvenanceLog) Releases(shortcode, target string) ([]string, error) {
+	return p.Cursor().Releases(shortcode, target)
+}
+
+// Origin returns the releases that archived a shortcode with the given
+// target and when it was seen.
+func (p *ProvenanceLog) Origin(shortcode, target string) (Origin, error) {
+	return p.Cursor().Origin(shortcode, target)
+}
+
+// Close closes the log.
+func (p *ProvenanceLog) Close() error {
+	return p.f.Close()
+}
+
+// Cursor returns a cursor for lookups in the log, which caches the
+// blocks that it decodes, so that lookups of increasing shortcodes, as
+// in exports, decode each block once. A cursor is not safe for
+// concurrent use.
+func (p *ProvenanceLog) Cursor() *ProvenanceCursor {
+	return &ProvenanceCursor{p: p, cache: make([]provBlock, len(p.batches))}
+}
+
+// ProvenanceCursor looks up the releases of shortcodes in a provenance
+// log.
+type ProvenanceCursor struct {
+	p     *ProvenanceLog
+	cache []provBlock // decoded block of each batch
+	buf   []byte
+}
+
+// provBlock is a decoded block of the entries of a batch.
+type provBlock struct {
+	i       int // index of the block, plus one
+	entries []provEntry
+}
+
+type provEntry struct {
+	shortcode string
+	versions  []provEntryVersion
+}
+
+type provEntryVersion struct {
+	hash        uint32
+	target      string
+	text        bool // whether target is set, instead of hash
+	srcs        []int
+	first, last int64 // Unix times, or 0 when unknown
+}
+
+func (v *provEntryVersion) match(target string) bool {
+	if v.text {
+		return v.target == target
+	}
+	return v.hash == targetHash(target)
+}
+
+// Origin is where and when a mapping was archived.
+type Origin struct {
+	Releases []string // IDs, in the order that they were indexed
+	// FirstSeen and LastSeen are the earliest and latest times that the
+	// mapping was archived, or zero when unknown. They are those of its
+	// records or, for records without times, of its releases.
+	FirstSeen, LastSeen time.Time
+}
+
+// Releases returns the IDs of the releases that archived a shortcode
+// with the given target, in the order that they were indexed.
+func (c *ProvenanceCursor) Releases(shortcode, target string) ([]string, error) {
+	o, err := c.Origin(shortcode, target)
+	return o.Releases, err
+}
+
+// Origin returns the releases that archived a shortcode with the given
+// target and when it was seen.
+func (c *ProvenanceCursor) Origin(shortcode, target string) (Origin, error) {
+	var o Origin
+	var seen provVersion
+	for i := range c.p.batches {
+		e, err := c.entry(i, shortcode)
+		if err != nil {
+			return Origin{}, err
+		}
+		if e == nil {
+			continue
+		}
+		b := &c.p.batches[i]
+		for _, v := range e.versions {
+			if !v.match(target) {
+				continue
+			}
+			for _, src := range v.srcs {
+				o.Releases = appendMissing(o.Releases, b.releases[src:src+1])
+				if !b.seen {
+					seen.addTime(b.times[src], b.times[src])
+				}
+			}
+			seen.addTime(v.first, v.last)
+		}
+	}
+	if seen.first != 0 {
+		o.FirstSeen, o.LastSeen = time.Unix(seen.first, 0).UTC(), time.Unix(seen.last, 0).UTC()
+	}
+	return o, nil
+}
+
+// entry returns the entry of a shortcode in a batch, if any.
+func (c *ProvenanceCursor) entry(batch int, shortcode string) (*provEntry, error) {
+	b := &c.p.batches[batch]
+	i := sort.Search(len(b.blocks), func(i int) bool {
+		return b.blocks[i].first > shortcode
+	}) - 1
+	if i < 0 {
+		return nil, nil
+	}
+	cb := &c.cache[batch]
+	if cb.i != i+1 {
+		if err := c.decodeBlock(b, i, cb); err != nil {
+			return nil, err
+		}
+	}
+	j := sort.Search(len(cb.entries), func(j int) bool {
+		return cb.entries[j].shortcode >= shortcode
+	})
+	if j == len(cb.entries) || cb.entries[j].shortcode != shortcode {
+		return nil, nil
+	}
+	return &cb.entries[j], nil
+}
+
+// decodeBlock reads and decodes block i of a batch.
+func (c *ProvenanceCursor) decodeBlock(b *provBatch, i int, cb *provBlock) error {
+	end := b.end
+	if i+1 < len(b.blocks) {
+		end = b.entries + b.blocks[i+1].offset
+	}
+	start := b.entries + b.blocks[i].offset
+	if start > end {
+		return fmt.Errorf("%w: provenance block offset out of range", ErrFormat)
+	}
+	if cap(c.buf) < int(end-start) {
+		c.buf = make([]byte, end-start)
+	}
+	data := c.buf[:end-start]
+	if _, err := c.p.f.ReadAt(data, start); err != nil {
+		return noEOF(err)
+	}
+	cb.i, cb.entries = 0, cb.entries[:0]
+	var key []byte
+	for len(data) != 0 {
+		var err error
+		if key, data, err = sliceKey(data, key); err != nil {
+			return fmt.Errorf("%w: provenance entry: %v", ErrFormat, err)
+		}
+		e := provEntry{shortcode: string(key)}
+		if e.versions, data, err = sliceVersions(data, len(b.releases), b.seen); err != nil {
+			return fmt.Errorf("%w: provenance entry %q: %v", ErrFormat, e.shortcode, err)
+		}
+		cb.entries = append(cb.entries, e)
+	}
+	cb.i = i + 1
+	return nil
+}
+
+// sliceVersions decodes the versions of an entry with sources in a
+// batch of n releases, which has times when seen is set.
+func sliceVersions(b []byte, n int, seen bool) ([]provEntryVersion, []byte, error) {
+	nv, k := binary.Uvarint(b)
+	if k <= 0 || nv > uint64(len(b)) {
+		return nil, nil, io.ErrUnexpectedEOF
+	}
+	b = b[k:]
+	versions := make([]provEntryVersion, nv)
+	for i := range versions {
+		v := &versions[i]
+		tag, k := binary.Uvarint(b)
+		if k <= 0 {
+			return nil, nil, io.ErrUnexpectedEOF
+		}
+		b = b[k:]
+		if tag&1 != 0 {
+			target, rest, err := sliceString(b)
+			if err != nil {
+				return nil, nil, err
+			}
+			v.target, v.text, b = string(target), true, rest
+		} else {
+			if len(b) < 4 {
+				return nil, nil, io.ErrUnexpectedEOF
+			}
+			v.hash, b = binary.BigEndian.Uint32(b), b[4:]
+		}
+		if tag>>1 > uint64(len(b)) {
+			return nil, nil, io.ErrUnexpectedEOF
+		}
+		v.srcs = make([]int, tag>>1)
+		for j := range v.srcs {
+			src, k := binary.Uvarint(b)
+			if k <= 0 {
+				return nil, nil, io.ErrUnexpectedEOF
+			}
+			if src >= uint64(n) {
+				return nil, nil, errors.New("release index out of range")
+			}
+			v.srcs[j], b = int(src), b[k:]
+		}
+		if !seen {
+			continue
+		}
+		first, k := binary.Uvarint(b)
+		if k <= 0 || first > math.MaxInt64 {
+			return nil, nil, io.ErrUnexpectedEOF
+		}
+		b = b[k:]
+		if first != 0 {
+			d, k := binary.Uvarint(b)
+			if k <= 0 || d > math.MaxInt64-first {
+				return nil, nil, io.ErrUnexpectedEOF
+			}
+			v.first, v.last, b = int64(first), int64(first+d), b[k:]
+		}
+	}
+	return versions, b, nil
+}
+
+// releaseTime returns the Unix time of a release, or 0 when its ID has
+// no time.
+func releaseTime(id string) int64 {
+	t, err := tinytown.ReleaseTime(id)
+	if err != nil || t.Unix() <= 0 {
+		return 0
+	}
+	return t.Unix()
+}
+
+// unixTime returns a time as a Unix time, or 0 when it is zero or
+// before 1970.
+func unixTime(t time.Time) int64 {
+	if t.IsZero() || t.Unix() <= 0 {
+		return 0
+	}
+	return t.Unix()
+}
+
+// Provenance returns the provenance log of the host of the index file,
+// or nil, when there is none.
+func (r *Reader) Provenance() *ProvenanceLog {
+	return r.prov
+}
+
+// Releases returns the IDs of the releases that archived a shortcode
+// with the given target, according to the provenance log of the host,
+// or nil, when there is none.
+func (r *Reader) Releases(shortcode, target string) ([]string, error) {
+	if r.prov == nil {
+		return nil, nil
+	}
+	return r.prov.Releases(shortcode, target)
+}
+
+// Origin returns the releases that archived a shortcode with the given
+// target and when it was seen, according to the provenance log of the
+// host, or the zero Origin, when there is none.
+func (r *Reader) Origin(shortcode, target string) (Origin, error) {
+	if r.prov == nil {
+		return Origin{}, nil
+	}
+	return r.prov.Origin(shortcode, target)
+}
+
+// LookupRecord finds the record of a shortcode, with the times that it
+// was first and last seen, when the host has a provenance log.
+func (r *Reader) LookupRecord(shortcode string) (Record, bool, error) {
+	target, ok, err := r.Lookup(shortcode)
+	if !ok || err != nil {
+		return Record{}, ok, err
+	}
+	o, err := r.Origin(shortcode, target)
+	if err != nil {
+		return Record{}, false, err
+	}
+	return Record{Shortcode: shortcode, Target: target, FirstSeen: o.FirstSeen, LastSeen: o.LastSeen}, true, nil
+}
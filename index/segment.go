@@ -0,0 +1,453 @@
+// Copyright (c) 2021 Andrew Archibald
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package index
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Updates to a host are written as segments beside its index file,
+// named host.NNNNNN.seg, where NNNNNN is a sequence number. A segment
+// has the same format as an index file, and its records supersede those
+// of the index file and of older segments with the same shortcodes.
+// Compaction merges the segments into the index file, so that lookups
+// do not slow as updates accumulate.
+
+// SegmentExt is the file extension of segments.
+const SegmentExt = ".seg"
+
+// SegmentFilename returns the name of a segment of a host in dir.
+func SegmentFilename(dir, host string, seq int) string {
+	return filepath.Join(dir, fmt.Sprintf("%s.%06d%s", host, seq, SegmentExt))
+}
+
+// parseSegment parses the sequence number of a segment filename.
+func parseSegment(name string) (int, bool) {
+	name = strings.TrimSuffix(name, SegmentExt)
+	i := strings.LastIndexByte(name, '.')
+	if i == -1 {
+		return 0, false
+	}
+	seq, err := strconv.Atoi(name[i+1:])
+	return seq, err == nil && seq >= 0
+}
+
+// segmentFile is a segment file in an index directory.
+type segmentFile struct {
+	seq  int
+	name string
+}
+
+// listSegments lists the segment files in dir in increasing sequence
+// order.
+func listSegments(dir string) ([]segmentFile, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var segs []segmentFile
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), SegmentExt) {
+			continue
+		}
+		if seq, ok := parseSegment(e.Name()); ok {
+			segs = append(segs, segmentFile{seq, filepath.Join(dir, e.Name())})
+		}
+	}
+	sort.Slice(segs, func(i, j int) bool { return segs[i].seq < segs[j].seq })
+	return segs, nil
+}
+
+// chain makes the readers of the segments of a host, in increasing
+// sequence order, supersede the first, which is the index file or the
+// oldest segment.
+func chain(readers []*Reader) *Reader {
+	base := readers[0]
+	for _, seg := range readers[1:] {
+		base.segments = append([]*Reader{seg}, base.segments...)
+		base.meta.Projects = appendMissing(base.meta.Projects, seg.meta.Projects)
+		base.meta.Releases = appendMissing(base.meta.Releases, seg.meta.Releases)
+		if base.meta.Alphabet == "" {
+			base.meta.Alphabet = seg.meta.Alphabet
+		}
+	}
+	sort.Strings(base.meta.Projects)
+	sort.Strings(base.meta.Releases)
+	return base
+}
+
+func appendMissing(dst, src []string) []string {
+	for _, s := range src {
+		found := false
+		for _, d := range dst {
+			if d == s {
+				found = true
+				break
+			}
+		}
+		if !found {
+			dst = append(dst, s)
+		}
+	}
+	return dst
+}
+
+// Segments returns the number of segments that supersede the index
+// file.
+func (r *Reader) Segments() int {
+	return len(r.segments)
+}
+
+// files returns the readers of the segments, newest first, then of the
+// index file.
+func (r *Reader) files() []*Reader {
+	return append(append([]*Reader(nil), r.segments...), r)
+}
+
+// rangeIter returns an iterator over the records of the file with
+// shortcodes in [start, end). An empty end is unbounded.
+func (r *Reader) rangeIter(start, end string) Iter {
+	i := sort.Search(len(r.blocks), func(i int) bool {
+		return r.blocks[i].first > start
+	}) - 1
+	if i < 0 {
+		i = 0
+	}
+	j := len(r.blocks)
+	if end != "" {
+		j = sort.Search(len(r.blocks), func(j int) bool {
+			return r.blocks[j].first >= end
+		})
+	}
+	return &boundedIter{it: r.iterBlocks(i, j), start: start, end: end}
+}
+
+// boundedIter bounds an iterator to shortcodes in [start, end).
+type boundedIter struct {
+	it         Iter
+	start, end string
+}
+
+func (b *boundedIter) Next() bool {
+	for b.it.Next() {
+		shortcode := b.it.Record().Shortcode
+		if shortcode < b.start {
+			continue
+		}
+		return b.end == "" || shortcode < b.end
+	}
+	return false
+}
+
+func (b *boundedIter) Record() Record { return b.it.Record() }
+func (b *boundedIter) Err() error     { return b.it.Err() }
+
+// chainIter iterates over the records of a chain of files with
+// shortcodes in [start, end), keeping the newest of each shortcode.
+func (r *Reader) chainIter(start, end string) Iter {
+	files := r.files()
+	its := make([]Iter, len(files))
+	for i, f := range files {
+		its[i] = f.rangeIter(start, end)
+	}
+	return MergeNewest(its...)
+}
+
+// MergeNewest merges iterators, which are in decreasing priority, into
+// one over every shortcode with the record of the first iterator that
+// has it. It is used to merge segments, newest first.
+func MergeNewest(its ...Iter) Iter {
+	return &newestIter{its: its, ok: make([]bool, len(its))}
+}
+
+type newestIter struct {
+	its     []Iter
+	ok      []bool // whether each iterator has a current record
+	started bool
+	rec     Record
+	err     error
+}
+
+func (m *newestIter) Next() bool {
+	if m.err != nil {
+		return false
+	}
+	if !m.started {
+		m.started = true
+		for i, it := range m.its {
+			m.ok[i] = m.advance(it)
+		}
+	} else {
+		// Advance every iterator past the shortcode yielded
+		for i, it := range m.its {
+			if m.ok[i] && it.Record().Shortcode == m.rec.Shortcode {
+				m.ok[i] = m.advance(it)
+			}
+		}
+	}
+	if m.err != nil {
+		return false
+	}
+	min := -1
+	for i, it := range m.its {
+		if m.ok[i] && (min == -1 || it.Record().Shortcode < m.its[min].Record().Shortcode) {
+			min = i
+		}
+	}
+	if min == -1 {
+		return false
+	}
+	m.rec = m.its[min].Record()
+	return true
+}
+
+func (m *newestIter) advance(it Iter) bool {
+	if it.Next() {
+		return true
+	}
+	if err := it.Err(); err != nil && m.err == nil {
+		m.err = err
+	}
+	return false
+}
+
+func (m *newestIter) Record() Record { return m.rec }
+func (m *newestIter) Err() error     { return m.err }
+
+// newRecordsIter skips the records of it that r already has with the
+// same target, which need not be written to a segment.
+type newRecordsIter struct {
+	it  Iter
+	r   *lastLookup
+	err error
+}
+
+// lastLookup memoizes the last lookup in a reader, which is made for
+// the same shortcode by the provenance log and newRecordsIter.
+type lastLookup struct {
+	r                 *Reader
+	shortcode, target string
+	ok, valid         bool
+}
+
+func (l *lastLookup) Lookup(shortcode string) (string, bool, error) {
+	if !l.valid || l.shortcode != shortcode {
+		target, ok, err := l.r.Lookup(shortcode)
+		if err != nil {
+			return "", false, err
+		}
+		l.shortcode, l.target, l.ok, l.valid = shortcode, target, ok, true
+	}
+	return l.target, l.ok, nil
+}
+
+// addRetargeted adds the versions of a shortcode to the provenance log
+// of an update, with the target that the index had, when the update
+// retargets it, so that every target that has been indexed is spelled
+// out in the log, though the first batch to index it hashes it.
+func addRetargeted(pw *provWriter, l *lastLookup, shortcode string, versions []provVersion) error {
+	target, ok, err := l.Lookup(shortcode)
+	if err != nil {
+		return err
+	}
+	if ok && target != versions[0].target {
+		for i := range versions {
+			if versions[i].target == target {
+				return pw.add(shortcode, versions)
+			}
+		}
+		versions = append(versions, provVersion{target: target, superseded: true})
+	}
+	return pw.add(shortcode, versions)
+}
+
+func (n *newRecordsIter) Next() bool {
+	for n.it.Next() {
+		rec := n.it.Record()
+		target, ok, err := n.r.Lookup(rec.Shortcode)
+		if err != nil {
+			n.err = err
+			return false
+		}
+		if !ok || target != rec.Target {
+			return true
+		}
+	}
+	return false
+}
+
+func (n *newRecordsIter) Record() Record { return n.it.Record() }
+
+func (n *newRecordsIter) Err() error {
+	if n.err != nil {
+		return n.err
+	}
+	return n.it.Err()
+}
+
+// hasRelease reports whether the index, if any, has a release for a
+// host.
+func (idx *Index) hasRelease(host, id string) bool {
+	if idx == nil {
+		return false
+	}
+	r := idx.Reader(host)
+	if r == nil {
+		return false
+	}
+	for _, r := range r.Meta().Releases {
+		if r == id {
+			return true
+		}
+	}
+	return false
+}
+
+// WriteSegment writes the records of each host as a new segment in dir,
+// superseding the records of earlier segments and index files there,
+// or as its index file, when the host is not yet in dir.
+func (b *Builder) WriteSegment(dir string) error {
+	if err := b.writeSegment(dir); err != nil {
+		b.abort()
+		return err
+	}
+	return b.Close()
+}
+
+func (b *Builder) writeSegment(dir string) error {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	segs, err := listSegments(dir)
+	if err != nil {
+		return err
+	}
+	seq := 0
+	for _, seg := range segs {
+		if seg.seq >= seq {
+			seq = seg.seq + 1
+		}
+	}
+	for _, host := range b.Hosts() {
+		filename := Filename(dir, host)
+		if _, err := os.Stat(filename); err == nil {
+			filename = SegmentFilename(dir, host, seq)
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+		// Written under a temporary name, so that a concurrent Open sees
+		// whole files
+		tmp := filename + ".tmp"
+		if err := b.writeHost(tmp, dir, host, true); err != nil {
+			os.Remove(tmp)
+			return err
+		}
+		if err := os.Rename(tmp, filename); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Compact merges the segments of a host into its index file and removes
+// them. Readers already open are unaffected; those opened after see the
+// compacted file.
+func Compact(dir, host string) error {
+	segs, err := listSegments(dir)
+	if err != nil {
+		return err
+	}
+	var files []string
+	for _, seg := range segs {
+		if segmentHost(seg.name) == host {
+			files = append(files, seg.name)
+		}
+	}
+	if len(files) == 0 {
+		return nil
+	}
+	if _, err := os.Stat(Filename(dir, host)); err == nil {
+		files = append([]string{Filename(dir, host)}, files...)
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	readers := make([]*Reader, 0, len(files))
+	defer func() {
+		for _, r := range readers {
+			r.segments = nil
+			r.Close()
+		}
+	}()
+	for _, filename := range files {
+		r, err := OpenReader(filename)
+		if err != nil {
+			return err
+		}
+		readers = append(readers, r)
+	}
+	if err := rewrite(chain(readers), Filename(dir, host)); err != nil {
+		return err
+	}
+	// A crash before the segments are removed leaves records that
+	// duplicate the compacted file, which are harmless
+	for _, filename := range files {
+		if filename != Filename(dir, host) {
+			if err := os.Remove(filename); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// CompactDir compacts every host in dir with at least minSegments
+// segments and returns the hosts compacted.
+func CompactDir(dir string, minSegments int) ([]string, error) {
+	return CompactDirContext(context.Background(), dir, minSegments)
+}
+
+// CompactDirContext is like CompactDir, but stops between hosts when
+// the context is done. Each host is compacted atomically, so none is
+// left partially compacted.
+func CompactDirContext(ctx context.Context, dir string, minSegments int) ([]string, error) {
+	segs, err := listSegments(dir)
+	if err != nil {
+		return nil, err
+	}
+	counts := make(map[string]int)
+	for _, seg := range segs {
+		counts[segmentHost(seg.name)]++
+	}
+	var hosts []string
+	for host, n := range counts {
+		if n >= minSegments {
+			hosts = append(hosts, host)
+		}
+	}
+	sort.Strings(hosts)
+	for i, host := range hosts {
+		if err := ctx.Err(); err != nil {
+			return hosts[:i], err
+		}
+		if err := Compact(dir, host); err != nil {
+			return hosts[:i], err
+		}
+	}
+	return hosts, nil
+}
+
+// segmentHost returns the host of a segment filename.
+func segmentHost(filename string) string {
+	name := strings.TrimSuffix(filepath.Base(filename), SegmentExt)
+	return name[:strings.LastIndexByte(name, '.')]
+}
@@ -0,0 +1,204 @@
+// Copyright (c) 2021 Andrew Archibald
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package index
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/andrewarchi/urlhero/extsort"
+)
+
+// The write-ahead log of a builder is a directory of sorted runs, one
+// per host for each batch of records spilled, and a log file, where each
+// line is a JSON-encoded walEntry that commits a batch. Runs are synced
+// before the line committing them is appended, so a torn final line
+// only loses its batch.
+
+const walLog = "wal.log"
+
+// Position is a position in the links of terroroftinytown releases.
+type Position struct {
+	Release string `json:"release"` // filename of the project release
+	Dump    string `json:"dump"`    // filename of the link dump in the release
+	Links   int64  `json:"links"`   // number of links of the dump processed
+}
+
+func (p Position) String() string {
+	return fmt.Sprintf("%s:%s:%d", p.Release, p.Dump, p.Links)
+}
+
+// walEntry is a batch committed to the write-ahead log.
+type walEntry struct {
+	Batch int               `json:"batch"`
+	Runs  map[string]string `json:"runs"` // key: host; run filename in the WAL directory
+	Meta  map[string]*Meta  `json:"meta"` // key: host; all hosts
+	// Releases are the sources of the records in runs, by host
+	Releases map[string][]string `json:"releases,omitempty"`
+	Timed    []string            `json:"timed,omitempty"` // hosts with records with times
+	Position Position            `json:"position"`
+}
+
+// commit syncs the runs of a batch and commits it to the write-ahead
+// log.
+func (b *Builder) commit(runs map[string]string) error {
+	for host := range runs {
+		if err := b.hosts[host].sorter.Sync(); err != nil {
+			return err
+		}
+	}
+	syncDir(b.WALDir)
+	if b.wal == nil {
+		f, err := os.OpenFile(filepath.Join(b.WALDir, walLog), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+		if err != nil {
+			return err
+		}
+		b.wal = f
+	}
+	b.batch++
+	e := walEntry{Batch: b.batch, Runs: runs, Meta: make(map[string]*Meta, len(b.hosts)), Position: b.pos}
+	for host, h := range b.hosts {
+		e.Meta[host] = b.Meta(host)
+		if len(h.releases) != 0 {
+			if e.Releases == nil {
+				e.Releases = make(map[string][]string)
+			}
+			e.Releases[host] = h.releases
+		}
+		if h.timed {
+			e.Timed = append(e.Timed, host)
+		}
+	}
+	sort.Strings(e.Timed)
+	line, err := json.Marshal(&e)
+	if err != nil {
+		return err
+	}
+	if _, err := b.wal.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	return b.wal.Sync()
+}
+
+// Recover restores the batches committed to the write-ahead log in
+// WALDir, by a builder that crashed or failed, and returns the position
+// in the input after the last batch. Links before it are then skipped by
+// ProcessFunc. It must be called before any records are added and
+// reports false when there is nothing to recover.
+func (b *Builder) Recover() (Position, bool, error) {
+	if b.WALDir == "" {
+		return Position{}, false, errors.New("index: recover without a WAL directory")
+	}
+	filename := filepath.Join(b.WALDir, walLog)
+	f, err := os.Open(filename)
+	if errors.Is(err, os.ErrNotExist) {
+		return Position{}, false, b.removeOrphans(nil)
+	} else if err != nil {
+		return Position{}, false, err
+	}
+	defer f.Close()
+	var entries []walEntry
+	var valid int64
+	br := bufio.NewReader(f)
+	for {
+		line, err := br.ReadBytes('\n')
+		if err == io.EOF {
+			break // a torn final line did not commit its batch
+		} else if err != nil {
+			return Position{}, false, err
+		}
+		var e walEntry
+		if err := json.Unmarshal(line, &e); err != nil {
+			return Position{}, false, fmt.Errorf("index: %s: batch %d: %w", filename, len(entries)+1, err)
+		}
+		entries = append(entries, e)
+		valid += int64(len(line))
+	}
+	if err := os.Truncate(filename, valid); err != nil {
+		return Position{}, false, err
+	}
+	referenced := make(map[string]bool)
+	for _, e := range entries {
+		for host, run := range e.Runs {
+			h := b.host(host)
+			if h.sorter == nil {
+				h.sorter = extsort.NewSorter(lessRecord, b.WALDir, 0)
+			}
+			if err := h.sorter.AddRun(filepath.Join(b.WALDir, run)); err != nil {
+				return Position{}, false, err
+			}
+			referenced[run] = true
+		}
+	}
+	if err := b.removeOrphans(referenced); err != nil {
+		return Position{}, false, err
+	}
+	if len(entries) == 0 {
+		return Position{}, false, nil
+	}
+	last := entries[len(entries)-1]
+	for host, m := range last.Meta {
+		b.host(host).meta = *m
+	}
+	for host, releases := range last.Releases {
+		h := b.host(host)
+		for _, id := range releases {
+			h.source(id)
+		}
+	}
+	for _, host := range last.Timed {
+		b.host(host).timed = true
+	}
+	b.batch = last.Batch
+	b.resume = &last.Position
+	return last.Position, true, nil
+}
+
+// removeOrphans removes runs that were spilled, but not committed.
+func (b *Builder) removeOrphans(referenced map[string]bool) error {
+	runs, err := filepath.Glob(filepath.Join(b.WALDir, "extsort-*.run"))
+	if err != nil {
+		return err
+	}
+	for _, run := range runs {
+		if !referenced[filepath.Base(run)] {
+			if err := os.Remove(run); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// removeWAL removes the write-ahead log, once its records are written.
+func (b *Builder) removeWAL() error {
+	if b.wal != nil {
+		b.wal.Close()
+		b.wal = nil
+	}
+	if err := os.Remove(filepath.Join(b.WALDir, walLog)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	// Only removed when empty
+	os.Remove(b.WALDir)
+	return nil
+}
+
+// syncDir commits the entries of a directory to stable storage, where
+// supported, so that new files are not lost.
+func syncDir(dir string) {
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+}
@@ -0,0 +1,113 @@
+// Copyright (c) 2021 Andrew Archibald
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package intern deduplicates repeated strings, so that structures
+// aggregating billions of records hold one copy of each.
+package intern
+
+import (
+	"hash/maphash"
+	"strings"
+	"sync"
+)
+
+// Table interns every string given to it, for sets of low cardinality,
+// such as hosts, scheme prefixes, and shortener names. It is safe for
+// concurrent use.
+type Table struct {
+	mu      sync.Mutex
+	strings map[string]string
+	size    int
+}
+
+// NewTable constructs an empty table.
+func NewTable() *Table {
+	return &Table{strings: make(map[string]string)}
+}
+
+// String returns the interned copy of s. The first time a string is
+// seen, it is copied, so that it does not retain the memory of a larger
+// string that it is a substring of.
+func (t *Table) String(s string) string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if interned, ok := t.strings[s]; ok {
+		return interned
+	}
+	s = Clone(s)
+	t.strings[s] = s
+	t.size += len(s)
+	return s
+}
+
+// Bytes returns the interned copy of b, without allocating when it has
+// been seen.
+func (t *Table) Bytes(b []byte) string {
+	t.mu.Lock()
+	if interned, ok := t.strings[string(b)]; ok {
+		t.mu.Unlock()
+		return interned
+	}
+	t.mu.Unlock()
+	return t.String(string(b))
+}
+
+// Len returns the number of strings interned.
+func (t *Table) Len() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.strings)
+}
+
+// Size returns the number of bytes of strings interned.
+func (t *Table) Size() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.size
+}
+
+// Cache interns recently seen strings in a fixed number of slots, for
+// sets of high cardinality with hot repeats, such as redirect targets,
+// where interning every string would retain each unique one. A string
+// evicts the previous occupant of its slot. It is safe for concurrent
+// use.
+type Cache struct {
+	mu    sync.Mutex
+	seed  maphash.Seed
+	slots []string
+}
+
+// NewCache constructs a cache with the given number of slots.
+func NewCache(slots int) *Cache {
+	if slots < 1 {
+		slots = 1
+	}
+	return &Cache{seed: maphash.MakeSeed(), slots: make([]string, slots)}
+}
+
+// String returns the cached copy of s and true, when s is in the cache.
+// Otherwise, it caches s and returns it and false. Unlike Table, s is
+// not copied.
+func (c *Cache) String(s string) (string, bool) {
+	var h maphash.Hash
+	h.SetSeed(c.seed)
+	h.WriteString(s)
+	i := h.Sum64() % uint64(len(c.slots))
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if cached := c.slots[i]; cached == s {
+		return cached, true
+	}
+	c.slots[i] = s
+	return s, false
+}
+
+// Clone returns a copy of s that does not share its memory.
+func Clone(s string) string {
+	var b strings.Builder
+	b.WriteString(s)
+	return b.String()
+}
@@ -0,0 +1,46 @@
+// Copyright (c) 2021 Andrew Archibald
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package intern
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestTable(t *testing.T) {
+	tab := NewTable()
+	line := "http://example.com/a|http://example.org"
+	a := tab.String(line[:len("http://")])
+	b := tab.Bytes([]byte("http://"))
+	if a != "http://" || b != a {
+		t.Errorf("got %q and %q, want %q", a, b, "http://")
+	}
+	tab.String("https://")
+	if tab.Len() != 2 || tab.Size() != len("http://https://") {
+		t.Errorf("got %d strings of %d bytes", tab.Len(), tab.Size())
+	}
+	if allocs := testing.AllocsPerRun(100, func() { tab.Bytes([]byte("https://")) }); allocs != 0 {
+		t.Errorf("Bytes of interned string: got %v allocs, want 0", allocs)
+	}
+}
+
+func TestCache(t *testing.T) {
+	c := NewCache(16)
+	if s, hit := c.String("http://example.org"); hit || s != "http://example.org" {
+		t.Errorf("first String = %q, %t, want miss", s, hit)
+	}
+	if s, hit := c.String("http://example.org"); !hit || s != "http://example.org" {
+		t.Errorf("second String = %q, %t, want hit", s, hit)
+	}
+	// Every slot is eventually evicted
+	for i := 0; i < 1000; i++ {
+		c.String(fmt.Sprint(i))
+	}
+	if _, hit := c.String("http://example.org"); hit {
+		t.Error("cached string not evicted")
+	}
+}
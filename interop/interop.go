@@ -0,0 +1,128 @@
+// Copyright (c) 2021 Andrew Archibald
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package interop defines small interfaces for the sources, stores, and
+// resolvers of shortcodes, so that the indexes and shortener registry
+// of this module and the link resolver of URLHero can be plugged into
+// each other. The interfaces depend only on the standard library, so
+// implementations need not import index or shorteners, and neither
+// imports this package, so there are no import cycles.
+package interop
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/andrewarchi/urlhero/index"
+	"github.com/andrewarchi/urlhero/shorteners"
+)
+
+// ShortcodeSource enumerates the known shortcodes of a shortener.
+type ShortcodeSource interface {
+	// Shortcodes calls fn with each shortcode of the shortener with the
+	// given host. Iteration stops early when fn returns an error.
+	Shortcodes(host string, fn func(shortcode string) error) error
+}
+
+// MappingStore looks up the targets of shortcodes. *index.Index is a
+// MappingStore.
+type MappingStore interface {
+	Lookup(host, shortcode string) (target string, ok bool, err error)
+}
+
+// Resolver resolves short URLs to their targets.
+type Resolver interface {
+	Resolve(shortURL string) (target string, ok bool, err error)
+}
+
+var _ MappingStore = (*index.Index)(nil)
+
+// ErrUnknownHost is returned by sources for hosts that they do not
+// have.
+var ErrUnknownHost = errors.New("interop: unknown host")
+
+// IndexSource is a source of the shortcodes of the hosts of an index,
+// in shortcode order.
+type IndexSource struct {
+	Index *index.Index
+}
+
+// Shortcodes calls fn with each shortcode of a host in the index.
+func (s IndexSource) Shortcodes(host string, fn func(shortcode string) error) error {
+	r := s.Index.Reader(host)
+	if r == nil {
+		return fmt.Errorf("%w: %s", ErrUnknownHost, host)
+	}
+	return r.Iterate(func(rec index.Record) error {
+		return fn(rec.Shortcode)
+	})
+}
+
+// IASource is a source of the shortcodes of registered shorteners that
+// have been archived on the Internet Archive, in the order of the
+// shortener.
+type IASource struct {
+	Options *shorteners.IAOptions
+}
+
+// Shortcodes calls fn with each shortcode of a registered shortener,
+// by its host or name, that has been archived.
+func (s IASource) Shortcodes(host string, fn func(shortcode string) error) error {
+	sh, ok := shorteners.Lookup[host]
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrUnknownHost, host)
+	}
+	shortcodes, err := sh.GetIAShortcodesOptions(s.Options)
+	if err != nil {
+		return err
+	}
+	for _, shortcode := range shortcodes {
+		if err := fn(shortcode); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// storeResolver resolves short URLs with the targets of a store.
+type storeResolver struct {
+	store MappingStore
+}
+
+// NewResolver returns a resolver of short URLs, which are parsed by
+// the rules of the shortener registry, to the targets in a store.
+func NewResolver(store MappingStore) Resolver {
+	return storeResolver{store}
+}
+
+// Resolve finds the target of a short URL. URLs without shortcodes are
+// not found.
+func (r storeResolver) Resolve(shortURL string) (string, bool, error) {
+	host, shortcode, err := shorteners.ParseShortURL(shortURL)
+	if err != nil || shortcode == "" {
+		return "", false, err
+	}
+	return r.store.Lookup(host, shortcode)
+}
+
+// Import adds the mappings of the shortcodes of a host in src, which
+// are looked up in store, to an index builder, and returns the number
+// that were found.
+func Import(b *index.Builder, host string, src ShortcodeSource, store MappingStore) (int, error) {
+	n := 0
+	err := src.Shortcodes(host, func(shortcode string) error {
+		target, ok, err := store.Lookup(host, shortcode)
+		if err != nil || !ok {
+			return err
+		}
+		if err := b.Add(host, index.Record{Shortcode: shortcode, Target: target}); err != nil {
+			return err
+		}
+		n++
+		return nil
+	})
+	return n, err
+}
@@ -0,0 +1,96 @@
+// Copyright (c) 2021 Andrew Archibald
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package interop
+
+import (
+	"errors"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/andrewarchi/urlhero/index"
+)
+
+// mapStore is a MappingStore of another project.
+type mapStore map[string]string
+
+func (m mapStore) Lookup(host, shortcode string) (string, bool, error) {
+	target, ok := m[host+"/"+shortcode]
+	return target, ok, nil
+}
+
+// sliceSource is a ShortcodeSource of another project.
+type sliceSource []string
+
+func (s sliceSource) Shortcodes(host string, fn func(shortcode string) error) error {
+	for _, shortcode := range s {
+		if err := fn(shortcode); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestInterop(t *testing.T) {
+	store := mapStore{
+		"rb.gy/abc": "http://example.com/abc",
+		"rb.gy/xyz": "http://example.com/xyz",
+	}
+	b := index.NewBuilder()
+	n, err := Import(b, "rb.gy", sliceSource{"abc", "missing", "xyz"}, store)
+	if err != nil || n != 2 {
+		t.Fatalf("Import = %d, %v, want 2", n, err)
+	}
+
+	// Mappings that fail to be added are not counted
+	failing := index.NewBuilder()
+	failing.MemLimit, failing.TempDir = 1, filepath.Join(t.TempDir(), "missing")
+	if n, err := Import(failing, "rb.gy", sliceSource{"abc", "xyz"}, store); err == nil || n != 0 {
+		t.Errorf("Import with failing Add = %d, %v, want 0 and an error", n, err)
+	}
+
+	dir := filepath.Join(t.TempDir(), "index")
+	if err := b.Write(dir); err != nil {
+		t.Fatal(err)
+	}
+	idx, err := index.Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idx.Close()
+
+	res := NewResolver(idx)
+	for _, tt := range []struct {
+		shortURL, target string
+		ok               bool
+	}{
+		{"https://rb.gy/abc", "http://example.com/abc", true},
+		{"http://rb.gy/xyz+", "http://example.com/xyz", true}, // preview
+		{"https://rb.gy/missing", "", false},
+		{"https://rb.gy/", "", false},
+	} {
+		target, ok, err := res.Resolve(tt.shortURL)
+		if err != nil || ok != tt.ok || target != tt.target {
+			t.Errorf("Resolve(%q) = %q, %t, %v, want %q, %t", tt.shortURL, target, ok, err, tt.target, tt.ok)
+		}
+	}
+
+	var got []string
+	if err := (IndexSource{idx}).Shortcodes("rb.gy", func(shortcode string) error {
+		got = append(got, shortcode)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"abc", "xyz"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got shortcodes %q, want %q", got, want)
+	}
+	err = (IndexSource{idx}).Shortcodes("example.com", func(string) error { return nil })
+	if !errors.Is(err, ErrUnknownHost) {
+		t.Errorf("Shortcodes of unknown host: got error %v", err)
+	}
+}
@@ -0,0 +1,149 @@
+// Copyright (c) 2021 Andrew Archibald
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package logger provides the leveled, structured logger used by the
+// long-running operations in urlhero packages.
+package logger
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Level is the severity of a log message.
+type Level int8
+
+const (
+	LevelDebug Level = iota - 1
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+func (l Level) String() string {
+	switch l {
+	case LevelDebug:
+		return "debug"
+	case LevelInfo:
+		return "info"
+	case LevelWarn:
+		return "warn"
+	case LevelError:
+		return "error"
+	}
+	return "level" + strconv.Itoa(int(l))
+}
+
+// Logger logs a message with alternating key-value pairs of attributes.
+type Logger interface {
+	Log(level Level, msg string, kv ...interface{})
+}
+
+// Default is the logger used by urlhero packages. It can be replaced to
+// redirect or silence logs.
+var Default Logger = NewText(os.Stderr, LevelInfo)
+
+// Debug, Info, Warn, and Error log to Default at their level.
+func Debug(msg string, kv ...interface{}) { Default.Log(LevelDebug, msg, kv...) }
+func Info(msg string, kv ...interface{})  { Default.Log(LevelInfo, msg, kv...) }
+func Warn(msg string, kv ...interface{})  { Default.Log(LevelWarn, msg, kv...) }
+func Error(msg string, kv ...interface{}) { Default.Log(LevelError, msg, kv...) }
+
+type writerLogger struct {
+	mu    sync.Mutex
+	w     io.Writer
+	level Level
+	json  bool
+	buf   bytes.Buffer
+}
+
+// NewText constructs a logger that writes messages at or above level as
+// lines of the form "level msg key=value ...".
+func NewText(w io.Writer, level Level) Logger {
+	return &writerLogger{w: w, level: level}
+}
+
+// NewJSON constructs a logger that writes messages at or above level as
+// JSON objects, one per line.
+func NewJSON(w io.Writer, level Level) Logger {
+	return &writerLogger{w: w, level: level, json: true}
+}
+
+func (l *writerLogger) Log(level Level, msg string, kv ...interface{}) {
+	if level < l.level {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.buf.Reset()
+	if l.json {
+		l.buf.WriteString(`{"time":`)
+		writeJSON(&l.buf, time.Now().UTC().Format(time.RFC3339Nano))
+		l.buf.WriteString(`,"level":`)
+		writeJSON(&l.buf, level.String())
+		l.buf.WriteString(`,"msg":`)
+		writeJSON(&l.buf, msg)
+		for i := 0; i < len(kv); i += 2 {
+			l.buf.WriteByte(',')
+			writeJSON(&l.buf, key(kv, i))
+			l.buf.WriteByte(':')
+			writeJSON(&l.buf, value(kv, i))
+		}
+		l.buf.WriteString("}\n")
+	} else {
+		l.buf.WriteString(level.String())
+		l.buf.WriteByte(' ')
+		l.buf.WriteString(msg)
+		for i := 0; i < len(kv); i += 2 {
+			fmt.Fprintf(&l.buf, " %s=", key(kv, i))
+			s := fmt.Sprint(value(kv, i))
+			if s == "" || bytes.ContainsAny([]byte(s), " \t\n\"=") {
+				s = strconv.Quote(s)
+			}
+			l.buf.WriteString(s)
+		}
+		l.buf.WriteByte('\n')
+	}
+	l.w.Write(l.buf.Bytes())
+}
+
+func key(kv []interface{}, i int) string {
+	if s, ok := kv[i].(string); ok {
+		return s
+	}
+	return fmt.Sprint(kv[i])
+}
+
+func value(kv []interface{}, i int) interface{} {
+	if i+1 >= len(kv) {
+		return "(missing)"
+	}
+	if err, ok := kv[i+1].(error); ok {
+		return err.Error()
+	}
+	return kv[i+1]
+}
+
+func writeJSON(buf *bytes.Buffer, v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		b, _ = json.Marshal(fmt.Sprint(v))
+	}
+	buf.Write(b)
+}
+
+// Discard is a logger that discards all messages.
+var Discard Logger = discard{}
+
+type discard struct{}
+
+func (discard) Log(Level, string, ...interface{}) {}
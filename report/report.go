@@ -0,0 +1,266 @@
+// Copyright (c) 2021 Andrew Archibald
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package report collects the outcomes of the items of batch
+// operations, such as the releases of a download or the projects of a
+// processing run, so that a run with some failures reports which failed
+// and why, instead of stopping at the first error.
+package report
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Classes of failures. Errors choose their class by implementing
+// ErrorClass.
+const (
+	ClassFailure      = "failure" // unclassified
+	ClassInput        = "input"   // malformed or missing input data
+	ClassNetwork      = "network"
+	ClassVerification = "verification" // checksum or integrity failure
+	ClassTruncated    = "truncated"    // input that ends early
+	ClassCanceled     = "canceled"
+)
+
+// ErrorClass is implemented by errors that know their class.
+type ErrorClass interface {
+	ErrorClass() string
+}
+
+// Classify returns the class of an error.
+func Classify(err error) string {
+	var ec ErrorClass
+	var netErr net.Error
+	switch {
+	case errors.As(err, &ec):
+		return ec.ErrorClass()
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return ClassCanceled
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		return ClassTruncated
+	case errors.Is(err, fs.ErrNotExist), errors.Is(err, fs.ErrPermission):
+		return ClassInput
+	case errors.As(err, &netErr):
+		return ClassNetwork
+	}
+	return ClassFailure
+}
+
+// DefaultExamples is the number of example items kept for each class
+// of failure and for the skipped items.
+const DefaultExamples = 5
+
+// Report collects the outcomes of the items of an operation. It is safe
+// for concurrent use.
+type Report struct {
+	mu        sync.Mutex
+	op        string
+	started   time.Time
+	finished  time.Time
+	succeeded int64
+	skipped   int64
+	failed    int64
+	classes   map[string]*Class
+	skips     []Item
+	first     error
+
+	// Examples is the number of example items kept, by default
+	// DefaultExamples.
+	Examples int
+	// Classify classifies failures, by default with Classify.
+	Classify func(error) string
+	// OnFail, when not nil, is called with each failure as it is
+	// recorded, such as to log it.
+	OnFail func(item string, err error)
+}
+
+// Summary is a snapshot of a report, as it is serialized to JSON.
+type Summary struct {
+	Operation string    `json:"operation"`
+	Started   time.Time `json:"started"`
+	Seconds   float64   `json:"seconds"` // until finished or the snapshot
+	Succeeded int64     `json:"succeeded"`
+	Failed    int64     `json:"failed"`
+	Skipped   int64     `json:"skipped"`
+	// Classes are the failures by class, in decreasing count.
+	Classes []Class `json:"classes,omitempty"`
+	// Skips are examples of the skipped items.
+	Skips []Item `json:"skips,omitempty"`
+}
+
+// Class is the failures of a class.
+type Class struct {
+	Class    string `json:"class"`
+	Count    int64  `json:"count"`
+	Examples []Item `json:"examples"`
+}
+
+// Item is an item that failed or was skipped.
+type Item struct {
+	Item   string `json:"item"`
+	Reason string `json:"reason"` // the error or why it was skipped
+}
+
+// New starts a report of an operation, such as "download".
+func New(operation string) *Report {
+	return &Report{op: operation, started: time.Now(), classes: make(map[string]*Class)}
+}
+
+// Succeed records that n items succeeded.
+func (r *Report) Succeed(n int64) {
+	r.mu.Lock()
+	r.succeeded += n
+	r.mu.Unlock()
+}
+
+// Fail records that an item failed with an error.
+func (r *Report) Fail(item string, err error) {
+	classify := r.Classify
+	if classify == nil {
+		classify = Classify
+	}
+	class := classify(err)
+	if r.OnFail != nil {
+		r.OnFail(item, err)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.failed++
+	if r.first == nil {
+		r.first = err
+	}
+	c, ok := r.classes[class]
+	if !ok {
+		c = &Class{Class: class}
+		r.classes[class] = c
+	}
+	c.Count++
+	if len(c.Examples) < r.examples() {
+		c.Examples = append(c.Examples, Item{item, err.Error()})
+	}
+}
+
+// Skip records that an item was skipped, for a reason.
+func (r *Report) Skip(item, reason string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.skipped++
+	if len(r.skips) < r.examples() {
+		r.skips = append(r.skips, Item{item, reason})
+	}
+}
+
+func (r *Report) examples() int {
+	if r.Examples > 0 {
+		return r.Examples
+	}
+	return DefaultExamples
+}
+
+// Finish records that the operation finished, which stops the clock of
+// its duration.
+func (r *Report) Finish() {
+	r.mu.Lock()
+	if r.finished.IsZero() {
+		r.finished = time.Now()
+	}
+	r.mu.Unlock()
+}
+
+// Failed returns the number of items that failed.
+func (r *Report) Failed() int64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.failed
+}
+
+// Summary returns a snapshot of the report.
+func (r *Report) Summary() Summary {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	end := r.finished
+	if end.IsZero() {
+		end = time.Now()
+	}
+	s := Summary{
+		Operation: r.op,
+		Started:   r.started.UTC(),
+		Seconds:   end.Sub(r.started).Seconds(),
+		Succeeded: r.succeeded,
+		Failed:    r.failed,
+		Skipped:   r.skipped,
+		Skips:     append([]Item(nil), r.skips...),
+	}
+	for _, c := range r.classes {
+		c := *c
+		c.Examples = append([]Item(nil), c.Examples...)
+		s.Classes = append(s.Classes, c)
+	}
+	sort.Slice(s.Classes, func(i, j int) bool {
+		if s.Classes[i].Count != s.Classes[j].Count {
+			return s.Classes[i].Count > s.Classes[j].Count
+		}
+		return s.Classes[i].Class < s.Classes[j].Class
+	})
+	return s
+}
+
+// MarshalJSON encodes the summary of the report.
+func (r *Report) MarshalJSON() ([]byte, error) {
+	return json.Marshal(r.Summary())
+}
+
+// Err returns an *Error, when any items failed, or nil.
+func (r *Report) Err() error {
+	s := r.Summary()
+	if s.Failed == 0 {
+		return nil
+	}
+	r.mu.Lock()
+	first := r.first
+	r.mu.Unlock()
+	return &Error{Summary: s, first: first}
+}
+
+// Error is returned for operations in which some items failed. It
+// unwraps to the first failure.
+type Error struct {
+	Summary Summary
+	first   error
+}
+
+func (err *Error) Error() string {
+	s := &err.Summary
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s: %d of %d items failed", s.Operation, s.Failed, s.Succeeded+s.Failed+s.Skipped)
+	for i, c := range s.Classes {
+		if i == 0 {
+			b.WriteString(" (")
+		} else {
+			b.WriteString(", ")
+		}
+		fmt.Fprintf(&b, "%s: %d", c.Class, c.Count)
+	}
+	if len(s.Classes) != 0 {
+		b.WriteByte(')')
+	}
+	if err.first != nil {
+		fmt.Fprintf(&b, "; first: %v", err.first)
+	}
+	return b.String()
+}
+
+func (err *Error) Unwrap() error { return err.first }
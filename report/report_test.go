@@ -0,0 +1,97 @@
+// Copyright (c) 2021 Andrew Archibald
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package report
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"testing"
+)
+
+type classError struct{}
+
+func (classError) Error() string      { return "checksum mismatch" }
+func (classError) ErrorClass() string { return ClassVerification }
+
+func TestClassify(t *testing.T) {
+	tests := []struct {
+		err   error
+		class string
+	}{
+		{errors.New("oops"), ClassFailure},
+		{fmt.Errorf("wrapped: %w", classError{}), ClassVerification},
+		{context.Canceled, ClassCanceled},
+		{fmt.Errorf("read: %w", io.ErrUnexpectedEOF), ClassTruncated},
+		{&os.PathError{Op: "open", Path: "x", Err: os.ErrNotExist}, ClassInput},
+	}
+	for _, tt := range tests {
+		if class := Classify(tt.err); class != tt.class {
+			t.Errorf("Classify(%v) = %q, want %q", tt.err, class, tt.class)
+		}
+	}
+}
+
+func TestReport(t *testing.T) {
+	r := New("download")
+	r.Examples = 1
+	r.Succeed(3)
+	if err := r.Err(); err != nil {
+		t.Fatalf("Err without failures: %v", err)
+	}
+	first := fmt.Errorf("read: %w", io.ErrUnexpectedEOF)
+	r.Fail("a", first)
+	r.Fail("b", classError{})
+	r.Fail("c", classError{})
+	r.Skip("d", "not found")
+	r.Skip("e", "not found")
+	r.Finish()
+
+	s := r.Summary()
+	want := Summary{
+		Operation: "download",
+		Started:   s.Started,
+		Seconds:   s.Seconds,
+		Succeeded: 3,
+		Failed:    3,
+		Skipped:   2,
+		Classes: []Class{
+			{ClassVerification, 2, []Item{{"b", "checksum mismatch"}}},
+			{ClassTruncated, 1, []Item{{"a", "read: unexpected EOF"}}},
+		},
+		Skips: []Item{{"d", "not found"}},
+	}
+	if !reflect.DeepEqual(s, want) {
+		t.Errorf("Summary:\ngot  %+v\nwant %+v", s, want)
+	}
+
+	err := r.Err()
+	var rerr *Error
+	if !errors.As(err, &rerr) || !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("Err: got %v, want *Error that unwraps to the first failure", err)
+	}
+	const msg = "download: 3 of 8 items failed (verification: 2, truncated: 1); first: read: unexpected EOF"
+	if err.Error() != msg {
+		t.Errorf("Err: got message %q, want %q", err.Error(), msg)
+	}
+
+	b, err := json.Marshal(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got Summary
+	if err := json.Unmarshal(b, &got); err != nil {
+		t.Fatal(err)
+	}
+	if got.Failed != 3 || len(got.Classes) != 2 || got.Classes[0].Class != ClassVerification {
+		t.Errorf("MarshalJSON: got %s", b)
+	}
+}
@@ -0,0 +1,144 @@
+// Copyright (c) 2021 Andrew Archibald
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package sample draws uniform random samples of mappings from streams
+// of unknown length, such as the releases of a corpus as they are
+// processed or the records of an index, for spot checks and for test
+// corpora of new shortener rules.
+package sample
+
+import (
+	"math/rand"
+	"path/filepath"
+	"sort"
+
+	"github.com/andrewarchi/urlhero/beacon"
+	"github.com/andrewarchi/urlhero/index"
+	"github.com/andrewarchi/urlhero/tinytown"
+)
+
+// Mapping is a sampled mapping of a shortcode.
+type Mapping struct {
+	Host      string `json:"host"`
+	Shortcode string `json:"shortcode"`
+	Target    string `json:"target"`
+	Release   string `json:"release,omitempty"` // when sampled from releases
+}
+
+// Sampler keeps a uniform random sample of the mappings added to it,
+// of all hosts or of each host, with Algorithm R, so every mapping
+// added is equally likely to be in the sample, in memory proportional
+// to the size of the sample. It is not safe for concurrent use.
+type Sampler struct {
+	size       int
+	perHost    bool
+	r          *rand.Rand
+	reservoirs map[string]*reservoir
+	seen       int64
+}
+
+// reservoir is a uniform random sample of a stream of unknown length.
+type reservoir struct {
+	seen  int64
+	items []Mapping
+}
+
+// New constructs a sampler of size mappings in total or, when perHost
+// is set, of each host, which is seeded with seed, so that samples are
+// reproducible.
+func New(size int, perHost bool, seed int64) *Sampler {
+	return &Sampler{
+		size:       size,
+		perHost:    perHost,
+		r:          rand.New(rand.NewSource(seed)),
+		reservoirs: make(map[string]*reservoir),
+	}
+}
+
+// Add adds a mapping to the stream.
+func (s *Sampler) Add(m Mapping) {
+	s.seen++
+	key := ""
+	if s.perHost {
+		key = m.Host
+	}
+	res, ok := s.reservoirs[key]
+	if !ok {
+		res = &reservoir{}
+		s.reservoirs[key] = res
+	}
+	res.seen++
+	if len(res.items) < s.size {
+		res.items = append(res.items, m)
+		return
+	}
+	if i := s.r.Int63n(res.seen); i < int64(s.size) {
+		res.items[i] = m
+	}
+}
+
+// Seen returns the number of mappings added.
+func (s *Sampler) Seen() int64 {
+	return s.seen
+}
+
+// Sample returns the sampled mappings, ordered by host, shortcode, then
+// target, as shortcodes are repeated across releases.
+func (s *Sampler) Sample() []Mapping {
+	var sample []Mapping
+	for _, res := range s.reservoirs {
+		sample = append(sample, res.items...)
+	}
+	sort.Slice(sample, func(i, j int) bool {
+		if sample[i].Host != sample[j].Host {
+			return sample[i].Host < sample[j].Host
+		}
+		if sample[i].Shortcode != sample[j].Shortcode {
+			return sample[i].Shortcode < sample[j].Shortcode
+		}
+		return sample[i].Target < sample[j].Target
+	})
+	return sample
+}
+
+// ProcessFunc returns a function for tinytown.ProcessReleases, which
+// adds the links of the releases processed with it to the sample.
+func (s *Sampler) ProcessFunc() tinytown.ProcessFunc {
+	// The meta of a project is shared by its links
+	type project struct{ host, release string }
+	projects := make(map[*tinytown.Meta]project)
+	return func(l *beacon.Link, m *tinytown.Meta, shortcodeLen int, releaseFilename, dumpFilename string) error {
+		p, ok := projects[m]
+		if !ok {
+			p = project{index.TemplateHost(m.URLTemplate), filepath.Base(filepath.Dir(releaseFilename))}
+			projects[m] = p
+		}
+		s.Add(Mapping{p.host, l.Source, l.Target, p.release})
+		return nil
+	}
+}
+
+// AddIndex adds the records of the given hosts of an index or, when
+// none are given, of every host.
+func (s *Sampler) AddIndex(idx *index.Index, hosts ...string) error {
+	if len(hosts) == 0 {
+		hosts = idx.Hosts()
+	}
+	for _, h := range hosts {
+		r := idx.Reader(h)
+		if r == nil {
+			continue
+		}
+		err := r.Iterate(func(rec index.Record) error {
+			s.Add(Mapping{Host: h, Shortcode: rec.Shortcode, Target: rec.Target})
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+// Copyright (c) 2021 Andrew Archibald
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package sample
+
+import (
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+
+	"github.com/andrewarchi/urlhero/index"
+)
+
+func addN(s *Sampler, host string, n int) {
+	for i := 0; i < n; i++ {
+		s.Add(Mapping{Host: host, Shortcode: fmt.Sprintf("%04d", i), Target: fmt.Sprintf("http://example.com/%d", i)})
+	}
+}
+
+func TestSampler(t *testing.T) {
+	for _, tt := range []struct {
+		size    int
+		perHost bool
+		want    map[string]int // sampled per host
+	}{
+		{10, false, nil},
+		{10, true, map[string]int{"a.example": 10, "b.example": 5}},
+		{100, false, map[string]int{"a.example": 50, "b.example": 5}},
+	} {
+		s := New(tt.size, tt.perHost, 1)
+		addN(s, "a.example", 50)
+		addN(s, "b.example", 5)
+		sample := s.Sample()
+		if s.Seen() != 55 {
+			t.Errorf("Seen() = %d, want 55", s.Seen())
+		}
+		counts := make(map[string]int)
+		for i, m := range sample {
+			counts[m.Host]++
+			if i != 0 && (m.Host < sample[i-1].Host || m.Host == sample[i-1].Host && m.Shortcode <= sample[i-1].Shortcode) {
+				t.Errorf("sample not sorted at %d: %v", i, sample)
+			}
+		}
+		if tt.want == nil {
+			if len(sample) != tt.size {
+				t.Errorf("sampled %d, want %d", len(sample), tt.size)
+			}
+		} else if !reflect.DeepEqual(counts, tt.want) {
+			t.Errorf("sampled %v, want %v", counts, tt.want)
+		}
+
+		// Samples are reproducible by seed
+		s2 := New(tt.size, tt.perHost, 1)
+		addN(s2, "a.example", 50)
+		addN(s2, "b.example", 5)
+		if !reflect.DeepEqual(s2.Sample(), sample) {
+			t.Error("samples of the same seed differ")
+		}
+	}
+}
+
+func TestUniform(t *testing.T) {
+	const n, trials = 10, 20000
+	var counts [n]int
+	for trial := 0; trial < trials; trial++ {
+		s := New(1, false, int64(trial))
+		addN(s, "example.com", n)
+		i, err := strconv.Atoi(s.Sample()[0].Shortcode)
+		if err != nil {
+			t.Fatal(err)
+		}
+		counts[i]++
+	}
+	// Each is expected trials/n = 2000 times, with a standard
+	// deviation of about 42
+	for i, c := range counts {
+		if c < 1800 || c > 2200 {
+			t.Errorf("mapping %d sampled %d times of %d", i, c, trials)
+		}
+	}
+}
+
+func TestAddIndex(t *testing.T) {
+	b := index.NewBuilder()
+	for i := 0; i < 20; i++ {
+		b.Add("example.com", index.Record{Shortcode: fmt.Sprintf("%02d", i), Target: "http://example.org/"})
+	}
+	dir := filepath.Join(t.TempDir(), "index")
+	if err := b.Write(dir); err != nil {
+		t.Fatal(err)
+	}
+	idx, err := index.Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idx.Close()
+	s := New(5, true, 1)
+	if err := s.AddIndex(idx); err != nil {
+		t.Fatal(err)
+	}
+	if s.Seen() != 20 || len(s.Sample()) != 5 {
+		t.Errorf("sampled %d of %d, want 5 of 20", len(s.Sample()), s.Seen())
+	}
+}
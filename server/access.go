@@ -0,0 +1,301 @@
+// Copyright (c) 2021 Andrew Archibald
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io"
+	mrand "math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// RequestIDHeader is the header that propagates request IDs. A valid ID
+// from the client or a proxy is kept; otherwise, one is generated. The
+// gRPC server uses the same name in metadata.
+const RequestIDHeader = "X-Request-Id"
+
+// maxRequestIDLen is the length of the longest request ID kept.
+const maxRequestIDLen = 128
+
+// AccessLogFormat is the format of access log lines.
+type AccessLogFormat int
+
+const (
+	// AccessLogJSON writes each request as a JSON object.
+	AccessLogJSON AccessLogFormat = iota
+	// AccessLogCombined writes each request in the Combined Log Format
+	// of Apache and nginx, followed by the quoted request ID.
+	AccessLogCombined
+)
+
+// ParseAccessLogFormat parses the name of an access log format, "json"
+// or "combined".
+func ParseAccessLogFormat(name string) (AccessLogFormat, error) {
+	switch name {
+	case "json":
+		return AccessLogJSON, nil
+	case "combined":
+		return AccessLogCombined, nil
+	}
+	return 0, fmt.Errorf("server: unknown access log format %q", name)
+}
+
+// AccessLog writes a line for each request to the HTTP and gRPC
+// servers.
+type AccessLog struct {
+	mu     sync.Mutex
+	w      io.Writer
+	format AccessLogFormat
+	sample float64
+	buf    bytes.Buffer
+}
+
+// NewAccessLog constructs an access log that writes to w. Only the
+// sampled fraction of requests is logged, or all of them when sample is
+// 0 or at least 1; server errors are always logged.
+func NewAccessLog(w io.Writer, format AccessLogFormat, sample float64) *AccessLog {
+	return &AccessLog{w: w, format: format, sample: sample}
+}
+
+// accessEntry is a request in the access log.
+type accessEntry struct {
+	Time      time.Time `json:"time"`
+	RequestID string    `json:"request_id"`
+	Remote    string    `json:"remote"`
+	User      string    `json:"user,omitempty"` // token name, if authenticated
+	Method    string    `json:"method"`
+	URI       string    `json:"uri"`
+	Proto     string    `json:"proto"`
+	Status    int       `json:"status"`
+	GRPCCode  string    `json:"grpc_code,omitempty"`
+	Bytes     int64     `json:"bytes"`
+	Duration  float64   `json:"duration"` // seconds
+	Referer   string    `json:"referer,omitempty"`
+	UserAgent string    `json:"user_agent,omitempty"`
+}
+
+type accessKey struct{}
+
+// RequestID returns the ID of the request being served with the
+// context, or "" when access logging is disabled.
+func RequestID(ctx context.Context) string {
+	if e, ok := ctx.Value(accessKey{}).(*accessEntry); ok {
+		return e.RequestID
+	}
+	return ""
+}
+
+// setAccessUser records the authenticated user of a request.
+func setAccessUser(ctx context.Context, user string) {
+	if e, ok := ctx.Value(accessKey{}).(*accessEntry); ok {
+		e.User = user
+	}
+}
+
+// serve serves a request with h and logs it.
+func (l *AccessLog) serve(w http.ResponseWriter, r *http.Request, trustProxy bool, h http.HandlerFunc) {
+	e := &accessEntry{
+		Time:      time.Now(),
+		RequestID: requestID(r.Header.Get(RequestIDHeader)),
+		Remote:    clientIP(r, trustProxy),
+		Method:    r.Method,
+		URI:       r.RequestURI,
+		Proto:     r.Proto,
+		Referer:   r.Referer(),
+		UserAgent: r.UserAgent(),
+	}
+	w.Header().Set(RequestIDHeader, e.RequestID)
+	aw := &accessWriter{ResponseWriter: w, status: http.StatusOK}
+	h(aw, r.WithContext(context.WithValue(r.Context(), accessKey{}, e)))
+	e.Status, e.Bytes = aw.status, aw.bytes
+	e.Duration = time.Since(e.Time).Seconds()
+	if e.Status >= 500 || l.sampled() {
+		l.write(e)
+	}
+}
+
+// UnaryInterceptor logs unary gRPC calls. Register it with
+// grpc.ChainUnaryInterceptor.
+func (l *AccessLog) UnaryInterceptor() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		ctx, e := l.startRPC(ctx, info.FullMethod)
+		resp, err := handler(ctx, req)
+		l.endRPC(e, err)
+		return resp, err
+	}
+}
+
+// StreamInterceptor logs streaming gRPC calls. Register it with
+// grpc.ChainStreamInterceptor.
+func (l *AccessLog) StreamInterceptor() grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		ctx, e := l.startRPC(ss.Context(), info.FullMethod)
+		err := handler(srv, &accessStream{ss, ctx})
+		l.endRPC(e, err)
+		return err
+	}
+}
+
+func (l *AccessLog) startRPC(ctx context.Context, method string) (context.Context, *accessEntry) {
+	e := &accessEntry{Time: time.Now(), Method: http.MethodPost, URI: method, Proto: "HTTP/2.0"}
+	var id string
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if ids := md.Get(RequestIDHeader); len(ids) != 0 {
+			id = ids[0]
+		}
+		if uas := md.Get("user-agent"); len(uas) != 0 {
+			e.UserAgent = uas[0]
+		}
+	}
+	e.RequestID = requestID(id)
+	if p, ok := peer.FromContext(ctx); ok {
+		e.Remote = p.Addr.String()
+	}
+	grpc.SetHeader(ctx, metadata.Pairs(RequestIDHeader, e.RequestID))
+	return context.WithValue(ctx, accessKey{}, e), e
+}
+
+func (l *AccessLog) endRPC(e *accessEntry, err error) {
+	code := status.Code(err)
+	e.Status = http.StatusOK // gRPC statuses are sent in trailers
+	e.GRPCCode = code.String()
+	e.Duration = time.Since(e.Time).Seconds()
+	switch code {
+	case codes.Unknown, codes.Internal, codes.DataLoss, codes.Unavailable:
+		l.write(e)
+	default:
+		if l.sampled() {
+			l.write(e)
+		}
+	}
+}
+
+func (l *AccessLog) sampled() bool {
+	return l.sample <= 0 || l.sample >= 1 || mrand.Float64() < l.sample
+}
+
+// commonTimeFormat is the time format of the Common Log Format.
+const commonTimeFormat = "02/Jan/2006:15:04:05 -0700"
+
+func (l *AccessLog) write(e *accessEntry) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.buf.Reset()
+	if l.format == AccessLogCombined {
+		size := "-"
+		if e.Bytes != 0 {
+			size = strconv.FormatInt(e.Bytes, 10)
+		}
+		fmt.Fprintf(&l.buf, "%s - %s [%s] %s %d %s %s %s %s",
+			e.Remote, dash(e.User), e.Time.Format(commonTimeFormat),
+			quoteLog(e.Method+" "+e.URI+" "+e.Proto), e.Status, size,
+			quoteLog(dash(e.Referer)), quoteLog(dash(e.UserAgent)), quoteLog(e.RequestID))
+		if e.GRPCCode != "" {
+			l.buf.WriteString(" grpc-status=" + e.GRPCCode)
+		}
+		l.buf.WriteByte('\n')
+	} else {
+		e.Time = e.Time.UTC()
+		json.NewEncoder(&l.buf).Encode(e)
+	}
+	l.w.Write(l.buf.Bytes())
+}
+
+func dash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// quoteLog quotes a field of a Combined Log Format line, escaping quotes,
+// backslashes, and non-printable bytes as nginx does.
+func quoteLog(s string) string {
+	b := make([]byte, 0, len(s)+2)
+	b = append(b, '"')
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '"' || c == '\\':
+			b = append(b, '\\', c)
+		case c < 0x20 || c >= 0x7f:
+			b = append(b, '\\', 'x', hex[c>>4], hex[c&0xf])
+		default:
+			b = append(b, c)
+		}
+	}
+	return string(append(b, '"'))
+}
+
+// requestID returns the propagated request ID, if valid, or generates
+// one.
+func requestID(id string) string {
+	if id != "" && len(id) <= maxRequestIDLen {
+		valid := true
+		for i := 0; i < len(id); i++ {
+			if c := id[i]; c <= ' ' || c >= 0x7f || c == '"' || c == '\\' {
+				valid = false
+				break
+			}
+		}
+		if valid {
+			return id
+		}
+	}
+	var b [8]byte
+	rand.Read(b[:])
+	return fmt.Sprintf("%x", b[:])
+}
+
+// accessWriter records the status and size of a response.
+type accessWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (w *accessWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *accessWriter) Write(b []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += int64(n)
+	return n, err
+}
+
+// Flush implements http.Flusher, for streaming responses.
+func (w *accessWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// accessStream is a server stream with the context of its access log
+// entry.
+type accessStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *accessStream) Context() context.Context {
+	return s.ctx
+}
@@ -0,0 +1,104 @@
+// Copyright (c) 2021 Andrew Archibald
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package server
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+)
+
+// Scope is a permission granted to an API token.
+type Scope string
+
+// Scopes of API tokens.
+const (
+	ScopeRead  Scope = "read"  // single lookups and listings
+	ScopeBulk  Scope = "bulk"  // bulk lookups and exports
+	ScopeAdmin Scope = "admin" // administration, such as reloading
+)
+
+// ParseScope parses the name of a scope.
+func ParseScope(name string) (Scope, error) {
+	switch s := Scope(name); s {
+	case ScopeRead, ScopeBulk, ScopeAdmin:
+		return s, nil
+	}
+	return "", fmt.Errorf("server: unknown scope %q", name)
+}
+
+// Token is an API token, which is sent as a bearer token in the
+// Authorization header.
+type Token struct {
+	Name   string // identifies the holder in logs and rate limits
+	Secret string
+	Scopes []Scope
+}
+
+func (t *Token) has(scope Scope) bool {
+	for _, s := range t.Scopes {
+		if s == scope || s == ScopeAdmin {
+			return true
+		}
+	}
+	return false
+}
+
+// authenticator checks the bearer tokens of requests. Tokens are
+// compared by hash, so that lookups do not leak timing information
+// about the secrets.
+type authenticator struct {
+	tokens    map[[sha256.Size]byte]*Token
+	anonymous Token // scopes of requests without a token
+}
+
+func newAuthenticator(tokens []Token, anonymous []Scope) *authenticator {
+	a := &authenticator{
+		tokens:    make(map[[sha256.Size]byte]*Token, len(tokens)),
+		anonymous: Token{Name: "anonymous", Scopes: anonymous},
+	}
+	for i := range tokens {
+		a.tokens[sha256.Sum256([]byte(tokens[i].Secret))] = &tokens[i]
+	}
+	return a
+}
+
+// lookup returns the token with the secret, or nil if there is none.
+func (a *authenticator) lookup(secret string) *Token {
+	if secret == "" {
+		return nil
+	}
+	return a.tokens[sha256.Sum256([]byte(secret))]
+}
+
+// middleware rejects requests without a token that grants the scope.
+func (a *authenticator) middleware(scope Scope, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		secret := bearerToken(r)
+		if secret == "" {
+			if !a.anonymous.has(scope) {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="urlteam"`)
+				writeError(w, http.StatusUnauthorized, "authentication required")
+				return
+			}
+			h(w, r)
+			return
+		}
+		t := a.lookup(secret)
+		if t == nil {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="urlteam", error="invalid_token"`)
+			writeError(w, http.StatusUnauthorized, "invalid token")
+			return
+		}
+		if !t.has(scope) {
+			writeError(w, http.StatusForbidden, "token lacks scope "+string(scope))
+			return
+		}
+		setAccessUser(r.Context(), t.Name)
+		h(w, r)
+	}
+}
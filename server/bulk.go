@@ -0,0 +1,177 @@
+// Copyright (c) 2021 Andrew Archibald
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/andrewarchi/urlhero/index"
+	"github.com/andrewarchi/urlhero/logger"
+	"github.com/andrewarchi/urlhero/shorteners"
+	"github.com/andrewarchi/urlhero/tracing"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// MaxBulkQueries is the maximum number of queries in a bulk lookup.
+const MaxBulkQueries = 1000
+
+// BulkRequest is the body of a bulk lookup, POST /v1/lookup.
+type BulkRequest struct {
+	Shortener string   `json:"shortener,omitempty"` // shortener of bare shortcodes
+	Queries   []string `json:"queries"`             // shortcodes or short URLs
+}
+
+// BulkResponse is the result of a bulk lookup. Results are in the order
+// of the queries. A query that fails does not fail the others; its
+// result has an error instead.
+type BulkResponse struct {
+	Results []BulkResult `json:"results"`
+	Found   int          `json:"found"`
+	Missing int          `json:"missing"`
+	Failed  int          `json:"failed"`
+}
+
+// BulkResult is the result of a query in a bulk lookup.
+type BulkResult struct {
+	Query string `json:"query"`
+	Mapping
+	Error string `json:"error,omitempty"`
+}
+
+func (s *Server) handleBulk(w http.ResponseWriter, r *http.Request, g *generation) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	var req BulkRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		// Body size is limited by limitBody
+		if strings.Contains(err.Error(), "request body too large") {
+			writeError(w, http.StatusRequestEntityTooLarge, "request body larger than "+strconv.FormatInt(s.opts.MaxRequestBytes, 10)+" bytes")
+		} else {
+			writeError(w, http.StatusBadRequest, "invalid request: "+err.Error())
+		}
+		return
+	}
+	if len(req.Queries) > MaxBulkQueries {
+		writeError(w, http.StatusRequestEntityTooLarge, "more than "+strconv.Itoa(MaxBulkQueries)+" queries")
+		return
+	}
+	writeJSON(w, http.StatusOK, s.bulkLookup(r.Context(), g.idx, &req))
+}
+
+func (s *Server) bulkLookup(ctx context.Context, idx *index.Index, req *BulkRequest) *BulkResponse {
+	resp := &BulkResponse{Results: make([]BulkResult, len(req.Queries))}
+	byHost := make(map[*index.Reader][]int)
+	for i, q := range req.Queries {
+		res := &resp.Results[i]
+		res.Query = q
+		reader, shortcode, err := parseQuery(idx, q, req.Shortener)
+		if err != nil {
+			res.Error = err.Error()
+			continue
+		}
+		res.Shortcode = shortcode
+		if reader == nil {
+			continue // shortener not indexed
+		}
+		res.Host = reader.Meta().Host
+		byHost[reader] = append(byHost[reader], i)
+	}
+	for reader, is := range byHost {
+		shortcodes := make([]string, len(is))
+		for j, i := range is {
+			shortcodes[j] = resp.Results[i].Shortcode
+		}
+		ms, err := lookupBatch(ctx, idx, reader, shortcodes)
+		if err != nil {
+			logger.Error("bulk lookup failed", "host", reader.Meta().Host, "err", err)
+			for _, i := range is {
+				resp.Results[i].Error = "lookup failed"
+			}
+			continue
+		}
+		for j, i := range is {
+			res := &resp.Results[i]
+			res.Mapping = ms[j]
+			s.metrics.lookup(res.Host, res.Found)
+		}
+	}
+	for _, res := range resp.Results {
+		switch {
+		case res.Error != "":
+			resp.Failed++
+		case res.Found:
+			resp.Found++
+		default:
+			resp.Missing++
+		}
+	}
+	return resp
+}
+
+// lookupBatch finds the targets of shortcodes of a host with a batch
+// lookup in each layer of the index. Unlike generation.lookup, it
+// bypasses the cache and omits the history of the shortcodes.
+func lookupBatch(ctx context.Context, idx *index.Index, reader *index.Reader, shortcodes []string) ([]Mapping, error) {
+	host := reader.Meta().Host
+	layers := idx.Layers(host)
+	_, span := tracing.Start(ctx, "index.LookupBatch", attribute.String("host", host),
+		attribute.Int("shortcodes", len(shortcodes)), attribute.Int("layers", len(layers)))
+	targets := make([][]string, len(layers))
+	found := make([][]bool, len(layers))
+	var err error
+	for l, layer := range layers {
+		if targets[l], found[l], err = layer.LookupBatch(shortcodes); err != nil {
+			break
+		}
+	}
+	tracing.End(span, err)
+	if err != nil {
+		return nil, err
+	}
+	ms := make([]Mapping, len(shortcodes))
+	lt := make([]string, len(layers))
+	lf := make([]bool, len(layers))
+	for j, shortcode := range shortcodes {
+		for l := range layers {
+			lt[l], lf[l] = targets[l][j], found[l][j]
+		}
+		ms[j] = Mapping{Host: host, Shortcode: shortcode}
+		ms[j].merge(layers, lt, lf)
+	}
+	return ms, nil
+}
+
+// parseQuery parses a shortcode or short URL. The reader is nil, when
+// the shortener is not indexed.
+func parseQuery(idx *index.Index, q, shortener string) (*index.Reader, string, error) {
+	if !strings.Contains(q, "://") {
+		if shortener == "" {
+			return nil, "", errors.New("shortcode without shortener")
+		}
+		if q == "" {
+			return nil, "", errors.New("empty shortcode")
+		}
+		reader, _ := resolve(idx, shortener)
+		return reader, q, nil
+	}
+	host, shortcode, err := shorteners.ParseShortURL(q)
+	if err != nil {
+		return nil, "", err
+	}
+	if shortcode == "" {
+		return nil, "", errors.New("no shortcode in URL")
+	}
+	return idx.Reader(host), shortcode, nil
+}
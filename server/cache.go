@@ -0,0 +1,93 @@
+// Copyright (c) 2021 Andrew Archibald
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package server
+
+import (
+	"container/list"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// lruCache is a fixed-size cache of lookups, evicting the least
+// recently used.
+type lruCache struct {
+	mu      sync.Mutex
+	size    int
+	entries map[lruKey]*list.Element
+	order   *list.List // front: most recently used
+}
+
+type lruKey struct {
+	host, shortcode string
+}
+
+type lruEntry struct {
+	key lruKey
+	m   Mapping
+}
+
+func newLRUCache(size int) *lruCache {
+	return &lruCache{size: size, entries: make(map[lruKey]*list.Element), order: list.New()}
+}
+
+func (c *lruCache) get(host, shortcode string) (Mapping, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[lruKey{host, shortcode}]
+	if !ok {
+		return Mapping{}, false
+	}
+	c.order.MoveToFront(e)
+	return e.Value.(*lruEntry).m, true
+}
+
+func (c *lruCache) add(host, shortcode string, m Mapping) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key := lruKey{host, shortcode}
+	if e, ok := c.entries[key]; ok {
+		e.Value.(*lruEntry).m = m
+		c.order.MoveToFront(e)
+		return
+	}
+	c.entries[key] = c.order.PushFront(&lruEntry{key, m})
+	if c.order.Len() > c.size {
+		e := c.order.Back()
+		c.order.Remove(e)
+		delete(c.entries, e.Value.(*lruEntry).key)
+	}
+}
+
+// cacheable sets the caching headers of a GET response and reports
+// whether the client already has the current version, in which case
+// 304 Not Modified has been written. Responses only change when the
+// index is rebuilt, so the ETag is the index version.
+func (s *Server) cacheable(w http.ResponseWriter, r *http.Request, g *generation) bool {
+	h := w.Header()
+	// Assign the shared values directly, to not allocate
+	h["Etag"] = g.etag
+	if s.cacheControl != nil {
+		h["Cache-Control"] = s.cacheControl
+	}
+	if match := r.Header.Get("If-None-Match"); match != "" && etagMatch(match, g.etag[0]) {
+		w.WriteHeader(http.StatusNotModified)
+		return true
+	}
+	return false
+}
+
+// etagMatch reports whether an If-None-Match header matches the ETag.
+func etagMatch(header, etag string) bool {
+	for _, t := range strings.Split(header, ",") {
+		t = strings.TrimSpace(t)
+		if t == "*" || strings.TrimPrefix(t, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
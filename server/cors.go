@@ -0,0 +1,93 @@
+// Copyright (c) 2021 Andrew Archibald
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package server
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultCORSMethods are the methods allowed by CORS, when none are
+// configured.
+var DefaultCORSMethods = []string{http.MethodGet, http.MethodHead, http.MethodPost}
+
+// Header values of CORS responses.
+const (
+	corsAllowHeaders  = "Accept-Datetime, Authorization, Content-Type, If-Match, If-None-Match"
+	corsExposeHeaders = "ETag, Link, Memento-Datetime, Retry-After, WWW-Authenticate"
+)
+
+// cors handles cross-origin requests from browsers, as defined by the
+// Fetch standard.
+type cors struct {
+	origins   map[string]bool
+	anyOrigin bool
+	methods   string // Access-Control-Allow-Methods
+	maxAge    string // Access-Control-Max-Age, if any
+}
+
+func newCORS(origins, methods []string, maxAge time.Duration) *cors {
+	c := &cors{origins: make(map[string]bool)}
+	for _, o := range origins {
+		if o == "*" {
+			c.anyOrigin = true
+		}
+		// Origins are serialized in lowercase without a trailing slash
+		c.origins[strings.ToLower(strings.TrimSuffix(o, "/"))] = true
+	}
+	if len(methods) == 0 {
+		methods = DefaultCORSMethods
+	}
+	upper := make([]string, len(methods))
+	for i, m := range methods {
+		upper[i] = strings.ToUpper(m)
+	}
+	c.methods = strings.Join(upper, ", ")
+	if maxAge > 0 {
+		c.maxAge = strconv.Itoa(int(maxAge.Seconds()))
+	}
+	return c
+}
+
+// middleware adds CORS headers to the responses of allowed origins and
+// answers their preflight requests, before authentication, because
+// browsers send preflights without credentials.
+func (c *cors) middleware(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			next(w, r)
+			return
+		}
+		h := w.Header()
+		if !c.anyOrigin {
+			h.Add("Vary", "Origin")
+			if !c.origins[strings.ToLower(origin)] {
+				// Browsers block the response without CORS headers
+				next(w, r)
+				return
+			}
+			h.Set("Access-Control-Allow-Origin", origin)
+		} else {
+			h.Set("Access-Control-Allow-Origin", "*")
+		}
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			h.Add("Vary", "Access-Control-Request-Method, Access-Control-Request-Headers")
+			h.Set("Access-Control-Allow-Methods", c.methods)
+			h.Set("Access-Control-Allow-Headers", corsAllowHeaders)
+			if c.maxAge != "" {
+				h.Set("Access-Control-Max-Age", c.maxAge)
+			}
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		h.Set("Access-Control-Expose-Headers", corsExposeHeaders)
+		next(w, r)
+	}
+}
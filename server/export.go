@@ -0,0 +1,270 @@
+// Copyright (c) 2021 Andrew Archibald
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package server
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/andrewarchi/urlhero/beacon"
+	"github.com/andrewarchi/urlhero/index"
+	"github.com/andrewarchi/urlhero/logger"
+	"github.com/andrewarchi/urlhero/tracing"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// exportFlushRecords is the number of records written between flushes
+// of a streaming export.
+const exportFlushRecords = 4096
+
+// ExportRecord is a line of an NDJSON export.
+type ExportRecord struct {
+	Shortcode string `json:"shortcode"`
+	Target    string `json:"target"`
+	// Releases and the times first and last seen are included with
+	// ?provenance=1
+	Releases  []string   `json:"releases,omitempty"`
+	FirstSeen *time.Time `json:"first_seen,omitempty"`
+	LastSeen  *time.Time `json:"last_seen,omitempty"`
+}
+
+// Writers of exports are recycled, because the state of a gzip writer
+// is large.
+var (
+	gzipWriters   = sync.Pool{New: func() interface{} { return gzip.NewWriter(nil) }}
+	exportWriters = sync.Pool{New: func() interface{} { return bufio.NewWriterSize(nil, 32<<10) }}
+)
+
+// lineBreakEscaper percent-encodes line breaks in targets, which are
+// invalid in URLs and cannot be represented in BEACON link dumps.
+var lineBreakEscaper = strings.NewReplacer("\r", "%0D", "\n", "%0A")
+
+// handleExport streams every mapping of a shortener in increasing
+// shortcode order, as NDJSON with ?format=ndjson (the default) or as a
+// URLTeam-format BEACON link dump with ?format=beacon. The response is
+// gzip-compressed when the client accepts it.
+//
+// An interrupted export is resumed with ?after= set to the last
+// shortcode received, and a range of shortcodes is selected with ?after=
+// and ?end=, which is exclusive. With ?provenance=1, NDJSON records
+// include the releases that archived them and when they were first and
+// last seen, from the provenance log of the shortener. Targets are
+// exported as they were archived or, with ?encoding=uri or
+// ?encoding=iri, normalized as by index.EncodingURI or
+// index.EncodingIRI. The ETag identifies the index version, so the
+// client can send If-Match to ensure that a resumed export is consistent
+// with the first part. In a federation, the mappings of every index are
+// merged, with the target of the first index that has each shortcode.
+func (s *Server) handleExport(w http.ResponseWriter, r *http.Request, g *generation) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	shortener := strings.TrimPrefix(r.URL.Path, "/v1/export/")
+	reader, ok := resolve(g.idx, shortener)
+	if shortener == "" || strings.ContainsRune(shortener, '/') || !ok {
+		writeError(w, http.StatusNotFound, "shortener not indexed: "+shortener)
+		return
+	}
+	q := r.URL.Query()
+	format := q.Get("format")
+	var contentType, ext string
+	switch format {
+	case "", "ndjson":
+		format, contentType, ext = "ndjson", "application/x-ndjson", ".ndjson"
+	case "beacon":
+		contentType, ext = "text/plain; charset=utf-8", ".beacon"
+	default:
+		writeError(w, http.StatusBadRequest, "format must be ndjson or beacon")
+		return
+	}
+	layers := g.idx.Layers(reader.Meta().Host)
+	var provs map[string]*index.ProvenanceCursor // by layer source
+	switch q.Get("provenance") {
+	case "", "0":
+	case "1":
+		if format != "ndjson" {
+			writeError(w, http.StatusBadRequest, "provenance requires format ndjson")
+			return
+		}
+		for _, l := range layers {
+			if p := l.Provenance(); p != nil {
+				if provs == nil {
+					provs = make(map[string]*index.ProvenanceCursor)
+				}
+				provs[l.Source] = p.Cursor()
+			}
+		}
+	default:
+		writeError(w, http.StatusBadRequest, "provenance must be 0 or 1")
+		return
+	}
+	encoding := index.EncodingRaw
+	if name := q.Get("encoding"); name != "" {
+		var err error
+		if encoding, err = index.ParseTargetEncoding(name); err != nil {
+			writeError(w, http.StatusBadRequest, "encoding must be raw, uri, or iri")
+			return
+		}
+	}
+	if match := r.Header.Get("If-Match"); match != "" && !etagMatch(match, g.etag[0]) {
+		writeError(w, http.StatusPreconditionFailed, "index version changed")
+		return
+	}
+	if s.cacheable(w, r, g) {
+		return
+	}
+
+	host := reader.Meta().Host
+	h := w.Header()
+	h.Set("Content-Type", contentType)
+	h.Add("Vary", "Accept-Encoding")
+	var body io.Writer = w
+	var gz *gzip.Writer
+	if acceptsGzip(r) {
+		h.Set("Content-Encoding", "gzip")
+		gz = gzipWriters.Get().(*gzip.Writer)
+		gz.Reset(w)
+		defer func() {
+			gz.Reset(nil)
+			gzipWriters.Put(gz)
+		}()
+		body = gz
+		ext += ".gz"
+	}
+	h.Set("Content-Disposition", `attachment; filename="`+host+ext+`"`)
+	w.WriteHeader(http.StatusOK)
+	if r.Method == http.MethodHead {
+		return
+	}
+
+	bw := exportWriters.Get().(*bufio.Writer)
+	bw.Reset(body)
+	defer func() {
+		bw.Reset(nil)
+		exportWriters.Put(bw)
+	}()
+	var write func(m Mapping) error
+	var flush func() error
+	if format == "beacon" {
+		// The beacon writer uses bw, rather than wrap it in another buffer
+		bw := beacon.NewWriter(bw)
+		meta := []beacon.MetaField{{Name: "FORMAT", Value: "BEACON"}, {Name: "PREFIX", Value: shortURLPrefix(host)}}
+		if err := bw.WriteMeta(meta); err != nil {
+			abortExport(host, 0, err)
+		}
+		write = func(m Mapping) error {
+			return bw.Write(&beacon.Link{Source: m.Shortcode, Target: lineBreakEscaper.Replace(encoding.Encode(m.Target))})
+		}
+		flush = bw.Flush
+	} else {
+		enc := json.NewEncoder(bw)
+		enc.SetEscapeHTML(false)
+		write = func(m Mapping) error {
+			er := ExportRecord{Shortcode: m.Shortcode, Target: encoding.Encode(m.Target)}
+			if provs != nil {
+				// The origins are those of every layer with the target
+				sources := []string{layers[0].Source}
+				if m.Provenance != nil {
+					sources = m.Provenance.Sources
+				}
+				var p Provenance
+				for _, source := range sources {
+					prov := provs[source]
+					if prov == nil {
+						continue
+					}
+					o, err := prov.Origin(m.Shortcode, m.Target)
+					if err != nil {
+						return err
+					}
+					p.addOrigin(o)
+				}
+				er.Releases, er.FirstSeen, er.LastSeen = p.Releases, p.FirstSeen, p.LastSeen
+			}
+			return enc.Encode(er)
+		}
+		flush = bw.Flush
+	}
+	flusher, _ := w.(http.Flusher)
+	flushAll := func() error {
+		if err := flush(); err != nil {
+			return err
+		}
+		if gz != nil {
+			if err := gz.Flush(); err != nil {
+				return err
+			}
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		return nil
+	}
+
+	after, end := q.Get("after"), q.Get("end")
+	n := 0
+	_, span := tracing.Start(r.Context(), "index.Range",
+		attribute.String("host", host), attribute.Int("layers", len(layers)))
+	defer span.End()
+	err := mergeLayers(layers, after, end, func(m Mapping) error {
+		if after != "" && m.Shortcode == after {
+			return nil
+		}
+		if err := write(m); err != nil {
+			return err
+		}
+		if n++; n%exportFlushRecords == 0 {
+			// Stop scanning once the client disconnects
+			if err := r.Context().Err(); err != nil {
+				return err
+			}
+			return flushAll()
+		}
+		return nil
+	})
+	if err == nil {
+		err = flush()
+	}
+	if err == nil && gz != nil {
+		err = gz.Close()
+	}
+	if err != nil {
+		abortExport(host, n, err)
+	}
+}
+
+// abortExport aborts a streaming export after an error. The status has
+// already been sent, so the connection is closed to signal to the client
+// that the export is incomplete.
+func abortExport(host string, records int, err error) {
+	logger.Error("export failed", "host", host, "records", records, "err", err)
+	panic(http.ErrAbortHandler)
+}
+
+// acceptsGzip reports whether the client accepts gzip-encoded
+// responses.
+func acceptsGzip(r *http.Request) bool {
+	for _, enc := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		enc = strings.TrimSpace(enc)
+		params := ""
+		if i := strings.IndexByte(enc, ';'); i != -1 {
+			enc, params = strings.TrimSpace(enc[:i]), strings.ReplaceAll(enc[i+1:], " ", "")
+		}
+		if strings.EqualFold(enc, "gzip") {
+			return params != "q=0" && params != "q=0.0" && params != "q=0.00" && params != "q=0.000"
+		}
+	}
+	return false
+}
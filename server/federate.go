@@ -0,0 +1,124 @@
+// Copyright (c) 2021 Andrew Archibald
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package server
+
+import (
+	"github.com/andrewarchi/urlhero/index"
+)
+
+// mergeLayers calls fn for every shortcode in [start, end) of any layer
+// of a host in increasing shortcode order, with its mapping merged from
+// the layers as by a lookup: the target is that of the first layer with
+// the shortcode and the others are attributed or in conflict with it.
+// Mappings of a host with a single layer have no provenance, like
+// records. An empty end is unbounded. Iteration stops early when fn
+// returns an error, which is returned.
+func mergeLayers(layers []index.Layer, start, end string, fn func(Mapping) error) error {
+	host := layers[0].Meta().Host
+	its := make([]index.Iter, len(layers))
+	ok := make([]bool, len(layers))
+	for i, l := range layers {
+		its[i] = l.RangeIter(start, end)
+		if ok[i] = its[i].Next(); !ok[i] {
+			if err := its[i].Err(); err != nil {
+				return err
+			}
+		}
+	}
+	targets := make([]string, len(layers))
+	found := make([]bool, len(layers))
+	for {
+		min := -1
+		for i, it := range its {
+			if ok[i] && (min == -1 || it.Record().Shortcode < its[min].Record().Shortcode) {
+				min = i
+			}
+		}
+		if min == -1 {
+			return nil
+		}
+		shortcode := its[min].Record().Shortcode
+		for i, it := range its {
+			found[i] = ok[i] && it.Record().Shortcode == shortcode
+			if found[i] {
+				targets[i] = it.Record().Target
+			}
+		}
+		m := Mapping{Host: host, Shortcode: shortcode}
+		if len(layers) == 1 {
+			m.Target, m.Found = targets[0], true
+		} else {
+			m.merge(layers, targets, found)
+		}
+		if err := fn(m); err != nil {
+			return err
+		}
+		for i, it := range its {
+			if !found[i] {
+				continue
+			}
+			if ok[i] = it.Next(); !ok[i] {
+				if err := it.Err(); err != nil {
+					return err
+				}
+			}
+		}
+	}
+}
+
+// pageLayers returns up to limit merged mappings of a host with
+// shortcodes starting with prefix that sort after the cursor after, like
+// index.Reader.Page. A limit of 0 is unlimited.
+func pageLayers(layers []index.Layer, prefix, after string, limit int) (mappings []Mapping, next string, err error) {
+	start := prefix
+	if after >= start {
+		start = after + "\x00"
+	}
+	end := index.PrefixEnd(prefix)
+	if end != "" && start >= end {
+		return nil, "", nil
+	}
+	err = mergeLayers(layers, start, end, func(m Mapping) error {
+		if limit != 0 && len(mappings) == limit {
+			next = mappings[len(mappings)-1].Shortcode
+			return errLimit
+		}
+		mappings = append(mappings, m)
+		return nil
+	})
+	if err == errLimit {
+		err = nil
+	}
+	return mappings, next, err
+}
+
+// count returns the number of shortcodes of a host in any layer. It is
+// counted once per generation for a host with several layers, as it
+// requires scanning every layer.
+func (g *generation) count(host string) (int64, error) {
+	layers := g.idx.Layers(host)
+	if len(layers) == 1 {
+		return layers[0].Len(), nil
+	}
+	g.countMu.Lock()
+	defer g.countMu.Unlock()
+	if n, ok := g.counts[host]; ok {
+		return n, nil
+	}
+	var n int64
+	if err := mergeLayers(layers, "", "", func(Mapping) error {
+		n++
+		return nil
+	}); err != nil {
+		return 0, err
+	}
+	if g.counts == nil {
+		g.counts = make(map[string]int64)
+	}
+	g.counts[host] = n
+	return n, nil
+}
@@ -0,0 +1,250 @@
+// Copyright (c) 2021 Andrew Archibald
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package server
+
+import (
+	"context"
+	"errors"
+	"io"
+
+	"github.com/andrewarchi/urlhero/index"
+	"github.com/andrewarchi/urlhero/logger"
+	"github.com/andrewarchi/urlhero/server/lookuppb"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// GRPCServer implements the gRPC lookup service for an index.
+type GRPCServer struct {
+	lookuppb.UnimplementedLookupServiceServer
+	gens *generations
+}
+
+// NewGRPC constructs a gRPC lookup service for the index. Register it
+// with lookuppb.RegisterLookupServiceServer.
+func NewGRPC(idx *index.Index) *GRPCServer {
+	return &GRPCServer{gens: newGenerations(idx, 0)}
+}
+
+// GRPC constructs a gRPC lookup service that serves the same index as
+// the server, including after reloads.
+func (s *Server) GRPC() *GRPCServer {
+	return &GRPCServer{gens: s.gens}
+}
+
+// Lookup finds the target of a shortcode.
+func (g *GRPCServer) Lookup(ctx context.Context, req *lookuppb.LookupRequest) (*lookuppb.Mapping, error) {
+	gen := g.gens.acquire()
+	defer gen.release()
+	reader, err := grpcReader(gen.idx, req.Shortener)
+	if err != nil {
+		return nil, err
+	}
+	return lookupMapping(ctx, gen, reader, req.Shortcode)
+}
+
+// BulkLookup looks up a stream of shortcodes in order.
+func (g *GRPCServer) BulkLookup(stream lookuppb.LookupService_BulkLookupServer) error {
+	for {
+		req, err := stream.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		// Acquire per request, so that a long stream does not hold up
+		// reloads
+		gen := g.gens.acquire()
+		reader, err := grpcReader(gen.idx, req.Shortener)
+		var m *lookuppb.Mapping
+		if err == nil {
+			m, err = lookupMapping(stream.Context(), gen, reader, req.Shortcode)
+		} else if status.Code(err) == codes.NotFound {
+			// An unindexed shortener does not fail the rest of the stream
+			m, err = &lookuppb.Mapping{Shortcode: req.Shortcode}, nil
+		}
+		gen.release()
+		if err != nil {
+			return err
+		}
+		if err := stream.Send(m); err != nil {
+			return err
+		}
+	}
+}
+
+// MaxBatchShortcodes is the maximum number of shortcodes in a batch of
+// BatchLookup.
+const MaxBatchShortcodes = 10000
+
+// BatchLookup looks up a stream of batches of shortcodes in order.
+func (g *GRPCServer) BatchLookup(stream lookuppb.LookupService_BatchLookupServer) error {
+	for {
+		req, err := stream.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if len(req.Shortcodes) > MaxBatchShortcodes {
+			return status.Errorf(codes.InvalidArgument, "more than %d shortcodes in batch", MaxBatchShortcodes)
+		}
+		resp := &lookuppb.BatchLookupResponse{Mappings: make([]*lookuppb.Mapping, len(req.Shortcodes))}
+		gen := g.gens.acquire()
+		reader, err := grpcReader(gen.idx, req.Shortener)
+		var ms []Mapping
+		if err == nil {
+			ms, err = lookupBatch(stream.Context(), gen.idx, reader, req.Shortcodes)
+			err = toStatus(err)
+		} else if status.Code(err) == codes.NotFound {
+			// An unindexed shortener does not fail the rest of the stream
+			err = nil
+		}
+		gen.release()
+		if err != nil {
+			return err
+		}
+		for i, shortcode := range req.Shortcodes {
+			pm := &lookuppb.Mapping{Shortcode: shortcode}
+			if ms != nil {
+				m := &ms[i]
+				pm.Host, pm.Target, pm.Found = m.Host, m.Target, m.Found
+				if m.Provenance != nil {
+					pm.Projects = m.Provenance.Projects
+				}
+			}
+			resp.Mappings[i] = pm
+		}
+		if err := stream.Send(resp); err != nil {
+			return err
+		}
+	}
+}
+
+// PrefixScan streams the mappings with shortcodes starting with a
+// prefix.
+func (g *GRPCServer) PrefixScan(req *lookuppb.PrefixScanRequest, stream lookuppb.LookupService_PrefixScanServer) error {
+	gen := g.gens.acquire()
+	defer gen.release()
+	reader, err := grpcReader(gen.idx, req.Shortener)
+	if err != nil {
+		return err
+	}
+	if req.Limit < 0 {
+		return status.Error(codes.InvalidArgument, "negative limit")
+	}
+	start := req.Prefix
+	if req.After >= start {
+		start = req.After + "\x00"
+	}
+	end := index.PrefixEnd(req.Prefix)
+	if end != "" && start >= end {
+		return nil
+	}
+	n := int32(0)
+	err = mergeLayers(gen.idx.Layers(reader.Meta().Host), start, end, func(m Mapping) error {
+		if req.Limit != 0 && n == req.Limit {
+			return errLimit
+		}
+		n++
+		return stream.Send(mappingProto(m))
+	})
+	if err == errLimit {
+		return nil
+	}
+	return toStatus(err)
+}
+
+// ReverseLookup streams the mappings that redirect to a target. It scans
+// every record of the searched shorteners.
+func (g *GRPCServer) ReverseLookup(req *lookuppb.ReverseLookupRequest, stream lookuppb.LookupService_ReverseLookupServer) error {
+	if req.Target == "" {
+		return status.Error(codes.InvalidArgument, "empty target")
+	}
+	gen := g.gens.acquire()
+	defer gen.release()
+	hosts := gen.idx.Hosts()
+	if req.Shortener != "" {
+		reader, err := grpcReader(gen.idx, req.Shortener)
+		if err != nil {
+			return err
+		}
+		hosts = []string{reader.Meta().Host}
+	}
+	ctx := stream.Context()
+	for _, host := range hosts {
+		layers := gen.idx.Layers(host)
+		projects := layers[0].Meta().Projects
+		err := mergeLayers(layers, "", "", func(m Mapping) error {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if m.Target != req.Target {
+				return nil
+			}
+			pm := mappingProto(m)
+			if m.Provenance == nil {
+				// Mappings of a single layer are not attributed
+				pm.Projects = projects
+			}
+			return stream.Send(pm)
+		})
+		if err != nil {
+			return toStatus(err)
+		}
+	}
+	return nil
+}
+
+// grpcReader resolves a shortener to its index reader, or a NotFound error.
+func grpcReader(idx *index.Index, shortener string) (*index.Reader, error) {
+	reader, ok := resolve(idx, shortener)
+	if !ok {
+		return nil, status.Error(codes.NotFound, "shortener not indexed: "+shortener)
+	}
+	return reader, nil
+}
+
+func lookupMapping(ctx context.Context, gen *generation, reader *index.Reader, shortcode string) (*lookuppb.Mapping, error) {
+	m, err := gen.lookup(ctx, reader, shortcode)
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	return mappingProto(m), nil
+}
+
+// mappingProto converts a mapping to its message.
+func mappingProto(m Mapping) *lookuppb.Mapping {
+	pm := &lookuppb.Mapping{Host: m.Host, Shortcode: m.Shortcode, Target: m.Target, Found: m.Found}
+	if m.Provenance != nil {
+		pm.Projects = m.Provenance.Projects
+	}
+	return pm
+}
+
+var errLimit = errors.New("limit reached")
+
+// toStatus converts an index error to a gRPC status, leaving errors that
+// are already statuses unchanged.
+func toStatus(err error) error {
+	if err == nil {
+		return nil
+	}
+	if _, ok := status.FromError(err); ok {
+		return err
+	}
+	switch {
+	case errors.Is(err, context.Canceled):
+		return status.Error(codes.Canceled, err.Error())
+	case errors.Is(err, context.DeadlineExceeded):
+		return status.Error(codes.DeadlineExceeded, err.Error())
+	}
+	logger.Error("lookup failed", "err", err)
+	return status.Error(codes.Internal, "lookup failed")
+}
@@ -0,0 +1,172 @@
+// Copyright (c) 2021 Andrew Archibald
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+
+	"github.com/andrewarchi/urlhero/server/lookuppb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+func newTestClient(t *testing.T, opts ...grpc.ServerOption) lookuppb.LookupServiceClient {
+	t.Helper()
+	s := newTestServer(t)
+	l := bufconn.Listen(1 << 20)
+	g := grpc.NewServer(opts...)
+	lookuppb.RegisterLookupServiceServer(g, s.GRPC())
+	go g.Serve(l)
+	t.Cleanup(g.Stop)
+	conn, err := grpc.Dial("bufnet", grpc.WithInsecure(), grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+		return l.DialContext(ctx)
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return lookuppb.NewLookupServiceClient(conn)
+}
+
+func TestGRPC(t *testing.T) {
+	c := newTestClient(t)
+	ctx := context.Background()
+
+	m, err := c.Lookup(ctx, &lookuppb.LookupRequest{Shortener: "bit-ly", Shortcode: "0010"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !m.Found || m.Target != "http://example.com/16" {
+		t.Errorf("Lookup = %v", m)
+	}
+
+	bulk, err := c.BulkLookup(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reqs := []*lookuppb.LookupRequest{
+		{Shortener: "bit.ly", Shortcode: "0001"},
+		{Shortener: "is.gd", Shortcode: "0001"},
+		{Shortener: "bit.ly", Shortcode: "zzzz"},
+		{Shortener: "bit.ly", Shortcode: "0000"},
+	}
+	for _, req := range reqs {
+		if err := bulk.Send(req); err != nil {
+			t.Fatal(err)
+		}
+	}
+	bulk.CloseSend()
+	for i, want := range []bool{true, false, false, true} {
+		m, err := bulk.Recv()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m.Shortcode != reqs[i].Shortcode || m.Found != want {
+			t.Errorf("BulkLookup %d = %v", i, m)
+		}
+	}
+	if _, err := bulk.Recv(); err != io.EOF {
+		t.Errorf("BulkLookup: got %v, want EOF", err)
+	}
+
+	batch, err := c.BatchLookup(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	batches := []*lookuppb.BatchLookupRequest{
+		{Shortener: "bit-ly", Shortcodes: []string{"0001", "zzzz", "0000"}},
+		{Shortener: "is.gd", Shortcodes: []string{"0001"}},
+		{Shortener: "bit.ly"},
+	}
+	for _, req := range batches {
+		if err := batch.Send(req); err != nil {
+			t.Fatal(err)
+		}
+	}
+	batch.CloseSend()
+	for i, want := range [][]bool{{true, false, true}, {false}, {}} {
+		resp, err := batch.Recv()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(resp.Mappings) != len(want) {
+			t.Fatalf("BatchLookup %d: got %d mappings, want %d", i, len(resp.Mappings), len(want))
+		}
+		for j, m := range resp.Mappings {
+			if m.Shortcode != batches[i].Shortcodes[j] || m.Found != want[j] ||
+				m.Found && (m.Host != "bit.ly" || m.Target != "http://example.com/"+strconv.Itoa(int(m.Shortcode[3]-'0'))) {
+				t.Errorf("BatchLookup %d.%d = %v", i, j, m)
+			}
+		}
+	}
+	if _, err := batch.Recv(); err != io.EOF {
+		t.Errorf("BatchLookup: got %v, want EOF", err)
+	}
+
+	scan, err := c.PrefixScan(ctx, &lookuppb.PrefixScanRequest{Shortener: "bit.ly", Prefix: "00", After: "00f0", Limit: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var shortcodes []string
+	for {
+		m, err := scan.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		shortcodes = append(shortcodes, m.Shortcode)
+	}
+	if len(shortcodes) != 5 || shortcodes[0] != "00f1" || shortcodes[4] != "00f5" {
+		t.Errorf("PrefixScan = %v", shortcodes)
+	}
+
+	rev, err := c.ReverseLookup(ctx, &lookuppb.ReverseLookupRequest{Target: "http://example.com/255"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err = rev.Recv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Shortcode != "00ff" {
+		t.Errorf("ReverseLookup = %v", m)
+	}
+	if _, err := rev.Recv(); err != io.EOF {
+		t.Errorf("ReverseLookup: got %v, want EOF", err)
+	}
+}
+
+func TestGRPCAccessLog(t *testing.T) {
+	var buf bytes.Buffer
+	l := NewAccessLog(&buf, AccessLogJSON, 0)
+	c := newTestClient(t, grpc.ChainUnaryInterceptor(l.UnaryInterceptor()),
+		grpc.ChainStreamInterceptor(l.StreamInterceptor()))
+	ctx := metadata.AppendToOutgoingContext(context.Background(), RequestIDHeader, "abc-123")
+	var header metadata.MD
+	if _, err := c.Lookup(ctx, &lookuppb.LookupRequest{Shortener: "is.gd", Shortcode: "0010"}, grpc.Header(&header)); err == nil {
+		t.Fatal("lookup in unindexed shortener succeeded")
+	}
+	if ids := header.Get(RequestIDHeader); len(ids) != 1 || ids[0] != "abc-123" {
+		t.Errorf("got request IDs %q", ids)
+	}
+	var e accessEntry
+	if err := json.Unmarshal(buf.Bytes(), &e); err != nil {
+		t.Fatal(err)
+	}
+	if e.RequestID != "abc-123" || e.URI != "/urlteam.lookup.v1.LookupService/Lookup" || e.GRPCCode != "NotFound" {
+		t.Errorf("got entry %+v", e)
+	}
+}
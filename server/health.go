@@ -0,0 +1,62 @@
+// Copyright (c) 2021 Andrew Archibald
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package server
+
+import (
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/andrewarchi/urlhero/logger"
+)
+
+// Warm reads the index into the page cache, then marks the server as
+// ready.
+func (s *Server) Warm() error {
+	g := s.gens.acquire()
+	defer g.release()
+	start := time.Now()
+	if err := g.idx.Warm(); err != nil {
+		return err
+	}
+	logger.Info("warmed index", "hosts", len(g.idx.Hosts()), "elapsed", time.Since(start))
+	s.SetReady(true)
+	return nil
+}
+
+// SetReady sets whether the server reports that it is ready to serve
+// traffic on /readyz. A server is not ready until it is warmed or set
+// ready.
+func (s *Server) SetReady(ready bool) {
+	var v int32
+	if ready {
+		v = 1
+	}
+	atomic.StoreInt32(&s.ready, v)
+}
+
+// Ready reports whether the server is ready to serve traffic.
+func (s *Server) Ready() bool {
+	return atomic.LoadInt32(&s.ready) != 0
+}
+
+// handleHealthz reports that the process is live.
+func (s *Server) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write([]byte("ok\n"))
+}
+
+// handleReadyz reports whether the index is loaded and warmed.
+func (s *Server) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if !s.Ready() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte("not ready\n"))
+		return
+	}
+	w.Write([]byte("ok\n"))
+}
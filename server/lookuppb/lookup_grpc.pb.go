@@ -0,0 +1,388 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.2.0
+// - protoc             v3.21.12
+// source: server/lookuppb/lookup.proto
+
+package lookuppb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+// LookupServiceClient is the client API for LookupService service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type LookupServiceClient interface {
+	// Lookup finds the target of a shortcode.
+	Lookup(ctx context.Context, in *LookupRequest, opts ...grpc.CallOption) (*Mapping, error)
+	// BulkLookup looks up a stream of shortcodes and returns a mapping for
+	// each, in request order.
+	BulkLookup(ctx context.Context, opts ...grpc.CallOption) (LookupService_BulkLookupClient, error)
+	// BatchLookup looks up a stream of batches of shortcodes and returns
+	// the mappings of each batch, in request order. Batches are looked up
+	// together, so pipelines that resolve millions of shortcodes should
+	// prefer it to BulkLookup.
+	BatchLookup(ctx context.Context, opts ...grpc.CallOption) (LookupService_BatchLookupClient, error)
+	// PrefixScan streams the mappings with shortcodes starting with a
+	// prefix, in increasing shortcode order.
+	PrefixScan(ctx context.Context, in *PrefixScanRequest, opts ...grpc.CallOption) (LookupService_PrefixScanClient, error)
+	// ReverseLookup streams the mappings that redirect to a target.
+	ReverseLookup(ctx context.Context, in *ReverseLookupRequest, opts ...grpc.CallOption) (LookupService_ReverseLookupClient, error)
+}
+
+type lookupServiceClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewLookupServiceClient(cc grpc.ClientConnInterface) LookupServiceClient {
+	return &lookupServiceClient{cc}
+}
+
+func (c *lookupServiceClient) Lookup(ctx context.Context, in *LookupRequest, opts ...grpc.CallOption) (*Mapping, error) {
+	out := new(Mapping)
+	err := c.cc.Invoke(ctx, "/urlteam.lookup.v1.LookupService/Lookup", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *lookupServiceClient) BulkLookup(ctx context.Context, opts ...grpc.CallOption) (LookupService_BulkLookupClient, error) {
+	stream, err := c.cc.NewStream(ctx, &LookupService_ServiceDesc.Streams[0], "/urlteam.lookup.v1.LookupService/BulkLookup", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &lookupServiceBulkLookupClient{stream}
+	return x, nil
+}
+
+type LookupService_BulkLookupClient interface {
+	Send(*LookupRequest) error
+	Recv() (*Mapping, error)
+	grpc.ClientStream
+}
+
+type lookupServiceBulkLookupClient struct {
+	grpc.ClientStream
+}
+
+func (x *lookupServiceBulkLookupClient) Send(m *LookupRequest) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *lookupServiceBulkLookupClient) Recv() (*Mapping, error) {
+	m := new(Mapping)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *lookupServiceClient) BatchLookup(ctx context.Context, opts ...grpc.CallOption) (LookupService_BatchLookupClient, error) {
+	stream, err := c.cc.NewStream(ctx, &LookupService_ServiceDesc.Streams[1], "/urlteam.lookup.v1.LookupService/BatchLookup", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &lookupServiceBatchLookupClient{stream}
+	return x, nil
+}
+
+type LookupService_BatchLookupClient interface {
+	Send(*BatchLookupRequest) error
+	Recv() (*BatchLookupResponse, error)
+	grpc.ClientStream
+}
+
+type lookupServiceBatchLookupClient struct {
+	grpc.ClientStream
+}
+
+func (x *lookupServiceBatchLookupClient) Send(m *BatchLookupRequest) error {
+	return x.ClientStream.SendMsg(m)
+}
+
+func (x *lookupServiceBatchLookupClient) Recv() (*BatchLookupResponse, error) {
+	m := new(BatchLookupResponse)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *lookupServiceClient) PrefixScan(ctx context.Context, in *PrefixScanRequest, opts ...grpc.CallOption) (LookupService_PrefixScanClient, error) {
+	stream, err := c.cc.NewStream(ctx, &LookupService_ServiceDesc.Streams[2], "/urlteam.lookup.v1.LookupService/PrefixScan", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &lookupServicePrefixScanClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type LookupService_PrefixScanClient interface {
+	Recv() (*Mapping, error)
+	grpc.ClientStream
+}
+
+type lookupServicePrefixScanClient struct {
+	grpc.ClientStream
+}
+
+func (x *lookupServicePrefixScanClient) Recv() (*Mapping, error) {
+	m := new(Mapping)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *lookupServiceClient) ReverseLookup(ctx context.Context, in *ReverseLookupRequest, opts ...grpc.CallOption) (LookupService_ReverseLookupClient, error) {
+	stream, err := c.cc.NewStream(ctx, &LookupService_ServiceDesc.Streams[3], "/urlteam.lookup.v1.LookupService/ReverseLookup", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &lookupServiceReverseLookupClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type LookupService_ReverseLookupClient interface {
+	Recv() (*Mapping, error)
+	grpc.ClientStream
+}
+
+type lookupServiceReverseLookupClient struct {
+	grpc.ClientStream
+}
+
+func (x *lookupServiceReverseLookupClient) Recv() (*Mapping, error) {
+	m := new(Mapping)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// LookupServiceServer is the server API for LookupService service.
+// All implementations must embed UnimplementedLookupServiceServer
+// for forward compatibility
+type LookupServiceServer interface {
+	// Lookup finds the target of a shortcode.
+	Lookup(context.Context, *LookupRequest) (*Mapping, error)
+	// BulkLookup looks up a stream of shortcodes and returns a mapping for
+	// each, in request order.
+	BulkLookup(LookupService_BulkLookupServer) error
+	// BatchLookup looks up a stream of batches of shortcodes and returns
+	// the mappings of each batch, in request order. Batches are looked up
+	// together, so pipelines that resolve millions of shortcodes should
+	// prefer it to BulkLookup.
+	BatchLookup(LookupService_BatchLookupServer) error
+	// PrefixScan streams the mappings with shortcodes starting with a
+	// prefix, in increasing shortcode order.
+	PrefixScan(*PrefixScanRequest, LookupService_PrefixScanServer) error
+	// ReverseLookup streams the mappings that redirect to a target.
+	ReverseLookup(*ReverseLookupRequest, LookupService_ReverseLookupServer) error
+	mustEmbedUnimplementedLookupServiceServer()
+}
+
+// UnimplementedLookupServiceServer must be embedded to have forward compatible implementations.
+type UnimplementedLookupServiceServer struct {
+}
+
+func (UnimplementedLookupServiceServer) Lookup(context.Context, *LookupRequest) (*Mapping, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Lookup not implemented")
+}
+func (UnimplementedLookupServiceServer) BulkLookup(LookupService_BulkLookupServer) error {
+	return status.Errorf(codes.Unimplemented, "method BulkLookup not implemented")
+}
+func (UnimplementedLookupServiceServer) BatchLookup(LookupService_BatchLookupServer) error {
+	return status.Errorf(codes.Unimplemented, "method BatchLookup not implemented")
+}
+func (UnimplementedLookupServiceServer) PrefixScan(*PrefixScanRequest, LookupService_PrefixScanServer) error {
+	return status.Errorf(codes.Unimplemented, "method PrefixScan not implemented")
+}
+func (UnimplementedLookupServiceServer) ReverseLookup(*ReverseLookupRequest, LookupService_ReverseLookupServer) error {
+	return status.Errorf(codes.Unimplemented, "method ReverseLookup not implemented")
+}
+func (UnimplementedLookupServiceServer) mustEmbedUnimplementedLookupServiceServer() {}
+
+// UnsafeLookupServiceServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to LookupServiceServer will
+// result in compilation errors.
+type UnsafeLookupServiceServer interface {
+	mustEmbedUnimplementedLookupServiceServer()
+}
+
+func RegisterLookupServiceServer(s grpc.ServiceRegistrar, srv LookupServiceServer) {
+	s.RegisterService(&LookupService_ServiceDesc, srv)
+}
+
+func _LookupService_Lookup_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(LookupRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(LookupServiceServer).Lookup(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/urlteam.lookup.v1.LookupService/Lookup",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(LookupServiceServer).Lookup(ctx, req.(*LookupRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _LookupService_BulkLookup_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(LookupServiceServer).BulkLookup(&lookupServiceBulkLookupServer{stream})
+}
+
+type LookupService_BulkLookupServer interface {
+	Send(*Mapping) error
+	Recv() (*LookupRequest, error)
+	grpc.ServerStream
+}
+
+type lookupServiceBulkLookupServer struct {
+	grpc.ServerStream
+}
+
+func (x *lookupServiceBulkLookupServer) Send(m *Mapping) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *lookupServiceBulkLookupServer) Recv() (*LookupRequest, error) {
+	m := new(LookupRequest)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func _LookupService_BatchLookup_Handler(srv interface{}, stream grpc.ServerStream) error {
+	return srv.(LookupServiceServer).BatchLookup(&lookupServiceBatchLookupServer{stream})
+}
+
+type LookupService_BatchLookupServer interface {
+	Send(*BatchLookupResponse) error
+	Recv() (*BatchLookupRequest, error)
+	grpc.ServerStream
+}
+
+type lookupServiceBatchLookupServer struct {
+	grpc.ServerStream
+}
+
+func (x *lookupServiceBatchLookupServer) Send(m *BatchLookupResponse) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func (x *lookupServiceBatchLookupServer) Recv() (*BatchLookupRequest, error) {
+	m := new(BatchLookupRequest)
+	if err := x.ServerStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func _LookupService_PrefixScan_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(PrefixScanRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(LookupServiceServer).PrefixScan(m, &lookupServicePrefixScanServer{stream})
+}
+
+type LookupService_PrefixScanServer interface {
+	Send(*Mapping) error
+	grpc.ServerStream
+}
+
+type lookupServicePrefixScanServer struct {
+	grpc.ServerStream
+}
+
+func (x *lookupServicePrefixScanServer) Send(m *Mapping) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _LookupService_ReverseLookup_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(ReverseLookupRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(LookupServiceServer).ReverseLookup(m, &lookupServiceReverseLookupServer{stream})
+}
+
+type LookupService_ReverseLookupServer interface {
+	Send(*Mapping) error
+	grpc.ServerStream
+}
+
+type lookupServiceReverseLookupServer struct {
+	grpc.ServerStream
+}
+
+func (x *lookupServiceReverseLookupServer) Send(m *Mapping) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+// LookupService_ServiceDesc is the grpc.ServiceDesc for LookupService service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var LookupService_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "urlteam.lookup.v1.LookupService",
+	HandlerType: (*LookupServiceServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Lookup",
+			Handler:    _LookupService_Lookup_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "BulkLookup",
+			Handler:       _LookupService_BulkLookup_Handler,
+			ServerStreams: true,
+			ClientStreams: true,
+		},
+		{
+			StreamName:    "BatchLookup",
+			Handler:       _LookupService_BatchLookup_Handler,
+			ServerStreams: true,
+			ClientStreams: true,
+		},
+		{
+			StreamName:    "PrefixScan",
+			Handler:       _LookupService_PrefixScan_Handler,
+			ServerStreams: true,
+		},
+		{
+			StreamName:    "ReverseLookup",
+			Handler:       _LookupService_ReverseLookup_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "server/lookuppb/lookup.proto",
+}
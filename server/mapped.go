@@ -0,0 +1,157 @@
+// Copyright (c) 2021 Andrew Archibald
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package server
+
+import (
+	"net/http"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/andrewarchi/urlhero/index"
+	"github.com/andrewarchi/urlhero/logger"
+)
+
+// lookupBuf holds the buffers of a lookup in a mapped index.
+type lookupBuf struct {
+	target, body []byte
+}
+
+var lookupBufs = sync.Pool{New: func() interface{} { return new(lookupBuf) }}
+
+var jsonContentType = []string{"application/json"}
+
+// handleMappedLookup serves a lookup in a mapped index without
+// allocating. The response is the same as handleLookup, but is encoded
+// by hand into pooled buffers.
+func (s *Server) handleMappedLookup(w http.ResponseWriter, reader *index.Reader, shortcode string) {
+	buf := lookupBufs.Get().(*lookupBuf)
+	defer lookupBufs.Put(buf)
+	meta := reader.Meta()
+	var found bool
+	var err error
+	buf.target, found, err = reader.AppendLookup(buf.target[:0], shortcode)
+	if err != nil {
+		logger.Error("lookup failed", "host", meta.Host, "shortcode", shortcode, "err", err)
+		writeError(w, http.StatusInternalServerError, "lookup failed")
+		return
+	}
+	s.metrics.lookup(meta.Host, found)
+
+	b := append(buf.body[:0], `{"host":`...)
+	b = appendJSONString(b, meta.Host)
+	b = append(b, `,"shortcode":`...)
+	b = appendJSONString(b, shortcode)
+	status := http.StatusOK
+	if found {
+		if len(buf.target) != 0 {
+			b = append(b, `,"target":`...)
+			b = appendJSONBytes(b, buf.target)
+		}
+		b = append(b, `,"found":true,"provenance":{`...)
+		if len(meta.Projects) != 0 {
+			b = append(b, `"projects":[`...)
+			for i, p := range meta.Projects {
+				if i != 0 {
+					b = append(b, ',')
+				}
+				b = appendJSONString(b, p)
+			}
+			b = append(b, ']')
+		}
+		b = append(b, "}}\n"...)
+	} else {
+		status = http.StatusNotFound
+		b = append(b, ",\"found\":false}\n"...)
+	}
+	buf.body = b
+
+	w.Header()["Content-Type"] = jsonContentType
+	w.WriteHeader(status)
+	if _, err := w.Write(b); err != nil {
+		logger.Debug("writing response", "err", err)
+	}
+}
+
+// appendJSONString appends s as a JSON string, escaped like
+// encoding/json.
+func appendJSONString(b []byte, s string) []byte {
+	b = append(b, '"')
+	start := 0
+	for i := 0; i < len(s); {
+		if c := s[i]; c < utf8.RuneSelf {
+			if jsonSafe(c) {
+				i++
+				continue
+			}
+			b = appendJSONEscape(append(b, s[start:i]...), rune(c))
+			i++
+			start = i
+			continue
+		}
+		r, size := utf8.DecodeRuneInString(s[i:])
+		if (r == utf8.RuneError && size == 1) || r == '\u2028' || r == '\u2029' {
+			b = appendJSONEscape(append(b, s[start:i]...), r)
+			start = i + size
+		}
+		i += size
+	}
+	b = append(b, s[start:]...)
+	return append(b, '"')
+}
+
+// appendJSONBytes appends s as a JSON string, escaped like
+// encoding/json.
+func appendJSONBytes(b []byte, s []byte) []byte {
+	b = append(b, '"')
+	start := 0
+	for i := 0; i < len(s); {
+		if c := s[i]; c < utf8.RuneSelf {
+			if jsonSafe(c) {
+				i++
+				continue
+			}
+			b = appendJSONEscape(append(b, s[start:i]...), rune(c))
+			i++
+			start = i
+			continue
+		}
+		r, size := utf8.DecodeRune(s[i:])
+		if (r == utf8.RuneError && size == 1) || r == '\u2028' || r == '\u2029' {
+			b = appendJSONEscape(append(b, s[start:i]...), r)
+			start = i + size
+		}
+		i += size
+	}
+	b = append(b, s[start:]...)
+	return append(b, '"')
+}
+
+// jsonSafe reports whether an ASCII character is written unescaped in
+// JSON strings by encoding/json, with HTML escaping.
+func jsonSafe(c byte) bool {
+	return c >= 0x20 && c != '"' && c != '\\' && c != '<' && c != '>' && c != '&'
+}
+
+const hex = "0123456789abcdef"
+
+// appendJSONEscape appends the escape sequence of an unsafe rune. Invalid
+// UTF-8 is replaced with U+FFFD.
+func appendJSONEscape(b []byte, r rune) []byte {
+	switch r {
+	case '"', '\\':
+		return append(b, '\\', byte(r))
+	case '\n':
+		return append(b, '\\', 'n')
+	case '\r':
+		return append(b, '\\', 'r')
+	case '\t':
+		return append(b, '\\', 't')
+	case utf8.RuneError:
+		return append(b, "\uFFFD"...)
+	}
+	return append(b, '\\', 'u', hex[r>>12&0xf], hex[r>>8&0xf], hex[r>>4&0xf], hex[r&0xf])
+}
@@ -0,0 +1,187 @@
+// Copyright (c) 2021 Andrew Archibald
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/andrewarchi/urlhero/ia"
+	"github.com/andrewarchi/urlhero/index"
+	"github.com/andrewarchi/urlhero/logger"
+	"github.com/andrewarchi/urlhero/shorteners"
+	"github.com/andrewarchi/urlhero/tinytown"
+)
+
+// memento is the archived redirect of a short URL, as defined by the
+// Memento protocol, RFC 7089.
+type memento struct {
+	original string // URI-R, the short URL
+	target   string
+	datetime time.Time
+}
+
+// collapsedScheme matches the scheme of a URL in a path where a proxy
+// has collapsed the slashes.
+var collapsedScheme = regexp.MustCompile(`^(?i)(https?):/+`)
+
+// handleMemento serves the Memento TimeMap, TimeGate, and mementos of
+// short URLs. Each archived short URL has a single memento, its
+// redirect, which is dated by the most recent release of the shortener,
+// by which the redirect had been archived.
+func (s *Server) handleMemento(w http.ResponseWriter, r *http.Request, g *generation) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	path := strings.TrimPrefix(r.URL.Path, "/memento/")
+	var kind, shortURL string
+	switch {
+	case strings.HasPrefix(path, "timemap/link/"):
+		kind, shortURL = "timemap", strings.TrimPrefix(path, "timemap/link/")
+	case strings.HasPrefix(path, "timegate/"):
+		kind, shortURL = "timegate", strings.TrimPrefix(path, "timegate/")
+	default:
+		i := strings.IndexByte(path, '/')
+		if i == -1 {
+			writeError(w, http.StatusNotFound, "not found")
+			return
+		}
+		kind, shortURL = path[:i], path[i+1:]
+		if _, err := time.Parse(ia.TimestampFormat, kind); err != nil {
+			writeError(w, http.StatusNotFound, "not found")
+			return
+		}
+	}
+	if r.URL.RawQuery != "" {
+		shortURL += "?" + r.URL.RawQuery
+	}
+	m, status, err := s.findMemento(r.Context(), g, shortURL)
+	if err != nil {
+		writeError(w, status, err.Error())
+		return
+	}
+
+	base := s.baseURL(r)
+	timegate := base + "/memento/timegate/" + m.original
+	timemap := base + "/memento/timemap/link/" + m.original
+	mementoURL := base + "/memento/" + m.datetime.Format(ia.TimestampFormat) + "/" + m.original
+	datetime := m.datetime.Format(http.TimeFormat)
+	mementoLink := fmt.Sprintf(`<%s>; rel="first last memento"; datetime="%s"`, mementoURL, datetime)
+	h := w.Header()
+	switch kind {
+	case "timemap":
+		h.Set("Content-Type", "application/link-format")
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprintf(w, "<%s>; rel=\"original\",\n<%s>; rel=\"timegate\",\n"+
+			"<%s>; rel=\"self\"; type=\"application/link-format\"; from=\"%s\"; until=\"%s\",\n%s\n",
+			m.original, timegate, timemap, datetime, datetime, mementoLink)
+	case "timegate":
+		if ad := r.Header.Get("Accept-Datetime"); ad != "" {
+			if _, err := http.ParseTime(ad); err != nil {
+				writeError(w, http.StatusBadRequest, "invalid Accept-Datetime")
+				return
+			}
+		}
+		// The only memento is the closest to any requested datetime
+		h.Set("Vary", "accept-datetime")
+		h.Set("Link", fmt.Sprintf(`<%s>; rel="original", <%s>; rel="timemap"; type="application/link-format", %s`,
+			m.original, timemap, mementoLink))
+		http.Redirect(w, r, mementoURL, http.StatusFound)
+	default:
+		if kind != m.datetime.Format(ia.TimestampFormat) {
+			http.Redirect(w, r, mementoURL, http.StatusFound)
+			return
+		}
+		h.Set("Memento-Datetime", datetime)
+		h.Set("Link", fmt.Sprintf(`<%s>; rel="original", <%s>; rel="timegate", <%s>; rel="timemap"; type="application/link-format"`,
+			m.original, timegate, timemap))
+		http.Redirect(w, r, m.target, http.StatusMovedPermanently)
+	}
+}
+
+// findMemento looks up the memento of a short URL. An error is returned
+// with the HTTP status for it, when not found.
+func (s *Server) findMemento(ctx context.Context, g *generation, shortURL string) (*memento, int, error) {
+	shortURL = collapsedScheme.ReplaceAllString(shortURL, "$1://")
+	if !strings.Contains(shortURL, "://") {
+		shortURL = "http://" + shortURL
+	}
+	host, shortcode, err := shorteners.ParseShortURL(shortURL)
+	if err != nil {
+		return nil, http.StatusBadRequest, err
+	}
+	if shortcode == "" {
+		return nil, http.StatusBadRequest, fmt.Errorf("no shortcode in URL: %q", shortURL)
+	}
+	reader := g.idx.Reader(host)
+	if reader == nil {
+		return nil, http.StatusNotFound, fmt.Errorf("shortener not indexed: %s", host)
+	}
+	mapping, err := g.lookup(ctx, reader, shortcode)
+	if err != nil {
+		logger.Error("lookup failed", "host", host, "shortcode", shortcode, "err", err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("lookup failed")
+	}
+	s.metrics.lookup(host, mapping.Found)
+	if !mapping.Found {
+		return nil, http.StatusNotFound, fmt.Errorf("shortcode not archived: %s/%s", host, shortcode)
+	}
+	var datetime time.Time
+	if p := mapping.Provenance; p != nil && p.FirstSeen != nil {
+		datetime = *p.FirstSeen
+	} else if datetime, err = archiveTime(reader); err != nil {
+		logger.Error("dating memento failed", "host", host, "err", err)
+		return nil, http.StatusInternalServerError, fmt.Errorf("lookup failed")
+	}
+	return &memento{shortURLPrefix(host) + shortcode, mapping.Target, datetime}, 0, nil
+}
+
+// archiveTime returns the time of the most recent release of a
+// shortener, for mementos of mappings that were not dated by the
+// provenance log. Indexes without releases are dated by their modification
+// time, which is likewise after every record was archived.
+func archiveTime(reader *index.Reader) (time.Time, error) {
+	var latest time.Time
+	for _, id := range reader.Meta().Releases {
+		if t, err := tinytown.ReleaseTime(id); err == nil && t.After(latest) {
+			latest = t
+		}
+	}
+	if !latest.IsZero() {
+		return latest, nil
+	}
+	t, err := reader.ModTime()
+	return t.UTC().Truncate(time.Second), err
+}
+
+// baseURL returns the scheme and host that the request was made to.
+func (s *Server) baseURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	if s.opts.TrustProxy {
+		if proto := r.Header.Get("X-Forwarded-Proto"); proto == "http" || proto == "https" {
+			scheme = proto
+		}
+	}
+	return scheme + "://" + r.Host
+}
+
+// shortURLPrefix returns the prefix of short URLs for a host.
+func shortURLPrefix(host string) string {
+	if reg, ok := shorteners.Lookup[host]; ok && reg.Prefix != "" {
+		return reg.Prefix
+	}
+	return "http://" + host + "/"
+}
@@ -0,0 +1,167 @@
+// Copyright (c) 2021 Andrew Archibald
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package server
+
+import (
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/andrewarchi/urlhero/index"
+	"github.com/andrewarchi/urlhero/tracing"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.10.0"
+)
+
+// metrics are the Prometheus collectors of a server.
+type metrics struct {
+	registry *prometheus.Registry
+	requests *prometheus.CounterVec
+	duration *prometheus.HistogramVec
+	inFlight prometheus.Gauge
+	lookups  *prometheus.CounterVec
+	counters atomic.Value // *lookupCounters
+}
+
+// lookupCounters are the lookup counters of indexed hosts, resolved in
+// advance, so that recording lookups does not allocate.
+type lookupCounters struct {
+	hits, misses map[string]prometheus.Counter // key: host
+}
+
+func newMetrics(gens *generations) *metrics {
+	m := &metrics{
+		registry: prometheus.NewRegistry(),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "urlteam_http_requests_total",
+			Help: "Number of HTTP requests by endpoint and status code.",
+		}, []string{"endpoint", "code"}),
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "urlteam_http_request_duration_seconds",
+			Help:    "Latency of HTTP requests by endpoint.",
+			Buckets: []float64{.0001, .0005, .001, .005, .01, .05, .1, .5, 1, 5},
+		}, []string{"endpoint"}),
+		inFlight: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "urlteam_http_requests_in_flight",
+			Help: "Number of HTTP requests being served.",
+		}),
+		lookups: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "urlteam_lookups_total",
+			Help: "Number of shortcode lookups by host and result, hit or miss.",
+		}, []string{"host", "result"}),
+	}
+	g := gens.acquire()
+	m.setHosts(g.idx.Hosts())
+	g.release()
+	gens.onSwap = func(idx *index.Index) { m.setHosts(idx.Hosts()) }
+	m.registry.MustRegister(
+		m.requests, m.duration, m.inFlight, m.lookups,
+		&indexCollector{gens},
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	return m
+}
+
+// setHosts resolves the lookup counters of the indexed hosts.
+func (m *metrics) setHosts(hosts []string) {
+	c := &lookupCounters{
+		hits:   make(map[string]prometheus.Counter, len(hosts)),
+		misses: make(map[string]prometheus.Counter, len(hosts)),
+	}
+	for _, host := range hosts {
+		c.hits[host] = m.lookups.WithLabelValues(host, "hit")
+		c.misses[host] = m.lookups.WithLabelValues(host, "miss")
+	}
+	m.counters.Store(c)
+}
+
+// handler serves the metrics in the Prometheus exposition format.
+func (m *metrics) handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// instrument wraps a handler to record requests to an endpoint, in
+// metrics and a trace span.
+func (m *metrics) instrument(endpoint string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		m.inFlight.Inc()
+		defer m.inFlight.Dec()
+		start := time.Now()
+		ctx, span := tracing.StartServer(r.Context(), "HTTP "+endpoint, r.Header,
+			semconv.HTTPMethodKey.String(r.Method), semconv.HTTPTargetKey.String(r.URL.Path))
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		h(sw, r.WithContext(ctx))
+		span.SetAttributes(semconv.HTTPStatusCodeKey.Int(sw.status))
+		if sw.status >= 500 {
+			span.SetStatus(codes.Error, http.StatusText(sw.status))
+		}
+		span.End()
+		m.duration.WithLabelValues(endpoint).Observe(time.Since(start).Seconds())
+		m.requests.WithLabelValues(endpoint, strconv.Itoa(sw.status)).Inc()
+	}
+}
+
+// lookup records the result of a lookup.
+func (m *metrics) lookup(host string, found bool) {
+	c := m.counters.Load().(*lookupCounters)
+	counters := c.misses
+	if found {
+		counters = c.hits
+	}
+	if c, ok := counters[host]; ok {
+		c.Inc()
+		return
+	}
+	result := "miss"
+	if found {
+		result = "hit"
+	}
+	m.lookups.WithLabelValues(host, result).Inc()
+}
+
+// statusWriter records the status code of a response.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// Flush implements http.Flusher, for streaming responses.
+func (w *statusWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// indexCollector reports the size of the index.
+type indexCollector struct {
+	gens *generations
+}
+
+var indexShortcodesDesc = prometheus.NewDesc("urlteam_index_shortcodes",
+	"Number of indexed shortcodes by host.", []string{"host"}, nil)
+
+func (c *indexCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- indexShortcodesDesc
+}
+
+func (c *indexCollector) Collect(ch chan<- prometheus.Metric) {
+	g := c.gens.acquire()
+	defer g.release()
+	for _, host := range g.idx.Hosts() {
+		ch <- prometheus.MustNewConstMetric(indexShortcodesDesc, prometheus.GaugeValue, float64(g.idx.Len(host)), host)
+	}
+}
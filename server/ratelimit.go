@@ -0,0 +1,151 @@
+// Copyright (c) 2021 Andrew Archibald
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package server
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// clientIdleTimeout is how long the rate limiter of an idle client is
+// kept.
+const clientIdleTimeout = 10 * time.Minute
+
+// rateLimiter limits the request rate of each client with a token
+// bucket. Clients are identified by their valid token, if any, or
+// otherwise by IP address, so that invalid tokens are limited with the
+// address that guesses them.
+type rateLimiter struct {
+	mu         sync.Mutex
+	limit      rate.Limit
+	burst      int
+	trustProxy bool
+	auth       *authenticator // nil when authentication is disabled
+	clients    map[string]*client
+	lastSweep  time.Time
+}
+
+type client struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+func newRateLimiter(limit float64, burst int, trustProxy bool, auth *authenticator) *rateLimiter {
+	if burst < 1 {
+		burst = int(math.Ceil(limit))
+	}
+	return &rateLimiter{
+		limit:      rate.Limit(limit),
+		burst:      burst,
+		trustProxy: trustProxy,
+		auth:       auth,
+		clients:    make(map[string]*client),
+		lastSweep:  time.Now(),
+	}
+}
+
+// reserve takes a token from the bucket of a client and returns the
+// delay until the request may proceed.
+func (rl *rateLimiter) reserve(key string, now time.Time) time.Duration {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	if now.Sub(rl.lastSweep) >= clientIdleTimeout {
+		for k, c := range rl.clients {
+			if now.Sub(c.lastSeen) >= clientIdleTimeout {
+				delete(rl.clients, k)
+			}
+		}
+		rl.lastSweep = now
+	}
+	c, ok := rl.clients[key]
+	if !ok {
+		c = &client{limiter: rate.NewLimiter(rl.limit, rl.burst)}
+		rl.clients[key] = c
+	}
+	c.lastSeen = now
+	if c.limiter.AllowN(now, 1) {
+		return 0
+	}
+	r := c.limiter.ReserveN(now, 1)
+	delay := r.DelayFrom(now)
+	r.CancelAt(now)
+	return delay
+}
+
+// middleware rejects requests over the rate limit with 429 Too Many
+// Requests.
+func (rl *rateLimiter) middleware(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if delay := rl.reserve(rl.clientKey(r), time.Now()); delay > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(delay.Seconds()))))
+			writeError(w, http.StatusTooManyRequests, "rate limit exceeded")
+			return
+		}
+		h(w, r)
+	}
+}
+
+// clientKey identifies the client of a request.
+func (rl *rateLimiter) clientKey(r *http.Request) string {
+	if rl.auth != nil {
+		if t := rl.auth.lookup(bearerToken(r)); t != nil {
+			return "token:" + t.Name
+		}
+	}
+	return "ip:" + clientIP(r, rl.trustProxy)
+}
+
+// bearerToken returns the bearer token of the Authorization header.
+func bearerToken(r *http.Request) string {
+	auth := r.Header.Get("Authorization")
+	if len(auth) > len("Bearer ") && strings.EqualFold(auth[:len("Bearer ")], "Bearer ") {
+		return strings.TrimSpace(auth[len("Bearer "):])
+	}
+	return ""
+}
+
+// clientIP returns the IP address of the client of a request. When the
+// server is behind a trusted proxy, the last address in
+// X-Forwarded-For is used, which is the one that the proxy appended.
+// Earlier addresses are sent by the client, so may be spoofed.
+func clientIP(r *http.Request, trustProxy bool) string {
+	if trustProxy {
+		if fwds := r.Header.Values("X-Forwarded-For"); len(fwds) != 0 {
+			fwd := fwds[len(fwds)-1]
+			if i := strings.LastIndexByte(fwd, ','); i != -1 {
+				fwd = fwd[i+1:]
+			}
+			if fwd = strings.TrimSpace(fwd); fwd != "" {
+				return fwd
+			}
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// limitBody limits the size of request bodies.
+func limitBody(max int64, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.ContentLength > max {
+			writeError(w, http.StatusRequestEntityTooLarge, "request body larger than "+strconv.FormatInt(max, 10)+" bytes")
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, max)
+		h(w, r)
+	}
+}
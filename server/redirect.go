@@ -0,0 +1,152 @@
+// Copyright (c) 2021 Andrew Archibald
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package server
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/andrewarchi/urlhero/index"
+	"github.com/andrewarchi/urlhero/logger"
+	"github.com/andrewarchi/urlhero/shorteners"
+)
+
+// Redirector is an HTTP handler that resurrects dead shorteners by
+// redirecting requests shaped like the original short URLs to their
+// archived targets. The shortener is selected by the Host header, such
+// as when the shortener's domain is pointed at the server, or by the
+// first path element, as in /bit.ly/abc. Clients that accept JSON, or
+// that request ?format=json, are sent the mapping as in the API,
+// instead of a redirect.
+type Redirector struct {
+	gens       *generations
+	access     *AccessLog // nil when disabled
+	trustProxy bool
+	status     int
+}
+
+// NewRedirector constructs a redirector for the index.
+func NewRedirector(idx *index.Index) *Redirector {
+	return &Redirector{gens: newGenerations(idx, 0), status: http.StatusMovedPermanently}
+}
+
+// Redirector constructs a redirector that serves the same index as the
+// server, including after reloads.
+func (s *Server) Redirector() *Redirector {
+	status := s.opts.RedirectStatus
+	if status == 0 {
+		status = http.StatusMovedPermanently
+	}
+	return &Redirector{gens: s.gens, access: s.opts.AccessLog, trustProxy: s.opts.TrustProxy, status: status}
+}
+
+// ServeHTTP implements http.Handler.
+func (rd *Redirector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if rd.access != nil {
+		rd.access.serve(w, r, rd.trustProxy, rd.redirect)
+		return
+	}
+	rd.redirect(w, r)
+}
+
+func (rd *Redirector) redirect(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	g := rd.gens.acquire()
+	defer g.release()
+	reader, u := shortURL(g.idx, r)
+	if reader == nil {
+		http.NotFound(w, r)
+		return
+	}
+	shortcode := strings.TrimLeft(u.Path, "/")
+	if s, ok := shorteners.Lookup[reader.Meta().Host]; ok {
+		var err error
+		if shortcode, err = s.CleanURL(u); err != nil {
+			http.NotFound(w, r)
+			return
+		}
+	}
+	if shortcode == "" {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Add("Vary", "Accept")
+	if wantsJSON(r) {
+		m, err := g.lookup(r.Context(), reader, shortcode)
+		if err != nil {
+			logger.Error("lookup failed", "host", reader.Meta().Host, "shortcode", shortcode, "err", err)
+			writeError(w, http.StatusInternalServerError, "lookup failed")
+			return
+		}
+		status := http.StatusOK
+		if !m.Found {
+			status = http.StatusNotFound
+		}
+		writeJSON(w, status, m)
+		return
+	}
+	target, ok, err := g.idx.Lookup(reader.Meta().Host, shortcode)
+	if err != nil {
+		logger.Error("lookup failed", "host", reader.Meta().Host, "shortcode", shortcode, "err", err)
+		http.Error(w, "lookup failed", http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		http.Error(w, "shortcode not archived: "+u.Host+"/"+shortcode, http.StatusNotFound)
+		return
+	}
+	http.Redirect(w, r, target, rd.status)
+}
+
+// wantsJSON reports whether a request asks for the mapping as JSON,
+// rather than a redirect. Browsers following short links do not list
+// JSON in their Accept headers.
+func wantsJSON(r *http.Request) bool {
+	if r.URL.Query().Get("format") == "json" {
+		return true
+	}
+	for _, accept := range r.Header.Values("Accept") {
+		for _, typ := range strings.Split(accept, ",") {
+			if i := strings.IndexByte(typ, ';'); i != -1 {
+				typ = typ[:i]
+			}
+			if strings.TrimSpace(typ) == "application/json" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// shortURL reconstructs the requested short URL and selects the index
+// reader for its shortener.
+func shortURL(idx *index.Index, r *http.Request) (*index.Reader, *url.URL) {
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.TrimPrefix(strings.ToLower(host), "www.")
+	if reader := idx.Reader(host); reader != nil {
+		return reader, &url.URL{Scheme: "http", Host: host, Path: r.URL.Path}
+	}
+	path := strings.TrimPrefix(r.URL.Path, "/")
+	i := strings.IndexByte(path, '/')
+	if i == -1 {
+		return nil, nil
+	}
+	reader, ok := resolve(idx, path[:i])
+	if !ok {
+		return nil, nil
+	}
+	return reader, &url.URL{Scheme: "http", Host: reader.Meta().Host, Path: path[i:]}
+}
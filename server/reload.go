@@ -0,0 +1,151 @@
+// Copyright (c) 2021 Andrew Archibald
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package server
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/andrewarchi/urlhero/index"
+	"github.com/andrewarchi/urlhero/logger"
+)
+
+// generation is an index being served, with the state derived from it.
+// Requests hold its lock for reading while they use it, so that it is
+// not closed until they finish.
+type generation struct {
+	mu     sync.RWMutex
+	closed bool
+	idx    *index.Index
+	etag   []string  // quoted index version
+	cache  *lruCache // nil when disabled
+
+	countMu sync.Mutex
+	counts  map[string]int64 // shortcodes of hosts with several layers
+}
+
+// generations is the current index generation, shared by the HTTP,
+// redirect, and gRPC servers of an index.
+type generations struct {
+	cur       atomic.Value // *generation
+	mu        sync.Mutex   // serializes swaps
+	cacheSize int
+	onSwap    func(idx *index.Index)
+}
+
+func newGenerations(idx *index.Index, cacheSize int) *generations {
+	gs := &generations{cacheSize: cacheSize}
+	gs.cur.Store(gs.newGeneration(idx))
+	return gs
+}
+
+func (gs *generations) newGeneration(idx *index.Index) *generation {
+	g := &generation{idx: idx, etag: []string{`"` + idx.Version() + `"`}}
+	if gs.cacheSize > 0 {
+		g.cache = newLRUCache(gs.cacheSize)
+	}
+	return g
+}
+
+// acquire returns the current generation, which must be released when
+// no longer used.
+func (gs *generations) acquire() *generation {
+	for {
+		g := gs.cur.Load().(*generation)
+		g.mu.RLock()
+		if !g.closed {
+			return g
+		}
+		// Swapped and drained since it was loaded
+		g.mu.RUnlock()
+	}
+}
+
+func (g *generation) release() {
+	g.mu.RUnlock()
+}
+
+// swap replaces the current generation with one for idx, then closes
+// the old index in the background, once requests using it finish.
+func (gs *generations) swap(idx *index.Index) {
+	gs.mu.Lock()
+	old := gs.cur.Load().(*generation)
+	gs.cur.Store(gs.newGeneration(idx))
+	if gs.onSwap != nil {
+		gs.onSwap(idx)
+	}
+	gs.mu.Unlock()
+	go func() {
+		start := time.Now()
+		old.mu.Lock()
+		old.closed = true
+		old.mu.Unlock()
+		if err := old.idx.Close(); err != nil {
+			logger.Error("closing old index failed", "dir", old.idx.Dir(), "err", err)
+		}
+		logger.Info("closed old index", "version", old.idx.Version(), "drained", time.Since(start))
+	}()
+}
+
+// errNoReload is returned by Reload when the server has no Open
+// option.
+var errNoReload = errors.New("server: reloading not configured")
+
+// Reload opens a new generation of the index with Options.Open and
+// atomically swaps to it. Requests in progress finish with the old
+// index, which is then closed.
+func (s *Server) Reload() error {
+	if s.opts.Open == nil {
+		return errNoReload
+	}
+	idx, err := s.opts.Open()
+	if err != nil {
+		return err
+	}
+	s.gens.swap(idx)
+	logger.Info("reloaded index", "version", idx.Version(), "hosts", len(idx.Hosts()))
+	return nil
+}
+
+// Close closes the index being served, once requests using it finish.
+// It should only be called after the HTTP servers are shut down.
+func (s *Server) Close() error {
+	g := s.gens.cur.Load().(*generation)
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.idx.Close()
+}
+
+// ReloadResponse is the body of responses to POST /v1/admin/reload.
+type ReloadResponse struct {
+	Version string `json:"version"`
+	Hosts   int    `json:"hosts"`
+}
+
+// handleReload reloads the index.
+func (s *Server) handleReload(w http.ResponseWriter, r *http.Request, _ *generation) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if err := s.Reload(); err != nil {
+		if err == errNoReload {
+			writeError(w, http.StatusNotImplemented, "reloading not configured")
+			return
+		}
+		logger.Error("reloading index failed", "err", err)
+		writeError(w, http.StatusInternalServerError, "reloading index failed: "+err.Error())
+		return
+	}
+	g := s.gens.acquire()
+	defer g.release()
+	writeJSON(w, http.StatusOK, ReloadResponse{g.idx.Version(), len(g.idx.Hosts())})
+}
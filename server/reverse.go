@@ -0,0 +1,208 @@
+// Copyright (c) 2021 Andrew Archibald
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package server
+
+import (
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/andrewarchi/urlhero/index"
+	"github.com/andrewarchi/urlhero/logger"
+	"github.com/andrewarchi/urlhero/tracing"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// MaxReverseScan is the maximum number of records scanned for a page of
+// reverse lookup results. When reached, the page is returned with a
+// cursor, even if it has fewer results than the limit, so that
+// requests for rare targets stay bounded.
+const MaxReverseScan = 1 << 20
+
+// ReversePage is a page of results of a reverse lookup,
+// GET /v1/reverse.
+type ReversePage struct {
+	Domain   string    `json:"domain,omitempty"`
+	Target   string    `json:"target,omitempty"`
+	Mappings []Mapping `json:"mappings"`
+	Scanned  int64     `json:"scanned"`        // records scanned for this page
+	Next     string    `json:"next,omitempty"` // cursor for ?after=
+}
+
+// handleReverse finds the mappings that redirect to a target URL, with
+// ?target=, or to any URL on a domain or its subdomains, with ?domain=.
+// In a federation, a shortcode matches by its target in the first index
+// that has it.
+func (s *Server) handleReverse(w http.ResponseWriter, r *http.Request, g *generation) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	q := r.URL.Query()
+	p := ReversePage{
+		Domain:   strings.ToLower(strings.TrimSuffix(q.Get("domain"), ".")),
+		Target:   q.Get("target"),
+		Mappings: []Mapping{},
+	}
+	if (p.Domain == "") == (p.Target == "") {
+		writeError(w, http.StatusBadRequest, "exactly one of domain or target is required")
+		return
+	}
+	limit := DefaultLimit
+	if l := q.Get("limit"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n < 1 || n > MaxLimit {
+			writeError(w, http.StatusBadRequest, "limit must be between 1 and "+strconv.Itoa(MaxLimit))
+			return
+		}
+		limit = n
+	}
+	hosts := g.idx.Hosts()
+	if shortener := q.Get("shortener"); shortener != "" {
+		reader, ok := resolve(g.idx, shortener)
+		if !ok {
+			writeError(w, http.StatusNotFound, "shortener not indexed: "+shortener)
+			return
+		}
+		hosts = []string{reader.Meta().Host}
+	}
+	startHost, startCode, err := decodeCursor(q.Get("after"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid cursor")
+		return
+	}
+	if s.cacheable(w, r, g) {
+		return
+	}
+
+	match := func(target string) bool { return target == p.Target }
+	if p.Domain != "" {
+		match = func(target string) bool { return domainMatch(targetHost(target), p.Domain) }
+	}
+	scan := (*index.Reader).Range
+	if p.Domain != "" {
+		// Only the hosts of targets are read, until one matches
+		scan = (*index.Reader).RangeHosts
+	}
+	i := sort.SearchStrings(hosts, startHost)
+	for ; i < len(hosts) && p.Next == ""; i++ {
+		host := hosts[i]
+		layers := g.idx.Layers(host)
+		start := ""
+		if host == startHost {
+			start = startCode
+		}
+		// next counts a record as scanned, unless the page is full
+		next := func(shortcode string) error {
+			if len(p.Mappings) == limit || p.Scanned == MaxReverseScan {
+				p.Next = encodeCursor(host, shortcode)
+				return errLimit
+			}
+			p.Scanned++
+			return nil
+		}
+		_, span := tracing.Start(r.Context(), "index.Range",
+			attribute.String("host", host), attribute.Int("layers", len(layers)))
+		var err error
+		if len(layers) > 1 {
+			// The layers are merged, so that only the newest target of
+			// each shortcode matches
+			err = mergeLayers(layers, start, "", func(m Mapping) error {
+				if err := next(m.Shortcode); err != nil {
+					return err
+				}
+				if match(m.Target) {
+					p.Mappings = append(p.Mappings, m)
+				}
+				return nil
+			})
+		} else {
+			reader := layers[0].Reader
+			err = scan(reader, start, "", func(rec index.Record) error {
+				if err := next(rec.Shortcode); err != nil {
+					return err
+				}
+				if !match(rec.Target) {
+					return nil
+				}
+				if p.Domain != "" {
+					target, _, err := reader.Lookup(rec.Shortcode)
+					if err != nil {
+						return err
+					}
+					rec.Target = target
+				}
+				p.Mappings = append(p.Mappings, Mapping{Host: host, Shortcode: rec.Shortcode, Target: rec.Target, Found: true})
+				return nil
+			})
+		}
+		if err == errLimit {
+			span.End()
+		} else {
+			tracing.End(span, err)
+		}
+		if err != nil && err != errLimit {
+			logger.Error("reverse lookup failed", "host", host, "err", err)
+			writeError(w, http.StatusInternalServerError, "reverse lookup failed")
+			return
+		}
+	}
+	writeJSON(w, http.StatusOK, p)
+}
+
+// encodeCursor encodes the position of the next record to scan as a
+// cursor.
+func encodeCursor(host, shortcode string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(host + "\x00" + shortcode))
+}
+
+// decodeCursor decodes a cursor into the position of the next record to
+// scan.
+func decodeCursor(cursor string) (host, shortcode string, err error) {
+	if cursor == "" {
+		return "", "", nil
+	}
+	b, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return "", "", err
+	}
+	i := strings.IndexByte(string(b), 0)
+	if i == -1 {
+		return "", "", errors.New("invalid cursor")
+	}
+	return string(b[:i]), string(b[i+1:]), nil
+}
+
+// targetHost extracts the lowercase host of a target URL without fully
+// parsing it.
+func targetHost(target string) string {
+	i := strings.Index(target, "://")
+	if i == -1 {
+		return ""
+	}
+	host := target[i+3:]
+	if j := strings.IndexAny(host, "/?#"); j != -1 {
+		host = host[:j]
+	}
+	if j := strings.LastIndexByte(host, '@'); j != -1 {
+		host = host[j+1:]
+	}
+	if j := strings.LastIndexByte(host, ':'); j != -1 && !strings.HasSuffix(host, "]") {
+		host = host[:j]
+	}
+	return strings.ToLower(strings.TrimSuffix(host, "."))
+}
+
+// domainMatch reports whether host is domain or a subdomain of it.
+func domainMatch(host, domain string) bool {
+	return host == domain || (strings.HasSuffix(host, domain) &&
+		len(host) > len(domain) && host[len(host)-len(domain)-1] == '.')
+}
@@ -0,0 +1,554 @@
+// Copyright (c) 2021 Andrew Archibald
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package server serves lookups in a URLTeam index over HTTP.
+//
+// Endpoints:
+//
+//	GET /v1/                         list the indexed shorteners
+//	GET /v1/{shortener}              list shortcodes, optionally with
+//	                                 ?prefix=, ?after=, and ?limit=
+//	GET /v1/{shortener}/{code}       look up the target of a shortcode
+//	POST /v1/lookup                  look up many shortcodes or short URLs
+//	GET /v1/reverse                  find shortcodes by ?target= or ?domain=
+//	GET /v1/export/{shortener}       stream all mappings as NDJSON or BEACON
+//	GET /v1/releases                 list the releases, most recently indexed first
+//	POST /v1/admin/reload            reload the index (admin scope; only
+//	                                 served when tokens are configured)
+//	GET /memento/timemap/link/{url}  Memento TimeMap of a short URL
+//	GET /memento/timegate/{url}      Memento TimeGate of a short URL
+//	GET /memento/{timestamp}/{url}   Memento of a short URL
+//	GET /                            web UI
+//	GET /metrics                     Prometheus metrics
+//	GET /healthz                     liveness probe
+//	GET /readyz                      readiness probe, after Warm or SetReady
+//
+// A shortener is either a registered shortener name, such as "bit-ly",
+// or a host, such as "bit.ly".
+//
+// Redirector serves redirects from short URLs to archived targets, and
+// GRPCServer implements the gRPC lookup service.
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/andrewarchi/urlhero/index"
+	"github.com/andrewarchi/urlhero/logger"
+	"github.com/andrewarchi/urlhero/shorteners"
+	"github.com/andrewarchi/urlhero/tracing"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// Listing limits for the prefix endpoint.
+const (
+	DefaultLimit = 100
+	MaxLimit     = 1000
+)
+
+// Server is an HTTP handler for lookups in an index.
+type Server struct {
+	gens         *generations
+	opts         Options
+	mux          *http.ServeMux
+	metrics      *metrics
+	limiter      *rateLimiter   // nil when disabled
+	auth         *authenticator // nil when disabled
+	cors         *cors          // nil when disabled
+	ready        int32          // accessed atomically
+	memento      http.HandlerFunc
+	cacheControl []string // header value, shared to not allocate
+}
+
+// Options configures a server.
+type Options struct {
+	// CacheSize is the number of lookups kept in the in-memory cache of
+	// hot shortcodes, or 0 to disable it. Single lookups in indexes
+	// opened with index.OpenMmap bypass the cache.
+	CacheSize int
+	// CacheMaxAge is the max-age of Cache-Control headers, or 0 to omit
+	// them. Responses always have ETags.
+	CacheMaxAge time.Duration
+	// RateLimit is the sustained number of requests per second allowed
+	// for each client, or 0 for no limit. RateBurst is the number of
+	// requests a client may make at once.
+	RateLimit float64
+	RateBurst int
+	// TrustProxy identifies clients by the last address of the
+	// X-Forwarded-For header, for servers behind a reverse proxy that
+	// appends it.
+	TrustProxy bool
+	// MaxRequestBytes is the maximum size of request bodies.
+	MaxRequestBytes int64
+	// Tokens are the API tokens that grant access. When empty,
+	// authentication is disabled and every request is allowed, except
+	// to admin endpoints, which are not served. Otherwise, requests
+	// without a token are only granted AnonymousScopes.
+	Tokens          []Token
+	AnonymousScopes []Scope
+	// CORSOrigins are the origins, such as "https://example.org", that
+	// browsers allow to call the API, or "*" for any. When empty, CORS
+	// is disabled. CORSMethods are the methods allowed, by default
+	// DefaultCORSMethods, and CORSMaxAge is how long browsers may cache
+	// preflight responses, or 0 for their default.
+	CORSOrigins []string
+	CORSMethods []string
+	CORSMaxAge  time.Duration
+	// RedirectStatus is the status of the redirects of the redirector,
+	// by default 301 Moved Permanently. 302 Found keeps clients from
+	// caching redirects, for indexes that may yet be corrected.
+	RedirectStatus int
+	// AccessLog logs requests to the server and its redirector, or is
+	// nil to disable access logs.
+	AccessLog *AccessLog
+	// Releases lists the releases that the index was built from, for
+	// GET /v1/releases, or is nil when unknown.
+	Releases func() ([]Release, error)
+	// Open opens a new generation of the index for Reload, or is nil
+	// when reloading is not supported.
+	Open func() (*index.Index, error)
+}
+
+// DefaultOptions are the options used when none are given.
+var DefaultOptions = Options{
+	CacheSize:       10000,
+	CacheMaxAge:     time.Hour,
+	RateLimit:       50,
+	RateBurst:       100,
+	MaxRequestBytes: 1 << 20,
+}
+
+// New constructs a server for the index. When opts is nil,
+// DefaultOptions is used.
+func New(idx *index.Index, opts *Options) *Server {
+	if opts == nil {
+		opts = &DefaultOptions
+	}
+	s := &Server{gens: newGenerations(idx, opts.CacheSize), opts: *opts, mux: http.NewServeMux()}
+	s.metrics = newMetrics(s.gens)
+	if len(opts.Tokens) != 0 {
+		s.auth = newAuthenticator(opts.Tokens, opts.AnonymousScopes)
+	}
+	if opts.RateLimit > 0 {
+		s.limiter = newRateLimiter(opts.RateLimit, opts.RateBurst, opts.TrustProxy, s.auth)
+	}
+	if len(opts.CORSOrigins) != 0 {
+		s.cors = newCORS(opts.CORSOrigins, opts.CORSMethods, opts.CORSMaxAge)
+	}
+	if opts.CacheMaxAge > 0 {
+		s.cacheControl = []string{"public, max-age=" + strconv.Itoa(int(opts.CacheMaxAge.Seconds()))}
+	}
+	if s.opts.MaxRequestBytes <= 0 {
+		s.opts.MaxRequestBytes = DefaultOptions.MaxRequestBytes
+	}
+	s.handle("/v1/", "v1", ScopeRead, s.handleV1)
+	s.handle("/v1/lookup", "bulk", ScopeBulk, s.handleBulk)
+	s.handle("/v1/reverse", "reverse", ScopeRead, s.handleReverse)
+	s.handle("/v1/export/", "export", ScopeBulk, s.handleExport)
+	s.handle("/v1/releases", "releases", ScopeRead, s.handleReleases)
+	s.handle("/v1/admin/reload", "reload", ScopeAdmin, s.handleReload)
+	s.memento = s.wrap("memento", ScopeRead, s.handleMemento)
+	s.mux.Handle("/", s.metrics.instrument("ui", uiHandler().ServeHTTP))
+	s.mux.Handle("/metrics", s.metrics.handler())
+	s.mux.HandleFunc("/healthz", s.handleHealthz)
+	s.mux.HandleFunc("/readyz", s.handleReadyz)
+	return s
+}
+
+// handlerFunc handles a request with the index generation that it is
+// served from.
+type handlerFunc func(w http.ResponseWriter, r *http.Request, g *generation)
+
+// handle registers an API endpoint, which requires the scope.
+func (s *Server) handle(pattern, endpoint string, scope Scope, h handlerFunc) {
+	s.mux.HandleFunc(pattern, s.wrap(endpoint, scope, h))
+}
+
+// wrap wraps the handler of an API endpoint, which requires the scope,
+// with instrumentation, CORS, rate limiting, authentication, and request
+// size limits. Requests are rate limited before they are authenticated,
+// so that failed guesses of tokens count against the limit.
+func (s *Server) wrap(endpoint string, scope Scope, hf handlerFunc) http.HandlerFunc {
+	h := func(w http.ResponseWriter, r *http.Request) {
+		g := s.gens.acquire()
+		defer g.release()
+		hf(w, r, g)
+	}
+	h = limitBody(s.opts.MaxRequestBytes, h)
+	if s.auth != nil {
+		h = s.auth.middleware(scope, h)
+	} else if scope == ScopeAdmin {
+		// Administration is never open to every client, so is disabled
+		// along with authentication
+		h = func(w http.ResponseWriter, r *http.Request) {
+			writeError(w, http.StatusNotFound, "admin endpoints require an admin token")
+		}
+	}
+	if s.limiter != nil {
+		h = s.limiter.middleware(h)
+	}
+	if s.cors != nil {
+		h = s.cors.middleware(h)
+	}
+	return s.metrics.instrument(endpoint, h)
+}
+
+// ServeHTTP implements http.Handler.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if s.opts.AccessLog != nil {
+		s.opts.AccessLog.serve(w, r, s.opts.TrustProxy, s.route)
+		return
+	}
+	s.route(w, r)
+}
+
+func (s *Server) route(w http.ResponseWriter, r *http.Request) {
+	// Memento paths contain URLs, which the mux would clean
+	if strings.HasPrefix(r.URL.Path, "/memento/") {
+		s.memento(w, r)
+		return
+	}
+	s.mux.ServeHTTP(w, r)
+}
+
+// Shortener describes an indexed shortener.
+type Shortener struct {
+	Host     string   `json:"host"`
+	Name     string   `json:"name,omitempty"` // registered name, if any
+	Projects []string `json:"projects,omitempty"`
+	Alphabet string   `json:"alphabet,omitempty"`
+	Count    int64    `json:"count"`
+}
+
+// Mapping is the result of a shortcode lookup.
+type Mapping struct {
+	Host       string      `json:"host"`
+	Shortcode  string      `json:"shortcode"`
+	Target     string      `json:"target,omitempty"`
+	Found      bool        `json:"found"`
+	Provenance *Provenance `json:"provenance,omitempty"`
+	Conflicts  []Conflict  `json:"conflicts,omitempty"` // other targets, in a federated index
+	// History is the other targets that the shortcode has been archived
+	// with, according to the provenance logs, in the order that they
+	// were first seen.
+	History []Version `json:"history,omitempty"`
+}
+
+// Provenance describes where a mapping was archived from.
+type Provenance struct {
+	Projects []string `json:"projects,omitempty"` // terroroftinytown projects
+	Sources  []string `json:"sources,omitempty"`  // federated indexes with the target
+	Releases []string `json:"releases,omitempty"` // releases that archived the target
+	// FirstSeen and LastSeen are when the target was archived, if known
+	FirstSeen *time.Time `json:"first_seen,omitempty"`
+	LastSeen  *time.Time `json:"last_seen,omitempty"`
+}
+
+// Conflict is a different target for a shortcode in a lower-priority
+// index of a federation.
+type Conflict struct {
+	Source string `json:"source"`
+	Target string `json:"target"`
+}
+
+// Version is a target that a shortcode had before it was retargeted or
+// that a conflicting release archived.
+type Version struct {
+	Target    string     `json:"target,omitempty"` // empty when only its hash is known
+	Releases  []string   `json:"releases,omitempty"`
+	FirstSeen *time.Time `json:"first_seen,omitempty"`
+	LastSeen  *time.Time `json:"last_seen,omitempty"`
+}
+
+// Page is a page of shortcodes in a listing.
+type Page struct {
+	Host     string    `json:"host"`
+	Prefix   string    `json:"prefix,omitempty"`
+	Mappings []Mapping `json:"mappings"`
+	Next     string    `json:"next,omitempty"` // cursor for ?after=
+}
+
+// Error is the body of error responses.
+type Error struct {
+	Error string `json:"error"`
+}
+
+func (s *Server) handleV1(w http.ResponseWriter, r *http.Request, g *generation) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	path := strings.TrimPrefix(r.URL.Path, "/v1/")
+	if path == "" {
+		if !s.cacheable(w, r, g) {
+			s.handleShorteners(w, r, g)
+		}
+		return
+	}
+	shortener, shortcode := path, ""
+	if i := strings.IndexByte(path, '/'); i != -1 {
+		shortener, shortcode = path[:i], path[i+1:]
+	}
+	reader, ok := resolve(g.idx, shortener)
+	if !ok {
+		writeError(w, http.StatusNotFound, "shortener not indexed: "+shortener)
+		return
+	}
+	if s.cacheable(w, r, g) {
+		return
+	}
+	if shortcode == "" {
+		s.handlePage(w, r, g, reader)
+	} else {
+		s.handleLookup(w, r, g, reader, shortcode)
+	}
+}
+
+func (s *Server) handleShorteners(w http.ResponseWriter, r *http.Request, g *generation) {
+	list := make([]Shortener, 0, len(g.idx.Hosts()))
+	for _, host := range g.idx.Hosts() {
+		layers := g.idx.Layers(host)
+		meta := layers[0].Meta()
+		count, err := g.count(host)
+		if err != nil {
+			logger.Error("count failed", "host", host, "err", err)
+			writeError(w, http.StatusInternalServerError, "listing failed")
+			return
+		}
+		sh := Shortener{
+			Host:     host,
+			Projects: meta.Projects,
+			Alphabet: meta.Alphabet,
+			Count:    count,
+		}
+		for _, l := range layers[1:] {
+			sh.Projects = appendMissing(sh.Projects, l.Meta().Projects)
+		}
+		if reg, ok := shorteners.Lookup[host]; ok {
+			sh.Name = reg.Name
+		}
+		list = append(list, sh)
+	}
+	writeJSON(w, http.StatusOK, list)
+}
+
+func (s *Server) handleLookup(w http.ResponseWriter, r *http.Request, g *generation, reader *index.Reader, shortcode string) {
+	if reader.Mapped() && reader.Provenance() == nil && len(g.idx.Layers(reader.Meta().Host)) == 1 {
+		s.handleMappedLookup(w, reader, shortcode)
+		return
+	}
+	m, err := g.lookup(r.Context(), reader, shortcode)
+	if err != nil {
+		logger.Error("lookup failed", "host", reader.Meta().Host, "shortcode", shortcode, "err", err)
+		writeError(w, http.StatusInternalServerError, "lookup failed")
+		return
+	}
+	s.metrics.lookup(m.Host, m.Found)
+	status := http.StatusOK
+	if !m.Found {
+		status = http.StatusNotFound
+	}
+	writeJSON(w, status, m)
+}
+
+// lookup finds the target of a shortcode, through the cache.
+func (g *generation) lookup(ctx context.Context, reader *index.Reader, shortcode string) (Mapping, error) {
+	meta := reader.Meta()
+	if g.cache != nil {
+		if m, ok := g.cache.get(meta.Host, shortcode); ok {
+			return m, nil
+		}
+	}
+	layers := g.idx.Layers(meta.Host)
+	_, span := tracing.Start(ctx, "index.Lookup",
+		attribute.String("host", meta.Host), attribute.Int("layers", len(layers)))
+	targets := make([]string, len(layers))
+	found := make([]bool, len(layers))
+	for i, l := range layers {
+		var err error
+		if targets[i], found[i], err = l.Lookup(shortcode); err != nil {
+			tracing.End(span, err)
+			return Mapping{}, err
+		}
+	}
+	m := Mapping{Host: meta.Host, Shortcode: shortcode}
+	m.merge(layers, targets, found)
+	if m.Found {
+		for i, l := range layers {
+			if !found[i] || targets[i] != m.Target {
+				continue
+			}
+			p := l.Provenance()
+			if p == nil {
+				continue
+			}
+			vs, err := p.Cursor().Versions(shortcode, m.Target)
+			if err != nil {
+				tracing.End(span, err)
+				return Mapping{}, err
+			}
+			for _, v := range vs {
+				if v.Target == m.Target {
+					m.Provenance.addOrigin(index.Origin{Releases: v.Releases, FirstSeen: v.FirstSeen, LastSeen: v.LastSeen})
+				} else {
+					m.addVersion(v)
+				}
+			}
+		}
+		sort.SliceStable(m.History, func(i, j int) bool {
+			fi, fj := m.History[i].FirstSeen, m.History[j].FirstSeen
+			return fi != nil && (fj == nil || fi.Before(*fj))
+		})
+	}
+	span.End()
+	if g.cache != nil {
+		g.cache.add(meta.Host, shortcode, m)
+	}
+	return m, nil
+}
+
+// merge sets the result of a lookup from the targets found in each
+// layer of the host. The target is that of the first layer with the
+// shortcode; later layers that agree are attributed with it and those
+// that differ are conflicts, in priority order.
+func (m *Mapping) merge(layers []index.Layer, targets []string, found []bool) {
+	for i, l := range layers {
+		if !found[i] {
+			continue
+		}
+		if !m.Found {
+			m.Target, m.Found = targets[i], true
+			m.Provenance = &Provenance{Projects: l.Meta().Projects}
+			if len(layers) > 1 {
+				m.Provenance.Sources = []string{l.Source}
+			}
+		} else if targets[i] == m.Target {
+			m.Provenance.Projects = appendMissing(m.Provenance.Projects, l.Meta().Projects)
+			m.Provenance.Sources = append(m.Provenance.Sources, l.Source)
+		} else {
+			m.Conflicts = append(m.Conflicts, Conflict{l.Source, targets[i]})
+		}
+	}
+}
+
+// addOrigin adds the releases and times of a layer with the target.
+func (p *Provenance) addOrigin(o index.Origin) {
+	p.Releases = appendMissing(p.Releases, o.Releases)
+	if o.FirstSeen.IsZero() {
+		return
+	}
+	if p.FirstSeen == nil || o.FirstSeen.Before(*p.FirstSeen) {
+		p.FirstSeen = &o.FirstSeen
+	}
+	if p.LastSeen == nil || o.LastSeen.After(*p.LastSeen) {
+		p.LastSeen = &o.LastSeen
+	}
+}
+
+// addVersion adds a version of a layer to the history, merging it with
+// that of another layer with the same target.
+func (m *Mapping) addVersion(v index.Version) {
+	var first, last *time.Time
+	if !v.FirstSeen.IsZero() {
+		first, last = &v.FirstSeen, &v.LastSeen
+	}
+	for i := range m.History {
+		h := &m.History[i]
+		if h.Target != v.Target || v.Target == "" {
+			continue
+		}
+		h.Releases = appendMissing(h.Releases, v.Releases)
+		if first != nil && (h.FirstSeen == nil || first.Before(*h.FirstSeen)) {
+			h.FirstSeen = first
+		}
+		if last != nil && (h.LastSeen == nil || last.After(*h.LastSeen)) {
+			h.LastSeen = last
+		}
+		return
+	}
+	m.History = append(m.History, Version{Target: v.Target, Releases: v.Releases, FirstSeen: first, LastSeen: last})
+}
+
+// appendMissing appends the elements of add that are not in list. list
+// is copied before appending, as it may be shared.
+func appendMissing(list, add []string) []string {
+	copied := false
+outer:
+	for _, a := range add {
+		for _, l := range list {
+			if a == l {
+				continue outer
+			}
+		}
+		if !copied {
+			list = append(list[:len(list):len(list)], a)
+			copied = true
+		} else {
+			list = append(list, a)
+		}
+	}
+	return list
+}
+
+func (s *Server) handlePage(w http.ResponseWriter, r *http.Request, g *generation, reader *index.Reader) {
+	q := r.URL.Query()
+	limit := DefaultLimit
+	if l := q.Get("limit"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n < 1 || n > MaxLimit {
+			writeError(w, http.StatusBadRequest, "limit must be between 1 and "+strconv.Itoa(MaxLimit))
+			return
+		}
+		limit = n
+	}
+	prefix := q.Get("prefix")
+	host := reader.Meta().Host
+	layers := g.idx.Layers(host)
+	_, span := tracing.Start(r.Context(), "index.Page",
+		attribute.String("host", host), attribute.Int("layers", len(layers)))
+	mappings, next, err := pageLayers(layers, prefix, q.Get("after"), limit)
+	tracing.End(span, err)
+	if err != nil {
+		logger.Error("listing failed", "host", host, "prefix", prefix, "err", err)
+		writeError(w, http.StatusInternalServerError, "listing failed")
+		return
+	}
+	if mappings == nil {
+		mappings = []Mapping{}
+	}
+	writeJSON(w, http.StatusOK, Page{Host: host, Prefix: prefix, Mappings: mappings, Next: next})
+}
+
+// resolve resolves a shortener name or host to its index reader.
+func resolve(idx *index.Index, shortener string) (*index.Reader, bool) {
+	host := shortener
+	if reg, ok := shorteners.Lookup[shortener]; ok {
+		host = reg.Host
+	} else if !strings.ContainsRune(shortener, '.') {
+		host = strings.ReplaceAll(shortener, "-", ".")
+	}
+	reader := idx.Reader(host)
+	return reader, reader != nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		logger.Debug("writing response", "err", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, Error{msg})
+}
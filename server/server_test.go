@@ -0,0 +1,1004 @@
+// Copyright (c) 2021 Andrew Archibald
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/andrewarchi/urlhero/index"
+	"github.com/andrewarchi/urlhero/tinytown"
+)
+
+func newTestServer(t *testing.T) *Server {
+	t.Helper()
+	dir := t.TempDir()
+	b := index.NewBuilder()
+	for i := 0; i < 300; i++ {
+		b.Add("bit.ly", index.Record{Shortcode: fmt.Sprintf("%04x", i), Target: fmt.Sprintf("http://example.com/%d", i)})
+	}
+	if err := b.Write(dir); err != nil {
+		t.Fatal(err)
+	}
+	idx, err := index.Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { idx.Close() })
+	return New(idx, nil)
+}
+
+// currentIndex returns the index that the server is serving.
+func currentIndex(s *Server) *index.Index {
+	return s.gens.cur.Load().(*generation).idx
+}
+
+func get(t *testing.T, h http.Handler, url string, v interface{}) int {
+	t.Helper()
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, url, nil))
+	if v != nil {
+		if err := json.NewDecoder(w.Body).Decode(v); err != nil {
+			t.Fatalf("GET %s: %v", url, err)
+		}
+	}
+	return w.Code
+}
+
+func TestLookup(t *testing.T) {
+	s := newTestServer(t)
+	tests := []struct {
+		url    string
+		status int
+		target string
+	}{
+		{"/v1/bit.ly/0010", http.StatusOK, "http://example.com/16"},
+		{"/v1/bit-ly/012b", http.StatusOK, "http://example.com/299"},
+		{"/v1/bit.ly/012c", http.StatusNotFound, ""},
+		{"/v1/is.gd/0010", http.StatusNotFound, ""},
+	}
+	for _, tt := range tests {
+		var m Mapping
+		if status := get(t, s, tt.url, &m); status != tt.status || m.Target != tt.target {
+			t.Errorf("GET %s = %d %q, want %d %q", tt.url, status, m.Target, tt.status, tt.target)
+		}
+	}
+
+	var list []Shortener
+	if status := get(t, s, "/v1/", &list); status != http.StatusOK || len(list) != 1 || list[0].Host != "bit.ly" || list[0].Count != 300 {
+		t.Errorf("GET /v1/ = %d %+v", status, list)
+	}
+}
+
+func TestPage(t *testing.T) {
+	s := newTestServer(t)
+	var shortcodes []string
+	after := ""
+	for pages := 0; ; pages++ {
+		if pages > 10 {
+			t.Fatal("too many pages")
+		}
+		var p Page
+		url := "/v1/bit.ly?prefix=01&limit=30&after=" + after
+		if status := get(t, s, url, &p); status != http.StatusOK {
+			t.Fatalf("GET %s = %d", url, status)
+		}
+		for _, m := range p.Mappings {
+			shortcodes = append(shortcodes, m.Shortcode)
+		}
+		if p.Next == "" {
+			break
+		}
+		after = p.Next
+	}
+	if len(shortcodes) != 0x12c-0x100 || shortcodes[0] != "0100" || shortcodes[len(shortcodes)-1] != "012b" {
+		t.Errorf("got %d shortcodes %v", len(shortcodes), shortcodes)
+	}
+	if status := get(t, s, "/v1/bit.ly?limit=0", nil); status != http.StatusBadRequest {
+		t.Errorf("got status %d for invalid limit", status)
+	}
+}
+
+func TestRedirect(t *testing.T) {
+	s := newTestServer(t)
+	rd := s.Redirector()
+	tests := []struct {
+		host, path string
+		status     int
+		location   string
+	}{
+		{"bit.ly", "/0010", http.StatusMovedPermanently, "http://example.com/16"},
+		{"www.bit.ly:8080", "/0011", http.StatusMovedPermanently, "http://example.com/17"},
+		{"localhost", "/bit.ly/0012", http.StatusMovedPermanently, "http://example.com/18"},
+		{"localhost", "/bit-ly/0013", http.StatusMovedPermanently, "http://example.com/19"},
+		{"bit.ly", "/zzzz", http.StatusNotFound, ""},
+		{"bit.ly", "/", http.StatusNotFound, ""},
+		{"localhost", "/0010", http.StatusNotFound, ""},
+		{"localhost", "/is.gd/0010", http.StatusNotFound, ""},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+		req.Host = tt.host
+		w := httptest.NewRecorder()
+		rd.ServeHTTP(w, req)
+		if loc := w.Header().Get("Location"); w.Code != tt.status || loc != tt.location {
+			t.Errorf("GET %s%s = %d %q, want %d %q", tt.host, tt.path, w.Code, loc, tt.status, tt.location)
+		}
+	}
+
+	jsonTests := []struct {
+		path, accept string
+		status       int
+		want         Mapping
+	}{
+		{"/0010", "application/json", http.StatusOK, Mapping{Host: "bit.ly", Shortcode: "0010", Target: "http://example.com/16", Found: true}},
+		{"/0010?format=json", "", http.StatusOK, Mapping{Host: "bit.ly", Shortcode: "0010", Target: "http://example.com/16", Found: true}},
+		{"/zzzz", "text/html, application/json;q=0.9", http.StatusNotFound, Mapping{Host: "bit.ly", Shortcode: "zzzz"}},
+	}
+	for _, tt := range jsonTests {
+		req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+		req.Host = "bit.ly"
+		if tt.accept != "" {
+			req.Header.Set("Accept", tt.accept)
+		}
+		w := httptest.NewRecorder()
+		rd.ServeHTTP(w, req)
+		var m Mapping
+		if err := json.NewDecoder(w.Body).Decode(&m); err != nil {
+			t.Fatalf("GET %s: %v", tt.path, err)
+		}
+		m.Provenance = nil
+		if w.Code != tt.status || !reflect.DeepEqual(m, tt.want) {
+			t.Errorf("GET %s as JSON = %d %+v, want %d %+v", tt.path, w.Code, m, tt.status, tt.want)
+		}
+	}
+
+	idx := currentIndex(s)
+	rd = New(idx, &Options{RedirectStatus: http.StatusFound}).Redirector()
+	req := httptest.NewRequest(http.MethodGet, "/0010", nil)
+	req.Host = "bit.ly"
+	w := httptest.NewRecorder()
+	rd.ServeHTTP(w, req)
+	if w.Code != http.StatusFound {
+		t.Errorf("GET with RedirectStatus 302 = %d", w.Code)
+	}
+}
+
+func TestBulk(t *testing.T) {
+	s := newTestServer(t)
+	body := `{"shortener": "bit-ly", "queries": ["0010", "https://bit.ly/0011", "zzzz", "http://is.gd/0010", "/0010", ""]}`
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/v1/lookup", strings.NewReader(body)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", w.Code, w.Body)
+	}
+	var resp BulkResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	want := []struct {
+		target string
+		failed bool
+	}{
+		{"http://example.com/16", false},
+		{"http://example.com/17", false},
+		{"", false},
+		{"", false},
+		{"", false},
+		{"", true},
+	}
+	if len(resp.Results) != len(want) {
+		t.Fatalf("got %d results, want %d", len(resp.Results), len(want))
+	}
+	for i, res := range resp.Results {
+		if res.Target != want[i].target || (res.Error != "") != want[i].failed {
+			t.Errorf("result %d = %+v", i, res)
+		}
+	}
+	if resp.Found != 2 || resp.Missing != 3 || resp.Failed != 1 {
+		t.Errorf("got %d found, %d missing, %d failed", resp.Found, resp.Missing, resp.Failed)
+	}
+
+	w = httptest.NewRecorder()
+	queries := strings.Repeat(`"a",`, MaxBulkQueries) + `"a"`
+	s.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/v1/lookup", strings.NewReader(`{"queries": [`+queries+`]}`)))
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("got status %d for too many queries", w.Code)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	s := newTestServer(t)
+	get(t, s, "/v1/bit.ly/0010", nil)
+	get(t, s, "/v1/bit.ly/zzzz", nil)
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	body := w.Body.String()
+	for _, want := range []string{
+		`urlteam_lookups_total{host="bit.ly",result="hit"} 1`,
+		`urlteam_lookups_total{host="bit.ly",result="miss"} 1`,
+		`urlteam_http_requests_total{code="404",endpoint="v1"} 1`,
+		`urlteam_index_shortcodes{host="bit.ly"} 300`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("metrics missing %s", want)
+		}
+	}
+}
+
+func TestReady(t *testing.T) {
+	s := newTestServer(t)
+	if status := get(t, s, "/healthz", nil); status != http.StatusOK {
+		t.Errorf("/healthz = %d", status)
+	}
+	if status := get(t, s, "/readyz", nil); status != http.StatusServiceUnavailable {
+		t.Errorf("/readyz before warming = %d", status)
+	}
+	if err := s.Warm(); err != nil {
+		t.Fatal(err)
+	}
+	if status := get(t, s, "/readyz", nil); status != http.StatusOK {
+		t.Errorf("/readyz after warming = %d", status)
+	}
+}
+
+func TestETag(t *testing.T) {
+	s := newTestServer(t)
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/v1/bit.ly/0010", nil))
+	etag := w.Header().Get("ETag")
+	if w.Code != http.StatusOK || etag == "" || w.Header().Get("Cache-Control") == "" {
+		t.Fatalf("got %d with headers %v", w.Code, w.Header())
+	}
+	for _, match := range []string{etag, "W/" + etag, `"other", ` + etag, "*"} {
+		req := httptest.NewRequest(http.MethodGet, "/v1/bit.ly/0010", nil)
+		req.Header.Set("If-None-Match", match)
+		w = httptest.NewRecorder()
+		s.ServeHTTP(w, req)
+		if w.Code != http.StatusNotModified {
+			t.Errorf("If-None-Match %s: got %d", match, w.Code)
+		}
+	}
+	req := httptest.NewRequest(http.MethodGet, "/v1/bit.ly/0010", nil)
+	req.Header.Set("If-None-Match", `"other"`)
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Errorf("stale If-None-Match: got %d", w.Code)
+	}
+}
+
+func TestLRUCache(t *testing.T) {
+	c := newLRUCache(2)
+	c.add("h", "a", Mapping{Target: "1"})
+	c.add("h", "b", Mapping{Target: "2"})
+	c.get("h", "a")
+	c.add("h", "c", Mapping{Target: "3"})
+	if _, ok := c.get("h", "b"); ok {
+		t.Error("b not evicted")
+	}
+	for _, shortcode := range []string{"a", "c"} {
+		if _, ok := c.get("h", shortcode); !ok {
+			t.Errorf("%s evicted", shortcode)
+		}
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	s := newTestServer(t)
+	s = New(currentIndex(s), &Options{
+		RateLimit:       1,
+		RateBurst:       2,
+		MaxRequestBytes: 64,
+		Tokens:          []Token{{Name: "test", Secret: "secret", Scopes: []Scope{ScopeRead, ScopeBulk}}},
+		AnonymousScopes: []Scope{ScopeRead, ScopeBulk},
+	})
+	do := func(remoteAddr, token string) int {
+		req := httptest.NewRequest(http.MethodGet, "/v1/bit.ly/0010", nil)
+		req.RemoteAddr = remoteAddr
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, req)
+		if w.Code == http.StatusTooManyRequests && w.Header().Get("Retry-After") == "" {
+			t.Error("429 without Retry-After")
+		}
+		return w.Code
+	}
+	for i, want := range []int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests} {
+		if got := do("192.0.2.1:1234", ""); got != want {
+			t.Errorf("request %d: got %d, want %d", i, got, want)
+		}
+	}
+	if got := do("192.0.2.2:1234", ""); got != http.StatusOK {
+		t.Errorf("other client: got %d", got)
+	}
+	if got := do("192.0.2.1:1234", "secret"); got != http.StatusOK {
+		t.Errorf("token client: got %d", got)
+	}
+	// Invalid tokens are limited by address, before they are rejected
+	for i, want := range []int{http.StatusUnauthorized, http.StatusUnauthorized, http.StatusTooManyRequests} {
+		if got := do("192.0.2.4:1234", fmt.Sprintf("guess%d", i)); got != want {
+			t.Errorf("guess %d: got %d, want %d", i, got, want)
+		}
+	}
+	if status := get(t, s, "/healthz", nil); status != http.StatusOK {
+		t.Errorf("/healthz is rate limited: got %d", status)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/v1/lookup", strings.NewReader(`{"queries": ["`+strings.Repeat("a", 100)+`"]}`))
+	req.RemoteAddr = "192.0.2.3:1234"
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, req)
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("large body: got %d", w.Code)
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	tests := []struct {
+		fwd        []string
+		trustProxy bool
+		want       string
+	}{
+		{nil, false, "192.0.2.1"},
+		{[]string{"198.51.100.1"}, false, "192.0.2.1"},
+		{nil, true, "192.0.2.1"},
+		{[]string{"198.51.100.1"}, true, "198.51.100.1"},
+		{[]string{"203.0.113.7, 198.51.100.1"}, true, "198.51.100.1"},
+		{[]string{"203.0.113.7", "198.51.100.1"}, true, "198.51.100.1"},
+		{[]string{"203.0.113.7,"}, true, "192.0.2.1"},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = "192.0.2.1:1234"
+		for _, fwd := range tt.fwd {
+			req.Header.Add("X-Forwarded-For", fwd)
+		}
+		if got := clientIP(req, tt.trustProxy); got != tt.want {
+			t.Errorf("clientIP(%q, %t) = %q, want %q", tt.fwd, tt.trustProxy, got, tt.want)
+		}
+	}
+}
+
+func TestAuth(t *testing.T) {
+	s := newTestServer(t)
+	s = New(currentIndex(s), &Options{
+		Tokens: []Token{
+			{Name: "reader", Secret: "r", Scopes: []Scope{ScopeRead}},
+			{Name: "admin", Secret: "a", Scopes: []Scope{ScopeAdmin}},
+		},
+		AnonymousScopes: []Scope{ScopeRead},
+	})
+	tests := []struct {
+		method, token string
+		status        int
+	}{
+		{http.MethodGet, "", http.StatusOK},
+		{http.MethodGet, "r", http.StatusOK},
+		{http.MethodGet, "x", http.StatusUnauthorized},
+		{http.MethodPost, "", http.StatusUnauthorized},
+		{http.MethodPost, "r", http.StatusForbidden},
+		{http.MethodPost, "a", http.StatusOK},
+	}
+	for _, tt := range tests {
+		url, body := "/v1/bit.ly/0010", ""
+		if tt.method == http.MethodPost {
+			url, body = "/v1/lookup", `{"shortener": "bit.ly", "queries": ["0010"]}`
+		}
+		req := httptest.NewRequest(tt.method, url, strings.NewReader(body))
+		if tt.token != "" {
+			req.Header.Set("Authorization", "Bearer "+tt.token)
+		}
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, req)
+		if w.Code != tt.status {
+			t.Errorf("%s %s with token %q: got %d, want %d", tt.method, url, tt.token, w.Code, tt.status)
+		}
+	}
+}
+
+func TestReverse(t *testing.T) {
+	dir := t.TempDir()
+	b := index.NewBuilder()
+	for i := 0; i < 500; i++ {
+		target := fmt.Sprintf("https://example.org/%d", i)
+		switch i % 5 {
+		case 0:
+			target = fmt.Sprintf("http://www.Example.com:80/%d", i)
+		case 1:
+			target = fmt.Sprintf("https://user@example.com/%d", i)
+		case 2:
+			target = fmt.Sprintf("https://notexample.com/%d", i)
+		}
+		for _, host := range []string{"bit.ly", "is.gd"} {
+			b.Add(host, index.Record{Shortcode: fmt.Sprintf("%04x", i), Target: target})
+		}
+	}
+	if err := b.Write(dir); err != nil {
+		t.Fatal(err)
+	}
+	idx, err := index.Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idx.Close()
+	s := New(idx, &Options{})
+
+	var got []string
+	after := ""
+	for pages := 0; ; pages++ {
+		if pages > 20 {
+			t.Fatal("too many pages")
+		}
+		var p ReversePage
+		if status := get(t, s, "/v1/reverse?domain=example.com&limit=30&after="+after, &p); status != http.StatusOK {
+			t.Fatalf("got status %d", status)
+		}
+		for _, m := range p.Mappings {
+			got = append(got, m.Host+"/"+m.Shortcode)
+		}
+		if p.Next == "" {
+			break
+		}
+		after = p.Next
+	}
+	if len(got) != 400 {
+		t.Errorf("got %d mappings, want 400", len(got))
+	}
+	seen := make(map[string]bool)
+	for _, m := range got {
+		if seen[m] {
+			t.Errorf("duplicate mapping %s", m)
+		}
+		seen[m] = true
+	}
+
+	var p ReversePage
+	get(t, s, "/v1/reverse?shortener=is-gd&target=https://example.org/3", &p)
+	if len(p.Mappings) != 1 || p.Mappings[0].Host != "is.gd" || p.Mappings[0].Shortcode != "0003" {
+		t.Errorf("target lookup = %+v", p.Mappings)
+	}
+	if status := get(t, s, "/v1/reverse", nil); status != http.StatusBadRequest {
+		t.Errorf("no query: got %d", status)
+	}
+}
+
+func TestExport(t *testing.T) {
+	s := newTestServer(t)
+	export := func(url string, gzipped bool) (*httptest.ResponseRecorder, []string) {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodGet, url, nil)
+		if gzipped {
+			req.Header.Set("Accept-Encoding", "gzip")
+		}
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("GET %s: got status %d", url, w.Code)
+		}
+		var r io.Reader = w.Body
+		if gzipped {
+			if enc := w.Header().Get("Content-Encoding"); enc != "gzip" {
+				t.Fatalf("GET %s: got Content-Encoding %q", url, enc)
+			}
+			zr, err := gzip.NewReader(w.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			r = zr
+		}
+		var lines []string
+		sc := bufio.NewScanner(r)
+		for sc.Scan() {
+			lines = append(lines, sc.Text())
+		}
+		if err := sc.Err(); err != nil {
+			t.Fatal(err)
+		}
+		return w, lines
+	}
+
+	_, lines := export("/v1/export/bit-ly", true)
+	if len(lines) != 300 {
+		t.Fatalf("got %d lines, want 300", len(lines))
+	}
+	var rec ExportRecord
+	if err := json.Unmarshal([]byte(lines[10]), &rec); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Shortcode != "000a" || rec.Target != "http://example.com/10" || rec.Releases != nil {
+		t.Errorf("got record %+v", rec)
+	}
+
+	_, lines = export("/v1/export/bit.ly?format=beacon&after=0100&end=0103", false)
+	want := []string{"#FORMAT: BEACON", "#PREFIX: http://bit.ly/", "",
+		"0101|http://example.com/257", "0102|http://example.com/258"}
+	if strings.Join(lines, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got %q, want %q", lines, want)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/v1/export/bit.ly", nil)
+	req.Header.Set("If-Match", `"stale"`)
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, req)
+	if w.Code != http.StatusPreconditionFailed {
+		t.Errorf("stale If-Match: got status %d", w.Code)
+	}
+	_, lines = export("/v1/export/bit.ly?format=beacon&after=0100&end=0103&encoding=uri", false)
+	if strings.Join(lines, "\n") != strings.Join(want, "\n") {
+		t.Errorf("encoding=uri: got %q, want %q", lines, want)
+	}
+	if status := get(t, s, "/v1/export/bit.ly?format=csv", nil); status != http.StatusBadRequest {
+		t.Errorf("invalid format: got status %d", status)
+	}
+	if status := get(t, s, "/v1/export/bit.ly?encoding=url", nil); status != http.StatusBadRequest {
+		t.Errorf("invalid encoding: got status %d", status)
+	}
+	if status := get(t, s, "/v1/export/t.co", nil); status != http.StatusNotFound {
+		t.Errorf("unindexed shortener: got status %d", status)
+	}
+}
+
+func TestUI(t *testing.T) {
+	s := newTestServer(t)
+	for _, path := range []string{"/", "/ui/app.js", "/ui/style.css"} {
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		if w.Code != http.StatusOK || w.Body.Len() == 0 {
+			t.Errorf("GET %s: got status %d with %d bytes", path, w.Code, w.Body.Len())
+		}
+		if csp := w.Header().Get("Content-Security-Policy"); csp == "" {
+			t.Errorf("GET %s: no Content-Security-Policy", path)
+		}
+	}
+	if status := get(t, s, "/missing", nil); status != http.StatusNotFound {
+		t.Errorf("GET /missing: got status %d", status)
+	}
+
+	var releases []Release
+	if status := get(t, s, "/v1/releases", &releases); status != http.StatusOK || len(releases) != 0 {
+		t.Errorf("no releases: got status %d, %v", status, releases)
+	}
+	s.opts.Releases = func() ([]Release, error) {
+		return []Release{
+			{ID: "urlteam_2021-01-01", Indexed: time.Date(2021, 1, 2, 0, 0, 0, 0, time.UTC)},
+			{ID: "urlteam_2021-02-01"},
+			{ID: "urlteam_2021-03-01", Indexed: time.Date(2021, 3, 2, 0, 0, 0, 0, time.UTC)},
+		}, nil
+	}
+	get(t, s, "/v1/releases", &releases)
+	var ids []string
+	for _, r := range releases {
+		ids = append(ids, r.ID)
+	}
+	if got, want := strings.Join(ids, " "), "urlteam_2021-03-01 urlteam_2021-01-01 urlteam_2021-02-01"; got != want {
+		t.Errorf("got releases %s, want %s", got, want)
+	}
+}
+
+func TestMemento(t *testing.T) {
+	dir := t.TempDir()
+	b := index.NewBuilder()
+	b.Add("bit.ly", index.Record{Shortcode: "abc", Target: "http://example.com/abc"})
+	b.AddRelease("bit.ly", "urlteam_2021-01-01-00-00-00")
+	b.AddRelease("bit.ly", "urlteam_2021-03-04-05-06-07")
+	if err := b.Write(dir); err != nil {
+		t.Fatal(err)
+	}
+	idx, err := index.Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idx.Close()
+	s := New(idx, &Options{})
+	serve := func(url string, header ...string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, url, nil)
+		for i := 0; i+1 < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, req)
+		return w
+	}
+
+	w := serve("/memento/timemap/link/https://bit.ly/abc")
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/link-format" {
+		t.Fatalf("TimeMap: got status %d, type %q", w.Code, w.Header().Get("Content-Type"))
+	}
+	for _, want := range []string{
+		`<http://bit.ly/abc>; rel="original"`,
+		`<http://example.com/memento/timegate/http://bit.ly/abc>; rel="timegate"`,
+		`<http://example.com/memento/20210304050607/http://bit.ly/abc>; rel="first last memento"; datetime="Thu, 04 Mar 2021 05:06:07 GMT"`,
+	} {
+		if !strings.Contains(w.Body.String(), want) {
+			t.Errorf("TimeMap missing %s:\n%s", want, w.Body)
+		}
+	}
+
+	w = serve("/memento/timegate/bit.ly/abc", "Accept-Datetime", "Fri, 01 Jan 2016 00:00:00 GMT")
+	if w.Code != http.StatusFound || w.Header().Get("Location") != "http://example.com/memento/20210304050607/http://bit.ly/abc" {
+		t.Errorf("TimeGate: got status %d, location %q", w.Code, w.Header().Get("Location"))
+	}
+	if w.Header().Get("Vary") != "accept-datetime" {
+		t.Errorf("TimeGate: got Vary %q", w.Header().Get("Vary"))
+	}
+	if w := serve("/memento/timegate/bit.ly/abc", "Accept-Datetime", "yesterday"); w.Code != http.StatusBadRequest {
+		t.Errorf("invalid Accept-Datetime: got status %d", w.Code)
+	}
+
+	w = serve("/memento/20210304050607/http:/bit.ly/abc")
+	if w.Code != http.StatusMovedPermanently || w.Header().Get("Location") != "http://example.com/abc" {
+		t.Errorf("memento: got status %d, location %q", w.Code, w.Header().Get("Location"))
+	}
+	if got := w.Header().Get("Memento-Datetime"); got != "Thu, 04 Mar 2021 05:06:07 GMT" {
+		t.Errorf("memento: got Memento-Datetime %q", got)
+	}
+	if w := serve("/memento/20200101000000/http://bit.ly/abc"); w.Code != http.StatusFound {
+		t.Errorf("memento at other datetime: got status %d", w.Code)
+	}
+	if w := serve("/memento/timemap/link/http://bit.ly/abd"); w.Code != http.StatusNotFound {
+		t.Errorf("unarchived short URL: got status %d", w.Code)
+	}
+}
+
+func TestMappedLookup(t *testing.T) {
+	dir := t.TempDir()
+	b := index.NewBuilder()
+	targets := []string{
+		"http://example.com/",
+		"http://example.com/?a=1&b=<2>",
+		"http://example.com/\"quoted\"\\",
+		"http://example.com/\t\n\x01",
+		"http://example.com/ \xff☃",
+		"",
+	}
+	for i, target := range targets {
+		b.Add("bit.ly", index.Record{Shortcode: fmt.Sprintf("%04x", i), Target: target})
+	}
+	b.AddProject("bit.ly", &tinytown.Meta{Name: "bitly_6"})
+	if err := b.Write(dir); err != nil {
+		t.Fatal(err)
+	}
+	idx, err := index.OpenMmap(dir)
+	if err != nil {
+		t.Skip(err)
+	}
+	defer idx.Close()
+	s := New(idx, &Options{})
+	reader := idx.Reader("bit.ly")
+
+	for i := 0; i <= len(targets); i++ {
+		shortcode := fmt.Sprintf("%04x", i)
+		w := httptest.NewRecorder()
+		s.handleMappedLookup(w, reader, shortcode)
+		m, err := (&generation{idx: idx}).lookup(context.Background(), reader, shortcode)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Compare decoded, since encoding/json versions differ in how they
+		// escape invalid UTF-8
+		want := httptest.NewRecorder()
+		writeJSON(want, http.StatusOK, m)
+		var got, wantM Mapping
+		if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+			t.Fatalf("%s: %v: %s", shortcode, err, w.Body)
+		}
+		if err := json.Unmarshal(want.Body.Bytes(), &wantM); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, wantM) {
+			t.Errorf("%s: got %s, want %s", shortcode, w.Body, want.Body)
+		}
+		if wantStatus := map[bool]int{true: http.StatusOK, false: http.StatusNotFound}[m.Found]; w.Code != wantStatus {
+			t.Errorf("%s: got status %d, want %d", shortcode, w.Code, wantStatus)
+		}
+	}
+
+	w := &discardWriter{header: make(http.Header)}
+	r := httptest.NewRequest(http.MethodGet, "/v1/bit.ly/0001", nil)
+	g := s.gens.acquire()
+	defer g.release()
+	allocs := testing.AllocsPerRun(100, func() {
+		s.handleV1(w, r, g)
+	})
+	if allocs != 0 {
+		t.Errorf("lookup: got %v allocations, want 0", allocs)
+	}
+}
+
+// discardWriter is a ResponseWriter that discards the response.
+type discardWriter struct {
+	header http.Header
+}
+
+func (w *discardWriter) Header() http.Header         { return w.header }
+func (w *discardWriter) Write(b []byte) (int, error) { return len(b), nil }
+func (w *discardWriter) WriteHeader(int)             {}
+
+func TestReload(t *testing.T) {
+	s := newTestServer(t)
+	if status := serve(s, http.MethodPost, "/v1/admin/reload"); status != http.StatusNotFound {
+		t.Errorf("reload without tokens: got %d, want %d", status, http.StatusNotFound)
+	}
+	tokens := []Token{{Name: "admin", Secret: "a", Scopes: []Scope{ScopeAdmin}}}
+	s = New(currentIndex(s), &Options{Tokens: tokens})
+	req := httptest.NewRequest(http.MethodPost, "/v1/admin/reload", nil)
+	req.Header.Set("Authorization", "Bearer a")
+	w := httptest.NewRecorder()
+	if s.ServeHTTP(w, req); w.Code != http.StatusNotImplemented {
+		t.Errorf("reload without Open: got %d", w.Code)
+	}
+
+	dir := t.TempDir()
+	b := index.NewBuilder()
+	b.Add("is.gd", index.Record{Shortcode: "abc", Target: "http://example.org/"})
+	if err := b.Write(dir); err != nil {
+		t.Fatal(err)
+	}
+	s = New(currentIndex(s), &Options{
+		Open:            func() (*index.Index, error) { return index.Open(dir) },
+		Tokens:          tokens,
+		AnonymousScopes: []Scope{ScopeRead},
+	})
+	if status := serve(s, http.MethodPost, "/v1/admin/reload"); status != http.StatusUnauthorized {
+		t.Errorf("reload without a token: got %d, want %d", status, http.StatusUnauthorized)
+	}
+	old := currentIndex(s)
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/v1/bit.ly/0010", nil))
+	etag := w.Header().Get("ETag")
+
+	// A request in progress holds the old generation until it finishes
+	g := s.gens.acquire()
+	req = httptest.NewRequest(http.MethodGet, "/v1/admin/reload", nil)
+	req.Header.Set("Authorization", "Bearer a")
+	w = httptest.NewRecorder()
+	if s.ServeHTTP(w, req); w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET reload: got %d", w.Code)
+	}
+	req = httptest.NewRequest(http.MethodPost, "/v1/admin/reload", nil)
+	req.Header.Set("Authorization", "Bearer a")
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, req)
+	var resp ReloadResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("reload: got %d, %v", w.Code, err)
+	}
+	if want := (ReloadResponse{currentIndex(s).Version(), 1}); resp != want {
+		t.Errorf("got %+v, want %+v", resp, want)
+	}
+	if m, err := g.lookup(context.Background(), old.Reader("bit.ly"), "0010"); err != nil || !m.Found {
+		t.Errorf("lookup in old generation: got %+v, %v", m, err)
+	}
+	g.release()
+
+	if status := get(t, s, "/v1/bit.ly/0010", nil); status != http.StatusNotFound {
+		t.Errorf("old shortener after reload: got %d", status)
+	}
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/v1/is.gd/abc", nil))
+	if w.Code != http.StatusOK || w.Header().Get("ETag") == etag {
+		t.Errorf("new shortener after reload: got %d with ETag %s", w.Code, w.Header().Get("ETag"))
+	}
+	if err := s.Close(); err != nil {
+		t.Error(err)
+	}
+}
+
+func serve(h http.Handler, method, url string) int {
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(method, url, nil))
+	return w.Code
+}
+
+func TestFederation(t *testing.T) {
+	root := t.TempDir()
+	var indexes []*index.Index
+	for _, src := range []struct {
+		name, project string
+		records       []index.Record
+	}{
+		{"tinytown", "isgd_1", []index.Record{{Shortcode: "a", Target: "http://example.com/a"}, {Shortcode: "b", Target: "http://example.com/b"}}},
+		{"301works", "", []index.Record{{Shortcode: "a", Target: "http://example.com/a"}, {Shortcode: "b", Target: "http://example.com/other"}, {Shortcode: "c", Target: "http://example.com/c"}}},
+	} {
+		dir := filepath.Join(root, src.name)
+		b := index.NewBuilder()
+		for _, r := range src.records {
+			b.Add("is.gd", r)
+		}
+		if src.project != "" {
+			b.AddProject("is.gd", &tinytown.Meta{Name: src.project})
+		}
+		if err := b.Write(dir); err != nil {
+			t.Fatal(err)
+		}
+		idx, err := index.Open(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		indexes = append(indexes, idx)
+	}
+	fed, err := index.Federate(indexes...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fed.Close()
+	s := New(fed, nil)
+
+	want := map[string]Mapping{
+		"a": {Host: "is.gd", Shortcode: "a", Target: "http://example.com/a", Found: true,
+			Provenance: &Provenance{Projects: []string{"isgd_1"}, Sources: []string{"tinytown", "301works"}}},
+		"b": {Host: "is.gd", Shortcode: "b", Target: "http://example.com/b", Found: true,
+			Provenance: &Provenance{Projects: []string{"isgd_1"}, Sources: []string{"tinytown"}},
+			Conflicts:  []Conflict{{Source: "301works", Target: "http://example.com/other"}}},
+		"c": {Host: "is.gd", Shortcode: "c", Target: "http://example.com/c", Found: true,
+			Provenance: &Provenance{Sources: []string{"301works"}}},
+	}
+	for _, code := range []string{"a", "b", "c"} {
+		var m Mapping
+		if status := get(t, s, "/v1/is.gd/"+code, &m); status != http.StatusOK || !reflect.DeepEqual(m, want[code]) {
+			t.Errorf("GET %s: got %d, %+v, want %+v", code, status, m, want[code])
+		}
+	}
+	resp := s.bulkLookup(context.Background(), fed, &BulkRequest{Shortener: "is.gd", Queries: []string{"b", "a"}})
+	for i, code := range []string{"b", "a"} {
+		if m := resp.Results[i].Mapping; !reflect.DeepEqual(m, want[code]) {
+			t.Errorf("bulk %s: got %+v, want %+v", code, m, want[code])
+		}
+	}
+
+	// Listings merge the layers, including shortcodes only in lower ones
+	var list []Shortener
+	if get(t, s, "/v1/", &list); len(list) != 1 || list[0].Count != 3 || !reflect.DeepEqual(list[0].Projects, []string{"isgd_1"}) {
+		t.Errorf("shorteners: got %+v", list)
+	}
+	var p Page
+	get(t, s, "/v1/is.gd?limit=2", &p)
+	if !reflect.DeepEqual(p.Mappings, []Mapping{want["a"], want["b"]}) || p.Next != "b" {
+		t.Errorf("page: got %+v", p)
+	}
+	p = Page{}
+	get(t, s, "/v1/is.gd?after=b", &p)
+	if !reflect.DeepEqual(p.Mappings, []Mapping{want["c"]}) || p.Next != "" {
+		t.Errorf("next page: got %+v", p)
+	}
+	for _, tt := range []struct {
+		query string
+		want  []Mapping
+	}{
+		{"domain=example.com", []Mapping{want["a"], want["b"], want["c"]}},
+		{"target=http://example.com/c", []Mapping{want["c"]}},
+		{"target=http://example.com/other", []Mapping{}}, // only a conflict
+	} {
+		var rp ReversePage
+		get(t, s, "/v1/reverse?"+tt.query, &rp)
+		if !reflect.DeepEqual(rp.Mappings, tt.want) || rp.Scanned != 3 {
+			t.Errorf("reverse %s: got %+v", tt.query, rp)
+		}
+	}
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/v1/export/is.gd?format=beacon", nil))
+	wantExport := "#FORMAT: BEACON\n#PREFIX: http://is.gd/\n\na|http://example.com/a\nb|http://example.com/b\nc|http://example.com/c\n"
+	if got := w.Body.String(); got != wantExport {
+		t.Errorf("export: got %q, want %q", got, wantExport)
+	}
+}
+
+func TestCORS(t *testing.T) {
+	s := newTestServer(t)
+	s = New(currentIndex(s), &Options{
+		CORSOrigins: []string{"https://tools.example.org"},
+		CORSMaxAge:  10 * time.Minute,
+		Tokens:      []Token{{Name: "admin", Secret: "a", Scopes: []Scope{ScopeAdmin}}},
+	})
+	tests := []struct {
+		method, origin, requestMethod string
+		status                        int
+		allowOrigin, allowMethods     string
+	}{
+		{http.MethodOptions, "https://tools.example.org", "POST", http.StatusNoContent, "https://tools.example.org", "GET, HEAD, POST"},
+		{http.MethodOptions, "https://evil.example.com", "POST", http.StatusUnauthorized, "", ""},
+		{http.MethodGet, "https://tools.example.org", "", http.StatusUnauthorized, "https://tools.example.org", ""},
+		{http.MethodGet, "", "", http.StatusUnauthorized, "", ""},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(tt.method, "/v1/bit.ly/0010", nil)
+		if tt.origin != "" {
+			req.Header.Set("Origin", tt.origin)
+		}
+		if tt.requestMethod != "" {
+			req.Header.Set("Access-Control-Request-Method", tt.requestMethod)
+		}
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, req)
+		h := w.Header()
+		if w.Code != tt.status || h.Get("Access-Control-Allow-Origin") != tt.allowOrigin ||
+			h.Get("Access-Control-Allow-Methods") != tt.allowMethods {
+			t.Errorf("%s from %q: got %d with headers %v", tt.method, tt.origin, w.Code, h)
+		}
+		if tt.status == http.StatusNoContent && h.Get("Access-Control-Max-Age") != "600" {
+			t.Errorf("preflight: got Access-Control-Max-Age %q", h.Get("Access-Control-Max-Age"))
+		}
+	}
+
+	s = New(currentIndex(s), &Options{CORSOrigins: []string{"*"}})
+	req := httptest.NewRequest(http.MethodGet, "/v1/bit.ly/0010", nil)
+	req.Header.Set("Origin", "https://anywhere.example")
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, req)
+	if w.Code != http.StatusOK || w.Header().Get("Access-Control-Allow-Origin") != "*" ||
+		!strings.Contains(w.Header().Get("Access-Control-Expose-Headers"), "ETag") {
+		t.Errorf("any origin: got %d with headers %v", w.Code, w.Header())
+	}
+}
+
+func TestAccessLog(t *testing.T) {
+	s := newTestServer(t)
+	var buf bytes.Buffer
+	s = New(currentIndex(s), &Options{
+		AccessLog:       NewAccessLog(&buf, AccessLogJSON, 0),
+		Tokens:          []Token{{Name: "mirror", Secret: "m", Scopes: []Scope{ScopeRead}}},
+		AnonymousScopes: []Scope{ScopeRead},
+	})
+	req := httptest.NewRequest(http.MethodGet, "/v1/bit.ly/0010", nil)
+	req.Header.Set("Authorization", "Bearer m")
+	req.Header.Set(RequestIDHeader, "abc-123")
+	req.Header.Set("User-Agent", "test")
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, req)
+	if id := w.Header().Get(RequestIDHeader); id != "abc-123" {
+		t.Errorf("got request ID %q", id)
+	}
+	var e accessEntry
+	if err := json.Unmarshal(buf.Bytes(), &e); err != nil {
+		t.Fatal(err)
+	}
+	want := accessEntry{Time: e.Time, RequestID: "abc-123", Remote: "192.0.2.1", User: "mirror",
+		Method: "GET", URI: "/v1/bit.ly/0010", Proto: "HTTP/1.1", Status: http.StatusOK,
+		Bytes: int64(w.Body.Len()), Duration: e.Duration, UserAgent: "test"}
+	if e != want {
+		t.Errorf("got entry\n%+v, want\n%+v", e, want)
+	}
+
+	buf.Reset()
+	s = New(currentIndex(s), &Options{AccessLog: NewAccessLog(&buf, AccessLogCombined, 0)})
+	req = httptest.NewRequest(http.MethodGet, `/v1/bit.ly/"zzzz"`, nil)
+	req.Header.Set(RequestIDHeader, "bad id")
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, req)
+	id := w.Header().Get(RequestIDHeader)
+	if len(id) != 16 {
+		t.Errorf("got generated request ID %q", id)
+	}
+	line := buf.String()
+	prefix := "192.0.2.1 - - ["
+	suffix := fmt.Sprintf(`] "GET /v1/bit.ly/\"zzzz\" HTTP/1.1" 404 %d "-" "-" "%s"`+"\n", w.Body.Len(), id)
+	if !strings.HasPrefix(line, prefix) || !strings.HasSuffix(line, suffix) {
+		t.Errorf("got line %q, want %q...%q", line, prefix, suffix)
+	}
+
+	buf.Reset()
+	s = New(currentIndex(s), &Options{AccessLog: NewAccessLog(&buf, AccessLogJSON, 1e-9)})
+	get(t, s, "/v1/bit.ly/0010", nil)
+	if buf.Len() != 0 {
+		t.Errorf("unsampled request logged: %s", buf.Bytes())
+	}
+}
@@ -0,0 +1,83 @@
+// Copyright (c) 2021 Andrew Archibald
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package server
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/andrewarchi/urlhero/logger"
+)
+
+// ui is the web UI, a single page that uses the JSON API.
+//
+//go:embed ui
+var ui embed.FS
+
+// Release describes the processing of a URLTeam release, for
+// GET /v1/releases.
+type Release struct {
+	ID         string    `json:"id"` // Internet Archive identifier
+	Downloaded time.Time `json:"downloaded,omitempty"`
+	Indexed    time.Time `json:"indexed,omitempty"`
+	Error      string    `json:"error,omitempty"` // last failure
+}
+
+// uiHandler serves the web UI at / and its assets under /ui/.
+func uiHandler() http.Handler {
+	assets, err := fs.Sub(ui, "ui")
+	if err != nil {
+		panic(err)
+	}
+	files := http.FileServer(http.FS(assets))
+	mux := http.NewServeMux()
+	mux.Handle("/ui/", http.StripPrefix("/ui/", files))
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			writeError(w, http.StatusNotFound, "not found")
+			return
+		}
+		files.ServeHTTP(w, r)
+	})
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h := w.Header()
+		h.Set("Content-Security-Policy", "default-src 'self'")
+		h.Set("X-Content-Type-Options", "nosniff")
+		h.Set("X-Frame-Options", "DENY")
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// handleReleases lists the releases known to the server, most recently
+// indexed first.
+func (s *Server) handleReleases(w http.ResponseWriter, r *http.Request, _ *generation) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	releases := []Release{}
+	if s.opts.Releases != nil {
+		rs, err := s.opts.Releases()
+		if err != nil {
+			logger.Error("listing releases failed", "err", err)
+			writeError(w, http.StatusInternalServerError, "listing releases failed")
+			return
+		}
+		releases = append(releases, rs...)
+	}
+	sort.SliceStable(releases, func(i, j int) bool {
+		if !releases[i].Indexed.Equal(releases[j].Indexed) {
+			return releases[i].Indexed.After(releases[j].Indexed)
+		}
+		return releases[i].ID > releases[j].ID
+	})
+	writeJSON(w, http.StatusOK, releases)
+}
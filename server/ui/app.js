@@ -0,0 +1,148 @@
+// Copyright (c) 2021 Andrew Archibald
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+'use strict';
+
+async function getJSON(path) {
+  const resp = await fetch(path, {headers: {Accept: 'application/json'}});
+  const body = await resp.json().catch(() => ({}));
+  if (!resp.ok && resp.status !== 404) {
+    throw new Error(body.error || resp.statusText);
+  }
+  return {status: resp.status, body};
+}
+
+function el(tag, text, className) {
+  const e = document.createElement(tag);
+  if (text !== undefined) {
+    e.textContent = text;
+  }
+  if (className) {
+    e.className = className;
+  }
+  return e;
+}
+
+function fillTable(table, rows) {
+  const tbody = table.querySelector('tbody');
+  tbody.replaceChildren();
+  if (rows.length === 0) {
+    const tr = el('tr');
+    const td = el('td', 'None');
+    td.colSpan = table.querySelectorAll('th').length;
+    tr.append(td);
+    tbody.append(tr);
+    return;
+  }
+  for (const cells of rows) {
+    const tr = el('tr');
+    for (const cell of cells) {
+      tr.append(cell instanceof Node ? cell : el('td', cell));
+    }
+    tbody.append(tr);
+  }
+}
+
+function tableError(table, err) {
+  const tbody = table.querySelector('tbody');
+  const td = el('td', err.message, 'error');
+  td.colSpan = table.querySelectorAll('th').length;
+  tbody.replaceChildren(el('tr'));
+  tbody.firstChild.append(td);
+}
+
+// parseQuery splits a short URL into its shortener host and shortcode.
+// A bare shortcode uses the selected shortener.
+function parseQuery(query, shortener) {
+  query = query.trim();
+  if (!query.includes('://')) {
+    if (!shortener) {
+      throw new Error('Enter a full short URL or choose a shortener.');
+    }
+    return {shortener, shortcode: query};
+  }
+  const u = new URL(query);
+  const host = u.hostname.replace(/^www\./, '');
+  const shortcode = decodeURIComponent(u.pathname.replace(/^\/+/, ''));
+  if (!shortcode) {
+    throw new Error('The URL has no shortcode.');
+  }
+  return {shortener: host, shortcode};
+}
+
+async function lookup(event) {
+  event.preventDefault();
+  const form = event.target;
+  const result = document.getElementById('result');
+  result.replaceChildren();
+  try {
+    const q = parseQuery(form.query.value, form.shortener.value);
+    const path = '/v1/' + encodeURIComponent(q.shortener) + '/' + encodeURIComponent(q.shortcode);
+    const {status, body} = await getJSON(path);
+    if (status === 404 && !body.shortcode) {
+      result.append(el('p', body.error || 'Shortener not archived.', 'error'));
+    } else if (!body.found) {
+      result.append(el('p', `${body.host}/${body.shortcode} was not found in the archive.`, 'error'));
+    } else {
+      const p = el('p', `${body.host}/${body.shortcode} → `, 'found');
+      if (/^https?:\/\//i.test(body.target)) {
+        const a = el('a', body.target);
+        a.href = body.target;
+        a.rel = 'noopener noreferrer nofollow';
+        p.append(a);
+      } else {
+        p.append(el('code', body.target));
+      }
+      result.append(p);
+      if (body.provenance && body.provenance.projects) {
+        result.append(el('p', 'Archived by ' + body.provenance.projects.join(', ')));
+      }
+    }
+  } catch (err) {
+    result.append(el('p', err.message, 'error'));
+  }
+}
+
+async function loadShorteners() {
+  const table = document.getElementById('shorteners');
+  try {
+    const {body} = await getJSON('/v1/');
+    const select = document.getElementById('shortener');
+    fillTable(table, body.map(s => {
+      const option = el('option', s.host);
+      option.value = s.host;
+      select.append(option);
+      const count = el('td', s.count.toLocaleString(), 'num');
+      return [s.name ? `${s.host} (${s.name})` : s.host, count, (s.projects || []).join(', ')];
+    }));
+  } catch (err) {
+    tableError(table, err);
+  }
+}
+
+async function loadReleases() {
+  const table = document.getElementById('releases');
+  try {
+    const {body} = await getJSON('/v1/releases');
+    fillTable(table, body.slice(0, 10).map(r => {
+      const a = el('a', r.id);
+      a.href = 'https://archive.org/details/' + encodeURIComponent(r.id);
+      const id = el('td');
+      id.append(a);
+      // Unset times are encoded as the zero time
+      const indexed = new Date(r.indexed);
+      const isIndexed = indexed.getUTCFullYear() > 1;
+      const status = r.error ? el('td', r.error, 'error') : el('td', isIndexed ? 'Indexed' : 'Pending');
+      return [id, isIndexed ? indexed.toLocaleString() : '', status];
+    }));
+  } catch (err) {
+    tableError(table, err);
+  }
+}
+
+document.getElementById('lookup').addEventListener('submit', lookup);
+loadShorteners();
+loadReleases();
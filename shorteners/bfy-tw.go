@@ -9,6 +9,8 @@ package shorteners
 import (
 	"net/url"
 	"regexp"
+	"strings"
+	"unicode/utf8"
 )
 
 // Bfytw describes the bfy.tw link shortener. All URLs redirect to
@@ -20,9 +22,76 @@ var Bfytw = &Shortener{
 	Alphabet: "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz",
 	Pattern:  regexp.MustCompile(`^[0-9A-Za-z]+$`),
 	CleanFunc: func(shortcode string, u *url.URL) string {
-		return bfytwTrailing.ReplaceAllLiteralString(shortcode, "")
+		return trimBfytw(shortcode)
 	},
 	HasVanity: false,
 }
 
-var bfytwTrailing = regexp.MustCompile(`/?(?:https?://.+|[/.].*|favicon.ico|robots.txt|ip\d+\.\d+\.\d+\.\d+)?=?$`)
+// trimBfytw trims trailing junk from a shortcode, without allocating.
+// It is equivalent to removing the leftmost match of the expression
+//
+//	/?(?:https?://.+|[/.].*|favicon.ico|robots.txt|ip\d+\.\d+\.\d+\.\d+)?=?$
+func trimBfytw(shortcode string) string {
+	for i := 0; i < len(shortcode); i++ {
+		if bfytwJunk(shortcode[i:]) {
+			return shortcode[:i]
+		}
+	}
+	return shortcode
+}
+
+// bfytwJunk reports whether s is trailing junk in a bfy.tw shortcode.
+func bfytwJunk(s string) bool {
+	if len(s) == 0 || s[0] == '/' {
+		return true
+	}
+	// . matches any character except newline
+	oneLine := strings.IndexByte(s, '\n') == -1
+	switch {
+	case s[0] == '.':
+		return oneLine
+	case strings.HasPrefix(s, "http://"):
+		return len(s) > len("http://") && oneLine
+	case strings.HasPrefix(s, "https://"):
+		return len(s) > len("https://") && oneLine
+	}
+	s = strings.TrimSuffix(s, "=")
+	switch {
+	case s == "":
+		return true
+	case strings.HasPrefix(s, "ip"):
+		return isDottedQuad(s[len("ip"):])
+	}
+	return matchAnyDot(s, "favicon", "ico") || matchAnyDot(s, "robots", "txt")
+}
+
+// matchAnyDot reports whether s is name, then any one character except
+// newline, then ext.
+func matchAnyDot(s, name, ext string) bool {
+	if !strings.HasPrefix(s, name) || !strings.HasSuffix(s, ext) {
+		return false
+	}
+	r, size := utf8.DecodeRuneInString(s[len(name):])
+	return r != '\n' && len(name)+size+len(ext) == len(s)
+}
+
+// isDottedQuad reports whether s is four dot-separated decimal numbers.
+func isDottedQuad(s string) bool {
+	for part := 0; part < 4; part++ {
+		if part != 0 {
+			if len(s) == 0 || s[0] != '.' {
+				return false
+			}
+			s = s[1:]
+		}
+		n := 0
+		for n < len(s) && '0' <= s[n] && s[n] <= '9' {
+			n++
+		}
+		if n == 0 {
+			return false
+		}
+		s = s[n:]
+	}
+	return s == ""
+}
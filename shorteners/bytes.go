@@ -0,0 +1,89 @@
+// Copyright (c) 2021 Andrew Archibald
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package shorteners
+
+import (
+	"net/url"
+	"reflect"
+	"sync"
+	"unsafe"
+)
+
+// CleanBytes extracts the shortcode from a URL, like Clean, but without
+// allocating for well-formed URLs. The returned shortcode usually
+// aliases shortURL, which must not be modified while it is used. A nil
+// slice is returned when no shortcode can be found.
+func (s *Shortener) CleanBytes(shortURL []byte) ([]byte, error) {
+	u := urlPool.Get().(*url.URL)
+	defer urlPool.Put(u)
+	return s.cleanBytes(shortURL, u)
+}
+
+// urlPool holds URLs for splitting, which escape to the heap through
+// CleanFunc.
+var urlPool = sync.Pool{New: func() interface{} { return new(url.URL) }}
+
+// CleanBytesFunc extracts the shortcodes of a sequence of URLs, calling
+// fn with each that is found, in order, without deduplicating them. It
+// reuses its state across URLs, so is suited to ingest pipelines, where
+// cleaning is the bottleneck. The shortcode passed to fn is only valid
+// until the next URL is read. Iteration stops at the first error from
+// next or fn.
+func (s *Shortener) CleanBytesFunc(next func() ([]byte, bool), fn func(shortcode []byte) error) error {
+	var u url.URL
+	for {
+		shortURL, ok := next()
+		if !ok {
+			return nil
+		}
+		shortcode, err := s.cleanBytes(shortURL, &u)
+		if err != nil {
+			return err
+		}
+		if shortcode != nil {
+			if err := fn(shortcode); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (s *Shortener) cleanBytes(shortURL []byte, u *url.URL) ([]byte, error) {
+	// The URL is viewed as a string, rather than copied. The string does
+	// not escape: shortcodes are mapped back to the bytes and errors
+	// format copies of it.
+	str := bytesToString(shortURL)
+	shortcode, err := s.clean(str, u)
+	*u = url.URL{}
+	if err != nil || shortcode == "" {
+		return nil, err
+	}
+	if i, ok := substringOffset(str, shortcode); ok {
+		return shortURL[i : i+len(shortcode) : i+len(shortcode)], nil
+	}
+	// Rewritten by the shortener's CleanFunc or unescaped by url.Parse
+	return []byte(shortcode), nil
+}
+
+// bytesToString returns a string that shares the memory of b.
+func bytesToString(b []byte) string {
+	if len(b) == 0 {
+		return ""
+	}
+	return *(*string)(unsafe.Pointer(&b))
+}
+
+// substringOffset returns the offset of sub in s, when sub shares the
+// memory of s.
+func substringOffset(s, sub string) (int, bool) {
+	sp := (*reflect.StringHeader)(unsafe.Pointer(&s)).Data
+	subp := (*reflect.StringHeader)(unsafe.Pointer(&sub)).Data
+	if subp < sp || subp+uintptr(len(sub)) > sp+uintptr(len(s)) {
+		return 0, false
+	}
+	return int(subp - sp), true
+}
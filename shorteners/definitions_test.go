@@ -0,0 +1,24 @@
+// Copyright (c) 2021 Andrew Archibald
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package shorteners_test
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/andrewarchi/urlhero/shorteners"
+	"github.com/andrewarchi/urlhero/shorteners/shortenertest"
+)
+
+func TestDefinitions(t *testing.T) {
+	for _, s := range shorteners.Shorteners {
+		s := s
+		t.Run(s.Name, func(t *testing.T) {
+			shortenertest.Run(t, s, filepath.Join("testdata", s.Name+".txt"))
+		})
+	}
+}
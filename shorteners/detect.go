@@ -0,0 +1,99 @@
+// Copyright (c) 2021 Andrew Archibald
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package shorteners
+
+import (
+	"net/url"
+	"strings"
+)
+
+// detector is the entry of a registered shortener in the combined
+// matching table of Detect, with its pattern compiled ahead of time.
+type detector struct {
+	s *Shortener
+	m *codeMatcher // nil without a pattern
+}
+
+// detectors maps the normalized hosts of registered shorteners to their
+// entries, so that URLs in mixed streams are matched with a single
+// lookup and a single pattern check, regardless of how many shorteners
+// there are.
+var detectors = make(map[string]*detector)
+
+func init() {
+	for _, s := range Shorteners {
+		d := &detector{s: s}
+		if s.Pattern != nil {
+			d.m = compileMatcher(s.Pattern)
+			matchers.Store(s.Pattern, d.m)
+		}
+		detectors[normalizeHost(s.Host)] = d
+	}
+}
+
+// Detect finds the registered shortener of a URL and extracts its
+// shortcode by the rules of that shortener. A nil shortener is returned
+// for URLs of unregistered hosts and an empty shortcode when no
+// shortcode can be found.
+func Detect(shortURL string) (*Shortener, string, error) {
+	var u url.URL
+	return detect(shortURL, &u)
+}
+
+// detect is Detect with u for splitting the URL, to not allocate.
+func detect(shortURL string, u *url.URL) (*Shortener, string, error) {
+	shortURL = trimURL(shortURL)
+	if !splitURL(shortURL, u) {
+		var err error
+		if u, err = url.Parse(shortURL); err != nil {
+			return nil, "", err
+		}
+	}
+	d, ok := detectors[getHostname(u)]
+	if !ok {
+		return nil, "", nil
+	}
+	shortcode := cleanURL(u, d.s.CleanFunc)
+	if shortcode != "" && d.m != nil && !d.match(shortcode) {
+		return d.s, "", newPatternError(d.s, shortcode, u)
+	}
+	return d.s, shortcode, nil
+}
+
+func (d *detector) match(shortcode string) bool {
+	if !d.m.exact {
+		return strings.HasPrefix(shortcode, d.m.prefix) && d.s.Pattern.MatchString(shortcode)
+	}
+	return d.m.match(shortcode)
+}
+
+// CleanAll extracts the shortcodes in a stream of URLs of any of the
+// registered shorteners and groups them by shortener, each deduplicated
+// and sorted as by CleanURLs. URLs of unregistered hosts are skipped.
+func CleanAll(urls []string) (map[*Shortener][]string, error) {
+	groups := make(map[*Shortener][]string)
+	var errs []error
+	var u url.URL
+	for _, shortURL := range urls {
+		s, shortcode, err := detect(shortURL, &u)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		} else if s == nil || shortcode == "" {
+			continue
+		}
+		groups[s] = append(groups[s], shortcode)
+	}
+	for s, shortcodes := range groups {
+		s.Sort(shortcodes)
+		groups[s] = dedupSorted(shortcodes)
+	}
+	if len(errs) != 0 {
+		return groups, &multiError{"CleanAll", errs}
+	}
+	return groups, nil
+}
@@ -0,0 +1,92 @@
+// Copyright (c) 2021 Andrew Archibald
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package shorteners
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/andrewarchi/urlhero/report"
+)
+
+// ErrNoHost is returned, wrapped with the URL, by ParseShortURL for
+// URLs without a host.
+var ErrNoHost = errors.New("no host in short URL")
+
+// PatternError is returned when a cleaned shortcode does not match the
+// pattern of its shortener, which usually means that the URL is
+// malformed, rather than that a request failed.
+type PatternError struct {
+	Shortener string // name of the shortener
+	Shortcode string // after cleaning
+	URL       string
+	Pattern   *regexp.Regexp
+}
+
+// newPatternError returns a PatternError with copies of the strings,
+// which may alias the bytes of a URL passed to CleanBytes.
+func newPatternError(s *Shortener, shortcode string, u *url.URL) *PatternError {
+	return &PatternError{s.Name, cloneString(shortcode), u.String(), s.Pattern}
+}
+
+func (err *PatternError) Error() string {
+	return fmt.Sprintf("%s: shortcode %q does not match alphabet %s after cleaning: %q", err.Shortener, err.Shortcode, err.Pattern, err.URL)
+}
+
+// ErrorClass classifies the error in run reports.
+func (err *PatternError) ErrorClass() string { return report.ClassInput }
+
+func cloneString(s string) string {
+	var b strings.Builder
+	b.WriteString(s)
+	return b.String()
+}
+
+// multiError collects the errors of the URLs of a batch. It matches
+// each with errors.Is and errors.As, so that callers can check for, say,
+// a *PatternError in the batch.
+type multiError struct {
+	tag  string
+	errs []error
+}
+
+func (merr *multiError) Error() string {
+	if len(merr.errs) == 0 {
+		return merr.tag
+	}
+	if len(merr.errs) == 1 {
+		return fmt.Sprintf("%s: %s", merr.tag, merr.errs[0])
+	}
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "%s:\n", merr.tag)
+	for _, err := range merr.errs {
+		fmt.Fprintf(&b, "\t%s\n", err)
+	}
+	return b.String()
+}
+
+func (merr *multiError) Is(target error) bool {
+	for _, err := range merr.errs {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+func (merr *multiError) As(target interface{}) bool {
+	for _, err := range merr.errs {
+		if errors.As(err, target) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,124 @@
+// Copyright (c) 2021 Andrew Archibald
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package shorteners
+
+import (
+	"regexp"
+	"regexp/syntax"
+	"strings"
+	"sync"
+)
+
+// codeMatcher matches shortcodes without regexp for patterns of the
+// common form ^prefix[alphabet]{min,max}$, where the alphabet is ASCII.
+type codeMatcher struct {
+	prefix   string
+	min, max int       // max is -1 when unbounded
+	alphabet [2]uint64 // bitmask of ASCII bytes
+	exact    bool      // whether the pattern has the common form
+}
+
+// matchers caches the codeMatcher of each pattern.
+var matchers sync.Map // map[*regexp.Regexp]*codeMatcher
+
+// matchPattern reports whether a shortcode matches the pattern, checking
+// its prefix, length, and alphabet before falling back to regexp.
+func matchPattern(re *regexp.Regexp, shortcode string) bool {
+	v, ok := matchers.Load(re)
+	if !ok {
+		v, _ = matchers.LoadOrStore(re, compileMatcher(re))
+	}
+	m := v.(*codeMatcher)
+	if !m.exact {
+		return strings.HasPrefix(shortcode, m.prefix) && re.MatchString(shortcode)
+	}
+	return m.match(shortcode)
+}
+
+func (m *codeMatcher) match(shortcode string) bool {
+	if !strings.HasPrefix(shortcode, m.prefix) {
+		return false
+	}
+	code := shortcode[len(m.prefix):]
+	if len(code) < m.min || (m.max != -1 && len(code) > m.max) {
+		return false
+	}
+	for i := 0; i < len(code); i++ {
+		c := code[i]
+		if c >= 128 || m.alphabet[c/64]&(1<<(c%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// compileMatcher analyzes a pattern. When the pattern does not have the
+// common form, only its literal prefix is used to reject shortcodes.
+func compileMatcher(re *regexp.Regexp) *codeMatcher {
+	if m, ok := compileExact(re.String()); ok {
+		return m
+	}
+	prefix, _ := re.LiteralPrefix()
+	return &codeMatcher{prefix: prefix}
+}
+
+func compileExact(expr string) (*codeMatcher, bool) {
+	re, err := syntax.Parse(expr, syntax.Perl)
+	if err != nil || re.Op != syntax.OpConcat {
+		return nil, false
+	}
+	subs := re.Sub
+	if len(subs) < 3 || subs[0].Op != syntax.OpBeginText || subs[len(subs)-1].Op != syntax.OpEndText {
+		return nil, false
+	}
+	subs = subs[1 : len(subs)-1]
+	m := &codeMatcher{exact: true}
+	if subs[0].Op == syntax.OpLiteral {
+		if subs[0].Flags&syntax.FoldCase != 0 {
+			return nil, false
+		}
+		m.prefix = string(subs[0].Rune)
+		subs = subs[1:]
+	}
+	if len(subs) != 1 {
+		return nil, false
+	}
+	rep := subs[0]
+	switch rep.Op {
+	case syntax.OpStar:
+		m.min, m.max = 0, -1
+	case syntax.OpPlus:
+		m.min, m.max = 1, -1
+	case syntax.OpQuest:
+		m.min, m.max = 0, 1
+	case syntax.OpRepeat:
+		m.min, m.max = rep.Min, rep.Max
+	default:
+		return nil, false
+	}
+	class := rep.Sub[0]
+	switch class.Op {
+	case syntax.OpCharClass:
+	case syntax.OpLiteral:
+		if class.Flags&syntax.FoldCase != 0 || len(class.Rune) != 1 {
+			return nil, false
+		}
+		class = &syntax.Regexp{Op: syntax.OpCharClass, Rune: []rune{class.Rune[0], class.Rune[0]}}
+	default:
+		return nil, false
+	}
+	for i := 0; i+1 < len(class.Rune); i += 2 {
+		lo, hi := class.Rune[i], class.Rune[i+1]
+		if hi >= 128 {
+			return nil, false
+		}
+		for c := lo; c <= hi; c++ {
+			m.alphabet[c/64] |= 1 << (c % 64)
+		}
+	}
+	return m, true
+}
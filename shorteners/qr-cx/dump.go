@@ -7,19 +7,25 @@
 package qrcx
 
 import (
+	"context"
 	"encoding/csv"
 	"fmt"
 	"io"
-	"net/http"
 	"os"
 	"path/filepath"
 	"strings"
 	"time"
+
+	"github.com/andrewarchi/urlhero/ia"
 )
 
 func DownloadDump(dir string) error {
+	return DownloadDumpContext(context.Background(), dir)
+}
+
+func DownloadDumpContext(ctx context.Context, dir string) error {
 	url := "https://web.archive.org/web/20151229075230id_/http://qr.cx/dataset/qrcx_all_06eec9b9-1f29-4860-bd91-49c2d517d87d.7z"
-	resp, err := http.Get(url)
+	resp, err := ia.GetContext(ctx, url)
 	if err != nil {
 		return err
 	}
@@ -9,14 +9,16 @@
 package shorteners
 
 import (
-	"bytes"
+	"context"
 	"fmt"
 	"net/url"
 	"regexp"
 	"sort"
 	"strings"
+	"unicode/utf8"
 
 	"github.com/andrewarchi/urlhero/ia"
+	"golang.org/x/net/idna"
 )
 
 type Shortener struct {
@@ -49,24 +51,56 @@ var Shorteners = []*Shortener{
 var Lookup = make(map[string]*Shortener)
 
 func init() {
+	// Catch definition bugs before they corrupt processing runs
+	if err := validateRegistry(Shorteners); err != nil {
+		panic(err)
+	}
 	for _, s := range Shorteners {
-		if _, ok := Lookup[s.Name]; ok {
-			panic(fmt.Errorf("multiple shorteners with name %s", s.Name))
-		}
-		if _, ok := Lookup[s.Host]; ok {
-			panic(fmt.Errorf("multiple shorteners with host %s", s.Host))
-		}
 		Lookup[s.Name] = s
 		Lookup[s.Host] = s
+		// Hosts are matched in punycode
+		if host := normalizeHost(s.Host); host != s.Host {
+			Lookup[host] = s
+		}
 	}
 }
 
+// ParseShortURL extracts the host and shortcode from a short URL of any
+// shortener. URLs of registered shorteners are cleaned by the rules of
+// that shortener and others by the common rules. An empty shortcode is
+// returned when no shortcode can be found.
+func ParseShortURL(shortURL string) (host, shortcode string, err error) {
+	u, err := url.Parse(trimURL(shortURL))
+	if err != nil {
+		return "", "", err
+	}
+	host = getHostname(u)
+	if host == "" {
+		return "", "", fmt.Errorf("%w: %q", ErrNoHost, shortURL)
+	}
+	if s, ok := Lookup[host]; ok {
+		shortcode, err = s.CleanURL(u)
+		return s.Host, shortcode, err
+	}
+	return host, cleanURL(u, nil), nil
+}
+
 // Clean extracts the shortcode from a URL. An empty string is returned
 // when no shortcode can be found.
 func (s *Shortener) Clean(shortURL string) (string, error) {
-	u, err := url.Parse(shortURL)
-	if err != nil {
-		return "", err
+	var u url.URL
+	return s.clean(shortURL, &u)
+}
+
+// clean extracts the shortcode from a URL, which is split into u, when
+// it is well-formed, to not allocate.
+func (s *Shortener) clean(shortURL string, u *url.URL) (string, error) {
+	shortURL = trimURL(shortURL)
+	if !splitURL(shortURL, u) {
+		var err error
+		if u, err = url.Parse(shortURL); err != nil {
+			return "", err
+		}
 	}
 	return s.CleanURL(u)
 }
@@ -75,16 +109,16 @@ func (s *Shortener) Clean(shortURL string) (string, error) {
 // returned when no shortcode can be found.
 func (s *Shortener) CleanURL(u *url.URL) (string, error) {
 	shortcode := cleanURL(u, s.CleanFunc)
-	if shortcode != "" && s.Pattern != nil && !s.Pattern.MatchString(shortcode) {
-		return "", fmt.Errorf("%s: shortcode %q does not match alphabet %s after cleaning: %q", s.Name, shortcode, s.Pattern, u)
+	if shortcode != "" && s.Pattern != nil && !matchPattern(s.Pattern, shortcode) {
+		return "", newPatternError(s, shortcode, u)
 	}
 	return shortcode, nil
 }
 
 func cleanURL(u *url.URL, clean CleanFunc) string {
 	shortcode := strings.TrimLeft(u.Path, "/")
-	// Remove trailing junk (escapes are nbsp and zwsp)
-	if i := strings.IndexAny(shortcode, "()[]<>‹›«»\"'‘’“”\\& \n\x00\u00a0\u200B"); i != -1 {
+	// Remove trailing junk
+	if i := indexJunk(shortcode); i != -1 {
 		shortcode = shortcode[:i]
 	}
 	// Remove concatenated URLs
@@ -106,6 +140,41 @@ func cleanURL(u *url.URL, clean CleanFunc) string {
 	return shortcode
 }
 
+// junkChars are the characters that begin trailing junk in shortcodes.
+// The escapes are nbsp and zwsp.
+const junkChars = "()[]<>‹›«»\"'‘’“”\\& \n\x00\u00a0\u200B"
+
+// asciiJunk is the set of ASCII bytes in junkChars.
+var asciiJunk = func() (set [utf8.RuneSelf]bool) {
+	for i := 0; i < len(junkChars); i++ {
+		if c := junkChars[i]; c < utf8.RuneSelf {
+			set[c] = true
+		}
+	}
+	return set
+}()
+
+// indexJunk returns the index of the first character of junkChars in s,
+// or -1, like strings.IndexAny. ASCII bytes are checked by table and
+// runes are only decoded for the rare non-ASCII shortcodes.
+func indexJunk(s string) int {
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c < utf8.RuneSelf {
+			if asciiJunk[c] {
+				return i
+			}
+			continue
+		}
+		r, size := utf8.DecodeRuneInString(s[i:])
+		if strings.ContainsRune(junkChars, r) {
+			return i
+		}
+		i += size - 1
+	}
+	return -1
+}
+
 func isCommonFile(shortcode string) bool {
 	switch shortcode {
 	case "", "favicon.ico", "robots.txt":
@@ -115,25 +184,25 @@ func isCommonFile(shortcode string) bool {
 }
 
 // CleanURLs extracts, deduplicates, and sorts the shortcodes in slice
-// of URLs.
+// of URLs. The result is the same for any order of the URLs.
 func (s *Shortener) CleanURLs(urls []string) ([]string, error) {
-	shortcodesMap := make(map[string]struct{})
-	var shortcodes []string
+	// Shortcodes are substrings of the URLs, so are not copied, and are
+	// deduplicated once sorted, rather than with a set
+	shortcodes := make([]string, 0, len(urls))
 	var errs []error
+	var u url.URL
 	for _, shortURL := range urls {
-		shortcode, err := s.Clean(shortURL)
+		shortcode, err := s.clean(shortURL, &u)
 		if err != nil {
 			errs = append(errs, err)
 			continue
 		} else if shortcode == "" {
 			continue
 		}
-		if _, ok := shortcodesMap[shortcode]; !ok {
-			shortcodesMap[shortcode] = struct{}{}
-			shortcodes = append(shortcodes, shortcode)
-		}
+		shortcodes = append(shortcodes, shortcode)
 	}
 	s.Sort(shortcodes)
+	shortcodes = dedupSorted(shortcodes)
 	if len(errs) != 0 {
 		return shortcodes, &multiError{"CleanURLs", errs}
 	}
@@ -148,33 +217,87 @@ func (s *Shortener) IsVanity(shortcode string) bool {
 }
 
 // Sort sorts shorter codes first and generated codes before vanity
-// codes.
+// codes, then bytewise, independent of locale. The order is total, so
+// the result does not depend on the order of the input.
 func (s *Shortener) Sort(shortcodes []string) {
-	less := func(a, b string) bool {
-		return (len(a) == len(b) && a < b) || len(a) < len(b)
-	}
 	if s.IsVanityFunc != nil {
-		less = func(a, b string) bool {
-			aVanity := s.IsVanityFunc(a)
-			bVanity := s.IsVanityFunc(b)
-			return (aVanity == bVanity && ((len(a) == len(b) && a < b) || len(a) < len(b))) ||
-				(!aVanity && bVanity)
+		// Partition generated codes before vanity codes, so that each
+		// code is classified once
+		n := 0
+		for i, shortcode := range shortcodes {
+			if !s.IsVanityFunc(shortcode) {
+				shortcodes[i], shortcodes[n] = shortcodes[n], shortcodes[i]
+				n++
+			}
 		}
+		sort.Sort(byLength(shortcodes[:n]))
+		sort.Sort(byLength(shortcodes[n:]))
+		return
 	}
-	sort.Slice(shortcodes, func(i, j int) bool {
-		return less(shortcodes[i], shortcodes[j])
-	})
+	sort.Sort(byLength(shortcodes))
+}
+
+// byLength sorts shorter strings first, then lexicographically.
+type byLength []string
+
+func (s byLength) Len() int      { return len(s) }
+func (s byLength) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s byLength) Less(i, j int) bool {
+	return len(s[i]) < len(s[j]) || (len(s[i]) == len(s[j]) && s[i] < s[j])
+}
+
+// dedupSorted removes adjacent duplicates in place.
+func dedupSorted(shortcodes []string) []string {
+	if len(shortcodes) == 0 {
+		return shortcodes
+	}
+	n := 1
+	for _, shortcode := range shortcodes[1:] {
+		if shortcode != shortcodes[n-1] {
+			shortcodes[n] = shortcode
+			n++
+		}
+	}
+	return shortcodes[:n]
 }
 
 // GetIAShortcodes queries all the shortcodes that have been archived on
 // the Internet Archive.
 func (s *Shortener) GetIAShortcodes() ([]string, error) {
-	timemap, err := ia.GetTimemap(s.Host, &ia.TimemapOptions{
+	return s.GetIAShortcodesOptions(nil)
+}
+
+// IAOptions contains options for querying archived shortcodes.
+type IAOptions struct {
+	From   string // earliest capture timestamp, as a prefix of ia.TimestampFormat
+	To     string // latest capture timestamp, as a prefix of ia.TimestampFormat
+	UseCDX bool   // query the CDX server instead of the timemap API
+}
+
+// GetIAShortcodesOptions queries the shortcodes that have been archived
+// on the Internet Archive, restricted by the given options.
+func (s *Shortener) GetIAShortcodesOptions(options *IAOptions) ([]string, error) {
+	return s.GetIAShortcodesContext(context.Background(), options)
+}
+
+// GetIAShortcodesContext is like GetIAShortcodesOptions, but the query
+// is canceled with the context.
+func (s *Shortener) GetIAShortcodesContext(ctx context.Context, options *IAOptions) ([]string, error) {
+	tmOptions := &ia.TimemapOptions{
 		Collapse:    "original",
 		Fields:      []string{"original"},
 		MatchPrefix: true,
 		Limit:       100000,
-	})
+	}
+	getCaptures := ia.GetTimemapContext
+	if options != nil {
+		tmOptions.From = options.From
+		tmOptions.To = options.To
+		if options.UseCDX {
+			getCaptures = ia.GetCDXContext
+		}
+	}
+	timemap, err := getCaptures(ctx, s.Host, tmOptions)
 	if err != nil {
 		return nil, err
 	}
@@ -185,13 +308,121 @@ func (s *Shortener) GetIAShortcodes() ([]string, error) {
 	return s.CleanURLs(urls)
 }
 
-// getHostname gets the hostname of the given URL, without www or the
-// port.
+// trimURL recovers the leading URL from scraped text, which often has
+// surrounding whitespace or is followed by more text, by trimming
+// leading spaces and C0 controls and cutting at the first after the
+// URL. Otherwise, url.Parse would reject the control characters or
+// they would be cleaned as part of the shortcode. A substring of s is
+// returned, so that it can be mapped back by CleanBytes.
+func trimURL(s string) string {
+	start := 0
+	for start < len(s) && isSpaceOrControl(s[start]) {
+		start++
+	}
+	for i := start; i < len(s); i++ {
+		if isSpaceOrControl(s[i]) {
+			return s[start:i]
+		}
+	}
+	return s[start:]
+}
+
+// isSpaceOrControl reports whether c is a space, a C0 control, or DEL.
+func isSpaceOrControl(c byte) bool {
+	return c <= ' ' || c == 0x7f
+}
+
+// splitURL splits a well-formed absolute URL into u, like url.Parse,
+// but without allocating. It reports false for URLs that need the full
+// parser, such as those with escapes, user info, fragments, or
+// uppercase schemes, which url.Parse lowercases.
+func splitURL(s string, u *url.URL) bool {
+	*u = url.URL{}
+	i := strings.Index(s, "://")
+	if i <= 0 {
+		return false
+	}
+	for j := 0; j < i; j++ {
+		c := s[j]
+		if !('a' <= c && c <= 'z' || j != 0 && ('0' <= c && c <= '9' || c == '+' || c == '-' || c == '.')) {
+			return false
+		}
+	}
+	rest := s[i+len("://"):]
+	end := len(rest)
+	for j := 0; j < len(rest); j++ {
+		if c := rest[j]; c == '/' || c == '?' {
+			end = j
+			break
+		}
+	}
+	host := rest[:end]
+	colon := -1
+	for j := 0; j < len(host); j++ {
+		switch c := host[j]; {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9', c == '-', c == '.', c == '_':
+		case c == ':':
+			colon = j
+		default:
+			return false
+		}
+	}
+	if colon != -1 {
+		for j := colon + 1; j < len(host); j++ {
+			if c := host[j]; c < '0' || c > '9' {
+				return false
+			}
+		}
+	}
+	path, query := rest[end:], ""
+	hasQuery := false
+	for j := 0; j < len(path); j++ {
+		switch c := path[j]; {
+		case c == '?' && !hasQuery:
+			path, query, hasQuery = path[:j], path[j+1:], true
+			// Query bytes are kept raw, but are still validated
+			for k := 0; k < len(query); k++ {
+				if c := query[k]; c < 0x20 || c == 0x7f || c == '#' {
+					return false
+				}
+			}
+			j = len(path)
+		case c < 0x20 || c == 0x7f || c == '%' || c == '#':
+			return false
+		}
+	}
+	u.Scheme = s[:i]
+	u.Host = host
+	u.Path = path
+	u.RawQuery = query
+	u.ForceQuery = hasQuery && query == ""
+	return true
+}
+
+// getHostname gets the normalized hostname of the given URL, without
+// www or the port.
 func getHostname(u *url.URL) string {
 	if u == nil {
 		return ""
 	}
-	return strings.TrimPrefix(u.Hostname(), "www.")
+	return normalizeHost(u.Hostname())
+}
+
+// normalizeHost lowercases a hostname, converts internationalized
+// domain names to punycode, and removes www, so that Unicode forms of
+// hosts, as harvested from pages, match the ASCII hosts of the
+// registry. Hosts that are not valid IDNs are only lowercased.
+func normalizeHost(host string) string {
+	for i := 0; i < len(host); i++ {
+		if host[i] >= utf8.RuneSelf {
+			if ascii, err := idna.Lookup.ToASCII(host); err == nil {
+				host = ascii
+			}
+			break
+		}
+	}
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	return strings.TrimPrefix(host, "www.")
 }
 
 func trimAfter(s string, substr string) string {
@@ -214,23 +445,3 @@ func trimAfterAny(s, chars string) string {
 	}
 	return s
 }
-
-type multiError struct {
-	tag  string
-	errs []error
-}
-
-func (merr *multiError) Error() string {
-	if len(merr.errs) == 0 {
-		return merr.tag
-	}
-	if len(merr.errs) == 1 {
-		return fmt.Sprintf("%s: %s", merr.tag, merr.errs[0])
-	}
-	var b bytes.Buffer
-	fmt.Fprintf(&b, "%s:\n", merr.tag)
-	for _, err := range merr.errs {
-		fmt.Fprintf(&b, "\t%s\n", err)
-	}
-	return b.String()
-}
@@ -6,7 +6,20 @@
 
 package shorteners
 
-import "testing"
+import (
+	"errors"
+	"math/rand"
+	"net/url"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"testing/quick"
+
+	"github.com/andrewarchi/urlhero/benchdata"
+)
 
 func TestIAGetShortcodes(t *testing.T) {
 	t.Skip()
@@ -20,162 +33,523 @@ func TestIAGetShortcodes(t *testing.T) {
 	}
 }
 
-func TestClean(t *testing.T) {
+func TestParseShortURL(t *testing.T) {
 	tests := []struct {
-		s              *Shortener
-		url, shortcode string
+		url, host, shortcode string
+	}{
+		{"http://a.ll.st/agentlocatorFB?linkId=104180290", "a.ll.st", "agentlocatorFB"},
+		{"https://www.bfy.tw/80xn=", "bfy.tw", "80xn"},
+		{"https://bit.ly/3xKabc.", "bit.ly", "3xKabc"},
+		{"http://example.com:80/favicon.ico", "example.com", ""},
+		{"http://Bücher.example/abc", "xn--bcher-kva.example", "abc"},
+		{"https://WWW.Example.COM./abc", "example.com", "abc"},
+	}
+	for _, tt := range tests {
+		host, shortcode, err := ParseShortURL(tt.url)
+		if err != nil {
+			t.Errorf("ParseShortURL(%q): %v", tt.url, err)
+		} else if host != tt.host || shortcode != tt.shortcode {
+			t.Errorf("ParseShortURL(%q) = %q, %q, want %q, %q", tt.url, host, shortcode, tt.host, tt.shortcode)
+		}
+	}
+	if _, _, err := ParseShortURL("/abc"); !errors.Is(err, ErrNoHost) {
+		t.Errorf("ParseShortURL without host: got error %v, want ErrNoHost", err)
+	}
+}
+
+func TestDetect(t *testing.T) {
+	tests := []struct {
+		url       string
+		s         *Shortener
+		shortcode string
+	}{
+		{"http://a.ll.st/agentlocatorFB?linkId=104180290", Allst, "agentlocatorFB"},
+		{"https://WWW.BFY.TW/80xn=", Bfytw, "80xn"},
+		{"http://qr.cx:80/favicon.ico", Qrcx, ""},
+		{"https://bit.ly/3xKabc", nil, ""},
+		{"https://bfy.tw./PanS", Bfytw, "PanS"},
+	}
+	for _, tt := range tests {
+		s, shortcode, err := Detect(tt.url)
+		if err != nil {
+			t.Errorf("Detect(%q): %v", tt.url, err)
+		} else if s != tt.s || shortcode != tt.shortcode {
+			t.Errorf("Detect(%q) = %v, %q, want %v, %q", tt.url, s, shortcode, tt.s, tt.shortcode)
+		}
+	}
+	if s, _, err := Detect("https://qr.cx/0OIl"); s != Qrcx || err == nil {
+		t.Errorf("Detect with shortcode outside alphabet = %v, %v, want qr-cx and an error", s, err)
+	}
+}
+
+func TestCleanAll(t *testing.T) {
+	urls := []string{
+		"https://bfy.tw/PanS",
+		"http://deb.li/3cbd",
+		"https://bit.ly/3xKabc",
+		"http://bfy.tw/80xn=",
+		"https://www.bfy.tw/PanS",
+		"https://qr.cx/0OIl",
+	}
+	groups, err := CleanAll(urls)
+	var perr *PatternError
+	if !errors.As(err, &perr) {
+		t.Errorf("CleanAll: got error %v, want *PatternError", err)
+	} else if perr.Shortener != "qr-cx" || perr.Shortcode != "0OIl" {
+		t.Errorf("CleanAll: got pattern error %+v", perr)
+	}
+	want := map[*Shortener][]string{
+		Bfytw: {"80xn", "PanS"},
+		Debli: {"3cbd"},
+	}
+	if !reflect.DeepEqual(groups, want) {
+		t.Errorf("CleanAll = %v, want %v", groups, want)
+	}
+}
+
+func TestNormalizeHost(t *testing.T) {
+	tests := []struct {
+		host, want string
+	}{
+		{"bfy.tw", "bfy.tw"},
+		{"WWW.BFY.TW", "bfy.tw"},
+		{"bfy.tw.", "bfy.tw"},
+		{"例え.テスト", "xn--r8jz45g.xn--zckzah"},
+		{"www.Bücher.de", "xn--bcher-kva.de"},
+		{"xn--bcher-kva.de", "xn--bcher-kva.de"},
+	}
+	for _, tt := range tests {
+		if got := normalizeHost(tt.host); got != tt.want {
+			t.Errorf("normalizeHost(%q) = %q, want %q", tt.host, got, tt.want)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	valid := func() *Shortener {
+		return &Shortener{
+			Name:     "example",
+			Host:     "ex.am",
+			Prefix:   "https://ex.am/",
+			Alphabet: "0123456789abcdef",
+			Pattern:  regexp.MustCompile(`^[0-9a-f]+$`),
+		}
+	}
+	tests := []struct {
+		edit func(s *Shortener)
+		err  string
 	}{
-		{Allst, "http://a.ll.st/1NRwM3", "1NRwM3"},
-		{Allst, "http://a.ll.st/Facebook", "Facebook"},
-		{Allst, "http://a.ll.st/agentlocatorFB?linkId=104180290", "agentlocatorFB"},
-		{Allst, "http://a.ll.st/Instagram%22,%22isCrawlable%22:true,%22thumbnail", "Instagram"}, // "
-		{Allst, "http://a.ll.st:80/scmf/OrMCe04Lcp0lODk0BD1FrBcO2E4FP0NMEHFGSZ--Pq5q7EdIBj5D0RZwQ0r5O5LJxfQiUmcjxE_yFyVUmcC7Ue52R7KC2DlT6j1Anuut1CVBLh2fal1IZic40eX4xD2dJTg/PrJJpv", "PrJJpv"},
-		{Allst, "http://a.ll.st:80/scmf/OrMCe04Lcp0lODk2Bzg71hcM2079O8ZJEHE_NJu-wtVr7D9JB0U8qWl1RzYCRZPJxfQiUmcjxE_yF9swgNxdUAkTP4vGed-VJvLu3uityvkzL-5fGDGJnyV0iKf6RXKdJQ/hiddenworldofdata", "hiddenworldofdata"},
-
-		{Bfytw, "https://bfy.tw/PanS", "PanS"},
-		{Bfytw, "http://bfy.tw/80xn=", "80xn"},
-		{Bfytw, "http://bfy.tw:80/7JAH.", "7JAH"},
-		{Bfytw, "http://bfy.tw:80/fb/7rt7", "fb"},
-		{Bfytw, "http://bfy.tw:80/LOr7...", "LOr7"},
-		{Bfytw, "http://bfy.tw:80/3hQy...You", "3hQy"},
-		{Bfytw, "http://bfy.tw/BFsxrobots.txt", "BFsx"},
-		{Bfytw, "http://bfy.tw/D9lj/robots.txt", "D9lj"},
-		{Bfytw, "https://bfy.tw/4jz9ip124.41.235.255", "4jz9"},
-		{Bfytw, "http://bfy.tw:80/5PrLhttp://bfy.tw/5PrL", "5PrL"},
-		{Bfytw, "http://bfy.tw/Ej4D/wordpress/wp-content/uploads/kisaflo-top-loog.png", "Ej4D"},
-		{Bfytw, "https://bfy.tw/Okad%22,%22e%22:%22link%22,%22t%22:%22https://bfy.tw/Okad", "Okad"}, // ""
-
-		{Debli, "https://deb.li/hvPc", "hvPc"},
-		{Debli, "http://deb.li:80/p/debian", "debian"},           // redirect preview
-		{Debli, "http://deb.li:80/4BE7F84D.5040104@bzed.de", ""}, // mailing list redirect
-		{Debli, "http://deb.li:80/imprint.html", ""},
-		{Debli, "https://deb.li/static/pics/openlogo-50.png", ""},
-		{Debli, "http://deb.li:80/log%20dari%20training%20Debian%20Women%20dengan%20tema%20%22Debian%20package%20informations%22%20dini%20hari%20tadi%20dapat%20dilihat%20di%20http://meetbot.debian.net/debian-women/2010/debian-women.2010-12-16-20.09.log.html", "log"}, // space
-		{Debli, "http://deb.li:80/%3Ckey%3E", ""},  // <key> placeholder
-		{Debli, "http://deb.li:80/%3Cname%3E", ""}, // <name> placeholder
-
-		{GoHawaiiEdu, "https://go.hawaii.edu/34A", "34A"},
-		{GoHawaiiEdu, "http://go.hawaii.edu:80/Vf+", "Vf"}, // redirect preview
-		{GoHawaiiEdu, "http://go.hawaii.edu/3P6.", "3P6"},
-		{GoHawaiiEdu, "http://go.hawaii.edu/j7L;", "j7L"},
-		{GoHawaiiEdu, "http://go.hawaii.edu/fP7)", "fP7"},
-		{GoHawaiiEdu, "http://go.hawaii.edu/admin", ""},
-		{GoHawaiiEdu, "http://go.hawaii.edu:80/admin/", ""},
-		{GoHawaiiEdu, "http://go.hawaii.edu:80/admin/index.php?", ""},
-		{GoHawaiiEdu, "http://go.hawaii.edu:80/submit?", ""},
-		{GoHawaiiEdu, "http://go.hawaii.edu:80/%E2%80%8Bhttps://www.star.hawaii.edu/studentinterface", ""}, // ZWSP
-		{GoHawaiiEdu, "http://go.hawaii.edu:80/robert-j-elisberg/live-from-ces-day-two-the_b_416265.html", ""},
-
-		{MobyTo, "http://moby.to//8dfstt", "8dfstt"},
-		{MobyTo, "http://moby.to:80/368eck-", "368eck"},
-		{MobyTo, "http://moby.to:80/8f9n7k--", "8f9n7k"},
-		{MobyTo, "http://moby.to:80/4rcbqg%E2%80%9D", "4rcbqg"},   // ”
-		{MobyTo, "http://moby.to:80/ac35nh%3C%3C", "ac35nh"},      // <<
-		{MobyTo, "http://moby.to:80/ac35nh%C2%ABWoW..", "ac35nh"}, // «
-		{MobyTo, "http://moby.to/1rrlao:view", "1rrlao"},
-		{MobyTo, "https://moby.to/atmkt0:full", "atmkt0"},
-		{MobyTo, "http://moby.to/8hmrkj:square", "8hmrkj"},
-		{MobyTo, "http://moby.to:80/22ibg5:small", "22ibg5"},
-		{MobyTo, "http://moby.to:80/91ttyo:large", "91ttyo"},
-		{MobyTo, "http://moby.to:80/1b55uh:thumb", "1b55uh"},
-		{MobyTo, "http://moby.to/08dlmz:thumbnail", "08dlmz"},
-		{MobyTo, "http://moby.to:80/author/hermioneway/item/3417018", ""},
-		{MobyTo, "http://moby.to/*", ""},
-		{MobyTo, "http://moby.to:80/***", ""},
-		{MobyTo, "http://moby.to:80/******", ""},
-		{MobyTo, "http://moby.to/.*", ""},
-		{MobyTo, "http://moby.to/.+", ""},
-
-		{Qrcx, "http://qr.cx:80/)", ""},
-		{Qrcx, "http://www.qr.cx/mQBM", "mQBM"},
-		{Qrcx, "http://qr.cx/tEv/get", "tEv"}, // redirect preview
-		{Qrcx, "http://qr.cx/sQ2U+", "sQ2U"},  // redirect preview
-		{Qrcx, "http://qr.cx/plvd%5Dclick", "plvd"},
-		{Qrcx, "http://qr.cx/plvd%5Dhttp:/qr.cx/plvd%5B/link%5D", "plvd"},
-		{Qrcx, "http://qr.cx/yzj/img/301works.png", "yzj"},
-		{Qrcx, "http://qr.cx:80/itZ/api.php", "itZ"},
-		{Qrcx, "http://qr.cx:80/uqn/piwik.php", "uqn"},
-		{Qrcx, "http://qr.cx/img/twitter_icon.png", ""},
-		{Qrcx, "http://qr.cx/api.php", ""},
-		{Qrcx, "http://qr.cx:80/deleted.php", ""},
-		{Qrcx, "http://qr.cx:80/api/?bookmarklet=1&longurl=", ""},
-		{Qrcx, "http://qr.cx:80/admin/latest.php?", ""},
-		{Qrcx, "http://qr.cx:80/dataset/?flocxshorty=dataset", ""},
-		{Qrcx, "http://qr.cx:80/qr/php/qr_img.php?", ""},
-		{Qrcx, "http://qr.cx/qr/php/qr_img.php?e=M&s=9&d=http://qr.cx/1oz", "1oz"},
-		{Qrcx, "http://qr.cx/qr/php/qr_img.php?e=M&s=9&d=http%3A%2F%2Fqr.cx%2Fyzj", "yzj"},
-		{Qrcx, "http://qr.cx:80/http://qr.cx/about:blank", ""},
-		{Qrcx, "http://qr.cx:80/http://maps.google.at/maps?", ""},
-
-		{RedHt, "https://red.ht/3tg9nOW", "3tg9nOW"},
-		{RedHt, "https://red.ht/3olOq1B@OpenRoboticsOrg", "3olOq1B"},
-		{RedHt, "http://red.ht/1H7Wyt1@sklososky@FuturePOV", "1H7Wyt1"},
-		{RedHt, "http://www.red.ht/forumswitzerland2017", "forumswitzerland2017"},
-		{RedHt, "https://red.ht/SAPvirtualevent?sc_cid=701f2000000tzLzAAI", "SAPvirtualevent"},
-		{RedHt, "http://red.ht/sitemap.xml", ""},
-		{RedHt, "http://red.ht/static/graphics/fish-404.png", ""},
-
-		{Rbgy, "https://rb.gy/bdb02v+", "bdb02v"}, // redirect preview
-		{Rbgy, "https://rb.gy/auvwlc-", "auvwlc"},
-		{Rbgy, "https://rb.gy/fpkgmy!", "fpkgmy"},
-		{Rbgy, "http://rb.gy/txzznf_", "txzznf"},
-		{Rbgy, "https://rb.gy/5xw62x%00", "5xw62x"},
-		{Rbgy, "https://rb.gy/qntquc.Questions", "qntquc"},
-		// {Rbgy, "http://rb.gy/uku.jog", "ukujog"},
-		{Rbgy, "https://rb.gy/ouvdl3It's", "ouvdl3"},
-		{Rbgy, "https://rb.gy/ddq3vo/UCaujr", "ddq3vo"},
-		{Rbgy, "https://rb.gy/5wsqyxal-text&sr=1-3", "5wsqyx"},
-		{Rbgy, "http://rb.gy/bj4..%3C/PAGE_TITLE%3E", "bj4"},
-		{Rbgy, "https://rb.gy/gz35r7@YouTubeCreators", "gz35r7"},
-		{Rbgy, "https://rb.gy/hjgyijrb.gy/hjgyij", "hjgyij"},
-		{Rbgy, "http://rb.gy/ff7gyg/exercise-with-aerobic-video/", "ff7gyg"},
-		{Rbgy, "https://rb.gy/wlshcv@drninaansary@A_Tabatabai@EllieGeranmayeh@ebtekarm@araghchi@milanimohsen@JafariPeyman@SadeghKharrazi@ahandjani", "wlshcv"},
-		{Rbgy, "https://rb.gy/1zidswv%C3%ADa", "1zidsw"},                                                                 // í
-		{Rbgy, "https://rb.gy/mi6dex%E5%B0%8F%E5%BF%83", "mi6dex"},                                                       // 小心
-		{Rbgy, "https://rb.gy/vnaknf%E0%B8%AA%E0%B8%A1%E0%B8%B1%E0%B8%84%E0%B8%A3%E0%B8%87%E0%B8%B2%E0%B8%99", "vnaknf"}, // สมัครงาน
-		{Rbgy, "https://rb.gy/sef%D0%B4%D0%BE%D0%BBa1x", "sefa1x"},                                                       // дол
-		{Rbgy, "https://rb.gy/etqdt2%E2%97%84", "etqdt2"},                                                                // ◄
-		{Rbgy, "https://rb.gy/etqdt2%e2%97%84%e2%80%8b%e2%80%8b%e2%80%8b", "etqdt2"},                                     // ◄ ZWSP ZWSP ZWSP
-
-		{RedHt, "https://red.ht/sig%3E", "sig"}, // >
-		{RedHt, "https://red.ht/dev-sandbox", "dev-sandbox"},
-		{RedHt, "http://red.ht/1zzgkXp&esheet=51687448&newsitemid=20170921005271&lan=en-US&anchor=Red+Hat+blog&index=5&md5=7ea962d15a0e5bf8e35f385550f4decb", "1zzgkXp"},
-		{RedHt, "http://red.ht/13LslKt&quot", "13LslKt"},
-		{RedHt, "http://red.ht/2k3DNz3%E2%80%99", "2k3DNz3"}, // ’
-		{RedHt, "http://red.ht/21Krw4z%C2%A0", "21Krw4z"},    // NBSP
-
-		{ShortIm, "http://www.short.im:80/09u", "09u"},
-		{ShortIm, "http://short.im:80/nova", "nova"},
-		{ShortIm, "http://short.im:80/Christmas-Corner", "Christmas-Corner"},
-		{ShortIm, "http://short.im/api", ""},
-		{ShortIm, "http://short.im/api.php?short=http://short.im/1", "1"},
-		{ShortIm, "http://short.im/api.php?url=http://example.com/very/long/?url", ""},
-		{ShortIm, "http://short.im/donate", ""},
-		{ShortIm, "http://short.im/tos", ""},
-		{ShortIm, "http://short.im/warn", ""},
-		{ShortIm, "http://short.im/feed.rss", ""},
-		{ShortIm, "http://short.im:80/index.php", ""},
-		{ShortIm, "http://short.im/stats.html", ""},
-		{ShortIm, "http://short.im/developer.html", ""},
-		{ShortIm, "http://short.im/multishrink.html", ""},
-		{ShortIm, "https://short.im/modern_theme/build/img/bg.jpg", ""},
-		{ShortIm, "http://short.im/stylesheets/Colaborate-fontfacekit/ColabLig-webfont.eot", ""},
-		{ShortIm, "http://short.im/js/standard.js?rte=1&tm=2&dn=short.im&tid=1020", ""},
-		{ShortIm, "http://short.im:80/caf/earch/tsc.php?&ses=14159950212c36f8a357f0b866615fe9dab1d7e009&200=MjA0MDg5ODA3&21=MTc0LjEyOS4yMzcuMTU3&681=MTQxNTk5NTAyMTJjMzZmOGEzNTdmMGI4NjY2MTVmZTlkYWIxZDdlMDA5&682=&616=MA==&crc=caada4a2a66dc82a6bcaf8e25c06fff5a7ccc2ec&cv=1", ""},
-		// {ShortIm, "http://short.im:80/info/%3C%=urlKeyword%%3E.html?ses=Y3JlPTE0MTU5OTUwMjEmdGNpZD1zaG9ydC5pbTU0NjY1ZThjZTA5ZGEzLjc3OTA3MTEzJmZraT01NDY0JnRhc2s9c2VhcmNoJmRvbWFpbj1zaG9ydC5pbSZzPTZlM2U2YzA2YzdhMWRjN2MxYmRlJmxhbmd1YWdlPWVuJmFfaWQ9Mg==&keyword=%3C%=urlKeyword%%3E&token=%3C%=token%%3E", ""},
-
-		{SUconnEdu, "http://s.uconn.edu/2by", "2by"},
-		{SUconnEdu, "http://s.uconn.edu/ctsrc.", "ctsrc"},
-		{SUconnEdu, "http://s.uconn.edu/fall-21-letter", "fall-21-letter"},
-		{SUconnEdu, "http://s.uconn.edu/PreservingHistoricalResources", "preservinghistoricalresources"},
-		{SUconnEdu, "https://s.uconn.edu/css/custom.css", ""},
+		{func(s *Shortener) {}, ""},
+		{func(s *Shortener) { s.Name = "" }, `shortener with host "ex.am" has no name`},
+		{func(s *Shortener) { s.Host = "ex.am/x" }, `example: host "ex.am/x" is not a bare hostname`},
+		{func(s *Shortener) { s.Host = "www.ex.am" }, `example: host "www.ex.am" is not normalized`},
+		{func(s *Shortener) { s.Host = "Ex.am" }, `example: host "Ex.am" is not normalized`},
+		{func(s *Shortener) { s.Prefix = "ftp://ex.am/" }, `example: prefix "ftp://ex.am/" is not an http or https URL`},
+		{func(s *Shortener) { s.Prefix = "https://example.com/" }, `example: prefix "https://example.com/" is not of host ex.am`},
+		{func(s *Shortener) { s.Prefix = "https://www.ex.am/" }, ""},
+		{func(s *Shortener) { s.Prefix = "https://ex.am" }, `example: prefix "https://ex.am" does not end in a slash`},
+		{func(s *Shortener) { s.Alphabet += "a" }, `example: alphabet repeats 'a'`},
+		{func(s *Shortener) { s.Pattern = regexp.MustCompile(`^[0-9a-e]+$`) }, `example: pattern ^[0-9a-e]+$ rejects alphabet character 'f'`},
+		{func(s *Shortener) { s.Pattern = regexp.MustCompile(`^[0-9a-g]+$`) }, `example: pattern ^[0-9a-g]+$ accepts 'g', which is not in the alphabet`},
+		{func(s *Shortener) { s.Pattern = regexp.MustCompile(`^(?i)[0-9a-f]+$`) }, `example: pattern ^(?i)[0-9a-f]+$ accepts 'A', which is not in the alphabet`},
+		{func(s *Shortener) { s.Pattern = regexp.MustCompile(`^.+$`) }, `example: pattern ^.+$ accepts any character`},
+		{func(s *Shortener) { s.Pattern, s.HasVanity = regexp.MustCompile(`^[0-9a-z\-]+$`), true }, ""},
 	}
 	for i, tt := range tests {
-		shortcode, err := tt.s.Clean(tt.url)
+		s := valid()
+		tt.edit(s)
+		err := s.Validate()
+		if (err == nil) != (tt.err == "") || err != nil && err.Error() != tt.err {
+			t.Errorf("#%d: Validate() = %v, want %q", i, err, tt.err)
+		}
+	}
+	if err := validateRegistry([]*Shortener{valid(), valid()}); err == nil {
+		t.Error("validateRegistry with duplicates: got no error")
+	}
+}
+
+func TestCleanBytesFunc(t *testing.T) {
+	urls := [][]byte{[]byte("https://bfy.tw/PanS"), []byte("https://bfy.tw/favicon.ico"), []byte("http://bfy.tw/80xn=")}
+	var got []string
+	i := 0
+	err := Bfytw.CleanBytesFunc(func() ([]byte, bool) {
+		if i == len(urls) {
+			return nil, false
+		}
+		i++
+		return urls[i-1], true
+	}, func(shortcode []byte) error {
+		got = append(got, string(shortcode))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"PanS", "80xn"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("CleanBytesFunc = %q, want %q", got, want)
+	}
+}
+
+func TestSplitURL(t *testing.T) {
+	urls := []string{
+		"https://bfy.tw/PanS",
+		"http://bfy.tw:80/7JAH.",
+		"https://bfy.tw/4jz9?utm_source=x",
+		"https://bfy.tw/4jz9?",
+		"http://bfy.tw:80/5PrLhttp://bfy.tw/5PrL",
+		"http://bfy.tw",
+		"https://w.wiki/a?b?c",
+	}
+	for _, rawURL := range urls {
+		var got url.URL
+		if !splitURL(rawURL, &got) {
+			t.Errorf("splitURL(%q): not split", rawURL)
+			continue
+		}
+		want, err := url.Parse(rawURL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != *want {
+			t.Errorf("splitURL(%q) = %#v, want %#v", rawURL, got, *want)
+		}
+	}
+	for _, rawURL := range []string{
+		"HTTP://bfy.tw/PanS",
+		"http://user@bfy.tw/PanS",
+		"http://bfy.tw/Pan%53",
+		"http://bfy.tw/PanS#frag",
+		"http://[::1]/PanS",
+		"http://bfy.tw:port/PanS",
+		"bfy.tw/PanS",
+	} {
+		var u url.URL
+		if splitURL(rawURL, &u) {
+			t.Errorf("splitURL(%q): split, want parser fallback", rawURL)
+		}
+	}
+}
+
+func TestTrimBfytw(t *testing.T) {
+	re := regexp.MustCompile(`/?(?:https?://.+|[/.].*|favicon.ico|robots.txt|ip\d+\.\d+\.\d+\.\d+)?=?$`)
+	for _, shortcode := range []string{
+		"PanS", "80xn=", "7JAH.", "fb/7rt7", "LOr7...", "BFsxrobots.txt",
+		"D9lj/robots.txt", "4jz9ip124.41.235.255", "4jz9ip124.41.235", "5PrLhttp://bfy.tw/5PrL",
+		"abhttp://", "abhttp://=", "abfavicon.ico=", "abfavicon\nico", "abfaviconéico",
+		"ab=c", "a\n.b", "", "=", "/", "ip1.2.3.4",
+	} {
+		if got, want := trimBfytw(shortcode), re.ReplaceAllLiteralString(shortcode, ""); got != want {
+			t.Errorf("trimBfytw(%q) = %q, want %q", shortcode, got, want)
+		}
+	}
+}
+
+func TestCleanControl(t *testing.T) {
+	tests := []struct {
+		url, shortcode string
+	}{
+		{"  https://bfy.tw/PanS", "PanS"},
+		{"\thttps://bfy.tw/PanS\r\n", "PanS"},
+		{"https://bfy.tw/PanS https://bfy.tw/80xn", "PanS"},
+		{"https://bfy.tw/PanS\tClick here", "PanS"},
+		{"https://bfy.tw/Pa\x00nS", "Pa"},
+		{"\x1bhttps://bfy.tw/PanS\x7f", "PanS"},
+		{"https://bfy.tw/PanS\u00a0more", "PanS"},
+		{" \t\n", ""},
+	}
+	for _, tt := range tests {
+		shortcode, err := Bfytw.Clean(tt.url)
 		if err != nil {
-			t.Errorf("#%d: %v", i, err)
+			t.Errorf("Clean(%q): %v", tt.url, err)
 		} else if shortcode != tt.shortcode {
-			t.Errorf("#%d: (%s).Clean(%q) = %q, want %q", i, tt.s.Name, tt.url, shortcode, tt.shortcode)
+			t.Errorf("Clean(%q) = %q, want %q", tt.url, shortcode, tt.shortcode)
+		}
+		b, err := Bfytw.CleanBytes([]byte(tt.url))
+		if err != nil {
+			t.Errorf("CleanBytes(%q): %v", tt.url, err)
+		} else if string(b) != tt.shortcode {
+			t.Errorf("CleanBytes(%q) = %q, want %q", tt.url, b, tt.shortcode)
+		}
+	}
+	if host, shortcode, err := ParseShortURL("\thttp://a.ll.st/1NRwM3\n"); err != nil || host != "a.ll.st" || shortcode != "1NRwM3" {
+		t.Errorf("ParseShortURL with whitespace = %q, %q, %v", host, shortcode, err)
+	}
+}
+
+func TestIndexJunk(t *testing.T) {
+	shortcodes := []string{
+		"", "PanS", "abc def", "abc\x00", "éabc", "ab\u00a0c", "ab\u200Bc", "ab‹c", "ab»",
+		"ab”c", "ab\xffc", "ab\xe2\x80", "\xe2\x80\x9d", "日本語", "ab\u00a1c", "ab\u200Cc",
+	}
+	for _, c := range junkChars {
+		shortcodes = append(shortcodes, "ab"+string(c)+"c")
+	}
+	for _, shortcode := range shortcodes {
+		if got, want := indexJunk(shortcode), strings.IndexAny(shortcode, junkChars); got != want {
+			t.Errorf("indexJunk(%q) = %d, want %d", shortcode, got, want)
 		}
 	}
 }
+
+func TestMatchPattern(t *testing.T) {
+	var patterns []*regexp.Regexp
+	for _, s := range Shorteners {
+		patterns = append(patterns, s.Pattern)
+	}
+	patterns = append(patterns,
+		regexp.MustCompile(`^x-[0-9a-f]{4,6}$`),
+		regexp.MustCompile(`^[a-z]+(?:\.html)?$`),
+		regexp.MustCompile(`^(?i)ab[0-9]*$`),
+		regexp.MustCompile(`^[0-9]+é$`))
+	codes := []string{"", "a", "PanS", "7JAH", "3hQy_", "a-b_c", "0OIl", "é", "abcé",
+		"x-12ab", "x-12", "x-1234567", "x-12AB", "abc.html", "abc.htm", "AB12", "ab12", "12é"}
+	for _, re := range patterns {
+		for _, code := range codes {
+			if got, want := matchPattern(re, code), re.MatchString(code); got != want {
+				t.Errorf("matchPattern(%s, %q) = %t, want %t", re, code, got, want)
+			}
+		}
+	}
+	for _, s := range Shorteners {
+		if m := compileMatcher(s.Pattern); !m.exact {
+			t.Errorf("%s: pattern %s not matched without regexp", s.Name, s.Pattern)
+		}
+	}
+}
+
+// sortCodes generates random shortcodes, including vanity codes and
+// duplicates, for property tests.
+type sortCodes []string
+
+func (sortCodes) Generate(rng *rand.Rand, size int) reflect.Value {
+	const chars = "0123456789aAzZ_-"
+	codes := make(sortCodes, rng.Intn(size+1))
+	for i := range codes {
+		if i != 0 && rng.Intn(4) == 0 {
+			codes[i] = codes[rng.Intn(i)]
+			continue
+		}
+		b := make([]byte, rng.Intn(8))
+		for j := range b {
+			b[j] = chars[rng.Intn(len(chars))]
+		}
+		codes[i] = string(b)
+	}
+	return reflect.ValueOf(codes)
+}
+
+// sortLess is the order of Sort, as a comparator.
+func sortLess(s *Shortener, a, b string) bool {
+	if va, vb := s.IsVanity(a), s.IsVanity(b); va != vb {
+		return vb
+	}
+	return byLength{a, b}.Less(0, 1)
+}
+
+var quickConfig = &quick.Config{MaxCount: 500, Rand: rand.New(rand.NewSource(1))}
+
+func TestSortProperties(t *testing.T) {
+	for _, s := range []*Shortener{Allst, Bfytw, RedHt} {
+		// The comparator is a strict weak ordering
+		order := func(a, b, c string) bool {
+			ab, ba := sortLess(s, a, b), sortLess(s, b, a)
+			return !sortLess(s, a, a) && !(ab && ba) &&
+				(!ab || !sortLess(s, b, c) || sortLess(s, a, c)) &&
+				// Incomparable elements are equal, since none tie
+				(ab || ba || a == b)
+		}
+		if err := quick.Check(order, quickConfig); err != nil {
+			t.Errorf("%s: comparator: %v", s.Name, err)
+		}
+		sorted := func(codes sortCodes) bool {
+			got := append([]string(nil), codes...)
+			s.Sort(got)
+			for i := 1; i < len(got); i++ {
+				if sortLess(s, got[i], got[i-1]) {
+					return false
+				}
+			}
+			again := append([]string(nil), got...)
+			s.Sort(again)
+			want := append([]string(nil), codes...)
+			sort.Strings(want)
+			perm := append([]string(nil), got...)
+			sort.Strings(perm)
+			return reflect.DeepEqual(again, got) && reflect.DeepEqual(perm, want)
+		}
+		if err := quick.Check(sorted, quickConfig); err != nil {
+			t.Errorf("%s: Sort: %v", s.Name, err)
+		}
+	}
+}
+
+func TestCleanURLsProperties(t *testing.T) {
+	suffixes := []string{"", ".", "/", "?x=1", "%22", "/robots.txt", "http://bfy.tw/x"}
+	for _, s := range []*Shortener{Allst, Bfytw, RedHt} {
+		clean := func(codes sortCodes, seed int64) bool {
+			rng := rand.New(rand.NewSource(seed))
+			urls := make([]string, len(codes))
+			for i, code := range codes {
+				urls[i] = s.Prefix + code + suffixes[rng.Intn(len(suffixes))]
+			}
+			got, _ := s.CleanURLs(urls)
+			for i := 1; i < len(got); i++ {
+				if !sortLess(s, got[i-1], got[i]) {
+					return false
+				}
+			}
+			for _, code := range got {
+				if code == "" {
+					return false
+				}
+			}
+			return true
+		}
+		if err := quick.Check(clean, quickConfig); err != nil {
+			t.Errorf("%s: CleanURLs: %v", s.Name, err)
+		}
+	}
+	// The order of the URLs does not matter
+	urls := make([]string, 0, 1000)
+	for _, code := range benchdata.Shortcodes(500, 4) {
+		urls = append(urls, "https://red.ht/"+code, "http://www.red.ht/"+code+"-x.")
+	}
+	want, _ := RedHt.CleanURLs(append([]string(nil), urls...))
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 10; i++ {
+		rng.Shuffle(len(urls), func(i, j int) { urls[i], urls[j] = urls[j], urls[i] })
+		if got, _ := RedHt.CleanURLs(append([]string(nil), urls...)); !reflect.DeepEqual(got, want) {
+			t.Fatalf("CleanURLs of shuffled URLs = %q, want %q", got, want)
+		}
+	}
+	// Deduplication is exact
+	got, err := Bfytw.CleanURLs([]string{"https://bfy.tw/b", "https://bfy.tw/a", "http://bfy.tw/b.", "https://bfy.tw/a"})
+	if err != nil || !reflect.DeepEqual(got, []string{"a", "b"}) {
+		t.Errorf("CleanURLs with duplicates = %q, %v", got, err)
+	}
+}
+
+func BenchmarkMatchPattern(b *testing.B) {
+	urls := benchURLs()
+	codes := make([]string, len(urls))
+	for i, u := range urls {
+		code, err := Bfytw.Clean(u)
+		if err != nil {
+			b.Fatal(err)
+		}
+		codes[i] = code
+	}
+	b.ResetTimer()
+	b.Run("regexp", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			Bfytw.Pattern.MatchString(codes[i%len(codes)])
+		}
+	})
+	b.Run("matcher", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			matchPattern(Bfytw.Pattern, codes[i%len(codes)])
+		}
+	})
+}
+
+func BenchmarkIndexJunk(b *testing.B) {
+	urls := benchURLs()
+	paths := make([]string, len(urls))
+	for i, u := range urls {
+		paths[i] = u[strings.IndexByte(u[len("https://"):], '/')+len("https://")+1:]
+	}
+	for i := 0; i < len(paths); i += 100 {
+		paths[i] += "\u00a0…"
+	}
+	b.Run("IndexAny", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			strings.IndexAny(paths[i%len(paths)], junkChars)
+		}
+	})
+	b.Run("indexJunk", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			indexJunk(paths[i%len(paths)])
+		}
+	})
+}
+
+var (
+	benchURLsOnce sync.Once
+	benchURLsList []string
+)
+
+// benchURLs returns a million short URLs, with duplicates and junk, like
+// those archived by the Internet Archive. They are built on first use,
+// so that tests without benchmarks do not build them.
+func benchURLs() []string {
+	benchURLsOnce.Do(func() { benchURLsList = makeBenchURLs() })
+	return benchURLsList
+}
+
+func makeBenchURLs() []string {
+	const alphabet = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+	urls := make([]string, 1000000)
+	for i := range urls {
+		n := i % 700000
+		code := []byte{alphabet[n%62], alphabet[n/62%62], alphabet[n/3844%62], alphabet[n/238328%62]}
+		switch i % 10 {
+		case 0:
+			urls[i] = "http://bfy.tw:80/" + string(code) + "..."
+		case 1:
+			urls[i] = "https://bfy.tw/" + string(code) + "?utm_source=x"
+		default:
+			urls[i] = "http://bfy.tw/" + string(code)
+		}
+	}
+	return urls
+}
+
+func BenchmarkCleanBytes(b *testing.B) {
+	urls := make([][]byte, len(benchURLs()))
+	for i, u := range benchURLs() {
+		urls[i] = []byte(u)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := Bfytw.CleanBytes(urls[i%len(urls)]); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkCleanURLs(b *testing.B) {
+	urls := benchURLs()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := Bfytw.CleanURLs(urls); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkCleanAll(b *testing.B) {
+	// Interleave the URLs of every shortener
+	urls := make([]string, len(benchURLs()))
+	for i, u := range benchURLs() {
+		s := Shorteners[i%len(Shorteners)]
+		urls[i] = strings.Replace(u, Bfytw.Host, s.Host, 1)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		CleanAll(urls)
+	}
+}
+
+func BenchmarkSort(b *testing.B) {
+	shortcodes := benchdata.Shortcodes(1000000, 5)
+	sorted := make([]string, len(shortcodes))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		copy(sorted, shortcodes)
+		Bfytw.Sort(sorted)
+	}
+}
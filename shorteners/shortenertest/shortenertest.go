@@ -0,0 +1,130 @@
+// Copyright (c) 2021 Andrew Archibald
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package shortenertest runs a standard table of assertions against
+// shortener definitions, so that each, including those registered
+// outside this module, is covered uniformly.
+//
+// The cases of a shortener are read from a text file, by convention
+// testdata/<name>.txt, with one case per line:
+//
+//	clean <url> <shortcode>  # the URL cleans to the shortcode
+//	junk <url>               # the URL has no shortcode
+//	vanity <shortcode>       # the shortcode is a vanity code
+//	generated <shortcode>    # the shortcode is not a vanity code
+//
+// Fields are separated by spaces or tabs, so URLs must be escaped.
+// Blank lines and lines starting with # are ignored.
+package shortenertest
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/andrewarchi/urlhero/shorteners"
+)
+
+// Run validates the definition of a shortener and checks it against
+// the cases in a testdata file. Each URL is cleaned with Clean and
+// CleanBytes and, when the shortener is registered, with Detect.
+func Run(t *testing.T, s *shorteners.Shortener, filename string) {
+	t.Helper()
+	if err := s.Validate(); err != nil {
+		t.Errorf("Validate: %v", err)
+	}
+	cases, err := readCases(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	registered := shorteners.Lookup[s.Host] == s
+	for _, c := range cases {
+		switch c.kind {
+		case "clean", "junk":
+			checkClean(t, s, c, registered)
+		case "vanity", "generated":
+			if got, want := s.IsVanity(c.shortcode), c.kind == "vanity"; got != want {
+				t.Errorf("%s: (%s).IsVanity(%q) = %t, want %t", c.pos, s.Name, c.shortcode, got, want)
+			}
+		}
+	}
+}
+
+func checkClean(t *testing.T, s *shorteners.Shortener, c testCase, registered bool) {
+	t.Helper()
+	shortcode, err := s.Clean(c.url)
+	if err != nil {
+		t.Errorf("%s: (%s).Clean(%q): %v", c.pos, s.Name, c.url, err)
+	} else if shortcode != c.shortcode {
+		t.Errorf("%s: (%s).Clean(%q) = %q, want %q", c.pos, s.Name, c.url, shortcode, c.shortcode)
+	}
+	b, err := s.CleanBytes([]byte(c.url))
+	if err != nil {
+		t.Errorf("%s: (%s).CleanBytes(%q): %v", c.pos, s.Name, c.url, err)
+	} else if string(b) != c.shortcode {
+		t.Errorf("%s: (%s).CleanBytes(%q) = %q, want %q", c.pos, s.Name, c.url, b, c.shortcode)
+	}
+	if registered {
+		ds, shortcode, err := shorteners.Detect(c.url)
+		if err != nil {
+			t.Errorf("%s: Detect(%q): %v", c.pos, c.url, err)
+		} else if ds != s || shortcode != c.shortcode {
+			name := "<nil>"
+			if ds != nil {
+				name = ds.Name
+			}
+			t.Errorf("%s: Detect(%q) = %s, %q, want %s, %q", c.pos, c.url, name, shortcode, s.Name, c.shortcode)
+		}
+	}
+}
+
+type testCase struct {
+	pos       string // file:line
+	kind      string
+	url       string
+	shortcode string
+}
+
+// fieldCounts is the number of fields of each kind of case, after the
+// kind.
+var fieldCounts = map[string]int{"clean": 2, "junk": 1, "vanity": 1, "generated": 1}
+
+func readCases(filename string) ([]testCase, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var cases []testCase
+	sc := bufio.NewScanner(f)
+	for line := 1; sc.Scan(); line++ {
+		text := strings.TrimSpace(sc.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		c := testCase{pos: fmt.Sprintf("%s:%d", filename, line), kind: fields[0]}
+		n, ok := fieldCounts[c.kind]
+		if !ok {
+			return nil, fmt.Errorf("%s: unknown case kind %q", c.pos, c.kind)
+		}
+		if len(fields)-1 != n {
+			return nil, fmt.Errorf("%s: %s case has %d fields, want %d", c.pos, c.kind, len(fields)-1, n)
+		}
+		switch c.kind {
+		case "clean":
+			c.url, c.shortcode = fields[1], fields[2]
+		case "junk":
+			c.url = fields[1]
+		default:
+			c.shortcode = fields[1]
+		}
+		cases = append(cases, c)
+	}
+	return cases, sc.Err()
+}
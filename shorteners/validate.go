@@ -0,0 +1,169 @@
+// Copyright (c) 2021 Andrew Archibald
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package shorteners
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp/syntax"
+	"strings"
+	"unicode"
+)
+
+// Validate checks a shortener definition for consistency: that it has a
+// name and a bare, lowercase host, that its prefix is an http or https
+// URL of its host, and that its pattern accepts every character of its
+// alphabet and, unless it has vanity codes, no others.
+func (s *Shortener) Validate() error {
+	if s.Name == "" {
+		return fmt.Errorf("shortener with host %q has no name", s.Host)
+	}
+	if err := s.validateHost(); err != nil {
+		return fmt.Errorf("%s: %w", s.Name, err)
+	}
+	if err := s.validatePrefix(); err != nil {
+		return fmt.Errorf("%s: %w", s.Name, err)
+	}
+	if err := s.validateAlphabet(); err != nil {
+		return fmt.Errorf("%s: %w", s.Name, err)
+	}
+	return nil
+}
+
+func (s *Shortener) validateHost() error {
+	if s.Host == "" {
+		return errors.New("no host")
+	}
+	u, err := url.Parse("http://" + s.Host)
+	if err != nil {
+		return fmt.Errorf("host %q does not parse: %w", s.Host, err)
+	}
+	if u.Host != s.Host || u.Port() != "" || u.Path != "" || u.User != nil {
+		return fmt.Errorf("host %q is not a bare hostname", s.Host)
+	}
+	// URLs are matched by normalized host, so other forms never match
+	if s.Host != strings.ToLower(s.Host) || strings.HasPrefix(s.Host, "www.") || strings.HasSuffix(s.Host, ".") {
+		return fmt.Errorf("host %q is not normalized", s.Host)
+	}
+	return nil
+}
+
+func (s *Shortener) validatePrefix() error {
+	if s.Prefix == "" {
+		return nil
+	}
+	u, err := url.Parse(s.Prefix)
+	if err != nil {
+		return fmt.Errorf("prefix %q does not parse: %w", s.Prefix, err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("prefix %q is not an http or https URL", s.Prefix)
+	}
+	if getHostname(u) != normalizeHost(s.Host) {
+		return fmt.Errorf("prefix %q is not of host %s", s.Prefix, s.Host)
+	}
+	if !strings.HasSuffix(u.Path, "/") || u.RawQuery != "" || u.Fragment != "" {
+		return fmt.Errorf("prefix %q does not end in a slash", s.Prefix)
+	}
+	return nil
+}
+
+func (s *Shortener) validateAlphabet() error {
+	for i, r := range s.Alphabet {
+		if strings.ContainsRune(s.Alphabet[:i], r) {
+			return fmt.Errorf("alphabet repeats %q", r)
+		}
+	}
+	if s.Pattern == nil || s.Alphabet == "" {
+		return nil
+	}
+	re, err := syntax.Parse(s.Pattern.String(), syntax.Perl)
+	if err != nil {
+		return fmt.Errorf("pattern %s does not compile: %w", s.Pattern, err)
+	}
+	ranges, ok := patternRanges(re, nil)
+	for _, r := range s.Alphabet {
+		if ok && !inRanges(ranges, r) {
+			return fmt.Errorf("pattern %s rejects alphabet character %q", s.Pattern, r)
+		}
+	}
+	// Vanity codes may have characters outside the alphabet of generated
+	// codes
+	if s.HasVanity || s.IsVanityFunc != nil {
+		return nil
+	}
+	if !ok {
+		return fmt.Errorf("pattern %s accepts any character", s.Pattern)
+	}
+	for i := 0; i+1 < len(ranges); i += 2 {
+		for r := ranges[i]; r <= ranges[i+1]; r++ {
+			if !strings.ContainsRune(s.Alphabet, r) {
+				return fmt.Errorf("pattern %s accepts %q, which is not in the alphabet", s.Pattern, r)
+			}
+		}
+	}
+	return nil
+}
+
+// patternRanges appends the ranges of the characters that a pattern can
+// match, as pairs of low and high runes, or reports false when it can
+// match any character.
+func patternRanges(re *syntax.Regexp, ranges []rune) ([]rune, bool) {
+	switch re.Op {
+	case syntax.OpAnyChar, syntax.OpAnyCharNotNL:
+		return nil, false
+	case syntax.OpLiteral:
+		for _, r := range re.Rune {
+			ranges = append(ranges, r, r)
+			if re.Flags&syntax.FoldCase != 0 {
+				for f := unicode.SimpleFold(r); f != r; f = unicode.SimpleFold(f) {
+					ranges = append(ranges, f, f)
+				}
+			}
+		}
+	case syntax.OpCharClass:
+		ranges = append(ranges, re.Rune...)
+	}
+	for _, sub := range re.Sub {
+		var ok bool
+		if ranges, ok = patternRanges(sub, ranges); !ok {
+			return nil, false
+		}
+	}
+	return ranges, true
+}
+
+func inRanges(ranges []rune, r rune) bool {
+	for i := 0; i+1 < len(ranges); i += 2 {
+		if ranges[i] <= r && r <= ranges[i+1] {
+			return true
+		}
+	}
+	return false
+}
+
+// validateRegistry validates each shortener and checks that no two
+// share a name or host, which share the keys of Lookup.
+func validateRegistry(shorteners []*Shortener) error {
+	keys := make(map[string]bool, 2*len(shorteners))
+	for _, s := range shorteners {
+		if err := s.Validate(); err != nil {
+			return err
+		}
+		if keys[s.Name] {
+			return fmt.Errorf("multiple shorteners with name %s", s.Name)
+		}
+		keys[s.Name] = true
+		host := normalizeHost(s.Host)
+		if keys[host] {
+			return fmt.Errorf("multiple shorteners with host %s", s.Host)
+		}
+		keys[host] = true
+	}
+	return nil
+}
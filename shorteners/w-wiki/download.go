@@ -7,7 +7,7 @@
 package wwiki
 
 import (
-	"fmt"
+	"context"
 	"io"
 	"net/url"
 	"os"
@@ -16,17 +16,24 @@ import (
 	"time"
 
 	"github.com/andrewarchi/urlhero/ia"
+	"github.com/andrewarchi/urlhero/logger"
 )
 
 // DownloadDumps saves all short URL dumps to the given directory.
 func DownloadDumps(dir string) error {
-	dumps, err := GetDumps()
+	return DownloadDumpsContext(context.Background(), dir)
+}
+
+// DownloadDumpsContext saves all short URL dumps to the given
+// directory, until the context is done.
+func DownloadDumpsContext(ctx context.Context, dir string) error {
+	dumps, err := GetDumpsContext(ctx)
 	if err != nil {
 		return err
 	}
 	for _, dump := range dumps {
 		out := filepath.Join(dir, path.Base(dump.URL.Path))
-		if err := downloadDump(dump.URL.String(), out, nil); err != nil {
+		if err := downloadDump(ctx, dump.URL.String(), out, nil); err != nil {
 			return err
 		}
 	}
@@ -36,7 +43,14 @@ func DownloadDumps(dir string) error {
 // DownloadIADumps saves all short URL dumps that have been archived by
 // the Internet Archive to the given directory.
 func DownloadIADumps(dir string) error {
-	dumps, err := GetIADumps()
+	return DownloadIADumpsContext(context.Background(), dir)
+}
+
+// DownloadIADumpsContext saves all short URL dumps that have been
+// archived by the Internet Archive to the given directory, until the
+// context is done.
+func DownloadIADumpsContext(ctx context.Context, dir string) error {
+	dumps, err := GetIADumpsContext(ctx)
 	if err != nil {
 		return err
 	}
@@ -47,19 +61,19 @@ func DownloadIADumps(dir string) error {
 			return err
 		}
 		out := filepath.Join(dir, path.Base(u.Path))
-		if err := downloadDump(iaURL, out, dump.SHA1[:]); err != nil {
+		if err := downloadDump(ctx, iaURL, out, dump.SHA1[:]); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
-func downloadDump(url, out string, sha1Sum []byte) error {
-	fmt.Println("Downloading", url)
+func downloadDump(ctx context.Context, url, out string, sha1Sum []byte) error {
+	logger.Info("downloading dump", "url", url)
 	// Skip existing
 	if _, err := os.Stat(out); err == nil {
 		if sha1Sum != nil {
-			return ia.ValidateFile(out, nil, sha1Sum, nil)
+			return ia.ValidateFileContext(ctx, out, nil, sha1Sum, nil)
 		}
 		// TODO check ETag, if it is a checksum
 		return nil
@@ -71,7 +85,7 @@ func downloadDump(url, out string, sha1Sum []byte) error {
 	}
 	defer f.Close()
 
-	resp, err := httpGet(url)
+	resp, err := httpGet(ctx, url)
 	if err != nil {
 		return err
 	}
@@ -110,7 +124,14 @@ type IADumpInfo struct {
 // GetIADumps retrieves information on all short URL dumps that have
 // been archived by the Internet Archive.
 func GetIADumps() ([]IADumpInfo, error) {
-	timemap, err := ia.GetTimemap("https://dumps.wikimedia.org/other/shorturls/", &ia.TimemapOptions{
+	return GetIADumpsContext(context.Background())
+}
+
+// GetIADumpsContext retrieves information on all short URL dumps that
+// have been archived by the Internet Archive, until the context is
+// done.
+func GetIADumpsContext(ctx context.Context) ([]IADumpInfo, error) {
+	timemap, err := ia.GetTimemapContext(ctx, "https://dumps.wikimedia.org/other/shorturls/", &ia.TimemapOptions{
 		MatchPrefix: true,
 		Collapse:    "digest",
 		Fields:      []string{"original", "timestamp", "mimetype", "statuscode", "digest"},
@@ -8,6 +8,7 @@
 package wwiki
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"net/http"
@@ -16,6 +17,7 @@ import (
 	"strings"
 	"time"
 
+	"github.com/andrewarchi/urlhero/crawl"
 	"golang.org/x/net/html"
 	"golang.org/x/net/html/atom"
 )
@@ -29,13 +31,19 @@ type DumpInfo struct {
 
 // GetDumps retrieves information on all short URL dumps.
 func GetDumps() ([]DumpInfo, error) {
+	return GetDumpsContext(context.Background())
+}
+
+// GetDumpsContext retrieves information on all short URL dumps, until
+// the context is done.
+func GetDumpsContext(ctx context.Context) ([]DumpInfo, error) {
 	const indexURL = "https://dumps.wikimedia.org/other/shorturls/"
 	baseURL, err := url.Parse(indexURL)
 	if err != nil {
 		return nil, err
 	}
 
-	resp, err := httpGet(indexURL)
+	resp, err := httpGet(ctx, indexURL)
 	if err != nil {
 		return nil, err
 	}
@@ -90,8 +98,15 @@ func GetDumps() ([]DumpInfo, error) {
 	return dumps, nil
 }
 
-func httpGet(url string) (*http.Response, error) {
-	resp, err := http.Get(url)
+// client applies the crawl configuration to requests for dumps.
+var client = &http.Client{Transport: crawl.Transport(nil)}
+
+func httpGet(ctx context.Context, url string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,301 @@
+// Copyright (c) 2021 Andrew Archibald
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package spam clusters the mappings of shorteners by the templates of
+// their targets, to find campaigns where large ranges of shortcodes
+// point at nearly identical destinations, which are usually spam.
+package spam
+
+import (
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/andrewarchi/urlhero/intern"
+)
+
+// Template returns the template of a target URL, which is shared by
+// the targets of a campaign: its lowercase host, without "www.", and
+// its path, with variable segments replaced by placeholders, then the
+// sorted keys of its query, without values. Segments of digits are
+// replaced by {n}, tokens of letters and digits, like IDs, by {id}, and
+// runs of digits in other segments by {n}. The scheme and fragment are
+// dropped. An empty template is returned for targets that are not
+// absolute URLs.
+func Template(target string) string {
+	u, err := url.Parse(strings.TrimSpace(target))
+	if err != nil || u.Host == "" {
+		return ""
+	}
+	var b strings.Builder
+	host := strings.ToLower(u.Hostname())
+	b.WriteString(strings.TrimPrefix(host, "www."))
+	for _, seg := range strings.Split(u.EscapedPath(), "/") {
+		if seg == "" {
+			continue
+		}
+		b.WriteByte('/')
+		writeSegment(&b, seg)
+	}
+	if u.RawQuery != "" {
+		var keys []string
+		for _, kv := range strings.Split(u.RawQuery, "&") {
+			if i := strings.IndexByte(kv, '='); i != -1 {
+				kv = kv[:i]
+			}
+			if kv != "" {
+				keys = append(keys, kv)
+			}
+		}
+		sort.Strings(keys)
+		b.WriteByte('?')
+		for i, k := range keys {
+			if i != 0 && k == keys[i-1] {
+				continue
+			}
+			if i != 0 {
+				b.WriteByte('&')
+			}
+			b.WriteString(k)
+		}
+	}
+	return b.String()
+}
+
+// minIDLen is the length of the shortest token of letters and digits
+// that is replaced as an ID.
+const minIDLen = 6
+
+func writeSegment(b *strings.Builder, seg string) {
+	letters, digits, other := 0, 0, 0
+	for i := 0; i < len(seg); i++ {
+		switch c := seg[i]; {
+		case '0' <= c && c <= '9':
+			digits++
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z':
+			letters++
+		default:
+			other++
+		}
+	}
+	switch {
+	case digits == len(seg):
+		b.WriteString("{n}")
+		return
+	case other == 0 && letters != 0 && digits != 0 && len(seg) >= minIDLen:
+		b.WriteString("{id}")
+		return
+	}
+	for i := 0; i < len(seg); i++ {
+		if c := seg[i]; '0' <= c && c <= '9' {
+			if i == 0 || !('0' <= seg[i-1] && seg[i-1] <= '9') {
+				b.WriteString("{n}")
+			}
+			continue
+		}
+		b.WriteByte(seg[i])
+	}
+}
+
+// Options configure which clusters are reported.
+type Options struct {
+	// MinCount is the fewest mappings of a shortener that a cluster
+	// flagged as spam has, by default 1000.
+	MinCount int64
+	// MinDensity is the smallest share, by default 0.5, of the mappings
+	// from the first to the last of a flagged cluster, in the order that
+	// they were added, that are in the cluster. Mappings of an index are
+	// added in shortcode order, so dense clusters are campaigns that
+	// created many consecutive shortcodes.
+	MinDensity float64
+	// MaxTemplates is the most templates tracked per shortener, by
+	// default 1 << 16. When it is exceeded, the smallest clusters are
+	// pruned, so the counts of clusters first seen after are
+	// underestimated by at most the largest count that was pruned.
+	MaxTemplates int
+	// Examples is the number of distinct targets kept for each cluster,
+	// by default 3.
+	Examples int
+}
+
+// Cluster is the mappings of a shortener with targets of the same
+// template.
+type Cluster struct {
+	Host     string `json:"host"`
+	Template string `json:"template"`
+	Count    int64  `json:"count"`
+	// Share is the share of the mappings of the shortener in the
+	// cluster.
+	Share float64 `json:"share"`
+	// First and Last are the first and last shortcodes of the cluster,
+	// in the order that they were added, and Density is the share of
+	// the mappings between them that are in the cluster.
+	First   string  `json:"first"`
+	Last    string  `json:"last"`
+	Density float64 `json:"density"`
+	// Examples are distinct targets of the cluster.
+	Examples []string `json:"examples"`
+
+	first, last int64 // ordinals of First and Last
+}
+
+// Campaign is a template with flagged clusters on more than one
+// shortener.
+type Campaign struct {
+	Template string   `json:"template"`
+	Count    int64    `json:"count"`
+	Hosts    []string `json:"hosts"`
+}
+
+// Report is the clusters that are flagged as spam.
+type Report struct {
+	// Clusters are ordered by decreasing count, then by host and
+	// template.
+	Clusters []Cluster `json:"clusters"`
+	// Campaigns are ordered as Clusters.
+	Campaigns []Campaign `json:"campaigns,omitempty"`
+	Mappings  int64      `json:"mappings"` // total mappings clustered
+}
+
+// Clusterer clusters mappings as they are added. It is not safe for
+// concurrent use.
+type Clusterer struct {
+	opts     Options
+	hosts    map[string]*hostClusters
+	strings  *intern.Table
+	mappings int64
+}
+
+type hostClusters struct {
+	clusters map[string]*Cluster
+	n        int64 // mappings added
+	floor    int64 // largest count pruned
+}
+
+// NewClusterer constructs a clusterer with the given options or, when
+// nil, the defaults.
+func NewClusterer(opts *Options) *Clusterer {
+	var o Options
+	if opts != nil {
+		o = *opts
+	}
+	if o.MinCount <= 0 {
+		o.MinCount = 1000
+	}
+	if o.MinDensity <= 0 {
+		o.MinDensity = 0.5
+	}
+	if o.MaxTemplates <= 0 {
+		o.MaxTemplates = 1 << 16
+	}
+	if o.Examples <= 0 {
+		o.Examples = 3
+	}
+	return &Clusterer{opts: o, hosts: make(map[string]*hostClusters), strings: intern.NewTable()}
+}
+
+// Add adds a mapping of a shortener to its cluster.
+func (c *Clusterer) Add(host, shortcode, target string) {
+	h, ok := c.hosts[host]
+	if !ok {
+		h = &hostClusters{clusters: make(map[string]*Cluster)}
+		c.hosts[host] = h
+	}
+	ord := h.n
+	h.n++
+	c.mappings++
+	tmpl := Template(target)
+	if tmpl == "" {
+		return
+	}
+	cl, ok := h.clusters[tmpl]
+	if !ok {
+		if len(h.clusters) >= c.opts.MaxTemplates {
+			h.prune(c.opts.MaxTemplates / 2)
+		}
+		cl = &Cluster{Host: c.strings.String(host), Template: tmpl,
+			First: intern.Clone(shortcode), first: ord}
+		h.clusters[tmpl] = cl
+	}
+	cl.Count++
+	// Last is copied when the report is made, to not copy every
+	// shortcode
+	cl.last, cl.Last = ord, shortcode
+	if len(cl.Examples) < c.opts.Examples {
+		for _, ex := range cl.Examples {
+			if ex == target {
+				return
+			}
+		}
+		cl.Examples = append(cl.Examples, intern.Clone(target))
+	}
+}
+
+// prune removes the smallest clusters, until at most n remain.
+func (h *hostClusters) prune(n int) {
+	for len(h.clusters) > n {
+		h.floor++
+		for tmpl, cl := range h.clusters {
+			if cl.Count <= h.floor {
+				delete(h.clusters, tmpl)
+			}
+		}
+	}
+}
+
+// Report returns the flagged clusters of the mappings added so far.
+func (c *Clusterer) Report() *Report {
+	report := &Report{Mappings: c.mappings}
+	campaigns := make(map[string]*Campaign)
+	for _, h := range c.hosts {
+		for _, cl := range h.clusters {
+			if cl.Count < c.opts.MinCount {
+				continue
+			}
+			density := float64(cl.Count) / float64(cl.last-cl.first+1)
+			if density < c.opts.MinDensity {
+				continue
+			}
+			r := *cl
+			r.Last = intern.Clone(cl.Last)
+			r.Share = float64(cl.Count) / float64(h.n)
+			r.Density = density
+			r.Examples = append([]string(nil), cl.Examples...)
+			report.Clusters = append(report.Clusters, r)
+			camp, ok := campaigns[cl.Template]
+			if !ok {
+				camp = &Campaign{Template: cl.Template}
+				campaigns[cl.Template] = camp
+			}
+			camp.Count += cl.Count
+			camp.Hosts = append(camp.Hosts, cl.Host)
+		}
+	}
+	sort.Slice(report.Clusters, func(i, j int) bool {
+		a, b := &report.Clusters[i], &report.Clusters[j]
+		if a.Count != b.Count {
+			return a.Count > b.Count
+		}
+		if a.Host != b.Host {
+			return a.Host < b.Host
+		}
+		return a.Template < b.Template
+	})
+	for _, camp := range campaigns {
+		if len(camp.Hosts) > 1 {
+			sort.Strings(camp.Hosts)
+			report.Campaigns = append(report.Campaigns, *camp)
+		}
+	}
+	sort.Slice(report.Campaigns, func(i, j int) bool {
+		a, b := &report.Campaigns[i], &report.Campaigns[j]
+		if a.Count != b.Count {
+			return a.Count > b.Count
+		}
+		return a.Template < b.Template
+	})
+	return report
+}
@@ -0,0 +1,84 @@
+// Copyright (c) 2021 Andrew Archibald
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package spam
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestTemplate(t *testing.T) {
+	for _, tt := range []struct {
+		target, want string
+	}{
+		{"http://www.Example.com/", "example.com"},
+		{"https://example.com/p/12345", "example.com/p/{n}"},
+		{"https://example.com/item/a8Fk2Qx9/buy", "example.com/item/{id}/buy"},
+		{"https://example.com/page2.html", "example.com/page{n}.html"},
+		{"https://example.com/?utm=1&ref=2&ref=3#top", "example.com?ref&utm"},
+		{"https://example.com/cheap-pills", "example.com/cheap-pills"},
+		{"mailto:someone@example.com", ""},
+		{"not a url", ""},
+	} {
+		if got := Template(tt.target); got != tt.want {
+			t.Errorf("Template(%q) = %q, want %q", tt.target, got, tt.want)
+		}
+	}
+}
+
+func TestClusterer(t *testing.T) {
+	c := NewClusterer(&Options{MinCount: 50, MinDensity: 0.8, Examples: 2})
+	for i := 0; i < 200; i++ {
+		code := fmt.Sprintf("%04d", i)
+		switch {
+		case i >= 100 && i < 190:
+			// A campaign of consecutive shortcodes
+			c.Add("example.com", code, fmt.Sprintf("http://spam.example/offer/%d?id=%d", i%7, i))
+			c.Add("other.com", code, fmt.Sprintf("http://spam.example/offer/%d?id=%d", i, i))
+		case i%3 == 0:
+			// Scattered, so not dense
+			c.Add("example.com", code, fmt.Sprintf("http://blog.example/post/%d", i))
+		default:
+			c.Add("example.com", code, fmt.Sprintf("http://site%d.example/", i))
+		}
+	}
+	report := c.Report()
+	want := &Report{
+		Clusters: []Cluster{{
+			Host: "example.com", Template: "spam.example/offer/{n}?id", Count: 90, Share: 0.45,
+			First: "0100", Last: "0189", Density: 1,
+			Examples: []string{"http://spam.example/offer/2?id=100", "http://spam.example/offer/3?id=101"},
+			first:    100, last: 189,
+		}, {
+			Host: "other.com", Template: "spam.example/offer/{n}?id", Count: 90, Share: 1,
+			First: "0100", Last: "0189", Density: 1,
+			Examples: []string{"http://spam.example/offer/100?id=100", "http://spam.example/offer/101?id=101"},
+			first:    0, last: 89,
+		}},
+		Campaigns: []Campaign{{Template: "spam.example/offer/{n}?id", Count: 180, Hosts: []string{"example.com", "other.com"}}},
+		Mappings:  290,
+	}
+	if !reflect.DeepEqual(report, want) {
+		t.Errorf("got report %+v, want %+v", report, want)
+	}
+}
+
+func TestPrune(t *testing.T) {
+	c := NewClusterer(&Options{MinCount: 10, MaxTemplates: 8})
+	for i := 0; i < 1000; i++ {
+		c.Add("example.com", fmt.Sprint(i), fmt.Sprintf("http://site%d.example/", i))
+		c.Add("example.com", fmt.Sprint(i), "http://spam.example/")
+	}
+	if n := len(c.hosts["example.com"].clusters); n > 8 {
+		t.Errorf("tracking %d templates, want at most 8", n)
+	}
+	report := c.Report()
+	if len(report.Clusters) != 1 || report.Clusters[0].Template != "spam.example" || report.Clusters[0].Count != 1000 {
+		t.Errorf("got clusters %+v", report.Clusters)
+	}
+}
@@ -9,14 +9,14 @@
 package tinyback
 
 import (
-	"fmt"
 	"io"
 	"path/filepath"
 	"strings"
 
-	"github.com/andrewarchi/archive"
 	"github.com/andrewarchi/urlhero/beacon"
 	"github.com/andrewarchi/urlhero/ia"
+	"github.com/andrewarchi/urlhero/logger"
+	"github.com/andrewarchi/urlhero/xz"
 )
 
 // Scraper: https://github.com/ArchiveTeam/tinyback
@@ -44,13 +44,12 @@ func ProcessRelease(dir string) error {
 }
 
 func processFile(file *ia.FileMeta, dir string) error {
-	fmt.Print(file.Name)
 	fv, err := file.OpenValidator(dir)
 	if err != nil {
 		return err
 	}
 	defer fv.Close()
-	xr, err := archive.NewXZReader(fv)
+	xr, err := xz.NewReader(fv)
 	if err != nil {
 		return err
 	}
@@ -68,6 +67,6 @@ func processFile(file *ia.FileMeta, dir string) error {
 		n++
 		_ = link
 	}
-	fmt.Printf(" [%d links]\n", n)
+	logger.Info("processed file", "file", file.Name, "links", n)
 	return nil
 }
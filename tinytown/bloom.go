@@ -0,0 +1,224 @@
+// Copyright (c) 2021 Andrew Archibald
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package tinytown
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+)
+
+// Bloom is a probabilistic set of the shortcodes of shorteners, so
+// that crawlers can cheaply check whether URLTeam has already archived
+// a shortcode before requesting it. Contains never reports false for a
+// shortcode that was added, but may report true, at the false positive
+// rate, for one that was not.
+type Bloom struct {
+	bits []uint64
+	m    uint64 // number of bits
+	k    uint32 // number of hashes
+}
+
+// bloomMagic starts the serialization of a Bloom filter.
+const bloomMagic = "urlbloom"
+
+// ErrBloomFormat is returned when reading a Bloom filter that is
+// malformed.
+var ErrBloomFormat = errors.New("tinytown: malformed bloom filter")
+
+// NewBloom constructs an empty Bloom filter sized for n shortcodes at a
+// false positive rate p, such as 0.01. When more are added, the rate
+// rises.
+func NewBloom(n int, p float64) *Bloom {
+	if n < 1 {
+		n = 1
+	}
+	if p <= 0 || p >= 1 {
+		p = 0.01
+	}
+	m := uint64(math.Ceil(-float64(n) * math.Log(p) / (math.Ln2 * math.Ln2)))
+	m = (m + 63) &^ 63
+	k := uint32(math.Round(float64(m) / float64(n) * math.Ln2))
+	if k < 1 {
+		k = 1
+	}
+	return &Bloom{bits: make([]uint64, m/64), m: m, k: k}
+}
+
+// BuildBloom adds the shortcodes of every release in releasesDir to a
+// Bloom filter sized for n shortcodes at a false positive rate p.
+func BuildBloom(releasesDir string, n int, p float64) (*Bloom, error) {
+	return BuildBloomContext(context.Background(), releasesDir, n, p)
+}
+
+// BuildBloomContext is like BuildBloom, but stops when the context is
+// done.
+func BuildBloomContext(ctx context.Context, releasesDir string, n int, p float64) (*Bloom, error) {
+	b := NewBloom(n, p)
+	hosts := make(map[*Meta]string)
+	err := ProcessMappingsContext(ctx, releasesDir, func(m Mapping) error {
+		host, ok := hosts[m.Project]
+		if !ok {
+			host = m.Project.Host()
+			hosts[m.Project] = host
+		}
+		b.add(host, m.Shortcode)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// Add adds a shortcode of a shortener, given by name or host.
+func (b *Bloom) Add(shortener, shortcode string) {
+	b.add(shortenerHost(shortener), shortcode)
+}
+
+func (b *Bloom) add(host, shortcode string) {
+	h1, h2 := bloomHash(host, shortcode)
+	for i := uint32(0); i < b.k; i++ {
+		bit := (h1 + uint64(i)*h2) % b.m
+		b.bits[bit/64] |= 1 << (bit % 64)
+	}
+}
+
+// Contains reports whether a shortcode of a shortener, given by name or
+// host, may have been added.
+func (b *Bloom) Contains(shortener, shortcode string) bool {
+	h1, h2 := bloomHash(shortenerHost(shortener), shortcode)
+	for i := uint32(0); i < b.k; i++ {
+		bit := (h1 + uint64(i)*h2) % b.m
+		if b.bits[bit/64]&(1<<(bit%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// bloomHash returns the two hashes of a shortcode, from which the k
+// hashes are derived, as in Kirsch and Mitzenmacher, "Less Hashing,
+// Same Performance". The first is FNV-1a of the host and shortcode and
+// the second mixes the first, as in SplitMix64, and is odd, so that the
+// derived hashes do not repeat.
+func bloomHash(host, shortcode string) (uint64, uint64) {
+	const offset, prime = 14695981039346656037, 1099511628211
+	h := uint64(offset)
+	for i := 0; i < len(host); i++ {
+		h = (h ^ uint64(host[i])) * prime
+	}
+	h *= prime // a zero byte separates the host and shortcode
+	for i := 0; i < len(shortcode); i++ {
+		h = (h ^ uint64(shortcode[i])) * prime
+	}
+	z := h + 0x9e3779b97f4a7c15
+	z = (z ^ z>>30) * 0xbf58476d1ce4e5b9
+	z = (z ^ z>>27) * 0x94d049bb133111eb
+	z ^= z >> 31
+	return h, z | 1
+}
+
+// WriteTo writes the filter, to be read by ReadBloom.
+func (b *Bloom) WriteTo(w io.Writer) (int64, error) {
+	bw := bufio.NewWriter(w)
+	var header [len(bloomMagic) + 12]byte
+	copy(header[:], bloomMagic)
+	binary.LittleEndian.PutUint32(header[len(bloomMagic):], b.k)
+	binary.LittleEndian.PutUint64(header[len(bloomMagic)+4:], b.m)
+	bw.Write(header[:])
+	var word [8]byte
+	for _, bits := range b.bits {
+		binary.LittleEndian.PutUint64(word[:], bits)
+		bw.Write(word[:])
+	}
+	if err := bw.Flush(); err != nil {
+		return 0, err
+	}
+	return int64(len(header) + 8*len(b.bits)), nil
+}
+
+// maxBloomHashes is the most hashes of a filter that ReadBloom accepts,
+// which NewBloom exceeds only for false positive rates below 1e-19.
+const maxBloomHashes = 64
+
+// bloomChunk is the number of words of bits that ReadBloom allocates at
+// a time, so that a malformed header of a short filter does not cause
+// a large allocation.
+const bloomChunk = 1 << 17
+
+// ReadBloom reads a filter written by WriteTo. When r reports its
+// length, as files and in-memory readers do, the number of bits in the
+// header is checked against it before they are read; otherwise the bits
+// are allocated as they are read.
+func ReadBloom(r io.Reader) (*Bloom, error) {
+	size, sized := remaining(r)
+	br := bufio.NewReader(r)
+	var header [len(bloomMagic) + 12]byte
+	if _, err := io.ReadFull(br, header[:]); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			err = ErrBloomFormat
+		}
+		return nil, err
+	}
+	if string(header[:len(bloomMagic)]) != bloomMagic {
+		return nil, ErrBloomFormat
+	}
+	k := binary.LittleEndian.Uint32(header[len(bloomMagic):])
+	m := binary.LittleEndian.Uint64(header[len(bloomMagic)+4:])
+	if k == 0 || k > maxBloomHashes || m == 0 || m%64 != 0 || m > 1<<40 {
+		return nil, fmt.Errorf("%w: %d bits and %d hashes", ErrBloomFormat, m, k)
+	}
+	if sized && m/8 > uint64(size-int64(len(header))) {
+		return nil, fmt.Errorf("%w: %d bits in %d bytes", ErrBloomFormat, m, size-int64(len(header)))
+	}
+	b := &Bloom{m: m, k: k}
+	var word [8]byte
+	for n := m / 64; uint64(len(b.bits)) < n; {
+		chunk := n - uint64(len(b.bits))
+		if chunk > bloomChunk {
+			chunk = bloomChunk
+		}
+		bits := append(b.bits, make([]uint64, chunk)...)
+		for i := len(b.bits); i < len(bits); i++ {
+			if _, err := io.ReadFull(br, word[:]); err != nil {
+				if err == io.EOF || err == io.ErrUnexpectedEOF {
+					err = ErrBloomFormat
+				}
+				return nil, err
+			}
+			bits[i] = binary.LittleEndian.Uint64(word[:])
+		}
+		b.bits = bits
+	}
+	return b, nil
+}
+
+// remaining returns the number of bytes left to read from r, when it
+// reports them.
+func remaining(r io.Reader) (int64, bool) {
+	switch r := r.(type) {
+	case interface{ Len() int }:
+		return int64(r.Len()), true
+	case *os.File:
+		fi, err := r.Stat()
+		if err != nil || !fi.Mode().IsRegular() {
+			return 0, false
+		}
+		off, err := r.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return 0, false
+		}
+		return fi.Size() - off, true
+	}
+	return 0, false
+}
@@ -0,0 +1,110 @@
+// Copyright (c) 2021 Andrew Archibald
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package tinytown
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestBloom(t *testing.T) {
+	root := t.TempDir()
+	dir := filepath.Join(root, "urlteam_2021-01-01-00-00-00")
+	if err := os.Mkdir(dir, 0o777); err != nil {
+		t.Fatal(err)
+	}
+	var dump bytes.Buffer
+	for i := 0; i < 1000; i++ {
+		fmt.Fprintf(&dump, "%04d|http://example.org/%d\n", i, i)
+	}
+	writeProject(t, dir, map[string][]byte{"0000.txt.xz": dump.Bytes()})
+	b, err := BuildBloom(root, 1000, 0.01)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if _, err := b.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if b, err = ReadBloom(&buf); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 1000; i++ {
+		if shortcode := fmt.Sprintf("%04d", i); !b.Contains("example.com", shortcode) {
+			t.Fatalf("Contains(%s) = false for an added shortcode", shortcode)
+		}
+	}
+	if !b.Contains("example-com", "0000") {
+		t.Error("Contains by shortener name = false")
+	}
+	falsePositives := 0
+	for i := 1000; i < 11000; i++ {
+		if b.Contains("example.com", fmt.Sprintf("%05d", i)) {
+			falsePositives++
+		}
+	}
+	if falsePositives > 300 {
+		t.Errorf("%d false positives of 10000, want about 100", falsePositives)
+	}
+	if _, err := ReadBloom(strings.NewReader("urlbloom")); !errors.Is(err, ErrBloomFormat) {
+		t.Errorf("ReadBloom of truncated filter: got error %v, want ErrBloomFormat", err)
+	}
+}
+
+func TestReadBloomHeader(t *testing.T) {
+	header := func(k uint32, m uint64) []byte {
+		b := append([]byte(bloomMagic), make([]byte, 12)...)
+		binary.LittleEndian.PutUint32(b[len(bloomMagic):], k)
+		binary.LittleEndian.PutUint64(b[len(bloomMagic)+4:], m)
+		return append(b, make([]byte, 64)...) // 512 bits
+	}
+	if b, err := ReadBloom(bytes.NewReader(header(3, 512))); err != nil || b.m != 512 || b.k != 3 {
+		t.Fatalf("ReadBloom: got %+v, %v", b, err)
+	}
+	f, err := os.Create(filepath.Join(t.TempDir(), "bloom"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.Write(header(3, 1<<39)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		name string
+		r    io.Reader
+	}{
+		{"no hashes", bytes.NewReader(header(0, 512))},
+		{"too many hashes", bytes.NewReader(header(1000, 512))},
+		{"no bits", bytes.NewReader(header(3, 0))},
+		{"partial word", bytes.NewReader(header(3, 500))},
+		{"too many bits", bytes.NewReader(header(3, 1<<50))},
+		{"bits beyond reader", bytes.NewReader(header(3, 1<<39))},
+		{"bits beyond file", f},
+		{"bits beyond stream", io.MultiReader(bytes.NewReader(header(3, 1<<39)))},
+	} {
+		var before, after runtime.MemStats
+		runtime.ReadMemStats(&before)
+		if _, err := ReadBloom(tt.r); !errors.Is(err, ErrBloomFormat) {
+			t.Errorf("%s: got error %v, want ErrBloomFormat", tt.name, err)
+		}
+		runtime.ReadMemStats(&after)
+		if alloc := after.TotalAlloc - before.TotalAlloc; alloc > 16<<20 {
+			t.Errorf("%s: allocated %d bytes", tt.name, alloc)
+		}
+	}
+}
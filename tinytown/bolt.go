@@ -0,0 +1,192 @@
+// Copyright (c) 2021 Andrew Archibald
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package tinytown
+
+import (
+	"encoding/binary"
+	"errors"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Bolt storage has a bucket for each host, with a key for each
+// shortcode and values of the target, project, and release, each
+// prefixed by its length as a uvarint. Projects are in a bucket whose
+// name, starting with NUL, is no host, with a key for each name and
+// values of the host.
+
+// boltBatch is the number of puts per transaction.
+const boltBatch = 100000
+
+var errBoltEntry = errors.New("tinytown: malformed bolt entry")
+
+// boltProjects is the name of the bucket of projects.
+var boltProjects = []byte("\x00projects")
+
+type boltStorage struct {
+	db *bolt.DB
+	tx *bolt.Tx // open write transaction, if any
+	n  int      // puts in tx
+}
+
+func openBolt(filename string, readOnly bool) (Storage, error) {
+	db, err := bolt.Open(filename, 0o644, &bolt.Options{ReadOnly: readOnly, Timeout: time.Minute})
+	if err != nil {
+		return nil, err
+	}
+	return &boltStorage{db: db}, nil
+}
+
+func (s *boltStorage) Put(host string, e Entry) error {
+	if err := s.begin(); err != nil {
+		return err
+	}
+	b, err := s.tx.CreateBucketIfNotExists([]byte(host))
+	if err != nil {
+		return err
+	}
+	if err := b.Put([]byte(e.Shortcode), encodeBoltEntry(e)); err != nil {
+		return err
+	}
+	s.n++
+	if s.n >= boltBatch {
+		return s.commit()
+	}
+	return nil
+}
+
+func (s *boltStorage) PutProject(name, host string) error {
+	if err := s.begin(); err != nil {
+		return err
+	}
+	b, err := s.tx.CreateBucketIfNotExists(boltProjects)
+	if err != nil {
+		return err
+	}
+	return b.Put([]byte(name), []byte(host))
+}
+
+// begin opens a write transaction, if none is open.
+func (s *boltStorage) begin() error {
+	if s.db.IsReadOnly() {
+		return ErrReadOnly
+	}
+	if s.tx != nil {
+		return nil
+	}
+	tx, err := s.db.Begin(true)
+	if err != nil {
+		return err
+	}
+	s.tx = tx
+	return nil
+}
+
+func (s *boltStorage) Flush() error {
+	return s.commit()
+}
+
+func (s *boltStorage) commit() error {
+	if s.tx == nil {
+		return nil
+	}
+	err := s.tx.Commit()
+	s.tx, s.n = nil, 0
+	return err
+}
+
+// view calls fn in the open write transaction, so that buffered puts
+// are visible, or else in a read transaction.
+func (s *boltStorage) view(fn func(tx *bolt.Tx) error) error {
+	if s.tx != nil {
+		return fn(s.tx)
+	}
+	return s.db.View(fn)
+}
+
+func (s *boltStorage) Get(host, shortcode string) (Entry, bool, error) {
+	var e Entry
+	var ok bool
+	err := s.view(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(host))
+		if b == nil {
+			return nil
+		}
+		v := b.Get([]byte(shortcode))
+		if v == nil {
+			return nil
+		}
+		var err error
+		e, err = decodeBoltEntry(shortcode, v)
+		ok = err == nil
+		return err
+	})
+	return e, ok, err
+}
+
+func (s *boltStorage) Iterate(host string, fn func(Entry) error) error {
+	return s.view(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(host))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			e, err := decodeBoltEntry(string(k), v)
+			if err != nil {
+				return err
+			}
+			return fn(e)
+		})
+	})
+}
+
+func (s *boltStorage) Projects() (map[string]string, error) {
+	projects := make(map[string]string)
+	err := s.view(func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltProjects)
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			projects[string(k)] = string(v)
+			return nil
+		})
+	})
+	return projects, err
+}
+
+func (s *boltStorage) Close() error {
+	err := s.commit()
+	if err1 := s.db.Close(); err == nil {
+		err = err1
+	}
+	return err
+}
+
+func encodeBoltEntry(e Entry) []byte {
+	buf := make([]byte, 0, len(e.Target)+len(e.Project)+len(e.Release)+3*binary.MaxVarintLen32)
+	var n [binary.MaxVarintLen64]byte
+	for _, field := range []string{e.Target, e.Project, e.Release} {
+		buf = append(buf, n[:binary.PutUvarint(n[:], uint64(len(field)))]...)
+		buf = append(buf, field...)
+	}
+	return buf
+}
+
+func decodeBoltEntry(shortcode string, v []byte) (Entry, error) {
+	var fields [3]string
+	for i := range fields {
+		n, size := binary.Uvarint(v)
+		if size <= 0 || uint64(len(v)-size) < n {
+			return Entry{}, errBoltEntry
+		}
+		fields[i] = string(v[size : size+int(n)])
+		v = v[size+int(n):]
+	}
+	return Entry{shortcode, fields[0], fields[1], fields[2]}, nil
+}
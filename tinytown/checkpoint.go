@@ -0,0 +1,124 @@
+// Copyright (c) 2021 Andrew Archibald
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package tinytown
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Checkpoint records the project zips of releases that are completely
+// processed, so that processing that stops, such as with a crash,
+// resumes after them. Its file has a line for each project of its
+// release identifier and filename, such as
+// "urlteam_2021-01-01-00-00-00/bitly_6_1609459200.zip", which is synced
+// as it is appended, so that a torn final line only loses its project.
+type Checkpoint struct {
+	f    *os.File
+	done map[string]bool
+
+	// Sync, when not nil, is called before each project is recorded, to
+	// persist the effects of processing its links, such as buffered
+	// writes.
+	Sync func() error
+}
+
+// OpenCheckpoint opens or creates the checkpoint file at filename.
+func OpenCheckpoint(filename string) (*Checkpoint, error) {
+	f, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	data, err := io.ReadAll(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	// Drop a torn final line
+	n := bytes.LastIndexByte(data, '\n') + 1
+	if n != len(data) {
+		if err := f.Truncate(int64(n)); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	if _, err := f.Seek(int64(n), io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	done := make(map[string]bool)
+	for _, line := range strings.Split(string(data[:n]), "\n") {
+		if line != "" {
+			done[line] = true
+		}
+	}
+	return &Checkpoint{f: f, done: done}, nil
+}
+
+// checkpointKey returns the key of a project zip in a checkpoint.
+func checkpointKey(filename string) string {
+	return releaseID(filename) + "/" + filepath.Base(filename)
+}
+
+// Done reports whether the project zip with the given filename is
+// recorded as processed.
+func (cp *Checkpoint) Done(filename string) bool {
+	return cp.done[checkpointKey(filename)]
+}
+
+// Len returns the number of projects recorded as processed.
+func (cp *Checkpoint) Len() int {
+	return len(cp.done)
+}
+
+// Mark records the project zip with the given filename as processed,
+// after calling Sync, if any.
+func (cp *Checkpoint) Mark(filename string) error {
+	key := checkpointKey(filename)
+	if cp.done[key] {
+		return nil
+	}
+	if cp.Sync != nil {
+		if err := cp.Sync(); err != nil {
+			return err
+		}
+	}
+	if _, err := cp.f.WriteString(key + "\n"); err != nil {
+		return err
+	}
+	if err := cp.f.Sync(); err != nil {
+		return err
+	}
+	cp.done[key] = true
+	return nil
+}
+
+// Close closes the checkpoint file.
+func (cp *Checkpoint) Close() error {
+	return cp.f.Close()
+}
+
+// ProcessReleasesCheckpoint is like ProcessReleasesContext, but skips
+// the projects that cp records as processed and records each project in
+// cp once it is, so that processing that stops resumes with the project
+// that it stopped in. The links of that project that were visited
+// before it stopped are visited again.
+func ProcessReleasesCheckpoint(ctx context.Context, root string, fn ProcessFunc, cp *Checkpoint) error {
+	return walkProjects(ctx, root, nil, func(filename string) error {
+		if cp.Done(filename) {
+			return nil
+		}
+		if err := ProcessProjectContext(ctx, filename, fn); err != nil {
+			return err
+		}
+		return cp.Mark(filename)
+	})
+}
@@ -0,0 +1,111 @@
+// Copyright (c) 2021 Andrew Archibald
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package tinytown
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/andrewarchi/urlhero/beacon"
+)
+
+func TestCheckpoint(t *testing.T) {
+	root := t.TempDir()
+	for i, dump := range []string{
+		"abc|http://example.org/1\nxyz|http://example.org/2\n",
+		"abc|http://example.org/3\n",
+	} {
+		dir := filepath.Join(root, fmt.Sprintf("urlteam_2021-01-0%d-00-00-00", i+1))
+		if err := os.Mkdir(dir, 0o777); err != nil {
+			t.Fatal(err)
+		}
+		writeProject(t, dir, map[string][]byte{"abc.txt.xz": []byte(dump)})
+	}
+	second := filepath.Join(root, "urlteam_2021-01-02-00-00-00", "example_1609459200.zip")
+	cpPath := filepath.Join(t.TempDir(), "checkpoint")
+	cp, err := OpenCheckpoint(cpPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	errCrash := errors.New("crash")
+	err = ProcessReleasesCheckpoint(context.Background(), root, func(l *beacon.Link, m *Meta, shortcodeLen int, releaseFilename, dumpFilename string) error {
+		if releaseFilename == second {
+			return errCrash
+		}
+		return nil
+	}, cp)
+	if err != errCrash {
+		t.Fatalf("got error %v, want %v", err, errCrash)
+	}
+	if err := cp.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A torn final line is dropped
+	f, err := os.OpenFile(cpPath, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString("urlteam_2021-01-02")
+	f.Close()
+	if cp, err = OpenCheckpoint(cpPath); err != nil {
+		t.Fatal(err)
+	}
+	if cp.Len() != 1 || cp.Done(second) {
+		t.Errorf("got %d projects done, second %t, want only the first", cp.Len(), cp.Done(second))
+	}
+	var got []string
+	if err := ProcessReleasesCheckpoint(context.Background(), root, func(l *beacon.Link, m *Meta, shortcodeLen int, releaseFilename, dumpFilename string) error {
+		got = append(got, l.Target)
+		return nil
+	}, cp); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"http://example.org/3"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("resumed links: got %q, want %q", got, want)
+	}
+	if !cp.Done(second) {
+		t.Error("second project not recorded")
+	}
+	cp.Close()
+
+	// Builds that stop resume from the temporary file
+	path := filepath.Join(t.TempDir(), "index")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ctx = WithProgress(ctx, func(e ProgressEvent) {
+		if e.Kind == ProgressFile {
+			cancel()
+		}
+	})
+	if err := BuildIndexBackend(ctx, root, path, BackendBolt); !errors.Is(err, context.Canceled) {
+		t.Fatalf("got error %v, want context.Canceled", err)
+	}
+	if _, err := os.Stat(path + ".tmp"); err != nil {
+		t.Fatalf("temporary index removed: %v", err)
+	}
+	if err := BuildIndexBackend(context.Background(), root, path, BackendBolt); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path + ".checkpoint"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("checkpoint left: %v", err)
+	}
+	idx, err := OpenIndex(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idx.Close()
+	targets, _, err := idx.LookupBatch("example.com", []string{"abc", "xyz"})
+	if want := []string{"http://example.org/3", "http://example.org/2"}; err != nil || !reflect.DeepEqual(targets, want) {
+		t.Errorf("LookupBatch: got %q, %v, want %q", targets, err, want)
+	}
+}
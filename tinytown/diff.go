@@ -0,0 +1,158 @@
+// Copyright (c) 2021 Andrew Archibald
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package tinytown
+
+import (
+	"bytes"
+	"context"
+
+	"github.com/andrewarchi/urlhero/extsort"
+)
+
+// ShortenerDelta is the difference between the shortcodes of a
+// shortener in two releases.
+type ShortenerDelta struct {
+	Host    string `json:"host"`
+	Added   int64  `json:"added"`   // shortcodes only in the second release
+	Removed int64  `json:"removed"` // shortcodes only in the first release
+	Common  int64  `json:"common"`  // shortcodes in both
+}
+
+// Dropped reports whether the shortener is in the first release, but
+// not the second.
+func (d *ShortenerDelta) Dropped() bool {
+	return d.Added == 0 && d.Common == 0
+}
+
+// ShortcodeDelta is a shortcode that is in only one of two releases.
+type ShortcodeDelta struct {
+	Host      string
+	Shortcode string
+	Added     bool // in only the second release, otherwise only the first
+}
+
+// Diff compares the shortcodes of two release directories and returns
+// their differences for each shortener that is in either, in order of
+// host. Targets are not compared.
+func Diff(a, b string) ([]ShortenerDelta, error) {
+	return DiffContext(context.Background(), a, b, nil)
+}
+
+// DiffContext is like Diff, but stops when the context is done and
+// calls fn, when not nil, with each shortcode that is in only one of
+// the releases, in order of host and shortcode. The shortcodes of each
+// release are sorted externally, so memory use is bounded, however
+// large the releases are.
+func DiffContext(ctx context.Context, a, b string, fn func(ShortcodeDelta) error) ([]ShortenerDelta, error) {
+	sa, err := sortShortcodes(ctx, a)
+	if sa != nil {
+		defer sa.Close()
+	}
+	if err != nil {
+		return nil, err
+	}
+	sb, err := sortShortcodes(ctx, b)
+	if sb != nil {
+		defer sb.Close()
+	}
+	if err != nil {
+		return nil, err
+	}
+	itA, err := sa.Sort()
+	if err != nil {
+		return nil, err
+	}
+	itB, err := sb.Sort()
+	if err != nil {
+		return nil, err
+	}
+	itA, itB = extsort.Unique(itA, bytes.Equal), extsort.Unique(itB, bytes.Equal)
+
+	// Items of both releases are visited in order, so hosts are too
+	var deltas []ShortenerDelta
+	var d *ShortenerDelta
+	// delta returns the delta of the host of an item
+	delta := func(item []byte) *ShortenerDelta {
+		host := item[:bytes.IndexByte(item, 0)]
+		if d == nil || d.Host != string(host) {
+			deltas = append(deltas, ShortenerDelta{Host: string(host)})
+			d = &deltas[len(deltas)-1]
+		}
+		return d
+	}
+	record := func(item []byte, added bool) error {
+		d := delta(item)
+		if added {
+			d.Added++
+		} else {
+			d.Removed++
+		}
+		if fn == nil {
+			return nil
+		}
+		i := bytes.IndexByte(item, 0)
+		return fn(ShortcodeDelta{Host: d.Host, Shortcode: string(item[i+1:]), Added: added})
+	}
+	okA, okB := itA.Next(), itB.Next()
+	for n := 1; okA || okB; n++ {
+		if n%ctxCheckInterval == 0 {
+			if err := ctx.Err(); err != nil {
+				return deltas, err
+			}
+		}
+		var cmp int
+		switch {
+		case !okB:
+			cmp = -1
+		case !okA:
+			cmp = 1
+		default:
+			cmp = bytes.Compare(itA.Item(), itB.Item())
+		}
+		switch {
+		case cmp < 0:
+			err = record(itA.Item(), false)
+			okA = itA.Next()
+		case cmp > 0:
+			err = record(itB.Item(), true)
+			okB = itB.Next()
+		default:
+			delta(itA.Item()).Common++
+			okA, okB = itA.Next(), itB.Next()
+		}
+		if err != nil {
+			return deltas, err
+		}
+	}
+	if err := itA.Err(); err != nil {
+		return deltas, err
+	}
+	if err := itB.Err(); err != nil {
+		return deltas, err
+	}
+	return deltas, nil
+}
+
+// sortShortcodes sorts the shortcodes of a release, as host NUL
+// shortcode.
+func sortShortcodes(ctx context.Context, dir string) (*extsort.Sorter, error) {
+	s := extsort.NewSorter(func(a, b []byte) bool { return bytes.Compare(a, b) < 0 }, "", DefaultMergeMemory)
+	hosts := make(map[*Meta]string)
+	var item []byte
+	err := ProcessReleaseContext(ctx, dir, mappingFunc(func(m Mapping) error {
+		host, ok := hosts[m.Project]
+		if !ok {
+			host = m.Project.Host()
+			hosts[m.Project] = host
+		}
+		item = append(item[:0], host...)
+		item = append(item, 0)
+		item = append(item, m.Shortcode...)
+		return s.Add(item)
+	}))
+	return s, err
+}
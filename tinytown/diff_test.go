@@ -0,0 +1,54 @@
+// Copyright (c) 2021 Andrew Archibald
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package tinytown
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestDiff(t *testing.T) {
+	root := t.TempDir()
+	a, b := filepath.Join(root, "urlteam_2021-01-01-00-00-00"), filepath.Join(root, "urlteam_2021-01-02-00-00-00")
+	for dir, dump := range map[string]string{
+		a: "abc|http://example.org/1\nxyz|http://example.org/2\nabc|http://example.org/1\n",
+		b: "abc|http://example.org/3\nmno|http://example.org/4\n",
+	} {
+		if err := os.Mkdir(dir, 0o777); err != nil {
+			t.Fatal(err)
+		}
+		writeProject(t, dir, map[string][]byte{"abc.txt.xz": []byte(dump)})
+	}
+	var got []ShortcodeDelta
+	deltas, err := DiffContext(context.Background(), a, b, func(d ShortcodeDelta) error {
+		got = append(got, d)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []ShortcodeDelta{{"example.com", "mno", true}, {"example.com", "xyz", false}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got shortcodes %+v, want %+v", got, want)
+	}
+	if want := []ShortenerDelta{{Host: "example.com", Added: 1, Removed: 1, Common: 1}}; !reflect.DeepEqual(deltas, want) {
+		t.Errorf("got deltas %+v, want %+v", deltas, want)
+	}
+
+	// A shortener only in the first release was dropped
+	empty := filepath.Join(root, "urlteam_2021-01-03-00-00-00")
+	if err := os.Mkdir(empty, 0o777); err != nil {
+		t.Fatal(err)
+	}
+	deltas, err = Diff(a, empty)
+	if err != nil || len(deltas) != 1 || deltas[0].Removed != 2 || !deltas[0].Dropped() {
+		t.Errorf("Diff to an empty release = %+v, %v, want example.com dropped", deltas, err)
+	}
+}
@@ -0,0 +1,149 @@
+// Copyright (c) 2021 Andrew Archibald
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package tinytown
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/andrewarchi/urlhero/ia"
+	"github.com/andrewarchi/urlhero/logger"
+	"golang.org/x/time/rate"
+)
+
+// downloadReleaseHTTP downloads the files of a release that the filter
+// of the options selects directly from the Internet Archive, as listed
+// in its _files.xml metadata, and calls the OnFile function of the
+// options, when not nil, with each project zip as it completes. Files in
+// have, by their names in the item, are taken to be complete, as are
+// files that exist and match their checksums, so that a release that a
+// torrent partly downloaded is resumed. The torrent of the item and
+// private files are not downloaded, nor is any release with a file
+// whose name would escape the release directory. Downloads are limited
+// by lim, when not nil.
+func downloadReleaseHTTP(ctx context.Context, lim *rate.Limiter, dir, id string, have map[string]bool, opts *DownloadOptions) error {
+	releaseDir := filepath.Join(dir, id)
+	if err := os.MkdirAll(releaseDir, 0o755); err != nil {
+		return err
+	}
+	if err := saveFile(ctx, downloadURL(id, id+"_files.xml"), filepath.Join(releaseDir, id+"_files.xml")); err != nil {
+		return err
+	}
+	meta, err := ia.ReadFileMeta(releaseDir)
+	if err != nil {
+		return err
+	}
+	files := releaseFiles(id, meta, opts)
+	filenames := make([]string, len(files))
+	var total int64
+	for i, f := range files {
+		if filenames[i], err = itemPath(releaseDir, f.Name); err != nil {
+			return err
+		}
+		total += f.Size
+	}
+
+	progress := progressFrom(ctx)
+	if len(files) == 0 && progress != nil {
+		progress(ProgressEvent{Kind: ProgressTorrent, Release: id})
+	}
+	var done int64
+	for i := range files {
+		f, filename := &files[i], filenames[i]
+		if !have[f.Name] && !validFile(ctx, filename, f) {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			logger.Debug("downloading file", "id", id, "file", f.Name, "size", f.Size)
+			if err := os.MkdirAll(filepath.Dir(filename), 0o755); err != nil {
+				return err
+			}
+			if err := fetchFile(ctx, downloadURL(id, f.Name), filename, f, lim); err != nil {
+				return err
+			}
+			if strings.HasSuffix(f.Name, ".zip") && opts.OnFile != nil {
+				opts.OnFile(filename)
+			}
+		}
+		done += f.Size
+		if progress != nil {
+			kind := ProgressBytes
+			if i == len(files)-1 {
+				kind = ProgressTorrent
+			}
+			progress(ProgressEvent{Kind: kind, Release: id, N: done, Total: total})
+		}
+	}
+	return nil
+}
+
+// releaseFiles returns the files of the metadata of a release that are
+// downloaded over HTTPS, which are those that the filter of the options
+// selects, other than private files, the torrent of the item, and its
+// _files.xml metadata.
+func releaseFiles(id string, meta []ia.FileMeta, opts *DownloadOptions) []ia.FileMeta {
+	var files []ia.FileMeta
+	for _, f := range meta {
+		if f.Private || f.Name == id+"_files.xml" || f.Name == id+"_archive.torrent" || !opts.wants(f.Name) {
+			continue
+		}
+		files = append(files, f)
+	}
+	return files
+}
+
+// itemPath returns the path in dir of a file of an item, named with
+// slashes as in its metadata, or an error for names that are absolute
+// or that escape dir with "..".
+func itemPath(dir, name string) (string, error) {
+	filename := filepath.Join(dir, filepath.FromSlash(name))
+	rel, err := filepath.Rel(dir, filename)
+	if err != nil || path.IsAbs(name) || filepath.IsAbs(filepath.FromSlash(name)) ||
+		rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("tinytown: unsafe file name in item: %q", name)
+	}
+	return filename, nil
+}
+
+// validFile reports whether a file exists with the size and checksums
+// of its metadata.
+func validFile(ctx context.Context, filename string, f *ia.FileMeta) bool {
+	fi, err := os.Stat(filename)
+	if err != nil || fi.Size() != f.Size {
+		return false
+	}
+	return ia.ValidateFileContext(ctx, filename, f.MD5, f.SHA1, f.CRC32) == nil
+}
+
+// minRateBurst is the minimum burst of rate limits, which must fit the
+// largest read from a peer, of a chunk of 16 KiB, or from a response.
+const minRateBurst = 64 << 10
+
+// limitReader limits the rate of reads from a reader.
+type limitReader struct {
+	ctx context.Context
+	r   io.Reader
+	lim *rate.Limiter
+}
+
+func (r *limitReader) Read(p []byte) (int, error) {
+	if len(p) > r.lim.Burst() {
+		p = p[:r.lim.Burst()]
+	}
+	n, err := r.r.Read(p)
+	if n > 0 {
+		if err := r.lim.WaitN(r.ctx, n); err != nil {
+			return n, err
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,22 @@
+// Copyright (c) 2021 Andrew Archibald
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+//go:build !linux && !darwin && !freebsd
+// +build !linux,!darwin,!freebsd
+
+package tinytown
+
+import (
+	"fmt"
+	"runtime"
+)
+
+// DiskFree returns the number of bytes available to unprivileged users
+// on the file system containing path, which is unsupported on this
+// platform.
+func DiskFree(path string) (uint64, error) {
+	return 0, fmt.Errorf("tinytown: disk space unsupported on %s", runtime.GOOS)
+}
@@ -9,121 +9,812 @@
 package tinytown
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"net/http"
+	"net/url"
 	"os"
 	"path"
 	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/anacrolix/torrent"
 	"github.com/anacrolix/torrent/storage"
-	"github.com/andrewarchi/browser/jsonutil"
+	"github.com/andrewarchi/urlhero/crawl"
+	"github.com/andrewarchi/urlhero/ia"
+	"github.com/andrewarchi/urlhero/logger"
+	"github.com/andrewarchi/urlhero/report"
+	"golang.org/x/time/rate"
 )
 
 // DownloadTorrents downloads all terroroftinytown releases via torrent.
+// Releases that were completely downloaded to dir by an earlier call
+// are skipped, so that repeated calls only fetch new releases.
 func DownloadTorrents(dir string) error {
-	ids, err := GetReleaseIDs()
+	return DownloadTorrentsContext(context.Background(), dir)
+}
+
+// DownloadTorrentsContext is like DownloadTorrents, but stops when the
+// context is done.
+func DownloadTorrentsContext(ctx context.Context, dir string) error {
+	_, err := DownloadTorrentsSince(ctx, dir, "")
+	return err
+}
+
+// DownloadTorrentsSince is like DownloadTorrentsContext, but, when
+// since is not empty, only downloads the releases with identifiers
+// after it, such as the latest release of an earlier run. It returns
+// the identifiers of the releases that it downloaded.
+func DownloadTorrentsSince(ctx context.Context, dir, since string) ([]string, error) {
+	return DownloadTorrentsOptions(ctx, dir, since, nil)
+}
+
+// DownloadTorrentsOptions is like DownloadTorrentsSince, but downloads
+// with the given options, which may be nil.
+func DownloadTorrentsOptions(ctx context.Context, dir, since string, opts *DownloadOptions) ([]string, error) {
+	var filter *ReleaseFilter
+	if opts != nil {
+		filter = opts.Releases
+	}
+	ids, err := GetReleaseIDsFilter(ctx, filter)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	ids = PendingReleases(dir, ids, since)
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	if err := DownloadReleasesOptions(ctx, dir, ids, opts); err != nil {
+		return nil, err
 	}
+	return ids, nil
+}
 
-	conf := torrent.NewDefaultClientConfig()
-	conf.DataDir = dir
-	conf.DefaultStorage = storage.NewMMap(dir)
-	c, err := torrent.NewClient(conf)
-	if err != nil {
-		return err
+// downloadedMarker is the file in the directory of a release that marks
+// that every file of its torrent was downloaded.
+const downloadedMarker = ".downloaded"
+
+// Downloaded reports whether a release was completely downloaded to dir
+// by a download of this package.
+func Downloaded(dir, id string) bool {
+	_, err := os.Stat(filepath.Join(dir, id, downloadedMarker))
+	return err == nil
+}
+
+// PendingReleases returns the sorted identifiers of the releases that
+// are not yet downloaded to dir and, when since is not empty, are after
+// it. Identifiers of releases sort by their times.
+func PendingReleases(dir string, ids []string, since string) []string {
+	var pending []string
+	for _, id := range ids {
+		if (since == "" || id > since) && !Downloaded(dir, id) {
+			pending = append(pending, id)
+		}
 	}
+	sort.Strings(pending)
+	return pending
+}
 
-	for i, id := range ids {
-		fmt.Printf("(%d/%d) Adding %s\n", i+1, len(ids), id)
-		filename, err := saveTorrentFile(id, dir)
-		if err != nil {
+func markDownloaded(dir, id string) error {
+	stamp := time.Now().UTC().Format(time.RFC3339) + "\n"
+	return os.WriteFile(filepath.Join(dir, id, downloadedMarker), []byte(stamp), 0o644)
+}
+
+// DownloadMode is how releases are downloaded.
+type DownloadMode uint8
+
+const (
+	// DownloadTorrentOnly downloads releases via torrent.
+	DownloadTorrentOnly DownloadMode = iota
+	// DownloadHTTPOnly downloads the files of releases directly from the
+	// Internet Archive over HTTPS.
+	DownloadHTTPOnly
+	// DownloadAuto downloads releases via torrent, but falls back to
+	// HTTPS for releases whose torrents cannot be added or stall, as is
+	// common for old items without seeders.
+	DownloadAuto
+)
+
+var downloadModes = []string{
+	DownloadTorrentOnly: "torrent",
+	DownloadHTTPOnly:    "http",
+	DownloadAuto:        "auto",
+}
+
+// ParseDownloadMode parses the name of a download mode: torrent, http,
+// or auto.
+func ParseDownloadMode(name string) (DownloadMode, error) {
+	for m, n := range downloadModes {
+		if n == name {
+			return DownloadMode(m), nil
+		}
+	}
+	return 0, fmt.Errorf("tinytown: unknown download mode %q", name)
+}
+
+func (m DownloadMode) String() string {
+	if int(m) < len(downloadModes) {
+		return downloadModes[m]
+	}
+	return fmt.Sprintf("DownloadMode(%d)", uint8(m))
+}
+
+// DefaultStallTimeout is the default of DownloadOptions.StallTimeout.
+const DefaultStallTimeout = 10 * time.Minute
+
+// DownloadOptions contains options for downloading releases.
+type DownloadOptions struct {
+	// Mode is how releases are downloaded, by default via torrent only.
+	Mode DownloadMode
+	// StallTimeout is how long a torrent may go without downloading
+	// anything before its release is downloaded over HTTPS instead, in
+	// DownloadAuto mode, by default DefaultStallTimeout.
+	StallTimeout time.Duration
+	// OnFile, when not nil, is called with the filename of each project
+	// zip once it is downloaded, so that it can be processed before the
+	// rest of its release. It is called from another goroutine for each
+	// release.
+	OnFile func(filename string)
+	// Filter, when not nil, selects the files of releases that are
+	// downloaded by their names in the item, such as
+	// "bitly_6_1609459200.zip", so that derived and metadata files can be
+	// skipped. Releases are marked as downloaded once their selected
+	// files are, so later downloads of other files should name their
+	// releases.
+	Filter func(name string) bool
+	// MaxTorrents is the number of releases that are downloaded at once,
+	// by default DefaultMaxTorrents.
+	MaxTorrents int
+	// MaxConns, when positive, limits the peer connections of each
+	// torrent.
+	MaxConns int
+	// RateLimit, when positive, limits the rate of downloads from peers
+	// and over HTTPS, together, in bytes per second.
+	RateLimit int64
+	// Seed keeps seeding the torrents of the releases that are downloaded
+	// via torrent once every release is downloaded, until the context is
+	// done, SeedTime passes, or, when SeedRatio is positive, each has
+	// uploaded SeedRatio times its size.
+	Seed bool
+	// SeedRatio is the ratio of the bytes uploaded to the size of each
+	// torrent after which it is no longer seeded, or, when not positive,
+	// torrents are seeded until the context is done.
+	SeedRatio float64
+	// SeedTime, when positive, limits how long torrents are seeded.
+	SeedTime time.Duration
+	// SkipSpaceCheck skips comparing the size of the files that are
+	// downloaded, from the metadata of their releases, with the free
+	// space of the download directory before downloading.
+	SkipSpaceCheck bool
+	// Releases, when not nil, selects the releases that
+	// DownloadTorrentsOptions downloads of those that are listed.
+	// Releases that are given by identifier are always downloaded.
+	Releases *ReleaseFilter
+	// Report, when not nil, records the releases that cannot be
+	// downloaded as failures, and the rest are downloaded, instead of
+	// stopping at the first. Only errors starting the torrent client and
+	// of the context are then returned.
+	Report *report.Report
+}
+
+// wants reports whether a file of a release is selected by the filter.
+func (opts *DownloadOptions) wants(name string) bool {
+	return opts.Filter == nil || opts.Filter(name)
+}
+
+func (opts *DownloadOptions) maxTorrents() int {
+	if opts.MaxTorrents > 0 {
+		return opts.MaxTorrents
+	}
+	return DefaultMaxTorrents
+}
+
+func (opts *DownloadOptions) stallTimeout() time.Duration {
+	if opts.StallTimeout > 0 {
+		return opts.StallTimeout
+	}
+	return DefaultStallTimeout
+}
+
+// DownloadReleases downloads the given terroroftinytown releases via
+// torrent. Each release is saved to a directory named by its
+// identifier.
+func DownloadReleases(dir string, ids []string) error {
+	return DownloadReleasesFunc(dir, ids, nil)
+}
+
+// DownloadReleasesFunc is like DownloadReleases, but calls fn, when not
+// nil, with the filename of each project zip once it is downloaded, so
+// that it can be processed before the rest of its release. fn is called
+// from another goroutine for each release.
+func DownloadReleasesFunc(dir string, ids []string, fn func(filename string)) error {
+	return DownloadReleasesContext(context.Background(), dir, ids, fn)
+}
+
+// DownloadReleasesContext is like DownloadReleasesFunc, but stops when
+// the context is done. Pieces that were downloaded are kept, so a
+// download that is stopped resumes when it is started again.
+func DownloadReleasesContext(ctx context.Context, dir string, ids []string, fn func(filename string)) error {
+	return DownloadReleasesOptions(ctx, dir, ids, &DownloadOptions{OnFile: fn})
+}
+
+// DownloadReleasesReport is like DownloadReleasesContext, but records
+// the releases whose torrents cannot be fetched or added as failures in
+// rep and downloads the rest, instead of stopping at the first. Only
+// errors starting the torrent client and of the context are returned.
+func DownloadReleasesReport(ctx context.Context, dir string, ids []string, fn func(filename string), rep *report.Report) error {
+	return DownloadReleasesOptions(ctx, dir, ids, &DownloadOptions{OnFile: fn, Report: rep})
+}
+
+// DefaultMaxTorrents is the default of DownloadOptions.MaxTorrents.
+const DefaultMaxTorrents = 15
+
+// DownloadReleasesOptions is like DownloadReleasesContext, but
+// downloads with the given options, which may be nil. Each release is
+// marked as downloaded once it completes. When the options seed, the
+// context being done stops seeding without an error. Unless the options
+// skip it, a *SpaceError is returned before anything is downloaded when
+// the releases need more space than is free in dir.
+func DownloadReleasesOptions(ctx context.Context, dir string, ids []string, opts *DownloadOptions) error {
+	if opts == nil {
+		opts = &DownloadOptions{}
+	}
+	if !opts.SkipSpaceCheck {
+		if err := checkSpace(ctx, dir, ids, opts); err != nil {
 			return err
 		}
-		t, err := c.AddTorrentFromFile(filename)
+	}
+	var lim *rate.Limiter
+	if opts.RateLimit > 0 {
+		// The burst must fit the largest read from a peer or response
+		burst := int(opts.RateLimit)
+		if burst < minRateBurst {
+			burst = minRateBurst
+		}
+		lim = rate.NewLimiter(rate.Limit(opts.RateLimit), burst)
+	}
+	var c *torrent.Client
+	if opts.Mode != DownloadHTTPOnly {
+		conf := torrent.NewDefaultClientConfig()
+		conf.DataDir = dir
+		conf.DefaultStorage = storage.NewMMap(dir)
+		conf.HTTPUserAgent = crawl.UserAgent()
+		conf.Seed = opts.Seed
+		if lim != nil {
+			conf.DownloadRateLimiter = lim
+		}
+		if opts.MaxConns > 0 {
+			conf.EstablishedConnsPerTorrent = opts.MaxConns
+			if conf.HalfOpenConnsPerTorrent > opts.MaxConns {
+				conf.HalfOpenConnsPerTorrent = opts.MaxConns
+			}
+		}
+		var err error
+		c, err = torrent.NewClient(conf)
 		if err != nil {
 			return err
 		}
-		t.DownloadAll()
-		if i%15 == 14 {
-			c.WaitAll()
+		defer c.Close()
+	}
+
+	// Without a report, the first failure stops the download
+	dctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	rep := opts.Report
+	var mu sync.Mutex
+	var first error
+	work := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < opts.maxTorrents() && w < len(ids); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range work {
+				id := ids[i]
+				logger.Info("downloading release", "id", id, "n", i+1, "total", len(ids), "mode", opts.Mode)
+				err := downloadRelease(dctx, c, lim, dir, id, opts)
+				switch {
+				case err == nil:
+					if err := markDownloaded(dir, id); err != nil {
+						logger.Warn("marking release as downloaded failed", "id", id, "err", err)
+					}
+					if rep != nil {
+						rep.Succeed(1)
+					}
+				case dctx.Err() != nil:
+					// Stopped by the context or another failure
+				case rep != nil:
+					rep.Fail(id, err)
+				default:
+					mu.Lock()
+					if first == nil {
+						first = err
+					}
+					mu.Unlock()
+					cancel()
+				}
+			}
+		}()
+	}
+feed:
+	for i := range ids {
+		select {
+		case work <- i:
+		case <-dctx.Done():
+			break feed
 		}
 	}
-	c.WaitAll()
+	close(work)
+	wg.Wait()
+	if first != nil {
+		return first
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if opts.Seed && c != nil {
+		seed(ctx, c, opts.SeedRatio, opts.SeedTime)
+	}
 	return nil
 }
 
-// GetReleaseIDs queries the Internet Archive for the identifiers of all
-// incremental terroroftinytown releases.
-func GetReleaseIDs() ([]string, error) {
-	url := "https://archive.org/services/search/v1/scrape?q=subject:terroroftinytown&count=10000"
-	resp, err := httpGet(url)
+// seedInterval is the interval between checks of the upload ratios of
+// seeded torrents.
+var seedInterval = time.Minute
+
+// seed seeds the torrents of the client until each has uploaded ratio
+// times its size, when ratio is positive, d passes, when positive, or
+// the context is done.
+func seed(ctx context.Context, c *torrent.Client, ratio float64, d time.Duration) {
+	logger.Info("seeding releases", "torrents", len(c.Torrents()), "ratio", ratio, "time", d)
+	if d > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d)
+		defer cancel()
+	}
+	tick := time.NewTicker(seedInterval)
+	defer tick.Stop()
+	for {
+		if ratio > 0 {
+			seeding := 0
+			for _, t := range c.Torrents() {
+				stats := t.Stats()
+				uploaded := stats.BytesWrittenData.Int64()
+				if float64(uploaded) >= ratio*float64(t.Length()) {
+					logger.Info("seeded release", "id", t.Name(), "uploaded", uploaded)
+					t.Drop()
+					continue
+				}
+				seeding++
+			}
+			if seeding == 0 {
+				return
+			}
+		}
+		select {
+		case <-tick.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// downloadRelease downloads a release in the mode of the options.
+func downloadRelease(ctx context.Context, c *torrent.Client, lim *rate.Limiter, dir, id string, opts *DownloadOptions) error {
+	if opts.Mode == DownloadHTTPOnly {
+		return downloadReleaseHTTP(ctx, lim, dir, id, nil, opts)
+	}
+	t, err := addTorrent(ctx, c, id, dir)
+	if err != nil {
+		if opts.Mode != DownloadAuto || ctx.Err() != nil {
+			return err
+		}
+		logger.Warn("adding torrent failed; downloading over HTTPS", "id", id, "err", err)
+		return downloadReleaseHTTP(ctx, lim, dir, id, nil, opts)
+	}
+	// Torrents are dropped once done, so that at most MaxTorrents are
+	// active, unless they are seeded
+	seeding := false
+	defer func() {
+		if !seeding {
+			t.Drop()
+		}
+	}()
+	files := t.Files()
+	wanted := make([]bool, len(files))
+	for i, f := range files {
+		wanted[i] = opts.wants(itemName(t, f))
+		if wanted[i] {
+			f.Download()
+		} else {
+			f.SetPriority(torrent.PiecePriorityNone)
+		}
+	}
+	complete, err := prioritize(ctx, t, id, dir, wanted, opts)
+	if err != errStalled {
+		seeding = err == nil && opts.Seed
+		return err
+	}
+	// Files that the torrent completed are kept
+	logger.Warn("torrent stalled; downloading over HTTPS", "id", id, "after", opts.stallTimeout())
+	have := make(map[string]bool)
+	for i, f := range files {
+		if complete[i] {
+			have[itemName(t, f)] = true
+		}
+	}
+	t.Drop()
+	return downloadReleaseHTTP(ctx, lim, dir, id, have, opts)
+}
+
+// itemName returns the name of a file of a release torrent in its
+// item, without the directory of the torrent.
+func itemName(t *torrent.Torrent, f *torrent.File) string {
+	return strings.TrimPrefix(f.Path(), t.Name()+"/")
+}
+
+// addTorrent fetches the torrent file of a release and adds it to the
+// client.
+func addTorrent(ctx context.Context, c *torrent.Client, id, dir string) (*torrent.Torrent, error) {
+	filename, err := saveTorrentFile(ctx, id, dir)
 	if err != nil {
 		return nil, err
 	}
-	defer resp.Body.Close()
+	return c.AddTorrentFromFile(filename)
+}
 
-	type Scrape struct {
-		Items []struct {
-			Identifier string `json:"identifier"`
-		} `json:"items"`
-		Count int `json:"count"`
-		Total int `json:"total"`
-		// TODO fields for error response
+// payloadWindow is the number of project zips of a release that are
+// downloaded first, so that they complete roughly in order.
+const payloadWindow = 2
+
+type filePriority uint8
+
+const (
+	priorityAux     filePriority = iota // _files.xml, _meta.xml, etc.
+	priorityPayload                     // project zips
+	priorityNext                        // the next project zips in order
+)
+
+// filePriorities returns the priority of each file of a release torrent,
+// given in torrent order: project zips are wanted before auxiliary
+// files, and the first payloadWindow incomplete zips before the others.
+func filePriorities(paths []string, complete []bool) []filePriority {
+	prios := make([]filePriority, len(paths))
+	next := 0
+	for i, p := range paths {
+		if !strings.HasSuffix(p, ".zip") {
+			continue
+		}
+		prios[i] = priorityPayload
+		if !complete[i] && next < payloadWindow {
+			prios[i] = priorityNext
+			next++
+		}
 	}
-	var items Scrape
-	if err := jsonutil.Decode(resp.Body, &items); err != nil {
-		return nil, err
+	return prios
+}
+
+// errStalled is returned by prioritize for torrents that download
+// nothing for the stall timeout.
+var errStalled = errors.New("tinytown: torrent stalled")
+
+// prioritize updates the piece priorities of the wanted files of a
+// release torrent as its pieces complete, until every wanted file is
+// complete, and calls the OnFile function of the options, if any, with
+// each project zip as it completes. It reports the progress of the
+// torrent and returns which of its files are complete. In DownloadAuto
+// mode, when no bytes complete for the stall timeout, it returns
+// errStalled.
+func prioritize(ctx context.Context, t *torrent.Torrent, id, dir string, wanted []bool, opts *DownloadOptions) ([]bool, error) {
+	progress := progressFrom(ctx)
+	sub := t.SubscribePieceStateChanges()
+	defer sub.Close()
+	files := t.Files()
+	paths := make([]string, len(files))
+	var length int64
+	for i, f := range files {
+		paths[i] = f.Path()
+		if wanted[i] {
+			length += f.Length()
+		}
+	}
+	complete := make([]bool, len(files))
+	done := make([]bool, len(files)) // complete or not wanted
+	var timer *time.Timer
+	var stalled <-chan time.Time
+	if opts.Mode == DownloadAuto {
+		timer = time.NewTimer(opts.stallTimeout())
+		defer timer.Stop()
+		stalled = timer.C
+	}
+	last := int64(-1)
+	for {
+		payloadLeft, left := false, false
+		var bytes int64
+		for i, f := range files {
+			if !wanted[i] {
+				done[i] = true
+				continue
+			}
+			if complete[i] {
+				bytes += f.Length()
+				continue
+			}
+			complete[i] = true
+			for _, ps := range f.State() {
+				if !ps.Complete {
+					complete[i] = false
+					break
+				}
+			}
+			done[i] = complete[i]
+			isPayload := strings.HasSuffix(paths[i], ".zip")
+			if complete[i] && isPayload && opts.OnFile != nil {
+				opts.OnFile(filepath.Join(dir, filepath.FromSlash(paths[i])))
+			}
+			payloadLeft = payloadLeft || (isPayload && !complete[i])
+			left = left || !complete[i]
+			bytes += f.BytesCompleted()
+		}
+		if progress != nil {
+			if !left {
+				progress(ProgressEvent{Kind: ProgressTorrent, Release: id, N: length, Total: length})
+			} else {
+				progress(ProgressEvent{Kind: ProgressBytes, Release: id, N: bytes, Total: length})
+			}
+		}
+		if !left {
+			return complete, nil
+		}
+		if timer != nil && bytes > last {
+			if !timer.Stop() {
+				<-timer.C
+			}
+			timer.Reset(opts.stallTimeout())
+		}
+		last = bytes
+		if payloadLeft {
+			for i, prio := range filePriorities(paths, done) {
+				if !wanted[i] {
+					continue
+				}
+				switch prio {
+				case priorityNext:
+					files[i].SetPriority(torrent.PiecePriorityReadahead)
+				case priorityPayload:
+					files[i].SetPriority(torrent.PiecePriorityHigh)
+				default:
+					files[i].SetPriority(torrent.PiecePriorityNormal)
+				}
+			}
+		}
+		select {
+		case _, ok := <-sub.Values:
+			if !ok {
+				return complete, closedErr(ctx)
+			}
+		case <-t.Closed():
+			return complete, closedErr(ctx)
+		case <-ctx.Done():
+			return complete, ctx.Err()
+		case <-stalled:
+			return complete, errStalled
+		}
+	}
+}
+
+// closedErr returns the error of a torrent that was closed before it
+// completed: that of the context, when done, since the client is closed
+// when it is.
+func closedErr(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return errors.New("tinytown: torrent closed")
+}
+
+// VerifyRelease validates the project zips of a downloaded release
+// against the checksums in its _files.xml metadata, which is excluded
+// from torrents and is downloaded when missing.
+func VerifyRelease(dir, id string) error {
+	return VerifyReleaseContext(context.Background(), dir, id)
+}
+
+// VerifyReleaseContext is like VerifyRelease, but stops when the
+// context is done.
+func VerifyReleaseContext(ctx context.Context, dir, id string) error {
+	releaseDir := filepath.Join(dir, id)
+	if err := saveFile(ctx, downloadURL(id, id+"_files.xml"), filepath.Join(releaseDir, id+"_files.xml")); err != nil {
+		return err
+	}
+	files, err := ia.ReadFileMeta(releaseDir)
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		if !strings.HasSuffix(f.Name, ".zip") {
+			continue
+		}
+		if err := ia.ValidateFileContext(ctx, filepath.Join(releaseDir, f.Name), f.MD5, f.SHA1, f.CRC32); err != nil {
+			return err
+		}
 	}
+	return nil
+}
 
-	// TODO handle paging
-	if items.Count != items.Total {
-		return nil, fmt.Errorf("tinytown: queried %d of %d releases", items.Count, items.Total)
+// ReleaseTime parses the time of a release from its identifier, such as
+// "urlteam_2021-05-06-01-17-03".
+func ReleaseTime(id string) (time.Time, error) {
+	ts := strings.TrimPrefix(id, "urlteam_")
+	for _, layout := range []string{"2006-01-02-15-04-05", "2006-01-02"} {
+		if t, err := time.Parse(layout, ts); err == nil {
+			return t, nil
+		}
 	}
+	return time.Time{}, fmt.Errorf("tinytown: no time in release identifier: %q", id)
+}
+
+// ReleaseFilter selects releases by their times, as parsed from their
+// identifiers by ReleaseTime, and by their identifiers.
+type ReleaseFilter struct {
+	// From, when not zero, excludes the releases before it.
+	From time.Time
+	// Before, when not zero, excludes the releases at or after it.
+	Before time.Time
+	// Pattern, when not empty, is a glob, with the syntax of path.Match,
+	// that the identifiers of releases must match, such as
+	// "urlteam_2021-*".
+	Pattern string
+}
 
-	ids := make([]string, len(items.Items))
-	for i, item := range items.Items {
-		ids[i] = item.Identifier
+// Valid returns an error when the pattern of the filter is malformed.
+func (f *ReleaseFilter) Valid() error {
+	if _, err := path.Match(f.Pattern, ""); err != nil {
+		return fmt.Errorf("tinytown: release pattern %q: %w", f.Pattern, err)
+	}
+	return nil
+}
+
+// Match reports whether the release with the given identifier is
+// selected by the filter. Releases without times in their identifiers
+// are excluded when the filter bounds times.
+func (f *ReleaseFilter) Match(id string) bool {
+	if f.Pattern != "" {
+		if ok, _ := path.Match(f.Pattern, id); !ok {
+			return false
+		}
+	}
+	if f.From.IsZero() && f.Before.IsZero() {
+		return true
+	}
+	t, err := ReleaseTime(id)
+	if err != nil {
+		return false
+	}
+	return (f.From.IsZero() || !t.Before(f.From)) && (f.Before.IsZero() || t.Before(f.Before))
+}
+
+// FilterReleases returns the identifiers of the releases that the
+// filter selects, in order, or every identifier, when the filter is nil.
+func FilterReleases(ids []string, f *ReleaseFilter) ([]string, error) {
+	if f == nil {
+		return ids, nil
+	}
+	if err := f.Valid(); err != nil {
+		return nil, err
+	}
+	var selected []string
+	for _, id := range ids {
+		if f.Match(id) {
+			selected = append(selected, id)
+		}
+	}
+	return selected, nil
+}
+
+// GetReleaseIDs queries the Internet Archive for the identifiers of all
+// incremental terroroftinytown releases, following every page of
+// results of the scrape API.
+func GetReleaseIDs() ([]string, error) {
+	return GetReleaseIDsContext(context.Background())
+}
+
+// GetReleaseIDsContext is like GetReleaseIDs, but the query is canceled
+// with the context.
+func GetReleaseIDsContext(ctx context.Context) ([]string, error) {
+	var ids []string
+	err := ia.ScrapeContext(ctx, "subject:terroroftinytown", []string{"identifier"}, func(item json.RawMessage) error {
+		var v struct {
+			Identifier string `json:"identifier"`
+		}
+		if err := json.Unmarshal(item, &v); err != nil {
+			return err
+		}
+		ids = append(ids, v.Identifier)
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
 	return ids, nil
 }
 
-func saveTorrentFile(id, dir string) (string, error) {
-	url := "https://archive.org/download/" + id + "/" + id + "_archive.torrent"
-	filename := filepath.Join(dir, path.Base(url))
-	return filename, saveFile(url, filename)
+// GetReleaseIDsFilter is like GetReleaseIDsContext, but only returns
+// the identifiers of the releases that the filter, when not nil,
+// selects.
+func GetReleaseIDsFilter(ctx context.Context, f *ReleaseFilter) ([]string, error) {
+	if f != nil {
+		if err := f.Valid(); err != nil {
+			return nil, err
+		}
+	}
+	ids, err := GetReleaseIDsContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return FilterReleases(ids, f)
+}
+
+func saveTorrentFile(ctx context.Context, id, dir string) (string, error) {
+	filename := filepath.Join(dir, id+"_archive.torrent")
+	return filename, saveFile(ctx, downloadURL(id, id+"_archive.torrent"), filename)
+}
+
+// downloadBase is the base URL of the files of Internet Archive items.
+var downloadBase = "https://archive.org/download/"
+
+// downloadURL returns the URL of a file of an Internet Archive item.
+func downloadURL(id, name string) string {
+	return downloadBase + id + "/" + (&url.URL{Path: name}).EscapedPath()
 }
 
-func saveFile(url, filename string) error {
+// saveFile downloads a URL to a file, unless it exists. It is written
+// to a temporary file that is renamed once complete, so that a download
+// that fails or is canceled does not leave a partial file, which would
+// be taken as complete by the next call.
+func saveFile(ctx context.Context, url, filename string) error {
 	if _, err := os.Stat(filename); err == nil {
 		return nil
 	}
+	return fetchFile(ctx, url, filename, nil, nil)
+}
 
-	resp, err := httpGet(url)
+// fetchFile downloads a URL to a file, as saveFile does, but replaces
+// the file, if it exists, validates the download against the checksums
+// of fm, when not nil, and limits its rate by lim, when not nil.
+func fetchFile(ctx context.Context, url, filename string, fm *ia.FileMeta, lim *rate.Limiter) error {
+	resp, err := ia.GetContext(ctx, url)
 	if err != nil {
 		return err
 	}
 	defer resp.Body.Close()
 
-	f, err := os.Create(filename)
+	tmp := filename + ".tmp"
+	f, err := os.Create(tmp)
 	if err != nil {
 		return err
 	}
-	defer f.Close()
-	_, err = io.Copy(f, resp.Body)
-	return err
-}
-
-func httpGet(url string) (*http.Response, error) {
-	resp, err := http.Get(url)
-	if err != nil {
-		return nil, err
+	var r io.Reader = resp.Body
+	if lim != nil {
+		r = &limitReader{ctx, r, lim}
 	}
-	if resp.StatusCode != http.StatusOK {
-		resp.Body.Close()
-		return nil, fmt.Errorf("tinytown: http status %s", resp.Status)
+	if fm != nil {
+		r = fm.Validator(r)
 	}
-	return resp, nil
+	_, err = io.Copy(f, r)
+	if err1 := f.Close(); err == nil {
+		err = err1
+	}
+	if err == nil {
+		err = os.Rename(tmp, filename)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
 }
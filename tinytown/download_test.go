@@ -0,0 +1,428 @@
+// Copyright (c) 2021 Andrew Archibald
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package tinytown
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/anacrolix/torrent"
+	"github.com/anacrolix/torrent/bencode"
+	"github.com/anacrolix/torrent/metainfo"
+	"github.com/anacrolix/torrent/storage"
+	"github.com/andrewarchi/urlhero/ia"
+	"github.com/andrewarchi/urlhero/report"
+	"golang.org/x/time/rate"
+)
+
+func TestFilePriorities(t *testing.T) {
+	paths := []string{
+		"urlteam_2021/bitly_6_1.zip",
+		"urlteam_2021/bitly_6_2.zip",
+		"urlteam_2021/isgd_6_1.zip",
+		"urlteam_2021/isgd_6_2.zip",
+		"urlteam_2021/urlteam_2021_meta.xml",
+	}
+	tests := []struct {
+		complete []bool
+		want     []filePriority
+	}{
+		{[]bool{false, false, false, false, false},
+			[]filePriority{priorityNext, priorityNext, priorityPayload, priorityPayload, priorityAux}},
+		{[]bool{true, false, false, false, false},
+			[]filePriority{priorityPayload, priorityNext, priorityNext, priorityPayload, priorityAux}},
+		{[]bool{true, true, false, true, true},
+			[]filePriority{priorityPayload, priorityPayload, priorityNext, priorityPayload, priorityAux}},
+	}
+	for _, tt := range tests {
+		if got := filePriorities(paths, tt.complete); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("filePriorities(%v) = %v, want %v", tt.complete, got, tt.want)
+		}
+	}
+}
+
+func TestPendingReleases(t *testing.T) {
+	dir := t.TempDir()
+	for _, id := range []string{"urlteam_2021-01-01-00-00-00", "urlteam_2021-01-02-00-00-00"} {
+		if err := os.Mkdir(filepath.Join(dir, id), 0o777); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := markDownloaded(dir, "urlteam_2021-01-01-00-00-00"); err != nil {
+		t.Fatal(err)
+	}
+	ids := []string{
+		"urlteam_2021-01-03-00-00-00",
+		"urlteam_2021-01-02-00-00-00",
+		"urlteam_2021-01-01-00-00-00",
+		"urlteam_2020-12-31-00-00-00",
+	}
+	tests := []struct {
+		since string
+		want  []string
+	}{
+		{"", []string{"urlteam_2020-12-31-00-00-00", "urlteam_2021-01-02-00-00-00", "urlteam_2021-01-03-00-00-00"}},
+		{"urlteam_2021-01-01-00-00-00", []string{"urlteam_2021-01-02-00-00-00", "urlteam_2021-01-03-00-00-00"}},
+		{"urlteam_2021-01-03-00-00-00", nil},
+	}
+	for _, tt := range tests {
+		if got := PendingReleases(dir, ids, tt.since); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("PendingReleases(%q) = %v, want %v", tt.since, got, tt.want)
+		}
+	}
+}
+
+func TestFilterReleases(t *testing.T) {
+	ids := []string{
+		"urlteam_2019-12-31-23-59-59",
+		"urlteam_2020-01-01-00-00-00",
+		"urlteam_2020-06-01",
+		"urlteam_2021-01-01-00-00-00",
+		"urlteam_custom",
+	}
+	date := func(year int) time.Time { return time.Date(year, 1, 1, 0, 0, 0, 0, time.UTC) }
+	tests := []struct {
+		filter *ReleaseFilter
+		want   []string
+	}{
+		{nil, ids},
+		{&ReleaseFilter{}, ids},
+		{&ReleaseFilter{From: date(2020)}, []string{"urlteam_2020-01-01-00-00-00", "urlteam_2020-06-01", "urlteam_2021-01-01-00-00-00"}},
+		{&ReleaseFilter{Before: date(2020)}, []string{"urlteam_2019-12-31-23-59-59"}},
+		{&ReleaseFilter{From: date(2020), Before: date(2021)}, []string{"urlteam_2020-01-01-00-00-00", "urlteam_2020-06-01"}},
+		{&ReleaseFilter{Pattern: "urlteam_2020-*"}, []string{"urlteam_2020-01-01-00-00-00", "urlteam_2020-06-01"}},
+		{&ReleaseFilter{Pattern: "urlteam_c*"}, []string{"urlteam_custom"}},
+		{&ReleaseFilter{Pattern: "urlteam_c*", From: date(2020)}, nil},
+	}
+	for _, tt := range tests {
+		got, err := FilterReleases(ids, tt.filter)
+		if err != nil || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("FilterReleases(%+v) = %v, %v, want %v", tt.filter, got, err, tt.want)
+		}
+	}
+	if _, err := FilterReleases(ids, &ReleaseFilter{Pattern: "["}); err == nil {
+		t.Error("FilterReleases with a malformed pattern succeeded")
+	}
+}
+
+func TestDownloadHTTP(t *testing.T) {
+	const id = "urlteam_2021-01-01-00-00-00"
+	zip := []byte("project zip")
+	md5Sum := md5.Sum(zip)
+	filesXML := `<files>
+<file name="` + id + `_files.xml" source="original"><format>Metadata</format></file>
+<file name="` + id + `_archive.torrent" source="metadata"><size>10</size></file>
+<file name="` + id + `_meta.xml" source="metadata"><size>7</size></file>
+<file name="example_1609459200.zip" source="original"><size>` + strconv.Itoa(len(zip)) +
+		`</size><md5>` + hex.EncodeToString(md5Sum[:]) + `</md5></file>
+</files>`
+	var requests int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		switch r.URL.Path {
+		case "/" + id + "/" + id + "_files.xml":
+			w.Write([]byte(filesXML))
+		case "/" + id + "/example_1609459200.zip":
+			w.Write(zip)
+		case "/" + id + "/" + id + "_meta.xml":
+			w.Write([]byte("<meta/>"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+	defer func(base string) { downloadBase = base }(downloadBase)
+	downloadBase = srv.URL + "/"
+
+	dir := t.TempDir()
+	var zips []string
+	var events []ProgressEvent
+	ctx := WithProgress(context.Background(), func(e ProgressEvent) { events = append(events, e) })
+	opts := &DownloadOptions{
+		Mode:      DownloadHTTPOnly,
+		Filter:    func(name string) bool { return strings.HasSuffix(name, ".zip") },
+		OnFile:    func(filename string) { zips = append(zips, filename) },
+		RateLimit: 1 << 20,
+	}
+	// Planning fetches only metadata and writes nothing
+	rep := report.New("plan")
+	plans, err := PlanReleases(context.Background(), dir, []string{id, "urlteam_missing"}, &DownloadOptions{Filter: opts.Filter, Report: rep})
+	if want := []ReleasePlan{{ID: id, Files: 1, Bytes: int64(len(zip))}}; err != nil || !reflect.DeepEqual(plans, want) {
+		t.Errorf("PlanReleases = %+v, %v, want %+v", plans, err, want)
+	}
+	if rep.Failed() != 1 {
+		t.Errorf("PlanReleases recorded %d failures, want 1", rep.Failed())
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("PlanReleases wrote %d files", len(entries))
+	}
+
+	// Releases that do not fit are not downloaded
+	defer func(fn func(string) (uint64, error)) { diskFree = fn }(diskFree)
+	diskFree = func(string) (uint64, error) { return 1, nil }
+	var spaceErr *SpaceError
+	if err := DownloadReleasesOptions(ctx, dir, []string{id}, opts); !errors.As(err, &spaceErr) ||
+		spaceErr.Needed != uint64(len(zip)) || spaceErr.Free != 1 {
+		t.Fatalf("got error %v, want a *SpaceError of %d needed and 1 free", err, len(zip))
+	}
+	if _, err := os.Stat(filepath.Join(dir, id)); !os.IsNotExist(err) {
+		t.Errorf("release that does not fit was downloaded: %v", err)
+	}
+	diskFree = func(string) (uint64, error) { return 1 << 20, nil }
+
+	if err := DownloadReleasesOptions(ctx, dir, []string{id}, opts); err != nil {
+		t.Fatal(err)
+	}
+	filename := filepath.Join(dir, id, "example_1609459200.zip")
+	if got, err := os.ReadFile(filename); err != nil || !bytes.Equal(got, zip) {
+		t.Errorf("got zip %q, %v, want %q", got, err, zip)
+	}
+	if !reflect.DeepEqual(zips, []string{filename}) {
+		t.Errorf("got downloaded zips %v, want %v", zips, []string{filename})
+	}
+	want := []ProgressEvent{{Kind: ProgressTorrent, Release: id, N: int64(len(zip)), Total: int64(len(zip))}}
+	if !reflect.DeepEqual(events, want) {
+		t.Errorf("got progress %+v, want %+v", events, want)
+	}
+	if !Downloaded(dir, id) {
+		t.Error("release not marked as downloaded")
+	}
+	if _, err := os.Stat(filepath.Join(dir, id, id+"_meta.xml")); !os.IsNotExist(err) {
+		t.Errorf("file excluded by the filter was downloaded: %v", err)
+	}
+
+	// Files that match their checksums are not downloaded again
+	requests = 0
+	if err := downloadReleaseHTTP(context.Background(), nil, dir, id, nil, &DownloadOptions{Filter: opts.Filter}); err != nil {
+		t.Fatal(err)
+	}
+	if requests != 0 {
+		t.Errorf("got %d requests for a complete release, want 0", requests)
+	}
+	if err := os.WriteFile(filename, []byte("corrupt zip"), 0o666); err != nil {
+		t.Fatal(err)
+	}
+	if err := downloadReleaseHTTP(context.Background(), nil, dir, id, nil, &DownloadOptions{Filter: opts.Filter}); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := os.ReadFile(filename); !bytes.Equal(got, zip) || requests != 1 {
+		t.Errorf("got zip %q after %d requests, want %q after 1", got, requests, zip)
+	}
+
+	zip = []byte("changed zip")
+	os.Remove(filename)
+	var checksumErr *ia.ChecksumError
+	if err := downloadReleaseHTTP(context.Background(), nil, dir, id, nil, &DownloadOptions{Filter: opts.Filter}); !errors.As(err, &checksumErr) {
+		t.Errorf("got error %v, want *ia.ChecksumError", err)
+	}
+	if _, err := os.Stat(filename); !os.IsNotExist(err) {
+		t.Errorf("zip that failed its checksum was kept: %v", err)
+	}
+}
+
+func TestParseDownloadMode(t *testing.T) {
+	for _, m := range []DownloadMode{DownloadTorrentOnly, DownloadHTTPOnly, DownloadAuto} {
+		if got, err := ParseDownloadMode(m.String()); err != nil || got != m {
+			t.Errorf("ParseDownloadMode(%q) = %v, %v, want %v", m.String(), got, err, m)
+		}
+	}
+	if _, err := ParseDownloadMode("ftp"); err == nil {
+		t.Error("ParseDownloadMode(\"ftp\") succeeded")
+	}
+}
+
+func TestLimitReader(t *testing.T) {
+	lim := rate.NewLimiter(minRateBurst*4, minRateBurst)
+	r := &limitReader{context.Background(), bytes.NewReader(make([]byte, 2*minRateBurst)), lim}
+	start := time.Now()
+	n, err := io.Copy(io.Discard, r)
+	if err != nil || n != 2*minRateBurst {
+		t.Fatalf("read %d bytes, %v, want %d", n, err, 2*minRateBurst)
+	}
+	// The first burst is free and the second takes a quarter second
+	if d := time.Since(start); d < 200*time.Millisecond {
+		t.Errorf("limited read took %v, want at least 200ms", d)
+	}
+}
+
+func TestDownloadHTTPNames(t *testing.T) {
+	filesXML := map[string]string{
+		"urlteam_parent":   `<files><file name="../escape.zip" source="original"><size>1</size></file></files>`,
+		"urlteam_absolute": `<files><file name="/escape.zip" source="original"><size>1</size></file></files>`,
+		"urlteam_empty":    `<files><file name="urlteam_empty_files.xml" source="original"/></files>`,
+	}
+	var requests int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for id, xml := range filesXML {
+			if r.URL.Path == "/"+id+"/"+id+"_files.xml" {
+				w.Write([]byte(xml))
+				return
+			}
+		}
+		atomic.AddInt32(&requests, 1)
+		w.Write([]byte("x"))
+	}))
+	defer srv.Close()
+	defer func(base string) { downloadBase = base }(downloadBase)
+	downloadBase = srv.URL + "/"
+
+	dir := filepath.Join(t.TempDir(), "releases")
+	for _, id := range []string{"urlteam_parent", "urlteam_absolute"} {
+		if err := downloadReleaseHTTP(context.Background(), nil, dir, id, nil, &DownloadOptions{}); err == nil {
+			t.Errorf("%s: got no error for an unsafe file name", id)
+		}
+	}
+	if requests != 0 {
+		t.Errorf("got %d requests for unsafe files, want 0", requests)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "escape.zip")); !os.IsNotExist(err) {
+		t.Errorf("file outside of the release was written: %v", err)
+	}
+
+	// Releases without files to download are complete
+	var events []ProgressEvent
+	ctx := WithProgress(context.Background(), func(e ProgressEvent) { events = append(events, e) })
+	if err := downloadReleaseHTTP(ctx, nil, dir, "urlteam_empty", nil, &DownloadOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if want := []ProgressEvent{{Kind: ProgressTorrent, Release: "urlteam_empty"}}; !reflect.DeepEqual(events, want) {
+		t.Errorf("got progress %+v, want %+v", events, want)
+	}
+}
+
+// newSeedClient constructs a torrent client for tests that stores
+// torrents in dir and seeds them.
+func newSeedClient(t *testing.T, dir string) *torrent.Client {
+	conf := torrent.TestingConfig(t)
+	conf.DataDir = dir
+	conf.DefaultStorage = storage.NewMMap(dir)
+	conf.Seed = true
+	c, err := torrent.NewClient(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+// seedReturns runs seed and reports whether it returned within a
+// timeout.
+func seedReturns(ctx context.Context, c *torrent.Client, ratio float64, d time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		seed(ctx, c, ratio, d)
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(10 * time.Second):
+		return false
+	}
+}
+
+func TestSeed(t *testing.T) {
+	defer func(d time.Duration) { seedInterval = d }(seedInterval)
+	seedInterval = 10 * time.Millisecond
+	const id = "urlteam_2021-01-01-00-00-00"
+
+	// A client with the complete release is the peer of the download
+	srcDir := t.TempDir()
+	data := make([]byte, 1<<18)
+	rand.New(rand.NewSource(1)).Read(data)
+	if err := os.Mkdir(filepath.Join(srcDir, id), 0o777); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(srcDir, id, "example_1609459200.zip"), data, 0o666); err != nil {
+		t.Fatal(err)
+	}
+	info := metainfo.Info{PieceLength: 1 << 16}
+	if err := info.BuildFromFilePath(filepath.Join(srcDir, id)); err != nil {
+		t.Fatal(err)
+	}
+	infoBytes, err := bencode.Marshal(info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mi := &metainfo.MetaInfo{InfoBytes: infoBytes}
+	src := newSeedClient(t, srcDir)
+	srcT, err := src.AddTorrent(mi)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srcT.VerifyData()
+	if srcT.BytesMissing() != 0 {
+		t.Fatalf("source torrent is missing %d bytes", srcT.BytesMissing())
+	}
+
+	// Downloaded torrents are kept for seeding
+	dir := t.TempDir()
+	f, err := os.Create(filepath.Join(dir, id+"_archive.torrent"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := mi.Write(f); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	c := newSeedClient(t, dir)
+	ct, err := c.AddTorrent(mi)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ct.AddClientPeer(src)
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := downloadRelease(ctx, c, nil, dir, id, &DownloadOptions{Mode: DownloadTorrentOnly, Seed: true}); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := os.ReadFile(filepath.Join(dir, id, "example_1609459200.zip")); err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("downloaded zip does not match: %v", err)
+	}
+	if n := len(c.Torrents()); n != 1 {
+		t.Fatalf("got %d torrents after the download, want 1 seeded", n)
+	}
+
+	// Seeding stops when the context is done or the seed time passes,
+	// before the ratio is reached
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	if !seedReturns(canceled, c, 0, 0) {
+		t.Fatal("seeding did not stop when the context was done")
+	}
+	if !seedReturns(context.Background(), c, 1, 50*time.Millisecond) {
+		t.Fatal("seeding did not stop after the seed time")
+	}
+	if n := len(c.Torrents()); n != 1 {
+		t.Errorf("got %d torrents before the ratio was reached, want 1", n)
+	}
+
+	// The source uploaded the whole release, so reached a ratio of 1
+	if !seedReturns(context.Background(), src, 1, 0) {
+		t.Fatal("seeding did not stop at the ratio")
+	}
+	if n := len(src.Torrents()); n != 0 {
+		t.Errorf("got %d torrents after the ratio was reached, want 0", n)
+	}
+}
@@ -0,0 +1,85 @@
+// Copyright (c) 2021 Andrew Archibald
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package tinytown
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/andrewarchi/urlhero/crawl"
+	"github.com/andrewarchi/urlhero/report"
+)
+
+// ErrFormat is matched by errors.Is for every *ArchiveError.
+var ErrFormat = errors.New("tinytown: invalid project archive")
+
+// ArchiveError is returned when a project archive does not have the
+// layout of a release, such as when it has no meta file.
+type ArchiveError struct {
+	Filename string
+	Problem  string // e.g. "no meta file in archive"
+}
+
+func (err *ArchiveError) Error() string {
+	return fmt.Sprintf("tinytown: %s: %s", err.Problem, err.Filename)
+}
+
+func (err *ArchiveError) Unwrap() error { return ErrFormat }
+
+// ErrorClass classifies the error in run reports.
+func (err *ArchiveError) ErrorClass() string { return report.ClassInput }
+
+// DumpError is returned when a link dump of a project archive cannot be
+// read. Dumps that end early, as when a download was cut off, match
+// io.ErrUnexpectedEOF with errors.Is.
+type DumpError struct {
+	Filename string // of the project archive
+	Dump     string // name of the link dump in the archive
+	Err      error
+}
+
+func (err *DumpError) Error() string {
+	return fmt.Sprintf("tinytown: %s: %s: %v", err.Filename, err.Dump, err.Err)
+}
+
+func (err *DumpError) Unwrap() error { return err.Err }
+
+// Truncated reports whether the link dump ended early.
+func (err *DumpError) Truncated() bool {
+	return errors.Is(err.Err, io.ErrUnexpectedEOF)
+}
+
+// ErrorClass classifies the error in run reports, as truncated when the
+// link dump ended early.
+func (err *DumpError) ErrorClass() string {
+	if err.Truncated() {
+		return report.ClassTruncated
+	}
+	return report.ClassInput
+}
+
+// StatusError is returned when a tracker request responds with a status
+// other than 200 OK.
+type StatusError struct {
+	URL        string
+	StatusCode int    // e.g. 503
+	Status     string // e.g. "503 Service Unavailable"
+}
+
+func (err *StatusError) Error() string {
+	return fmt.Sprintf("tinytown: http status %s", err.Status)
+}
+
+// Temporary reports whether the request may succeed when retried, for
+// server errors and rate limiting.
+func (err *StatusError) Temporary() bool {
+	return crawl.TemporaryStatus(err.StatusCode)
+}
+
+// ErrorClass classifies the error in run reports.
+func (err *StatusError) ErrorClass() string { return report.ClassNetwork }
@@ -0,0 +1,136 @@
+// Copyright (c) 2021 Andrew Archibald
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package tinytown
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"time"
+)
+
+// ExportRecord is a mapping as it is exported.
+type ExportRecord struct {
+	Shortener string // host of the shortener, e.g. "bit.ly"
+	Shortcode string
+	Target    string
+	Release   string // identifier of the release, if known
+	Project   string // name of the project, e.g. "bitly_6", if known
+}
+
+// ExportWriter is implemented by the writers of exports of mappings.
+type ExportWriter interface {
+	// Write writes a mapping.
+	Write(r ExportRecord) error
+	// Flush writes any buffered mappings to the underlying writer.
+	Flush() error
+}
+
+// csvHeader is the header row of CSV and TSV exports.
+var csvHeader = []string{"shortener", "shortcode", "target_url", "release_id"}
+
+// CSVWriter writes mappings as rows of shortener, shortcode, target_url,
+// and release_id, after a header row, so that they can be loaded into
+// spreadsheets and SQL databases. Fields are quoted as RFC 4180
+// requires: those that contain the separator, quotes, or line breaks
+// are quoted, with quotes doubled, so targets with line breaks are
+// preserved.
+type CSVWriter struct {
+	cw     *csv.Writer
+	header bool // whether the header is written
+	row    []string
+}
+
+// NewCSVWriter constructs a writer of comma-separated values.
+func NewCSVWriter(w io.Writer) *CSVWriter {
+	return &CSVWriter{cw: csv.NewWriter(w), row: make([]string, len(csvHeader))}
+}
+
+// NewTSVWriter constructs a writer of tab-separated values, which are
+// quoted like CSV.
+func NewTSVWriter(w io.Writer) *CSVWriter {
+	cw := NewCSVWriter(w)
+	cw.cw.Comma = '\t'
+	return cw
+}
+
+// Write writes a mapping as a row, after the header, if it is the
+// first.
+func (w *CSVWriter) Write(r ExportRecord) error {
+	if !w.header {
+		w.header = true
+		if err := w.cw.Write(csvHeader); err != nil {
+			return err
+		}
+	}
+	w.row[0], w.row[1], w.row[2], w.row[3] = r.Shortener, r.Shortcode, r.Target, r.Release
+	return w.cw.Write(w.row)
+}
+
+// Flush writes the header, if no mappings were written, and any
+// buffered rows to the underlying writer.
+func (w *CSVWriter) Flush() error {
+	if !w.header {
+		w.header = true
+		if err := w.cw.Write(csvHeader); err != nil {
+			return err
+		}
+	}
+	w.cw.Flush()
+	return w.cw.Error()
+}
+
+// JSONLWriter writes mappings as JSON Lines, with an object per line,
+// for tools such as jq and the bulk ingestion of Elasticsearch and
+// BigQuery. Each object has the shortener, project, shortcode, target,
+// release, and time of the release, such as
+//
+//	{"shortener":"bit.ly","project":"bitly_6","shortcode":"abc","target":"http://example.org/","release":"urlteam_2021-01-01-00-00-00","time":"2021-01-01T00:00:00Z"}
+//
+// Project, release, and time are omitted when not known.
+type JSONLWriter struct {
+	bw  *bufio.Writer
+	enc *json.Encoder
+
+	// The time of the last release, which is shared by runs of mappings
+	release string
+	time    *time.Time
+}
+
+// NewJSONLWriter constructs a writer of JSON Lines.
+func NewJSONLWriter(w io.Writer) *JSONLWriter {
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+	enc.SetEscapeHTML(false)
+	return &JSONLWriter{bw: bw, enc: enc}
+}
+
+type jsonlRecord struct {
+	Shortener string     `json:"shortener"`
+	Project   string     `json:"project,omitempty"`
+	Shortcode string     `json:"shortcode"`
+	Target    string     `json:"target"`
+	Release   string     `json:"release,omitempty"`
+	Time      *time.Time `json:"time,omitempty"`
+}
+
+// Write writes a mapping as a line.
+func (w *JSONLWriter) Write(r ExportRecord) error {
+	if r.Release != w.release {
+		w.release, w.time = r.Release, nil
+		if t, err := ReleaseTime(r.Release); err == nil {
+			w.time = &t
+		}
+	}
+	return w.enc.Encode(jsonlRecord{r.Shortener, r.Project, r.Shortcode, r.Target, r.Release, w.time})
+}
+
+// Flush writes any buffered lines to the underlying writer.
+func (w *JSONLWriter) Flush() error {
+	return w.bw.Flush()
+}
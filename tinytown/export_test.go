@@ -0,0 +1,77 @@
+// Copyright (c) 2021 Andrew Archibald
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package tinytown
+
+import (
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestCSVWriter(t *testing.T) {
+	records := []ExportRecord{
+		{"bit.ly", "abc", "http://example.org/1", "urlteam_2021-01-01-00-00-00", "bitly_6"},
+		{"bit.ly", "xyz", "http://example.org/?a=\"b\",c\td", "urlteam_2021-01-01-00-00-00", "bitly_6"},
+		{"is.gd", "mno", "http://example.org/line\nbreak", "", ""},
+	}
+	tests := []struct {
+		newWriter func(io.Writer) *CSVWriter
+		want      string
+	}{
+		{NewCSVWriter, "shortener,shortcode,target_url,release_id\n" +
+			"bit.ly,abc,http://example.org/1,urlteam_2021-01-01-00-00-00\n" +
+			"bit.ly,xyz,\"http://example.org/?a=\"\"b\"\",c\td\",urlteam_2021-01-01-00-00-00\n" +
+			"is.gd,mno,\"http://example.org/line\nbreak\",\n"},
+		{NewTSVWriter, "shortener\tshortcode\ttarget_url\trelease_id\n" +
+			"bit.ly\tabc\thttp://example.org/1\turlteam_2021-01-01-00-00-00\n" +
+			"bit.ly\txyz\t\"http://example.org/?a=\"\"b\"\",c\td\"\turlteam_2021-01-01-00-00-00\n" +
+			"is.gd\tmno\t\"http://example.org/line\nbreak\"\t\n"},
+	}
+	for _, tt := range tests {
+		var b strings.Builder
+		w := tt.newWriter(&b)
+		for _, r := range records {
+			if err := w.Write(r); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := w.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		if b.String() != tt.want {
+			t.Errorf("got\n%s\nwant\n%s", b.String(), tt.want)
+		}
+	}
+	var b strings.Builder
+	if err := NewCSVWriter(&b).Flush(); err != nil || b.String() != "shortener,shortcode,target_url,release_id\n" {
+		t.Errorf("empty export = %q, %v, want only the header", b.String(), err)
+	}
+}
+
+func TestJSONLWriter(t *testing.T) {
+	var b strings.Builder
+	w := NewJSONLWriter(&b)
+	for _, r := range []ExportRecord{
+		{"bit.ly", "abc", "http://example.org/?a=1&b=<2>", "urlteam_2021-01-01-00-00-00", "bitly_6"},
+		{"bit.ly", "xyz", "http://example.org/2", "urlteam_2021-01-02", "bitly_6"},
+		{"is.gd", "mno", "http://example.org/3", "", ""},
+	} {
+		if err := w.Write(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	want := `{"shortener":"bit.ly","project":"bitly_6","shortcode":"abc","target":"http://example.org/?a=1&b=<2>","release":"urlteam_2021-01-01-00-00-00","time":"2021-01-01T00:00:00Z"}
+{"shortener":"bit.ly","project":"bitly_6","shortcode":"xyz","target":"http://example.org/2","release":"urlteam_2021-01-02","time":"2021-01-02T00:00:00Z"}
+{"shortener":"is.gd","shortcode":"mno","target":"http://example.org/3"}
+`
+	if b.String() != want {
+		t.Errorf("got\n%s\nwant\n%s", b.String(), want)
+	}
+}
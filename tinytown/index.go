@@ -0,0 +1,158 @@
+// Copyright (c) 2021 Andrew Archibald
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package tinytown
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/andrewarchi/urlhero/shorteners"
+)
+
+// Index is an index of mappings built by BuildIndex or
+// BuildIndexBackend, opened read-only for lookups. It is safe for
+// concurrent use.
+type Index struct {
+	mu sync.Mutex
+	s  Storage
+	// hosts of the shortener of each project, by name, such as
+	// "bitly_6", and by name without its version, such as "bitly"
+	projects map[string]string
+}
+
+// sqliteMagic starts every SQLite database.
+const sqliteMagic = "SQLite format 3\x00"
+
+// OpenIndex opens an index for lookups. Its backend is detected from
+// the file.
+func OpenIndex(path string) (*Index, error) {
+	backend, err := detectBackend(path)
+	if err != nil {
+		return nil, err
+	}
+	return OpenIndexBackend(backend, path)
+}
+
+// OpenIndexBackend opens an index with a backend for lookups.
+func OpenIndexBackend(backend, path string) (*Index, error) {
+	s, err := openStorage(backend, path, true)
+	if err != nil {
+		return nil, err
+	}
+	projects, err := s.Projects()
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	return &Index{s: s, projects: projectAliases(projects)}, nil
+}
+
+// projectAliases returns the hosts of projects by name and by name
+// without its version. Later versions take precedence.
+func projectAliases(projects map[string]string) map[string]string {
+	names := make([]string, 0, len(projects))
+	for name := range projects {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	aliases := make(map[string]string, 2*len(projects))
+	for _, name := range names {
+		if i := strings.LastIndexByte(name, '_'); i != -1 {
+			if _, err := strconv.Atoi(name[i+1:]); err == nil {
+				aliases[name[:i]] = projects[name]
+			}
+		}
+	}
+	for name, host := range projects {
+		aliases[name] = host
+	}
+	return aliases
+}
+
+func detectBackend(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	if fi, err := f.Stat(); err != nil {
+		return "", err
+	} else if fi.IsDir() {
+		return BackendLevelDB, nil
+	}
+	magic := make([]byte, len(sqliteMagic))
+	if _, err := io.ReadFull(f, magic); err != nil && err != io.ErrUnexpectedEOF {
+		return "", err
+	}
+	if bytes.Equal(magic, []byte(sqliteMagic)) {
+		return BackendSQLite, nil
+	}
+	return BackendBolt, nil
+}
+
+// shortenerHost returns the host under which the mappings of a
+// shortener, given by name or host, are indexed.
+func shortenerHost(shortener string) string {
+	if s, ok := shorteners.Lookup[shortener]; ok {
+		return s.Host
+	}
+	if !strings.ContainsRune(shortener, '.') {
+		return strings.ReplaceAll(shortener, "-", ".")
+	}
+	return strings.TrimPrefix(shortener, "www.")
+}
+
+// host returns the host under which the mappings of a shortener are
+// indexed, resolving names of the registry first, then those of the
+// projects in the index.
+func (idx *Index) host(shortener string) string {
+	if _, ok := shorteners.Lookup[shortener]; !ok {
+		if host, ok := idx.projects[shortener]; ok {
+			return host
+		}
+	}
+	return shortenerHost(shortener)
+}
+
+// Lookup finds the target of a shortcode of a shortener, given by name,
+// such as "bitly" or "bitly_6", or host, such as "bit.ly".
+func (idx *Index) Lookup(shortener, shortcode string) (targetURL string, found bool, err error) {
+	host := idx.host(shortener)
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	e, found, err := idx.s.Get(host, shortcode)
+	return e.Target, found, err
+}
+
+// LookupBatch finds the targets of several shortcodes of a shortener.
+// The targets and whether each was found are in the order of the
+// shortcodes.
+func (idx *Index) LookupBatch(shortener string, shortcodes []string) ([]string, []bool, error) {
+	host := idx.host(shortener)
+	targets := make([]string, len(shortcodes))
+	found := make([]bool, len(shortcodes))
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	for i, shortcode := range shortcodes {
+		e, ok, err := idx.s.Get(host, shortcode)
+		if err != nil {
+			return nil, nil, err
+		}
+		targets[i], found[i] = e.Target, ok
+	}
+	return targets, found, nil
+}
+
+// Close closes the index.
+func (idx *Index) Close() error {
+	return idx.s.Close()
+}
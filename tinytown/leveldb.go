@@ -0,0 +1,142 @@
+// Copyright (c) 2021 Andrew Archibald
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package tinytown
+
+import (
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+// LevelDB storage is a directory with a key for each mapping of the
+// host, a NUL, and the shortcode, which cannot contain NUL, so that the
+// mappings of a host are a range in order of shortcode. Values are
+// encoded as in Bolt storage. Projects are keyed by 0xFF, which is in
+// no UTF-8 host, and the name, with values of the host.
+
+// levelDBProjects prefixes the keys of projects.
+const levelDBProjects = "\xff"
+
+// levelDBBatch is the number of puts per batch.
+const levelDBBatch = 100000
+
+type levelDBStorage struct {
+	db       *leveldb.DB
+	readOnly bool
+	batch    leveldb.Batch // puts not yet written
+	key      []byte
+}
+
+func openLevelDB(dir string, readOnly bool) (Storage, error) {
+	db, err := leveldb.OpenFile(dir, &opt.Options{ReadOnly: readOnly, ErrorIfMissing: readOnly})
+	if err != nil {
+		return nil, err
+	}
+	return &levelDBStorage{db: db, readOnly: readOnly}, nil
+}
+
+// levelDBKey appends the key of a shortcode of a host to b.
+func levelDBKey(b []byte, host, shortcode string) []byte {
+	b = append(b, host...)
+	b = append(b, 0)
+	return append(b, shortcode...)
+}
+
+func (s *levelDBStorage) Put(host string, e Entry) error {
+	if s.readOnly {
+		return ErrReadOnly
+	}
+	s.key = levelDBKey(s.key[:0], host, e.Shortcode)
+	s.batch.Put(s.key, encodeBoltEntry(e))
+	if s.batch.Len() >= levelDBBatch {
+		return s.write(false)
+	}
+	return nil
+}
+
+func (s *levelDBStorage) PutProject(name, host string) error {
+	if s.readOnly {
+		return ErrReadOnly
+	}
+	s.batch.Put([]byte(levelDBProjects+name), []byte(host))
+	return nil
+}
+
+// write writes the batch of puts, which with sync is committed to
+// stable storage.
+func (s *levelDBStorage) write(sync bool) error {
+	if s.batch.Len() == 0 && !sync {
+		return nil
+	}
+	err := s.db.Write(&s.batch, &opt.WriteOptions{Sync: sync})
+	s.batch.Reset()
+	return err
+}
+
+func (s *levelDBStorage) Flush() error {
+	if s.readOnly {
+		return nil
+	}
+	return s.write(true)
+}
+
+func (s *levelDBStorage) Get(host, shortcode string) (Entry, bool, error) {
+	// Buffered puts are written, so that they are visible
+	if err := s.write(false); err != nil {
+		return Entry{}, false, err
+	}
+	s.key = levelDBKey(s.key[:0], host, shortcode)
+	v, err := s.db.Get(s.key, nil)
+	if err == leveldb.ErrNotFound {
+		return Entry{}, false, nil
+	}
+	if err != nil {
+		return Entry{}, false, err
+	}
+	e, err := decodeBoltEntry(shortcode, v)
+	return e, err == nil, err
+}
+
+func (s *levelDBStorage) Iterate(host string, fn func(Entry) error) error {
+	if err := s.write(false); err != nil {
+		return err
+	}
+	prefix := levelDBKey(nil, host, "")
+	it := s.db.NewIterator(util.BytesPrefix(prefix), nil)
+	defer it.Release()
+	for it.Next() {
+		e, err := decodeBoltEntry(string(it.Key()[len(prefix):]), it.Value())
+		if err != nil {
+			return err
+		}
+		if err := fn(e); err != nil {
+			return err
+		}
+	}
+	return it.Error()
+}
+
+func (s *levelDBStorage) Projects() (map[string]string, error) {
+	if err := s.write(false); err != nil {
+		return nil, err
+	}
+	projects := make(map[string]string)
+	it := s.db.NewIterator(util.BytesPrefix([]byte(levelDBProjects)), nil)
+	defer it.Release()
+	for it.Next() {
+		projects[string(it.Key()[len(levelDBProjects):])] = string(it.Value())
+	}
+	return projects, it.Error()
+}
+
+func (s *levelDBStorage) Close() error {
+	err := s.Flush()
+	if err1 := s.db.Close(); err == nil {
+		err = err1
+	}
+	return err
+}
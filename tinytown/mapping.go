@@ -0,0 +1,90 @@
+// Copyright (c) 2021 Andrew Archibald
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package tinytown
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+
+	"github.com/andrewarchi/urlhero/beacon"
+	"github.com/andrewarchi/urlhero/xz"
+)
+
+// Mapping is a shortcode mapping read from a release.
+type Mapping struct {
+	Shortcode string
+	Target    string
+	Project   *Meta  // metadata of the project, shared by its mappings
+	Release   string // identifier of the release, e.g. "urlteam_2021-05-06-01-17-03"
+}
+
+// MappingReader reads the mappings of a single xz-compressed link dump,
+// such as a *.txt.xz file of a project zip, outside of a release. The
+// dump is decompressed and decoded as a stream, one line at a time, so
+// memory use is constant, however large the dump is.
+type MappingReader struct {
+	xr  io.ReadCloser
+	br  *bufio.Reader
+	lr  *beacon.Reader
+	err error
+}
+
+// NewMappingReader constructs a reader of an xz-compressed link dump.
+// Every shortcode of a dump has the same length, which is given by the
+// name of the dump, such as 5 for 00000.txt.xz, and is used to join the
+// lines of targets that contain line breaks. As the name is not known
+// here, the length is taken from the first line.
+func NewMappingReader(r io.Reader) (*MappingReader, error) {
+	xr, err := xz.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	return &MappingReader{xr: xr, br: bufio.NewReader(xr)}, nil
+}
+
+// maxShortcodeLen is the longest shortcode of the first line of a dump
+// that is recognized.
+const maxShortcodeLen = 512
+
+// Read reads the next mapping. Only the shortcode and target are set.
+// It returns io.EOF at the end of the dump and an error matching
+// io.ErrUnexpectedEOF, with errors.Is, when the dump ends early.
+func (mr *MappingReader) Read() (Mapping, error) {
+	if mr.err != nil {
+		return Mapping{}, mr.err
+	}
+	if mr.lr == nil {
+		first, err := mr.br.Peek(maxShortcodeLen + 1)
+		if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+			mr.err = err
+			return Mapping{}, err
+		}
+		if len(first) == 0 {
+			mr.err = io.EOF
+			return Mapping{}, io.EOF
+		}
+		n := bytes.IndexByte(first, '|')
+		if n <= 0 || bytes.IndexByte(first[:n], '\n') != -1 {
+			mr.err = fmt.Errorf("tinytown: link dump does not start with a link: %q", first)
+			return Mapping{}, mr.err
+		}
+		mr.lr = beacon.NewURLTeamReader(mr.br, n)
+	}
+	l, err := mr.lr.Read()
+	if err != nil {
+		mr.err = err
+		return Mapping{}, err
+	}
+	return Mapping{Shortcode: l.Source, Target: l.Target}, nil
+}
+
+// Close releases the decompressor.
+func (mr *MappingReader) Close() error {
+	return mr.xr.Close()
+}
@@ -0,0 +1,280 @@
+// Copyright (c) 2021 Andrew Archibald
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package tinytown
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/andrewarchi/urlhero/beacon"
+	"github.com/andrewarchi/urlhero/extsort"
+)
+
+// MergePolicy selects which mapping MergeReleases keeps of a shortcode
+// that is in several releases.
+type MergePolicy uint8
+
+const (
+	// MergeLastSeen keeps the mapping of the latest release, as
+	// BuildStorage does.
+	MergeLastSeen MergePolicy = iota
+	// MergeFirstSeen keeps the mapping of the earliest release, before
+	// any later rescan that found the shortcode changed or broken.
+	MergeFirstSeen
+)
+
+var mergePolicies = []string{
+	MergeLastSeen:  "last",
+	MergeFirstSeen: "first",
+}
+
+// ParseMergePolicy parses the name of a merge policy: last or first.
+func ParseMergePolicy(name string) (MergePolicy, error) {
+	for p, n := range mergePolicies {
+		if n == name {
+			return MergePolicy(p), nil
+		}
+	}
+	return 0, fmt.Errorf("tinytown: unknown merge policy %q", name)
+}
+
+func (p MergePolicy) String() string {
+	if int(p) < len(mergePolicies) {
+		return mergePolicies[p]
+	}
+	return fmt.Sprintf("MergePolicy(%d)", uint8(p))
+}
+
+// DefaultMergeMemory is the default of MergeOptions.MemLimit.
+const DefaultMergeMemory = 256 << 20
+
+// MergeOptions contains options for merging releases.
+type MergeOptions struct {
+	// Policy selects the mapping that is kept of duplicate shortcodes,
+	// by default that of the latest release.
+	Policy MergePolicy
+	// MemLimit is the size in bytes of the mappings that are held in
+	// memory before they are spilled to sorted runs, by default
+	// DefaultMergeMemory.
+	MemLimit int
+	// TempDir is the directory that runs are spilled to, by default the
+	// output directory.
+	TempDir string
+}
+
+// MergedShortener is the consolidated dataset of a shortener that
+// MergeReleases wrote.
+type MergedShortener struct {
+	Host     string `json:"host"`
+	Filename string `json:"filename"`
+	// Mappings is the number of unique shortcodes and Duplicates is the
+	// number of mappings of them that were dropped by the policy.
+	Mappings   int64 `json:"mappings"`
+	Duplicates int64 `json:"duplicates"`
+}
+
+// MergeReleases deduplicates the mappings of every release in root,
+// which are visited in order of their identifiers, and writes a BEACON
+// link dump for each shortener to outDir, named by its host, such as
+// "bit.ly.beacon", with a mapping for each shortcode, in order, as
+// selected by the policy of the options, which may be nil. Mappings are
+// sorted externally, so memory use is bounded, however many releases
+// there are. Line breaks in targets are escaped as %0D and %0A. Each
+// dump is written to a temporary file, which is renamed once complete.
+func MergeReleases(ctx context.Context, root, outDir string, opts *MergeOptions) ([]MergedShortener, error) {
+	if opts == nil {
+		opts = &MergeOptions{}
+	}
+	memLimit := opts.MemLimit
+	if memLimit <= 0 {
+		memLimit = DefaultMergeMemory
+	}
+	tempDir := opts.TempDir
+	if tempDir == "" {
+		tempDir = outDir
+	}
+	if err := os.MkdirAll(outDir, 0o755); err != nil {
+		return nil, err
+	}
+
+	// Items are host NUL shortcode | target, which sort by host and
+	// shortcode, and stably, so in order of release
+	sorter := extsort.NewSorter(lessMergeItem, tempDir, memLimit)
+	defer sorter.Close()
+	prefixes := make(map[string]string)
+	hosts := make(map[*Meta]string)
+	var item []byte
+	err := ProcessReleasesContext(ctx, root, mappingFunc(func(m Mapping) error {
+		host, ok := hosts[m.Project]
+		if !ok {
+			host = m.Project.Host()
+			hosts[m.Project] = host
+			if _, ok := prefixes[host]; !ok {
+				prefixes[host] = templatePrefix(m.Project.URLTemplate)
+			}
+		}
+		item = append(item[:0], host...)
+		item = append(item, 0)
+		item = append(item, m.Shortcode...)
+		item = append(item, '|')
+		item = append(item, lineBreakEscaper.Replace(m.Target)...)
+		return sorter.Add(item)
+	}))
+	if err != nil {
+		return nil, err
+	}
+	it, err := sorter.Sort()
+	if err != nil {
+		return nil, err
+	}
+
+	var merged []MergedShortener
+	var w *mergeWriter
+	var key, line []byte // of the pending mapping
+	flush := func() error {
+		if line == nil {
+			return nil
+		}
+		return w.write(line)
+	}
+	for n := 1; it.Next(); n++ {
+		if n%ctxCheckInterval == 0 && ctx.Err() != nil {
+			break
+		}
+		item := it.Item()
+		sep := bytes.IndexByte(item, '|')
+		host := item[:bytes.IndexByte(item, 0)]
+		if line != nil && bytes.Equal(item[:sep], key) {
+			w.dups++
+			if opts.Policy == MergeLastSeen {
+				line = append(line[:0], item[len(host)+1:]...)
+			}
+			continue
+		}
+		if err := flush(); err != nil {
+			w.abort()
+			return merged, err
+		}
+		if w == nil || string(host) != w.host {
+			if w != nil {
+				m, err := w.close()
+				if err != nil {
+					return merged, err
+				}
+				merged = append(merged, m)
+			}
+			if w, err = newMergeWriter(outDir, string(host), prefixes[string(host)]); err != nil {
+				return merged, err
+			}
+		}
+		key = append(key[:0], item[:sep]...)
+		line = append(line[:0], item[len(host)+1:]...)
+	}
+	err = it.Err()
+	if err == nil {
+		err = ctx.Err()
+	}
+	if w == nil {
+		return merged, err
+	}
+	if err == nil {
+		err = flush()
+	}
+	if err != nil {
+		w.abort()
+		return merged, err
+	}
+	m, err := w.close()
+	if err != nil {
+		return merged, err
+	}
+	return append(merged, m), nil
+}
+
+// lessMergeItem orders merge items by host and shortcode.
+func lessMergeItem(a, b []byte) bool {
+	return bytes.Compare(a[:bytes.IndexByte(a, '|')], b[:bytes.IndexByte(b, '|')]) < 0
+}
+
+// lineBreakEscaper escapes line breaks in targets, which BEACON links
+// cannot contain.
+var lineBreakEscaper = strings.NewReplacer("\r", "%0D", "\n", "%0A")
+
+// templatePrefix returns the BEACON prefix of a URL template that ends
+// with its shortcode, or "" for other templates.
+func templatePrefix(template string) string {
+	if prefix := strings.TrimSuffix(template, "{shortcode}"); prefix != template && !strings.Contains(prefix, "{") {
+		return prefix
+	}
+	return ""
+}
+
+// mergeFilename returns the filename of the merged dump of a host,
+// which is a template, when it has no host, so may contain separators.
+func mergeFilename(host string) string {
+	return strings.NewReplacer("/", "_", "\\", "_", ":", "_").Replace(host) + ".beacon"
+}
+
+// mergeWriter writes the merged dump of a shortener.
+type mergeWriter struct {
+	host     string
+	filename string
+	f        *os.File
+	bw       *beacon.Writer
+	n, dups  int64
+}
+
+func newMergeWriter(dir, host, prefix string) (*mergeWriter, error) {
+	filename := filepath.Join(dir, mergeFilename(host))
+	f, err := os.Create(filename + ".tmp")
+	if err != nil {
+		return nil, err
+	}
+	w := &mergeWriter{host: host, filename: filename, f: f, bw: beacon.NewWriter(f)}
+	meta := []beacon.MetaField{{Name: "FORMAT", Value: "BEACON"}}
+	if prefix != "" {
+		meta = append(meta, beacon.MetaField{Name: "PREFIX", Value: prefix})
+	}
+	if err := w.bw.WriteMeta(meta); err != nil {
+		w.abort()
+		return nil, err
+	}
+	return w, nil
+}
+
+// write writes a line of shortcode | target.
+func (w *mergeWriter) write(line []byte) error {
+	sep := bytes.IndexByte(line, '|')
+	w.n++
+	return w.bw.Write(&beacon.Link{Source: string(line[:sep]), Target: string(line[sep+1:])})
+}
+
+// close completes the dump and renames it into place.
+func (w *mergeWriter) close() (MergedShortener, error) {
+	err := w.bw.Flush()
+	if err1 := w.f.Close(); err == nil {
+		err = err1
+	}
+	if err == nil {
+		err = os.Rename(w.f.Name(), w.filename)
+	}
+	if err != nil {
+		os.Remove(w.f.Name())
+		return MergedShortener{}, err
+	}
+	return MergedShortener{Host: w.host, Filename: w.filename, Mappings: w.n, Duplicates: w.dups}, nil
+}
+
+// abort removes the incomplete dump.
+func (w *mergeWriter) abort() {
+	w.f.Close()
+	os.Remove(w.f.Name())
+}
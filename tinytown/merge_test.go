@@ -0,0 +1,62 @@
+// Copyright (c) 2021 Andrew Archibald
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package tinytown
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestMergeReleases(t *testing.T) {
+	root := t.TempDir()
+	for id, dump := range map[string]string{
+		"urlteam_2021-01-01-00-00-00": "abc|http://example.org/1\nxyz|http://example.org/2\n",
+		"urlteam_2021-01-02-00-00-00": "abc|http://example.org/3\nmno|http://example.org/4\nmulti\n",
+		"urlteam_2021-01-03-00-00-00": "abc|http://example.org/5\n",
+	} {
+		dir := filepath.Join(root, id)
+		if err := os.Mkdir(dir, 0o777); err != nil {
+			t.Fatal(err)
+		}
+		writeProject(t, dir, map[string][]byte{"abc.txt.xz": []byte(dump)})
+	}
+	tests := []struct {
+		policy MergePolicy
+		want   string
+	}{
+		{MergeLastSeen, "abc|http://example.org/5\nmno|http://example.org/4%0Amulti\nxyz|http://example.org/2\n"},
+		{MergeFirstSeen, "abc|http://example.org/1\nmno|http://example.org/4%0Amulti\nxyz|http://example.org/2\n"},
+	}
+	for _, tt := range tests {
+		out := t.TempDir()
+		// A small limit spills every release to its own run
+		merged, err := MergeReleases(context.Background(), root, out, &MergeOptions{Policy: tt.policy, MemLimit: 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		filename := filepath.Join(out, "example.com.beacon")
+		if want := []MergedShortener{{Host: "example.com", Filename: filename, Mappings: 3, Duplicates: 2}}; !reflect.DeepEqual(merged, want) {
+			t.Errorf("%v: got %+v, want %+v", tt.policy, merged, want)
+		}
+		data, err := os.ReadFile(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := "#FORMAT: BEACON\n#PREFIX: http://example.com/\n\n" + tt.want; string(data) != want {
+			t.Errorf("%v: got dump\n%s\nwant\n%s", tt.policy, data, want)
+		}
+		if entries, _ := os.ReadDir(out); len(entries) != 1 {
+			t.Errorf("%v: got %d files, want only the dump", tt.policy, len(entries))
+		}
+	}
+	if _, err := ParseMergePolicy("middle"); err == nil {
+		t.Error("ParseMergePolicy of an unknown policy succeeded")
+	}
+}
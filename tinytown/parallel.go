@@ -0,0 +1,136 @@
+// Copyright (c) 2021 Andrew Archibald
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package tinytown
+
+import (
+	"archive/zip"
+	"context"
+	"runtime"
+	"sync"
+	"sync/atomic"
+)
+
+// ProcessReleasesParallel processes every release in a directory like
+// ProcessReleasesContext, but decompresses and parses link dumps with
+// the given number of workers, or runtime.GOMAXPROCS(0) when not
+// positive. Each link dump is read by a single worker, so fn visits the
+// links of a dump in order, but is called concurrently for different
+// dumps and must be safe for concurrent use. Callers that need calls to
+// fn to be serialized, such as to write to a storage, can wrap it with
+// a mutex and still decompress in parallel. The first error stops the
+// workers and is returned.
+func ProcessReleasesParallel(ctx context.Context, root string, workers int, fn ProcessFunc) error {
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var mu sync.Mutex
+	var first error
+	fail := func(err error) {
+		mu.Lock()
+		if first == nil {
+			first = err
+		}
+		mu.Unlock()
+		cancel()
+	}
+
+	jobs := make(chan dumpJob)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range jobs {
+				n, err := processLinkDump(ctx, job.f, job.p.filename, job.p.meta, fn)
+				if err != nil && ctx.Err() == nil {
+					fail(err)
+				}
+				job.p.done(ctx, n)
+			}
+		}()
+	}
+	err := walkProjects(ctx, root, nil, func(filename string) error {
+		return queueProject(ctx, filename, jobs)
+	})
+	close(jobs)
+	wg.Wait()
+	if first != nil {
+		return first
+	}
+	if err != nil {
+		return err
+	}
+	return ctx.Err()
+}
+
+// dumpJob is a link dump of a project to be processed by a worker.
+type dumpJob struct {
+	p *parallelProject
+	f *zip.File
+}
+
+// parallelProject is a project zip whose link dumps are processed by
+// workers. It is closed once the last of its dumps is processed.
+type parallelProject struct {
+	filename string
+	zr       *zip.ReadCloser
+	meta     *Meta
+	pending  int32
+	links    int64
+}
+
+// done records that a link dump of the project was processed, with n
+// links, and, after the last, closes the project and reports it to the
+// progress function of the context.
+func (p *parallelProject) done(ctx context.Context, n int64) {
+	links := atomic.AddInt64(&p.links, n)
+	if atomic.AddInt32(&p.pending, -1) != 0 {
+		return
+	}
+	p.zr.Close()
+	if progress := progressFrom(ctx); progress != nil && ctx.Err() == nil {
+		progress(ProgressEvent{Kind: ProgressFile, Release: releaseID(p.filename), Filename: p.filename, N: links})
+	}
+}
+
+// queueProject opens a project zip and sends each of its link dumps to
+// the workers.
+func queueProject(ctx context.Context, filename string, jobs chan<- dumpJob) error {
+	zr, err := zip.OpenReader(filename)
+	if err != nil {
+		return err
+	}
+	metaFile, dumps, err := classifyFiles(zr.File, filename)
+	if err != nil {
+		zr.Close()
+		return err
+	}
+	meta, err := readMeta(metaFile)
+	if err != nil {
+		zr.Close()
+		return err
+	}
+	if len(dumps) == 0 {
+		zr.Close()
+		return nil
+	}
+	// One extra count is held until every dump is queued, so that the
+	// project is not closed while it is
+	p := &parallelProject{filename: filename, zr: zr, meta: meta, pending: int32(len(dumps)) + 1}
+	defer p.done(ctx, 0)
+	for i, f := range dumps {
+		select {
+		case jobs <- dumpJob{p, f}:
+		case <-ctx.Done():
+			atomic.AddInt32(&p.pending, -int32(len(dumps)-i))
+			return ctx.Err()
+		}
+	}
+	return nil
+}
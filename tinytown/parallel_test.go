@@ -0,0 +1,91 @@
+// Copyright (c) 2021 Andrew Archibald
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package tinytown
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/andrewarchi/urlhero/beacon"
+)
+
+func TestProcessReleasesParallel(t *testing.T) {
+	root := t.TempDir()
+	for r, id := range []string{"urlteam_2021-01-01-00-00-00", "urlteam_2021-01-02-00-00-00"} {
+		dir := filepath.Join(root, id)
+		if err := os.Mkdir(dir, 0o777); err != nil {
+			t.Fatal(err)
+		}
+		dumps := make(map[string][]byte)
+		for _, n := range []int{3, 4, 5} {
+			var dump bytes.Buffer
+			for i := 0; i < 100*n; i++ {
+				fmt.Fprintf(&dump, "%0*d|http://example.org/%d/%d/%d\n", n, i, r, n, i)
+			}
+			dumps[strings.Repeat("0", n)+".txt.xz"] = dump.Bytes()
+		}
+		writeProject(t, dir, dumps)
+	}
+	collect := func(links *[]string) ProcessFunc {
+		var mu sync.Mutex
+		return func(l *beacon.Link, m *Meta, shortcodeLen int, releaseFilename, dumpFilename string) error {
+			mu.Lock()
+			*links = append(*links, l.Target)
+			mu.Unlock()
+			return nil
+		}
+	}
+	var want []string
+	if err := ProcessReleasesContext(context.Background(), root, collect(&want)); err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(want)
+	for _, workers := range []int{0, 1, 4} {
+		var got []string
+		var mu sync.Mutex
+		files := make(map[string]int64)
+		ctx := WithProgress(context.Background(), func(e ProgressEvent) {
+			if e.Kind == ProgressFile {
+				mu.Lock()
+				files[e.Release] += e.N
+				mu.Unlock()
+			}
+		})
+		if err := ProcessReleasesParallel(ctx, root, workers, collect(&got)); err != nil {
+			t.Fatal(err)
+		}
+		sort.Strings(got)
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%d workers: got %d links, want %d", workers, len(got), len(want))
+		}
+		if wantFiles := map[string]int64{"urlteam_2021-01-01-00-00-00": 1200, "urlteam_2021-01-02-00-00-00": 1200}; !reflect.DeepEqual(files, wantFiles) {
+			t.Errorf("%d workers: got projects %v, want %v", workers, files, wantFiles)
+		}
+	}
+
+	errStop := errors.New("stop")
+	var calls int32
+	err := ProcessReleasesParallel(context.Background(), root, 4, func(l *beacon.Link, m *Meta, shortcodeLen int, releaseFilename, dumpFilename string) error {
+		if atomic.AddInt32(&calls, 1) == 10 {
+			return errStop
+		}
+		return nil
+	})
+	if err != errStop {
+		t.Errorf("got error %v, want the error of fn", err)
+	}
+}
@@ -0,0 +1,130 @@
+// Copyright (c) 2021 Andrew Archibald
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package tinytown
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/andrewarchi/urlhero/ia"
+	"github.com/andrewarchi/urlhero/logger"
+)
+
+// ReleasePlan is what a download of a release would fetch, as listed in
+// the metadata of its item.
+type ReleasePlan struct {
+	ID string `json:"id"`
+	// Files and Bytes are the number and total size of the files that
+	// the download selects.
+	Files int   `json:"files"`
+	Bytes int64 `json:"bytes"`
+	// Existing is the size of those files that already exist in the
+	// download directory with their listed sizes, which are not fetched
+	// again when they match their checksums.
+	Existing int64 `json:"existing"`
+}
+
+// PlanReleases queries the metadata of the items of releases and
+// returns what DownloadReleasesOptions would download to dir with the
+// given options, which may be nil, without starting any torrent or
+// writing any file. When the options have a report, the releases whose
+// metadata cannot be fetched are recorded as failures in it and
+// omitted, instead of stopping at the first.
+func PlanReleases(ctx context.Context, dir string, ids []string, opts *DownloadOptions) ([]ReleasePlan, error) {
+	if opts == nil {
+		opts = &DownloadOptions{}
+	}
+	plans := make([]ReleasePlan, 0, len(ids))
+	for _, id := range ids {
+		plan, err := planRelease(ctx, dir, id, opts)
+		if err != nil {
+			if opts.Report == nil || ctx.Err() != nil {
+				return nil, err
+			}
+			opts.Report.Fail(id, err)
+			continue
+		}
+		if opts.Report != nil {
+			opts.Report.Succeed(1)
+		}
+		plans = append(plans, *plan)
+	}
+	return plans, nil
+}
+
+func planRelease(ctx context.Context, dir, id string, opts *DownloadOptions) (*ReleasePlan, error) {
+	resp, err := ia.GetContext(ctx, downloadURL(id, id+"_files.xml"))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	meta, err := ia.DecodeFileMeta(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	plan := &ReleasePlan{ID: id}
+	for _, f := range releaseFiles(id, meta, opts) {
+		plan.Files++
+		plan.Bytes += f.Size
+		fi, err := os.Stat(filepath.Join(dir, id, filepath.FromSlash(f.Name)))
+		if err == nil && fi.Size() == f.Size {
+			plan.Existing += f.Size
+		}
+	}
+	return plan, nil
+}
+
+// SpaceError is returned when releases need more space to download
+// than is free.
+type SpaceError struct {
+	Dir    string
+	Needed uint64 // bytes of the files that are not yet downloaded
+	Free   uint64
+}
+
+func (err *SpaceError) Error() string {
+	return fmt.Sprintf("tinytown: downloading releases needs %d bytes in %s, but only %d are free; free up space, download fewer files, or skip the space check",
+		err.Needed, err.Dir, err.Free)
+}
+
+// diskFree is DiskFree, which tests replace.
+var diskFree = DiskFree
+
+// checkSpace returns a *SpaceError when the files that the options
+// select of releases, less those that exist, need more space than is
+// free in dir. Releases whose metadata cannot be fetched are not
+// counted, as their downloads report the failure, and the check is
+// skipped where free space is unsupported.
+func checkSpace(ctx context.Context, dir string, ids []string, opts *DownloadOptions) error {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	free, err := diskFree(dir)
+	if err != nil {
+		logger.Debug("skipping disk space check", "dir", dir, "err", err)
+		return nil
+	}
+	var needed uint64
+	for _, id := range ids {
+		plan, err := planRelease(ctx, dir, id, opts)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			logger.Warn("listing files for disk space check failed", "id", id, "err", err)
+			continue
+		}
+		needed += uint64(plan.Bytes - plan.Existing)
+	}
+	if needed > free {
+		return &SpaceError{Dir: dir, Needed: needed, Free: free}
+	}
+	logger.Debug("checked disk space", "dir", dir, "needed", needed, "free", free)
+	return nil
+}
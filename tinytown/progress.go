@@ -0,0 +1,87 @@
+// Copyright (c) 2021 Andrew Archibald
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package tinytown
+
+import (
+	"context"
+	"fmt"
+)
+
+// ProgressKind is the kind of a progress event.
+type ProgressKind uint8
+
+const (
+	// ProgressBytes reports the bytes of a release that are downloaded,
+	// as the pieces of its torrent or its files over HTTPS complete.
+	ProgressBytes ProgressKind = iota
+	// ProgressTorrent reports that every file of a release is
+	// downloaded.
+	ProgressTorrent
+	// ProgressFile reports that a project zip is processed.
+	ProgressFile
+	// ProgressMappings reports mappings parsed from the link dumps of a
+	// project zip, in batches.
+	ProgressMappings
+)
+
+var progressKinds = []string{
+	ProgressBytes:    "bytes",
+	ProgressTorrent:  "torrent",
+	ProgressFile:     "file",
+	ProgressMappings: "mappings",
+}
+
+func (k ProgressKind) String() string {
+	if int(k) < len(progressKinds) {
+		return progressKinds[k]
+	}
+	return fmt.Sprintf("ProgressKind(%d)", uint8(k))
+}
+
+// ProgressEvent is the progress of a download or of processing.
+type ProgressEvent struct {
+	Kind ProgressKind
+	// Release is the identifier of the release of the event.
+	Release string
+	// Filename is the project zip of ProgressFile and ProgressMappings
+	// events.
+	Filename string
+	// N is the bytes of the release that are downloaded, for
+	// ProgressBytes and ProgressTorrent events, the mappings in the
+	// project, for ProgressFile events, and the mappings parsed since the
+	// last event of the project, for ProgressMappings events.
+	N int64
+	// Total is the size in bytes of the release, for ProgressBytes and
+	// ProgressTorrent events.
+	Total int64
+	// Bytes is the bytes of the link dumps of the project zip that are
+	// read since the last event of the project, for ProgressMappings
+	// events. They sum to the size of the dumps in the zip, unless
+	// some are skipped.
+	Bytes int64
+}
+
+// ProgressFunc is the type of function that is called with progress
+// events. Downloads call it from a goroutine for each release, and
+// ProcessReleasesParallel from each of its workers, so it must be safe
+// for concurrent use.
+type ProgressFunc func(e ProgressEvent)
+
+type progressKey struct{}
+
+// WithProgress returns a copy of the context that reports the progress
+// of the downloads and processing of this package that are given it, as
+// with DownloadReleasesContext and ProcessReleasesContext, to fn.
+func WithProgress(ctx context.Context, fn ProgressFunc) context.Context {
+	return context.WithValue(ctx, progressKey{}, fn)
+}
+
+// progressFrom returns the ProgressFunc of a context, or nil.
+func progressFrom(ctx context.Context) ProgressFunc {
+	fn, _ := ctx.Value(progressKey{}).(ProgressFunc)
+	return fn
+}
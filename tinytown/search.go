@@ -7,8 +7,8 @@
 package tinytown
 
 import (
+	"context"
 	"fmt"
-	"os"
 	"path/filepath"
 	"strings"
 
@@ -16,45 +16,29 @@ import (
 )
 
 func SearchReleases(root, shortener string, shortcodes []string) ([]*beacon.Link, error) {
-	// TODO merge with ProcessReleases.
 	shortcodeMap := make(map[string]struct{})
 	for _, shortcode := range shortcodes {
 		shortcodeMap[shortcode] = struct{}{}
 	}
 
-	rootContents, err := os.ReadDir(root)
-	if err != nil {
-		return nil, err
-	}
 	var links []*beacon.Link
-	for _, release := range rootContents {
-		if !release.IsDir() {
-			continue
-		}
-		dir := filepath.Join(root, release.Name())
-		dirContents, err := os.ReadDir(dir)
-		if err != nil {
-			return nil, err
+	err := walkProjects(context.Background(), root, nil, func(filename string) error {
+		if !strings.HasPrefix(filepath.Base(filename), shortener+".") {
+			return nil
 		}
-		for _, file := range dirContents {
-			name := file.Name()
-			if !strings.HasPrefix(name, shortener+".") || !strings.HasSuffix(name, ".zip") {
-				continue
-			}
-			filename := filepath.Join(dir, name)
-			// TODO only search link dumps with shortcode length in the set of
-			// lengths being searched for.
-			fn := func(l *beacon.Link, m *Meta, shortcodeLen int, releaseFilename, dumpFilename string) error {
-				if _, ok := shortcodeMap[l.Source]; ok {
-					fmt.Printf("%s|%q\n", l.Source, l.Target)
-					links = append(links, l)
-				}
-				return nil
-			}
-			if err := ProcessProject(filename, fn); err != nil {
-				return nil, err
+		// TODO only search link dumps with shortcode length in the set of
+		// lengths being searched for.
+		fn := func(l *beacon.Link, m *Meta, shortcodeLen int, releaseFilename, dumpFilename string) error {
+			if _, ok := shortcodeMap[l.Source]; ok {
+				fmt.Printf("%s|%q\n", l.Source, l.Target)
+				links = append(links, l)
 			}
+			return nil
 		}
+		return ProcessProject(filename, fn)
+	})
+	if err != nil {
+		return nil, err
 	}
 	return links, nil
 }
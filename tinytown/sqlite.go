@@ -0,0 +1,35 @@
+// Copyright (c) 2021 Andrew Archibald
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package tinytown
+
+import "errors"
+
+// ErrNoSQLite is returned when opening SQLite storage in builds without
+// cgo, which SQLite requires.
+var ErrNoSQLite = errors.New("tinytown: SQLite unavailable without cgo")
+
+// sqliteSchema is the schema of SQLite storage. Mappings are keyed by
+// the host of the shortener and the shortcode, so that lookups are a
+// single seek of the primary key. Projects are keyed by name, but are
+// not in databases built before they were recorded.
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS mappings (
+	host      TEXT NOT NULL,
+	shortcode TEXT NOT NULL,
+	target    TEXT NOT NULL,
+	project   TEXT NOT NULL,
+	release   TEXT NOT NULL,
+	PRIMARY KEY (host, shortcode)
+) WITHOUT ROWID;
+CREATE TABLE IF NOT EXISTS projects (
+	name TEXT PRIMARY KEY,
+	host TEXT NOT NULL
+) WITHOUT ROWID;
+`
+
+// sqliteBatch is the number of puts per transaction.
+const sqliteBatch = 100000
@@ -0,0 +1,159 @@
+// Copyright (c) 2021 Andrew Archibald
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+//go:build cgo
+// +build cgo
+
+package tinytown
+
+import (
+	"crawshaw.io/sqlite"
+	"crawshaw.io/sqlite/sqlitex"
+)
+
+type sqliteStorage struct {
+	conn *sqlite.Conn
+	put  *sqlite.Stmt
+	get  *sqlite.Stmt
+	n    int // puts in the open transaction, if any
+	tx   bool
+}
+
+func openSQLite(filename string, readOnly bool) (Storage, error) {
+	flags := sqlite.SQLITE_OPEN_READWRITE | sqlite.SQLITE_OPEN_CREATE | sqlite.SQLITE_OPEN_WAL
+	if readOnly {
+		flags = sqlite.SQLITE_OPEN_READONLY
+	}
+	conn, err := sqlite.OpenConn(filename, flags|sqlite.SQLITE_OPEN_NOMUTEX)
+	if err != nil {
+		return nil, err
+	}
+	s := &sqliteStorage{conn: conn}
+	if err := s.init(readOnly); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *sqliteStorage) init(readOnly bool) error {
+	if !readOnly {
+		if err := sqlitex.ExecScript(s.conn, sqliteSchema); err != nil {
+			return err
+		}
+	}
+	var err error
+	s.get, err = s.conn.Prepare(`SELECT target, project, release FROM mappings
+		WHERE host = $host AND shortcode = $shortcode`)
+	if readOnly || err != nil {
+		return err
+	}
+	s.put, err = s.conn.Prepare(`INSERT INTO mappings (host, shortcode, target, project, release)
+		VALUES ($host, $shortcode, $target, $project, $release)
+		ON CONFLICT (host, shortcode) DO UPDATE SET
+			target = excluded.target, project = excluded.project, release = excluded.release`)
+	return err
+}
+
+func (s *sqliteStorage) Put(host string, e Entry) error {
+	if err := s.begin(); err != nil {
+		return err
+	}
+	s.put.SetText("$host", host)
+	s.put.SetText("$shortcode", e.Shortcode)
+	s.put.SetText("$target", e.Target)
+	s.put.SetText("$project", e.Project)
+	s.put.SetText("$release", e.Release)
+	if _, err := s.put.Step(); err != nil {
+		return err
+	}
+	if err := s.put.Reset(); err != nil {
+		return err
+	}
+	s.n++
+	if s.n >= sqliteBatch {
+		return s.commit()
+	}
+	return nil
+}
+
+func (s *sqliteStorage) PutProject(name, host string) error {
+	if err := s.begin(); err != nil {
+		return err
+	}
+	return sqlitex.Exec(s.conn, `INSERT INTO projects (name, host) VALUES (?, ?)
+		ON CONFLICT (name) DO UPDATE SET host = excluded.host`, nil, name, host)
+}
+
+// begin opens a transaction, if none is open.
+func (s *sqliteStorage) begin() error {
+	if s.put == nil {
+		return ErrReadOnly
+	}
+	if s.tx {
+		return nil
+	}
+	if err := sqlitex.ExecTransient(s.conn, "BEGIN", nil); err != nil {
+		return err
+	}
+	s.tx = true
+	return nil
+}
+
+func (s *sqliteStorage) Flush() error {
+	return s.commit()
+}
+
+func (s *sqliteStorage) commit() error {
+	if !s.tx {
+		return nil
+	}
+	s.tx, s.n = false, 0
+	return sqlitex.ExecTransient(s.conn, "COMMIT", nil)
+}
+
+func (s *sqliteStorage) Get(host, shortcode string) (Entry, bool, error) {
+	defer s.get.Reset()
+	s.get.SetText("$host", host)
+	s.get.SetText("$shortcode", shortcode)
+	ok, err := s.get.Step()
+	if err != nil || !ok {
+		return Entry{}, false, err
+	}
+	return Entry{shortcode, s.get.ColumnText(0), s.get.ColumnText(1), s.get.ColumnText(2)}, true, nil
+}
+
+func (s *sqliteStorage) Iterate(host string, fn func(Entry) error) error {
+	return sqlitex.Exec(s.conn, `SELECT shortcode, target, project, release FROM mappings
+		WHERE host = ? ORDER BY shortcode`, func(stmt *sqlite.Stmt) error {
+		return fn(Entry{stmt.ColumnText(0), stmt.ColumnText(1), stmt.ColumnText(2), stmt.ColumnText(3)})
+	}, host)
+}
+
+func (s *sqliteStorage) Projects() (map[string]string, error) {
+	projects := make(map[string]string)
+	var exists bool
+	if err := sqlitex.Exec(s.conn, `SELECT 1 FROM sqlite_master WHERE type = 'table' AND name = 'projects'`,
+		func(stmt *sqlite.Stmt) error {
+			exists = true
+			return nil
+		}); err != nil || !exists {
+		return projects, err
+	}
+	err := sqlitex.Exec(s.conn, `SELECT name, host FROM projects`, func(stmt *sqlite.Stmt) error {
+		projects[stmt.ColumnText(0)] = stmt.ColumnText(1)
+		return nil
+	})
+	return projects, err
+}
+
+func (s *sqliteStorage) Close() error {
+	err := s.commit()
+	if err1 := s.conn.Close(); err == nil {
+		err = err1
+	}
+	return err
+}
@@ -0,0 +1,14 @@
+// Copyright (c) 2021 Andrew Archibald
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+//go:build !cgo
+// +build !cgo
+
+package tinytown
+
+func openSQLite(filename string, readOnly bool) (Storage, error) {
+	return nil, ErrNoSQLite
+}
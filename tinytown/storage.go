@@ -0,0 +1,173 @@
+// Copyright (c) 2021 Andrew Archibald
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package tinytown
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// Storage is a key-value store of the mappings of releases, keyed by
+// the host of the shortener and the shortcode. Puts may be buffered
+// until Close, but are visible to Get and Iterate of the same storage.
+// Storage is not safe for concurrent use.
+type Storage interface {
+	// Put stores an entry for a host, replacing any with the same
+	// shortcode.
+	Put(host string, e Entry) error
+	// Get returns the entry of a shortcode of a host, if stored.
+	Get(host, shortcode string) (Entry, bool, error)
+	// Iterate calls fn with every entry of a host, in order of
+	// shortcode.
+	Iterate(host string, fn func(Entry) error) error
+	// PutProject records the host of the shortener of a project, so that
+	// lookups can name the shortener by the project.
+	PutProject(name, host string) error
+	// Projects returns the hosts of the recorded projects, by name.
+	Projects() (map[string]string, error)
+	// Flush commits buffered puts.
+	Flush() error
+	// Close flushes buffered puts and closes the storage.
+	Close() error
+}
+
+// Entry is a mapping as it is stored.
+type Entry struct {
+	Shortcode string
+	Target    string
+	Project   string // name of the project, e.g. "bitly_6"
+	Release   string // identifier of the release
+}
+
+// Storage backends, as named to OpenStorage. SQLite suits indexes that
+// are also queried with SQL and Bolt, which is pure Go and needs no cgo,
+// suits read-heavy lookups of large datasets, as it reads from a
+// memory-mapped B+tree. LevelDB, which is also pure Go, suits building
+// the largest datasets, as its log-structured merge tree writes
+// sequentially and compresses, and is a directory, not a file.
+const (
+	BackendSQLite  = "sqlite"
+	BackendBolt    = "bolt"
+	BackendLevelDB = "leveldb"
+)
+
+// ErrReadOnly is returned by Put of storage opened read-only.
+var ErrReadOnly = errors.New("tinytown: storage is read-only")
+
+// OpenStorage opens or creates the storage at path with a backend:
+// sqlite, bolt, or leveldb.
+func OpenStorage(backend, path string) (Storage, error) {
+	return openStorage(backend, path, false)
+}
+
+func openStorage(backend, path string, readOnly bool) (Storage, error) {
+	switch backend {
+	case BackendSQLite:
+		return openSQLite(path, readOnly)
+	case BackendBolt:
+		return openBolt(path, readOnly)
+	case BackendLevelDB:
+		return openLevelDB(path, readOnly)
+	}
+	return nil, fmt.Errorf("tinytown: unknown storage backend %q", backend)
+}
+
+// BuildStorage puts the mappings of every release in releasesDir into
+// a storage. Releases are put in order of their identifiers, so when a
+// shortcode is in several, the entry of the latest is kept.
+func BuildStorage(ctx context.Context, releasesDir string, s Storage) error {
+	return ProcessReleasesContext(ctx, releasesDir, storageFunc(s))
+}
+
+// storageFunc returns a ProcessFunc that puts every link into a
+// storage and records the projects of the links.
+func storageFunc(s Storage) ProcessFunc {
+	hosts := make(map[*Meta]string)
+	return mappingFunc(func(m Mapping) error {
+		host, ok := hosts[m.Project]
+		if !ok {
+			host = m.Project.Host()
+			hosts[m.Project] = host
+			if err := s.PutProject(m.Project.Name, host); err != nil {
+				return err
+			}
+		}
+		return s.Put(host, Entry{m.Shortcode, m.Target, m.Project.Name, m.Release})
+	})
+}
+
+// BuildIndex loads the mappings of every release in releasesDir into an
+// SQLite database at dbPath, keyed by the host of the shortener and the
+// shortcode, so that shortcodes are looked up without scanning the
+// dumps. Releases are loaded in order of their identifiers, so when a
+// shortcode is in several, the target of the latest is kept. The
+// database is built in a temporary file, then replaces any at dbPath.
+// The loaded projects are recorded in a checkpoint beside it, so that a
+// build that stops, such as with a crash, resumes from the temporary
+// file when it is started again.
+func BuildIndex(releasesDir, dbPath string) error {
+	return BuildIndexContext(context.Background(), releasesDir, dbPath)
+}
+
+// BuildIndexContext is like BuildIndex, but stops when the context is
+// done, leaving any database at dbPath as it was and the temporary file
+// to resume from.
+func BuildIndexContext(ctx context.Context, releasesDir, dbPath string) error {
+	return BuildIndexBackend(ctx, releasesDir, dbPath, BackendSQLite)
+}
+
+// BuildIndexBackend is like BuildIndexContext, but builds the index
+// with any storage backend.
+func BuildIndexBackend(ctx context.Context, releasesDir, path, backend string) error {
+	tmp := path + ".tmp"
+	cpPath := path + ".checkpoint"
+	cp, err := OpenCheckpoint(cpPath)
+	if err != nil {
+		return err
+	}
+	// Builds resume only from a temporary file of the same backend
+	if b, err := detectBackend(tmp); cp.Len() == 0 || err != nil || b != backend {
+		os.RemoveAll(tmp)
+		if err := cp.Close(); err != nil {
+			return err
+		}
+		if err := os.Remove(cpPath); err != nil {
+			return err
+		}
+		if cp, err = OpenCheckpoint(cpPath); err != nil {
+			return err
+		}
+	}
+	s, err := OpenStorage(backend, tmp)
+	if err != nil {
+		cp.Close()
+		return err
+	}
+	cp.Sync = s.Flush
+	err = ProcessReleasesCheckpoint(ctx, releasesDir, storageFunc(s), cp)
+	if err1 := s.Close(); err == nil {
+		err = err1
+	}
+	if err1 := cp.Close(); err == nil {
+		err = err1
+	}
+	if err != nil {
+		return err
+	}
+	// Directories are not replaced by renames
+	if fi, err := os.Stat(path); err == nil && fi.IsDir() {
+		if err := os.RemoveAll(path); err != nil {
+			return err
+		}
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+	return os.Remove(cpPath)
+}
@@ -0,0 +1,118 @@
+// Copyright (c) 2021 Andrew Archibald
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package tinytown
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestBuildIndex(t *testing.T) {
+	root := t.TempDir()
+	for i, dump := range []string{
+		"abc|http://example.org/1\nxyz|http://example.org/2\n",
+		"abc|http://example.org/3\n",
+	} {
+		dir := filepath.Join(root, fmt.Sprintf("urlteam_2021-01-0%d-00-00-00", i+1))
+		if err := os.Mkdir(dir, 0o777); err != nil {
+			t.Fatal(err)
+		}
+		writeProject(t, dir, map[string][]byte{"abc.txt.xz": []byte(dump)})
+	}
+	writeNamedProject(t, filepath.Join(root, "urlteam_2021-01-01-00-00-00"), "bitly_6",
+		"http://bit.ly/{shortcode}", map[string][]byte{"abc.txt.xz": []byte("abc|http://example.org/4\n")})
+	want := []Entry{
+		{"abc", "http://example.org/3", "example", "urlteam_2021-01-02-00-00-00"},
+		{"xyz", "http://example.org/2", "example", "urlteam_2021-01-01-00-00-00"},
+	}
+	for _, backend := range []string{BackendSQLite, BackendBolt, BackendLevelDB} {
+		t.Run(backend, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "index")
+			err := BuildIndexBackend(context.Background(), root, path, backend)
+			if errors.Is(err, ErrNoSQLite) {
+				t.Skip(err)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := os.Stat(path + ".tmp"); !errors.Is(err, os.ErrNotExist) {
+				t.Errorf("temporary index left: %v", err)
+			}
+			s, err := OpenStorage(backend, path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			e, ok, err := s.Get("example.com", "abc")
+			if err != nil || !ok || e != want[0] {
+				t.Errorf("Get(abc): got %+v, %t, %v, want %+v", e, ok, err, want[0])
+			}
+			if _, ok, err := s.Get("example.com", "abd"); ok || err != nil {
+				t.Errorf("Get(abd): got %t, %v, want not found", ok, err)
+			}
+			if _, ok, err := s.Get("example.org", "abc"); ok || err != nil {
+				t.Errorf("Get of another host: got %t, %v, want not found", ok, err)
+			}
+			var got []Entry
+			if err := s.Iterate("example.com", func(e Entry) error {
+				got = append(got, e)
+				return nil
+			}); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("Iterate: got %+v, want %+v", got, want)
+			}
+			projects, err := s.Projects()
+			if want := map[string]string{"bitly_6": "bit.ly", "example": "example.com"}; err != nil || !reflect.DeepEqual(projects, want) {
+				t.Errorf("Projects: got %v, %v, want %v", projects, err, want)
+			}
+			if err := s.Close(); err != nil {
+				t.Fatal(err)
+			}
+			// A rebuild replaces the index
+			if err := BuildIndexBackend(context.Background(), root, path, backend); err != nil {
+				t.Fatalf("rebuild: %v", err)
+			}
+			if b, err := detectBackend(path); err != nil || b != backend {
+				t.Errorf("detected backend %q, %v, want %q", b, err, backend)
+			}
+
+			idx, err := OpenIndex(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer idx.Close()
+			if target, found, err := idx.Lookup("example-com", "xyz"); err != nil || !found || target != want[1].Target {
+				t.Errorf("Lookup(xyz): got %q, %t, %v, want %q", target, found, err, want[1].Target)
+			}
+			// Projects name their shortener, with or without the version
+			for _, shortener := range []string{"bitly", "bitly_6", "bit.ly"} {
+				if target, found, err := idx.Lookup(shortener, "abc"); err != nil || !found || target != "http://example.org/4" {
+					t.Errorf("Lookup(%s, abc): got %q, %t, %v, want %q", shortener, target, found, err, "http://example.org/4")
+				}
+			}
+			if target, found, err := idx.Lookup("example", "xyz"); err != nil || !found || target != want[1].Target {
+				t.Errorf("Lookup(example, xyz): got %q, %t, %v, want %q", target, found, err, want[1].Target)
+			}
+			targets, found, err := idx.LookupBatch("example.com", []string{"abc", "abd", "xyz"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := []string{want[0].Target, "", want[1].Target}; !reflect.DeepEqual(targets, want) {
+				t.Errorf("LookupBatch: got targets %q, want %q", targets, want)
+			}
+			if want := []bool{true, false, true}; !reflect.DeepEqual(found, want) {
+				t.Errorf("LookupBatch: got found %v, want %v", found, want)
+			}
+		})
+	}
+}
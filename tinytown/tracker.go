@@ -7,9 +7,13 @@
 package tinytown
 
 import (
+	"context"
 	"encoding/hex"
+	"net/http"
 
 	"github.com/andrewarchi/browser/jsonutil"
+	"github.com/andrewarchi/urlhero/crawl"
+	"github.com/andrewarchi/urlhero/tracing"
 )
 
 // Tracker is the base URL of the Terror of Tiny Town tracker instance.
@@ -30,7 +34,13 @@ type ProjectStats struct {
 }
 
 func GetHealth() (*Health, error) {
-	resp, err := httpGet(Tracker + "/api/health")
+	return GetHealthContext(context.Background())
+}
+
+// GetHealthContext is like GetHealth, but the request is canceled with
+// the context.
+func GetHealthContext(ctx context.Context) (*Health, error) {
+	resp, err := httpGet(ctx, Tracker+"/api/health")
 	if err != nil {
 		return nil, err
 	}
@@ -69,3 +79,24 @@ func GetHealth() (*Health, error) {
 		ProjectStats:      stats,
 	}, nil
 }
+
+// trackerClient traces requests to the tracker, which is not part of the
+// Internet Archive, so does not use ia.Client, and applies the crawl
+// configuration.
+var trackerClient = &http.Client{Transport: tracing.Transport(crawl.Transport(nil))}
+
+func httpGet(ctx context.Context, url string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := trackerClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, &StatusError{url, resp.StatusCode, resp.Status}
+	}
+	return resp, nil
+}
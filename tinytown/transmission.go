@@ -7,22 +7,30 @@
 package tinytown
 
 import (
+	"context"
 	"fmt"
 
+	"github.com/andrewarchi/urlhero/logger"
 	trpc "github.com/hekmon/transmissionrpc"
 )
 
 func DownloadTransmission(c *trpc.Client, dir string) error {
+	return DownloadTransmissionContext(context.Background(), c, dir)
+}
+
+// DownloadTransmissionContext is like DownloadTransmission, but stops
+// adding torrents when the context is done.
+func DownloadTransmissionContext(ctx context.Context, c *trpc.Client, dir string) error {
 	if err := checkVersion(c); err != nil {
 		return err
 	}
-	ids, err := GetReleaseIDs()
+	ids, err := GetReleaseIDsContext(ctx)
 	if err != nil {
 		return err
 	}
 	for i, id := range ids {
-		fmt.Printf("(%d/%d) Adding %s\n", i+1, len(ids), id)
-		filename, err := saveTorrentFile(id, dir)
+		logger.Info("adding torrent", "id", id, "n", i+1, "total", len(ids))
+		filename, err := saveTorrentFile(ctx, id, dir)
 		if err != nil {
 			return err
 		}
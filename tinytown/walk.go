@@ -8,15 +8,20 @@ package tinytown
 
 import (
 	"archive/zip"
-	"fmt"
+	"context"
+	"errors"
 	"io"
+	"net/url"
 	"os"
 	"path/filepath"
 	"strings"
 
-	"github.com/andrewarchi/archive"
 	"github.com/andrewarchi/browser/jsonutil"
 	"github.com/andrewarchi/urlhero/beacon"
+	"github.com/andrewarchi/urlhero/intern"
+	"github.com/andrewarchi/urlhero/logger"
+	"github.com/andrewarchi/urlhero/report"
+	"github.com/andrewarchi/urlhero/xz"
 )
 
 // Meta contains link dump metadata from a *.meta.json.xz file.
@@ -42,14 +47,51 @@ type Meta struct {
 	AutoreleaseTime   int     `json:"autorelease_time"`
 }
 
+// Host returns the host of the shortener of the project, without www.
+func (m *Meta) Host() string {
+	return TemplateHost(m.URLTemplate)
+}
+
+// TemplateHost returns the host, without www, of a URL template, such
+// as "http://bit.ly/{shortcode}".
+func TemplateHost(template string) string {
+	u, err := url.Parse(strings.ReplaceAll(template, "{shortcode}", ""))
+	if err != nil || u.Host == "" {
+		return template
+	}
+	return strings.TrimPrefix(u.Hostname(), "www.")
+}
+
 // ProcessFunc is the type of function that is called for each link
-// visited.
+// visited. When it returns SkipDump, the rest of the link dump is
+// skipped.
 type ProcessFunc func(l *beacon.Link, m *Meta, shortcodeLen int, releaseFilename, dumpFilename string) error
 
+// SkipDump is used as a return value from a ProcessFunc to skip the
+// remaining links of the current link dump. It is not returned as an
+// error by any function.
+var SkipDump = errors.New("skip this dump")
+
 // ProcessReleases processes every release in a directory by calling fn
 // on every link.
 func ProcessReleases(root string, fn ProcessFunc) error {
+	return ProcessReleasesContext(context.Background(), root, fn)
+}
+
+// ProcessReleasesContext is like ProcessReleases, but stops when the
+// context is done.
+func ProcessReleasesContext(ctx context.Context, root string, fn ProcessFunc) error {
 	// TODO allow user to skip releases or projects.
+	return walkProjects(ctx, root, nil, func(filename string) error {
+		return ProcessProjectContext(ctx, filename, fn)
+	})
+}
+
+// walkProjects calls fn with the filename of every project zip in the
+// releases in a directory, in order, until the context is done. Errors
+// reading a release directory are passed to dirErr, when not nil, which
+// returns nil to skip the release, or else they stop the walk.
+func walkProjects(ctx context.Context, root string, dirErr func(release string, err error) error, fn func(filename string) error) error {
 	rootContents, err := os.ReadDir(root)
 	if err != nil {
 		return err
@@ -61,16 +103,115 @@ func ProcessReleases(root string, fn ProcessFunc) error {
 		dir := filepath.Join(root, release.Name())
 		dirContents, err := os.ReadDir(dir)
 		if err != nil {
-			return err
+			if dirErr != nil {
+				err = dirErr(release.Name(), err)
+			}
+			if err != nil {
+				return err
+			}
+			continue
 		}
 		for _, file := range dirContents {
-			filename := filepath.Join(dir, file.Name())
-			if !strings.HasSuffix(filename, ".zip") {
+			if !strings.HasSuffix(file.Name(), ".zip") {
 				continue
 			}
-			if err := ProcessProject(filename, fn); err != nil {
+			if err := ctx.Err(); err != nil {
 				return err
 			}
+			if err := fn(filepath.Join(dir, file.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// ProcessMappings walks the releases in a directory, like
+// ProcessReleases, and calls fn with every mapping. It is a simpler
+// alternative to ProcessReleases for callers that do not need the
+// filenames of the link dumps.
+func ProcessMappings(root string, fn func(Mapping) error) error {
+	return ProcessMappingsContext(context.Background(), root, fn)
+}
+
+// ProcessMappingsContext is like ProcessMappings, but stops when the
+// context is done.
+func ProcessMappingsContext(ctx context.Context, root string, fn func(Mapping) error) error {
+	return ProcessReleasesContext(ctx, root, mappingFunc(fn))
+}
+
+// mappingFunc returns a ProcessFunc that calls fn with the mapping of
+// every link.
+func mappingFunc(fn func(Mapping) error) ProcessFunc {
+	var lastFilename, release string
+	return func(l *beacon.Link, m *Meta, shortcodeLen int, releaseFilename, dumpFilename string) error {
+		if releaseFilename != lastFilename {
+			lastFilename = releaseFilename
+			release = releaseID(releaseFilename)
+		}
+		return fn(Mapping{l.Source, l.Target, m, release})
+	}
+}
+
+// ProcessReleasesReport processes every release in a directory like
+// ProcessReleases, but records the projects that cannot be read as
+// failures in rep and continues with the rest, instead of stopping at
+// the first. Links of a failed project that were visited before the
+// failure are not undone. Errors returned by fn still stop processing.
+func ProcessReleasesReport(ctx context.Context, root string, fn ProcessFunc, rep *report.Report) error {
+	return walkProjects(ctx, root, func(release string, err error) error {
+		rep.Fail(release, err)
+		return nil
+	}, func(filename string) error {
+		return ProcessProjectReport(ctx, filename, fn, rep)
+	})
+}
+
+// ProcessProjectReport processes a project release like
+// ProcessProjectContext and records its outcome in rep. It only returns
+// errors from fn and of the context.
+func ProcessProjectReport(ctx context.Context, filename string, fn ProcessFunc, rep *report.Report) error {
+	var fnErr error
+	err := ProcessProjectContext(ctx, filename, func(l *beacon.Link, m *Meta, shortcodeLen int, releaseFilename, dumpFilename string) error {
+		err := fn(l, m, shortcodeLen, releaseFilename, dumpFilename)
+		if err != nil && err != SkipDump {
+			fnErr = err
+		}
+		return err
+	})
+	switch {
+	case fnErr != nil:
+		return fnErr
+	case ctx.Err() != nil:
+		return ctx.Err()
+	case err != nil:
+		rep.Fail(filename, err)
+	default:
+		rep.Succeed(1)
+	}
+	return nil
+}
+
+// ProcessRelease processes every project in a release directory by
+// calling fn on every link.
+func ProcessRelease(dir string, fn ProcessFunc) error {
+	return ProcessReleaseContext(context.Background(), dir, fn)
+}
+
+// ProcessReleaseContext is like ProcessRelease, but stops when the
+// context is done.
+func ProcessReleaseContext(ctx context.Context, dir string, fn ProcessFunc) error {
+	dirContents, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, file := range dirContents {
+		filename := filepath.Join(dir, file.Name())
+		if !strings.HasSuffix(filename, ".zip") {
+			continue
+		}
+		if err := ProcessProjectContext(ctx, filename, fn); err != nil {
+			return err
 		}
 	}
 	return nil
@@ -79,6 +220,13 @@ func ProcessReleases(root string, fn ProcessFunc) error {
 // ProcessProject processes every link dump in a project release by
 // calling fn on every link.
 func ProcessProject(filename string, fn ProcessFunc) error {
+	return ProcessProjectContext(context.Background(), filename, fn)
+}
+
+// ProcessProjectContext is like ProcessProject, but stops when the
+// context is done, which is checked between link dumps and every
+// ctxCheckInterval links.
+func ProcessProjectContext(ctx context.Context, filename string, fn ProcessFunc) error {
 	zr, err := zip.OpenReader(filename)
 	if err != nil {
 		return err
@@ -92,14 +240,30 @@ func ProcessProject(filename string, fn ProcessFunc) error {
 	if err != nil {
 		return err
 	}
+	progress := progressFrom(ctx)
+	var links int64
 	for _, f := range dumps {
-		if err := processLinkDump(f, filename, meta, fn); err != nil {
+		if err := ctx.Err(); err != nil {
 			return err
 		}
+		n, err := processLinkDump(ctx, f, filename, meta, fn)
+		links += n
+		if err != nil {
+			return err
+		}
+	}
+	if progress != nil {
+		progress(ProgressEvent{Kind: ProgressFile, Release: releaseID(filename), Filename: filename, N: links})
 	}
 	return nil
 }
 
+// releaseID returns the identifier of the release of a project zip,
+// which is the name of its directory.
+func releaseID(filename string) string {
+	return filepath.Base(filepath.Dir(filename))
+}
+
 func classifyFiles(files []*zip.File, filename string) (meta *zip.File, dumps []*zip.File, err error) {
 	// Before 2015-07-29, project zip archives were sorted with meta
 	// first, followed by dumps in increasing shortcode length. Later
@@ -107,7 +271,7 @@ func classifyFiles(files []*zip.File, filename string) (meta *zip.File, dumps []
 meta:
 	switch {
 	case len(files) == 0:
-		return nil, nil, fmt.Errorf("tinytown: empty archive: %s", filename)
+		return nil, nil, &ArchiveError{filename, "empty archive"}
 	// Meta is usually first or last; don't allocate for those.
 	case strings.HasSuffix(files[0].Name, ".meta.json.xz"):
 		meta = files[0]
@@ -124,12 +288,12 @@ meta:
 				break meta
 			}
 		}
-		return nil, nil, fmt.Errorf("tinytown: no meta file in archive: %s", filename)
+		return nil, nil, &ArchiveError{filename, "no meta file in archive"}
 	}
 
 	for _, f := range dumps {
 		if !strings.HasSuffix(f.Name, ".txt.xz") {
-			return nil, nil, fmt.Errorf("tinytown: not a link dump: %s", filename)
+			return nil, nil, &ArchiveError{filename, "not a link dump"}
 		}
 	}
 	return
@@ -141,7 +305,14 @@ func readMeta(f *zip.File) (*Meta, error) {
 		return nil, err
 	}
 	defer fr.Close()
-	xr, err := archive.NewXZReader(fr)
+	return ParseMeta(fr)
+}
+
+// ParseMeta parses the xz-compressed metadata of a project, as in the
+// *.meta.json.xz file of a project zip. The metadata of the mappings
+// read from releases is in Mapping.Project.
+func ParseMeta(r io.Reader) (*Meta, error) {
+	xr, err := xz.NewReader(r)
 	if err != nil {
 		return nil, err
 	}
@@ -150,37 +321,82 @@ func readMeta(f *zip.File) (*Meta, error) {
 	if err := jsonutil.Decode(xr, &m); err != nil {
 		return nil, err
 	}
+	// Projects are repeated in every release
+	m.Name = metaStrings.String(m.Name)
+	m.Alphabet = metaStrings.String(m.Alphabet)
+	m.URLTemplate = metaStrings.String(m.URLTemplate)
 	return &m, nil
 }
 
-func processLinkDump(f *zip.File, filename string, meta *Meta, fn ProcessFunc) error {
+// metaStrings interns the strings of project metadata.
+var metaStrings = intern.NewTable()
+
+// ctxCheckInterval is the number of links processed between checks of
+// whether the context is done.
+const ctxCheckInterval = 4096
+
+// processLinkDump calls fn on every link of a link dump and returns the
+// number of links read. Parsed mappings are reported to the progress
+// function of the context every ctxCheckInterval links.
+func processLinkDump(ctx context.Context, f *zip.File, filename string, meta *Meta, fn ProcessFunc) (int64, error) {
 	r, err := f.Open()
 	if err != nil {
-		return err
+		return 0, err
 	}
 	defer r.Close()
-	xr, err := archive.NewXZReader(r)
+	cr := &countReader{r: r}
+	xr, err := xz.NewReader(cr)
 	if err != nil {
-		return err
+		return 0, &DumpError{filename, f.Name, err}
 	}
 	defer xr.Close()
 
+	progress := progressFrom(ctx)
+	var n, reported, reportedBytes int64
+	flush := func() {
+		if progress != nil && (n > reported || cr.n > reportedBytes) {
+			progress(ProgressEvent{Kind: ProgressMappings, Release: releaseID(filename), Filename: filename,
+				N: n - reported, Bytes: cr.n - reportedBytes})
+			reported, reportedBytes = n, cr.n
+		}
+	}
+	defer flush()
+
 	shortcodeLen := len(filepath.Base(f.Name)) - len(".txt.xz")
 	br := beacon.NewURLTeamReader(xr, shortcodeLen)
-	fmt.Fprintf(os.Stderr, "%s:%s ", filepath.Base(filename), f.Name)
-	n := 0
 	for {
 		link, err := br.Read()
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "[%d links]\n", n)
+			logger.Debug("processed link dump", "release", filepath.Base(filename), "dump", f.Name, "links", n)
 			if err == io.EOF {
-				return nil
+				return n, nil
 			}
-			return err
+			return n, &DumpError{filename, f.Name, err}
 		}
 		n++
+		if n%ctxCheckInterval == 0 {
+			flush()
+			if err := ctx.Err(); err != nil {
+				return n, err
+			}
+		}
 		if err := fn(link, meta, shortcodeLen, filename, f.Name); err != nil {
-			return err
+			if err == SkipDump {
+				return n, nil
+			}
+			return n, err
 		}
 	}
 }
+
+// countReader counts the bytes read from r.
+type countReader struct {
+	r io.Reader
+	n int64
+}
+
+func (cr *countReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,344 @@
+// Copyright (c) 2021 Andrew Archibald
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package tinytown
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/andrewarchi/urlhero/beacon"
+	"github.com/andrewarchi/urlhero/benchdata"
+	"github.com/andrewarchi/urlhero/report"
+	"github.com/ulikunitz/xz"
+)
+
+// writeProject writes a project release zip with a link dump for each
+// shortcode length.
+func writeProject(t testing.TB, dir string, dumps map[string][]byte) string {
+	return writeNamedProject(t, dir, "example", "http://example.com/{shortcode}", dumps)
+}
+
+// writeNamedProject is like writeProject, but for a project with a name
+// and URL template.
+func writeNamedProject(t testing.TB, dir, name, template string, dumps map[string][]byte) string {
+	filename := filepath.Join(dir, name+"_1609459200.zip")
+	f, err := os.Create(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	zw := zip.NewWriter(f)
+	files := map[string][]byte{
+		name + ".meta.json.xz": []byte(`{"name":"` + name + `","alphabet":"` + benchdata.Alphabet +
+			`","url_template":"` + template + `"}`),
+	}
+	for name, dump := range dumps {
+		files[name] = dump
+	}
+	for name, data := range files {
+		w, err := zw.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Store})
+		if err != nil {
+			t.Fatal(err)
+		}
+		xw, err := xz.NewWriter(w)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := xw.Write(data); err != nil {
+			t.Fatal(err)
+		}
+		if err := xw.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return filename
+}
+
+func TestProcessProject(t *testing.T) {
+	filename := writeProject(t, t.TempDir(), map[string][]byte{
+		"abc.txt.xz":  []byte("abc|http://example.org/1\nxyz|http://example.org/2\n"),
+		"abcd.txt.xz": []byte("abcd|http://example.org/3\nmulti\n"),
+	})
+	got := make(map[string]string)
+	err := ProcessProject(filename, func(l *beacon.Link, m *Meta, shortcodeLen int, releaseFilename, dumpFilename string) error {
+		if m.Name != "example" || m.URLTemplate != "http://example.com/{shortcode}" {
+			t.Errorf("got meta %+v", m)
+		}
+		if len(l.Source) != shortcodeLen || releaseFilename != filename {
+			t.Errorf("link %v from %s in %s", l, dumpFilename, releaseFilename)
+		}
+		got[l.Source] = l.Target
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"abc":  "http://example.org/1",
+		"xyz":  "http://example.org/2",
+		"abcd": "http://example.org/3\nmulti",
+	}
+	if len(got) != len(want) {
+		t.Errorf("got links %v, want %v", got, want)
+	}
+	for code, target := range want {
+		if got[code] != target {
+			t.Errorf("link %s: got target %q, want %q", code, got[code], target)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = ProcessProjectContext(ctx, filename, func(*beacon.Link, *Meta, int, string, string) error {
+		t.Error("link processed after cancellation")
+		return nil
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("ProcessProjectContext when canceled: got error %v, want context.Canceled", err)
+	}
+}
+
+func TestProcessMappings(t *testing.T) {
+	root := t.TempDir()
+	dir := filepath.Join(root, "urlteam_2021-01-01-00-00-00")
+	if err := os.Mkdir(dir, 0o777); err != nil {
+		t.Fatal(err)
+	}
+	writeProject(t, dir, map[string][]byte{"abc.txt.xz": []byte("abc|http://example.org/1\n")})
+	var got []Mapping
+	if err := ProcessMappings(root, func(m Mapping) error {
+		got = append(got, m)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || got[0].Shortcode != "abc" || got[0].Target != "http://example.org/1" ||
+		got[0].Release != "urlteam_2021-01-01-00-00-00" || got[0].Project.Name != "example" {
+		t.Errorf("got mappings %+v", got)
+	}
+}
+
+func TestProgress(t *testing.T) {
+	root := t.TempDir()
+	dir := filepath.Join(root, "urlteam_2021-01-01-00-00-00")
+	if err := os.Mkdir(dir, 0o777); err != nil {
+		t.Fatal(err)
+	}
+	filename := writeProject(t, dir, map[string][]byte{
+		"abc.txt.xz":  []byte("abc|http://example.org/1\nxyz|http://example.org/2\n"),
+		"abcd.txt.xz": []byte("abcd|http://example.org/3\n"),
+	})
+	var mappings, read int64
+	var files []ProgressEvent
+	ctx := WithProgress(context.Background(), func(e ProgressEvent) {
+		switch e.Kind {
+		case ProgressMappings:
+			mappings += e.N
+			read += e.Bytes
+		case ProgressFile:
+			files = append(files, e)
+		default:
+			t.Errorf("unexpected %s event %+v", e.Kind, e)
+		}
+	})
+	if err := ProcessReleasesContext(ctx, root, func(*beacon.Link, *Meta, int, string, string) error {
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if mappings != 3 {
+		t.Errorf("got %d mappings, want 3", mappings)
+	}
+	zr, err := zip.OpenReader(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer zr.Close()
+	var size int64
+	for _, f := range zr.File {
+		if strings.HasSuffix(f.Name, ".txt.xz") {
+			size += int64(f.UncompressedSize64)
+		}
+	}
+	if read != size {
+		t.Errorf("got %d bytes, want %d", read, size)
+	}
+	want := []ProgressEvent{{Kind: ProgressFile, Release: "urlteam_2021-01-01-00-00-00", Filename: filename, N: 3}}
+	if !reflect.DeepEqual(files, want) {
+		t.Errorf("got file events %+v, want %+v", files, want)
+	}
+}
+
+func TestParseMeta(t *testing.T) {
+	var b bytes.Buffer
+	xw, err := xz.NewWriter(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	xw.Write([]byte(`{"name":"bitly_6","alphabet":"0123456789","url_template":"http://www.bit.ly/{shortcode}","autoqueue":true,"num_count_per_item":50}`))
+	if err := xw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	m, err := ParseMeta(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Name != "bitly_6" || m.Alphabet != "0123456789" || !m.Autoqueue || m.NumCountPerItem != 50 {
+		t.Errorf("got meta %+v", m)
+	}
+	if host := m.Host(); host != "bit.ly" {
+		t.Errorf("Host() = %q, want bit.ly", host)
+	}
+}
+
+func TestMappingReader(t *testing.T) {
+	var b bytes.Buffer
+	xw, err := xz.NewWriter(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	xw.Write([]byte("abc|http://example.org/1\nxyz|http://example.org/2\nline\n"))
+	if err := xw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	read := func(data []byte) ([]Mapping, error) {
+		mr, err := NewMappingReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		defer mr.Close()
+		var got []Mapping
+		for {
+			m, err := mr.Read()
+			if err == io.EOF {
+				return got, nil
+			}
+			if err != nil {
+				return got, err
+			}
+			got = append(got, m)
+		}
+	}
+	got, err := read(b.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Mapping{
+		{Shortcode: "abc", Target: "http://example.org/1"},
+		{Shortcode: "xyz", Target: "http://example.org/2\nline"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got mappings %+v, want %+v", got, want)
+	}
+	if _, err := read(b.Bytes()[:b.Len()/2]); err == nil {
+		t.Error("truncated dump: got no error")
+	}
+}
+
+func TestProcessProjectErrors(t *testing.T) {
+	dir := t.TempDir()
+	filename := writeProject(t, dir, map[string][]byte{"abc.txt.xz": benchdata.LinkDump(1000, 3)})
+	// Rewrite the project with the dump cut off, as by an interrupted
+	// download
+	zr, err := zip.OpenReader(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b bytes.Buffer
+	zw := zip.NewWriter(&b)
+	for _, f := range zr.File {
+		r, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if f.Name == "abc.txt.xz" {
+			data = data[:len(data)/2]
+		}
+		w, err := zw.CreateHeader(&zip.FileHeader{Name: f.Name, Method: zip.Store})
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write(data)
+	}
+	zr.Close()
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	truncated := filepath.Join(dir, "truncated.zip")
+	if err := os.WriteFile(truncated, b.Bytes(), 0o666); err != nil {
+		t.Fatal(err)
+	}
+	var derr *DumpError
+	err = ProcessProject(truncated, func(*beacon.Link, *Meta, int, string, string) error { return nil })
+	if !errors.As(err, &derr) || derr.Dump != "abc.txt.xz" || !derr.Truncated() {
+		t.Errorf("ProcessProject with truncated dump: got error %v, want truncated *DumpError", err)
+	}
+
+	empty := filepath.Join(dir, "empty.zip")
+	f, err := os.Create(empty)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := zip.NewWriter(f).Close(); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	err = ProcessProject(empty, func(*beacon.Link, *Meta, int, string, string) error { return nil })
+	if !errors.Is(err, ErrFormat) {
+		t.Errorf("ProcessProject with empty archive: got error %v, want ErrFormat", err)
+	}
+
+	rep := report.New("process")
+	for _, filename := range []string{truncated, empty} {
+		if err := ProcessProjectReport(context.Background(), filename, func(*beacon.Link, *Meta, int, string, string) error { return nil }, rep); err != nil {
+			t.Errorf("ProcessProjectReport(%q): %v", filename, err)
+		}
+	}
+	s := rep.Summary()
+	if s.Failed != 2 || len(s.Classes) != 2 || s.Classes[0].Class != report.ClassInput || s.Classes[1].Class != report.ClassTruncated {
+		t.Errorf("ProcessProjectReport: got summary %+v, want an input and a truncated failure", s)
+	}
+}
+
+func BenchmarkProcessProject(b *testing.B) {
+	dumps := map[string][]byte{
+		"00000.txt.xz":  benchdata.LinkDump(20000, 5),
+		"000000.txt.xz": benchdata.LinkDump(80000, 6),
+	}
+	filename := writeProject(b, b.TempDir(), dumps)
+	b.SetBytes(int64(len(dumps["00000.txt.xz"]) + len(dumps["000000.txt.xz"])))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		n := 0
+		err := ProcessProject(filename, func(*beacon.Link, *Meta, int, string, string) error {
+			n++
+			return nil
+		})
+		if err != nil {
+			b.Fatal(err)
+		}
+		if n != 100000 {
+			b.Fatalf("processed %d links, want 100000", n)
+		}
+	}
+}
@@ -0,0 +1,39 @@
+#!/bin/bash
+# Copyright (c) 2021 Andrew Archibald
+#
+# This Source Code Form is subject to the terms of the Mozilla Public
+# License, v. 2.0. If a copy of the MPL was not distributed with this
+# file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+# bench.bash runs the benchmarks of a commit, by default HEAD, and of the
+# working tree and compares them with cmd/benchcmp, failing when any
+# regressed. Further arguments are passed to go test.
+#
+# Environment variables select what is run:
+#   PKGS       packages to benchmark (default ./...)
+#   BENCH      benchmark pattern (default .)
+#   COUNT      runs of each benchmark (default 5)
+#   THRESHOLD  fraction a metric may regress (default 0.10)
+#
+# Example:
+#   BENCH=Lookup tools/bench.bash main -benchtime=2s
+
+set -euo pipefail
+
+ref=HEAD
+if [[ $# -gt 0 && $1 != -* ]]; then
+  ref=$1
+  shift
+fi
+root=$(git rev-parse --show-toplevel)
+tmp=$(mktemp -d)
+trap 'git -C "$root" worktree remove --force "$tmp/old" 2>/dev/null; rm -rf "$tmp"' EXIT
+git -C "$root" worktree add --quiet --detach "$tmp/old" "$ref"
+
+flags=(-run='^$' -bench="${BENCH:-.}" -benchmem -count="${COUNT:-5}" "$@")
+echo "Benchmarking $ref" >&2
+(cd "$tmp/old" && go test "${flags[@]}" ${PKGS:-./...}) > "$tmp/old.txt"
+echo "Benchmarking working tree" >&2
+(cd "$root" && go test "${flags[@]}" ${PKGS:-./...}) > "$tmp/new.txt"
+cd "$root"
+go run ./cmd/benchcmp -threshold="${THRESHOLD:-0.10}" "$tmp/old.txt" "$tmp/new.txt"
@@ -0,0 +1,61 @@
+// Copyright (c) 2021 Andrew Archibald
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package tracing
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestTransport(t *testing.T) {
+	rec := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(rec)))
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, span := StartServer(r.Context(), "HTTP test", r.Header)
+		span.End()
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer srv.Close()
+
+	ctx, parent := Start(context.Background(), "parent")
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := (&http.Client{Transport: Transport(nil)}).Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	parent.End()
+
+	spans := rec.Ended()
+	if len(spans) != 3 {
+		t.Fatalf("got %d spans, want 3", len(spans))
+	}
+	server, client := spans[0], spans[1]
+	if server.Name() != "HTTP test" || client.Name() != "HTTP GET" || spans[2].Name() != "parent" {
+		t.Fatalf("got spans %q, %q, %q", server.Name(), client.Name(), spans[2].Name())
+	}
+	traceID := parent.SpanContext().TraceID()
+	if server.SpanContext().TraceID() != traceID || client.Parent().SpanID() != parent.SpanContext().SpanID() ||
+		server.Parent().SpanID() != client.SpanContext().SpanID() {
+		t.Error("trace context not propagated from client to server")
+	}
+	if client.Status().Description != "HTTP status 404" {
+		t.Errorf("got client status %+v", client.Status())
+	}
+}
@@ -0,0 +1,142 @@
+// Copyright (c) 2021 Andrew Archibald
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+//go:build cgo && liblzma
+// +build cgo,liblzma
+
+package xz
+
+/*
+#cgo LDFLAGS: -llzma
+#include <stdint.h>
+#include <stdlib.h>
+#include <lzma.h>
+
+static lzma_ret init_decoder(lzma_stream *strm, uint32_t threads) {
+#if LZMA_VERSION >= 50040002
+	lzma_mt mt = {0};
+	mt.flags = LZMA_CONCATENATED;
+	mt.threads = threads;
+	mt.memlimit_threading = lzma_physmem() / 4;
+	mt.memlimit_stop = UINT64_MAX;
+	return lzma_stream_decoder_mt(strm, &mt);
+#else
+	return lzma_stream_decoder(strm, UINT64_MAX, LZMA_CONCATENATED);
+#endif
+}
+*/
+import "C"
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"unsafe"
+)
+
+const haveLiblzma = true
+
+const liblzmaBufSize = 64 << 10
+
+// liblzmaReader decodes with liblzma. The stream state and buffers are
+// allocated in C, because liblzma retains pointers to them.
+type liblzmaReader struct {
+	r       io.Reader
+	strm    *C.lzma_stream
+	in, out *C.uint8_t
+	inBuf   []byte
+	outBuf  []byte
+	pending []byte // decoded, but not yet read
+	eof     bool   // of r
+	err     error
+}
+
+func newLiblzmaReader(r io.Reader, threads int) (io.ReadCloser, error) {
+	strm := (*C.lzma_stream)(C.calloc(1, C.sizeof_lzma_stream))
+	if ret := C.init_decoder(strm, C.uint32_t(threads)); ret != C.LZMA_OK {
+		C.free(unsafe.Pointer(strm))
+		return nil, liblzmaError(ret)
+	}
+	z := &liblzmaReader{
+		r:    r,
+		strm: strm,
+		in:   (*C.uint8_t)(C.malloc(liblzmaBufSize)),
+		out:  (*C.uint8_t)(C.malloc(liblzmaBufSize)),
+	}
+	z.inBuf = (*[liblzmaBufSize]byte)(unsafe.Pointer(z.in))[:]
+	z.outBuf = (*[liblzmaBufSize]byte)(unsafe.Pointer(z.out))[:]
+	return z, nil
+}
+
+func (z *liblzmaReader) Read(p []byte) (int, error) {
+	for len(z.pending) == 0 {
+		if z.err != nil {
+			return 0, z.err
+		}
+		z.decode()
+	}
+	n := copy(p, z.pending)
+	z.pending = z.pending[n:]
+	return n, nil
+}
+
+func (z *liblzmaReader) decode() {
+	if z.strm.avail_in == 0 && !z.eof {
+		n, err := z.r.Read(z.inBuf)
+		z.strm.next_in = z.in
+		z.strm.avail_in = C.size_t(n)
+		if err == io.EOF {
+			z.eof = true
+		} else if err != nil {
+			z.err = err
+			return
+		}
+	}
+	action := C.lzma_action(C.LZMA_RUN)
+	if z.eof {
+		action = C.LZMA_FINISH
+	}
+	z.strm.next_out = z.out
+	z.strm.avail_out = liblzmaBufSize
+	ret := C.lzma_code(z.strm, action)
+	z.pending = z.outBuf[:liblzmaBufSize-int(z.strm.avail_out)]
+	switch ret {
+	case C.LZMA_OK:
+	case C.LZMA_STREAM_END:
+		z.err = io.EOF
+	default:
+		z.err = liblzmaError(ret)
+	}
+}
+
+func (z *liblzmaReader) Close() error {
+	if z.strm != nil {
+		C.lzma_end(z.strm)
+		C.free(unsafe.Pointer(z.strm))
+		C.free(unsafe.Pointer(z.in))
+		C.free(unsafe.Pointer(z.out))
+		z.strm = nil
+	}
+	return nil
+}
+
+func liblzmaError(ret C.lzma_ret) error {
+	switch ret {
+	case C.LZMA_BUF_ERROR:
+		return io.ErrUnexpectedEOF
+	case C.LZMA_FORMAT_ERROR:
+		return errors.New("xz: not an xz stream")
+	case C.LZMA_DATA_ERROR:
+		return errors.New("xz: corrupt data")
+	case C.LZMA_OPTIONS_ERROR:
+		return errors.New("xz: unsupported options")
+	case C.LZMA_UNSUPPORTED_CHECK:
+		return errors.New("xz: unsupported integrity check")
+	case C.LZMA_MEM_ERROR, C.LZMA_MEMLIMIT_ERROR:
+		return errors.New("xz: out of memory")
+	}
+	return fmt.Errorf("xz: liblzma error %d", ret)
+}
@@ -0,0 +1,21 @@
+// Copyright (c) 2021 Andrew Archibald
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+//go:build !cgo || !liblzma
+// +build !cgo !liblzma
+
+package xz
+
+import (
+	"errors"
+	"io"
+)
+
+const haveLiblzma = false
+
+func newLiblzmaReader(r io.Reader, threads int) (io.ReadCloser, error) {
+	return nil, errors.New("xz: built without liblzma")
+}
@@ -0,0 +1,315 @@
+// Copyright (c) 2021 Andrew Archibald
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+// Package xz decompresses xz streams, such as link dumps, with the
+// fastest available backend. Backends that support it decode the blocks
+// of multi-block streams in parallel, and decoding runs concurrently
+// with the reader's processing of the output.
+package xz
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/andrewarchi/urlhero/logger"
+	"github.com/ulikunitz/xz"
+)
+
+// Backend is an implementation of xz decompression.
+type Backend int
+
+const (
+	// Auto selects liblzma, when built in, then the xz command, when in
+	// PATH, then Go.
+	Auto Backend = iota
+	// Go decodes with the pure Go decoder. It is the slowest, but always
+	// available.
+	Go
+	// Command runs the xz command of XZ Utils.
+	Command
+	// Liblzma decodes with liblzma through cgo. It is only available when
+	// built with the liblzma tag.
+	Liblzma
+)
+
+var backendNames = [...]string{"auto", "go", "xz", "liblzma"}
+
+// ParseBackend parses the name of a backend: "auto", "go", "xz", or
+// "liblzma".
+func ParseBackend(name string) (Backend, error) {
+	for b, n := range backendNames {
+		if n == name {
+			return Backend(b), nil
+		}
+	}
+	return 0, fmt.Errorf("xz: unknown backend %q", name)
+}
+
+func (b Backend) String() string {
+	if b >= 0 && int(b) < len(backendNames) {
+		return backendNames[b]
+	}
+	return "Backend(" + strconv.Itoa(int(b)) + ")"
+}
+
+// Available reports whether the backend can be used.
+func (b Backend) Available() bool {
+	switch b {
+	case Auto, Go:
+		return true
+	case Command:
+		_, err := exec.LookPath("xz")
+		return err == nil
+	case Liblzma:
+		return haveLiblzma
+	}
+	return false
+}
+
+// Resolve returns the backend that Auto selects, or b otherwise.
+func (b Backend) Resolve() Backend {
+	if b != Auto {
+		return b
+	}
+	for _, b := range []Backend{Liblzma, Command} {
+		if b.Available() {
+			return b
+		}
+	}
+	return Go
+}
+
+// DefaultBackend is the backend of NewReader.
+var DefaultBackend = Auto
+
+// Threads is the number of threads that liblzma and the xz command use
+// to decode multi-block streams, or 0 for one per CPU. Streams with a
+// single block, as written by xz before version 5.4 by default, are
+// decoded by one thread.
+var Threads = 0
+
+func threads() int {
+	if Threads > 0 {
+		return Threads
+	}
+	return runtime.NumCPU()
+}
+
+// NewReader returns a reader that decompresses r, which may contain
+// concatenated streams, with DefaultBackend.
+func NewReader(r io.Reader) (io.ReadCloser, error) {
+	return DefaultBackend.NewReader(r)
+}
+
+// NewReader returns a reader that decompresses r with the backend. With
+// Auto, backends that fail to start fall back to Go.
+func (b Backend) NewReader(r io.Reader) (io.ReadCloser, error) {
+	switch backend := b.Resolve(); backend {
+	case Liblzma:
+		zr, err := newLiblzmaReader(r, threads())
+		if err == nil {
+			return readAhead(zr), nil
+		} else if b != Auto {
+			return nil, err
+		}
+		logger.Warn("falling back to Go xz decoder", "backend", backend, "err", err)
+	case Command:
+		cr, err := newCommandReader(r, threads())
+		if err == nil {
+			return cr, nil
+		} else if b != Auto {
+			return nil, err
+		}
+		logger.Warn("falling back to Go xz decoder", "backend", backend, "err", err)
+	case Go:
+	default:
+		return nil, fmt.Errorf("xz: unknown backend %v", b)
+	}
+	xr, err := xz.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	return readAhead(io.NopCloser(xr)), nil
+}
+
+// commandReader decompresses with the xz command, which runs
+// concurrently in its own process.
+type commandReader struct {
+	cmd    *exec.Cmd
+	stdout io.ReadCloser
+	stderr bytes.Buffer
+	err    error
+	exited bool
+}
+
+func newCommandReader(r io.Reader, threads int) (*commandReader, error) {
+	cmd := exec.Command("xz", "--decompress", "--stdout", "--threads="+strconv.Itoa(threads))
+	cr := &commandReader{cmd: cmd}
+	cmd.Stdin = r
+	cmd.Stderr = &cr.stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	cr.stdout = stdout
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	return cr, nil
+}
+
+func (cr *commandReader) Read(p []byte) (int, error) {
+	if cr.err != nil {
+		return 0, cr.err
+	}
+	n, err := cr.stdout.Read(p)
+	if err == io.EOF {
+		if werr := cr.wait(); werr != nil {
+			err = werr
+		}
+	}
+	cr.err = err
+	return n, err
+}
+
+func (cr *commandReader) wait() error {
+	err := cr.cmd.Wait()
+	cr.exited = true
+	if err != nil && cr.stderr.Len() != 0 {
+		msg := strings.TrimSpace(cr.stderr.String())
+		if strings.Contains(msg, "Unexpected end of input") {
+			// Match the other backends for truncated streams
+			return fmt.Errorf("xz: %s: %w", msg, io.ErrUnexpectedEOF)
+		}
+		return fmt.Errorf("xz: %s", msg)
+	}
+	return err
+}
+
+// Close stops the command, when it has not finished.
+func (cr *commandReader) Close() error {
+	if !cr.exited {
+		cr.cmd.Process.Kill()
+		cr.wait()
+	}
+	return nil
+}
+
+const (
+	aheadChunks    = 4
+	aheadChunkSize = 256 << 10
+)
+
+// chunkPool recycles the chunks of closed readers, which would
+// otherwise be allocated for every link dump.
+var chunkPool = sync.Pool{New: func() interface{} { return new([aheadChunkSize]byte) }}
+
+// aheadReader decodes in a goroutine up to aheadChunks chunks ahead of
+// the reader.
+type aheadReader struct {
+	rc     io.ReadCloser
+	chunks chan aheadChunk
+	free   chan *[aheadChunkSize]byte
+	stop   chan struct{}
+	done   chan struct{}
+	once   sync.Once
+	chunk  *[aheadChunkSize]byte // chunk being read from
+	buf    []byte                // unread remainder of chunk
+	err    error
+}
+
+type aheadChunk struct {
+	b   *[aheadChunkSize]byte
+	n   int
+	err error
+}
+
+func readAhead(rc io.ReadCloser) io.ReadCloser {
+	a := &aheadReader{
+		rc:     rc,
+		chunks: make(chan aheadChunk, aheadChunks),
+		free:   make(chan *[aheadChunkSize]byte, aheadChunks),
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	for i := 0; i < aheadChunks; i++ {
+		a.free <- chunkPool.Get().(*[aheadChunkSize]byte)
+	}
+	go a.fill()
+	return a
+}
+
+func (a *aheadReader) fill() {
+	defer close(a.done)
+	for {
+		var b *[aheadChunkSize]byte
+		select {
+		case b = <-a.free:
+		case <-a.stop:
+			return
+		}
+		n, err := 0, error(nil)
+		for n < len(b) && err == nil {
+			var m int
+			m, err = a.rc.Read(b[n:])
+			n += m
+		}
+		select {
+		case a.chunks <- aheadChunk{b, n, err}:
+		case <-a.stop:
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (a *aheadReader) Read(p []byte) (int, error) {
+	for len(a.buf) == 0 {
+		if a.err != nil {
+			return 0, a.err
+		}
+		if a.chunk != nil {
+			a.free <- a.chunk
+		}
+		c := <-a.chunks
+		a.chunk, a.buf, a.err = c.b, c.b[:c.n], c.err
+	}
+	n := copy(p, a.buf)
+	a.buf = a.buf[n:]
+	return n, nil
+}
+
+var errClosed = errors.New("xz: read after close")
+
+// Close stops decoding and closes the decoder.
+func (a *aheadReader) Close() error {
+	var err error
+	a.once.Do(func() {
+		close(a.stop)
+		<-a.done
+		err = a.rc.Close()
+		if a.chunk != nil {
+			chunkPool.Put(a.chunk)
+		}
+		a.chunk, a.buf, a.err = nil, nil, errClosed
+		for len(a.free) != 0 {
+			chunkPool.Put(<-a.free)
+		}
+		for len(a.chunks) != 0 {
+			chunkPool.Put((<-a.chunks).b)
+		}
+	})
+	return err
+}
@@ -0,0 +1,175 @@
+// Copyright (c) 2021 Andrew Archibald
+//
+// This Source Code Form is subject to the terms of the Mozilla Public
+// License, v. 2.0. If a copy of the MPL was not distributed with this
+// file, You can obtain one at http://mozilla.org/MPL/2.0/.
+
+package xz
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os/exec"
+	"testing"
+
+	"github.com/ulikunitz/xz"
+)
+
+func linkDump(n int) []byte {
+	var b bytes.Buffer
+	for i := 0; i < n; i++ {
+		fmt.Fprintf(&b, "%06x|http://example.org/%d/page?id=%x\n", i, i*7919, i*31)
+	}
+	return b.Bytes()
+}
+
+func compress(t testing.TB, data []byte) []byte {
+	var b bytes.Buffer
+	w, err := xz.NewWriter(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+// compressBlocks compresses with the xz command into multiple blocks,
+// which can be decoded in parallel.
+func compressBlocks(t testing.TB, data []byte) []byte {
+	if _, err := exec.LookPath("xz"); err != nil {
+		t.Skip("xz not in PATH")
+	}
+	cmd := exec.Command("xz", "--compress", "--stdout", "--block-size=65536")
+	cmd.Stdin = bytes.NewReader(data)
+	out, err := cmd.Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+func backends() []Backend {
+	var bs []Backend
+	for _, b := range []Backend{Auto, Go, Command, Liblzma} {
+		if b.Available() {
+			bs = append(bs, b)
+		}
+	}
+	return bs
+}
+
+func TestNewReader(t *testing.T) {
+	data := linkDump(20000)
+	xzData := compress(t, data)
+	tests := []struct {
+		name string
+		in   func(t *testing.T) []byte
+		want []byte
+	}{
+		{"single", func(*testing.T) []byte { return xzData }, data},
+		{"concatenated", func(t *testing.T) []byte {
+			return append(append([]byte{}, xzData...), compress(t, []byte("tail\n"))...)
+		}, append(append([]byte{}, data...), "tail\n"...)},
+		{"blocks", func(t *testing.T) []byte { return compressBlocks(t, data) }, data},
+		{"empty", func(t *testing.T) []byte { return compress(t, nil) }, nil},
+	}
+	for _, b := range backends() {
+		for _, tt := range tests {
+			t.Run(b.String()+"/"+tt.name, func(t *testing.T) {
+				in := tt.in(t)
+				zr, err := b.NewReader(bytes.NewReader(in))
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer zr.Close()
+				got, err := io.ReadAll(zr)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(got, tt.want) {
+					t.Errorf("got %d bytes, want %d", len(got), len(tt.want))
+				}
+			})
+		}
+	}
+}
+
+func TestNewReaderInvalid(t *testing.T) {
+	xzData := compress(t, linkDump(10000))
+	tests := []struct {
+		name string
+		in   []byte
+	}{
+		{"truncated", xzData[:len(xzData)/2]},
+		{"corrupt", append(append(append([]byte{}, xzData[:100]...), 0xff, 0xff, 0xff), xzData[103:]...)},
+		{"garbage", []byte("not xz data at all")},
+	}
+	for _, b := range backends() {
+		for _, tt := range tests {
+			t.Run(b.String()+"/"+tt.name, func(t *testing.T) {
+				zr, err := b.NewReader(bytes.NewReader(tt.in))
+				if err != nil {
+					return
+				}
+				defer zr.Close()
+				if _, err := io.ReadAll(zr); err == nil {
+					t.Error("got no error")
+				}
+			})
+		}
+	}
+}
+
+func TestClose(t *testing.T) {
+	xzData := compress(t, linkDump(20000))
+	for _, b := range backends() {
+		zr, err := b.NewReader(bytes.NewReader(xzData))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var buf [100]byte
+		if _, err := io.ReadFull(zr, buf[:]); err != nil {
+			t.Errorf("%v: %v", b, err)
+		}
+		if err := zr.Close(); err != nil {
+			t.Errorf("%v: close: %v", b, err)
+		}
+	}
+}
+
+func TestParseBackend(t *testing.T) {
+	for _, b := range []Backend{Auto, Go, Command, Liblzma} {
+		if got, err := ParseBackend(b.String()); err != nil || got != b {
+			t.Errorf("ParseBackend(%q) = %v, %v", b.String(), got, err)
+		}
+	}
+	if _, err := ParseBackend("lzma"); err == nil {
+		t.Error("ParseBackend(\"lzma\") succeeded")
+	}
+}
+
+func BenchmarkNewReader(b *testing.B) {
+	data := linkDump(1000000)
+	xzData := compress(b, data)
+	for _, backend := range backends() {
+		b.Run(backend.String(), func(b *testing.B) {
+			b.SetBytes(int64(len(data)))
+			for i := 0; i < b.N; i++ {
+				zr, err := backend.NewReader(bytes.NewReader(xzData))
+				if err != nil {
+					b.Fatal(err)
+				}
+				if _, err := io.Copy(io.Discard, zr); err != nil {
+					b.Fatal(err)
+				}
+				zr.Close()
+			}
+		})
+	}
+}